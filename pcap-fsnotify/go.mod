@@ -3,10 +3,12 @@ module github.com/gchux/cloud-run-tcpdump/pcap-fsnotify
 go 1.22.4
 
 require (
+	filippo.io/age v1.2.1
 	github.com/alphadose/haxmap v1.4.0
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/gofrs/flock v0.12.1
 	go.uber.org/zap v1.27.0
+	golang.org/x/crypto v0.24.0
 )
 
 require (
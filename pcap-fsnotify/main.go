@@ -17,16 +17,23 @@ package main
 import (
 	"compress/gzip"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"maps"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -39,6 +46,17 @@ import (
 	"github.com/gofrs/flock"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/azure"
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/cpubudget"
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/envelope"
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/gcp"
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/otlp"
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/pcapinfo"
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/pcapng"
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/sftp"
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/workpool"
 )
 
 type (
@@ -49,6 +67,24 @@ type (
 		Target string `json:"target,omitempty"`
 		Bytes  int64  `json:"bytes,omitempty"`
 	}
+
+	rotationEvent struct {
+		*pcapinfo.Info
+		Iface     string `json:"iface"`
+		Extension string `json:"extension"`
+	}
+
+	// exportManifest describes how an encrypted PCAP file can be decrypted; it is written next to it.
+	exportManifest struct {
+		File       string               `json:"file"`
+		Source     string               `json:"source"`
+		Bytes      int64                `json:"bytes"`
+		Compressed bool                 `json:"compressed"`
+		Format     string               `json:"format"`
+		Key        *envelope.WrappedKey `json:"key"`
+		Tags       map[string]string    `json:"tags,omitempty"`
+		Window     string               `json:"window,omitempty"`
+	}
 )
 
 const (
@@ -61,6 +97,30 @@ const (
 	PCAP_OSWMEM pcapEvent = "PCAP_OSWMEM"
 	PCAP_SIGNAL pcapEvent = "PCAP_SIGNAL"
 	PCAP_FSLOCK pcapEvent = "PCAP_FSLOCK"
+	PCAP_TOKENS pcapEvent = "PCAP_TOKENS"
+	PCAP_METRIC pcapEvent = "PCAP_METRIC"
+	PCAP_ROTATE pcapEvent = "PCAP_ROTATE"
+	PCAP_UPLOAD pcapEvent = "PCAP_UPLOAD"
+)
+
+// exitExportFailure matches the exit code used by `tcpdumpw` for the same class of failure.
+const exitExportFailure = 8
+
+// exportedTarget describes a complete destination file, and the source PCAP file it was exported from.
+type exportedTarget struct {
+	srcBytes, tgtBytes, pcapBytes int64
+}
+
+const (
+	manifestSuffix = ".manifest.json"
+	// files are uploaded with a single request: large ones need more time
+	uploadTimeout = 5 * time.Minute
+	keyLogSuffix  = ".keylog"
+	// `tcpdumpw` may write the files of every execution into `<src_dir>/<job>/<execution>/`, along with a manifest
+	executionManifestName = "execution.json"
+	executionDirDepth     = 2
+	// uploads still pending when exiting are abandoned after this time
+	uploadDrainTimeout = 10 * time.Second
 )
 
 const (
@@ -68,6 +128,8 @@ const (
 	dockerCgroupMemoryUtilization = "/sys/fs/cgroup/memory.current"
 	procSysVmDropCaches           = "/proc/sys/vm/drop_caches"
 	pcapLockFile                  = "/var/lock/pcap.lock"
+	pcapngApplication             = "cloud-run-tcpdump"
+	errorEventType                = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
 )
 
 var (
@@ -75,10 +137,34 @@ var (
 	gcs_dir    = flag.String("gcs_dir", "/pcap", "pcaps destination directory")
 	pcap_ext   = flag.String("pcap_ext", "pcap", "pcap files extension")
 	gzip_pcaps = flag.Bool("gzip", false, "compress pcap files")
+	gzip_level = flag.Int("gzip_level", gzip.DefaultCompression, "compression level of PCAP files, from 1 ( fastest ) to 9 ( smallest ); -1 uses the default level")
+	cpu_budget = flag.Int("cpu_budget", 0, "max percentage of a CPU used to compress, convert and encrypt PCAP files while capturing; 0 disables the budget")
 	gcp_gae    = flag.Bool("gae", false, "define serverless execution environment")
-	interval   = flag.Uint("interval", 60, "seconds after which tcpdump rotates PCAP files")
+	interval   = secondsFlag("interval", 60, "seconds after which tcpdump rotates PCAP files")
 	compat     = flag.Bool("compat", false, "apply filters in Cloud Run gen1 mode")
 	rt_env     = flag.String("rt_env", "cloud_run_gen2", "runtime where PCAP sidecar is used")
+	to_pcapng  = flag.Bool("pcapng", false, "convert PCAP files to PCAPNG including revision and instance as comments")
+	imperso_sa = flag.String("impersonate_sa", "", "service account to be impersonated when exporting PCAP files")
+	token_addr = flag.String("token_server", "", "local address to serve tokens for 'impersonate_sa'; i/e: '127.0.0.1:12346'")
+	token_file = flag.String("token_secret", "", "file holding the per-boot secret which must prefix the path of token requests")
+	metrics    = flag.Bool("metrics", false, "push PCAP files export metrics into Cloud Monitoring")
+	metrics_to = secondsFlag("metrics_interval", 60, "seconds between pushes of PCAP files export metrics")
+	err_report = flag.Bool("error_reporting", true, "format ERROR and FATAL log entries to be collected by Error Reporting")
+	otlp_url   = flag.String("otlp_endpoint", "", "OTLP/HTTP endpoint to export traces to; i/e: 'http://127.0.0.1:4318'")
+	tls_keylog = flag.String("tls_keylog", "", "path of the SSLKEYLOGFILE written by the APP; it is embedded into PCAPNG files or exported alongside PCAP files")
+	enc_key    = flag.String("encrypt_key", "", "Cloud KMS key or 'age' recipient used to wrap the keys which encrypt PCAP files before exporting them; may reference a Secret Manager secret as 'sm://projects/<project>/secrets/<secret>'")
+	user_tags  = flag.String("tags", "", "comma separated 'key=value' tags included in log entries, PCAPNG comments and manifests")
+	azure_url  = flag.String("azure_url", "", "URL of the Azure Blob Storage container, and optional prefix, where exported files are also uploaded; i/e: 'https://<account>.blob.core.windows.net/<container>/<prefix>'")
+	azure_sas  = flag.String("azure_sas", "", "SAS token used to upload files into 'azure_url'; may reference a Secret Manager secret as 'sm://projects/<project>/secrets/<secret>'")
+	azure_tnt  = flag.String("azure_tenant", "", "Microsoft Entra tenant of 'azure_client_id'")
+	azure_cid  = flag.String("azure_client_id", "", "client ID of the Microsoft Entra application whose federated credential trusts the default service account; used instead of 'azure_sas'")
+	sftp_url   = flag.String("sftp_url", "", "URL of the SFTP directory where exported files are also uploaded; i/e: 'sftp://<user>@<host>[:<port>]/<dir>', where '<dir>' may include '{project}', '{region}', '{service}', '{revision}', '{instance}' and '{date}'")
+	sftp_key   = flag.String("sftp_key", "", "PEM encoded private key used to authenticate into 'sftp_url'; may reference a Secret Manager secret as 'sm://projects/<project>/secrets/<secret>'")
+	sftp_host  = flag.String("sftp_host_key", "", "public key of the host of 'sftp_url', in 'authorized_keys' format; may reference a Secret Manager secret as 'sm://projects/<project>/secrets/<secret>'")
+	gcs_pool   = flag.String("gcs_queue", "workers=2,queue=64,attempts=3,backoff=5s", "workers, queue size and retries of exports into 'gcs_dir', as 'workers=<n>,queue=<n>,attempts=<n>,backoff=<duration>'; unset fields keep their default value. Rotated PCAP files wait to be queued while the queue is full")
+	azure_pool = flag.String("azure_queue", "workers=2,queue=256,attempts=5,backoff=10s", "workers, queue size and retries of uploads into 'azure_url', as in 'gcs_queue'; files are not uploaded while the queue is full")
+	sftp_pool  = flag.String("sftp_queue", "workers=1,queue=256,attempts=5,backoff=10s", "workers, queue size and retries of uploads into 'sftp_url', as in 'gcs_queue'; files are not uploaded while the queue is full")
+	secret_rfr = flag.Duration("secret_refresh", 5*time.Minute, "interval between refreshes of 'encrypt_key' when it references a Secret Manager secret; 0 disables refreshes")
 )
 
 var (
@@ -86,6 +172,7 @@ var (
 	gcpRegion  string = os.Getenv("GCP_REGION")
 	service    string = os.Getenv("APP_SERVICE")
 	version    string = os.Getenv("APP_VERSION")
+	revision   string = os.Getenv("APP_REVISION")
 	sidecar    string = os.Getenv("APP_SIDECAR")
 	instanceID string = os.Getenv("INSTANCE_ID")
 	module     string = os.Getenv("PROC_NAME")
@@ -94,6 +181,9 @@ var (
 
 var tags []string = []string{projectID, service, gcpRegion, version, instanceID}
 
+// userTags are validated by `tcpdumpw`, which receives the same ones
+var userTags = map[string]string{}
+
 var logger, _ = zap.Config{
 	Encoding:    "json",
 	Level:       zap.NewAtomicLevelAt(zapcore.DebugLevel),
@@ -109,12 +199,98 @@ var logger, _ = zap.Config{
 var sugar = logger.Sugar()
 
 var (
-	counters *haxmap.Map[string, *atomic.Uint64]
-	lastPcap *haxmap.Map[string, string]
+	counters  *haxmap.Map[string, *atomic.Uint64]
+	lastPcap  *haxmap.Map[string, string]
+	snapshots *haxmap.Map[string, int64]
+	// serializes exports into the same destination file, i/e: a snapshot and the export of the same PCAP file
+	tgtLocks *haxmap.Map[string, *sync.Mutex]
+	// destination files whose source PCAP file could not be deleted yet, so that exporting it again only deletes it
+	exportedTargets *haxmap.Map[string, *exportedTarget]
+	// window ID of every PCAP file which was created while `tcpdumpw` was executing within a window
+	fileWindows *haxmap.Map[string, string]
 )
 
+// windows holds the window ID of the current execution of every `tcpdumpw` job, keyed by job name; see `TCPDUMPW_WINDOW`
+var windows atomic.Pointer[map[string]string]
+
 var isActive atomic.Bool
 
+var exportedFiles, exportedBytes, failedExports atomic.Uint64
+
+// exportedSignalName is the file written into `src_dir` once the last PCAP files were exported, so that `tcpdumpw`
+// waits for them and reflects failures in its own exit code.
+const exportedSignalName = "PCAPFSN_EXPORTED"
+
+type exportResult struct {
+	Files    uint64 `json:"files"`
+	Bytes    uint64 `json:"bytes"`
+	Failures uint64 `json:"failures"`
+}
+
+var exportMetrics *gcp.ExportMetrics = nil
+
+type (
+	// uploader writes exported files into destinations other than `gcs_dir`.
+	uploader interface {
+		Upload(ctx context.Context, name string, body io.Reader, size int64) error
+		String() string
+	}
+
+	// uploadDestination uploads files through its own pool, so that a slow destination only delays itself.
+	uploadDestination struct {
+		uploader
+		name                      string
+		pool                      *workpool.Pool
+		uploaded, failed, dropped atomic.Uint64
+	}
+)
+
+// uploadDestinations are empty when exported files are only available in `gcs_dir`
+var uploadDestinations []*uploadDestination = nil
+
+// exportPool exports rotated PCAP files into `gcs_dir`
+var exportPool *workpool.Pool = nil
+
+// tracer is `nil` when OTLP is disabled; recording spans into a `nil` tracer is a no-op
+var tracer *otlp.Exporter = nil
+
+// encrypter is `nil` when PCAP files are exported as plaintext
+var encrypter atomic.Pointer[envelope.Encrypter]
+
+// exportBudget is `nil` when exporting PCAP files may use as much CPU as needed
+var exportBudget *cpubudget.Budget = nil
+
+// secondsValue is a flag which holds an amount of seconds; it accepts both integers and duration strings like `90s` or `5m`.
+type secondsValue uint
+
+func (v *secondsValue) String() string {
+	return strconv.FormatUint(uint64(*v), 10)
+}
+
+func (v *secondsValue) Set(value string) error {
+	if seconds, err := strconv.ParseUint(value, 10, strconv.IntSize); err == nil {
+		*v = secondsValue(seconds)
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return fmt.Errorf("neither seconds nor duration: %s", value)
+	}
+	if d%time.Second != 0 {
+		return fmt.Errorf("not a whole amount of seconds: %s", value)
+	}
+	*v = secondsValue(d / time.Second)
+	return nil
+}
+
+// secondsFlag defines a flag which may be set using either an integer amount of seconds or a duration string;
+// the pointer it returns always holds seconds.
+func secondsFlag(name string, value uint, usage string) *uint {
+	seconds := value
+	flag.Var((*secondsValue)(&seconds), name, usage)
+	return &seconds
+}
+
 func logEvent(level zapcore.Level, message string, event pcapEvent, data map[string]interface{}, err error) {
 	now := time.Now()
 	_data := map[string]interface{}{
@@ -126,8 +302,49 @@ func logEvent(level zapcore.Level, message string, event pcapEvent, data map[str
 	if len(data) > 0 {
 		maps.Copy(_data, data)
 	}
-	sugar.Logw(level, message, "sidecar", sidecar, "module", module, "tags", tags, "data", _data,
-		"timestamp", map[string]interface{}{"seconds": now.Unix(), "nanos": now.Nanosecond()})
+	fields := []interface{}{
+		"sidecar", sidecar, "module", module, "tags", tags, "data", _data,
+		"timestamp",
+		map[string]interface{}{"seconds": now.Unix(), "nanos": now.Nanosecond()},
+	}
+	if *err_report && level >= zapcore.ErrorLevel {
+		fields = append(fields, errorEventFields(message)...)
+	}
+	sugar.Logw(level, message, fields...)
+}
+
+// errorEventFields allows Error Reporting to collect and group errors;
+// see: https://cloud.google.com/error-reporting/docs/formatting-error-messages
+func errorEventFields(message string) []interface{} {
+	serviceContext := map[string]string{"service": module, "version": revision}
+	if module == "" {
+		serviceContext["service"] = "pcapfsn"
+	}
+
+	reportLocation := map[string]interface{}{}
+	pcs := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "main.logEvent" && frame.Function != "main.logFsEvent" {
+			reportLocation["filePath"] = filepath.Base(frame.File)
+			reportLocation["lineNumber"] = frame.Line
+			reportLocation["functionName"] = frame.Function
+			break
+		}
+		if !more {
+			break
+		}
+	}
+
+	return []interface{}{
+		"@type", errorEventType,
+		"serviceContext", serviceContext,
+		"context",
+		map[string]interface{}{"reportLocation": reportLocation},
+		// Error Reporting groups errors by their stack trace, which must start with the error message
+		"stack_trace", fmt.Sprintf("%s\n\n%s", message, debug.Stack()),
+	}
 }
 
 func logFsEvent(level zapcore.Level, message string, event pcapEvent, src, tgt string, by int64, err error) {
@@ -141,14 +358,214 @@ func logFsEvent(level zapcore.Level, message string, event pcapEvent, src, tgt s
 	logEvent(level, message, event, data, err)
 }
 
-func movePcapToGcs(srcPcap *string, dstDir *string, compress, delete bool) (*string, *int64, error) {
+// logRotation describes a PCAP file which will not be written anymore,
+// so that automation can pick up individual files as soon as they are rotated.
+func logRotation(srcFile, iface, ext string) {
+	info, err := pcapinfo.Inspect(srcFile)
+	if err != nil {
+		logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to inspect rotated PCAP file: (%s/%s) %s", ext, iface, srcFile), PCAP_ROTATE, srcFile, "" /* target PCAP file */, 0, err)
+		return
+	}
+	data := map[string]interface{}{
+		"rotation": &rotationEvent{Info: info, Iface: iface, Extension: ext},
+	}
+	if info.Packets == 0 {
+		// the engine kept running while nothing was written: the file may reveal a silent capture failure
+		logEvent(zapcore.WarnLevel, fmt.Sprintf("rotated PCAP file contains no packets: (%s/%s) %s | bytes: %d", ext, iface, srcFile, info.Bytes), PCAP_ROTATE, data, nil)
+		return
+	}
+	logEvent(zapcore.InfoLevel, fmt.Sprintf("rotated PCAP file: (%s/%s) %s | bytes: %d | packets: %d", ext, iface, srcFile, info.Bytes, info.Packets), PCAP_ROTATE, data, nil)
+}
+
+func pcapngComment() string {
+	comment := fmt.Sprintf("project=%s service=%s region=%s revision=%s instance=%s", projectID, service, gcpRegion, revision, instanceID)
+	for _, tag := range tagPairs() {
+		comment += " " + tag
+	}
+	return comment
+}
+
+// parseTags adds the user defined tags to the tags of all log entries.
+func parseTags(value string) {
+	for _, pair := range strings.Split(value, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if ok && key != "" && value != "" {
+			userTags[key] = value
+		}
+	}
+	tags = append(tags, tagPairs()...)
+}
+
+// tagPairs returns the user defined tags as `key=value` sorted by key.
+func tagPairs() []string {
+	pairs := make([]string, 0, len(userTags))
+	for key, value := range userTags {
+		pairs = append(pairs, key+"="+value)
+	}
+	slices.Sort(pairs)
+	return pairs
+}
+
+// readWindows loads the window ID of the current execution of every `tcpdumpw` job from `signalFile`.
+func readWindows(signalFile string) {
+	content, err := os.ReadFile(signalFile)
+	if err != nil {
+		logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to read windows: %s", signalFile), PCAP_FSNERR, nil, err)
+		return
+	}
+	current := map[string]string{}
+	if err := json.Unmarshal(content, &current); err != nil {
+		logEvent(zapcore.ErrorLevel, fmt.Sprintf("invalid windows: %s", signalFile), PCAP_FSNERR, nil, err)
+		return
+	}
+	windows.Store(&current)
+}
+
+// fileWindow returns the window ID of the job which writes `srcFile`, in the compact form used in file names,
+// i/e: `20240501T0300Z`; job names are included in file names as `__<name>_`, or not at all for the default job.
+func fileWindow(pcapDotExt *regexp.Regexp, srcFile string) string {
+	current := windows.Load()
+	if current == nil {
+		return ""
+	}
+	rMatch := pcapDotExt.FindStringSubmatch(srcFile)
+	if len(rMatch) < 3 {
+		return ""
+	}
+	window := (*current)[""]
+	for name, id := range *current {
+		if name != "" && (strings.Contains(rMatch[2], "__"+name+"_") || strings.HasSuffix(rMatch[2], "__"+name)) {
+			window = id
+			break
+		}
+	}
+	return strings.NewReplacer("-", "", ":", "").Replace(window)
+}
+
+func copyPcap(dst io.Writer, src io.Reader, convert bool, tlsKeyLog []byte) (int64, error) {
+	if convert {
+		return pcapng.FromPcap(dst, src, pcapngComment(), pcapngApplication, tlsKeyLog)
+	}
+	return io.Copy(dst, src)
+}
+
+// serveTokens allows `gcsfuse` to export PCAP files using the identity of `impersonate_sa`
+// instead of the identity of the revision; it blocks until a termination signal is received.
+//
+// The loopback address is shared by all containers of the instance, so tokens are only served at
+// `/<secret>/token`, where `secret` is generated at boot and only readable from within the sidecar.
+func serveTokens(address, secretFile, serviceAccount *string) int {
+	tokenSource := gcp.NewImpersonatedTokenSource(*serviceAccount)
+
+	args := map[string]interface{}{
+		"address":        *address,
+		"serviceAccount": tokenSource.Target(),
+	}
+
+	secret, err := readTokenSecret(*secretFile)
+	if err != nil {
+		logEvent(zapcore.FatalLevel, fmt.Sprintf("failed to read tokens secret: %v", err), PCAP_TOKENS, args, err)
+		return 1
+	}
+
+	// fail fast if the revision identity is not allowed to impersonate `impersonate_sa`
+	if _, err := tokenSource.Token(context.Background()); err != nil {
+		logEvent(zapcore.FatalLevel, fmt.Sprintf("failed to impersonate '%s': %v", *serviceAccount, err), PCAP_TOKENS, args, err)
+		return 1
+	}
+
+	tokenPath := "/" + secret + "/token"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.URL.Path), []byte(tokenPath)) != 1 {
+			http.NotFound(w, r)
+			return
+		}
+		tokenSource.ServeHTTP(w, r)
+	})
+	server := &http.Server{Addr: *address, Handler: handler}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+	go func() {
+		<-sigChan
+		server.Shutdown(context.Background())
+	}()
+
+	logEvent(zapcore.InfoLevel, fmt.Sprintf("serving tokens for '%s' at: %s", *serviceAccount, *address), PCAP_TOKENS, args, nil)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logEvent(zapcore.FatalLevel, fmt.Sprintf("failed to serve tokens: %v", err), PCAP_TOKENS, args, err)
+		return 1
+	}
+	return 0
+}
+
+// minTokenSecretLength prevents serving tokens behind a secret which is trivial to guess.
+const minTokenSecretLength = 32
+
+func readTokenSecret(secretFile string) (string, error) {
+	if secretFile == "" {
+		return "", errors.New("'token_secret' is required to serve tokens")
+	}
+	content, err := os.ReadFile(secretFile)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(content))
+	if len(secret) < minTokenSecretLength || strings.ContainsAny(secret, "/?#%") {
+		return "", fmt.Errorf("%s must hold at least %d URL path safe characters", secretFile, minTokenSecretLength)
+	}
+	return secret, nil
+}
+
+// movePcapToGcs exports `srcPcap` into `dstDir`; failures are not accounted for if the export is going to be retried.
+func movePcapToGcs(srcPcap *string, dstDir *string, compress, delete, retry bool) (*string, *int64, error) {
+	exportStartTS := time.Now()
+	tgtPcap, pcapBytes, err := exportPcapToGcs(srcPcap, dstDir, compress, delete)
+	if err == nil {
+		exportedFiles.Add(1)
+		exportedBytes.Add(uint64(*pcapBytes))
+	} else if !retry {
+		failedExports.Add(1)
+	}
+	if exportMetrics != nil {
+		exportMetrics.Observe(*pcapBytes, time.Since(exportStartTS), err)
+	}
+	tracer.RecordSpan("pcap.export", exportStartTS, time.Now(), map[string]string{
+		"pcap.source":   *srcPcap,
+		"pcap.target":   *tgtPcap,
+		"pcap.bytes":    strconv.FormatInt(*pcapBytes, 10),
+		"pcap.compress": strconv.FormatBool(compress),
+		"pcap.encrypt":  strconv.FormatBool(encrypter.Load() != nil),
+		"pcap.delete":   strconv.FormatBool(delete),
+	}, err)
+	return tgtPcap, pcapBytes, err
+}
+
+func exportPcapToGcs(srcPcap *string, dstDir *string, compress, delete bool) (*string, *int64, error) {
 	// Define name of destination PCAP file, prefixed by its ordinal and destination directory
 	pcapName := filepath.Base(*srcPcap)
-	tgtPcap := filepath.Join(*dstDir, pcapName)
+	// files of the same window are grouped together regardless of the instance which captured them
+	if window, ok := fileWindows.Get(*srcPcap); ok {
+		pcapName = fmt.Sprintf("%s__%s", window, pcapName)
+	}
+	// only files written by `tcpdump` can be converted into PCAPNG
+	convert := *to_pcapng && strings.HasSuffix(pcapName, ".pcap")
+	if convert {
+		pcapName = fmt.Sprintf("%sng", pcapName)
+	}
+	tgtPcap := filepath.Join(exportDir(*srcPcap, *dstDir), pcapName)
+	// TLS secrets are exported alongside the packets they allow to decrypt
+	tlsKeyLog := readTLSKeyLog(srcPcap)
 	// If compressing PCAP files is enabled, add `gz` siffux to the destination PCAP file path
 	if compress {
 		tgtPcap = fmt.Sprintf("%s.gz", tgtPcap)
 	}
+	// PCAP files are compressed before being encrypted, as ciphertext is not compressible; the key may be rotated meanwhile
+	enc := encrypter.Load()
+	if enc != nil {
+		tgtPcap = fmt.Sprintf("%s.%s", tgtPcap, envelope.Extension)
+	}
 
 	var (
 		err                   error
@@ -156,6 +573,23 @@ func movePcapToGcs(srcPcap *string, dstDir *string, compress, delete bool) (*str
 		pcapBytes             int64 = 0
 	)
 
+	tgtLock, _ := tgtLocks.GetOrSet(tgtPcap, &sync.Mutex{})
+	tgtLock.Lock()
+	defer func() {
+		if delete {
+			// the source PCAP file is gone: its destination file will not be written again
+			tgtLocks.Del(tgtPcap)
+		}
+		tgtLock.Unlock()
+	}()
+
+	if exported, isExported := exportedTargets.Get(tgtPcap); isExported && delete && exported.matches(*srcPcap, tgtPcap) {
+		// a previous export copied it completely but failed to delete it: copying it again would fail as it exists
+		pcapBytes = exported.pcapBytes
+		logFsEvent(zapcore.InfoLevel, fmt.Sprintf("already COPIED: %s", *srcPcap), PCAP_EXPORT, *srcPcap, tgtPcap, pcapBytes, nil)
+		return &tgtPcap, &pcapBytes, deleteSourcePcap(srcPcap, &tgtPcap, pcapBytes)
+	}
+
 	// Open source PCAP file: the one thas is being moved to the destination directory
 	inputPcap, err = os.OpenFile(*srcPcap, os.O_RDONLY|os.O_EXCL, 0)
 	if err != nil {
@@ -165,45 +599,238 @@ func movePcapToGcs(srcPcap *string, dstDir *string, compress, delete bool) (*str
 	// logFsEvent(zapcore.InfoLevel, fmt.Sprintf("OPENED: %s", *srcPcap), PCAP_EXPORT, *srcPcap, tgtPcap, 0)
 
 	// Create destination PCAP file ( export to the GCS Bucket )
-	outputPcap, err = os.OpenFile(tgtPcap, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+	outputFlags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if _, isSnapshot := snapshots.GetAndDel(tgtPcap); isSnapshot {
+		// a partial copy of this PCAP file was flushed before: replace it with the complete one
+		outputFlags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	if !delete {
+		// snapshots are partial copies: the destination file is reserved before copying, so that the export
+		// of the complete PCAP file, or a later snapshot, replaces it instead of failing because it exists
+		outputFlags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+		snapshots.Set(tgtPcap, 0)
+	}
+	outputPcap, err = os.OpenFile(tgtPcap, outputFlags, 0o666)
 	if err != nil {
 		logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to CREATE file: %s", tgtPcap), PCAP_EXPORT, *srcPcap, tgtPcap, 0, err)
 		return &tgtPcap, &pcapBytes, fmt.Errorf("failed to create destination pcap: %s", tgtPcap)
 	}
 	// logFsEvent(zapcore.InfoLevel, fmt.Sprintf("CREATED: %s", tgtPcap), PCAP_EXPORT, *srcPcap, tgtPcap, 0)
 
+	var output io.Writer = outputPcap
+	var encryptedPcap io.WriteCloser = nil
+	var wrappedKey *envelope.WrappedKey = nil
+	if enc != nil {
+		// plaintext packet data must never be written into the destination directory
+		encryptedPcap, wrappedKey, err = enc.Encrypt(context.Background(), outputPcap)
+		if err != nil {
+			inputPcap.Close()
+			outputPcap.Close()
+			os.Remove(tgtPcap)
+			snapshots.Del(tgtPcap)
+			logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to ENCRYPT file: %s", *srcPcap), PCAP_EXPORT, *srcPcap, tgtPcap, 0, err)
+			return &tgtPcap, &pcapBytes, fmt.Errorf("failed to encrypt '%s': %w", *srcPcap, err)
+		}
+		output = encryptedPcap
+	}
+
 	// Copy source PCAP into destination PCAP, compressing destination PCAP is optional
+	input := exportBudget.Reader(inputPcap)
 	if compress {
-		gzipPcap := gzip.NewWriter(outputPcap)
-		pcapBytes, err = io.Copy(gzipPcap, inputPcap)
+		// the level was validated at startup
+		gzipPcap, _ := gzip.NewWriterLevel(output, *gzip_level)
+		pcapBytes, err = copyPcap(gzipPcap, input, convert, tlsKeyLog)
 		gzipPcap.Flush()
 		gzipPcap.Close() // this is still required; `Close()` on parent `Writer` does not trigger `Close()` at `gzip`
 	} else {
-		pcapBytes, err = io.Copy(outputPcap, inputPcap)
+		pcapBytes, err = copyPcap(output, input, convert, tlsKeyLog)
+	}
+
+	if encryptedPcap != nil {
+		// the last chunk of ciphertext is only written when closing
+		if closeErr := encryptedPcap.Close(); err == nil {
+			err = closeErr
+		}
 	}
 
+	srcBytes := int64(-1)
+	if srcInfo, statErr := inputPcap.Stat(); statErr == nil {
+		srcBytes = srcInfo.Size()
+	}
 	inputPcap.Close()
 	outputPcap.Close()
 
 	if err != nil {
+		// partial files must not be mistaken for complete ones, nor prevent the export from being retried
+		os.Remove(tgtPcap)
+		snapshots.Del(tgtPcap)
 		logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to COPY file: %s", *srcPcap), PCAP_EXPORT, *srcPcap, tgtPcap, 0, err)
 		return &tgtPcap, &pcapBytes, fmt.Errorf("failed to copy '%s' into '%s'", *srcPcap, tgtPcap)
 	}
 	logFsEvent(zapcore.InfoLevel, fmt.Sprintf("COPIED: %s", *srcPcap), PCAP_EXPORT, *srcPcap, tgtPcap, pcapBytes, nil)
 
+	tgtFiles := []string{tgtPcap}
+	if wrappedKey != nil {
+		if err = writeManifest(srcPcap, &tgtPcap, pcapBytes, compress, wrappedKey); err != nil {
+			// encrypted PCAP files cannot be decrypted without their manifest: keep the source PCAP file
+			os.Remove(tgtPcap)
+			snapshots.Del(tgtPcap)
+			logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to write manifest: %s", tgtPcap), PCAP_EXPORT, *srcPcap, tgtPcap, pcapBytes, err)
+			return &tgtPcap, &pcapBytes, fmt.Errorf("failed to write manifest for '%s': %w", tgtPcap, err)
+		}
+		tgtFiles = append(tgtFiles, tgtPcap+manifestSuffix)
+	}
+
+	if !convert && len(tlsKeyLog) > 0 {
+		// PCAP files cannot carry decryption secrets: the PCAP file is still usable without them
+		tgtFiles = append(tgtFiles, exportTLSKeyLog(srcPcap, &tgtPcap, tlsKeyLog, enc)...)
+	}
+
+	uploadExportedFiles(*srcPcap, tgtFiles...)
+
 	if delete {
-		// remove the source PCAP file if copying is sucessful
-		err = os.Remove(*srcPcap)
-		if err != nil {
-			logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to DELETE file: %s", *srcPcap), PCAP_EXPORT, *srcPcap, tgtPcap, pcapBytes, err)
-		} else {
-			logFsEvent(zapcore.InfoLevel, fmt.Sprintf("DELETED: %s", *srcPcap), PCAP_EXPORT, *srcPcap, tgtPcap, pcapBytes, nil)
+		if tgtInfo, statErr := os.Stat(tgtPcap); statErr == nil && srcBytes >= 0 {
+			exportedTargets.Set(tgtPcap, &exportedTarget{srcBytes: srcBytes, tgtBytes: tgtInfo.Size(), pcapBytes: pcapBytes})
 		}
+		// exports are retried if the source PCAP file could not be deleted
+		return &tgtPcap, &pcapBytes, deleteSourcePcap(srcPcap, &tgtPcap, pcapBytes)
 	}
 
 	return &tgtPcap, &pcapBytes, nil
 }
 
+// writeExportResult writes `result` into `src_dir`; it is renamed into place so that it is never read partially.
+func writeExportResult(result *exportResult) error {
+	content, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	signal := filepath.Join(*src_dir, exportedSignalName)
+	tmpSignal := filepath.Join(*src_dir, "."+exportedSignalName)
+	if err := os.WriteFile(tmpSignal, content, 0o666); err != nil {
+		return err
+	}
+	return os.Rename(tmpSignal, signal)
+}
+
+// deleteSourcePcap removes `srcPcap` once it was completely exported into `tgtPcap`.
+func deleteSourcePcap(srcPcap, tgtPcap *string, pcapBytes int64) error {
+	err := os.Remove(*srcPcap)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// it is kept in `exportedTargets`: exporting it again only retries deleting it
+		logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to DELETE file: %s", *srcPcap), PCAP_EXPORT, *srcPcap, *tgtPcap, pcapBytes, err)
+		return fmt.Errorf("failed to delete '%s': %w", *srcPcap, err)
+	}
+	exportedTargets.Del(*tgtPcap)
+	fileWindows.Del(*srcPcap)
+	logFsEvent(zapcore.InfoLevel, fmt.Sprintf("DELETED: %s", *srcPcap), PCAP_EXPORT, *srcPcap, *tgtPcap, pcapBytes, nil)
+	removeExecutionDir(*srcPcap)
+	return nil
+}
+
+// matches reports whether neither `srcPcap` nor `tgtPcap` changed since `tgtPcap` was completely exported from `srcPcap`.
+func (t *exportedTarget) matches(srcPcap, tgtPcap string) bool {
+	srcInfo, srcErr := os.Stat(srcPcap)
+	tgtInfo, tgtErr := os.Stat(tgtPcap)
+	return srcErr == nil && tgtErr == nil && srcInfo.Size() == t.srcBytes && tgtInfo.Size() == t.tgtBytes
+}
+
+// readTLSKeyLog returns the current content of `tls_keylog`; it is `nil` if TLS secrets are not exported.
+func readTLSKeyLog(srcPcap *string) []byte {
+	if *tls_keylog == "" {
+		return nil
+	}
+	tlsKeyLog, err := os.ReadFile(*tls_keylog)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// the APP may not have established any TLS session yet
+		logFsEvent(zapcore.WarnLevel, fmt.Sprintf("failed to READ TLS key log: %s", *tls_keylog), PCAP_EXPORT, *srcPcap, *tls_keylog, 0, err)
+	}
+	return tlsKeyLog
+}
+
+// exportTLSKeyLog writes `tlsKeyLog` into `<tgtPcap>.keylog`; it is encrypted with its own key if PCAP files are encrypted.
+// It returns the files which were written, if any.
+func exportTLSKeyLog(srcPcap, tgtPcap *string, tlsKeyLog []byte, enc *envelope.Encrypter) []string {
+	tgtKeyLog := strings.TrimSuffix(*tgtPcap, "."+envelope.Extension) + keyLogSuffix
+	if enc != nil {
+		tgtKeyLog = fmt.Sprintf("%s.%s", tgtKeyLog, envelope.Extension)
+	}
+
+	err := func() error {
+		output, err := os.OpenFile(tgtKeyLog, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+
+		if enc == nil {
+			_, err = output.Write(tlsKeyLog)
+			return err
+		}
+
+		encryptedKeyLog, wrappedKey, err := enc.Encrypt(context.Background(), output)
+		if err != nil {
+			return err
+		}
+		if _, err = encryptedKeyLog.Write(tlsKeyLog); err != nil {
+			encryptedKeyLog.Close()
+			return err
+		}
+		if err = encryptedKeyLog.Close(); err != nil {
+			return err
+		}
+		return writeManifest(tls_keylog, &tgtKeyLog, int64(len(tlsKeyLog)), false /* compress */, wrappedKey)
+	}()
+	if err != nil {
+		os.Remove(tgtKeyLog)
+		logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to EXPORT TLS key log: %s", tgtKeyLog), PCAP_EXPORT, *srcPcap, tgtKeyLog, 0, err)
+		return nil
+	}
+	logFsEvent(zapcore.InfoLevel, fmt.Sprintf("EXPORTED TLS key log: %s", tgtKeyLog), PCAP_EXPORT, *srcPcap, tgtKeyLog, int64(len(tlsKeyLog)), nil)
+	if enc != nil {
+		return []string{tgtKeyLog, tgtKeyLog + manifestSuffix}
+	}
+	return []string{tgtKeyLog}
+}
+
+// writeManifest writes the key required to decrypt `tgtPcap` into `<tgtPcap>.manifest.json`.
+func writeManifest(srcPcap, tgtPcap *string, pcapBytes int64, compress bool, wrappedKey *envelope.WrappedKey) error {
+	window, _ := fileWindows.Get(*srcPcap)
+	manifest, err := json.MarshalIndent(&exportManifest{
+		File:       filepath.Base(*tgtPcap),
+		Source:     filepath.Base(*srcPcap),
+		Bytes:      pcapBytes,
+		Compressed: compress,
+		Format:     envelope.Format,
+		Key:        wrappedKey,
+		Tags:       userTags,
+		Window:     window,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*tgtPcap+manifestSuffix, manifest, 0o666)
+}
+
+func pushExportMetrics(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pushCtx, pushCancel := context.WithTimeout(ctx, interval)
+		if err := exportMetrics.Push(pushCtx); err != nil {
+			logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to push export metrics: %v", err), PCAP_METRIC, nil, err)
+		}
+		pushCancel()
+	}
+}
+
 func getCurrentMemoryUtilization(isGAE bool) (uint64, error) {
 	var err error
 	var memoryUtilizationFilePath string
@@ -245,16 +872,18 @@ func flushBuffers() (int, error) {
 	return fmt.Fprintln(fd, "3")
 }
 
-func exportPcapFile(wg *sync.WaitGroup, pcapDotExt *regexp.Regexp, srcFile *string, compress, delete, flush bool) bool {
+// exportPcapFile queues the export of the PCAP file which was rotated when `srcFile` was created, or of `srcFile` itself
+// if it is being flushed; exports are done by `exportPool`, which reports their outcome, and `wg` waits for them.
+func exportPcapFile(wg *sync.WaitGroup, pcapDotExt *regexp.Regexp, srcFile *string, compress, delete, flush bool) {
 	defer wg.Done()
 
 	if flush && isActive.Load() {
-		return false
+		return
 	}
 
 	rMatch := pcapDotExt.FindStringSubmatch(*srcFile)
 	if len(rMatch) == 0 || len(rMatch) < 3 {
-		return false
+		return
 	}
 
 	iface := fmt.Sprintf("%s:%s", rMatch[1], rMatch[2])
@@ -263,16 +892,20 @@ func exportPcapFile(wg *sync.WaitGroup, pcapDotExt *regexp.Regexp, srcFile *stri
 
 	lastPcapFileName, loaded := lastPcap.Get(key)
 
+	// files in new execution directories may be reported both by the watcher and by scanning the directory
+	if !flush && loaded && lastPcapFileName == *srcFile {
+		return
+	} else if _, err := os.Lstat(*srcFile); !flush && err != nil {
+		// already exported: reported late by the watcher
+		return
+	}
+
 	// `flushing` is the only thread-safe PCAP export operation.
 	if flush {
 		logFsEvent(zapcore.InfoLevel, fmt.Sprintf("flushing PCAP file: [%s] (%s/%s) %s", key, ext, iface, *srcFile), PCAP_EXPORT, *srcFile, "" /* target PCAP file */, 0, nil)
-		tgtPcapFileName, pcapBytes, moveErr := movePcapToGcs(srcFile, gcs_dir, compress, delete)
-		if moveErr != nil {
-			logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to flush PCAP file: (%s/%s) %s", ext, iface, *srcFile), PCAP_FSNERR, *srcFile, *tgtPcapFileName /* target PCAP file */, 0, moveErr)
-			return false
-		}
-		logFsEvent(zapcore.InfoLevel, fmt.Sprintf("flushed PCAP file: (%s/%s) %s", ext, iface, *tgtPcapFileName), PCAP_EXPORT, *srcFile, *tgtPcapFileName, *pcapBytes, nil)
-		return true
+		logRotation(*srcFile, iface, ext)
+		queuePcapExport(wg, *srcFile, fmt.Sprintf("(%s/%s/flush)", ext, iface), compress, delete)
+		return
 	}
 
 	counter, _ := counters.GetOrCompute(key,
@@ -289,25 +922,23 @@ func exportPcapFile(wg *sync.WaitGroup, pcapDotExt *regexp.Regexp, srcFile *stri
 	// into the destination directory ( `gcs_dir` ). Otherwise it will contain all PCAPs.
 	if iteration == 1 {
 		lastPcap.Set(key, *srcFile)
-		return false
+		return
 	}
 
 	if !loaded || lastPcapFileName == "" {
 		lastPcap.Set(key, *srcFile)
 		logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("PCAP file [%s] (%s/%s/%d) unavailable", key, ext, iface, iteration), PCAP_EXPORT, "" /* source PCAP File */, *srcFile /* target PCAP file */, 0, nil)
-		return false
+		return
 	}
 
+	// a new PCAP file was created: the previous one was rotated
+	logRotation(lastPcapFileName, iface, ext)
 	logFsEvent(zapcore.InfoLevel, fmt.Sprintf("exporting PCAP file: (%s/%s/%d) %s", ext, iface, iteration, *srcFile), PCAP_EXPORT, lastPcapFileName, "" /* target PCAP file */, 0, nil)
 	// move non-current PCAP file into `gcs_dir` which means that:
 	// 1. the GCS Bucket should have already been mounted
 	// 2. the directory hierarchy to store PCAP files already exists
-	tgtPcapFileName, pcapBytes, moveErr := movePcapToGcs(&lastPcapFileName, gcs_dir, compress, delete)
-	if moveErr == nil {
-		logFsEvent(zapcore.InfoLevel, fmt.Sprintf("exported PCAP file: (%s/%s/%d) %s", ext, iface, iteration, *tgtPcapFileName), PCAP_EXPORT, lastPcapFileName, *tgtPcapFileName, *pcapBytes, nil)
-	} else {
-		logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to export PCAP file: (%s/%s/%d) %s", ext, iface, iteration, lastPcapFileName), PCAP_EXPORT, lastPcapFileName, *tgtPcapFileName /* target PCAP file */, 0, moveErr)
-	}
+	// exports are queued so that watching for new PCAP files only waits while the queue is full
+	queuePcapExport(wg, lastPcapFileName, fmt.Sprintf("(%s/%s/%d)", ext, iface, iteration), compress, delete)
 
 	// current PCAP file is the next one to be moved
 	if !lastPcap.CompareAndSwap(key, lastPcapFileName, *srcFile) {
@@ -315,8 +946,296 @@ func exportPcapFile(wg *sync.WaitGroup, pcapDotExt *regexp.Regexp, srcFile *stri
 		lastPcap.Set(key, *srcFile)
 	}
 	logFsEvent(zapcore.InfoLevel, fmt.Sprintf("queued PCAP file: (%s/%s/%d) %s", ext, iface, iteration, *srcFile), PCAP_QUEUED, *srcFile, "" /* target PCAP file */, 0, nil)
+}
+
+// queuePcapExport exports `srcFile` through `exportPool`, which retries it while it fails; `wg` waits until it is done.
+func queuePcapExport(wg *sync.WaitGroup, srcFile, label string, compress, delete bool) error {
+	attempts := exportPool.Policy().Attempts
+	tgtPcapFileName, pcapBytes := "", int64(0)
+
+	wg.Add(1)
+	err := exportPool.Submit(&workpool.Task{
+		Run: func(_ context.Context, attempt int) error {
+			tgtPcap, moveBytes, moveErr := movePcapToGcs(&srcFile, gcs_dir, compress, delete, attempt < attempts /* retry */)
+			tgtPcapFileName, pcapBytes = *tgtPcap, *moveBytes
+			if moveErr != nil && attempt < attempts {
+				logFsEvent(zapcore.WarnLevel, fmt.Sprintf("failed to export PCAP file: %s %s | attempt: %d/%d", label, srcFile, attempt, attempts), PCAP_EXPORT, srcFile, tgtPcapFileName, 0, moveErr)
+			}
+			return moveErr
+		},
+		Done: func(_ int, moveErr error) {
+			defer wg.Done()
+			if moveErr == nil {
+				logFsEvent(zapcore.InfoLevel, fmt.Sprintf("exported PCAP file: %s %s", label, tgtPcapFileName), PCAP_EXPORT, srcFile, tgtPcapFileName, pcapBytes, nil)
+			} else {
+				logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to export PCAP file: %s %s", label, srcFile), PCAP_EXPORT, srcFile, tgtPcapFileName, 0, moveErr)
+			}
+		},
+	})
+	if err != nil {
+		wg.Done()
+		failedExports.Add(1)
+		logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to queue PCAP file export: %s %s", label, srcFile), PCAP_EXPORT, srcFile, "" /* target PCAP file */, 0, err)
+	}
+	return err
+}
+
+func snapshotPcapFiles(wg *sync.WaitGroup, compress bool) uint32 {
+	snapshotFiles := uint32(0)
+	flushBuffers()
+	lastPcap.ForEach(func(key, srcFile string) bool {
+		snapshotFiles += 1
+		// current PCAP files are still being written: copy them without deleting the source
+		queuePcapExport(wg, srcFile, fmt.Sprintf("[%s] (snapshot)", key), compress, false /* delete */)
+		return true
+	})
+	return snapshotFiles
+}
+
+// srcDirDepth returns how deep `dir` is within `src_dir`: 0 for `src_dir` itself, or -1 if it is not within it.
+func srcDirDepth(dir string) int {
+	rel, err := filepath.Rel(*src_dir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return -1
+	}
+	if rel == "." {
+		return 0
+	}
+	return len(strings.Split(rel, string(filepath.Separator)))
+}
+
+// exportDir returns the directory within `dstDir` where `srcFile` is exported, and creates it if needed: files in
+// execution directories keep their `<job>/<execution>/` path, so that all the files of an execution are exported together.
+func exportDir(srcFile, dstDir string) string {
+	dir := filepath.Dir(srcFile)
+	if srcDirDepth(dir) <= 0 {
+		return dstDir
+	}
+	rel, _ := filepath.Rel(*src_dir, dir)
+	tgtDir := filepath.Join(dstDir, rel)
+	// failing to create it is reported when creating the destination file
+	os.MkdirAll(tgtDir, os.ModePerm)
+	return tgtDir
+}
+
+// removeExecutionDir removes the execution directory which contained `srcFile` once all its files were exported;
+// it is kept while it is not empty.
+func removeExecutionDir(srcFile string) {
+	if dir := filepath.Dir(srcFile); srcDirDepth(dir) == executionDirDepth {
+		os.Remove(dir)
+	}
+}
+
+// isExecutionManifest reports whether `path` is the manifest written by `tcpdumpw` into an execution directory when the execution ends.
+func isExecutionManifest(path string) bool {
+	return filepath.Base(path) == executionManifestName && srcDirDepth(filepath.Dir(path)) == executionDirDepth
+}
+
+// exportExecutionManifest copies the manifest of an execution into its directory within `gcs_dir`, and removes it;
+// it describes the execution instead of packets, so it is neither compressed nor encrypted.
+func exportExecutionManifest(srcFile string) {
+	tgtFile := filepath.Join(exportDir(srcFile, *gcs_dir), executionManifestName)
+	manifest, err := os.ReadFile(srcFile)
+	if err == nil {
+		err = os.WriteFile(tgtFile, manifest, 0o666)
+	}
+	if err != nil {
+		logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to export execution manifest: %s", srcFile), PCAP_FSNERR, srcFile, tgtFile, 0, err)
+		return
+	}
+	os.Remove(srcFile)
+	removeExecutionDir(srcFile)
+	logFsEvent(zapcore.InfoLevel, fmt.Sprintf("exported execution manifest: %s", tgtFile), PCAP_EXPORT, srcFile, tgtFile, int64(len(manifest)), nil)
+	uploadExportedFiles(srcFile, tgtFile)
+}
+
+// uploadExportedFiles queues the upload of files exported into `gcs_dir` into all other destinations, with the same path relative
+// to `gcs_dir`; files which fail to be uploaded, or which do not fit into the queue of a destination, are still available in `gcs_dir`.
+func uploadExportedFiles(srcFile string, tgtFiles ...string) {
+	for _, destination := range uploadDestinations {
+		for _, tgtFile := range tgtFiles {
+			name, _ := filepath.Rel(*gcs_dir, tgtFile)
+			name = filepath.ToSlash(name)
+			if err := destination.pool.TrySubmit(newUploadTask(destination, srcFile, tgtFile, name)); err != nil {
+				destination.dropped.Add(1)
+				logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to queue UPLOAD into %s: %s | pending: %d", destination.name, name, destination.pool.Pending()), PCAP_UPLOAD, srcFile, tgtFile, 0, err)
+			}
+		}
+	}
+}
+
+// newUploadTask returns the task which uploads `tgtFile` into `destination` as `name`; it is retried as configured for `destination`.
+func newUploadTask(destination *uploadDestination, srcFile, tgtFile, name string) *workpool.Task {
+	attempts := destination.pool.Policy().Attempts
+	var size int64 = 0
+	return &workpool.Task{
+		Run: func(ctx context.Context, attempt int) error {
+			err := func() error {
+				file, err := os.Open(tgtFile)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				info, err := file.Stat()
+				if err != nil {
+					return err
+				}
+				size = info.Size()
+				ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
+				defer cancel()
+				return destination.Upload(ctx, name, file, size)
+			}()
+			// uploads abandoned when exiting are not retried
+			if err != nil && attempt < attempts && ctx.Err() == nil {
+				logFsEvent(zapcore.WarnLevel, fmt.Sprintf("failed to UPLOAD file into %s: %s | attempt: %d/%d", destination.name, name, attempt, attempts), PCAP_UPLOAD, srcFile, tgtFile, size, err)
+			}
+			return err
+		},
+		Done: func(attempt int, err error) {
+			if err != nil {
+				destination.failed.Add(1)
+				logFsEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to UPLOAD file into %s: %s | attempts: %d", destination.name, name, attempt), PCAP_UPLOAD, srcFile, tgtFile, size, err)
+				return
+			}
+			destination.uploaded.Add(1)
+			logFsEvent(zapcore.InfoLevel, fmt.Sprintf("UPLOADED file into %s: %s", destination.name, name), PCAP_UPLOAD, srcFile, tgtFile, size, nil)
+		},
+	}
+}
 
-	return moveErr == nil
+// newPool starts the pool configured by `spec`, the value of the flag `name`; fields which are not set keep their default value.
+func newPool(name string, spec *string) (*workpool.Pool, error) {
+	defaults, _ := workpool.ParsePolicy(flag.Lookup(name).DefValue, workpool.Policy{})
+	policy, err := workpool.ParsePolicy(*spec, defaults)
+	if err != nil {
+		return nil, err
+	}
+	return workpool.New(policy), nil
+}
+
+// newAzureContainer returns the container where exported files are uploaded, authorized by a SAS token or workload identity federation.
+func newAzureContainer(secretManagerClient *gcp.SecretManagerClient) (*azure.Container, error) {
+	var credential azure.Credential = nil
+	if *azure_cid != "" || *azure_tnt != "" {
+		if *azure_cid == "" || *azure_tnt == "" || *azure_sas != "" {
+			return nil, errors.New("workload identity federation requires both 'azure_tenant' and 'azure_client_id', and must not be used along with 'azure_sas'")
+		}
+		identity := gcp.NewIdentityTokenSource(azure.FederationAudience)
+		credential = azure.NewFederatedCredential(*azure_tnt, *azure_cid, identity.Token)
+	} else if *azure_sas != "" {
+		sas, err := secretManagerClient.Resolve(context.Background(), *azure_sas)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve SAS token: %w", err)
+		}
+		if credential, err = azure.NewSASCredential(sas); err != nil {
+			return nil, err
+		}
+	}
+	return azure.NewContainer(*azure_url, credential, uploadTimeout)
+}
+
+// newSFTPClient returns the client which uploads exported files into `sftp_url`; its key and the key of the host may be Secret Manager secrets,
+// and its directory may include the identity of the instance.
+func newSFTPClient(secretManagerClient *gcp.SecretManagerClient) (*sftp.Client, error) {
+	if *sftp_key == "" || *sftp_host == "" {
+		return nil, errors.New("SFTP requires both 'sftp_key' and 'sftp_host_key'")
+	}
+	privateKey, err := secretManagerClient.Resolve(context.Background(), *sftp_key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	authorizedKey, err := secretManagerClient.Resolve(context.Background(), *sftp_host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve host key: %w", err)
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key: %w", err)
+	}
+	return sftp.NewClient(*sftp_url, signer, hostKey, map[string]string{
+		"project":  projectID,
+		"region":   gcpRegion,
+		"service":  service,
+		"revision": revision,
+		"instance": instanceID,
+	}, uploadTimeout)
+}
+
+// watchDir watches `dir` if it is the directory of a job or an execution within `src_dir`; links are not followed,
+// so that files are only reported from the directory which actually contains them. It returns `false` if `dir` is not watched.
+func watchDir(watcher *fsnotify.Watcher, dir string) bool {
+	if depth := srcDirDepth(dir); depth < 1 || depth > executionDirDepth {
+		return false
+	}
+	if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+		return false
+	}
+	if err := watcher.Add(dir); err != nil {
+		logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to watch directory '%s': %v", dir, err), PCAP_FSNERR, nil, err)
+		return false
+	}
+	return true
+}
+
+// scanDir handles the files and directories in `dir` as if they were just created:
+// the ones created before `dir` was watched are never reported by the watcher.
+func scanDir(wg *sync.WaitGroup, watcher *fsnotify.Watcher, pcapDotExt *regexp.Regexp, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() && watchDir(watcher, path) {
+			scanDir(wg, watcher, pcapDotExt, path)
+		} else if entry.Type().IsRegular() && pcapDotExt.MatchString(path) {
+			exportCreatedPcapFile(wg, pcapDotExt, path)
+		} else if entry.Type().IsRegular() && isExecutionManifest(path) {
+			exportExecutionManifest(path)
+		}
+	}
+}
+
+// exportCreatedPcapFile handles the creation of `srcFile`: the previous PCAP file for the same iface is exported.
+func exportCreatedPcapFile(wg *sync.WaitGroup, pcapDotExt *regexp.Regexp, srcFile string) {
+	// files belong to the window in which they are created: `tcpdumpw` rotates them when a window begins
+	if window := fileWindow(pcapDotExt, srcFile); window != "" {
+		fileWindows.Set(srcFile, window)
+	}
+	wg.Add(1)
+	exportPcapFile(wg, pcapDotExt, &srcFile, *gzip_pcaps /* compress */, true /* delete */, false /* flush */)
+}
+
+// exportRecoveredFiles exports the PCAP files listed in `signalFile`; they were left behind by a previous
+// `tcpdumpw` which did not stop gracefully, and `tcpdumpw` already truncated them to their last complete record.
+func exportRecoveredFiles(wg *sync.WaitGroup, pcapDotExt *regexp.Regexp, signalFile string, compress bool) uint32 {
+	content, err := os.ReadFile(signalFile)
+	os.Remove(signalFile)
+	if err != nil {
+		logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to read recovered PCAP files: %s", signalFile), PCAP_FSNERR, nil, err)
+		return 0
+	}
+
+	recoveredFiles := uint32(0)
+	for _, srcFile := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if !pcapDotExt.MatchString(srcFile) {
+			continue
+		}
+		// recovered files must not be exported again when the next file for the same iface is created
+		lastPcap.ForEach(func(key, lastPcapFileName string) bool {
+			if lastPcapFileName == srcFile {
+				lastPcap.Del(key)
+			}
+			return true
+		})
+		recoveredFiles += 1
+		queuePcapExport(wg, srcFile, "(recovered)", compress, true /* delete */)
+	}
+	return recoveredFiles
 }
 
 func flushSrcDir(wg *sync.WaitGroup, pcapDotExt *regexp.Regexp, sync, compress, delete bool, validator func(fs.FileInfo) bool) uint32 {
@@ -332,6 +1251,10 @@ func flushSrcDir(wg *sync.WaitGroup, pcapDotExt *regexp.Regexp, sync, compress,
 			logEvent(zapcore.ErrorLevel, "failed to flush PCAP files", PCAP_FSNERR, nil, err)
 			return nil
 		}
+		if isExecutionManifest(path) {
+			exportExecutionManifest(path)
+			return nil
+		}
 		if validator(info) {
 			pendingPcapFiles += 1
 			wg.Add(1)
@@ -349,25 +1272,128 @@ func main() {
 
 	defer logger.Sync()
 
+	parseTags(*user_tags)
+
+	if *token_addr != "" && *imperso_sa != "" {
+		exitCode := serveTokens(token_addr, token_file, imperso_sa)
+		logger.Sync()
+		os.Exit(exitCode)
+	}
+
+	var secretManagerClient *gcp.SecretManagerClient = nil
+	kek := *enc_key
+	if gcp.IsSecretRef(kek) {
+		secretManagerClient = gcp.NewSecretManagerClient()
+		var secretErr error
+		if kek, secretErr = secretManagerClient.Resolve(context.Background(), *enc_key); secretErr != nil {
+			logEvent(zapcore.FatalLevel, fmt.Sprintf("failed to resolve encryption key: %s | %v", *enc_key, secretErr), PCAP_FSNINI, nil, secretErr)
+			logger.Sync()
+			os.Exit(1)
+		}
+	}
+
+	if kek != "" {
+		if enc, encErr := envelope.NewEncrypter(kek); encErr == nil {
+			encrypter.Store(enc)
+		} else {
+			// policies which require encryption must never be violated by exporting plaintext PCAP files
+			logEvent(zapcore.FatalLevel, fmt.Sprintf("invalid encryption key: %v", encErr), PCAP_FSNINI, nil, encErr)
+			logger.Sync()
+			os.Exit(1)
+		}
+	}
+
+	if _, levelErr := gzip.NewWriterLevel(io.Discard, *gzip_level); levelErr != nil {
+		logEvent(zapcore.FatalLevel, fmt.Sprintf("invalid compression level: %d | %v", *gzip_level, levelErr), PCAP_FSNINI, nil, levelErr)
+		logger.Sync()
+		os.Exit(1)
+	}
+	exportBudget = cpubudget.New(*cpu_budget)
+
+	var poolErr error
+	if exportPool, poolErr = newPool("gcs_queue", gcs_pool); poolErr != nil {
+		logEvent(zapcore.FatalLevel, fmt.Sprintf("invalid 'gcs_queue': %q | %v", *gcs_pool, poolErr), PCAP_FSNINI, nil, poolErr)
+		logger.Sync()
+		os.Exit(1)
+	}
+
+	if secretManagerClient == nil && (gcp.IsSecretRef(*azure_sas) || gcp.IsSecretRef(*sftp_key) || gcp.IsSecretRef(*sftp_host)) {
+		secretManagerClient = gcp.NewSecretManagerClient()
+	}
+
+	if *azure_url != "" {
+		azureContainer, azureErr := newAzureContainer(secretManagerClient)
+		if azureErr != nil {
+			logEvent(zapcore.FatalLevel, fmt.Sprintf("invalid Azure Blob Storage container: %v", azureErr), PCAP_FSNINI, nil, azureErr)
+			logger.Sync()
+			os.Exit(1)
+		}
+		azurePool, poolErr := newPool("azure_queue", azure_pool)
+		if poolErr != nil {
+			logEvent(zapcore.FatalLevel, fmt.Sprintf("invalid 'azure_queue': %q | %v", *azure_pool, poolErr), PCAP_FSNINI, nil, poolErr)
+			logger.Sync()
+			os.Exit(1)
+		}
+		uploadDestinations = append(uploadDestinations, &uploadDestination{uploader: azureContainer, name: "Azure Blob Storage", pool: azurePool})
+	}
+
+	if *sftp_url != "" {
+		sftpClient, sftpErr := newSFTPClient(secretManagerClient)
+		if sftpErr != nil {
+			logEvent(zapcore.FatalLevel, fmt.Sprintf("invalid SFTP destination: %v", sftpErr), PCAP_FSNINI, nil, sftpErr)
+			logger.Sync()
+			os.Exit(1)
+		}
+		sftpPool, poolErr := newPool("sftp_queue", sftp_pool)
+		if poolErr != nil {
+			logEvent(zapcore.FatalLevel, fmt.Sprintf("invalid 'sftp_queue': %q | %v", *sftp_pool, poolErr), PCAP_FSNINI, nil, poolErr)
+			logger.Sync()
+			os.Exit(1)
+		}
+		defer sftpClient.Close()
+		uploadDestinations = append(uploadDestinations, &uploadDestination{uploader: sftpClient, name: "SFTP", pool: sftpPool})
+	}
+
 	counters = haxmap.New[string, *atomic.Uint64]()
 	lastPcap = haxmap.New[string, string]()
+	snapshots = haxmap.New[string, int64]()
+	tgtLocks = haxmap.New[string, *sync.Mutex]()
+	exportedTargets = haxmap.New[string, *exportedTarget]()
+	fileWindows = haxmap.New[string, string]()
 
 	isGAE, isGAEerr := strconv.ParseBool(gcpGAE)
 	isGAE = (isGAEerr == nil && isGAE) || *gcp_gae
 
 	ext := strings.Join(strings.Split(*pcap_ext, ","), "|")
-	pcapDotExt := regexp.MustCompile(`^` + *src_dir + `/part__(\d+?)_(.+?)__\d{8}T\d{6}\.(` + ext + `)$`)
+	// PCAP files may be written into `<src_dir>/<job>/<execution>/`
+	pcapDotExt := regexp.MustCompile(`^` + *src_dir + `/(?:[^/]+/[^/]+/)?part__(\d+?)_(.+?)__\d{8}T\d{6}(?:\.\d{3})?(?:_\d+)?\.(` + ext + `)$`)
 	tcpdumpwExitSignal := regexp.MustCompile(`^` + *src_dir + `/TCPDUMPW_EXITED$`)
+	tcpdumpwFlushSignal := regexp.MustCompile(`^` + *src_dir + `/TCPDUMPW_FLUSH$`)
+	tcpdumpwRecoveredSignal := regexp.MustCompile(`^` + *src_dir + `/TCPDUMPW_RECOVERED$`)
+	tcpdumpwWindowSignal := regexp.MustCompile(`^` + *src_dir + `/TCPDUMPW_WINDOW$`)
 
 	// must match the value of `PCAP_ROTATE_SECS`
 	watchdogInterval := time.Duration(*interval) * time.Second
 
 	args := map[string]interface{}{
-		"src_dir":  *src_dir,
-		"gcs_dir":  *gcs_dir,
-		"pcap_ext": pcapDotExt.String(),
-		"gzip":     *gzip_pcaps,
-		"interval": watchdogInterval.String(),
+		"src_dir":    *src_dir,
+		"gcs_dir":    *gcs_dir,
+		"pcap_ext":   pcapDotExt.String(),
+		"gzip":       *gzip_pcaps,
+		"gzip_level": *gzip_level,
+		"cpu_budget": *cpu_budget,
+		"interval":   watchdogInterval.String(),
+		"queue":      exportPool.Policy().String(),
+	}
+	if enc := encrypter.Load(); enc != nil {
+		args["encrypt"] = enc.String()
+	}
+	if len(uploadDestinations) > 0 {
+		uploads := make([]string, 0, len(uploadDestinations))
+		for _, destination := range uploadDestinations {
+			uploads = append(uploads, fmt.Sprintf("%s | queue: %s", destination, destination.pool.Policy()))
+		}
+		args["uploads"] = uploads
 	}
 
 	logEvent(zapcore.InfoLevel, "starting PCAP filesystem watcher", PCAP_FSNINI, args, nil)
@@ -385,6 +1411,42 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	if *metrics && *metrics_to > 0 {
+		exportMetrics = gcp.NewExportMetrics(projectID, gcpRegion, service, revision, instanceID)
+		go pushExportMetrics(ctx, time.Duration(*metrics_to)*time.Second)
+	}
+
+	if secretManagerClient != nil && *secret_rfr > 0 {
+		go secretManagerClient.Watch(ctx, *enc_key, kek, *secret_rfr, func(rotated string, err error) {
+			if err == nil {
+				var enc *envelope.Encrypter
+				if enc, err = envelope.NewEncrypter(rotated); err == nil {
+					encrypter.Store(enc)
+					logEvent(zapcore.InfoLevel, fmt.Sprintf("rotated encryption key: %s", enc), PCAP_FSNINI, nil, nil)
+					return
+				}
+			}
+			// PCAP files keep being encrypted with the last valid key
+			logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to refresh encryption key: %s | %v", *enc_key, err), PCAP_FSNERR, nil, err)
+		})
+	}
+
+	if *otlp_url != "" {
+		tracer = otlp.NewExporter(*otlp_url, "pcap-fsnotify", map[string]string{
+			"service.name":     "pcap-fsnotify",
+			"cloud.provider":   "gcp",
+			"cloud.platform":   "gcp_cloud_run",
+			"cloud.account.id": projectID,
+			"cloud.region":     gcpRegion,
+			"faas.name":        service,
+			"faas.version":     revision,
+			"faas.instance":    instanceID,
+		}, 10*time.Second)
+		go tracer.Run(ctx, 10*time.Second, func(err error) {
+			logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to export spans: %v", err), PCAP_METRIC, nil, err)
+		})
+	}
+
 	var wg sync.WaitGroup
 
 	// Watch the PCAP files source directory for FS events.
@@ -393,6 +1455,13 @@ func main() {
 			logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to watch directory '%s': %v", *src_dir, err), PCAP_FSNERR, nil, err)
 			isActive.Store(false)
 		}
+		// new execution directories are created within the directories of jobs which already exist
+		filepath.WalkDir(*src_dir, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && entry.IsDir() && path != *src_dir && !watchDir(watcher, path) {
+				return filepath.SkipDir
+			}
+			return nil
+		})
 	}
 
 	ticker := time.NewTicker(watchdogInterval)
@@ -407,9 +1476,39 @@ func main() {
 					return
 				}
 				// Skip events which are not CREATE, and all which are not related to PCAP files
-				if event.Has(fsnotify.Create) && pcapDotExt.MatchString(event.Name) {
-					wg.Add(1)
-					exportPcapFile(wg, pcapDotExt, &event.Name, *gzip_pcaps /* compress */, true /* delete */, false /* flush */)
+				if event.Has(fsnotify.Create) && watchDir(watcher, event.Name) {
+					// `tcpdumpw` creates a directory for every job and execution when 'execution_dirs' is enabled
+					scanDir(wg, watcher, pcapDotExt, event.Name)
+				} else if event.Has(fsnotify.Create) && pcapDotExt.MatchString(event.Name) {
+					exportCreatedPcapFile(wg, pcapDotExt, event.Name)
+				} else if event.Has(fsnotify.Create) && isExecutionManifest(event.Name) {
+					exportExecutionManifest(event.Name)
+				} else if event.Has(fsnotify.Create) && tcpdumpwFlushSignal.MatchString(event.Name) {
+					// `tcpdumpw` signals that the instance is about to be terminated by creating the file `TCPDUMPW_FLUSH`
+					os.Remove(event.Name)
+					// the instance is about to be terminated: PCAP files must be exported as fast as possible
+					exportBudget.Lift()
+					snapshotFiles := snapshotPcapFiles(wg, *gzip_pcaps)
+					logEvent(zapcore.InfoLevel,
+						fmt.Sprintf("detected 'tcpdumpw' flush signal: %d PCAP files", snapshotFiles),
+						PCAP_SIGNAL,
+						map[string]interface{}{
+							"signal": event.Name,
+							"files":  snapshotFiles,
+						}, nil)
+				} else if event.Has(fsnotify.Create) && tcpdumpwWindowSignal.MatchString(event.Name) {
+					// `tcpdumpw` replaces the file `TCPDUMPW_WINDOW` every time an execution begins or ends
+					readWindows(event.Name)
+				} else if event.Has(fsnotify.Create) && tcpdumpwRecoveredSignal.MatchString(event.Name) {
+					// `tcpdumpw` lists the PCAP files left behind by a previous execution in the file `TCPDUMPW_RECOVERED`
+					recoveredFiles := exportRecoveredFiles(wg, pcapDotExt, event.Name, *gzip_pcaps)
+					logEvent(zapcore.InfoLevel,
+						fmt.Sprintf("detected 'tcpdumpw' recovery signal: %d PCAP files", recoveredFiles),
+						PCAP_SIGNAL,
+						map[string]interface{}{
+							"signal": event.Name,
+							"files":  recoveredFiles,
+						}, nil)
 				} else if event.Has(fsnotify.Create) && tcpdumpwExitSignal.MatchString(event.Name) && isActive.CompareAndSwap(true, false) {
 					// `tcpdumpw` wignals its termination by creating the file `TCPDUMPW_EXITED` is the source directory
 					tcpdumpwExitTS := time.Now()
@@ -527,6 +1626,7 @@ func main() {
 	// wait for all regular export operations to terminate
 	wg.Wait()
 
+	exportBudget.Lift()
 	flushStart := time.Now()
 	// flush remaining PCAP files after context is done
 	// compression & deletion are disabled when exiting in order to speed up the process
@@ -553,4 +1653,75 @@ func main() {
 			"files":   pendingPcapFiles,
 			"latency": flushLatency.String(),
 		}, nil)
+
+	// all exports were waited for: the pool only needs to stop its workers
+	exportPool.Close(context.Background())
+
+	// uploads were queued by exports: they are given a last chance to complete, as files are still available in `gcs_dir`
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), uploadDrainTimeout)
+	for _, destination := range uploadDestinations {
+		pendingUploads := destination.pool.Pending()
+		if err := destination.pool.Close(drainCtx); err != nil {
+			logEvent(zapcore.ErrorLevel, fmt.Sprintf("abandoned pending uploads into %s after %v", destination.name, uploadDrainTimeout), PCAP_FSNEND,
+				map[string]interface{}{"pending": pendingUploads}, err)
+		}
+	}
+	drainCancel()
+
+	logEvent(zapcore.InfoLevel,
+		fmt.Sprintf("exported %d PCAP files", exportedFiles.Load()),
+		PCAP_FSNEND,
+		map[string]interface{}{
+			"summary": map[string]interface{}{
+				"files":    exportedFiles.Load(),
+				"bytes":    exportedBytes.Load(),
+				"failures": failedExports.Load(),
+			},
+		}, nil)
+
+	for _, destination := range uploadDestinations {
+		logEvent(zapcore.InfoLevel,
+			fmt.Sprintf("uploaded %d files into %s", destination.uploaded.Load(), destination.name),
+			PCAP_FSNEND,
+			map[string]interface{}{
+				"summary": map[string]interface{}{
+					"files":    destination.uploaded.Load(),
+					"failures": destination.failed.Load(),
+					"dropped":  destination.dropped.Load(),
+				},
+			}, nil)
+	}
+
+	if err := writeExportResult(&exportResult{
+		Files:    exportedFiles.Load(),
+		Bytes:    exportedBytes.Load(),
+		Failures: failedExports.Load(),
+	}); err != nil {
+		logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to signal export result: %v", err), PCAP_FSNEND, nil, err)
+	}
+
+	// include the files flushed at exit
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := tracer.Flush(flushCtx); err != nil {
+		logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to export spans: %v", err), PCAP_METRIC, nil, err)
+	}
+
+	if exportMetrics != nil {
+		// include the files flushed at exit
+		pushCtx, pushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer pushCancel()
+		if err := exportMetrics.Push(pushCtx); err != nil {
+			logEvent(zapcore.ErrorLevel, fmt.Sprintf("failed to push export metrics: %v", err), PCAP_METRIC, nil, err)
+		}
+	}
+
+	if failures := failedExports.Load(); failures > 0 {
+		logEvent(zapcore.ErrorLevel, fmt.Sprintf("process exiting: %d PCAP files were not exported | exit code: %d", failures, exitExportFailure), PCAP_FSNEND,
+			map[string]interface{}{"exit": map[string]interface{}{"code": exitExportFailure, "class": "export_failure"}}, nil)
+		logger.Sync()
+		os.Exit(exitExportFailure)
+	}
+	logEvent(zapcore.InfoLevel, "process exiting: all PCAP files were exported | exit code: 0", PCAP_FSNEND,
+		map[string]interface{}{"exit": map[string]interface{}{"code": 0, "class": "success"}}, nil)
 }
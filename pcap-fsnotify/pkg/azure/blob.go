@@ -0,0 +1,260 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package azure uploads exported files into Azure Blob Storage containers, using either a SAS token
+// or workload identity federation of the instance default identity with Microsoft Entra ID.
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Credential authorizes requests sent to Azure Blob Storage.
+	Credential interface {
+		Authorize(ctx context.Context, req *http.Request) error
+		String() string
+	}
+
+	// SASCredential appends a shared access signature to the URL of every request.
+	SASCredential struct {
+		query url.Values
+	}
+
+	// FederatedCredential exchanges ID tokens of another identity provider for Microsoft Entra ID access tokens,
+	// i/e: the instance default identity trusted by a federated credential of an Entra application.
+	FederatedCredential struct {
+		mu        sync.Mutex
+		tenant    string
+		clientID  string
+		assertion func(ctx context.Context) (string, error)
+		client    *http.Client
+		token     string
+		expiry    time.Time
+	}
+
+	// Container is an Azure Blob Storage container where files are uploaded as block blobs, below an optional prefix.
+	Container struct {
+		url        *url.URL
+		prefix     string
+		credential Credential
+		client     *http.Client
+	}
+
+	entraToken struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+)
+
+const (
+	// FederationAudience is the audience of ID tokens trusted by Entra federated credentials.
+	FederationAudience = "api://AzureADTokenExchange"
+	// MaxBlobSize is the largest blob which may be uploaded with a single request.
+	MaxBlobSize = 5000 * 1024 * 1024
+
+	entraTokenURL      = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+	storageScope       = "https://storage.azure.com/.default"
+	clientAssertionJWT = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// OAuth requires version `2017-11-09` or later
+	storageVersion = "2021-08-06"
+	// tokens are refreshed ahead of their expiration to account for clock skew and in-flight requests
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+var errUploadFailed = errors.New("upload failed")
+
+func (c *SASCredential) Authorize(_ context.Context, req *http.Request) error {
+	query := req.URL.Query()
+	for key, values := range c.query {
+		query[key] = values
+	}
+	req.URL.RawQuery = query.Encode()
+	return nil
+}
+
+func (c *SASCredential) String() string {
+	// the signature is a secret: only describe its scope
+	return fmt.Sprintf("sas(permissions=%s,expiry=%s)", c.query.Get("sp"), c.query.Get("se"))
+}
+
+// NewSASCredential parses a SAS token, with or without the leading `?`.
+func NewSASCredential(token string) (*SASCredential, error) {
+	query, err := url.ParseQuery(strings.TrimPrefix(strings.TrimSpace(token), "?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAS token: %w", err)
+	}
+	if query.Get("sig") == "" {
+		return nil, errors.New("invalid SAS token: it has no signature ( 'sig' )")
+	}
+	return &SASCredential{query: query}, nil
+}
+
+func (c *FederatedCredential) exchange(ctx context.Context) (*entraToken, error) {
+	assertion, err := c.assertion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain client assertion: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {c.clientID},
+		"scope":                 {storageScope},
+		"client_assertion_type": {clientAssertionJWT},
+		"client_assertion":      {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf(entraTokenURL, url.PathEscape(c.tenant)), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("entra token status: %d | %s", res.StatusCode, bytes.TrimSpace(message))
+	}
+
+	token := &entraToken{}
+	if err := json.NewDecoder(res.Body).Decode(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (c *FederatedCredential) Authorize(ctx context.Context, req *http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == "" || time.Until(c.expiry) < tokenRefreshMargin {
+		token, err := c.exchange(ctx)
+		if err != nil {
+			return err
+		}
+		c.token = token.AccessToken
+		c.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return nil
+}
+
+func (c *FederatedCredential) String() string {
+	return fmt.Sprintf("federated(tenant=%s,client_id=%s)", c.tenant, c.clientID)
+}
+
+// NewFederatedCredential authenticates as the Entra application `clientID` of `tenant`,
+// using the ID tokens returned by `assertion` for `FederationAudience`.
+func NewFederatedCredential(tenant, clientID string, assertion func(ctx context.Context) (string, error)) *FederatedCredential {
+	return &FederatedCredential{
+		tenant:    tenant,
+		clientID:  clientID,
+		assertion: assertion,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Upload writes `size` bytes of `body` into the block blob `name`, relative to the prefix of the container;
+// existing blobs are replaced.
+func (c *Container) Upload(ctx context.Context, name string, body io.Reader, size int64) error {
+	if size > MaxBlobSize {
+		return fmt.Errorf("%w: %s is larger than %d bytes", errUploadFailed, name, MaxBlobSize)
+	}
+
+	blobURL := *c.url
+	blobURL.Path = path.Join(c.url.Path, c.prefix, name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, blobURL.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-version", storageVersion)
+	if err := c.credential.Authorize(ctx, req); err != nil {
+		return err
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%w: %s | blob status: %d | %s", errUploadFailed, name, res.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+func (c *Container) String() string {
+	return fmt.Sprintf("%s | credential: %s", c.url.JoinPath(c.prefix), c.credential)
+}
+
+// NewContainer parses the URL of a container and an optional prefix, i/e: `https://<account>.blob.core.windows.net/<container>/<prefix>`;
+// a SAS token included in the URL is used if `credential` is `nil`.
+func NewContainer(rawURL string, credential Credential, timeout time.Duration) (*Container, error) {
+	containerURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid container URL: %w", err)
+	}
+	if containerURL.Scheme != "https" && containerURL.Scheme != "http" {
+		return nil, fmt.Errorf("invalid container URL: %s | use 'https://<account>.blob.core.windows.net/<container>'", rawURL)
+	}
+
+	// the container is the 1st segment of the path, and the prefix all other ones
+	container, prefix, _ := strings.Cut(strings.Trim(containerURL.Path, "/"), "/")
+	if container == "" {
+		return nil, fmt.Errorf("invalid container URL: %s | it does not include a container", rawURL)
+	}
+
+	if containerURL.RawQuery != "" {
+		if credential != nil {
+			return nil, errors.New("invalid container URL: it must not include a SAS token when another credential is used")
+		}
+		if credential, err = NewSASCredential(containerURL.RawQuery); err != nil {
+			return nil, err
+		}
+	}
+	if credential == nil {
+		return nil, errors.New("no credential: use a SAS token or workload identity federation")
+	}
+
+	containerURL.Path = "/" + container
+	containerURL.RawPath = ""
+	containerURL.RawQuery = ""
+	return &Container{
+		url:        containerURL,
+		prefix:     prefix,
+		credential: credential,
+		client:     &http.Client{Timeout: timeout},
+	}, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cpubudget limits the share of CPU time used by work which is done in chunks, i/e: compressing PCAP files,
+// so that exporting them does not starve the packet capturing engines on instances with a fraction of a CPU.
+package cpubudget
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Budget allows all the work accounted into it to use up to `percent` of a single CPU, as measured by wall time:
+	// work beyond the budget is delayed. It is safe for concurrent use, and a `nil` Budget never delays any work.
+	Budget struct {
+		percent int64
+		lifted  atomic.Bool
+		mu      sync.Mutex
+		// the time when all the work spent so far fits into the budget
+		next time.Time
+	}
+
+	budgetReader struct {
+		budget *Budget
+		reader io.Reader
+		// when the previous chunk was handed out; the time until the next read is spent processing it
+		lastRead time.Time
+	}
+)
+
+const minWait = 10 * time.Millisecond
+
+// New returns a budget of `percent` of a CPU, or `nil` if it would not limit anything.
+func New(percent int) *Budget {
+	if percent <= 0 || percent >= 100 {
+		return nil
+	}
+	return &Budget{percent: int64(percent)}
+}
+
+// Spend accounts for `busy` time spent working, and blocks until the work done so far fits into the budget.
+func (b *Budget) Spend(busy time.Duration) {
+	if b == nil || b.lifted.Load() || busy <= 0 {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	// idle time is not accumulated: the budget is not a credit
+	if b.next.Before(now.Add(-busy)) {
+		b.next = now.Add(-busy)
+	}
+	b.next = b.next.Add(busy * 100 / time.Duration(b.percent))
+	wait := time.Until(b.next)
+	b.mu.Unlock()
+
+	// short waits are accumulated: sleeping is not precise enough for them
+	if wait >= minWait {
+		time.Sleep(wait)
+	}
+}
+
+// Lift stops delaying work, i/e: when pending work must complete before a deadline.
+func (b *Budget) Lift() {
+	if b != nil {
+		b.lifted.Store(true)
+	}
+}
+
+// Reader returns a reader which accounts the time spent processing every chunk read from `reader` into the budget.
+func (b *Budget) Reader(reader io.Reader) io.Reader {
+	if b == nil {
+		return reader
+	}
+	return &budgetReader{budget: b, reader: reader}
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	if !r.lastRead.IsZero() {
+		r.budget.Spend(time.Since(r.lastRead))
+	}
+	n, err := r.reader.Read(p)
+	r.lastRead = time.Now()
+	return n, err
+}
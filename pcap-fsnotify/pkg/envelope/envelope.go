@@ -0,0 +1,155 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+
+	"github.com/gchux/cloud-run-tcpdump/pcap-fsnotify/pkg/gcp"
+)
+
+type (
+	// WrappedKey is a data encryption key encrypted with a key encryption key: either a Cloud KMS key or an `age` recipient.
+	WrappedKey struct {
+		// `kms` or `age`
+		Type string `json:"type"`
+		// the version of the Cloud KMS key, or the `age` recipient
+		KEK string `json:"kek"`
+		// base64 encoded for Cloud KMS; armored `age` file for `age` recipients
+		Ciphertext string `json:"ciphertext"`
+	}
+
+	// KeyWrapper encrypts data encryption keys.
+	KeyWrapper interface {
+		Wrap(ctx context.Context, dek []byte) (*WrappedKey, error)
+		String() string
+	}
+
+	// Encrypter encrypts files using envelope encryption: every file is encrypted with its own data encryption key,
+	// which is an `age` X25519 identity, so that files can be decrypted with `age -d -i <identity>` once the
+	// identity is unwrapped with `gcloud kms decrypt` or `age -d`.
+	Encrypter struct {
+		wrapper KeyWrapper
+	}
+
+	kmsWrapper struct {
+		client *gcp.KMSClient
+	}
+
+	ageWrapper struct {
+		recipient *age.X25519Recipient
+	}
+)
+
+const (
+	KeyTypeKMS = "kms"
+	KeyTypeAge = "age"
+
+	// files are written in the `age` format: https://age-encryption.org/v1
+	Format    = "age"
+	Extension = "enc"
+
+	ageRecipientPrefix = "age1"
+)
+
+func (w *kmsWrapper) Wrap(ctx context.Context, dek []byte) (*WrappedKey, error) {
+	ciphertext, version, err := w.client.Encrypt(ctx, dek)
+	if err != nil {
+		return nil, err
+	}
+	return &WrappedKey{
+		Type:       KeyTypeKMS,
+		KEK:        version,
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}, nil
+}
+
+func (w *kmsWrapper) String() string {
+	return w.client.Key()
+}
+
+func (w *ageWrapper) Wrap(_ context.Context, dek []byte) (*WrappedKey, error) {
+	buffer := &bytes.Buffer{}
+	armored := armor.NewWriter(buffer)
+	encrypted, err := age.Encrypt(armored, w.recipient)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := encrypted.Write(dek); err != nil {
+		return nil, err
+	}
+	if err := encrypted.Close(); err != nil {
+		return nil, err
+	}
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+	return &WrappedKey{
+		Type:       KeyTypeAge,
+		KEK:        w.recipient.String(),
+		Ciphertext: buffer.String(),
+	}, nil
+}
+
+func (w *ageWrapper) String() string {
+	return w.recipient.String()
+}
+
+// Encrypt returns a writer which encrypts everything written into it before writing it into `dst`, and the wrapped key
+// required to decrypt it; the writer must be closed to flush the last chunk of ciphertext.
+func (e *Encrypter) Encrypt(ctx context.Context, dst io.Writer) (io.WriteCloser, *WrappedKey, error) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, nil, err
+	}
+	wrappedKey, err := e.wrapper.Wrap(ctx, []byte(identity.String()+"\n"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap data encryption key with %s: %w", e.wrapper, err)
+	}
+	encrypted, err := age.Encrypt(dst, identity.Recipient())
+	if err != nil {
+		return nil, nil, err
+	}
+	return encrypted, wrappedKey, nil
+}
+
+func (e *Encrypter) String() string {
+	return e.wrapper.String()
+}
+
+// NewEncrypter creates an encrypter whose data encryption keys are wrapped by `kek`, which is either
+// the resource name of a Cloud KMS key or an `age` X25519 recipient, i/e: `age1...`.
+func NewEncrypter(kek string) (*Encrypter, error) {
+	kek = strings.TrimSpace(kek)
+	if strings.HasPrefix(kek, ageRecipientPrefix) {
+		recipient, err := age.ParseX25519Recipient(kek)
+		if err != nil {
+			return nil, err
+		}
+		return &Encrypter{wrapper: &ageWrapper{recipient: recipient}}, nil
+	}
+	if gcp.IsKMSKey(kek) {
+		return &Encrypter{wrapper: &kmsWrapper{client: gcp.NewKMSClient(kek)}}, nil
+	}
+	return nil, fmt.Errorf("key encryption keys must be Cloud KMS keys or age recipients: %s", kek)
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// IdentityTokenSource fetches ID tokens of the instance default identity from the metadata server,
+// so that it can be federated with identity providers of other clouds.
+type IdentityTokenSource struct {
+	client *http.Client
+	mdsURL string
+}
+
+const metadataIdentityURL = "http://%s/computeMetadata/v1/instance/service-accounts/default/identity?audience=%s&format=full"
+
+// Token returns a new ID token for `audience`; ID tokens are valid for 1 hour.
+func (s *IdentityTokenSource) Token(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.mdsURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: metadata identity status: %d", errTokenRequestFailed, res.StatusCode)
+	}
+
+	token, err := io.ReadAll(io.LimitReader(res.Body, 16*1024))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(token)), nil
+}
+
+func NewIdentityTokenSource(audience string) *IdentityTokenSource {
+	host := os.Getenv(metadataHostEnvVar)
+	if host == "" {
+		host = metadataDefaultHost
+	}
+	return &IdentityTokenSource{
+		client: &http.Client{Timeout: 10 * time.Second},
+		mdsURL: fmt.Sprintf(metadataIdentityURL, host, url.QueryEscape(audience)),
+	}
+}
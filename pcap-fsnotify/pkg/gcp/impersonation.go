@@ -0,0 +1,206 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// Token is formatted as an `oauth2.Token` so that it can be consumed by `gcsfuse --token-url`.
+	Token struct {
+		AccessToken string    `json:"access_token"`
+		TokenType   string    `json:"token_type"`
+		Expiry      time.Time `json:"expiry"`
+		ExpiresIn   int64     `json:"expires_in"`
+	}
+
+	// ImpersonatedTokenSource mints access tokens for `target` using the instance default identity,
+	// which must be granted `roles/iam.serviceAccountTokenCreator` on `target`.
+	ImpersonatedTokenSource struct {
+		mu       sync.Mutex
+		target   string
+		scopes   []string
+		lifetime time.Duration
+		client   *http.Client
+		mdsURL   string
+		token    *Token
+	}
+
+	metadataToken struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	generateAccessTokenRequest struct {
+		Scope    []string `json:"scope"`
+		Lifetime string   `json:"lifetime"`
+	}
+
+	generateAccessTokenResponse struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+)
+
+const (
+	StorageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+	metadataHostEnvVar     = "GCE_METADATA_HOST"
+	metadataDefaultHost    = "metadata.google.internal"
+	metadataTokenURL       = "http://%s/computeMetadata/v1/instance/service-accounts/default/token"
+	generateAccessTokenURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken"
+	tokenType              = "Bearer"
+	defaultTokenLifetime   = 1 * time.Hour
+	// tokens are refreshed ahead of their expiration to account for clock skew and in-flight requests
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+var errTokenRequestFailed = errors.New("token request failed")
+
+func metadataTokenURLFromEnv() string {
+	host := os.Getenv(metadataHostEnvVar)
+	if host == "" {
+		host = metadataDefaultHost
+	}
+	return fmt.Sprintf(metadataTokenURL, host)
+}
+
+// defaultToken fetches a token for the instance default identity from the metadata server.
+func defaultToken(ctx context.Context, client *http.Client, mdsURL string) (*metadataToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mdsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: metadata status: %d", errTokenRequestFailed, res.StatusCode)
+	}
+
+	token := &metadataToken{}
+	if err := json.NewDecoder(res.Body).Decode(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *ImpersonatedTokenSource) generateToken(ctx context.Context) (*Token, error) {
+	source, err := defaultToken(ctx, s.client, s.mdsURL)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(&generateAccessTokenRequest{
+		Scope:    s.scopes,
+		Lifetime: fmt.Sprintf("%ds", int64(s.lifetime.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf(generateAccessTokenURL, url.PathEscape(s.target)), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s %s", tokenType, source.AccessToken))
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: impersonation of %s status: %d", errTokenRequestFailed, s.target, res.StatusCode)
+	}
+
+	generated := &generateAccessTokenResponse{}
+	if err := json.NewDecoder(res.Body).Decode(generated); err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		AccessToken: generated.AccessToken,
+		TokenType:   tokenType,
+		Expiry:      generated.ExpireTime,
+	}, nil
+}
+
+// Token returns a cached token for `target`, or a new one if the cached one is about to expire.
+func (s *ImpersonatedTokenSource) Token(ctx context.Context) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == nil || time.Until(s.token.Expiry) < tokenRefreshMargin {
+		token, err := s.generateToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.token = token
+	}
+
+	token := *s.token
+	token.ExpiresIn = int64(time.Until(token.Expiry).Seconds())
+	return &token, nil
+}
+
+func (s *ImpersonatedTokenSource) Target() string {
+	return s.target
+}
+
+// ServeHTTP responds with a token for `target`; it is meant to be only reachable from within the instance.
+func (s *ImpersonatedTokenSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, err := s.Token(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(token)
+}
+
+func NewImpersonatedTokenSource(target string, scopes ...string) *ImpersonatedTokenSource {
+	if len(scopes) == 0 {
+		scopes = []string{StorageScope}
+	}
+
+	return &ImpersonatedTokenSource{
+		target:   target,
+		scopes:   scopes,
+		lifetime: defaultTokenLifetime,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		mdsURL:   metadataTokenURLFromEnv(),
+	}
+}
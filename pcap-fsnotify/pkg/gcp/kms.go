@@ -0,0 +1,110 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type (
+	// KMSClient encrypts data with a Cloud KMS symmetric key using the instance default identity,
+	// which must be granted `roles/cloudkms.cryptoKeyEncrypter` on the key.
+	KMSClient struct {
+		key    string
+		client *http.Client
+		mdsURL string
+	}
+
+	kmsEncryptRequest struct {
+		Plaintext string `json:"plaintext"`
+	}
+
+	kmsEncryptResponse struct {
+		Name       string `json:"name"`
+		Ciphertext string `json:"ciphertext"`
+	}
+)
+
+const kmsEncryptURL = "https://cloudkms.googleapis.com/v1/%s:encrypt"
+
+var kmsKeyRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// IsKMSKey reports whether `name` is the resource name of a Cloud KMS key,
+// i/e: `projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>`.
+func IsKMSKey(name string) bool {
+	return kmsKeyRegexp.MatchString(name)
+}
+
+// Encrypt returns `plaintext` encrypted with the primary version of the key, and the name of that version;
+// the ciphertext can be decrypted with `gcloud kms decrypt`.
+func (c *KMSClient) Encrypt(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	token, err := defaultToken(ctx, c.client, c.mdsURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	body, err := json.Marshal(&kmsEncryptRequest{Plaintext: base64.StdEncoding.EncodeToString(plaintext)})
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(kmsEncryptURL, c.key), bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s %s", tokenType, token.AccessToken))
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, "", fmt.Errorf("KMS encryption with %s status: %d | %s", c.key, res.StatusCode, bytes.TrimSpace(message))
+	}
+
+	encrypted := &kmsEncryptResponse{}
+	if err := json.NewDecoder(res.Body).Decode(encrypted); err != nil {
+		return nil, "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted.Ciphertext)
+	if err != nil {
+		return nil, "", err
+	}
+	return ciphertext, encrypted.Name, nil
+}
+
+func (c *KMSClient) Key() string {
+	return c.key
+}
+
+func NewKMSClient(key string) *KMSClient {
+	return &KMSClient{
+		key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+		mdsURL: metadataTokenURLFromEnv(),
+	}
+}
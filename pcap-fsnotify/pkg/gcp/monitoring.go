@@ -0,0 +1,153 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// ExportMetrics aggregates all exports that happen between two pushes into Cloud Monitoring.
+	ExportMetrics struct {
+		mu        sync.Mutex
+		client    *http.Client
+		mdsURL    string
+		url       string
+		resource  map[string]string
+		labels    map[string]string
+		exports   uint64
+		failures  uint64
+		bytes     uint64
+		latencyMs float64
+	}
+)
+
+const (
+	monitoringURL    = "https://monitoring.googleapis.com/v3/projects/%s/timeSeries"
+	metricTypePrefix = "custom.googleapis.com/pcap/"
+)
+
+// Observe records the result of exporting a single PCAP file.
+func (m *ExportMetrics) Observe(bytes int64, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.failures++
+		return
+	}
+	m.exports++
+	m.bytes += uint64(bytes)
+	m.latencyMs += float64(latency.Microseconds()) / 1000
+}
+
+func (m *ExportMetrics) reset() (uint64, uint64, uint64, float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	exports, failures, bytes, latencyMs := m.exports, m.failures, m.bytes, m.latencyMs
+	m.exports, m.failures, m.bytes, m.latencyMs = 0, 0, 0, 0
+	return exports, failures, bytes, latencyMs
+}
+
+func (m *ExportMetrics) timeSeries(name, valueType string, value map[string]interface{}, endTime string) map[string]interface{} {
+	return map[string]interface{}{
+		"metric":     map[string]interface{}{"type": metricTypePrefix + name, "labels": m.labels},
+		"resource":   map[string]interface{}{"type": "generic_task", "labels": m.resource},
+		"metricKind": "GAUGE",
+		"valueType":  valueType,
+		"points": []map[string]interface{}{
+			{"interval": map[string]string{"endTime": endTime}, "value": value},
+		},
+	}
+}
+
+// Push writes the amount of exported files and bytes, failures, and the average export latency
+// observed since the previous push.
+func (m *ExportMetrics) Push(ctx context.Context) error {
+	exports, failures, exportedBytes, latencyMs := m.reset()
+
+	endTime := time.Now().UTC().Format(time.RFC3339Nano)
+	int64Value := func(value uint64) map[string]interface{} {
+		return map[string]interface{}{"int64Value": strconv.FormatUint(value, 10)}
+	}
+	series := []map[string]interface{}{
+		m.timeSeries("export/files", "INT64", int64Value(exports), endTime),
+		m.timeSeries("export/failures", "INT64", int64Value(failures), endTime),
+		m.timeSeries("export/bytes", "INT64", int64Value(exportedBytes), endTime),
+	}
+	if exports > 0 {
+		series = append(series, m.timeSeries("export/latency", "DOUBLE",
+			map[string]interface{}{"doubleValue": latencyMs / float64(exports)}, endTime))
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"timeSeries": series})
+	if err != nil {
+		return err
+	}
+
+	token, err := defaultToken(ctx, m.client, m.mdsURL)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s %s", tokenType, token.AccessToken))
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("monitoring status: %d | %s", res.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// NewExportMetrics uses the same resource and labels as `tcpdumpw`: Cloud Run resources
+// do not accept custom metrics so `generic_task` is mapped to Cloud Run labels instead.
+func NewExportMetrics(projectID, region, service, revision, instanceID string) *ExportMetrics {
+	return &ExportMetrics{
+		client: &http.Client{Timeout: 10 * time.Second},
+		mdsURL: metadataTokenURLFromEnv(),
+		url:    fmt.Sprintf(monitoringURL, projectID),
+		resource: map[string]string{
+			"project_id": projectID,
+			"location":   region,
+			"namespace":  service,
+			"job":        revision,
+			"task_id":    instanceID,
+		},
+		labels: map[string]string{
+			"service_name":  service,
+			"revision_name": revision,
+		},
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type (
+	// SecretManagerClient resolves flag values which reference Secret Manager secrets using the instance default identity,
+	// which must be granted `roles/secretmanager.secretAccessor` on them.
+	SecretManagerClient struct {
+		client *http.Client
+		mdsURL string
+	}
+
+	secretVersion struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+)
+
+const (
+	// SecretScheme prefixes flag values which must be resolved from Secret Manager,
+	// i/e: `sm://projects/<project>/secrets/<secret>`.
+	SecretScheme = "sm://"
+
+	secretAccessURL     = "https://secretmanager.googleapis.com/v1/%s:access"
+	secretLatestVersion = "/versions/latest"
+)
+
+var secretNameRegexp = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+(/versions/[^/]+)?$`)
+
+// IsSecretRef reports whether `value` references a secret instead of being the value itself.
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretScheme)
+}
+
+// Resolve returns the payload of the secret referenced by `value`, without surrounding whitespace;
+// `value` is returned as is if it does not reference a secret. The latest version is used if it is not specified.
+func (c *SecretManagerClient) Resolve(ctx context.Context, value string) (string, error) {
+	if !IsSecretRef(value) {
+		return value, nil
+	}
+	name := strings.TrimPrefix(value, SecretScheme)
+	match := secretNameRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return "", fmt.Errorf("secrets must be formatted as: %sprojects/<project>/secrets/<secret>[/versions/<version>]", SecretScheme)
+	}
+	if match[1] == "" {
+		name += secretLatestVersion
+	}
+
+	token, err := defaultToken(ctx, c.client, c.mdsURL)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(secretAccessURL, name), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s %s", tokenType, token.AccessToken))
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", fmt.Errorf("secret manager status: %d | %s", res.StatusCode, bytes.TrimSpace(message))
+	}
+
+	version := &secretVersion{}
+	if err := json.NewDecoder(res.Body).Decode(version); err != nil {
+		return "", err
+	}
+	payload, err := base64.StdEncoding.DecodeString(version.Payload.Data)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(payload)), nil
+}
+
+// Watch resolves `ref` every `interval` until `ctx` is done; `onChange` is called when its payload is not `current`
+// anymore, or when it cannot be resolved.
+func (c *SecretManagerClient) Watch(
+	ctx context.Context,
+	ref, current string,
+	interval time.Duration,
+	onChange func(value string, err error),
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			resolveCtx, resolveCancel := context.WithTimeout(ctx, c.client.Timeout)
+			value, err := c.Resolve(resolveCtx, ref)
+			resolveCancel()
+			if err != nil {
+				onChange("", err)
+			} else if value != current {
+				current = value
+				onChange(value, nil)
+			}
+		}
+	}
+}
+
+func NewSecretManagerClient() *SecretManagerClient {
+	return &SecretManagerClient{
+		client: &http.Client{Timeout: 10 * time.Second},
+		mdsURL: metadataTokenURLFromEnv(),
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcapinfo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+type (
+	// Info describes the packets contained in a PCAP file, or in a JSON PCAP file.
+	Info struct {
+		Path        string     `json:"path"`
+		Bytes       int64      `json:"bytes"`
+		Packets     uint64     `json:"packets"`
+		FirstPacket *time.Time `json:"first_packet,omitempty"`
+		LastPacket  *time.Time `json:"last_packet,omitempty"`
+	}
+
+	// JSON translated packets are timestamped using the same format as Cloud Logging entries
+	jsonPacket struct {
+		Timestamp *struct {
+			Seconds int64 `json:"seconds"`
+			Nanos   int64 `json:"nanos"`
+		} `json:"timestamp"`
+	}
+)
+
+// see: https://wiki.wireshark.org/Development/LibpcapFileFormat
+const (
+	pcapMagicMicros uint32 = 0xA1B2C3D4
+	pcapMagicNanos  uint32 = 0xA1B23C4D
+
+	pcapGlobalHeaderSize = 24
+	pcapRecordHeaderSize = 16
+
+	maxJSONLineSize = 16 * 1024 * 1024
+)
+
+func (i *Info) observe(ts time.Time) {
+	i.Packets++
+	if i.FirstPacket == nil {
+		i.FirstPacket = &ts
+	}
+	i.LastPacket = &ts
+}
+
+func pcapByteOrder(magic []byte) (binary.ByteOrder, time.Duration, bool) {
+	switch {
+	case binary.LittleEndian.Uint32(magic) == pcapMagicMicros:
+		return binary.LittleEndian, time.Microsecond, true
+	case binary.LittleEndian.Uint32(magic) == pcapMagicNanos:
+		return binary.LittleEndian, time.Nanosecond, true
+	case binary.BigEndian.Uint32(magic) == pcapMagicMicros:
+		return binary.BigEndian, time.Microsecond, true
+	case binary.BigEndian.Uint32(magic) == pcapMagicNanos:
+		return binary.BigEndian, time.Nanosecond, true
+	}
+	return nil, 0, false
+}
+
+func (i *Info) inspectPcap(reader *bufio.Reader, order binary.ByteOrder, resolution time.Duration) error {
+	if _, err := reader.Discard(pcapGlobalHeaderSize); err != nil {
+		return err
+	}
+
+	header := make([]byte, pcapRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			// the last record may be incomplete if the file was not gracefully closed
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		seconds := int64(order.Uint32(header[0:4]))
+		fraction := time.Duration(order.Uint32(header[4:8])) * resolution
+		i.observe(time.Unix(seconds, int64(fraction)))
+
+		capLen := int(order.Uint32(header[8:12]))
+		if _, err := reader.Discard(capLen); err != nil {
+			return nil
+		}
+	}
+}
+
+func (i *Info) inspectJSON(reader *bufio.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJSONLineSize)
+	for scanner.Scan() {
+		packet := &jsonPacket{}
+		if err := json.Unmarshal(scanner.Bytes(), packet); err != nil || packet.Timestamp == nil {
+			continue
+		}
+		i.observe(time.Unix(packet.Timestamp.Seconds, packet.Timestamp.Nanos))
+	}
+	return scanner.Err()
+}
+
+// Inspect counts the packets in the file at `path`, and finds the timestamps of the first and last ones;
+// PCAP files are detected by their magic number, all other files are read as JSON lines.
+func Inspect(path string) (*Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{Path: path, Bytes: stat.Size()}
+	reader := bufio.NewReaderSize(file, 1024*1024)
+
+	magic, err := reader.Peek(4)
+	if err != nil {
+		// empty files contain no packets
+		if errors.Is(err, io.EOF) {
+			return info, nil
+		}
+		return nil, err
+	}
+
+	if order, resolution, ok := pcapByteOrder(magic); ok {
+		return info, info.inspectPcap(reader, order, resolution)
+	}
+	return info, info.inspectJSON(reader)
+}
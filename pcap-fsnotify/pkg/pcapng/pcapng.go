@@ -0,0 +1,221 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcapng
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// see: https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	blockTypeSHB uint32 = 0x0A0D0D0A
+	blockTypeIDB uint32 = 0x00000001
+	blockTypeEPB uint32 = 0x00000006
+	blockTypeDSB uint32 = 0x0000000A
+
+	secretsTypeTLSKeyLog uint32 = 0x544C534B
+
+	byteOrderMagic uint32 = 0x1A2B3C4D
+
+	optEndOfOpt  uint16 = 0
+	optComment   uint16 = 1
+	optUserAppl  uint16 = 4
+	optIfTsResol uint16 = 9
+)
+
+// see: https://wiki.wireshark.org/Development/LibpcapFileFormat
+const (
+	pcapMagicMicros uint32 = 0xA1B2C3D4
+	pcapMagicNanos  uint32 = 0xA1B23C4D
+
+	pcapGlobalHeaderSize = 24
+	pcapRecordHeaderSize = 16
+)
+
+var ErrNotPcap = errors.New("not a PCAP file")
+
+type (
+	blockWriter struct {
+		w     *bufio.Writer
+		order binary.ByteOrder
+		count int64
+	}
+
+	option struct {
+		code  uint16
+		value []byte
+	}
+)
+
+func padding(length int) int {
+	return (4 - length%4) % 4
+}
+
+func optionsLength(options []*option) int {
+	if len(options) == 0 {
+		return 0
+	}
+	length := 4 // `opt_endofopt`
+	for _, opt := range options {
+		length += 4 + len(opt.value) + padding(len(opt.value))
+	}
+	return length
+}
+
+func (b *blockWriter) write(data ...interface{}) {
+	for _, d := range data {
+		binary.Write(b.w, b.order, d)
+		b.count += int64(binary.Size(d))
+	}
+}
+
+func (b *blockWriter) writeBytes(data []byte) {
+	n, _ := b.w.Write(data)
+	b.count += int64(n)
+	if pad := padding(len(data)); pad > 0 {
+		n, _ = b.w.Write(make([]byte, pad))
+		b.count += int64(n)
+	}
+}
+
+func (b *blockWriter) writeOptions(options []*option) {
+	if len(options) == 0 {
+		return
+	}
+	for _, opt := range options {
+		b.write(opt.code, uint16(len(opt.value)))
+		b.writeBytes(opt.value)
+	}
+	b.write(optEndOfOpt, uint16(0))
+}
+
+func (b *blockWriter) writeSectionHeader(options []*option) {
+	length := uint32(28 + optionsLength(options))
+	b.write(blockTypeSHB, length, byteOrderMagic, uint16(1), uint16(0), int64(-1))
+	b.writeOptions(options)
+	b.write(length)
+}
+
+func (b *blockWriter) writeInterfaceDescription(linkType uint16, snaplen uint32, tsResolution uint8) {
+	options := []*option{{code: optIfTsResol, value: []byte{tsResolution}}}
+	length := uint32(20 + optionsLength(options))
+	b.write(blockTypeIDB, length, linkType, uint16(0), snaplen)
+	b.writeOptions(options)
+	b.write(length)
+}
+
+func (b *blockWriter) writeEnhancedPacket(timestamp uint64, capLen, origLen uint32, data []byte) {
+	length := uint32(32 + len(data) + padding(len(data)))
+	b.write(blockTypeEPB, length, uint32(0), uint32(timestamp>>32), uint32(timestamp), capLen, origLen)
+	b.writeBytes(data)
+	b.write(length)
+}
+
+func (b *blockWriter) writeDecryptionSecrets(secretsType uint32, secrets []byte) {
+	length := uint32(20 + len(secrets) + padding(len(secrets)))
+	b.write(blockTypeDSB, length, secretsType, uint32(len(secrets)))
+	b.writeBytes(secrets)
+	b.write(length)
+}
+
+// FromPcap converts a PCAP stream into a PCAPNG stream with a single section and interface;
+// `comment` and `application` are added to the section header block, and `tlsKeyLog` – if not empty – is added
+// as a decryption secrets block so that TLS sessions may be decrypted. It returns the bytes written into `dst`.
+func FromPcap(dst io.Writer, src io.Reader, comment, application string, tlsKeyLog []byte) (int64, error) {
+	reader := bufio.NewReader(src)
+
+	header := make([]byte, pcapGlobalHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, errors.Join(ErrNotPcap, err)
+	}
+
+	var order binary.ByteOrder
+	var tsResolution uint8
+	switch {
+	case binary.LittleEndian.Uint32(header) == pcapMagicMicros:
+		order, tsResolution = binary.LittleEndian, 6
+	case binary.LittleEndian.Uint32(header) == pcapMagicNanos:
+		order, tsResolution = binary.LittleEndian, 9
+	case binary.BigEndian.Uint32(header) == pcapMagicMicros:
+		order, tsResolution = binary.BigEndian, 6
+	case binary.BigEndian.Uint32(header) == pcapMagicNanos:
+		order, tsResolution = binary.BigEndian, 9
+	default:
+		return 0, ErrNotPcap
+	}
+
+	snaplen := order.Uint32(header[16:20])
+	linkType := uint16(order.Uint32(header[20:24]))
+
+	writer := &blockWriter{w: bufio.NewWriter(dst), order: binary.LittleEndian}
+
+	options := []*option{}
+	if comment != "" {
+		options = append(options, &option{code: optComment, value: []byte(comment)})
+	}
+	if application != "" {
+		options = append(options, &option{code: optUserAppl, value: []byte(application)})
+	}
+	writer.writeSectionHeader(options)
+	if len(tlsKeyLog) > 0 {
+		// decryption secrets must appear before the packets they apply to
+		writer.writeDecryptionSecrets(secretsTypeTLSKeyLog, tlsKeyLog)
+	}
+	writer.writeInterfaceDescription(linkType, snaplen, tsResolution)
+
+	tsUnitsPerSecond := uint64(1_000_000)
+	if tsResolution == 9 {
+		tsUnitsPerSecond = 1_000_000_000
+	}
+
+	record := make([]byte, pcapRecordHeaderSize)
+	data := make([]byte, snaplen)
+	for {
+		if _, err := io.ReadFull(reader, record); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			// the last record of a file which is still being written may be incomplete
+			break
+		} else if err != nil {
+			return writer.count, err
+		}
+
+		tsSeconds := uint64(order.Uint32(record[0:4]))
+		tsFraction := uint64(order.Uint32(record[4:8]))
+		capLen := order.Uint32(record[8:12])
+		origLen := order.Uint32(record[12:16])
+
+		if capLen > uint32(len(data)) {
+			if capLen > 0x10000000 {
+				return writer.count, fmt.Errorf("invalid record length: %d", capLen)
+			}
+			data = make([]byte, capLen)
+		}
+
+		if _, err := io.ReadFull(reader, data[:capLen]); err == io.ErrUnexpectedEOF || err == io.EOF {
+			break
+		} else if err != nil {
+			return writer.count, err
+		}
+
+		writer.writeEnhancedPacket(tsSeconds*tsUnitsPerSecond+tsFraction, capLen, origLen, data[:capLen])
+	}
+
+	return writer.count, writer.w.Flush()
+}
@@ -0,0 +1,402 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sftp uploads exported files into SFTP servers, using a minimal SFTP client which only creates directories
+// and writes files; files are written with a temporary name and renamed once they are complete.
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type (
+	// Client uploads files into the directory of an SFTP server described by an `sftp://` URL;
+	// it holds 1 connection, which is established when uploading the first file and whenever it fails.
+	Client struct {
+		mu        sync.Mutex
+		addr      string
+		user      string
+		dir       string
+		vars      map[string]string
+		sshConfig *ssh.ClientConfig
+		conn      *ssh.Client
+		session   *session
+	}
+
+	session struct {
+		*ssh.Session
+		in          io.WriteCloser
+		out         io.Reader
+		nextID      uint32
+		posixRename bool
+	}
+)
+
+const (
+	defaultPort = "22"
+	// temporary files are hidden, so that partners never pick up incomplete files
+	partialPrefix = "."
+	partialSuffix = ".part"
+	// writes which are sent before waiting for their responses
+	maxInflightWrites = 16
+	dateLayout        = "2006-01-02"
+)
+
+// DateVar is expanded into the date, in UTC, in which a file is uploaded; i/e: `2024-01-31`.
+const DateVar = "date"
+
+var templateVarRegex = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// expand replaces `{<var>}` in `template` with the value of `<var>`; it fails if `<var>` is unknown.
+func expand(template string, vars map[string]string, now time.Time) (string, error) {
+	var unknown []string
+	expanded := templateVarRegex.ReplaceAllStringFunc(template, func(match string) string {
+		name := match[1 : len(match)-1]
+		if name == DateVar {
+			return now.UTC().Format(dateLayout)
+		}
+		value, ok := vars[name]
+		if !ok {
+			unknown = append(unknown, match)
+			return match
+		}
+		// values must not add path segments
+		return strings.ReplaceAll(value, "/", "_")
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown directory template variables: %s", strings.Join(unknown, ", "))
+	}
+	return expanded, nil
+}
+
+func (s *session) id() uint32 {
+	s.nextID++
+	return s.nextID
+}
+
+// roundTrip sends `p` and waits for its response; requests are sent one at a time.
+func (s *session) roundTrip(p *packet, id uint32) (*response, error) {
+	if err := p.send(s.in); err != nil {
+		return nil, err
+	}
+	res, err := readResponse(s.out)
+	if err != nil {
+		return nil, err
+	}
+	if resID := res.uint32(); res.err != nil || resID != id {
+		return nil, fmt.Errorf("%w: id: %d | expected: %d", errUnexpectedPacket, resID, id)
+	}
+	return res, nil
+}
+
+func (s *session) init() error {
+	if err := newPacket(fxpInit).uint32(sftpVersion).send(s.in); err != nil {
+		return err
+	}
+	res, err := readResponse(s.out)
+	if err != nil {
+		return err
+	}
+	if res.kind != fxpVersion {
+		return fmt.Errorf("%w: type: %d | expected version", errUnexpectedPacket, res.kind)
+	}
+	if version := res.uint32(); version < sftpVersion {
+		return fmt.Errorf("unsupported SFTP version: %d", version)
+	}
+	for len(res.data) > 0 && res.err == nil {
+		name, _ := res.string(), res.string()
+		s.posixRename = s.posixRename || name == posixRenameExtension
+	}
+	return res.err
+}
+
+func (s *session) stat(name string) error {
+	id := s.id()
+	res, err := s.roundTrip(newPacket(fxpStat).uint32(id).string(name), id)
+	if err != nil {
+		return err
+	}
+	if res.kind == fxpAttrs {
+		return nil
+	}
+	return res.status()
+}
+
+func (s *session) simple(kind byte, args ...string) error {
+	id := s.id()
+	p := newPacket(kind).uint32(id)
+	for _, arg := range args {
+		p.string(arg)
+	}
+	if kind == fxpMkdir {
+		// no attributes: the server applies its defaults
+		p.uint32(0)
+	}
+	res, err := s.roundTrip(p, id)
+	if err != nil {
+		return err
+	}
+	return res.status()
+}
+
+// mkdirAll creates `dir` and all its parents which do not exist.
+func (s *session) mkdirAll(dir string) error {
+	if dir == "" || dir == "/" || dir == "." {
+		return nil
+	}
+	err := s.stat(dir)
+	var status *StatusError
+	if err == nil || !errors.As(err, &status) || status.Code != fxNoSuchFile {
+		return err
+	}
+	if err := s.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	if err := s.simple(fxpMkdir, dir); err != nil {
+		// another upload may have created it meanwhile
+		if s.stat(dir) == nil {
+			return nil
+		}
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+func (s *session) write(name string, body io.Reader) error {
+	id := s.id()
+	res, err := s.roundTrip(newPacket(fxpOpen).uint32(id).string(name).uint32(fxfWrite|fxfCreate|fxfTruncate).uint32(0), id)
+	if err != nil {
+		return err
+	}
+	if res.kind != fxpHandle {
+		return res.status()
+	}
+	handle := res.string()
+	if res.err != nil {
+		return res.err
+	}
+
+	// writes are pipelined: waiting for every response would make uploads bound by the latency to the server
+	inflight := 0
+	wait := func() error {
+		inflight--
+		res, err := readResponse(s.out)
+		if err != nil {
+			return err
+		}
+		if res.uint32(); res.err != nil {
+			return res.err
+		}
+		return res.status()
+	}
+
+	var writeErr error = nil
+	buf := make([]byte, maxWriteSize)
+	var offset uint64 = 0
+	for writeErr == nil {
+		n, readErr := io.ReadFull(body, buf)
+		if n > 0 {
+			if inflight == maxInflightWrites {
+				if writeErr = wait(); writeErr != nil {
+					break
+				}
+			}
+			if writeErr = newPacket(fxpWrite).uint32(s.id()).string(handle).uint64(offset).bytes(buf[:n]).send(s.in); writeErr != nil {
+				break
+			}
+			inflight++
+			offset += uint64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		writeErr = readErr
+	}
+	for inflight > 0 {
+		if err := wait(); writeErr == nil {
+			writeErr = err
+		}
+	}
+
+	if err := s.simple(fxpClose, handle); writeErr == nil {
+		writeErr = err
+	}
+	return writeErr
+}
+
+func (s *session) rename(from, to string) error {
+	if s.posixRename {
+		return s.simple(fxpExtended, posixRenameExtension, from, to)
+	}
+	// SFTP v3 renames fail if the target exists: files which are uploaded again replace the previous ones
+	if err := s.simple(fxpRemove, to); err != nil {
+		var status *StatusError
+		if !errors.As(err, &status) || status.Code != fxNoSuchFile {
+			return err
+		}
+	}
+	return s.simple(fxpRename, from, to)
+}
+
+func (c *Client) connect() error {
+	conn, err := ssh.Dial("tcp", c.addr, c.sshConfig)
+	if err != nil {
+		return err
+	}
+	sshSession, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s := &session{Session: sshSession}
+	if s.in, err = sshSession.StdinPipe(); err == nil {
+		s.out, err = sshSession.StdoutPipe()
+	}
+	if err == nil {
+		err = sshSession.RequestSubsystem("sftp")
+	}
+	if err == nil {
+		err = s.init()
+	}
+	if err != nil {
+		sshSession.Close()
+		conn.Close()
+		return err
+	}
+	c.conn, c.session = conn, s
+	return nil
+}
+
+func (c *Client) disconnect() {
+	if c.conn == nil {
+		return
+	}
+	c.session.Close()
+	c.conn.Close()
+	c.conn, c.session = nil, nil
+}
+
+// Upload writes `body` into `name`, relative to the expanded directory of the client; `name` is complete once it is visible,
+// as it is written into a hidden file which is then renamed. `size` is only used to describe failures.
+func (c *Client) Upload(ctx context.Context, name string, body io.Reader, size int64) error {
+	dir, err := expand(c.dir, c.vars, time.Now())
+	if err != nil {
+		return err
+	}
+	target := path.Join(dir, name)
+	partial := path.Join(path.Dir(target), partialPrefix+path.Base(target)+partialSuffix)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", c.addr, err)
+		}
+	}
+
+	// SSH does not support contexts: closing the connection aborts the upload
+	conn := c.conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = c.session.mkdirAll(path.Dir(target))
+	if err == nil {
+		err = c.session.write(partial, body)
+	}
+	if err == nil {
+		err = c.session.rename(partial, target)
+	}
+	if err != nil {
+		var status *StatusError
+		if !errors.As(err, &status) {
+			// the session is not usable after failing to send or receive packets
+			c.disconnect()
+		} else {
+			c.session.simple(fxpRemove, partial)
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("failed to upload %s ( %d bytes ): %w", target, size, err)
+	}
+	return nil
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnect()
+	return nil
+}
+
+func (c *Client) String() string {
+	return fmt.Sprintf("sftp://%s@%s%s", c.user, c.addr, c.dir)
+}
+
+// NewClient parses an URL such as `sftp://<user>@<host>[:<port>]/<dir>`, where `<dir>` may include `{<var>}` placeholders which
+// are replaced by the values of `vars`, or by the current date for `{date}`. The host must present `hostKey`.
+func NewClient(rawURL string, signer ssh.Signer, hostKey ssh.PublicKey, vars map[string]string, timeout time.Duration) (*Client, error) {
+	sftpURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SFTP URL: %w", err)
+	}
+	if sftpURL.Scheme != "sftp" || sftpURL.Hostname() == "" || sftpURL.User.Username() == "" {
+		return nil, fmt.Errorf("invalid SFTP URL: %s | use 'sftp://<user>@<host>[:<port>]/<dir>'", rawURL)
+	}
+	if _, hasPassword := sftpURL.User.Password(); hasPassword {
+		return nil, errors.New("invalid SFTP URL: passwords are not supported, use a private key")
+	}
+	if signer == nil || hostKey == nil {
+		return nil, errors.New("SFTP requires a private key and the public key of the host")
+	}
+
+	port := sftpURL.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	dir := sftpURL.Path
+	if dir == "" {
+		dir = "/"
+	}
+	// placeholders are validated once, so that uploads never fail because of them
+	if _, err := expand(dir, vars, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		addr: net.JoinHostPort(sftpURL.Hostname(), port),
+		user: sftpURL.User.Username(),
+		dir:  dir,
+		vars: vars,
+		sshConfig: &ssh.ClientConfig{
+			User:            sftpURL.User.Username(),
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+			Timeout:         timeout,
+		},
+	}, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SFTP version 3 is the one implemented by OpenSSH: https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+const (
+	sftpVersion = 3
+
+	fxpInit     byte = 1
+	fxpVersion  byte = 2
+	fxpOpen     byte = 3
+	fxpClose    byte = 4
+	fxpWrite    byte = 6
+	fxpRemove   byte = 13
+	fxpMkdir    byte = 14
+	fxpStat     byte = 17
+	fxpRename   byte = 18
+	fxpStatus   byte = 101
+	fxpHandle   byte = 102
+	fxpAttrs    byte = 105
+	fxpExtended byte = 200
+
+	fxfWrite    uint32 = 0x02
+	fxfCreate   uint32 = 0x08
+	fxfTruncate uint32 = 0x10
+
+	fxOK         uint32 = 0
+	fxNoSuchFile uint32 = 2
+
+	// rename which replaces the target, as `rename(2)` does; SFTP v3 renames fail if the target exists
+	posixRenameExtension = "posix-rename@openssh.com"
+
+	// OpenSSH accepts packets of up to 256 KiB; writes are kept well below it
+	maxPacketSize = 256 * 1024
+	maxWriteSize  = 32 * 1024
+)
+
+// StatusError is returned when the server responds to a request with a status other than `SSH_FX_OK`.
+type StatusError struct {
+	Code    uint32
+	Message string
+}
+
+var errUnexpectedPacket = errors.New("unexpected SFTP packet")
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sftp status: %d | %s", e.Code, e.Message)
+}
+
+type packet struct {
+	buf []byte
+}
+
+func newPacket(kind byte) *packet {
+	// the length is set when the packet is sent
+	return &packet{buf: []byte{0, 0, 0, 0, kind}}
+}
+
+func (p *packet) uint32(v uint32) *packet {
+	p.buf = binary.BigEndian.AppendUint32(p.buf, v)
+	return p
+}
+
+func (p *packet) uint64(v uint64) *packet {
+	p.buf = binary.BigEndian.AppendUint64(p.buf, v)
+	return p
+}
+
+func (p *packet) string(v string) *packet {
+	return p.bytes([]byte(v))
+}
+
+func (p *packet) bytes(v []byte) *packet {
+	p.uint32(uint32(len(v)))
+	p.buf = append(p.buf, v...)
+	return p
+}
+
+func (p *packet) send(w io.Writer) error {
+	binary.BigEndian.PutUint32(p.buf, uint32(len(p.buf)-4))
+	_, err := w.Write(p.buf)
+	return err
+}
+
+// response is a packet received from the server, which is consumed as it is parsed.
+type response struct {
+	kind byte
+	data []byte
+	err  error
+}
+
+func readResponse(r io.Reader) (*response, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > maxPacketSize {
+		return nil, fmt.Errorf("%w: length: %d", errUnexpectedPacket, length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return &response{kind: header[4], data: data}, nil
+}
+
+func (r *response) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.err = fmt.Errorf("%w: truncated", errUnexpectedPacket)
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *response) string() string {
+	length := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < length {
+		r.err = fmt.Errorf("%w: truncated", errUnexpectedPacket)
+		return ""
+	}
+	v := string(r.data[:length])
+	r.data = r.data[length:]
+	return v
+}
+
+// status returns the error carried by a `SSH_FXP_STATUS` response, or `nil` if it is `SSH_FX_OK`.
+func (r *response) status() error {
+	if r.kind != fxpStatus {
+		return fmt.Errorf("%w: type: %d | expected status", errUnexpectedPacket, r.kind)
+	}
+	code := r.uint32()
+	message := r.string()
+	if r.err != nil {
+		return r.err
+	}
+	if code != fxOK {
+		return &StatusError{Code: code, Message: message}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workpool runs tasks through a fixed amount of workers fed by a bounded queue, and retries the ones which fail;
+// every destination of exported files gets its own pool, so that a slow one never delays the others.
+package workpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Policy configures a pool: how many tasks run at the same time, how many may wait to be run,
+	// and how many times a task is attempted; the backoff between attempts doubles after every one.
+	Policy struct {
+		Workers  int           `json:"workers"`
+		Queue    int           `json:"queue"`
+		Attempts int           `json:"attempts"`
+		Backoff  time.Duration `json:"backoff"`
+	}
+
+	// Task is run by the first available worker; `Run` is called again while it fails, up to the attempts of the policy,
+	// and `Done` is called once with the amount of attempts and the error of the last one. Both may be called concurrently
+	// with other tasks.
+	Task struct {
+		Run  func(ctx context.Context, attempt int) error
+		Done func(attempts int, err error)
+	}
+
+	Pool struct {
+		policy  Policy
+		ctx     context.Context
+		cancel  context.CancelFunc
+		mu      sync.RWMutex
+		closed  bool
+		tasks   chan *Task
+		running atomic.Int64
+		wg      sync.WaitGroup
+	}
+)
+
+// maxBackoff caps the time between attempts
+const maxBackoff = 5 * time.Minute
+
+var (
+	ErrFull   = errors.New("queue is full")
+	ErrClosed = errors.New("pool is closed")
+)
+
+func (p Policy) String() string {
+	return fmt.Sprintf("workers=%d,queue=%d,attempts=%d,backoff=%v", p.Workers, p.Queue, p.Attempts, p.Backoff)
+}
+
+// ParsePolicy parses a policy such as `workers=2,queue=64,attempts=3,backoff=5s`; fields which are not set keep their value in `defaults`.
+func ParsePolicy(spec string, defaults Policy) (Policy, error) {
+	policy := defaults
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return policy, fmt.Errorf("invalid field: %q | use '<key>=<value>'", field)
+		}
+		var err error
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "workers":
+			policy.Workers, err = strconv.Atoi(value)
+		case "queue":
+			policy.Queue, err = strconv.Atoi(value)
+		case "attempts":
+			policy.Attempts, err = strconv.Atoi(value)
+		case "backoff":
+			policy.Backoff, err = time.ParseDuration(value)
+		default:
+			return policy, fmt.Errorf("unknown field: %q | use 'workers', 'queue', 'attempts' or 'backoff'", key)
+		}
+		if err != nil {
+			return policy, fmt.Errorf("invalid %s: %q | %w", key, value, err)
+		}
+	}
+
+	switch {
+	case policy.Workers < 1:
+		return policy, fmt.Errorf("'workers' must be at least 1: %d", policy.Workers)
+	case policy.Queue < 1:
+		return policy, fmt.Errorf("'queue' must be at least 1: %d", policy.Queue)
+	case policy.Attempts < 1:
+		return policy, fmt.Errorf("'attempts' must be at least 1: %d", policy.Attempts)
+	case policy.Backoff < 0:
+		return policy, fmt.Errorf("'backoff' must not be negative: %v", policy.Backoff)
+	}
+	return policy, nil
+}
+
+func (p *Pool) Policy() Policy {
+	return p.policy
+}
+
+// Submit queues `task`, and blocks while the queue is full.
+func (p *Pool) Submit(task *Task) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	p.tasks <- task
+	return nil
+}
+
+// TrySubmit queues `task`, or fails with `ErrFull` if the queue is full.
+func (p *Pool) TrySubmit(task *Task) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	select {
+	case p.tasks <- task:
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+// Pending returns the amount of tasks which are queued or running.
+func (p *Pool) Pending() int {
+	return len(p.tasks) + int(p.running.Load())
+}
+
+// Close stops accepting tasks, and waits until all the queued ones are done; once `ctx` is done, running tasks
+// are cancelled, and the rest are done with the error of `ctx` without being attempted again.
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	defer p.cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) backoff(attempt int) time.Duration {
+	backoff := p.policy.Backoff
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+func (p *Pool) run(task *Task) {
+	p.running.Add(1)
+	defer p.running.Add(-1)
+
+	attempts := 0
+	var err error
+	for attempts < p.policy.Attempts {
+		// the error of the last attempt prevails over the cancellation which stopped retrying
+		if ctxErr := p.ctx.Err(); ctxErr != nil {
+			if attempts == 0 {
+				err = ctxErr
+			}
+			break
+		}
+		attempts += 1
+		if err = task.Run(p.ctx, attempts); err == nil || attempts == p.policy.Attempts {
+			break
+		}
+		timer := time.NewTimer(p.backoff(attempts))
+		select {
+		case <-p.ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	if task.Done != nil {
+		task.Done(attempts, err)
+	}
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		p.run(task)
+	}
+}
+
+// New starts the workers of a pool configured by `policy`, which must be valid.
+func New(policy Policy) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		policy: policy,
+		ctx:    ctx,
+		cancel: cancel,
+		tasks:  make(chan *Task, policy.Queue),
+	}
+	p.wg.Add(policy.Workers)
+	for i := 0; i < policy.Workers; i++ {
+		go p.worker()
+	}
+	return p
+}
@@ -22,10 +22,15 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -38,34 +43,91 @@ import (
 
 	"github.com/alphadose/haxmap"
 	"github.com/gchux/pcap-cli/pkg/pcap"
-	"github.com/go-co-op/gocron/v2"
 	"github.com/gofrs/flock"
+	libpcap "github.com/google/gopacket/pcap"
 	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
 	"github.com/wissance/stringFormatter"
 
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/analysis"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/anonymize"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/audit"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/capture"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/control"
+	pcapEngines "github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/engines"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/enrich"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/execution"
 	pcapFilter "github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/filter"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/gcp"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/geoip"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/governor"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/headers"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/health"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/history"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/ifstats"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/ipfix"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/l7"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/logsink"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/mtls"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/notify"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/otlp"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/preflight"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/probe"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/profiles"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/rdns"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/readiness"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/replay"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/sampling"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/schema"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/sinks"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/state"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/stats"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/storage"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/tags"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/zoneinfo"
 )
 
 func UNUSED(x ...interface{}) {}
 
+// build metadata is injected at build time; i/e: `go build -ldflags "-X main.buildVersion=v1.2.3 -X main.buildCommit=<sha>"`.
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildDate    = ""
+)
+
 var (
 	use_cron   = flag.Bool("use_cron", false, "perform packet capture at specific intervals")
 	cron_exp   = flag.String("cron_exp", "", "stardard cron expression; i/e: '1 * * * *'")
 	timezone   = flag.String("timezone", "UTC", "TimeZone to be used to schedule packet captures")
-	duration   = flag.Int("timeout", 0, "perform packet capture during this mount of seconds")
-	interval   = flag.Int("interval", 60, "seconds after which tcpdump rotates PCAP files")
+	file_tz    = flag.String("file_timezone", "local", "timezone of the timestamps in file names: 'utc', or 'local' to use 'timezone'")
+	file_ms    = flag.Bool("file_millis", false, "include milliseconds in the timestamps of file names; not supported by 'tcpdump'")
+	file_seq   = flag.Bool("file_sequence", false, "include in file names a sequence number which increases every time a task creates a file, so that missing files are detectable; not supported by 'tcpdump'")
+	duration   = secondsFlag("timeout", 0, "perform packet capture during this mount of seconds")
+	interval   = secondsFlag("interval", 60, "seconds after which tcpdump rotates PCAP files")
 	snaplen    = flag.Int("snaplen", 0, "bytes to be captured from each packet")
 	extension  = flag.String("extension", "pcap", "extension to be used for tcpdump PCAP files")
 	directory  = flag.String("directory", "", "directory where PCAP files will be stored")
+	dry_run    = flag.Bool("dry_run", false, "validate interfaces, filters, directory and exporters, print a JSON report and exit; the exit code is 1 if any check fails")
+	self_test  = flag.Bool("selftest", false, "capture while sending UDP probes to 'selftest_probe', print a JSON report and exit; the exit code is 1 if no probe is captured")
+	st_probe   = flag.String("selftest_probe", "169.254.169.254:33434", "UDP address where 'selftest' probes are sent to; it must be routed through the captured ifaces")
+	st_secs    = secondsFlag("selftest_timeout", 5, "seconds to wait for 'selftest' probes to be captured")
+	probe_addr = flag.String("probe", "", "UDP address where tiny markers are periodically sent to while capturing, i/e: '169.254.169.254:33434'; an alert is raised if they stop appearing in the JSON translated packets. It must be routed through the captured ifaces and allowed by 'filter'")
+	probe_int  = secondsFlag("probe_interval", 10, "seconds between markers sent to 'probe'")
+	probe_to   = secondsFlag("probe_timeout", 60, "seconds without capturing any marker sent to 'probe' before raising an alert")
+	print_ver  = flag.Bool("version", false, "print version, git commit, build date, libpcap version and enabled engines, and exit")
+	list_tz    = flag.Bool("list_timezones", false, "print the zones which may be used as 'timezone' and exit; 'timezone' is used as a prefix filter if it is not 'UTC'")
 	tcp_dump   = flag.Bool("tcpdump", true, "enable JSON PCAP using tcpdump")
 	json_dump  = flag.Bool("jsondump", false, "enable JSON PCAP using gopacket")
 	json_log   = flag.Bool("jsonlog", false, "enable JSON PCAP to stardard output")
+	json_sinks = flag.String("json_sinks", "", "comma separated list of writers for JSON PCAP records: 'file' (alias 'gcs'), 'stdout', 'log_sink', 'gae' and any other registered sink; it prevails over 'jsondump', 'jsonlog' and 'log_sink_packets'")
 	ordered    = flag.Bool("ordered", false, "write JSON PCAP output as obtained from gopacket")
 	conntrack  = flag.Bool("conntrack", false, "enable connection tracking ('ordered' is also enabled)")
 	gcp_gae    = flag.Bool("gae", false, "enable GAE Flex environment configuration")
 	pcap_iface = flag.String("iface", "", "prefix to scan for network interfaces to capture from")
 	hc_port    = flag.Uint("hc_port", 12345, "TCP port for health checking")
-	filter     = flag.String("filter", pcap.PcapDefaultFilter, "BPF filter to be used for capturing packets")
+	filter     = flag.String("filter", pcap.PcapDefaultFilter, "BPF filter to be used for capturing packets; it may reference built-in presets as '@<name>', i/e: '@dns or @sql'")
 	l3_protos  = flag.String("l3_protos", "ipv4,ipv6", "FQDNs to be translated into IPs to apply as packet filter")
 	l4_protos  = flag.String("l4_protos", "tcp,udp", "FQDNs to be translated into IPs to apply as packet filter")
 	hosts      = flag.String("hosts", "", "FQDNs to be translated into IPs to apply as packet filter")
@@ -74,104 +136,703 @@ var (
 	ipv6       = flag.String("ipv6", "", "IPv6s or CIDR to be applied to the packet filter")
 	tcp_flags  = flag.String("tcp_flags", "", "TCP flags to be set for a segment to be captured")
 	ephemerals = flag.String("ephemerals", "32768,65535", "range of ephemeral ports")
+	no_noise   = flag.Bool("exclude_noise", false, "exclude health checks, metadata server and logging agents traffic from the packet filter")
 	compat     = flag.Bool("compat", false, "apply filters in Cloud Run gen1 mode")
 	rt_env     = flag.String("rt_env", "cloud_run_gen2", "runtime where PCAP sidecar is used")
+	err_report = flag.Bool("error_reporting", true, "format ERROR and FATAL log entries to be collected by Error Reporting")
+	use_mds    = flag.Bool("use_mds", true, "use the metadata server to resolve identity fields not available in env")
+	term_watch = flag.Bool("term_watch", true, "rotate and flush PCAP files as soon as the instance is notified to be terminated")
+	wait_for   = flag.String("wait_for", "", "HTTP URL or TCP address/port that must be ready before starting packet capture")
+	wait_to    = secondsFlag("wait_timeout", 0, "seconds to wait for 'wait_for' to be ready before starting packet capture anyway")
+	exp_wait   = secondsFlag("export_wait", 0, "seconds to wait for 'pcap_fsn' to report the result of exporting the last PCAP files after signaling it; 0 does not wait")
+	run_mode   = flag.String("mode", sidecarMode, "'sidecar' captures until terminated, 'job' captures during 'timeout' seconds and exits, 'window' captures only while requests are being handled")
+	leftovers  = flag.String("leftover_policy", leftoverPolicyExport, "what to do with the files left behind in 'directory' by previous executions: 'export', 'delete' or 'keep'")
+	engine_s   = flag.String("engine", liveEngine, "'live' captures packets from ifaces, 'file' replays the packets of 'input' through the JSON translation, analysis and writers, and exits once all were replayed")
+	input      = flag.String("input", "", "PCAP or PCAPNG file replayed by the 'file' engine")
+	replay_rt  = flag.Bool("replay_realtime", false, "replay the packets of 'input' respecting the original time between them, instead of as fast as they are translated")
+	user_tags  = tagsFlag("tag", "user defined 'key=value' tags stamped onto scheduled jobs, log entries, JSON translated packets and summaries; may be repeated, or hold comma separated pairs")
+	profile_s  = flag.String("profiles", "", "JSON array of capture profiles, or the path of a file containing it; every profile is scheduled independently with its own tasks, and unset fields take the value of the flag with the same name")
+	ctrl_sock  = flag.String("control_socket", "", "Unix socket to accept control commands from other containers")
+	audit_log  = flag.String("audit_log", audit.Stdout, "where control commands, signals and termination notices are recorded as JSON lines: 'stdout', the path of a file, or empty to disable")
+	win_linger = secondsFlag("window_linger", 1, "seconds to keep capturing after the last request window is closed")
+	gcs_fuse   = flag.String("gcs_fuse", "auto", "'auto' detects if 'directory' is a Cloud Storage FUSE mount; 'true' or 'false' to skip detection")
+	fuse_buf   = flag.Int("gcs_fuse_buffer", storage.DefaultFuseBufferSize/1024, "KiB to buffer before writing into Cloud Storage FUSE files")
+	nfs_mode   = flag.String("network_fs", "auto", "'auto' detects if 'directory' is a network filesystem such as NFS or Filestore; 'true' or 'false' to skip detection")
+	nfs_buf    = flag.Int("network_fs_buffer", 1024, "KiB to buffer before writing into files in network filesystems")
+	nfs_sync   = secondsFlag("network_fs_sync", 10, "seconds between syncs of files written into network filesystems; 0 only syncs them when they are rotated")
+	spill_dir  = flag.String("spill_dir", "", "slower directory, i/e: a persistent volume or a Cloud Storage FUSE mount, where PCAP files are moved into in the background as soon as they are rotated, so that 'directory' may be a fast in-memory volume")
+	mem_budget = flag.Int("tmpfs_budget", 25, "percentage of the instance memory that PCAP files may use when 'directory' is in-memory; 0 disables the guard")
+	mem_rotate = secondsFlag("tmpfs_interval", 15, "max seconds after which PCAP files are rotated when 'directory' is in-memory")
+	min_free   = flag.Int("directory_min_free", 16, "MiB that must be available in 'directory' at startup; 0 only verifies that it is writable")
+	disk_guard = flag.Bool("disk_guard", true, "pause engines while 'directory' has less than 'directory_min_free' MiB available or writes fail with ENOSPC, and resume them once space is recovered")
+	metrics    = flag.Bool("metrics", false, "push packet capture metrics into Cloud Monitoring")
+	metrics_to = secondsFlag("metrics_interval", 60, "seconds between pushes of packet capture metrics")
+	ifstats_on = flag.Bool("iface_stats", false, "sample the traffic of every iface using dedicated handles which only read packet headers, and publish packets, bytes, rates and their breakdown by protocol every 'iface_stats_interval', even while no PCAP files are being written")
+	ifstats_to = secondsFlag("iface_stats_interval", 60, "seconds between samples published by 'iface_stats'")
+	exec_dirs  = flag.Bool("execution_dirs", false, "write the files of every execution, along with its manifest, into '<directory>/<job>/<execution>/' instead of directly into 'directory'")
+	summary_to = flag.String("summary_dir", "", "directory where a JSON summary of every execution is written")
+	hist_size  = flag.Int("history", 10, "amount of the last execution summaries kept in memory and served by 'http_addr' as 'GET /executions'; 0 disables the history")
+	hist_file  = flag.String("history_file", "", "file where the summaries kept by 'history' are saved, so that they are restored when 'tcpdumpw' restarts; i/e: '/pcap-tmp/executions.json'")
+	http_addr  = flag.String("http_addr", "", "address where the HTTP API is served; i/e: '127.0.0.1:8081'. Disabled by default")
+	state_f    = flag.String("state_file", "", "file where the state of jobs and executions is persisted, so that it is restored when 'tcpdumpw' restarts; i/e: '/pcap-tmp/tcpdumpw.state'")
+	max_eps    = flag.Int("jsonlog_max_eps", 0, "max JSON PCAP records per second written to standard output by each iface; 0 disables rate limiting")
+	eps_tail   = flag.Int("jsonlog_tail", 0, "amount of the 'jsonlog_max_eps' records that are the last ones received during each second")
+	redact     = flag.String("redact", "", "comma separated list of redaction rules applied to JSON records: 'email', 'card', 'token', 'authorization', 'all' and JSONPath expressions such as '$.HTTP.headers.X-User'")
+	redact_re  = flag.String("redact_regex", "", "regular expression whose matches are masked in the application payload of JSON records")
+	stamp_exe  = flag.Bool("stamp_execution", false, "stamp the job, execution, window, profile and tags of the current execution onto every JSON translated packet as 'EXECUTION'")
+	hdrs_only  = flag.Bool("headers_only", false, "truncate every packet right after its transport header, so that no application payload is ever written into PCAP files nor JSON records")
+	anon_key   = flag.String("anonymize_key", "", "Secret Manager secret holding the key used to anonymize IP addresses in PCAP files and JSON records; i/e: 'projects/<project>/secrets/<secret>'")
+	json_pl    = flag.String("json_payload", l7.PayloadText, "how application payload is embedded into JSON records: 'text' as translated, 'none', 'base64[:maxbytes]' or 'hex[:maxbytes]'")
+	pl_match   = flag.String("payload_match", "", "regular expression that the payload of JSON records must match for them to be written; i/e: a request ID or a SQL statement")
+	pl_scope   = flag.String("payload_match_scope", l7.MatchScopeFlow, "'packet' writes only the JSON records that match 'payload_match', 'flow' writes all the records of flows with at least 1 match")
+	log_sink   = flag.String("log_sink", "", "syslog or GELF endpoint to ship log entries to; i/e: 'syslog+tls://siem.example.com:6514' or 'gelf+udp://graylog:12201'")
+	sink_pcap  = flag.Bool("log_sink_packets", false, "ship JSON PCAP records into 'log_sink' instead of standard output")
+	notify_url = flag.String("notify_webhook", "", "URL of a webhook to be notified when an execution completes")
+	notify_fmt = flag.String("notify_format", notify.FormatJSON, "format of webhook notifications: 'json' or 'slack'")
+	tcp_anlys  = flag.Bool("tcp_analysis", false, "find TCP retransmissions, duplicate ACKs, out of order segments, zero windows and stalled flows in JSON translated packets")
+	open_to    = secondsFlag("capture_open_timeout", 30, "seconds to retry opening a capture on every iface while it fails with transient errors before the iface is skipped; 0 disables the check")
+	max_engine = flag.Int("max_concurrent_engines", 0, "max PCAP engines running at the same time across all ifaces and executions; engines beyond it are queued by 'engine_priority'; 0 means unlimited")
+	eng_prio   = flag.String("engine_priority", "", "comma separated iface prefixes in decreasing priority used to queue engines beyond 'max_concurrent_engines'; other ifaces follow by index, and loopback is always last")
+	rot_grace  = secondsFlag("rotation_grace", 10, "seconds a task may keep writing into a file beyond 'interval' before a missed rotation is logged as a WARNING; 0 disables rotation alerts")
+	stall_to   = secondsFlag("stall_timeout", 0, "seconds 'tcpdump' may go without writing into PCAP files while its iface receives packets before it is restarted; 0 disables the watchdog")
+	tcp_stall  = secondsFlag("tcp_stall_timeout", 10, "seconds a TCP flow may go without progress before it is reported as stalled by 'tcp_analysis'; 0 disables stall detection")
+	tcp_rtt    = flag.Bool("tcp_latency", false, "measure TCP handshakes and time to first byte in JSON translated packets")
+	tcp_rtt_to = secondsFlag("tcp_latency_interval", 60, "seconds between reports of TCP latency percentiles for every destination")
+	tcp_close  = flag.Bool("tcp_close", false, "report TCP connections that are reset, or that time out without being closed")
+	rst_alert  = flag.Int("rst_alert_threshold", 0, "amount of TCP resets within a minute that raises an ERROR; 0 disables alerts")
+	conn_tbl   = flag.Bool("conn_table", false, "track the state of TCP connections from SYN, FIN and RST segments, and report open, half-open and closing connections per peer")
+	conn_to    = secondsFlag("conn_table_interval", 60, "seconds between snapshots of the TCP connection table")
+	dns_log    = flag.Bool("dns", false, "log DNS queries paired with their responses, including answers and latency")
+	tls_keylog = flag.String("tls_keylog", "", "path of the SSLKEYLOGFILE written by the APP into a shared volume, used to decrypt TLS sessions on 'tls_ports' and analyze them as HTTP/1.x or HTTP/2")
+	tls_ports  = flag.String("tls_ports", "443", "comma separated list of ports where the TLS sessions to be decrypted using 'tls_keylog' are established")
+	tls_log    = flag.Bool("tls", false, "log the SNI, ALPN, negotiated version and cipher, and JA3/JA4 fingerprints of TLS handshakes")
+	http_ports = flag.String("http_ports", "", "comma separated list of ports where plaintext HTTP/1.x servers listen; every transaction is logged")
+	h2_ports   = flag.String("h2_ports", "", "comma separated list of ports where cleartext HTTP/2 ( h2c ) servers listen; stream level events are logged")
+	grpc_log   = flag.Bool("grpc", false, "summarize gRPC calls on 'h2_ports' including service, method, status and message sizes")
+	ws_log     = flag.Bool("websocket", false, "summarize connections upgraded to WebSocket on 'http_ports' including frame counts, sizes and close codes")
+	trace_corr = flag.Bool("trace_correlation", false, "attach the Cloud Trace span propagated by 'X-Cloud-Trace-Context' or 'traceparent' headers to the rest of the packets and flow records of the connection")
+	flows_log  = flag.Bool("flows", false, "aggregate JSON translated packets into 5-tuple flow records with packets, bytes and TCP flags")
+	flows_to   = secondsFlag("flows_interval", 60, "seconds between exports of active flow records; flows are also exported when they expire")
+	mtu_log    = flag.Bool("mtu", false, "detect IP fragmentation, ICMP 'fragmentation needed' messages, clamped MSS announcements and path MTU blackholes")
+	icmp_log   = flag.Bool("icmp", false, "summarize ICMP and ICMPv6 errors ( unreachable, time exceeded, admin prohibited ) and attribute them to the original flow")
+	quic_log   = flag.Bool("quic", false, "log the SNI, ALPN and JA4 fingerprint of QUIC connections, follow their connection IDs, and report the QUIC vs TCP traffic split per destination")
+	quic_to    = secondsFlag("quic_interval", 60, "seconds between reports of the QUIC vs TCP traffic split for every destination")
+	anomalies  = flag.Bool("anomalies", false, "flag SYN floods, port scans and traffic to unexpected destinations as WARNING and ERROR events")
+	syn_flood  = flag.Int("anomaly_syn_rate", 1000, "connection attempts per second on a single iface that are reported as a SYN flood; 0 disables SYN flood detection")
+	scan_ports = flag.Int("anomaly_scan_ports", 50, "distinct destination ports within a minute that a single source may try to connect to before it is reported as a port scan; 0 disables port scan detection")
+	allowed_to = flag.String("allowed_destinations", "", "comma separated list of CIDRs that may be contacted; connections to any other destination are reported when 'anomalies' is enabled")
+	geoip_db   = flag.String("geoip_db", "", "comma separated list of MMDB databases, as local paths or 'gs://<bucket>/<object>' URLs, used to annotate external IPs with country and ASN")
+	rdns_log   = flag.Bool("rdns", false, "annotate external IPs in JSON translated packets and flow records with hostnames from PTR records; lookups are cached and never delay capturing")
+	rdns_cache = flag.Int("rdns_cache_size", 10000, "maximum amount of hostnames kept in the reverse DNS cache")
+	ipfix_to   = flag.String("ipfix_collector", "", "IPFIX or NetFlow v9 collector to export flow records to; i/e: 'collector:4739' or 'netflow9+udp://collector:2055'")
+	mtls_cert  = flag.String("mtls_cert", "", "client certificate presented to 'log_sink' and 'ipfix_collector', as a PEM file or a Secret Manager secret; mutual TLS is required when set")
+	mtls_key   = flag.String("mtls_key", "", "private key of 'mtls_cert', as a PEM file or a Secret Manager secret")
+	mtls_ca    = flag.String("mtls_ca", "", "CAs used to verify 'log_sink' and 'ipfix_collector', as a PEM file or a Secret Manager secret; system CAs are used when empty")
+	spiffe_id  = flag.String("mtls_spiffe_id", "", "SPIFFE ID that 'log_sink' and 'ipfix_collector' must present instead of a matching hostname; i/e: 'spiffe://example.org/collector' or 'spiffe://example.org'")
+	mtls_rld   = flag.Duration("mtls_reload", 5*time.Minute, "interval between reloads of 'mtls_cert', 'mtls_key' and 'mtls_ca', so that rotated certificates are used by new connections")
+	secret_rfr = flag.Duration("secret_refresh", 5*time.Minute, "interval between refreshes of 'notify_webhook' and 'log_sink' when they reference Secret Manager secrets as 'sm://projects/<project>/secrets/<secret>'; 0 disables refreshes")
+	win_slot   = flag.Duration("window_slot", 0, "length of the wall-clock slots executions are identified by, i/e: '1m' or '1h'; executions of all instances started within the same slot share a window ID, i/e: '2024-05-01T03:00Z', which is added to log entries, summaries, and the names of exported files; 0 disables window IDs")
+	shutdown_g = flag.Duration("shutdown_grace", 8*time.Second, "time to stop tasks, flush writers and signal exports after SIGTERM or SIGINT before exiting regardless; 0 waits indefinitely")
+	heartbeat  = flag.Duration("heartbeat", 60*time.Second, "interval between heartbeats describing the scheduler state; 0 disables heartbeats")
+	otlp_url   = flag.String("otlp_endpoint", "", "OTLP/HTTP endpoint to export traces and metrics to; i/e: 'http://127.0.0.1:4318'")
 )
 
 type (
 	pcapTask struct {
-		engine  pcap.PcapEngine   `json:"-"`
-		writers []pcap.PcapWriter `json:"-"`
-		iface   string            `json:"-"`
+		*capture.Task `json:"-"`
+		// rate limits JSON PCAP records written into standard output; may be `nil`
+		sampler *sampling.RateLimitedWriter `json:"-"`
+		// finds TCP anomalies in JSON translated packets; may be `nil`
+		analyzer *analysis.TCPAnalyzer `json:"-"`
+		// measures TCP latency in JSON translated packets; may be `nil`
+		latency *analysis.LatencyAnalyzer `json:"-"`
+		// aggregates JSON translated packets into flow records; may be `nil`
+		flows *analysis.FlowAnalyzer `json:"-"`
+		// stamps the current execution onto JSON translated packets; may be `nil`
+		execution *execution.Annotator `json:"-"`
+		// counts failed TLS handshakes; may be `nil`
+		tls *analysis.TLSAnalyzer `json:"-"`
+		// splits traffic between QUIC and TCP; may be `nil`
+		quic *analysis.QUICAnalyzer `json:"-"`
+		// tracks the state of TCP connections; may be `nil`
+		conns *analysis.ConnTable `json:"-"`
+		// files written by this task are named `<prefix>*.<extension>`, written into `directory` and rotated every `interval`
+		prefix    string        `json:"-"`
+		extension string        `json:"-"`
+		directory string        `json:"-"`
+		interval  time.Duration `json:"-"`
+	}
+
+	// recoveryManifest lists the files left behind by previous executions found at startup, and what was done with them.
+	recoveryManifest struct {
+		Directory string            `json:"directory"`
+		Policy    string            `json:"policy"`
+		Created   time.Time         `json:"created"`
+		Bytes     int64             `json:"bytes"`
+		Files     []*storage.Repair `json:"files"`
+		Tags      map[string]string `json:"tags,omitempty"`
+		// IDs of the executions which wrote the files, by path; only available if 'state_file' is set
+		Executions map[string]string `json:"executions,omitempty"`
+	}
+
+	// pcapTaskConfig describes the tasks of a job: what they capture, and what is done with the packets they capture.
+	pcapTaskConfig struct {
+		capture.Config
+		// tells apart the files of tasks of different profiles
+		label string
+		// sinks declared by the profile; they replace all others
+		sinks []*profiles.Sink
+		// JSON translated packets are written into files, or into standard output, at up to `maxEPS` records per second
+		jsondump, jsonlog bool
+		maxEPS, epsTail   int
+		// analyzers fed with JSON translated packets, or with TCP payloads
+		tcpAnalysis, tcpLatency, tcpClose, dns, tlsLog, grpc, flows, mtu, icmp bool
+		httpPorts, h2Ports                                                     []uint16
+		anomalies                                                              *analysis.AnomalyConfig
+	}
+
+	// pcapTaskHealth is the state of a task as reported by heartbeats and the `STATUS` control command.
+	pcapTaskHealth struct {
+		Iface  string `json:"iface"`
+		Engine string `json:"engine"`
+		health.Status
+	}
+
+	// shutdownProgress records the steps completed since the graceful shutdown began.
+	shutdownProgress struct {
+		mu      sync.Mutex
+		startTS time.Time
+		steps   []shutdownStep
+	}
+
+	shutdownStep struct {
+		Name    string `json:"name"`
+		Latency string `json:"latency"`
+	}
+
+	pcapTaskSummary struct {
+		Iface     string `json:"iface"`
+		Engine    string `json:"engine"`
+		Status    string `json:"status"`
+		Error     string `json:"error,omitempty"`
+		Packets   uint64 `json:"packets,omitempty"`
+		Bytes     uint64 `json:"bytes,omitempty"`
+		Rotations uint64 `json:"rotations"`
+		Restarts  uint64 `json:"restarts,omitempty"`
+		Files     uint64 `json:"files"`
+		FileBytes uint64 `json:"file_bytes"`
+		// only available when TCP analysis is enabled
+		TCP *analysis.Totals `json:"tcp,omitempty"`
+	}
+
+	pcapExecutionSummary struct {
+		Job       string                          `json:"job"`
+		Execution string                          `json:"execution"`
+		Window    string                          `json:"window,omitempty"`
+		Mode      string                          `json:"mode"`
+		Status    string                          `json:"status"`
+		Timeout   string                          `json:"timeout"`
+		Duration  string                          `json:"duration"`
+		Start     time.Time                       `json:"start"`
+		End       time.Time                       `json:"end"`
+		Tasks     []*pcapTaskSummary              `json:"tasks"`
+		Ifaces    map[string]*stats.IfaceCounters `json:"ifaces,omitempty"`
+		Tags      map[string]string               `json:"tags,omitempty"`
+		exitCode  int                             `json:"-"`
+	}
+
+	// pcapExecutionManifest describes an execution from within its own directory.
+	pcapExecutionManifest struct {
+		Summary *pcapExecutionSummary `json:"summary"`
+		// files written into the execution directory
+		Files []*pcapManifestFile `json:"files"`
+	}
+
+	pcapManifestFile struct {
+		Name string `json:"name"`
+		// Sequence is the position of the file among the ones created by the same task, if file names include it.
+		Sequence uint64 `json:"sequence,omitempty"`
+	}
+
+	// pcapExecutionStats holds the state of all counters when an execution starts.
+	pcapExecutionStats struct {
+		startTS time.Time
+		tasks   map[*pcapTask]stats.CountersSnapshot
+		tcp     map[*pcapTask]analysis.Totals
+		ifaces  map[string]*stats.IfaceCounters
+		files   *stats.FileTracker
 	}
 
 	tcpdumpJob struct {
-		j     *gocron.Job     `json:"-"`
-		Xid   string          `json:"xid,omitempty"`
-		Jid   string          `json:"jid,omitempty"`
-		Name  string          `json:"name,omitempty"`
-		Tags  []string        `json:"-"`
-		tasks []*pcapTask     `json:"-"`
-		ctx   context.Context `json:"-"`
+		j     *capture.Job  `json:"-"`
+		exe   *atomic.Value `json:"-"` // ID of the current execution; `nil` if the job uses the process wide one
+		Xid   string        `json:"xid,omitempty"`
+		Wid   string        `json:"wid,omitempty"`
+		Jid   string        `json:"jid,omitempty"`
+		Name  string        `json:"name,omitempty"`
+		Tags  []string      `json:"-"`
+		tasks []*pcapTask   `json:"-"`
+		// the profile the job executes; `nil` if it executes the default schedule
+		profile *profiles.Profile `json:"-"`
+		// summary of the last execution
+		summary *pcapExecutionSummary `json:"-"`
+	}
+
+	pcapHeartbeat struct {
+		Uptime      string            `json:"uptime"`
+		UptimeSecs  int64             `json:"uptime_secs"`
+		NextRun     *time.Time        `json:"next_run,omitempty"`
+		ActiveTasks int32             `json:"active_tasks"`
+		Executions  uint64            `json:"executions"`
+		Packets     uint64            `json:"packets"`
+		Rotations   uint64            `json:"rotations"`
+		Suppressed  uint64            `json:"suppressed,omitempty"`
+		FileBytes   uint64            `json:"file_bytes"`
+		Disk        *storage.Usage    `json:"disk,omitempty"`
+		Engines     *governor.Usage   `json:"engines,omitempty"`
+		Probe       *probe.Status     `json:"probe,omitempty"`
+		Tasks       []*pcapTaskHealth `json:"tasks"`
+	}
+
+	pcapNotification struct {
+		Service     string                `json:"service,omitempty"`
+		Revision    string                `json:"revision,omitempty"`
+		Instance    string                `json:"instance,omitempty"`
+		Destination string                `json:"destination,omitempty"`
+		Console     string                `json:"console,omitempty"`
+		Files       []string              `json:"files"`
+		MoreFiles   int                   `json:"more_files,omitempty"`
+		Summary     *pcapExecutionSummary `json:"summary"`
+	}
+
+	metricsSink struct {
+		name  string
+		write func(context.Context, time.Time, []*stats.Point) error
+	}
+
+	// pcapWindow starts an execution when the first request window is opened,
+	// and stops it when the last one is closed ( after lingering for a while ).
+	pcapWindow struct {
+		mu       sync.Mutex
+		ctx      context.Context
+		job      *tcpdumpJob
+		linger   time.Duration
+		requests uint64
+		cancel   context.CancelFunc
+		done     chan struct{}
+		timer    *time.Timer
 	}
 
 	jLogLevel string
 
+	// see: https://cloud.google.com/logging/docs/structured-logging#special-payload-fields
 	jLogEntry struct {
-		Severity  jLogLevel        `json:"severity"`
-		Message   string           `json:"message"`
-		Sidecar   string           `json:"sidecar"`
-		Module    string           `json:"module"`
-		Job       tcpdumpJob       `json:"job,omitempty"`
-		Tags      []string         `json:"tags,omitempty"`
-		Timestamp map[string]int64 `json:"timestamp,omitempty"`
+		Severity  string            `json:"severity"`
+		Message   string            `json:"message"`
+		Sidecar   string            `json:"sidecar"`
+		Module    string            `json:"module"`
+		Job       tcpdumpJob        `json:"job,omitempty"`
+		Tags      []string          `json:"tags,omitempty"`
+		Data      interface{}       `json:"data,omitempty"`
+		Timestamp map[string]int64  `json:"timestamp,omitempty"`
+		Labels    map[string]string `json:"logging.googleapis.com/labels,omitempty"`
+		Trace     string            `json:"logging.googleapis.com/trace,omitempty"`
+		SpanID    string            `json:"logging.googleapis.com/spanId,omitempty"`
+		// see: https://cloud.google.com/error-reporting/docs/formatting-error-messages
+		Type           string               `json:"@type,omitempty"`
+		ServiceContext *errorServiceContext `json:"serviceContext,omitempty"`
+		Context        *errorContext        `json:"context,omitempty"`
+		StackTrace     string               `json:"stack_trace,omitempty"`
+	}
+
+	// exitRecord is the last entry written before the process exits.
+	exitRecord struct {
+		Code   int    `json:"code"`
+		Class  string `json:"class"`
+		Reason string `json:"reason"`
+	}
+
+	buildInfo struct {
+		Version string   `json:"version"`
+		Commit  string   `json:"commit,omitempty"`
+		Date    string   `json:"date,omitempty"`
+		Go      string   `json:"go"`
+		Libpcap string   `json:"libpcap"`
+		Tags    string   `json:"tags,omitempty"`
+		Engines []string `json:"engines"`
+	}
+
+	// configFlag is the resolved value of a flag, and where it was taken from: `default`, `env` or `flag`.
+	configFlag struct {
+		Value  string `json:"value"`
+		Source string `json:"source"`
+	}
+
+	// effectiveConfig is the configuration which is actually used, after environment variables,
+	// the command line and defaults are merged, and after values derived at startup are applied.
+	effectiveConfig struct {
+		Flags   map[string]*configFlag `json:"flags"`
+		Derived map[string]any         `json:"derived"`
+	}
+
+	errorServiceContext struct {
+		Service string `json:"service"`
+		Version string `json:"version,omitempty"`
+	}
+
+	errorReportLocation struct {
+		FilePath     string `json:"filePath"`
+		LineNumber   int    `json:"lineNumber"`
+		FunctionName string `json:"functionName"`
+	}
+
+	errorContext struct {
+		ReportLocation *errorReportLocation `json:"reportLocation,omitempty"`
 	}
 )
 
 var (
-	projectID         string = os.Getenv("PROJECT_ID")
 	ifacePrefixEnvVar string = os.Getenv("PCAP_IFACE")
 	sidecarEnvVar     string = os.Getenv("APP_SIDECAR")
 	moduleEnvVar      string = os.Getenv("PROC_NAME")
 	gaeEnvVar         string = os.Getenv("GCP_GAE")
 	hcPortEnvVar      string = os.Getenv("PCAP_HC_PORT")
+	gcsBucketEnvVar   string = os.Getenv("PCAP_GCS_BUCKET")
+	gcsDirEnvVar      string = os.Getenv("GCS_DIR")
 )
 
-var wg sync.WaitGroup
+var identity *gcp.Identity = gcp.NewIdentityFromEnv()
+
+// files written into a Cloud Storage FUSE mount require a different write strategy
+var isGCSFuse bool = false
+
+// isNetworkFs is `true` when small writes and renames in `directory` are round trips to a file server
+var isNetworkFs bool = false
+
+// spiller moves rotated PCAP files from `directory` into `spill_dir`; it is `nil` if `spill_dir` is not set
+var spiller *storage.Spiller = nil
+
+// executions in progress; tasks are waited for by their own execution, which abandons the ones that never stop
+var executionsWG sync.WaitGroup
 
 var jid, xid atomic.Value
 
 var jobs *haxmap.Map[string, *tcpdumpJob]
 
+var executions atomic.Uint64
+
+// persists the state of jobs and executions across restarts; `nil` if 'state_file' is not set
+var stateStore *state.Store = nil
+
+// amount of ended executions kept in the state file
+const stateHistory = 20
+
+// summaries of the last executions served as `GET /executions`; `nil` if 'history' is 0
+var executionHistory *history.Ring = nil
+
+// resetAlerts is `nil` when alerts for bursts of TCP resets are disabled
+var resetAlerts *analysis.BurstDetector = nil
+
+var activeTasks atomic.Int32
+
+// markerProbe is `nil` when the synthetic traffic probe is disabled
+var markerProbe *probe.Probe = nil
+
+var startTime = time.Now()
+
+// tracer is `nil` when OTLP is disabled; spans created using a `nil` tracer are no-ops
+var tracer *otlp.Exporter = nil
+
+var currentExecution atomic.Pointer[otlp.Span]
+
+// windows holds the window ID of the current execution of every job, keyed by job name; it is empty if window IDs are disabled.
+var (
+	windowsMu sync.Mutex
+	windows   = map[string]string{}
+)
+
+// receivedSignal is `nil` unless the process is terminating because of a signal
+var receivedSignal atomic.Pointer[os.Signal]
+
+// shutdown records the steps of the graceful shutdown which completed within `shutdown_grace`
+var shutdown = &shutdownProgress{}
+
+// keyLog is `nil` when TLS sessions are not decrypted
+var keyLog *analysis.KeyLog = nil
+
+// auditStream is `nil` when control-plane actions are not recorded
+var auditStream *audit.Stream = nil
+
+// webhook is `nil` when execution notifications are disabled
+var webhook atomic.Pointer[notify.Webhook]
+
+// logSink is `nil` when log entries are only written into standard output
+var logSink atomic.Pointer[logsink.Sink]
+
+// geoDatabase is `nil` when external IPs are not annotated with their location
+var geoDatabase *geoip.Database = nil
+
+// rdnsResolver is `nil` when external IPs are not annotated with their hostname
+var rdnsResolver *rdns.Resolver = nil
+
+// payloadMode controls how the application payload is embedded into JSON translated packets
+var payloadMode *l7.PayloadMode = nil
+
+// payloadPattern is `nil` when JSON translated packets are written regardless of their payload
+var (
+	payloadPattern *regexp.Regexp = nil
+	payloadScope   string         = l7.MatchScopeFlow
+)
+
+// traceTable is `nil` when packets and flow records are not correlated with the traces of HTTP requests
+var traceTable *analysis.TraceTable = nil
+
+// redactionRules is `nil` when JSON translated packets are written without masking personal data
+var redactionRules *l7.RedactionRules = nil
+
+// anonymizer is `nil` when IP addresses are written as captured
+var anonymizer *anonymize.Anonymizer = nil
+
+// mtlsCredentials is `nil` when network exports do not require mutual TLS
+var mtlsCredentials *mtls.Credentials = nil
+
+// flowExporter is `nil` when flow records are only logged
+var flowExporter *ipfix.Exporter = nil
+
+// diskGuard is `nil` when engines are not paused if the PCAP files directory runs out of space
+var diskGuard *storage.DiskGuard = nil
+
+// engines is `nil` when the amount of PCAP engines running at the same time is not limited
+var engines *governor.Governor = nil
+
 var emptyTcpdumpJob = tcpdumpJob{Jid: uuid.Nil.String()}
 
 var (
-	errTcpdumpDisabled  = errors.New("GCS PCAP export disabled")
+	errNoPcapEngine     = errors.New("no engine is able to write PCAP files in this environment")
+	errNoJSONEngine     = errors.New("no engine is able to translate packets into JSON in this environment")
 	errJsondumpDisabled = errors.New("GCS JSON export disabled")
-	errJSONLogDisabled  = errors.New("STDOUT JSON log disabled")
-	errGaeDisabled      = errors.New("GAE JSON log disabled")
+	errLogSinkDisabled  = errors.New("log sink is not available")
+	// engines paused because of it are restarted as soon as space is recovered
+	errDiskFull = fmt.Errorf("%w: the PCAP files directory ran out of space", capture.ErrPaused)
 )
 
 var gaeJSONInterval = 0 // disable time based file rotation
 
+var errNoWindowOpen = errors.New("no request window is open")
+
+const (
+	INFO    jLogLevel = "INFO"
+	WARNING jLogLevel = "WARNING"
+	ERROR   jLogLevel = "ERROR"
+	FATAL   jLogLevel = "FATAL"
+)
+
+// Cloud Logging does not define a `FATAL` severity;
+// see: https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#LogSeverity
+var cloudLoggingSeverity = map[jLogLevel]string{
+	INFO:    "INFO",
+	WARNING: "WARNING",
+	ERROR:   "ERROR",
+	FATAL:   "CRITICAL",
+}
+
+const (
+	gaeFileOutput       = `/var/log/app_engine/app/app_pcap__` + capture.FileNamePattern
+	pcapLockFile        = "/var/lock/pcap.lock"
+	recoveredSignalName = "TCPDUMPW_RECOVERED"
+	windowSignalName    = "TCPDUMPW_WINDOW"
+	// replacements of files are staged here on network filesystems
+	stagingDirName = ".staging"
+	// with 'execution_dirs', files are written into `<directory>/<job>/<execution>/` through the link `<directory>/<job>/current`
+	currentExecutionDir   = "current"
+	executionManifestName = "execution.json"
+	executionDirDepth     = 2
+	tagsProperty          = "TAGS"
+	executionProperty     = "EXECUTION"
+	defaultPcapFilter     = "(tcp or udp or icmp or icmp6) and (ip or ip6)"
+)
+
+const (
+	leftoverPolicyExport = "export"
+	leftoverPolicyDelete = "delete"
+	leftoverPolicyKeep   = "keep"
+)
+
+const (
+	sidecarMode = "sidecar"
+	jobMode     = "job"
+	liveEngine  = "live"
+	fileEngine  = "file"
+	windowMode  = "window"
+)
+
 const (
-	INFO  jLogLevel = "INFO"
-	ERROR jLogLevel = "ERROR"
-	FATAL jLogLevel = "FATAL"
+	pcapStatusSuccess = "success"
+	pcapStatusPartial = "partial"
+	pcapStatusFailure = "failure"
 )
 
+// exit codes are stable: orchestration and alerting may react to each class of failure.
 const (
-	fileNamePattern      = "%d_%s__%%Y%%m%%dT%%H%%M%%S"
-	runFileOutput        = `%s/part__` + fileNamePattern
-	gaeFileOutput        = `/var/log/app_engine/app/app_pcap__` + fileNamePattern
-	pcapLockFile         = "/var/lock/pcap.lock"
-	defaultPcapFilter    = "(tcp or udp or icmp or icmp6) and (ip or ip6)"
-	devicesRegexTemplate = "^(?:(?:lo$)|(?:(?:ipvlan-)?%s\\d+.*$))"
+	exitSuccess       = 0
+	exitConfigError   = 1
+	exitLockFailure   = 2
+	exitNoIfaces      = 3
+	exitEngineFailure = 4
+	exitHealthCheck   = 5
+	exitJobPartial    = 6
+	exitJobFailure    = 7
+	exitExportFailure = 8
+	exitPanic         = 9
+	exitShutdownGrace = 10
+	// the number of the signal is added, as shells do
+	exitSignaled = 128
 )
 
 const (
-	anyIfaceName  string = "any"
-	anyIfaceIndex int    = int(0)
+	// written by `pcap_fsn` once it exported the last PCAP files
+	exportedSignalName = "PCAPFSN_EXPORTED"
+	// how often to check whether `pcap_fsn` reported the result of exporting the last PCAP files
+	exportedCheckInterval = 100 * time.Millisecond
 )
 
+var exitClasses = map[int]string{
+	exitSuccess:       "success",
+	exitConfigError:   "config_error",
+	exitLockFailure:   "lock_failure",
+	exitNoIfaces:      "no_interfaces",
+	exitEngineFailure: "engine_failure",
+	exitHealthCheck:   "health_check_failure",
+	exitJobPartial:    "job_partial",
+	exitJobFailure:    "job_failure",
+	exitExportFailure: "export_failure",
+	exitPanic:         "panic",
+	exitShutdownGrace: "shutdown_timeout",
+}
+
+const (
+	mdsTimeout           = 2 * time.Second
+	readinessInterval    = 1 * time.Second
+	memoryVolumeInterval = 5 * time.Second
+	monitoringTimeout    = 10 * time.Second
+	otlpFlushInterval    = 10 * time.Second
+	fileTrackerInterval  = 1 * time.Second
+	spillInterval        = 2 * time.Second
+	notifyTimeout        = 10 * time.Second
+	tcpIdleTimeout       = 2 * time.Minute
+	resetAlertWindow     = 1 * time.Minute
+	dnsTimeout           = 5 * time.Second
+	tlsTimeout           = 10 * time.Second
+	flowIdleTimeout      = 30 * time.Second
+	anomalyScanWindow    = 1 * time.Minute
+	storageTimeout       = 30 * time.Second
+	secretTimeout        = 10 * time.Second
+	dryRunTimeout        = 5 * time.Second
+	rdnsTTL              = 10 * time.Minute
+	rdnsTimeout          = 2 * time.Second
+	diskGuardInterval    = 5 * time.Second
+	diskFlushInterval    = 30 * time.Second
+	// free space required to resume engines on top of twice 'directory_min_free'
+	diskResumeHeadroom = 16 * 1024 * 1024
+)
+
+const logMsgID = "log"
+
+// connection attempts per second are reported when they are this many times the average
+const synRateFactor = 5.0
+
+// only the busiest destinations are published as latency metrics, to bound the amount of time series
+const maxLatencyMetricDestinations = 20
+
+// notifications only list the first files: executions may produce thousands of them
+const maxNotificationFiles = 50
+
+const errorEventType = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+
+// newErrorReportLocation finds the 1st caller which is not a logging function.
+func newErrorReportLocation() *errorReportLocation {
+	pcs := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "main.jlog" && frame.Function != "main.jlogWithData" {
+			return &errorReportLocation{
+				FilePath:     filepath.Base(frame.File),
+				LineNumber:   frame.Line,
+				FunctionName: frame.Function,
+			}
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+func withErrorEvent(entry *jLogEntry) *jLogEntry {
+	entry.Type = errorEventType
+	entry.ServiceContext = &errorServiceContext{
+		Service: moduleEnvVar,
+		Version: identity.Revision,
+	}
+	if entry.ServiceContext.Service == "" {
+		entry.ServiceContext.Service = "tcpdumpw"
+	}
+	entry.Context = &errorContext{ReportLocation: newErrorReportLocation()}
+	// Error Reporting groups errors by their stack trace, which must start with the error message
+	entry.StackTrace = fmt.Sprintf("%s\n\n%s", entry.Message, debug.Stack())
+	return entry
+}
+
+// executionID returns the ID of the current execution of `job`; profiles are executed concurrently, so they keep their own.
+func executionID(job *tcpdumpJob) uuid.UUID {
+	if job.exe != nil {
+		return job.exe.Load().(uuid.UUID)
+	}
+	return xid.Load().(uuid.UUID)
+}
+
 func jlog(severity jLogLevel, job *tcpdumpJob, message string) {
+	jlogWithData(severity, job, message, nil)
+}
+
+func jlogWithData(severity jLogLevel, job *tcpdumpJob, message string, data interface{}) {
 	now := time.Now()
 
 	j := *job
-	// this is safe as only 1 concurrent job execution is ever allowed.
-	j.Xid = xid.Load().(uuid.UUID).String()
+	j.Xid = executionID(job).String()
+	j.Wid = windowID(job)
+
+	tags := j.Tags
+	if len(tags) == 0 {
+		// jobs are tagged with the identity; use it for non job related entries as well
+		tags = jobTags()
+	}
 
 	entry := &jLogEntry{
-		Severity: severity,
+		Severity: cloudLoggingSeverity[severity],
 		Message:  message,
 		Sidecar:  sidecarEnvVar,
 		Module:   moduleEnvVar,
 		Job:      j,
-		Tags:     j.Tags,
+		Tags:     tags,
+		Data:     data,
 		Timestamp: map[string]int64{
 			"seconds": now.Unix(),
 			"nanos":   int64(now.Nanosecond()),
 		},
+		Labels: newLogLabels(&j),
+	}
+
+	// correlate entries with the execution trace so that both are shown together
+	if span := currentExecution.Load(); span != nil && identity.ProjectID != "" {
+		entry.Trace = stringFormatter.Format("projects/{0}/traces/{1}", identity.ProjectID, span.TraceID())
+		entry.SpanID = span.SpanID()
+	}
+
+	isError := severity == ERROR || severity == FATAL
+
+	if *err_report && isError {
+		entry = withErrorEvent(entry)
 	}
 
 	jEntry, err := json.Marshal(entry)
@@ -179,283 +840,3465 @@ func jlog(severity jLogLevel, job *tcpdumpJob, message string) {
 		fmt.Fprintf(os.Stderr, "%+v\n", entry)
 		return
 	}
-	io.WriteString(os.Stdout, string(jEntry)+"\n")
-}
 
-func afterTcpdump(id uuid.UUID, name string) {
-	if job, jobFound := jobs.Get(id.String()); jobFound {
-		jlog(INFO, job, "execution complete")
-		j := *job.j
-		nextRun, _ := j.NextRun()
-		jlog(INFO, job, fmt.Sprintf("next execution: %v", nextRun))
+	out := os.Stdout
+	if isError {
+		out = os.Stderr
+	}
+	io.WriteString(out, string(jEntry)+"\n")
+
+	if sink := logSink.Load(); sink != nil {
+		sink.Send(&logsink.Entry{Severity: entry.Severity, MsgID: logMsgID, Payload: jEntry})
 	}
-	xid.Store(uuid.Nil) // reset execution id
 }
 
-func beforeTcpdump(id uuid.UUID, name string) {
-	if job, jobFound := jobs.Get(id.String()); jobFound {
-		j := *job.j
-		lastRun, _ := j.LastRun()
-		jlog(INFO, job, fmt.Sprintf("execution started ( last execution: %v )", lastRun))
+// newBuildInfo describes this build of `tcpdumpw`; VCS metadata embedded by the Go toolchain is used if it was not injected.
+func newBuildInfo() *buildInfo {
+	info := &buildInfo{
+		Version: buildVersion,
+		Commit:  buildCommit,
+		Date:    buildDate,
+		Go:      runtime.Version(),
+		Libpcap: libpcap.Version(),
+		Engines: []string{},
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "-tags":
+				info.Tags = setting.Value
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.Date == "":
+				info.Date = setting.Value
+			}
+		}
+	}
+	if *tcp_dump {
+		info.Engines = append(info.Engines, "tcpdump")
 	}
-	xid.Store(uuid.New())
+	if *json_dump {
+		info.Engines = append(info.Engines, "jsondump")
+	}
+	return info
 }
 
-func waitJobDone(
-	job *tcpdumpJob,
-	wg *sync.WaitGroup,
-	ctxDoneTS *time.Time,
-	deadline *time.Duration,
-	stopDeadline chan<- *time.Duration,
-) {
-	jobDoneSignal := make(chan struct{})
+// sensitiveFlags may hold credentials when they are not Secret Manager references.
+var sensitiveFlags = map[string]bool{
+	"notify_webhook": true,
+	"log_sink":       true,
+}
 
-	maxWaitTime := *deadline - time.Since(*ctxDoneTS)
-	timer := time.NewTimer(maxWaitTime)
+// newEffectiveConfig collects the value of every flag along with its source; `envFlags` are the flags set from environment variables.
+func newEffectiveConfig(envFlags []string, derived map[string]any) *effectiveConfig {
+	sources := map[string]string{}
+	for _, name := range envFlags {
+		sources[name] = "env"
+	}
+	flag.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
 
-	go func(wg *sync.WaitGroup, ctxDoneTS *time.Time, deadline *time.Duration, signal chan struct{}) {
-		jlog(INFO, job, fmt.Sprintf("waiting for PCAP job execution to stop | deadline: %v", *deadline))
-		for range job.tasks {
-			taskStopDeadline := *deadline - time.Since(*ctxDoneTS)
-			stopDeadline <- &taskStopDeadline
+	config := &effectiveConfig{
+		Flags:   map[string]*configFlag{},
+		Derived: derived,
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		source, ok := sources[f.Name]
+		if !ok {
+			source = "default"
 		}
-		// wait for tasks to gracefully stop
-		wg.Wait()
-		close(signal)
-	}(wg, ctxDoneTS, &maxWaitTime, jobDoneSignal)
+		value := f.Value.String()
+		if sensitiveFlags[f.Name] && value != "" && !gcp.IsSecretRef(value) {
+			value = "<redacted>"
+		}
+		config.Flags[f.Name] = &configFlag{Value: value, Source: source}
+	})
+	return config
+}
 
-	select {
-	case <-timer.C:
-		jlog(ERROR, job, "timed out waiting for PCAP job execution to stop")
-	case <-jobDoneSignal:
-		if !timer.Stop() {
-			<-timer.C
+// newLogLabels allows to filter entries by job, execution and instance;
+// Cloud Logging only accepts string values for labels.
+func newLogLabels(job *tcpdumpJob) map[string]string {
+	labels := map[string]string{
+		"sidecar":  sidecarEnvVar,
+		"module":   moduleEnvVar,
+		"instance": identity.InstanceID,
+		"revision": identity.Revision,
+		"account":  identity.ServiceAccount,
+		"version":  buildVersion,
+		"jid":      job.Jid,
+		"xid":      job.Xid,
+		"wid":      job.Wid,
+	}
+	for key, value := range labels {
+		if value == "" {
+			delete(labels, key)
+		}
+	}
+	// user defined tags are validated not to replace any of the labels above
+	for key, value := range user_tags.Map() {
+		if _, ok := labels[key]; !ok {
+			labels[key] = value
 		}
-		jlog(INFO, job, fmt.Sprintf("PCAP job execution stopped | latency: %v", time.Since(*ctxDoneTS)))
 	}
+	return labels
 }
 
-func start(ctx context.Context, timeout *time.Duration, job *tcpdumpJob) error {
-	var cancel context.CancelFunc
-	if *timeout > 0*time.Second {
-		ctx, cancel = context.WithTimeout(ctx, *timeout)
-		defer cancel()
-	}
+// reservedTagKeys are the labels of all log entries.
+var reservedTagKeys = []string{"sidecar", "module", "instance", "revision", "account", "version", "jid", "xid", "wid"}
 
-	stopDeadline := make(chan *time.Duration, len(job.tasks))
-	for _, task := range job.tasks {
-		wg.Add(1)
-		go func(ctx context.Context, wg *sync.WaitGroup, j *tcpdumpJob, t *pcapTask) {
-			defer wg.Done()
-			// all PCAP engines are context aware
-			err := t.engine.Start(ctx, t.writers, stopDeadline)
-			if err != nil {
-				jlog(INFO, j, fmt.Sprintf("PCAP task execution stopped: %s | %s", t.iface, err.Error()))
-			} else {
-				jlog(INFO, j, fmt.Sprintf("PCAP task execution stopped: %s", t.iface))
-			}
-		}(ctx, &wg, job, task)
-	}
+// jobTags returns the tags of scheduled jobs and log entries: the identity followed by the user defined tags.
+func jobTags() []string {
+	return append(identity.Tags(), user_tags.List()...)
+}
 
-	// wait for context cancel/timeout
-	<-ctx.Done()
-	ctxDoneTS := time.Now()
+func newTracer(ctx context.Context, endpoint *string) *otlp.Exporter {
+	// see: https://opentelemetry.io/docs/specs/semconv/resource/cloud/
+	exporter := otlp.NewExporter(*endpoint, "tcpdumpw", map[string]string{
+		"service.name":     "tcpdumpw",
+		"cloud.provider":   "gcp",
+		"cloud.platform":   "gcp_cloud_run",
+		"cloud.account.id": identity.ProjectID,
+		"cloud.region":     identity.Region,
+		"faas.name":        identity.Service,
+		"faas.version":     identity.Revision,
+		"faas.instance":    identity.InstanceID,
+	}, monitoringTimeout)
 
-	deadline := 2 * time.Second
-	waitJobDone(job, &wg, &ctxDoneTS, &deadline, stopDeadline)
-	close(stopDeadline)
+	go exporter.Run(ctx, otlpFlushInterval, func(err error) {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to export spans: %v", err))
+	})
 
-	return ctx.Err()
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("exporting traces and metrics to: %s", *endpoint))
+	return exporter
 }
 
-func tcpdump(timeout time.Duration) error {
-	jobID := jid.Load().(uuid.UUID)
-	exeID := xid.Load().(uuid.UUID)
-
-	var job *tcpdumpJob
-	var jobFound bool
-	if job, jobFound = jobs.Get(jobID.String()); !jobFound {
-		message := fmt.Sprintf("job[id:%s] not found", jobID)
-		jlog(ERROR, &emptyTcpdumpJob, message)
-		return fmt.Errorf(message)
+// newLogSink creates a sink for `endpoint`; errors refer to the `log_sink` flag, as endpoints may be secrets.
+func newLogSink(endpoint string) *logsink.Sink {
+	hostname := identity.InstanceID
+	if hostname == "" {
+		hostname, _ = os.Hostname()
 	}
-
-	// enable PCAP tasks with context awareness
-	id := fmt.Sprintf("job/%s/exe/%s", jobID.String(), exeID.String())
-	ctx := context.WithValue(job.ctx, pcap.PcapContextID, id)
-	ctx = context.WithValue(ctx, pcap.PcapContextLogName,
-		fmt.Sprintf("projects/%s/pcap/%s", projectID, id))
-
-	err := start(ctx, &timeout, job)
-	if err == context.DeadlineExceeded || err == context.Canceled {
-		// if context times out, it is a clean termination
+	appName := moduleEnvVar
+	if appName == "" {
+		appName = "tcpdumpw"
+	}
+	sink, err := logsink.NewSink(endpoint, hostname, appName, mtlsCredentials)
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to create log sink: %s | %v", *log_sink, err))
 		return nil
 	}
-	return err
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("shipping log entries to: %s", sink))
+	return sink
 }
 
-func newPcapConfig(
-	iface, format, output, extension, filter string,
-	filters []pcap.PcapFilterProvider,
-	compatFilters pcap.PcapFilters,
-	snaplen, interval int,
-	compat, ordered, conntrack bool,
-	ephemerals *pcap.PcapEmphemeralPorts,
-) *pcap.PcapConfig {
-	return &pcap.PcapConfig{
-		Compat:        compat,
-		Promisc:       true,
-		Iface:         iface,
-		Snaplen:       snaplen,
-		TsType:        "",
-		Format:        format,
-		Output:        output,
-		Extension:     extension,
-		Filter:        filter,
-		Interval:      interval,
-		Ordered:       ordered,
-		ConnTrack:     conntrack,
-		Filters:       filters,
-		CompatFilters: compatFilters,
-		Ephemerals:    ephemerals,
-	}
-}
-
-func createTasks(
-	ctx context.Context,
-	ifacePrefix, timezone, directory, extension, filter *string,
-	filters []pcap.PcapFilterProvider,
-	compatFilters pcap.PcapFilters,
-	snaplen, interval *int,
-	compat, tcpdump, jsondump, jsonlog, ordered, conntrack, gcpGAE *bool,
-	ephemerals *pcap.PcapEmphemeralPorts,
-) []*pcapTask {
-	tasks := []*pcapTask{}
+func closeLogSink() {
+	// entries logged from now on are only written into standard output
+	closeSink(logSink.Swap(nil))
+}
 
-	iface := ifacePrefixEnvVar
-	if iface == "" {
-		iface = *ifacePrefix
+func closeSink(sink *logsink.Sink) {
+	if sink == nil {
+		return
 	}
-
-	isGAE, err := strconv.ParseBool(gaeEnvVar)
-	isGAE = (err == nil && isGAE) || *gcpGAE
-
-	var devices []*pcap.PcapDevice = nil
-	if strings.EqualFold(iface, anyIfaceName) {
-		devices = []*pcap.PcapDevice{
-			{
-				NetInterface: &net.Interface{
-					Name:  anyIfaceName,
-					Index: anyIfaceIndex,
-				},
-			},
-		}
-	} else {
-		ifaceRegexp := regexp.MustCompile(fmt.Sprintf(devicesRegexTemplate, iface))
-		devices, _ = pcap.FindDevicesByRegex(ifaceRegexp)
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), monitoringTimeout)
+	defer closeCancel()
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("closing log sink: %s | dropped entries: %d", sink, sink.Dropped()))
+	if err := sink.Close(closeCtx); err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to close log sink: %s | %v", sink, err))
 	}
+}
 
-	for _, device := range devices {
-
-		netIface := device.NetInterface
-		iface := netIface.Name
-		ifaceAndIndex := fmt.Sprintf("%d/%s", netIface.Index, iface)
-
-		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configuring PCAP for iface: %s", ifaceAndIndex))
-
-		output := fmt.Sprintf(runFileOutput, *directory, netIface.Index, netIface.Name)
+// resolveSecretFlag calls `apply` with the value of the flag `name`, which may reference a Secret Manager secret as
+// `sm://projects/<project>/secrets/<secret>`; secrets are resolved again every `secret_refresh`, and `apply` is
+// called with their new payload when they are rotated. Only the names of secrets are logged.
+func resolveSecretFlag(ctx context.Context, name, value string, apply func(value string)) {
+	if !gcp.IsSecretRef(value) {
+		apply(value)
+		return
+	}
 
-		tcpdumpCfg := newPcapConfig(iface, "pcap", output, *extension, *filter, filters, compatFilters, *snaplen, *interval, *compat, *ordered, *conntrack, ephemerals)
-		jsondumpCfg := newPcapConfig(iface, "json", output, "json", *filter, filters, compatFilters, *snaplen, *interval, *compat, *ordered, *conntrack, ephemerals)
+	secretManagerClient := gcp.NewSecretManagerClient(gcp.NewMetadataClient(mdsTimeout), secretTimeout)
+	secretCtx, secretCancel := context.WithTimeout(ctx, secretTimeout)
+	resolved, err := secretManagerClient.Resolve(secretCtx, value)
+	secretCancel()
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to resolve secret: %s=%s | %v", name, value, err))
+		return
+	}
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("resolved secret: %s=%s", name, value))
+	apply(resolved)
 
-		// premature optimization is the root of all evil
-		var engineErr, writerErr error = nil, nil
-		var tcpdumpEngine, jsondumpEngine pcap.PcapEngine = nil, nil
-		var jsondumpWriter, jsonlogWriter, gaejsonWriter pcap.PcapWriter = nil, nil, nil // `tcpdump` does not use custom writers
+	if *secret_rfr <= 0 {
+		return
+	}
+	go secretManagerClient.Watch(ctx, value, resolved, *secret_rfr, func(rotated string, err error) {
+		if err != nil {
+			// the last resolved payload is kept
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to refresh secret: %s=%s | %v", name, value, err))
+			return
+		}
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("rotated secret: %s=%s", name, value))
+		apply(rotated)
+	})
+}
 
-		if *tcpdump {
-			tcpdumpEngine, engineErr = pcap.NewTcpdump(tcpdumpCfg)
+// loadGeoDatabase reads all MMDB databases from local files or Cloud Storage;
+// it returns `nil` if any of them is not available, so that records are never partially annotated.
+func loadGeoDatabase(ctx context.Context, locations *string) *geoip.Database {
+	storageClient := gcp.NewStorageClient(gcp.NewMetadataClient(mdsTimeout), storageTimeout)
+	buffers := [][]byte{}
+	for _, location := range strings.Split(*locations, ",") {
+		location = strings.TrimSpace(location)
+		if location == "" {
+			continue
+		}
+		var buffer []byte
+		var err error
+		if gcp.IsStorageURL(location) {
+			buffer, err = storageClient.Download(ctx, location)
 		} else {
-			engineErr = errTcpdumpDisabled
+			buffer, err = os.ReadFile(location)
 		}
-		if engineErr == nil {
-			tasks = append(tasks, &pcapTask{engine: tcpdumpEngine, writers: nil, iface: iface})
-			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured 'tcpdump' for iface: %s", ifaceAndIndex))
-		} else if *tcpdump {
-			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("tcpdump GCS writer creation failed: %s (%s)", ifaceAndIndex, engineErr))
+		if err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to load GeoIP database: %s | %v", location, err))
+			return nil
 		}
+		buffers = append(buffers, buffer)
+	}
+	database, err := geoip.NewDatabase(buffers...)
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to open GeoIP databases: %s | %v", *locations, err))
+		return nil
+	}
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("loaded GeoIP databases: %s", *locations))
+	return database
+}
 
-		// skip JSON setup if JSON pcap is disabled
-		if !*jsondump && !*jsonlog {
-			continue
-		}
+// loadAnonymizer creates an anonymizer whose key is the payload of the Secret Manager secret `name`.
+func loadAnonymizer(ctx context.Context, name *string) (*anonymize.Anonymizer, error) {
+	if !gcp.IsSecretName(*name) {
+		return nil, fmt.Errorf("invalid secret name: %s", *name)
+	}
+	secretManagerClient := gcp.NewSecretManagerClient(gcp.NewMetadataClient(mdsTimeout), secretTimeout)
+	secret, err := secretManagerClient.Access(ctx, *name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := anonymize.ParseKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	return anonymize.NewAnonymizer(key)
+}
 
-		engineErr = nil
-		jsondumpCfg.Ordered = *ordered
+// loadTLSMaterial reads PEM encoded certificates and keys from local files or Secret Manager secrets.
+func loadTLSMaterial(ctx context.Context, location string) ([]byte, error) {
+	if !gcp.IsSecretName(location) {
+		return os.ReadFile(location)
+	}
+	secretCtx, secretCancel := context.WithTimeout(ctx, secretTimeout)
+	defer secretCancel()
+	secretManagerClient := gcp.NewSecretManagerClient(gcp.NewMetadataClient(mdsTimeout), secretTimeout)
+	return secretManagerClient.Access(secretCtx, location)
+}
 
-		// some form of JSON packet capturing is enabled
-		jsondumpEngine, engineErr = pcap.NewPcap(jsondumpCfg)
-		if engineErr != nil {
-			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("jsondump task creation failed: %s (%s)", ifaceAndIndex, engineErr))
-			continue // abort all JSON setup for this device
-		}
+// loadMTLSCredentials loads the credentials used by all network exports, and reloads them every `mtls_reload`.
+func loadMTLSCredentials(ctx context.Context) (*mtls.Credentials, error) {
+	if *mtls_key == "" {
+		return nil, errors.New("'mtls_key' is required")
+	}
+	credentials, err := mtls.NewCredentials(ctx, *mtls_cert, *mtls_key, *mtls_ca, *spiffe_id, loadTLSMaterial)
+	if err != nil {
+		return nil, err
+	}
+	if *mtls_rld > 0 {
+		go credentials.Run(ctx, *mtls_rld, func(rotated bool, err error) {
+			if err != nil {
+				// connections keep using the last valid certificates
+				jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to reload mTLS credentials: %s | %v", credentials, err))
+			} else if rotated {
+				jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("rotated mTLS credentials: %s", credentials))
+			}
+		})
+	}
+	return credentials, nil
+}
 
-		pcapWriters := []pcap.PcapWriter{}
+func newFlowExporter(endpoint *string) *ipfix.Exporter {
+	labels := &ipfix.Labels{
+		Service:  identity.Service,
+		Revision: identity.Revision,
+		Instance: identity.InstanceID,
+	}
+	exporter, err := ipfix.NewExporter(*endpoint, labels, mtlsCredentials)
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to create flow exporter: %s | %v", *endpoint, err))
+		return nil
+	}
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("exporting flow records to: %s", exporter))
+	return exporter
+}
 
-		if *jsondump {
-			// writing JSON PCAP file is only enabled if `jsondump` is enabled
-			jsondumpWriter, writerErr = pcap.NewPcapWriter(ctx, &ifaceAndIndex, &output, &jsondumpCfg.Extension, timezone, *interval)
-		} else {
-			jsondumpWriter, writerErr = nil, errJSONLogDisabled
-		}
-		if writerErr == nil {
-			pcapWriters = append(pcapWriters, jsondumpWriter)
-			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured JSON '%s' writer for iface: %s", output, ifaceAndIndex))
-		} else if *jsondump {
-			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("jsondump GCS writer creation failed: %s (%s)", ifaceAndIndex, writerErr))
-		}
+func closeFlowExporter() {
+	if flowExporter == nil {
+		return
+	}
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), monitoringTimeout)
+	defer closeCancel()
+	err := flowExporter.Close(closeCtx)
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("closing flow exporter: %s | exported records: %d | dropped records: %d",
+		flowExporter, flowExporter.Exported(), flowExporter.Dropped()))
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to close flow exporter: %s | %v", flowExporter, err))
+	}
+}
 
-		// add `/dev/stdout` as an additional PCAP writer
-		if *jsonlog {
-			jsonlogWriter, writerErr = pcap.NewStdoutPcapWriter(ctx, &ifaceAndIndex)
-		} else {
-			jsonlogWriter, writerErr = nil, errJSONLogDisabled
-		}
-		if writerErr == nil {
-			pcapWriters = append(pcapWriters, jsonlogWriter)
-			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured JSON 'stdout' writer for iface: %s", ifaceAndIndex))
-		} else if *jsonlog {
-			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("jsondump stdout writer creation failed: %s (%s)", ifaceAndIndex, writerErr))
-		}
+func flushTracer() {
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), monitoringTimeout)
+	defer flushCancel()
+	if err := tracer.Flush(flushCtx); err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to export spans: %v", err))
+	}
+}
 
-		// handle GAE JSON logger
-		gaeOutput := ""
-		if isGAE {
-			gaeOutput = fmt.Sprintf(gaeFileOutput, netIface.Index, netIface.Name)
-			gaejsonWriter, writerErr = pcap.NewPcapWriter(ctx, &ifaceAndIndex, &gaeOutput, &jsondumpCfg.Extension, timezone, *interval)
-		} else {
-			gaejsonWriter, writerErr = nil, errGaeDisabled
-		}
-		if writerErr == nil {
-			pcapWriters = append(pcapWriters, gaejsonWriter)
-			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured GAE JSON '%s' writer for iface: %s", gaeOutput, ifaceAndIndex))
-		} else if isGAE {
-			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("jsondump GAE json writer creation failed: %s (%s)", ifaceAndIndex, errGaeDisabled))
-		}
+func resolveIdentity(ctx context.Context) {
+	mdsCtx, mdsCancel := context.WithTimeout(ctx, mdsTimeout)
+	defer mdsCancel()
 
-		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured 'jsondump' for iface: %s", ifaceAndIndex))
-		tasks = append(tasks, &pcapTask{engine: jsondumpEngine, writers: pcapWriters, iface: iface})
+	resolved, err := identity.Resolve(mdsCtx, gcp.NewMetadataClient(mdsTimeout))
+	// fields which were resolved are used even if others were not
+	if len(resolved) > 0 {
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("resolved identity using metadata server: %v", resolved))
+	}
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to resolve identity using metadata server: %v", err))
 	}
+}
 
-	return tasks
+// rotateWriters forces all tasks to start new files, and returns how many files were rotated; `tcpdump` is restarted
+// into a new file, and writers into standard output are not rotated.
+func rotateWriters(tasks []*pcapTask) uint32 {
+	rotatedWriters := uint32(0)
+	for _, task := range tasks {
+		rotatedWriters += uint32(task.Rotate())
+	}
+	currentExecution.Load().AddEvent("pcap.rotation", map[string]string{"writers": strconv.FormatUint(uint64(rotatedWriters), 10)})
+	return rotatedWriters
 }
 
-func startTCPListener(ctx context.Context, port *uint, job *tcpdumpJob, stopChannel chan<- bool) {
-	tcpListener, tcpListenerErr := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+// leftoverFileRegex matches the names of the files written by any task of any execution, i/e: `part__2_eth0__20240101T000000.pcap`;
+// the sequence number of the file is captured if it is included.
+func leftoverFileRegex(extension string) *regexp.Regexp {
+	return regexp.MustCompile(`^part__\d+_.+__\d{8}T\d{6}(?:\.\d{3})?(?:_(\d+))?\.(?:` + regexp.QuoteMeta(extension) + `|json)$`)
+}
 
-	if tcpListenerErr != nil {
-		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to start the TCP listener: %v", tcpListenerErr))
-		os.Exit(5)
+// findFiles returns the paths of the files in `directory` whose name matches `fileRegex`, including the ones in
+// execution directories ( `<directory>/<job>/<execution>/` ); symbolic links, i/e: to the current execution, are not followed.
+func findFiles(directory string, fileRegex *regexp.Regexp) ([]string, error) {
+	var find func(directory string, depth int) ([]string, error)
+	find = func(directory string, depth int) ([]string, error) {
+		entries, err := os.ReadDir(directory)
+		if err != nil {
+			return nil, err
+		}
+		paths := []string{}
+		for _, entry := range entries {
+			path := filepath.Join(directory, entry.Name())
+			if entry.IsDir() && depth < executionDirDepth {
+				if files, err := find(path, depth+1); err == nil {
+					paths = append(paths, files...)
+				}
+			} else if entry.Type().IsRegular() && fileRegex.MatchString(entry.Name()) {
+				paths = append(paths, path)
+			}
+		}
+		return paths, nil
+	}
+	return find(directory, 0)
+}
+
+// reconcileFiles repairs the files left behind in `directory` by previous executions, including the ones which did not stop
+// gracefully, and applies `policy` to them; empty files are removed as they contain no packets. It returns `nil` if there are none.
+func reconcileFiles(directory, extension *string, policy string) *recoveryManifest {
+	paths, err := findFiles(*directory, leftoverFileRegex(*extension))
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to scan for leftover files: %s | %v", *directory, err))
+		return nil
+	}
+
+	manifest := &recoveryManifest{
+		Directory: *directory,
+		Policy:    policy,
+		Created:   time.Now(),
+		Files:     []*storage.Repair{},
+		Tags:      user_tags.Map(),
+	}
+
+	for _, path := range paths {
+		repair, err := storage.RepairFile(path)
+		if err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to repair leftover file: %s | %v", path, err))
+			continue
+		}
+		if repair.Bytes == 0 {
+			os.Remove(path)
+			continue
+		}
+		if repair.Truncated > 0 {
+			jlogWithData(WARNING, &emptyTcpdumpJob,
+				fmt.Sprintf("recovered partial file: %s | records: %d | truncated: %d", path, repair.Records, repair.Truncated), repair)
+		}
+		manifest.Files = append(manifest.Files, repair)
+		manifest.Bytes += repair.Bytes
+		if owner, ok := stateStore.Owner(path); ok {
+			if manifest.Executions == nil {
+				manifest.Executions = map[string]string{}
+			}
+			manifest.Executions[path] = owner
+		}
+	}
+
+	if len(manifest.Files) == 0 {
+		return nil
+	}
+
+	switch policy {
+	case leftoverPolicyExport:
+		if err := signalRecoveredFiles(directory, manifest); err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to signal recovered files: %v", err))
+		}
+	case leftoverPolicyDelete:
+		for _, file := range manifest.Files {
+			if err := os.Remove(file.Path); err != nil {
+				jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to delete leftover file: %s | %v", file.Path, err))
+			}
+		}
+	}
+	return manifest
+}
+
+// signalRecoveredFiles lists the files in `manifest` in the file which signals `pcap_fsn` to export them.
+func signalRecoveredFiles(directory *string, manifest *recoveryManifest) error {
+	paths := make([]string, 0, len(manifest.Files))
+	for _, file := range manifest.Files {
+		paths = append(paths, file.Path)
+	}
+
+	// the list of files is written before the signal is created so that `pcap_fsn` never reads it partially
+	recoveredSignal := filepath.Join(*directory, recoveredSignalName)
+	content := []byte(strings.Join(paths, "\n") + "\n")
+	return replaceFile(recoveredSignal, content)
+}
+
+// reportRecovery logs the recovery manifest, and writes it into `summary_dir` along with execution summaries.
+func reportRecovery(manifest *recoveryManifest) {
+	jlogWithData(WARNING, &emptyTcpdumpJob, fmt.Sprintf("reconciled leftover files: %d | bytes: %d | policy: %s",
+		len(manifest.Files), manifest.Bytes, manifest.Policy), manifest)
+
+	if *summary_to == "" {
+		return
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(*summary_to, os.ModePerm)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(*summary_to, fmt.Sprintf("recovery__%s.json", manifest.Created.UTC().Format("20060102T150405"))), data, 0o666)
+	}
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to write recovery manifest: %v", err))
+	}
+}
+
+func createSignal(signalFile *string) error {
+	signal, err := os.OpenFile(*signalFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return err
+	}
+	return signal.Close()
+}
+
+func watchTermination(ctx context.Context, tasks []*pcapTask, flushSignal *string) {
+	mds := gcp.NewMetadataClient(mdsTimeout)
+
+	select {
+	case <-ctx.Done():
+		return
+
+	case notice := <-mds.WatchTermination(ctx):
+		noticeTS := time.Now()
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("termination notice: %s=%s", notice.Path, notice.Value))
+		// force all writers to start a new file so that pending files are immediately exportable
+		rotatedWriters := rotateWriters(tasks)
+		// `TCPDUMPW_FLUSH` file creation signals `pcap_fsn` to export all files without waiting for rotation
+		err := createSignal(flushSignal)
+		if err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("'tcpdumpw' flush signal creation failed: %s | %v", *flushSignal, err))
+		}
+		recordAction(&audit.Actor{Source: audit.SourceMetadataServer}, "FLUSH",
+			[]string{fmt.Sprintf("%s=%s", notice.Path, notice.Value)}, fmt.Sprintf("writers: %d", rotatedWriters), err)
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("emergency rotation complete | writers: %d | latency: %v", rotatedWriters, time.Since(noticeTS)))
+	}
+}
+
+func waitForApp(ctx context.Context, target *string, timeout time.Duration) {
+	if *target == "" {
+		return
+	}
+
+	probe, err := readiness.NewReadinessProbe(*target)
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, err.Error())
+		return
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	waitStartTS := time.Now()
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("waiting for %s to be ready", probe))
+
+	err = readiness.WaitUntilReady(ctx, probe, readinessInterval, func(attempt uint64, err error) {
+		// avoid flooding logs while the app is starting
+		if attempt%10 == 1 {
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("%s is not ready | attempt: %d | %v", probe, attempt, err))
+		}
+	})
+
+	if err == context.DeadlineExceeded {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("timed out waiting for %s to be ready | latency: %v", probe, time.Since(waitStartTS)))
+	} else if err == nil {
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("%s is ready | latency: %v", probe, time.Since(waitStartTS)))
+	}
+}
+
+// newJobHooks plugs the executions of `job`, and the runs of its tasks, into everything `tcpdumpw` does along with them:
+// logs, spans, execution directories, summaries, exports, disk and engine limits.
+func newJobHooks(job *tcpdumpJob) capture.Hooks {
+	return capture.Hooks{
+		Begin: func(ctx context.Context, exe *capture.Execution) (context.Context, func()) {
+			return beginExecution(ctx, job, exe)
+		},
+		Acquire: func(ctx context.Context, t *capture.Task) (func(), error) {
+			return acquireEngine(ctx, job, t)
+		},
+		Start: func(ctx context.Context, t *capture.Task) (context.Context, func(error)) {
+			return startEngine(ctx, job, t)
+		},
+		OnEvent: func(event *capture.Event) {
+			onCaptureEvent(job, event)
+		},
+		OnWriteError: func(_ *capture.Task, err error) {
+			if diskGuard != nil && errors.Is(err, syscall.ENOSPC) {
+				diskGuard.ReportFull()
+			}
+		},
+	}
+}
+
+// jobTask returns the task of `job` which runs `t`.
+func jobTask(job *tcpdumpJob, t *capture.Task) *pcapTask {
+	for _, task := range job.tasks {
+		if task.Task == t {
+			return task
+		}
+	}
+	return &pcapTask{Task: t}
+}
+
+// captureTasks returns the tasks which are run by the executions of `tasks`.
+func captureTasks(tasks []*pcapTask) []*capture.Task {
+	captureTasks := make([]*capture.Task, 0, len(tasks))
+	for _, task := range tasks {
+		captureTasks = append(captureTasks, task.Task)
+	}
+	return captureTasks
+}
+
+// newExecutionContext labels `ctx` with the identity of an execution of the job `jobID`, which engines stamp onto
+// JSON translated packets; executions which do not belong to a scheduled job are logged under their own log name.
+func newExecutionContext(ctx context.Context, jobID, exeID, profile string) context.Context {
+	info := &execution.Info{JobID: jobID, ExecutionID: exeID, Profile: profile, Tags: user_tags.Map()}
+	if jobID == "" {
+		info.LogName = fmt.Sprintf("projects/%s/pcaps/%s", identity.ProjectID, info.ID())
+	} else {
+		info.LogName = fmt.Sprintf("projects/%s/pcap/%s", identity.ProjectID, info.ID())
+	}
+	return execution.NewContext(ctx, info)
+}
+
+// acquireEngine holds back the engine of `t` while the PCAP files directory is out of space,
+// and until it is allowed to run along with all other engines; it returns how to release it.
+func acquireEngine(ctx context.Context, job *tcpdumpJob, t *capture.Task) (func(), error) {
+	if diskGuard != nil {
+		if err := diskGuard.Wait(ctx); err != nil {
+			jlog(INFO, job, fmt.Sprintf("PCAP task execution stopped while paused: %s", t.Iface()))
+			return nil, err
+		}
+	}
+
+	if engines == nil {
+		return nil, nil
+	}
+	err := engines.Acquire(ctx, enginePriority(t.Iface()), func(position int) {
+		setTaskState(job, t, health.Queued, nil)
+		jlog(INFO, job, fmt.Sprintf("PCAP task queued: %s | engine: %s | position: %d | max concurrent engines: %d", t.Iface(), t.Engine(), position, *max_engine))
+	})
+	if err != nil {
+		jlog(INFO, job, fmt.Sprintf("PCAP task execution stopped while queued: %s", t.Iface()))
+		return nil, err
+	}
+	return engines.Release, nil
+}
+
+// startEngine traces a single run of the engine of `t`, and watches it until it stops.
+func startEngine(ctx context.Context, job *tcpdumpJob, t *capture.Task) (context.Context, func(error)) {
+	task := jobTask(job, t)
+	ctx, span := tracer.StartSpan(ctx, "pcap.engine", map[string]string{"pcap.iface": t.Iface(), "pcap.engine": t.Engine()})
+
+	// only the external `tcpdump` is not observable through its writers
+	_, isTcpdump := t.PcapEngine().(*pcap.Tcpdump)
+	if stallTimeout := time.Duration(*stall_to) * time.Second; isTcpdump && stallTimeout > 0 {
+		go watchStall(ctx, job, task, stallTimeout)
+	}
+	if rotationGrace := time.Duration(*rot_grace) * time.Second; task.prefix != "" && task.interval > 0 && rotationGrace > 0 {
+		go watchRotations(ctx, job, task, rotationGrace)
+	}
+	activeTasks.Add(1)
+
+	return ctx, func(err error) {
+		activeTasks.Add(-1)
+		if isCleanStop(err) {
+			span.End(nil)
+		} else {
+			span.End(err)
+		}
+	}
+}
+
+// onCaptureEvent logs what happened to an execution of `job`, or to one of its tasks.
+func onCaptureEvent(job *tcpdumpJob, event *capture.Event) {
+	t := event.Task
+	switch event.Kind {
+	case capture.StateChanged:
+		logTransition(job, t, event.Transition)
+
+	case capture.TaskRestarting:
+		if errors.Is(event.Err, capture.ErrPaused) {
+			jlog(WARNING, job, fmt.Sprintf("PCAP task execution paused: %s | %s", t.Iface(), event.Err.Error()))
+			return
+		}
+		jlog(ERROR, job, fmt.Sprintf("PCAP task execution failed: %s | %s | restart: %d | backoff: %v", t.Iface(), event.Err.Error(), t.Restarts(), event.Backoff))
+
+	case capture.TaskStopped:
+		if event.Err != nil {
+			jlog(INFO, job, fmt.Sprintf("PCAP task execution stopped: %s | %s", t.Iface(), event.Err.Error()))
+		} else {
+			jlog(INFO, job, fmt.Sprintf("PCAP task execution stopped: %s", t.Iface()))
+		}
+
+	case capture.TaskKilled:
+		if event.Process == nil {
+			jlog(ERROR, job, fmt.Sprintf("failed to find 'tcpdump' processes: %s | %v", t.Iface(), event.Err))
+		} else if event.Err != nil {
+			jlog(ERROR, job, fmt.Sprintf("failed to kill 'tcpdump': %s | pid: %d | %v", t.Iface(), event.Process.Pid, event.Err))
+		} else {
+			jlogWithData(WARNING, job, fmt.Sprintf("killed 'tcpdump': %s | pid: %d", t.Iface(), event.Process.Pid), event.Process)
+		}
+
+	case capture.TaskAbandoned:
+		jlog(ERROR, job, fmt.Sprintf("PCAP task abandoned: %s | engine: %s | %v", t.Iface(), t.Engine(), event.Err))
+
+	case capture.ExecutionStopping:
+		jlog(INFO, job, fmt.Sprintf("waiting for PCAP job execution to stop | deadline: %v", event.Deadline))
+
+	case capture.ExecutionStopped:
+		exe := event.Execution
+		if event.Err == nil {
+			jlog(INFO, job, fmt.Sprintf("PCAP job execution stopped | latency: %v", exe.End.Sub(exe.Stop)))
+			return
+		}
+		jlog(ERROR, job, "timed out waiting for PCAP job execution to stop")
+		if exe.Stopped {
+			jlog(WARNING, job, "PCAP job execution forcefully stopped")
+		}
+
+	case capture.ExecutionSkipped:
+		if job.profile != nil {
+			jlog(WARNING, job, fmt.Sprintf("execution skipped: profile '%s' is running %d executions", job.profile.Name, job.profile.MaxConcurrent))
+		} else {
+			jlog(WARNING, job, "execution skipped: the previous one is still running")
+		}
+	}
+}
+
+// setTaskState moves `t` into `state` and logs the transition; transitions caused by rotations are too frequent to be logged.
+func setTaskState(j *tcpdumpJob, t *capture.Task, state health.State, err error) {
+	transition, changed := t.Health().Set(state, err)
+	if !changed || transition.From == health.Rotating || transition.To == health.Rotating {
+		return
+	}
+	logTransition(j, t, transition)
+}
+
+// logTransition logs that `t` moved into a new state.
+func logTransition(j *tcpdumpJob, t *capture.Task, transition *health.Transition) {
+	level := INFO
+	switch transition.To {
+	case health.Degraded:
+		level = WARNING
+	case health.Failed:
+		level = ERROR
+	}
+	message := fmt.Sprintf("PCAP task state: %s | %s | %s -> %s", t.Iface(), t.Engine(), transition.From, transition.To)
+	if transition.Err != nil {
+		message = fmt.Sprintf("%s | %v", message, transition.Err)
+	}
+	jlogWithData(level, j, message, taskHealth(t))
+}
+
+// taskHealth describes the current state of `t` for log entries, heartbeats and the `STATUS` control command.
+func taskHealth(t *capture.Task) *pcapTaskHealth {
+	return &pcapTaskHealth{Iface: t.Iface(), Engine: t.Engine(), Status: t.Health().Status()}
+}
+
+// watchStall stops the engine of `t` if it does not write into its PCAP files for `timeout` while its iface keeps receiving packets;
+// a wedged `tcpdump` would otherwise look identical to an idle network. Files are buffered by `tcpdump`, so `timeout` must be generous.
+func watchStall(ctx context.Context, j *tcpdumpJob, t *pcapTask, timeout time.Duration) {
+	progress := stats.NewFileProgress(t.directory, t.prefix, "."+t.extension)
+	ifacePackets := func() uint64 {
+		if counters, err := stats.ReadIfaceCounters(t.Iface()); err == nil {
+			return counters.Packets
+		}
+		return 0
+	}
+
+	lastProgressTS := time.Now()
+	lastPackets := ifacePackets()
+
+	ticker := time.NewTicker(max(timeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		packets := ifacePackets()
+		// an idle iface is not a stalled engine
+		if progress.Advanced() || packets == lastPackets {
+			lastProgressTS = time.Now()
+			lastPackets = packets
+			continue
+		}
+
+		if stalledFor := time.Since(lastProgressTS); stalledFor >= timeout {
+			jlog(ERROR, j, fmt.Sprintf("PCAP task stalled: %s | no PCAP files written for %v | iface packets: %d", t.Iface(), stalledFor.Round(time.Second), packets-lastPackets))
+			t.Abort(fmt.Errorf("engine stalled: no PCAP files were written for %v while %s received packets", timeout, t.Iface()))
+			return
+		}
+	}
+}
+
+// watchRotations logs a WARNING when `t` keeps writing into the same file for longer than its rotation interval plus `grace`:
+// engines rotate files when they write the 1st packet past the interval, so files which grow past it were not rotated.
+func watchRotations(ctx context.Context, j *tcpdumpJob, t *pcapTask, grace time.Duration) {
+	rotations := stats.NewFileRotations(t.directory, t.prefix, "."+t.extension)
+	alerted := ""
+
+	ticker := time.NewTicker(max(t.interval/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		file, age, grew := rotations.Scan()
+		// idle files are rotated as soon as packets are written into them again
+		if file == "" || file == alerted || !grew || age < t.interval+grace {
+			continue
+		}
+		alerted = file
+		jlogWithData(WARNING, j, fmt.Sprintf("PCAP file rotation missed: %s | %s | file: %s | age: %v | interval: %v", t.Iface(), t.Engine(), file, age.Round(time.Second), t.interval), taskHealth(t.Task))
+		currentExecution.Load().AddEvent("pcap.rotation_missed", map[string]string{"iface": t.Iface(), "engine": t.Engine(), "file": file})
+	}
+}
+
+// enginePriority returns the position of `iface` in the queue of engines: ifaces matching the earliest prefix
+// in 'engine_priority' go first, then all others by index; loopback always goes last.
+func enginePriority(iface string) int {
+	prefixes := strings.Split(*eng_prio, ",")
+	rank := len(prefixes)
+	for i, prefix := range prefixes {
+		if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(iface, prefix) {
+			rank = i
+			break
+		}
+	}
+	index := 0
+	if netIface, err := net.InterfaceByName(iface); err == nil {
+		if netIface.Flags&net.FlagLoopback != 0 {
+			rank = len(prefixes) + 1
+		}
+		index = netIface.Index
+	}
+	return rank<<16 | index
+}
+
+// beginExecution starts everything `tcpdumpw` does along with the execution `exe` of `job`: logs, spans, windows,
+// the execution directory, stats and state; it returns the context tasks run with, and how to end the execution
+// once all of them stopped: it is summarized, reported, exported and notified.
+func beginExecution(ctx context.Context, job *tcpdumpJob, exe *capture.Execution) (context.Context, func()) {
+	executionsWG.Add(1)
+
+	exeID := uuid.MustParse(exe.ID)
+	if job.exe != nil {
+		job.exe.Store(exeID)
+	} else {
+		xid.Store(exeID)
+	}
+
+	jobID := job.j.ID()
+	profile := ""
+	if job.profile != nil {
+		profile = job.profile.Name
+	}
+	// enable PCAP tasks with context awareness
+	ctx = newExecutionContext(ctx, jobID, exe.ID, profile)
+
+	var scheduleSpan *otlp.Span = nil
+	if jobID != "" {
+		attributes := map[string]string{"pcap.job": jobID, "pcap.execution": exe.ID, "pcap.cron": *cron_exp}
+		if job.profile != nil {
+			attributes["pcap.cron"] = job.profile.CronExp
+			attributes["pcap.profile"] = profile
+			jlog(INFO, job, fmt.Sprintf("execution started | profile: %s", profile))
+		} else {
+			var lastRun time.Time
+			if last := job.j.Last(); last != nil {
+				lastRun = last.Start
+			}
+			// the scheduler forgets previous executions when `tcpdumpw` restarts
+			if restored := stateStore.Job(stateJobName(job)); lastRun.IsZero() && restored != nil && restored.Last != nil {
+				lastRun = restored.Last.Start
+			}
+			jlog(INFO, job, fmt.Sprintf("execution started ( last execution: %v )", lastRun))
+		}
+		ctx, scheduleSpan = tracer.StartSpan(ctx, "pcap.schedule", attributes)
+	}
+
+	if *win_slot > 0 {
+		beginWindow(job, time.Now())
+	}
+
+	if info, ok := execution.FromContext(ctx); ok {
+		if slot := windowID(job); slot != "" {
+			info = info.WithSlot(slot)
+			ctx = execution.NewContext(ctx, info)
+		}
+		for _, task := range job.tasks {
+			task.execution.Set(info)
+		}
+	}
+
+	ctx, span := tracer.StartSpan(ctx, "pcap.execution", map[string]string{
+		"pcap.job":     job.Jid,
+		"pcap.window":  windowID(job),
+		"pcap.timeout": exe.Timeout.String(),
+		"pcap.tasks":   strconv.Itoa(len(job.tasks)),
+	})
+	currentExecution.Store(span)
+
+	executionDir := ""
+	if *exec_dirs {
+		executionDir = beginExecutionDirectory(ctx, job)
+	}
+
+	executionStats := newExecutionStats(job, executionDir)
+	if executionDir != "" {
+		// files created from now on are tracked as part of the execution
+		rotateJobWriters(job)
+	}
+	executionState := beginExecutionState(ctx, job, executionStats.startTS)
+	trackerCtx, trackerCancel := context.WithCancel(ctx)
+	go executionStats.files.Track(trackerCtx, fileTrackerInterval)
+
+	return ctx, func() {
+		trackerCancel()
+		executions.Add(1)
+		currentExecution.CompareAndSwap(span, nil)
+		span.End(nil)
+
+		job.summary = summarizeExecution(job, &exe.Timeout, executionStats)
+		endExecutionState(job, executionState, job.summary)
+		reportExecution(job, job.summary)
+		if executionDir != "" {
+			if err := writeExecutionManifest(executionDir, job.summary); err != nil {
+				jlog(ERROR, job, fmt.Sprintf("failed to write execution manifest: %s | %v", executionDir, err))
+			} else if spiller != nil {
+				// manifests are written once: they follow the files of their execution
+				spiller.Spill(filepath.Join(executionDir, executionManifestName))
+			}
+		}
+		notifyExecution(job, job.summary, executionStats)
+
+		for _, task := range job.tasks {
+			task.execution.Set(nil)
+		}
+		if *win_slot > 0 {
+			endWindow(job)
+		}
+
+		if jobID != "" {
+			// executions stop when their timeout expires: it is a clean termination
+			scheduleSpan.End(nil)
+			jlog(INFO, job, "execution complete")
+			if job.profile == nil {
+				jlog(INFO, job, fmt.Sprintf("next execution: %v", job.j.NextRun()))
+			}
+		}
+
+		// reset execution id
+		if job.exe != nil {
+			job.exe.Store(uuid.Nil)
+		} else {
+			xid.Store(uuid.Nil)
+		}
+		executionsWG.Done()
+	}
+}
+
+// restoreState loads the state persisted by a previous `tcpdumpw` from `path`; executions which were running when it
+// stopped are reported as interrupted, and the amount of executions continues from where it was.
+func restoreState(path string) *state.Store {
+	store, err := state.Open(path, stateHistory)
+	if err != nil {
+		// a corrupted state must never prevent capturing: it is replaced when the next execution ends
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to restore state: %s | %v", path, err))
+		return store
+	}
+
+	for _, interrupted := range store.Interrupted(time.Now()) {
+		jlogWithData(WARNING, &emptyTcpdumpJob, fmt.Sprintf("execution interrupted by restart: %s | job: %s | started: %v",
+			interrupted.ID, interrupted.Job, interrupted.Start), interrupted)
+	}
+	executions.Store(store.Executions())
+
+	snapshot := store.Snapshot()
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("restored state: %s | jobs: %d | executions: %d | pending files: %d",
+		path, len(snapshot.Jobs), executions.Load(), len(snapshot.Pending)), snapshot)
+	if err := store.Save(); err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to persist state: %s | %v", path, err))
+	}
+	return store
+}
+
+// stateJobName returns the name `job` is persisted as; unnamed jobs are the ones which run the default schedule.
+func stateJobName(job *tcpdumpJob) string {
+	if job.Name == "" {
+		return "tcpdump"
+	}
+	return job.Name
+}
+
+// currentExecutionID returns the ID of the execution of `job` which runs with `ctx`;
+// executions which do not belong to a scheduled job are only identified by their context.
+func currentExecutionID(ctx context.Context, job *tcpdumpJob) string {
+	if info, ok := execution.FromContext(ctx); ok {
+		return info.ExecutionID
+	}
+	return executionID(job).String()
+}
+
+// jobDirectory returns the directory where the execution directories of the job named `name` are created.
+func jobDirectory(name string) string {
+	if name == "" {
+		name = "tcpdump"
+	}
+	return filepath.Join(*directory, name)
+}
+
+// prepareJobDirectory creates the directory of the job named `name`, along with the link to its current execution;
+// until the 1st execution starts, the link points to the job directory itself, where no files are written.
+func prepareJobDirectory(name string) error {
+	jobDir := jobDirectory(name)
+	if err := os.MkdirAll(jobDir, os.ModePerm); err != nil {
+		return err
+	}
+	current := filepath.Join(jobDir, currentExecutionDir)
+	// the execution the link points to may have been exported and removed
+	if info, err := os.Stat(current); err == nil && info.IsDir() {
+		return nil
+	}
+	return linkCurrentExecution(current, ".")
+}
+
+// stagingPath returns where the replacement of `path` is written until it is complete; on network filesystems, replacements
+// are staged out of the directories where PCAP files are written, so that they are never listed along with them.
+func stagingPath(path string) string {
+	if !isNetworkFs {
+		return path + ".tmp"
+	}
+	stagingDir := filepath.Join(*directory, stagingDirName)
+	// failing to create it is reported when writing the replacement
+	os.MkdirAll(stagingDir, os.ModePerm)
+	name, err := filepath.Rel(*directory, path)
+	if err != nil {
+		name = filepath.Base(path)
+	}
+	return filepath.Join(stagingDir, strings.ReplaceAll(name, string(filepath.Separator), "_")+".tmp")
+}
+
+// replaceFile writes `data` into `path` atomically: readers find either the previous content or `data`, never part of it.
+func replaceFile(path string, data []byte) error {
+	tmp := stagingPath(path)
+	if err := os.WriteFile(tmp, data, 0o666); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// linkCurrentExecution replaces the link `current` so that it points to `target` atomically:
+// engines and writers opening files through it never find it missing.
+func linkCurrentExecution(current, target string) error {
+	tmp := stagingPath(current)
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, current); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// beginExecutionDirectory creates the directory of the execution of `job` which runs with `ctx`, and points the link
+// to the current execution to it; engines open their files through it when they start, and writers once they are
+// rotated by `rotateJobWriters`. If it cannot be created, files are written into the previous one.
+func beginExecutionDirectory(ctx context.Context, job *tcpdumpJob) string {
+	jobDir := jobDirectory(job.Name)
+	executionDir := filepath.Join(jobDir, currentExecutionID(ctx, job))
+	if err := os.MkdirAll(executionDir, os.ModePerm); err != nil {
+		jlog(ERROR, job, fmt.Sprintf("failed to create execution directory: %s | %v", executionDir, err))
+		return ""
+	}
+	if err := linkCurrentExecution(filepath.Join(jobDir, currentExecutionDir), filepath.Base(executionDir)); err != nil {
+		jlog(ERROR, job, fmt.Sprintf("failed to switch to execution directory: %s | %v", executionDir, err))
+		return ""
+	}
+	jlog(INFO, job, fmt.Sprintf("writing files into execution directory: %s", executionDir))
+	return executionDir
+}
+
+// rotateJobWriters closes the files of all writers of `job`, which remain open after an execution ends,
+// so that the next ones are created in the directory of the current execution.
+func rotateJobWriters(job *tcpdumpJob) {
+	for _, task := range job.tasks {
+		for _, writer := range task.Writers() {
+			if !writer.IsStdOutOrErr() {
+				writer.Rotate()
+			}
+		}
+	}
+}
+
+// writeExecutionManifest writes the summary of an execution into its directory, along with the files it produced,
+// so that the directory describes the execution on its own.
+func writeExecutionManifest(executionDir string, summary *pcapExecutionSummary) error {
+	manifest := &pcapExecutionManifest{Summary: summary, Files: []*pcapManifestFile{}}
+	// files may still be buffered, so they are listed even if they look empty
+	fileRegex := leftoverFileRegex(*extension)
+	paths, err := findFiles(executionDir, fileRegex)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		file := &pcapManifestFile{Name: filepath.Base(path)}
+		if match := fileRegex.FindStringSubmatch(file.Name); match[1] != "" {
+			file.Sequence, _ = strconv.ParseUint(match[1], 10, 64)
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	// `pcap_fsn` exports the manifest as soon as it is created: it must never be read partially
+	return replaceFile(filepath.Join(executionDir, executionManifestName), data)
+}
+
+// beginExecutionState persists that the execution of `job` started at `startTS`; it returns `nil` if state is not persisted.
+func beginExecutionState(ctx context.Context, job *tcpdumpJob, startTS time.Time) *state.Execution {
+	if stateStore == nil {
+		return nil
+	}
+	record := &state.Execution{
+		ID:     currentExecutionID(ctx, job),
+		Job:    stateJobName(job),
+		Window: windowID(job),
+		Status: "running",
+		Start:  startTS,
+	}
+	if info, ok := execution.FromContext(ctx); ok {
+		record.Profile = info.Profile
+	}
+	stateStore.Begin(job.Jid, record)
+	if err := stateStore.Save(); err != nil {
+		jlog(ERROR, job, fmt.Sprintf("failed to persist state: %s | %v", stateStore.Path(), err))
+	}
+	return record
+}
+
+// endExecutionState persists the outcome of the execution of `job`, along with the files which were not exported yet.
+func endExecutionState(job *tcpdumpJob, record *state.Execution, summary *pcapExecutionSummary) {
+	if stateStore == nil || record == nil {
+		return
+	}
+	record.Status = summary.Status
+	record.End = &summary.End
+	for _, task := range summary.Tasks {
+		record.Files += task.Files
+		record.FileBytes += task.FileBytes
+	}
+	stateStore.End(record)
+
+	// exported files are removed from `directory`: the ones which remain are pending
+	pending, _ := findFiles(*directory, leftoverFileRegex(*extension))
+	stateStore.SetPending(pending, record.ID)
+
+	if err := stateStore.Save(); err != nil {
+		jlog(ERROR, job, fmt.Sprintf("failed to persist state: %s | %v", stateStore.Path(), err))
+	}
+}
+
+// windowSlot returns the start of the wall-clock slot `ts` belongs to; slots are aligned to UTC,
+// so that executions of all instances scheduled for the same time fall into the same slot.
+func windowSlot(ts time.Time) time.Time {
+	return ts.UTC().Truncate(*win_slot)
+}
+
+// formatWindowID returns the ID of the window starting at `slot`, i/e: `2024-05-01T03:00Z`;
+// seconds are only included when slots are not a whole number of minutes.
+func formatWindowID(slot time.Time) string {
+	if *win_slot%time.Minute != 0 {
+		return slot.Format("2006-01-02T15:04:05Z")
+	}
+	return slot.Format("2006-01-02T15:04Z")
+}
+
+// windowID returns the window ID of the current execution of `job`; it is empty if there is none.
+func windowID(job *tcpdumpJob) string {
+	windowsMu.Lock()
+	defer windowsMu.Unlock()
+	return windows[job.Name]
+}
+
+// beginWindow records the window of the execution of `job` started at `ts`, and signals it to `pcap_fsn`; writers are
+// rotated afterwards, so that every file belongs to a single window and is exported with its ID.
+func beginWindow(job *tcpdumpJob, ts time.Time) {
+	windowsMu.Lock()
+	windows[job.Name] = formatWindowID(windowSlot(ts))
+	err := signalWindows(directory)
+	windowsMu.Unlock()
+
+	if err != nil {
+		jlog(ERROR, job, fmt.Sprintf("failed to signal window: %s | %v", windowID(job), err))
+	}
+	rotated := rotateWriters(job.tasks)
+	jlog(INFO, job, fmt.Sprintf("execution window: %s | rotated writers: %d", windowID(job), rotated))
+}
+
+// endWindow forgets the window of `job`; files created until its next execution are exported without window ID.
+func endWindow(job *tcpdumpJob) {
+	windowsMu.Lock()
+	defer windowsMu.Unlock()
+	delete(windows, job.Name)
+	if err := signalWindows(directory); err != nil {
+		jlog(ERROR, job, fmt.Sprintf("failed to signal window end | %v", err))
+	}
+}
+
+// signalWindows writes the window ID of the current execution of every job into the file which signals `pcap_fsn`
+// which window new files belong to; must be called while holding `windowsMu`.
+func signalWindows(directory *string) error {
+	content, err := json.Marshal(windows)
+	if err != nil {
+		return err
+	}
+	// the signal is replaced atomically so that `pcap_fsn` never reads it partially
+	return replaceFile(filepath.Join(*directory, windowSignalName), content)
+}
+
+// isCleanStop reports whether an engine stopped only because its context was done
+func isCleanStop(err error) bool {
+	if err == nil {
+		return true
+	}
+	if joinedErr, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joinedErr.Unwrap() {
+			if !isCleanStop(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// newExecutionStats snapshots all counters when an execution starts; files are tracked in `executionDir`,
+// or in 'directory' if the execution has no directory of its own.
+func newExecutionStats(job *tcpdumpJob, executionDir string) *pcapExecutionStats {
+	filesDir := *directory
+	if executionDir != "" {
+		filesDir = executionDir
+	}
+	executionStats := &pcapExecutionStats{
+		startTS: time.Now(),
+		tasks:   make(map[*pcapTask]stats.CountersSnapshot, len(job.tasks)),
+		tcp:     make(map[*pcapTask]analysis.Totals),
+		ifaces:  make(map[string]*stats.IfaceCounters),
+		files:   stats.NewFileTracker(filesDir),
+	}
+	for _, task := range job.tasks {
+		executionStats.tasks[task] = task.Counters().Snapshot()
+		if task.analyzer != nil {
+			executionStats.tcp[task] = task.analyzer.Totals()
+		}
+		if counters, err := stats.ReadIfaceCounters(task.Iface()); err == nil {
+			executionStats.ifaces[task.Iface()] = counters
+		}
+	}
+	return executionStats
+}
+
+func summarizeExecution(job *tcpdumpJob, timeout *time.Duration, executionStats *pcapExecutionStats) *pcapExecutionSummary {
+	endTS := time.Now()
+	executionStats.files.Scan()
+
+	summary := &pcapExecutionSummary{
+		Job:       job.Jid,
+		Execution: executionID(job).String(),
+		Window:    windowID(job),
+		Mode:      strings.ToLower(*run_mode),
+		Timeout:   timeout.String(),
+		Duration:  endTS.Sub(executionStats.startTS).String(),
+		Start:     executionStats.startTS,
+		End:       endTS,
+		Tasks:     make([]*pcapTaskSummary, len(job.tasks)),
+		Ifaces:    make(map[string]*stats.IfaceCounters, len(executionStats.ifaces)),
+		Tags:      user_tags.Map(),
+	}
+
+	failedTasks := 0
+	for i, task := range job.tasks {
+		counters := task.Counters().Snapshot().Sub(executionStats.tasks[task])
+		files, fileBytes := executionStats.files.Summary(task.prefix, "."+task.extension)
+		taskSummary := &pcapTaskSummary{
+			Iface:     task.Iface(),
+			Engine:    task.Engine(),
+			Status:    pcapStatusSuccess,
+			Packets:   counters.Packets,
+			Bytes:     counters.Bytes,
+			Rotations: counters.Rotations,
+			Restarts:  task.Restarts(),
+			Files:     files,
+			FileBytes: fileBytes,
+		}
+		if task.analyzer != nil {
+			tcpTotals := task.analyzer.Totals().Sub(executionStats.tcp[task])
+			taskSummary.TCP = &tcpTotals
+		}
+		if !isCleanStop(task.Err()) {
+			failedTasks += 1
+			taskSummary.Status = pcapStatusFailure
+			taskSummary.Error = task.Err().Error()
+		}
+		summary.Tasks[i] = taskSummary
+	}
+
+	for iface, previous := range executionStats.ifaces {
+		if current, err := stats.ReadIfaceCounters(iface); err == nil {
+			summary.Ifaces[iface] = current.Sub(previous)
+		}
+	}
+
+	switch failedTasks {
+	case 0:
+		summary.Status = pcapStatusSuccess
+		summary.exitCode = exitSuccess
+	case len(job.tasks):
+		summary.Status = pcapStatusFailure
+		summary.exitCode = exitJobFailure
+	default:
+		summary.Status = pcapStatusPartial
+		summary.exitCode = exitJobPartial
+	}
+	return summary
+}
+
+// writeSummary stores `summary` as `<directory>/summary__<start>__<execution>.json`
+func writeSummary(directory *string, summary *pcapExecutionSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*directory, os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(*directory, fmt.Sprintf("summary__%s__%s.json", summary.Start.UTC().Format("20060102T150405"), summary.Execution)), data, 0o666)
+}
+
+func reportExecution(job *tcpdumpJob, summary *pcapExecutionSummary) {
+	severity := INFO
+	if summary.exitCode != exitSuccess {
+		severity = ERROR
+	}
+	jlogWithData(severity, job, fmt.Sprintf("execution summary: %s", summary.Status), summary)
+
+	if executionHistory != nil {
+		if err := executionHistory.Add(summary); err != nil {
+			jlog(ERROR, job, fmt.Sprintf("failed to record execution summary: %v", err))
+		}
+	}
+
+	if *summary_to == "" {
+		return
+	}
+	if err := writeSummary(summary_to, summary); err != nil {
+		jlog(ERROR, job, fmt.Sprintf("failed to write execution summary: %v", err))
+	}
+}
+
+// newNotification describes the files produced by an execution, and where they are exported into;
+// the amount of listed files is bounded by `maxNotificationFiles`.
+func newNotification(job *tcpdumpJob, summary *pcapExecutionSummary, executionStats *pcapExecutionStats) *pcapNotification {
+	notification := &pcapNotification{
+		Service:  identity.Service,
+		Revision: identity.Revision,
+		Instance: identity.InstanceID,
+		Files:    []string{},
+		Summary:  summary,
+	}
+
+	// PCAP files are exported by `pcap-fsnotify` into the Cloud Storage Bucket
+	if gcsBucketEnvVar != "" {
+		notification.Destination = fmt.Sprintf("gs://%s/%s", gcsBucketEnvVar, gcsDirEnvVar)
+		notification.Console = fmt.Sprintf("https://console.cloud.google.com/storage/browser/%s/%s", gcsBucketEnvVar, gcsDirEnvVar)
+	}
+
+	for _, task := range job.tasks {
+		for _, file := range executionStats.files.Files(task.prefix, "."+task.extension) {
+			if len(notification.Files) < maxNotificationFiles {
+				notification.Files = append(notification.Files, file)
+			} else {
+				notification.MoreFiles += 1
+			}
+		}
+	}
+	return notification
+}
+
+// String summarizes `n` for webhooks which only accept text.
+func (n *pcapNotification) String() string {
+	files := len(n.Files) + n.MoreFiles
+	text := fmt.Sprintf("PCAP execution %s: %s | service: %s | revision: %s | instance: %s | duration: %s | files: %d",
+		n.Summary.Execution, n.Summary.Status, n.Service, n.Revision, n.Instance, n.Summary.Duration, files)
+	if n.Console != "" {
+		text = fmt.Sprintf("%s\n%s", text, n.Console)
+	}
+	return text
+}
+
+// notifyExecution tells the `webhook` that the files produced by an execution are ( or will shortly be ) available.
+func notifyExecution(job *tcpdumpJob, summary *pcapExecutionSummary, executionStats *pcapExecutionStats) {
+	hook := webhook.Load()
+	if hook == nil || summary == nil {
+		return
+	}
+	notification := newNotification(job, summary, executionStats)
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	if err := hook.Send(ctx, notification.String(), notification); err != nil {
+		jlog(ERROR, job, fmt.Sprintf("failed to notify webhook: %s | %v", hook, err))
+		return
+	}
+	jlog(INFO, job, fmt.Sprintf("notified webhook: %s", hook))
+}
+
+// runJob performs a single packet capture execution which lasts exactly the timeout of `job`
+func runJob(ctx context.Context, job *tcpdumpJob, pcapMutex *flock.Flock, exitSignal *string) int {
+	job.j.Execute(ctx)
+	// writers are flushed and `pcap_fsn` is signaled to export all PCAP files
+	doneErr := waitDone(job, pcapMutex, exitSignal)
+
+	if job.summary == nil {
+		return exitJobFailure
+	}
+	if doneErr != nil && job.summary.exitCode == exitSuccess {
+		// all interfaces were captured, but their PCAP files did not make it out of the instance
+		jlog(ERROR, job, fmt.Sprintf("PCAP job execution %s | exit code: %d | %v", pcapStatusFailure, exitExportFailure, doneErr))
+		return exitExportFailure
+	}
+	jlog(INFO, job, fmt.Sprintf("PCAP job execution %s | exit code: %d", job.summary.Status, job.summary.exitCode))
+	return job.summary.exitCode
+}
+
+func (w *pcapWindow) open() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return 0, w.ctx.Err()
+		default:
+		}
+
+		if w.cancel != nil {
+			// already capturing: this request joins the current execution
+			w.requests += 1
+			if w.timer != nil {
+				w.timer.Stop()
+				w.timer = nil
+			}
+			return w.requests, nil
+		}
+
+		done := w.done
+		if done == nil {
+			break
+		}
+		select {
+		case <-done:
+		default:
+			// engines must be fully stopped before they can be started again; the lock is released meanwhile,
+			// as requests may be closed and the window may be stopped or waited for
+			w.mu.Unlock()
+			select {
+			case <-done:
+			case <-w.ctx.Done():
+			}
+			w.mu.Lock()
+			// another request may have started a new execution meanwhile
+			continue
+		}
+		w.done = nil
+	}
+
+	w.requests += 1
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+
+	done := make(chan struct{})
+	w.cancel = cancel
+	w.done = done
+
+	go func(ctx context.Context, job *tcpdumpJob, done chan struct{}) {
+		defer close(done)
+		jlog(INFO, job, "request window opened")
+		job.j.Execute(ctx)
+		jlog(INFO, job, "request window closed")
+	}(ctx, w.job, done)
+
+	return w.requests, nil
+}
+
+func (w *pcapWindow) close() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.requests == 0 {
+		return 0, errNoWindowOpen
+	}
+
+	w.requests -= 1
+	if w.requests == 0 && w.cancel != nil {
+		// keep capturing for a while to get the tail of the last request
+		w.timer = time.AfterFunc(w.linger, w.stop)
+	}
+
+	return w.requests, nil
+}
+
+func (w *pcapWindow) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// a new request window may have been opened while lingering
+	if w.requests > 0 || w.cancel == nil {
+		return
+	}
+
+	w.cancel()
+	w.cancel = nil
+	w.timer = nil
+}
+
+// wait forcefully stops the current execution and waits for it to be done
+func (w *pcapWindow) wait() {
+	w.mu.Lock()
+	w.requests = 0
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+	done := w.done
+	w.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+func newPcapWindow(ctx context.Context, job *tcpdumpJob, linger time.Duration) *pcapWindow {
+	return &pcapWindow{
+		ctx:    ctx,
+		job:    job,
+		linger: linger,
+	}
+}
+
+func registerWindowCommands(server *control.Server, window *pcapWindow) {
+	server.Handle("START", func(_ context.Context, _ []string) (string, error) {
+		requests, err := window.open()
+		return strconv.FormatUint(requests, 10), err
+	})
+	server.Handle("STOP", func(_ context.Context, _ []string) (string, error) {
+		requests, err := window.close()
+		return strconv.FormatUint(requests, 10), err
+	})
+}
+
+// registerStatusCommand exposes the state of every task, along with the scheduler state reported by heartbeats.
+func registerStatusCommand(server *control.Server, tasks []*pcapTask) {
+	server.Handle("STATUS", func(_ context.Context, _ []string) (string, error) {
+		status, err := json.Marshal(newHeartbeat(tasks, directory))
+		return string(status), err
+	})
+}
+
+// recordAction writes a control-plane action into the audit stream, along with the job and execution it resulted in.
+func recordAction(actor *audit.Actor, action string, params []string, result string, err error) {
+	if auditStream == nil {
+		return
+	}
+	record := &audit.Record{
+		Actor:  actor,
+		Action: action,
+		Params: params,
+		Result: result,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if jobID := jid.Load().(uuid.UUID); jobID != uuid.Nil {
+		record.Job = jobID.String()
+	}
+	if exeID := xid.Load().(uuid.UUID); exeID != uuid.Nil {
+		record.Execution = exeID.String()
+	}
+	if err := auditStream.Write(record); err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to record action: %s | %v", action, err))
+	}
+}
+
+// openHistory restores the summaries saved into 'history_file'; a file which cannot be read is replaced.
+func openHistory(size int, path string) *history.Ring {
+	ring, err := history.New(size, path)
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to restore execution history: %s | %v", path, err))
+	} else if path != "" {
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("restored execution history: %s | executions: %d", path, ring.Len()))
+	}
+	return ring
+}
+
+// startHTTPServer serves the HTTP API on `addr` until `ctx` is done; failing to serve it never stops packet capturing.
+func startHTTPServer(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	if executionHistory != nil {
+		executionHistory.Handle(mux)
+	}
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("starting HTTP server: %s", addr))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("HTTP server failed: %s | %v", addr, err))
+	}
+}
+
+func startControlServer(ctx context.Context, server *control.Server) {
+	server.OnCommand(func(ctx context.Context, command string, args []string, result string, err error) {
+		if err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("control command failed: %s %v | %v", command, args, err))
+		}
+		actor := &audit.Actor{Source: audit.SourceControlSocket}
+		if peer, ok := control.PeerFromContext(ctx); ok {
+			actor.PID, actor.UID, actor.GID = &peer.PID, &peer.UID, &peer.GID
+			actor.Process = audit.ProcessName(peer.PID)
+		}
+		recordAction(actor, command, args, result, err)
+	})
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("starting control socket: %s", server.Path()))
+	if err := server.Serve(ctx); err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("control socket failed: %s | %v", server.Path(), err))
+	}
+}
+
+// override returns `value` if the profile sets it, `flag` otherwise.
+func override[T any](value, flag *T) *T {
+	if value != nil {
+		return value
+	}
+	return flag
+}
+
+// newPcapProfile creates 1 set of tasks for every concurrent execution allowed by `profile`, and the job which
+// runs each execution with one of them; it returns the jobs which log the executions of each set.
+func newPcapProfile(profile *profiles.Profile, newTasks func(label string) []*pcapTask) []*tcpdumpJob {
+	jobs := make([]*tcpdumpJob, 0, profile.MaxConcurrent)
+	slots := make([]*capture.Slot, 0, profile.MaxConcurrent)
+	for i := 0; i < profile.MaxConcurrent; i++ {
+		label := profile.Name
+		if profile.MaxConcurrent > 1 {
+			label = fmt.Sprintf("%s-%d", profile.Name, i)
+		}
+		exe := &atomic.Value{}
+		exe.Store(uuid.Nil)
+		job := &tcpdumpJob{
+			tasks:   newTasks(label),
+			Name:    label,
+			exe:     exe,
+			profile: profile,
+		}
+		jobs = append(jobs, job)
+		slots = append(slots, &capture.Slot{Tasks: captureTasks(job.tasks), Hooks: newJobHooks(job)})
+	}
+
+	j := capture.NewJob(profile.Name, capture.Schedule{
+		CronExp: profile.CronExp,
+		Seconds: true,
+		Timeout: time.Duration(*override(profile.Timeout, duration)) * time.Second,
+	}, slots...)
+	for _, job := range jobs {
+		job.j = j
+	}
+	return jobs
+}
+
+// schedule executes `scheduledJobs` with 1 manager until `ctx` is done; jobs which share
+// the same capture job execute its slots, i/e: the concurrent executions of a profile.
+func schedule(ctx context.Context, scheduledJobs []*tcpdumpJob, job *tcpdumpJob, tcpStopChannel chan<- bool) {
+	location := loadTimezone(timezone)
+	jlog(INFO, job, fmt.Sprintf("parsed timezone: %v", location))
+
+	manager := capture.NewManager(location, nil)
+	manager.Tags = jobTags()
+
+	// the job which logs the scheduling of every capture job
+	captureJobs := map[*capture.Job]*tcpdumpJob{}
+	for _, scheduledJob := range scheduledJobs {
+		if _, added := captureJobs[scheduledJob.j]; added {
+			continue
+		}
+		if err := manager.Add(scheduledJob.j); err != nil {
+			fatal(exitConfigError, fmt.Sprintf("failed to create scheduled job '%s': %v", scheduledJob.j.Name(), err))
+		}
+		captureJobs[scheduledJob.j] = scheduledJob
+	}
+
+	if err := manager.Schedule(ctx); err != nil {
+		fatal(exitConfigError, fmt.Sprintf("failed to create scheduler: %v", err))
+	}
+
+	for _, scheduledJob := range scheduledJobs {
+		scheduledJob.Jid = scheduledJob.j.ID()
+		scheduledJob.Tags = scheduledJob.j.Tags()
+	}
+	for _, j := range manager.Jobs() {
+		scheduledJob := captureJobs[j]
+		jobs.Set(scheduledJob.Jid, scheduledJob)
+		if scheduledJob.profile != nil {
+			jlog(INFO, scheduledJob, fmt.Sprintf("scheduled profile: %s | max concurrent executions: %d", scheduledJob.profile.Name, scheduledJob.profile.MaxConcurrent))
+		} else {
+			jid.Store(uuid.MustParse(scheduledJob.Jid))
+			jlog(INFO, scheduledJob, "scheduled job")
+		}
+	}
+
+	// start the TCP listener for health checks
+	go startTCPListener(ctx, hc_port, job, tcpStopChannel)
+
+	waitForApp(ctx, wait_for, time.Duration(*wait_to)*time.Second)
+
+	manager.Start()
+
+	for _, j := range manager.Jobs() {
+		scheduledJob := captureJobs[j]
+		if nextRun := j.NextRun(); nextRun.IsZero() {
+			continue
+		} else if scheduledJob.profile != nil {
+			jlog(INFO, job, fmt.Sprintf("next execution of profile '%s': %v", j.Name(), nextRun))
+		} else {
+			jlog(INFO, scheduledJob, fmt.Sprintf("next execution: %v", nextRun))
+		}
+	}
+
+	// Block main goroutine until a signal is received
+	<-ctx.Done()
+
+	manager.Shutdown()
+	jlog(INFO, job, "scheduler terminated")
+}
+
+// newPayloadFilter builds the same BPF filter used by all other engines, which
+// is either the complex `filter` or the one built using 'Simple PCAP filters'.
+func newPayloadFilter(ctx context.Context, filter *string, filters []pcap.PcapFilterProvider) string {
+	if *filter != "" {
+		return *filter
+	}
+	payloadFilter := ""
+	for _, provider := range filters {
+		if f := provider.Apply(ctx, &payloadFilter, pcap.PCAP_FILTER_MODE_AND); f != nil {
+			payloadFilter = *f
+		}
+	}
+	return payloadFilter
+}
+
+// fileNameIdentity allows to disambiguate files produced by many instances/revisions:
+// `<revision>_<instance-hash>`; characters which are meaningful for file names or time formatting are removed.
+func fileNameIdentity() string {
+	parts := []string{}
+	for _, part := range []string{identity.Revision, identity.InstanceHash()} {
+		part = strings.NewReplacer("/", "", "%", "", "_", "-", " ", "").Replace(part)
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// prepareDirectories creates the directories where PCAP files are written if they are missing,
+// and verifies that files may be written and renamed into them before any PCAP engine is started;
+// otherwise, a missing or read-only mount would only surface as an engine error at the first rotation.
+func prepareDirectories(directory *string, isGAE bool, minFreeMiB *int) {
+	directories := []string{*directory}
+	if isGAE {
+		directories = append(directories, filepath.Dir(gaeFileOutput))
+	}
+	minFree := uint64(max(*minFreeMiB, 0)) * 1024 * 1024
+	for _, dir := range directories {
+		free, err := preflight.PrepareDirectory(dir, minFree)
+		if err != nil {
+			fatal(exitConfigError, fmt.Sprintf("output directory is not usable: %v", err))
+		}
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("output directory %s is writable | free: %d bytes", dir, free))
+	}
+}
+
+func findMount(directory *string) *storage.Mount {
+	mount, err := storage.FindMount(*directory)
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to find mount for: %s | %v", *directory, err))
+		return nil
+	}
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("directory %s is mounted at %s | type: %s | source: %s",
+		*directory, mount.Point, mount.FsType, mount.Source))
+	return mount
+}
+
+func detectGCSFuse(mount *storage.Mount, directory, mode *string) bool {
+	if isFuse, err := strconv.ParseBool(*mode); err == nil {
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("Cloud Storage FUSE detection skipped: %s | enabled: %t", *directory, isFuse))
+		return isFuse
+	}
+
+	isFuse := mount != nil && mount.IsGCSFuse()
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("directory %s is Cloud Storage FUSE: %t", *directory, isFuse))
+	return isFuse
+}
+
+func detectNetworkFs(mount *storage.Mount, directory, mode *string) bool {
+	if isNetworkFs, err := strconv.ParseBool(*mode); err == nil {
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("network filesystem detection skipped: %s | enabled: %t", *directory, isNetworkFs))
+		return isNetworkFs
+	}
+
+	isNetworkFs := mount != nil && mount.IsNetworkFs()
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("directory %s is a network filesystem: %t", *directory, isNetworkFs))
+	return isNetworkFs
+}
+
+// prepareSpillDirectory verifies that `spillDir` is writable, and starts spilling the files rotated in `directory` into it.
+func prepareSpillDirectory(directory, spillDir *string) {
+	free, err := preflight.PrepareDirectory(*spillDir, 0)
+	if err != nil {
+		fatal(exitConfigError, fmt.Sprintf("spill directory is not usable: %v", err))
+	}
+	findMount(spillDir)
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("rotated PCAP files are spilled from %s into %s | free: %d bytes", *directory, *spillDir, free))
+	spiller = storage.NewSpiller(*directory, *spillDir, storage.DefaultSpillQueueSize, onFileSpilled)
+}
+
+// spillRotatedFiles queues the files in `directory` which are no longer written into to be moved into `spill_dir`: all but the
+// newest file of every task, as file names start with the time when they were created; `all` also queues the newest ones.
+func spillRotatedFiles(directory, extension *string, all bool) int {
+	paths, err := findFiles(*directory, leftoverFileRegex(*extension))
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to scan for rotated files: %s | %v", *directory, err))
+		return 0
+	}
+
+	// the files of a task share everything but the timestamp and sequence, across execution directories
+	newest := map[string]string{}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		series := name[:strings.LastIndex(name, "__")] + filepath.Ext(name)
+		if current, ok := newest[series]; !ok || name > filepath.Base(current) {
+			newest[series] = path
+		}
+	}
+	active := map[string]bool{}
+	if !all {
+		for _, path := range newest {
+			active[path] = true
+		}
+	}
+
+	queued := 0
+	for _, path := range paths {
+		if !active[path] && spiller.Spill(path) {
+			queued += 1
+		}
+	}
+	return queued
+}
+
+// spillFiles spills the files rotated in `directory` every `interval` until `ctx` is done.
+func spillFiles(ctx context.Context, directory, extension *string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			spillRotatedFiles(directory, extension, false)
+		}
+	}
+}
+
+func onFileSpilled(spill *storage.Spill) {
+	if spill.Err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to spill file: %s | target: %s | %v", spill.Source, spill.Target, spill.Err))
+		currentExecution.Load().AddEvent("pcap.spill_failed", map[string]string{"file": spill.Source, "error": spill.Err.Error()})
+		return
+	}
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("spilled file: %s | target: %s | bytes: %d | latency: %v",
+		spill.Source, spill.Target, spill.Bytes, spill.Latency), spill)
+}
+
+// guardMemoryVolume returns the amount of bytes that PCAP files are allowed to use
+// if `directory` counts against the instance memory, or `0` if there is no need to guard it.
+func guardMemoryVolume(mount *storage.Mount, directory *string, budgetPercent, maxInterval *int) uint64 {
+	if mount == nil || !mount.IsMemoryBacked() || *budgetPercent <= 0 {
+		return 0
+	}
+
+	memoryLimit, err := storage.MemoryLimit()
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to get memory limit: %v", err))
+		return 0
+	}
+	budget := memoryLimit / 100 * uint64(*budgetPercent)
+
+	jlog(WARNING, &emptyTcpdumpJob, fmt.Sprintf("directory %s is in-memory: PCAP files count against the instance memory | limit: %d bytes | budget: %d bytes ( %d%% )",
+		*directory, memoryLimit, budget, *budgetPercent))
+
+	// rotate aggressively so that PCAP files are exported and deleted as soon as possible
+	if *maxInterval > 0 && (*interval <= 0 || *interval > *maxInterval) {
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("PCAP files rotation interval reduced from %ds to %ds", *interval, *maxInterval))
+		*interval = *maxInterval
+	}
+
+	return budget
+}
+
+// latencyPoints returns the latency percentiles of the busiest destinations observed during the previous report.
+func latencyPoints(task *pcapTask) []*stats.Point {
+	points := []*stats.Point{}
+	for _, report := range task.latency.LastReports(maxLatencyMetricDestinations) {
+		for name, percentiles := range map[string]*analysis.Percentiles{
+			"latency/handshake":     report.Handshake,
+			"latency/first_byte":    report.FirstByte,
+			"latency/tls_handshake": report.TLSHandshake,
+		} {
+			if percentiles == nil {
+				continue
+			}
+			for percentile, value := range map[string]float64{"p50": percentiles.P50, "p95": percentiles.P95, "p99": percentiles.P99} {
+				labels := map[string]string{"iface": task.Iface(), "destination": report.Destination, "percentile": percentile}
+				points = append(points, stats.DoublePoint(name, labels, value))
+			}
+		}
+	}
+	return points
+}
+
+// tlsFailurePoints returns the amount of failed TLS handshakes per destination and reason since the previous report.
+func tlsFailurePoints(task *pcapTask) []*stats.Point {
+	points := []*stats.Point{}
+	for destination, reasons := range task.tls.TakeFailures() {
+		for reason, count := range reasons {
+			labels := map[string]string{"iface": task.Iface(), "destination": destination, "reason": reason}
+			points = append(points, stats.Int64Point("tls/handshake_failures", labels, count))
+		}
+	}
+	return points
+}
+
+func collectMetrics(
+	tasks []*pcapTask,
+	taskCounters map[*pcapTask]stats.CountersSnapshot,
+	ifaceCounters map[string]*stats.IfaceCounters,
+	executionsCounter *uint64,
+) []*stats.Point {
+	points := []*stats.Point{}
+
+	for _, task := range tasks {
+		labels := map[string]string{"iface": task.Iface(), "engine": task.Engine()}
+		current := task.Counters().Snapshot()
+		delta := current.Sub(taskCounters[task])
+		taskCounters[task] = current
+		// `tcpdump` writes PCAP files by itself: packets are not visible to `tcpdumpw`
+		if task.Engine() != "tcpdump" {
+			points = append(points,
+				stats.Int64Point("packets", labels, delta.Packets),
+				stats.Int64Point("bytes", labels, delta.Bytes))
+		}
+		points = append(points, stats.Int64Point("rotations", labels, delta.Rotations))
+
+		if task.latency != nil {
+			points = append(points, latencyPoints(task)...)
+		}
+
+		if task.tls != nil {
+			points = append(points, tlsFailurePoints(task)...)
+		}
+
+		if _, ok := ifaceCounters[task.Iface()]; ok || task.Iface() == capture.AnyIface {
+			continue // many tasks share the same iface
+		}
+		if counters, err := stats.ReadIfaceCounters(task.Iface()); err == nil {
+			ifaceCounters[task.Iface()] = counters
+		}
+	}
+
+	for iface, previous := range ifaceCounters {
+		current, err := stats.ReadIfaceCounters(iface)
+		if err != nil {
+			continue
+		}
+		delta := current.Sub(previous)
+		ifaceCounters[iface] = current
+		labels := map[string]string{"iface": iface}
+		points = append(points,
+			stats.Int64Point("iface/packets", labels, delta.Packets),
+			stats.Int64Point("iface/bytes", labels, delta.Bytes),
+			stats.Int64Point("iface/drops", labels, delta.Drops))
+	}
+
+	currentExecutions := executions.Load()
+	points = append(points, stats.Int64Point("executions", nil, currentExecutions-*executionsCounter))
+	*executionsCounter = currentExecutions
+
+	return points
+}
+
+// reportMetrics pushes the amount of packets, bytes, drops and rotations observed
+// since the previous report into all `sinks`; a last report is pushed when `ctx` is done.
+func reportMetrics(ctx context.Context, tasks []*pcapTask, interval time.Duration, sinks []metricsSink) {
+	taskCounters := make(map[*pcapTask]stats.CountersSnapshot, len(tasks))
+	ifaceCounters := make(map[string]*stats.IfaceCounters)
+	executionsCounter := uint64(0)
+	// initialize interfaces counters so that the 1st report only contains traffic observed by the sidecar
+	collectMetrics(tasks, taskCounters, ifaceCounters, &executionsCounter)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		done := false
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+		}
+
+		points := collectMetrics(tasks, taskCounters, ifaceCounters, &executionsCounter)
+		// `ctx` might be done, but the last report must still be delivered
+		writeCtx, writeCancel := context.WithTimeout(context.Background(), monitoringTimeout)
+		now := time.Now()
+		for _, sink := range sinks {
+			if err := sink.write(writeCtx, now, points); err != nil {
+				jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to push metrics into %s: %v", sink.name, err))
+			}
+		}
+		writeCancel()
+
+		if done {
+			return
+		}
+	}
+}
+
+// watchMemoryVolume rotates all PCAP files when they use more than `budget` bytes,
+// so that they are exported and deleted before the instance runs out of memory; `tcpdump` is restarted to be rotated.
+func watchMemoryVolume(ctx context.Context, tasks []*pcapTask, directory *string, budget uint64) {
+	ticker := time.NewTicker(memoryVolumeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		usage, err := storage.DirectorySize(*directory)
+		if err != nil || usage <= budget {
+			continue
+		}
+
+		rotatedWriters := rotateWriters(tasks)
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("PCAP files exceeded in-memory budget | usage: %d bytes | budget: %d bytes | rotated writers: %d",
+			usage, budget, rotatedWriters))
+	}
+}
+
+// watchDisk pauses all engines when the PCAP files directory runs out of space, and signals `pcap_fsn` to export
+// ( and delete ) pending files until enough space is recovered; engines are resumed by their supervisors.
+func watchDisk(ctx context.Context, tasks []*pcapTask, flushSignal *string) {
+	ticker := time.NewTicker(diskGuardInterval)
+	defer ticker.Stop()
+
+	var lastFlushTS time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		transition, err := diskGuard.Check()
+		if err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to get free space of: %s | %v", *directory, err))
+			continue
+		}
+
+		if transition != nil {
+			message := fmt.Sprintf("disk state: %s => %s | %s | free: %d bytes | threshold: %d bytes",
+				transition.From, transition.To, transition.Reason, transition.Free, transition.Threshold)
+			if transition.To == storage.DiskPaused {
+				jlogWithData(ERROR, &emptyTcpdumpJob, message, transition)
+			} else {
+				jlogWithData(INFO, &emptyTcpdumpJob, message, transition)
+			}
+		}
+
+		if diskGuard.State() != storage.DiskPaused {
+			continue
+		}
+		// engines which were starting while pausing must be stopped as well
+		abortTasks(tasks, errDiskFull)
+
+		if time.Since(lastFlushTS) < diskFlushInterval {
+			continue
+		}
+		// `TCPDUMPW_FLUSH` file creation signals `pcap_fsn` to export all files without waiting for rotation
+		if err := createSignal(flushSignal); err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("'tcpdumpw' flush signal creation failed: %s | %v", *flushSignal, err))
+		}
+		lastFlushTS = time.Now()
+	}
+}
+
+// abortTasks stops the current run of every engine with `cause`.
+func abortTasks(tasks []*pcapTask, cause error) {
+	for _, task := range tasks {
+		task.Abort(cause)
+	}
+}
+
+func nextScheduledRun() *time.Time {
+	var nextRun *time.Time
+	jobs.ForEach(func(_ string, job *tcpdumpJob) bool {
+		if job.j == nil {
+			return true
+		}
+		if next := job.j.NextRun(); !next.IsZero() && (nextRun == nil || next.Before(*nextRun)) {
+			nextRun = &next
+		}
+		return true
+	})
+	return nextRun
+}
+
+func newHeartbeat(tasks []*pcapTask, directory *string) *pcapHeartbeat {
+	uptime := time.Since(startTime).Round(time.Second)
+	heartbeat := &pcapHeartbeat{
+		Uptime:      uptime.String(),
+		UptimeSecs:  int64(uptime.Seconds()),
+		NextRun:     nextScheduledRun(),
+		ActiveTasks: activeTasks.Load(),
+		Executions:  executions.Load(),
+	}
+	for _, task := range tasks {
+		heartbeat.Tasks = append(heartbeat.Tasks, taskHealth(task.Task))
+		counters := task.Counters().Snapshot()
+		heartbeat.Packets += counters.Packets
+		heartbeat.Rotations += counters.Rotations
+		if task.sampler != nil {
+			heartbeat.Suppressed += task.sampler.Suppressed()
+		}
+	}
+	if size, err := storage.DirectorySize(*directory); err == nil {
+		heartbeat.FileBytes = size
+	}
+	if usage, err := storage.DiskUsage(*directory); err == nil {
+		heartbeat.Disk = usage
+	}
+	if engines != nil {
+		usage := engines.Usage()
+		heartbeat.Engines = &usage
+	}
+	if markerProbe != nil {
+		status := markerProbe.Status()
+		heartbeat.Probe = &status
+	}
+	return heartbeat
+}
+
+// beat periodically logs the scheduler state, so that an idle sidecar
+// can be told apart from one where the PCAP engines stopped making progress.
+func beat(ctx context.Context, tasks []*pcapTask, directory *string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		heartbeat := newHeartbeat(tasks, directory)
+		jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("heartbeat | uptime: %s | active tasks: %d", heartbeat.Uptime, heartbeat.ActiveTasks), heartbeat)
+	}
+}
+
+// reportLatency logs the TCP latency percentiles for every destination observed
+// since the previous report; a last report is logged when `ctx` is done.
+func reportLatency(ctx context.Context, tasks []*pcapTask, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		done := false
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+		}
+
+		for _, task := range tasks {
+			if task.latency == nil {
+				continue
+			}
+			for _, report := range task.latency.Report() {
+				jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("TCP latency: %s | iface: %s", report.Destination, report.Iface), report)
+			}
+		}
+
+		if done {
+			return
+		}
+	}
+}
+
+// reportQUIC logs the QUIC vs TCP traffic split of every destination periodically.
+func reportQUIC(ctx context.Context, tasks []*pcapTask, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, task := range tasks {
+			if task.quic == nil {
+				continue
+			}
+			for _, split := range task.quic.TakeSplit() {
+				jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("QUIC/TCP split: %s | iface: %s | QUIC bytes: %d | TCP bytes: %d",
+					split.Destination, task.Iface(), split.QUICBytes, split.TCPBytes), split)
+			}
+		}
+	}
+}
+
+// ifaceStatsPoints returns the metrics of `sample`; packets and bytes are broken down by protocol.
+func ifaceStatsPoints(sample *ifstats.Sample) []*stats.Point {
+	labels := map[string]string{"iface": sample.Iface}
+	points := []*stats.Point{
+		stats.DoublePoint("iface_stats/pps", labels, sample.PPS),
+		stats.DoublePoint("iface_stats/bps", labels, sample.BPS),
+		stats.Int64Point("iface_stats/drops", labels, sample.Drops),
+	}
+	for protocol, counts := range sample.Protocols {
+		labels := map[string]string{"iface": sample.Iface, "protocol": protocol}
+		points = append(points,
+			stats.Int64Point("iface_stats/packets", labels, counts.Packets),
+			stats.Int64Point("iface_stats/bytes", labels, counts.Bytes))
+	}
+	return points
+}
+
+// publishIfaceStats logs `sample`, and pushes it into all `sinks`.
+func publishIfaceStats(sample *ifstats.Sample, sinks []metricsSink) {
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("iface stats: %s | pps: %.1f | bps: %.1f | drops: %d",
+		sample.Iface, sample.PPS, sample.BPS, sample.Drops), sample)
+
+	if len(sinks) == 0 {
+		return
+	}
+	points := ifaceStatsPoints(sample)
+	ctx, cancel := context.WithTimeout(context.Background(), monitoringTimeout)
+	defer cancel()
+	for _, sink := range sinks {
+		if err := sink.write(ctx, sample.End, points); err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to push iface stats into %s: %v", sink.name, err))
+		}
+	}
+}
+
+// sampleIfaces samples the traffic of all `devices` until `ctx` is done, independently of packet capturing;
+// samplers which fail, i/e: because their iface went away, are restarted after `interval`.
+func sampleIfaces(ctx context.Context, devices []*pcap.PcapDevice, interval time.Duration, sinks []metricsSink) {
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		sampler := ifstats.NewSampler(device.NetInterface.Name, "", interval, func(sample *ifstats.Sample) {
+			publishIfaceStats(sample, sinks)
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("sampling iface stats: %s | interval: %v", sampler.Iface(), interval))
+				if err := sampler.Run(ctx); err != nil {
+					jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to sample iface stats: %s | %v", sampler.Iface(), err))
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// reportConnections logs a snapshot of the TCP connection table of every task periodically.
+func reportConnections(ctx context.Context, tasks []*pcapTask, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, task := range tasks {
+			if task.conns == nil {
+				continue
+			}
+			for _, snapshot := range task.conns.Snapshot() {
+				jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("connections: %s | iface: %s | open: %d | half-open: %d | closing: %d",
+					snapshot.Peer, task.Iface(), snapshot.Open, snapshot.HalfOpen, snapshot.Closing), snapshot)
+			}
+		}
+	}
+}
+
+// reportFlows exports the flow records of every task periodically;
+// all remaining flows are exported by `waitDone` once all tasks are stopped.
+func reportFlows(ctx context.Context, tasks []*pcapTask, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, task := range tasks {
+			if task.flows != nil {
+				task.flows.Export(time.Now(), false)
+			}
+		}
+	}
+}
+
+func onFlowRecord(record *analysis.FlowRecord) {
+	if geoDatabase != nil {
+		record.SrcGeo = geoDatabase.Lookup(record.Src)
+		record.DstGeo = geoDatabase.Lookup(record.Dst)
+	}
+	if rdnsResolver != nil {
+		record.SrcHost = rdnsResolver.Lookup(record.Src)
+		record.DstHost = rdnsResolver.Lookup(record.Dst)
+	}
+	if traceTable != nil && record.SrcPort != 0 {
+		record.Trace, record.Span, _ = traceTable.Lookup(
+			fmt.Sprintf("%s:%d", record.Src, record.SrcPort), fmt.Sprintf("%s:%d", record.Dst, record.DstPort))
+	}
+	if flowExporter != nil {
+		flowExporter.Export(record)
+	}
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("flow %s %s:%d > %s:%d | packets: %d | bytes: %d | reason: %s",
+		record.Proto, record.Src, record.SrcPort, record.Dst, record.DstPort, record.Packets, record.Bytes, record.Reason), record)
+}
+
+func onDNSRecord(record *analysis.DNSRecord) {
+	if record.TimedOut {
+		jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("DNS %s | server: %s | timed out", record.Names(), record.Server), record)
+		return
+	}
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("DNS %s | server: %s | rcode: %s | answers: %d | latency: %.3fms",
+		record.Names(), record.Server, record.RCode, len(record.Answers), record.Latency), record)
+}
+
+func onQUICRecord(record *analysis.QUICRecord) {
+	server := record.SNI
+	if server == "" {
+		server = record.Server
+	}
+	if record.Type == analysis.QUICMigration {
+		jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("QUIC %s | migrated to: %s | migrations: %d", server, record.Client, record.Migrations), record)
+		return
+	}
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("QUIC %s | version: %s | ja4: %s", server, record.Version, record.JA4), record)
+}
+
+func onTLSRecord(record *analysis.TLSRecord) {
+	server := record.SNI
+	if server == "" {
+		server = record.Server
+	}
+	if record.TimedOut {
+		jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("TLS %s | ja4: %s | no server hello", server, record.JA4), record)
+		return
+	}
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("TLS %s | version: %s | cipher: %s | ja4: %s",
+		server, record.Version, record.Cipher, record.JA4), record)
+}
+
+func onTLSFailure(failure *analysis.TLSFailure) {
+	server := failure.SNI
+	if server == "" {
+		server = failure.Server
+	}
+	jlogWithData(WARNING, &emptyTcpdumpJob, fmt.Sprintf("TLS %s | handshake failed: %s | sender: %s | client: %s",
+		server, failure.Reason, failure.Sender, failure.Client), failure)
+}
+
+func onHTTPTransaction(transaction *analysis.HTTPTransaction) {
+	if transaction.TimedOut {
+		jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("HTTP %s %s%s | server: %s | no response",
+			transaction.Method, transaction.Host, transaction.Path, transaction.Server), transaction)
+		return
+	}
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("HTTP %s %s%s | status: %d | latency: %.3fms",
+		transaction.Method, transaction.Host, transaction.Path, transaction.Status, transaction.Latency), transaction)
+}
+
+func onWebSocketSession(session *analysis.WebSocketSession) {
+	// `1000` is a normal closure, and `1001` is sent by peers going away, i/e: servers shutting down
+	severity := INFO
+	if session.Ended != analysis.WebSocketEndedIdle && session.CloseCode != 1000 && session.CloseCode != 1001 {
+		severity = WARNING
+	}
+	jlogWithData(severity, &emptyTcpdumpJob, fmt.Sprintf("WebSocket %s%s | close code: %d | closed by: %s | ended: %s | frames: %d/%d",
+		session.Host, session.Path, session.CloseCode, session.ClosedBy, session.Ended,
+		session.ClientFrames.Frames, session.ServerFrames.Frames), session)
+}
+
+func onH2Event(event *analysis.H2Event) {
+	switch event.Type {
+	case analysis.H2EventHeaders:
+		jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("HTTP/2 %s | stream: %d | %s %s%s | status: %d",
+			event.Type, event.StreamID, event.Method, event.Authority, event.Path, event.Status), event)
+	case analysis.H2EventReset, analysis.H2EventGoAway:
+		jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("HTTP/2 %s | stream: %d | error: %s | server: %s",
+			event.Type, event.StreamID, event.ErrorCode, event.Server), event)
+	default:
+		jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("HTTP/2 %s | stream: %d | window: %d | %s",
+			event.Type, event.StreamID, event.Window, event.Direction), event)
+	}
+}
+
+func onGRPCCall(call *analysis.GRPCCall) {
+	status := call.Status
+	if call.Reset != "" {
+		status = "RST_STREAM " + call.Reset
+	}
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("gRPC /%s/%s | status: %s | messages: %d/%d | latency: %.3fms",
+		call.Service, call.Method, status, call.RequestMessages, call.ResponseMessages, call.Latency), call)
+}
+
+func onTCPClose(event *analysis.CloseEvent) {
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("TCP %s: %s:%d > %s:%d", event.Type,
+		event.ClientIP, event.ClientPort, event.ServerIP, event.ServerPort), event)
+
+	if resetAlerts == nil || event.Type != analysis.CloseEventReset {
+		return
+	}
+	if resets, alert := resetAlerts.Observe(event.Timestamp); alert {
+		jlogWithData(ERROR, &emptyTcpdumpJob, fmt.Sprintf("burst of TCP resets: %d within %v | iface: %s", resets, resetAlertWindow, event.Iface), event)
+	}
+}
+
+func onAnomaly(event *analysis.AnomalyEvent) {
+	severity := WARNING
+	if event.Severity == string(ERROR) {
+		severity = ERROR
+	}
+	switch event.Type {
+	case analysis.AnomalySYNFlood, analysis.AnomalySYNRate:
+		jlogWithData(severity, &emptyTcpdumpJob, fmt.Sprintf("anomaly %s: %d connection attempts within %s | average: %.1f | iface: %s",
+			event.Type, event.Count, event.Window, event.Baseline, event.Iface), event)
+	case analysis.AnomalyPortScan:
+		jlogWithData(severity, &emptyTcpdumpJob, fmt.Sprintf("anomaly %s: %s tried %d ports within %s | iface: %s",
+			event.Type, event.Source, event.Count, event.Window, event.Iface), event)
+	default:
+		jlogWithData(severity, &emptyTcpdumpJob, fmt.Sprintf("anomaly %s: %s > %s | iface: %s",
+			event.Type, event.Source, event.Destination, event.Iface), event)
+	}
+}
+
+// onProbeEvent alerts when markers sent by the probe stop appearing in the captured packets, and when they appear again;
+// the webhook is notified asynchronously, so that writers are never blocked.
+func onProbeEvent(event *probe.Event) {
+	var text string
+	severity := INFO
+	if event.Type == probe.EventMissing {
+		severity = ERROR
+		text = fmt.Sprintf("probe markers are not being captured: %s | silence: %s | sent: %d | captured: %d",
+			event.Target, event.Silence, event.Sent, event.Captured)
+	} else {
+		text = fmt.Sprintf("probe markers are being captured again: %s | silence: %s | sent: %d | captured: %d",
+			event.Target, event.Silence, event.Sent, event.Captured)
+	}
+	jlogWithData(severity, &emptyTcpdumpJob, text, event)
+
+	hook := webhook.Load()
+	if hook == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := hook.Send(ctx, text, event); err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to notify webhook: %s | %v", hook, err))
+		}
+	}()
+}
+
+func onMTUEvent(event *analysis.MTUEvent) {
+	severity := WARNING
+	if event.Severity == string(ERROR) {
+		severity = ERROR
+	}
+	switch event.Type {
+	case analysis.MTUFragmented:
+		jlogWithData(severity, &emptyTcpdumpJob, fmt.Sprintf("mtu %s: %d fragments %s > %s | iface: %s",
+			event.Type, event.Count, event.Source, event.Destination, event.Iface), event)
+	case analysis.MTUFragmentationNeeded:
+		jlogWithData(severity, &emptyTcpdumpJob, fmt.Sprintf("mtu %s: %s > %s | router: %s | iface: %s",
+			event.Type, event.Source, event.Destination, event.Router, event.Iface), event)
+	default:
+		jlogWithData(severity, &emptyTcpdumpJob, fmt.Sprintf("mtu %s: %s > %s | mss: %d | iface: %s",
+			event.Type, event.Source, event.Destination, event.MSS, event.Iface), event)
+	}
+}
+
+func onICMPEvent(event *analysis.ICMPEvent) {
+	severity := WARNING
+	if event.Severity == string(ERROR) {
+		severity = ERROR
+	}
+	jlogWithData(severity, &emptyTcpdumpJob, fmt.Sprintf("ICMP %s: %s | %s %s > %s | reporter: %s | count: %d | iface: %s",
+		event.Type, event.Message, event.Proto, event.Source, event.Destination, event.Reporter, event.Count, event.Iface), event)
+}
+
+// newAnomalyConfig returns `nil` if anomaly detection is disabled; addresses of local interfaces
+// are always allowed, so that inbound traffic is not reported as unexpected.
+func newAnomalyConfig() *analysis.AnomalyConfig {
+	if !*anomalies {
+		return nil
+	}
+	config := &analysis.AnomalyConfig{
+		SYNFloodRate:  *syn_flood,
+		SYNRateFactor: synRateFactor,
+		ScanPorts:     *scan_ports,
+		ScanWindow:    anomalyScanWindow,
+	}
+	for _, value := range strings.Split(*allowed_to, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("invalid allowed destination: %s | %v", value, err))
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		config.AllowedDestinations = append(config.AllowedDestinations, prefix.Masked())
+	}
+	if len(config.AllowedDestinations) == 0 {
+		return config
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if prefix, err := netip.ParsePrefix(addr.String()); err == nil {
+				config.AllowedDestinations = append(config.AllowedDestinations, netip.PrefixFrom(prefix.Addr(), prefix.Addr().BitLen()))
+			}
+		}
+	}
+	return config
+}
+
+func onTCPEvent(event *analysis.Event) {
+	if event.Type == analysis.EventStalled {
+		jlogWithData(WARNING, &emptyTcpdumpJob, fmt.Sprintf("TCP %s: %s | seq: %d | ack: %d | stall: %s", event.Type, event.Flow, event.Seq, event.Ack, event.Stall), event)
+		return
+	}
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("TCP %s: %s | seq: %d | ack: %d", event.Type, event.Flow, event.Seq, event.Ack), event)
+}
+
+func onSuppressedRecords(iface *string, window time.Time, suppressed uint64) {
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("suppressed JSON PCAP records for iface: %s | window: %s | records: %d",
+		*iface, window.Format(time.RFC3339), suppressed))
+}
+
+func onSinkDegraded(iface *string, sink string, policy sinks.Policy, dropped, failed uint64) {
+	jlog(WARNING, &emptyTcpdumpJob, fmt.Sprintf("JSON sink degraded: %s | sink: %s | policy: %s | dropped: %d | failed: %d",
+		*iface, sink, policy, dropped, failed))
+	currentExecution.Load().AddEvent("pcap.sink_degraded", map[string]string{
+		"iface": *iface, "sink": sink, "policy": string(policy),
+		"dropped": strconv.FormatUint(dropped, 10), "failed": strconv.FormatUint(failed, 10),
+	})
+}
+
+func onFuseFileClosed(path string, size int64, err error) {
+	if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to upload file: %s | bytes: %d | %v", path, size, err))
+		return
+	}
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("uploaded file: %s | bytes: %d", path, size))
+}
+
+func newFileWriter(ctx context.Context, ifaceAndIndex, output, extension, timezone *string, interval int) (pcap.PcapWriter, error) {
+	if isGCSFuse {
+		return storage.NewFuseWriter(ctx, ifaceAndIndex, output, extension, timezone, interval, *fuse_buf*1024, onFuseFileClosed)
+	}
+	if isNetworkFs {
+		// writers provided by `pcap-cli` flush every 4 KiB, which are as many round trips to the file server
+		writer, err := storage.NewFuseWriter(ctx, ifaceAndIndex, output, extension, timezone, interval, *nfs_buf*1024, nil)
+		if err == nil {
+			writer.SyncEvery(ctx, time.Duration(*nfs_sync)*time.Second, func(err error) {
+				jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to sync JSON file for iface: %s | %v", *ifaceAndIndex, err))
+			})
+		}
+		return writer, err
+	}
+	if *file_ms || *file_seq {
+		// writers provided by `pcap-cli` name files using `strftime`, which has no directive for milliseconds nor sequences
+		return storage.NewFuseWriter(ctx, ifaceAndIndex, output, extension, timezone, interval, *fuse_buf*1024, nil)
+	}
+	return pcap.NewPcapWriter(ctx, ifaceAndIndex, output, extension, timezone, interval)
+}
+
+// newFileOutput returns the file name template of `netIface`; `label` tells apart the files of tasks of different profiles.
+func newFileOutput(directory *string, netIface *net.Interface, label string) string {
+	ids := []string{}
+	for _, id := range []string{label, fileNameIdentity()} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	output := capture.FileOutput(*directory, netIface, strings.Join(ids, "_"))
+	if *file_ms {
+		output += storage.MillisFileTimestamp
+	}
+	if *file_seq {
+		output += storage.SequenceFileName
+	}
+	return output
+}
+
+// fileTimezone returns the timezone of the timestamps in file names; `tcpdump` always uses the timezone of the container.
+func fileTimezone() string {
+	if strings.EqualFold(*file_tz, "utc") {
+		return "UTC"
+	}
+	return *timezone
+}
+
+// withEnrichment annotates the JSON translated packets written into `writer` with the location and hostname of external IPs,
+// the user defined tags, and the annotations of `extra`.
+func withEnrichment(writer pcap.PcapWriter, extra ...enrich.Annotator) pcap.PcapWriter {
+	annotators := []enrich.Annotator{}
+	if geoDatabase != nil {
+		annotators = append(annotators, geoDatabase)
+	}
+	if rdnsResolver != nil {
+		annotators = append(annotators, rdnsResolver)
+	}
+	if user_tags.Len() > 0 {
+		// tags are strings: they are always encoded
+		annotator, _ := enrich.NewConstantAnnotator(tagsProperty, user_tags.Map())
+		annotators = append(annotators, annotator)
+	}
+	annotators = append(annotators, extra...)
+	if len(annotators) == 0 {
+		return writer
+	}
+	return enrich.NewWriter(writer, annotators...)
+}
+
+// withAnonymization replaces the IP addresses in the JSON translated packets written into `writer`, as `anonymize_key` requires.
+func withAnonymization(writer pcap.PcapWriter) pcap.PcapWriter {
+	return anonymize.NewWriter(writer, anonymizer)
+}
+
+// packetRewriter returns the rewriter of packets written into PCAP files; `nil` if packets are written as captured.
+func packetRewriter() headers.PacketRewriter {
+	if anonymizer == nil {
+		return nil
+	}
+	return anonymizer
+}
+
+// withRedaction masks personal data and credentials in the JSON translated packets written into `writer`, as `redact` requires.
+func withRedaction(writer pcap.PcapWriter) pcap.PcapWriter {
+	return l7.NewRedactWriter(writer, redactionRules)
+}
+
+// withTraceCorrelation adds the Cloud Trace span of their connection into the JSON translated packets written into `writer`.
+func withTraceCorrelation(writer pcap.PcapWriter) pcap.PcapWriter {
+	if traceTable == nil {
+		return writer
+	}
+	return enrich.NewTraceWriter(writer, traceTable)
+}
+
+// withPayloadMatch only writes into `writer` the JSON translated packets, or flows, whose payload matches `payload_match`.
+func withPayloadMatch(writer pcap.PcapWriter) pcap.PcapWriter {
+	return l7.NewMatchWriter(writer, payloadPattern, payloadScope)
+}
+
+// withPayloadMode embeds the application payload of the JSON translated packets written into `writer` as `json_payload` requires,
+// or removes everything decoded from it if `headers_only` is enabled.
+func withPayloadMode(writer pcap.PcapWriter) pcap.PcapWriter {
+	if *hdrs_only {
+		return l7.NewStripWriter(writer)
+	}
+	return l7.NewWriter(writer, payloadMode)
+}
+
+// dryRun validates the configuration without capturing packets, and prints a JSON report into standard output.
+func dryRun(ctx context.Context, filter *string, filters []pcap.PcapFilterProvider) int {
+	report := preflight.NewReport()
+
+	devices := findDevices(pcap_iface)
+	if len(devices) == 0 {
+		report.Add("iface", *pcap_iface, errors.New("no matching devices"), "")
+	}
+	expression := newPayloadFilter(ctx, filter, filters)
+	for _, device := range devices {
+		iface := device.NetInterface.Name
+		report.Add("iface", iface, nil, fmt.Sprintf("index: %d", device.NetInterface.Index))
+		instructions, err := preflight.CompileFilter(iface, *snaplen, expression)
+		report.Add("filter", iface, err, fmt.Sprintf("%d BPF instructions: %s", instructions, expression))
+	}
+
+	minFree := uint64(max(*min_free, 0)) * 1024 * 1024
+	if usage, err := storage.DiskUsage(*directory); err == nil && usage.Free < minFree {
+		report.Add("directory", *directory, fmt.Errorf("%d bytes available, %d bytes required", usage.Free, minFree), "free space")
+	} else {
+		report.Add("directory", *directory, preflight.CheckWritable(*directory), "writable and renamable")
+	}
+
+	endpoints := map[string]string{
+		"log_sink":        *log_sink,
+		"ipfix_collector": *ipfix_to,
+		"otlp_endpoint":   *otlp_url,
+		"notify_webhook":  *notify_url,
+	}
+	if *metrics {
+		endpoints["metrics"] = "https://monitoring.googleapis.com"
+	}
+	if endpoint := endpoints["ipfix_collector"]; endpoint != "" && !strings.Contains(endpoint, "://") {
+		endpoints["ipfix_collector"] = "ipfix+udp://" + endpoint
+	}
+	secretManagerClient := gcp.NewSecretManagerClient(gcp.NewMetadataClient(mdsTimeout), secretTimeout)
+	for name, endpoint := range endpoints {
+		if endpoint == "" {
+			continue
+		}
+		if gcp.IsSecretRef(endpoint) {
+			resolved, err := secretManagerClient.Resolve(ctx, endpoint)
+			if err != nil {
+				report.Add("exporter", name, err, "")
+				continue
+			}
+			endpoint = resolved
+		}
+		detail, err := preflight.ProbeEndpoint(ctx, endpoint, dryRunTimeout)
+		report.Add("exporter", name, err, detail)
+	}
+
+	jReport, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(jReport))
+
+	if !report.Valid {
+		jlog(ERROR, &emptyTcpdumpJob, "dry run failed: configuration is not valid")
+		return exitConfigError
+	}
+	jlog(INFO, &emptyTcpdumpJob, "dry run succeeded: configuration is valid")
+	return exitSuccess
+}
+
+// selfTest proves that packets are captured in this environment, and prints a JSON report into standard output.
+func selfTest(ctx context.Context) int {
+	report := preflight.NewReport()
+
+	ifaces := []string{}
+	for _, device := range findDevices(pcap_iface) {
+		ifaces = append(ifaces, device.NetInterface.Name)
+	}
+	if len(ifaces) == 0 {
+		report.Add("iface", *pcap_iface, errors.New("no matching devices"), "")
+	} else {
+		preflight.SelfTest(ctx, report, ifaces, *snaplen, *st_probe, time.Duration(*st_secs)*time.Second)
+	}
+
+	jReport, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(jReport))
+
+	if !report.Valid {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("self-test failed: probes to %s were not captured", *st_probe))
+		return exitEngineFailure
+	}
+	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("self-test succeeded: probes to %s were captured", *st_probe))
+	return exitSuccess
+}
+
+// engines selected at startup to write PCAP files and to translate packets into JSON; `nil` if none is available.
+var pcapFilesEngine, jsonEngine *pcapEngines.Engine
+
+func init() {
+	pcapEngines.Register(&pcapEngines.Engine{
+		Name:     "tcpdump",
+		Priority: 20,
+		// `tcpdump` is only able to truncate all packets to the same length, and it is not able to rewrite them
+		Capabilities: pcapEngines.Capabilities{
+			Formats: []string{pcapEngines.FormatPCAP}, Source: pcapEngines.Live, Root: true, Binary: "tcpdump", TsType: true,
+		},
+		Factory: func(_ context.Context, config *pcap.PcapConfig) (pcap.PcapEngine, error) {
+			return pcap.NewTcpdump(config)
+		},
+	})
+	pcapEngines.Register(&pcapEngines.Engine{
+		Name:     "pcapgo",
+		Priority: 10,
+		Capabilities: pcapEngines.Capabilities{
+			Formats: []string{pcapEngines.FormatPCAP}, Source: pcapEngines.Live, Root: true, Truncate: true, Rewrite: true, Millis: true, Sequence: true,
+		},
+		Factory: func(ctx context.Context, config *pcap.PcapConfig) (pcap.PcapEngine, error) {
+			engine, err := headers.NewEngine(config, newPayloadFilter(ctx, &config.Filter, config.Filters), fileTimezone(), *hdrs_only, packetRewriter())
+			if err == nil && isNetworkFs {
+				engine.BatchWrites(*nfs_buf*1024, time.Duration(*nfs_sync)*time.Second)
+			}
+			return engine, err
+		},
+	})
+	pcapEngines.Register(&pcapEngines.Engine{
+		Name: "gopacket",
+		Capabilities: pcapEngines.Capabilities{
+			Formats: []string{pcapEngines.FormatJSON}, Source: pcapEngines.Live, Root: true, TsType: true,
+		},
+		Factory: func(_ context.Context, config *pcap.PcapConfig) (pcap.PcapEngine, error) {
+			return pcap.NewPcap(config)
+		},
+	})
+	pcapEngines.Register(&pcapEngines.Engine{
+		Name:         fileEngine,
+		Capabilities: pcapEngines.Capabilities{Formats: []string{pcapEngines.FormatJSON}, Source: pcapEngines.File},
+		Factory: func(ctx context.Context, config *pcap.PcapConfig) (pcap.PcapEngine, error) {
+			return replay.NewEngine(config, *input, newPayloadFilter(ctx, &config.Filter, config.Filters), *replay_rt), nil
+		},
+	})
+}
+
+// engineSource returns where packets are obtained from, according to 'engine'.
+func engineSource() pcapEngines.Source {
+	switch strings.ToLower(*engine_s) {
+	case fileEngine:
+		return pcapEngines.File
+	}
+	return pcapEngines.Live
+}
+
+// selectEngines selects the best available engines to write PCAP files and to translate packets into JSON,
+// so that unavailable ones are reported at startup instead of when capturing starts; it returns the selection.
+func selectEngines() map[string]string {
+	selection := map[string]string{}
+	requirements := []*pcapEngines.Requirements{
+		{Format: pcapEngines.FormatPCAP, Source: engineSource(), Truncate: *hdrs_only, Rewrite: anonymizer != nil, Millis: *file_ms, Sequence: *file_seq},
+		{Format: pcapEngines.FormatJSON, Source: engineSource()},
+	}
+	for _, req := range requirements {
+		engine, rejections, err := pcapEngines.Select(req)
+		// PCAP files are never written when replaying
+		if err != nil && (req.Format == pcapEngines.FormatJSON || !isReplay()) {
+			jlogWithData(WARNING, &emptyTcpdumpJob, fmt.Sprintf("no '%s' engine available | %v", req.Format, err), rejections)
+		} else if err == nil {
+			jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("selected '%s' engine: %s", req.Format, engine.Name), rejections)
+			selection[req.Format] = engine.Name
+		}
+		if req.Format == pcapEngines.FormatPCAP {
+			pcapFilesEngine = engine
+		} else {
+			jsonEngine = engine
+		}
+	}
+	return selection
+}
+
+// JSON PCAP records may be written into any combination of these sinks; others may be registered into `sinks`.
+const (
+	jsonSinkFile    = "file"
+	jsonSinkStdout  = "stdout"
+	jsonSinkLogSink = "log_sink"
+	jsonSinkGAE     = "gae"
+)
+
+func init() {
+	sinks.Register(&sinks.Sink{
+		Name: jsonSinkFile,
+		// JSON PCAP files are exported into the Cloud Storage bucket
+		Aliases: []string{"gcs"},
+		Factory: sinks.WriterFactoryFunc(func(ctx context.Context, target *sinks.Target) (pcap.PcapWriter, error) {
+			return newFileWriter(ctx, &target.IfaceAndIndex, &target.Output, &target.Extension, &target.Timezone, target.Interval)
+		}),
+	})
+	sinks.Register(&sinks.Sink{
+		Name:    jsonSinkStdout,
+		Limited: true,
+		Factory: sinks.WriterFactoryFunc(func(ctx context.Context, target *sinks.Target) (pcap.PcapWriter, error) {
+			return pcap.NewStdoutPcapWriter(ctx, &target.IfaceAndIndex)
+		}),
+	})
+	sinks.Register(&sinks.Sink{
+		Name:    jsonSinkLogSink,
+		Limited: true,
+		Factory: sinks.WriterFactoryFunc(func(_ context.Context, target *sinks.Target) (pcap.PcapWriter, error) {
+			sink := logSink.Load()
+			if sink == nil {
+				return nil, fmt.Errorf("%w: %w", sinks.ErrUnavailable, errLogSinkDisabled)
+			}
+			return logsink.NewPcapWriter(sink, &target.IfaceAndIndex), nil
+		}),
+	})
+	sinks.Register(&sinks.Sink{
+		Name: jsonSinkGAE,
+		Factory: sinks.WriterFactoryFunc(func(ctx context.Context, target *sinks.Target) (pcap.PcapWriter, error) {
+			gaeOutput := fmt.Sprintf(gaeFileOutput, target.NetIface.Index, target.NetIface.Name)
+			return pcap.NewPcapWriter(ctx, &target.IfaceAndIndex, &gaeOutput, &target.Extension, &target.Timezone, target.Interval)
+		}),
+	})
+}
+
+// parseJSONSinks returns the sinks where JSON PCAP records are written into, by their registered name; when `selected` is empty,
+// they are derived from `jsondump`, `jsonlog` and `log_sink_packets`, and the GAE sink is enabled in GAE.
+func parseJSONSinks(selected string, jsondump, jsonlog, logSinkPackets, isGAE bool) (map[string]bool, error) {
+	enabled := map[string]bool{}
+	if strings.TrimSpace(selected) == "" {
+		enabled[jsonSinkFile] = jsondump
+		enabled[jsonSinkStdout] = jsonlog && !logSinkPackets
+		enabled[jsonSinkLogSink] = jsonlog && logSinkPackets
+		enabled[jsonSinkGAE] = isGAE
+		return enabled, nil
+	}
+	for _, name := range strings.Split(selected, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		sink, err := sinks.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		enabled[sink.Name] = true
+	}
+	return enabled, nil
+}
+
+// newFanoutWriter creates the writers of the sinks declared by a profile, in their order; the iface is not written
+// into any sink if a required one is not available, while best-effort ones are skipped.
+func newFanoutWriter(
+	ctx context.Context,
+	ifaceAndIndex string,
+	profileSinks []*profiles.Sink,
+	newSinkWriter func(*sinks.Sink) (pcap.PcapWriter, error),
+) (*sinks.FanoutWriter, error) {
+	branches := make([]*sinks.Branch, 0, len(profileSinks))
+	for _, profileSink := range profileSinks {
+		// profile sinks are validated along with all other flags
+		sink, _ := sinks.Lookup(profileSink.Name)
+		writer, err := newSinkWriter(sink)
+		if err != nil && profileSink.Policy == sinks.PolicyRequired {
+			for _, branch := range branches {
+				branch.Writer.Close()
+			}
+			return nil, fmt.Errorf("required JSON '%s' writer creation failed: %w", sink.Name, err)
+		}
+		if err != nil {
+			jlog(WARNING, &emptyTcpdumpJob, fmt.Sprintf("JSON '%s' writer creation failed: %s (%s)", sink.Name, ifaceAndIndex, err))
+			continue
+		}
+		branches = append(branches, &sinks.Branch{Name: sink.Name, Policy: profileSink.Policy, Queue: profileSink.Queue, Writer: writer})
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured JSON '%s' writer for iface: %s | policy: %s", sink.Name, ifaceAndIndex, profileSink.Policy))
+	}
+	if len(branches) == 0 {
+		return nil, errors.New("no JSON writers available")
+	}
+	return sinks.NewFanoutWriter(ctx, &ifaceAndIndex, branches, onSinkDegraded), nil
+}
+
+// findDevices returns the devices whose name starts with `PCAP_IFACE`, or `ifacePrefix` if it is not set.
+func findDevices(ifacePrefix *string) []*pcap.PcapDevice {
+	iface := ifacePrefixEnvVar
+	if iface == "" {
+		iface = *ifacePrefix
+	}
+	return capture.FindDevices(iface)
+}
+
+// isReplay returns `true` if packets are replayed from 'input' instead of being captured from ifaces.
+func isReplay() bool {
+	return strings.EqualFold(*engine_s, fileEngine)
+}
+
+// replayDevice is the iface replayed packets are translated as being captured from.
+func replayDevice() *pcap.PcapDevice {
+	return &pcap.PcapDevice{
+		NetInterface: &net.Interface{Index: 0, Name: replay.Iface},
+		Interface:    libpcap.Interface{Name: replay.Iface, Description: *input},
+	}
+}
+
+// replayEngine is implemented by engines which replay packets from 'input', and may run out of them.
+type replayEngine interface {
+	Done() <-chan struct{}
+	Err() error
+	Packets() uint64
+}
+
+// untilReplayed returns a context which is done once all replay engines in `tasks` replayed their input.
+func untilReplayed(ctx context.Context, tasks []*pcapTask) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		for _, task := range tasks {
+			engine, ok := task.PcapEngine().(replayEngine)
+			if !ok {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-engine.Done():
+				if err := engine.Err(); err != nil {
+					jlog(WARNING, &emptyTcpdumpJob, fmt.Sprintf("replay ended before the end of the input: %s | packets: %d | %v", *input, engine.Packets(), err))
+				} else {
+					jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("replay completed: %s | packets: %d", *input, engine.Packets()))
+				}
+			}
+		}
+	}()
+	return ctx
+}
+
+// openableDevices returns the devices in which a capture could be opened within `timeout`; devices are checked
+// concurrently, and transient errors, i/e: while the instance is starting, are retried with backoff.
+func openableDevices(ctx context.Context, devices []*pcap.PcapDevice, snaplen int, timeout time.Duration) []*pcap.PcapDevice {
+	if timeout <= 0 {
+		return devices
+	}
+
+	openable := make([]bool, len(devices))
+
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, iface string) {
+			defer wg.Done()
+			err := preflight.WaitForCapture(ctx, iface, snaplen, timeout, func(attempt int, err error, backoff time.Duration) {
+				jlog(WARNING, &emptyTcpdumpJob, fmt.Sprintf("failed to open capture: %s | attempt: %d | backoff: %v | %v", iface, attempt, backoff, err))
+			})
+			if err != nil {
+				jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("skipping iface: %s | %v", iface, err))
+				return
+			}
+			openable[i] = true
+		}(i, device.NetInterface.Name)
+	}
+	wg.Wait()
+
+	openableDevices := []*pcap.PcapDevice{}
+	for i, device := range devices {
+		if openable[i] {
+			openableDevices = append(openableDevices, device)
+		}
+	}
+	return openableDevices
+}
+
+// newTaskConfig returns the configuration of the tasks of the job `label`; the flags which are set by `profile` are overridden.
+func newTaskConfig(
+	label string,
+	profile *profiles.Profile,
+	filters []pcap.PcapFilterProvider,
+	compatFilters pcap.PcapFilters,
+	ephemerals *pcap.PcapEmphemeralPorts,
+) *pcapTaskConfig {
+	if profile == nil {
+		profile = &profiles.Profile{}
+	}
+	return &pcapTaskConfig{
+		Config: capture.Config{
+			Iface:         *override(profile.Iface, pcap_iface),
+			Directory:     *directory,
+			Extension:     *extension,
+			Filter:        *override(profile.Filter, filter),
+			Snaplen:       *override(profile.Snaplen, snaplen),
+			Interval:      time.Duration(*override(profile.Interval, interval)) * time.Second,
+			Timezone:      fileTimezone(),
+			Tcpdump:       *override(profile.Tcpdump, tcp_dump),
+			Ordered:       *ordered,
+			ConnTrack:     *conntrack,
+			Compat:        *compat,
+			Filters:       filters,
+			CompatFilters: compatFilters,
+			Ephemerals:    ephemerals,
+			ID:            label,
+		},
+		label:       label,
+		sinks:       profile.Sinks,
+		jsondump:    *override(profile.Jsondump, json_dump),
+		jsonlog:     *json_log,
+		tcpAnalysis: *tcp_anlys,
+		tcpLatency:  *tcp_rtt,
+		tcpClose:    *tcp_close,
+		dns:         *dns_log,
+		tlsLog:      *tls_log,
+		grpc:        *grpc_log,
+		flows:       *override(profile.Flows, flows_log),
+		mtu:         *mtu_log,
+		icmp:        *icmp_log,
+		maxEPS:      *max_eps,
+		epsTail:     *eps_tail,
+		httpPorts:   parsePorts(http_ports),
+		h2Ports:     parsePorts(h2_ports),
+		anomalies:   newAnomalyConfig(),
+	}
+}
+
+// createTasks creates the tasks described by `config` using `capture.NewTasks`: `tcpdump`, the engine which feeds
+// payload analyzers, and the JSON one, whose writers are the enabled sinks along with all packet analyzers.
+func createTasks(ctx context.Context, config *pcapTaskConfig) []*pcapTask {
+	isGAE, err := strconv.ParseBool(gaeEnvVar)
+	isGAE = (err == nil && isGAE) || *gcp_gae
+
+	// `json_sinks` is validated before creating tasks
+	enabledSinks, _ := parseJSONSinks(*json_sinks, config.jsondump, config.jsonlog, *sink_pcap && logSink.Load() != nil, isGAE)
+	isJSONWritten := false
+	for sink, enabled := range enabledSinks {
+		// the GAE sink is implied in GAE, but it only requires JSON packet capturing if it is explicitly enabled
+		isJSONWritten = isJSONWritten || (enabled && (sink != jsonSinkGAE || *json_sinks != ""))
+	}
+	// sinks declared by the profile replace all others
+	if len(config.sinks) > 0 {
+		isJSONWritten = config.jsondump
+	}
+
+	if *exec_dirs {
+		// engines create the directory of their files if it does not exist: the link must exist before them
+		if err := prepareJobDirectory(config.label); err != nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to prepare job directory: %s | %v", jobDirectory(config.label), err))
+		}
+	}
+
+	// analyzers are attached to the tasks of their iface once all of them are created
+	ifaces := map[string]string{}
+	latencies := map[string]*analysis.LatencyAnalyzer{}
+	jsonTasks := map[string]*pcapTask{}
+	payloadTasks := map[*capture.Task]*pcapTask{}
+
+	config.Devices = func(ctx context.Context) []*pcap.PcapDevice {
+		var devices []*pcap.PcapDevice
+		if isReplay() {
+			devices = []*pcap.PcapDevice{replayDevice()}
+		} else {
+			devices = openableDevices(ctx, findDevices(&config.Iface), config.Snaplen, time.Duration(*open_to)*time.Second)
+		}
+		for _, device := range devices {
+			ifaceAndIndex := fmt.Sprintf("%d/%s", device.NetInterface.Index, device.NetInterface.Name)
+			ifaces[device.NetInterface.Name] = ifaceAndIndex
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configuring PCAP for iface: %s", ifaceAndIndex))
+		}
+		return devices
+	}
+
+	config.Output = func(netIface *net.Interface) string {
+		outputDirectory := directory
+		if *exec_dirs {
+			// files are written into the directory of the current execution, which is only known when it starts
+			currentDirectory := filepath.Join(jobDirectory(config.label), currentExecutionDir)
+			outputDirectory = &currentDirectory
+		}
+		return newFileOutput(outputDirectory, netIface, config.label)
+	}
+
+	// the engines which write PCAP files and translate packets into JSON were selected at startup
+	config.NewEngine = func(ctx context.Context, engineConfig *pcap.PcapConfig) (pcap.PcapEngine, error) {
+		if engineConfig.Format == "pcap" {
+			if pcapFilesEngine == nil {
+				return nil, errNoPcapEngine
+			}
+			return pcapFilesEngine.Factory(ctx, engineConfig)
+		}
+		if jsonEngine == nil {
+			return nil, errNoJSONEngine
+		}
+		return jsonEngine.Factory(ctx, engineConfig)
+	}
+
+	// TCP payloads are not available in JSON translated packets: segments are captured by a dedicated engine
+	config.Tasks = func(ctx context.Context, device *pcap.PcapDevice) []*capture.Task {
+		iface := device.NetInterface.Name
+		ifaceAndIndex := ifaces[iface]
+
+		// created ahead of the JSON engine, so that it can be fed with TLS handshakes as well
+		var latency *analysis.LatencyAnalyzer = nil
+		if config.tcpLatency {
+			latency = analysis.NewLatencyAnalyzer(&ifaceAndIndex)
+			latencies[iface] = latency
+		}
+
+		payloadAnalyzers := []payload.Analyzer{}
+		var tlsAnalyzer *analysis.TLSAnalyzer = nil
+		if config.tlsLog {
+			onRecord := onTLSRecord
+			if latency != nil {
+				onRecord = func(record *analysis.TLSRecord) {
+					if !record.TimedOut {
+						latency.AddTLSHandshake(record.Server, time.Duration(record.Latency*float64(time.Millisecond)))
+					}
+					onTLSRecord(record)
+				}
+			}
+			tlsAnalyzer = analysis.NewTLSAnalyzer(&ifaceAndIndex, tlsTimeout, onRecord, onTLSFailure)
+			payloadAnalyzers = append(payloadAnalyzers, tlsAnalyzer)
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured TLS analysis for iface: %s", ifaceAndIndex))
+		}
+		if len(config.httpPorts) > 0 {
+			var onWebSocket analysis.WebSocketHandler = nil
+			if *ws_log {
+				onWebSocket = onWebSocketSession
+			}
+			payloadAnalyzers = append(payloadAnalyzers, analysis.NewHTTPAnalyzer(&ifaceAndIndex, config.httpPorts, tcpIdleTimeout, onHTTPTransaction, onWebSocket, traceTable))
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured HTTP analysis for iface: %s | ports: %v | WebSocket: %t | trace correlation: %t", ifaceAndIndex, config.httpPorts, *ws_log, traceTable != nil))
+		}
+		if len(config.h2Ports) > 0 {
+			var onCall analysis.GRPCHandler = nil
+			if config.grpc {
+				onCall = onGRPCCall
+			}
+			payloadAnalyzers = append(payloadAnalyzers, analysis.NewH2Analyzer(&ifaceAndIndex, config.h2Ports, tcpIdleTimeout, onH2Event, onCall))
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured HTTP/2 analysis for iface: %s | ports: %v | gRPC: %t", ifaceAndIndex, config.h2Ports, config.grpc))
+		}
+		if keyLog != nil {
+			// decrypted sessions are analyzed by dedicated analyzers, which are only fed with plaintext
+			tlsPorts := parsePorts(tls_ports)
+			var onWebSocket analysis.WebSocketHandler = nil
+			if *ws_log {
+				onWebSocket = onWebSocketSession
+			}
+			var onCall analysis.GRPCHandler = nil
+			if config.grpc {
+				onCall = onGRPCCall
+			}
+			payloadAnalyzers = append(payloadAnalyzers, analysis.NewTLSDecrypter(tlsPorts, keyLog, tcpIdleTimeout,
+				analysis.NewHTTPAnalyzer(&ifaceAndIndex, tlsPorts, tcpIdleTimeout, onHTTPTransaction, onWebSocket, traceTable),
+				analysis.NewH2Analyzer(&ifaceAndIndex, tlsPorts, tcpIdleTimeout, onH2Event, onCall)))
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured TLS decryption for iface: %s | ports: %v | key log: %s", ifaceAndIndex, tlsPorts, keyLog.Path()))
+		}
+		var quicAnalyzer *analysis.QUICAnalyzer = nil
+		if *quic_log {
+			quicAnalyzer = analysis.NewQUICAnalyzer(&ifaceAndIndex, tlsTimeout, onQUICRecord)
+			payloadAnalyzers = append(payloadAnalyzers, quicAnalyzer)
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured QUIC analysis for iface: %s", ifaceAndIndex))
+		}
+
+		if len(payloadAnalyzers) == 0 {
+			return nil
+		}
+		if isReplay() {
+			// TCP payloads are only captured from ifaces
+			jlog(WARNING, &emptyTcpdumpJob, fmt.Sprintf("payload analysis is not available when replaying: %s | analyzers: %d", *input, len(payloadAnalyzers)))
+			return nil
+		}
+		engine := payload.NewEngine(iface, newPayloadFilter(ctx, &config.Filter, config.Filters), config.Snaplen, payloadAnalyzers...)
+		task := capture.NewTask(iface, "payload", engine, nil)
+		payloadTasks[task] = &pcapTask{Task: task, tls: tlsAnalyzer, quic: quicAnalyzer}
+		return []*capture.Task{task}
+	}
+
+	// analyzers are fed with JSON translated packets even if they are not written anywhere
+	config.Writers = func(ctx context.Context, device *pcap.PcapDevice, output string) []pcap.PcapWriter {
+		if !isJSONWritten && !config.tcpAnalysis && !config.tcpLatency && !config.tcpClose && !*conn_tbl && !config.dns &&
+			!config.flows && !config.mtu && !config.icmp && config.anomalies == nil && markerProbe == nil {
+			return nil
+		}
+		netIface := device.NetInterface
+		ifaceAndIndex := ifaces[netIface.Name]
+		// writers would never be fed
+		if jsonEngine == nil {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("jsondump task creation failed: %s (%s)", ifaceAndIndex, errNoJSONEngine))
+			return nil
+		}
+
+		task := &pcapTask{}
+		pcapWriters := []pcap.PcapWriter{}
+
+		// records written into standard output or shipped into `log_sink` are rate limited
+		withSampling := func(writer pcap.PcapWriter) pcap.PcapWriter {
+			if task.sampler != nil || config.maxEPS <= 0 {
+				return writer
+			}
+			task.sampler = sampling.NewRateLimitedWriter(ctx, writer, config.maxEPS, config.epsTail, onSuppressedRecords)
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("limited JSON writer for iface: %s | max records per second: %d", ifaceAndIndex, config.maxEPS))
+			return task.sampler
+		}
+
+		// all writers of the iface are stamped with the same execution, which is set every time one starts
+		annotators := []enrich.Annotator{}
+		if *stamp_exe {
+			task.execution = execution.NewAnnotator(executionProperty)
+			annotators = append(annotators, task.execution)
+		}
+
+		// every sink is independent from all others: any combination of them is valid
+		target := &sinks.Target{
+			NetIface: netIface, IfaceAndIndex: ifaceAndIndex, Output: output,
+			Extension: "json", Timezone: config.Timezone, Interval: int(config.Interval / time.Second),
+		}
+		newSinkWriter := func(sink *sinks.Sink) (pcap.PcapWriter, error) {
+			writer, writerErr := sink.Factory.New(ctx, target)
+			if writerErr != nil {
+				return nil, writerErr
+			}
+			writer = withAnonymization(withRedaction(withTraceCorrelation(withPayloadMatch(withPayloadMode(withEnrichment(writer, annotators...))))))
+			if sink.Limited {
+				writer = withSampling(writer)
+			}
+			return writer, nil
+		}
+
+		if len(config.sinks) > 0 && config.jsondump {
+			fanout, fanoutErr := newFanoutWriter(ctx, ifaceAndIndex, config.sinks, newSinkWriter)
+			if fanoutErr != nil {
+				jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("jsondump task creation failed: %s (%s)", ifaceAndIndex, fanoutErr))
+				return nil
+			}
+			pcapWriters = append(pcapWriters, fanout)
+		} else if len(config.sinks) == 0 {
+			for _, sink := range sinks.Sinks() {
+				if !enabledSinks[sink.Name] {
+					continue
+				}
+				writer, writerErr := newSinkWriter(sink)
+				if writerErr != nil {
+					jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("JSON '%s' writer creation failed: %s (%s)", sink.Name, ifaceAndIndex, writerErr))
+					continue
+				}
+				pcapWriters = append(pcapWriters, writer)
+				jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured JSON '%s' writer for iface: %s", sink.Name, ifaceAndIndex))
+			}
+		}
+
+		// analyzers share the JSON translated packets decoded once by a single dispatcher
+		packetAnalyzers := []analysis.PacketAnalyzer{}
+
+		if config.tcpAnalysis {
+			task.analyzer = analysis.NewTCPAnalyzer(&ifaceAndIndex, time.Duration(*tcp_stall)*time.Second, onTCPEvent)
+			packetAnalyzers = append(packetAnalyzers, task.analyzer)
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured TCP analysis for iface: %s", ifaceAndIndex))
+		}
+
+		if config.tcpLatency {
+			task.latency = latencies[netIface.Name]
+			packetAnalyzers = append(packetAnalyzers, task.latency)
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured TCP latency for iface: %s", ifaceAndIndex))
+		}
+
+		if config.tcpClose {
+			packetAnalyzers = append(packetAnalyzers, analysis.NewCloseAnalyzer(&ifaceAndIndex, tcpIdleTimeout, onTCPClose))
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured TCP close analysis for iface: %s", ifaceAndIndex))
+		}
+
+		if *conn_tbl {
+			task.conns = analysis.NewConnTable(&ifaceAndIndex, tcpIdleTimeout)
+			packetAnalyzers = append(packetAnalyzers, task.conns)
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured TCP connection table for iface: %s", ifaceAndIndex))
+		}
+
+		if config.dns {
+			packetAnalyzers = append(packetAnalyzers, analysis.NewDNSAnalyzer(&ifaceAndIndex, dnsTimeout, onDNSRecord))
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured DNS analysis for iface: %s", ifaceAndIndex))
+		}
+
+		if config.mtu {
+			packetAnalyzers = append(packetAnalyzers, analysis.NewMTUAnalyzer(&ifaceAndIndex, netIface.MTU, onMTUEvent))
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured MTU analysis for iface: %s", ifaceAndIndex))
+		}
+
+		if config.icmp {
+			packetAnalyzers = append(packetAnalyzers, analysis.NewICMPAnalyzer(&ifaceAndIndex, onICMPEvent))
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured ICMP analysis for iface: %s", ifaceAndIndex))
+		}
+
+		if config.anomalies != nil {
+			packetAnalyzers = append(packetAnalyzers, analysis.NewAnomalyAnalyzer(&ifaceAndIndex, config.anomalies, onAnomaly))
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured anomaly detection for iface: %s", ifaceAndIndex))
+		}
+
+		if markerProbe != nil {
+			packetAnalyzers = append(packetAnalyzers, markerProbe.Observer())
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured probe observer for iface: %s | target: %s", ifaceAndIndex, markerProbe.Target()))
+		}
+
+		if config.flows {
+			task.flows = analysis.NewFlowAnalyzer(&ifaceAndIndex, flowIdleTimeout, onFlowRecord)
+			packetAnalyzers = append(packetAnalyzers, task.flows)
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured flow records for iface: %s", ifaceAndIndex))
+		}
+
+		if len(packetAnalyzers) > 0 {
+			pcapWriters = append(pcapWriters, analysis.NewDispatcher(&ifaceAndIndex, packetAnalyzers...))
+		}
+
+		jsonTasks[netIface.Name] = task
+		return pcapWriters
+	}
+
+	captureTasks, err := capture.NewTasks(ctx, &config.Config)
+	// tasks which could not be created are left out: the ones of other ifaces and engines still capture
+	if joinedErr, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joinedErr.Unwrap() {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("PCAP task creation failed: %v", err))
+		}
+	} else if err != nil {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("PCAP task creation failed: %v", err))
+	}
+
+	tasks := make([]*pcapTask, 0, len(captureTasks))
+	for _, t := range captureTasks {
+		task := &pcapTask{Task: t}
+		switch t.Engine() {
+		case "tcpdump":
+			task.extension = config.Extension
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured 'tcpdump' for iface: %s | engine: %s", ifaces[t.Iface()], pcapFilesEngine.Name))
+		case "jsondump":
+			task = jsonTasks[t.Iface()]
+			task.Task = t
+			task.extension = "json"
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("configured 'jsondump' for iface: %s", ifaces[t.Iface()]))
+		case "payload":
+			task = payloadTasks[t]
+		}
+		if output := t.Output(); output != "" {
+			// the part of file names which is not time dependent
+			task.prefix = strings.SplitN(filepath.Base(output), "%", 2)[0]
+			task.directory = filepath.Dir(output)
+			task.interval = config.Interval
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+func startTCPListener(ctx context.Context, port *uint, job *tcpdumpJob, stopChannel chan<- bool) {
+	tcpListener, tcpListenerErr := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+
+	if tcpListenerErr != nil {
+		exit(exitHealthCheck, fmt.Sprintf("failed to start the TCP listener: %v", tcpListenerErr))
 	}
 
 	for {
@@ -480,112 +4323,818 @@ func startTCPListener(ctx context.Context, port *uint, job *tcpdumpJob, stopChan
 	}
 }
 
-func waitDone(job *tcpdumpJob, pcapMutex *flock.Flock, exitSignal *string) {
-	// wait for all PCAP tasks to be gracefully stopped
-	wg.Wait()
+// waitDone flushes all writers and signals `pcap_fsn` to export the last PCAP files; it returns an error if `pcap_fsn`
+// could not be signaled, or if it reported that some PCAP files were not exported.
+func waitDone(job *tcpdumpJob, pcapMutex *flock.Flock, exitSignal *string) error {
+	// wait for all PCAP executions to be stopped
+	executionsWG.Wait()
+	shutdown.complete("tasks")
+
+	for _, task := range job.tasks {
+		for _, writer := range task.Writers() {
+			writer.Rotate()
+			writer.Close()
+		}
+		if task.flows != nil {
+			task.flows.Export(time.Now(), true)
+		}
+	}
+	shutdown.complete("writers")
+
+	if spiller != nil {
+		// no more files are written into `directory`: the newest ones are also spilled
+		queued := spillRotatedFiles(directory, extension, true)
+		jlog(INFO, job, fmt.Sprintf("spilling the last PCAP files into %s | files: %d | pending: %d", *spill_dir, queued, spiller.Pending()))
+		spiller.Close()
+	}
+	shutdown.complete("spills")
+
+	for _, task := range job.tasks {
+		if task.Health().State() != health.Failed {
+			setTaskState(job, task.Task, health.Exporting, nil)
+		}
+	}
+
+	// a result left behind by a previous process must not be mistaken for the one of this process
+	exportedSignal := filepath.Join(filepath.Dir(*exitSignal), exportedSignalName)
+	os.Remove(exportedSignal)
+
+	// `TCPDUMPW_EXITED` file creation signals `pcap_fsn` to start its own termination process
+	terminationSignal, err := os.OpenFile(*exitSignal, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+
+	if err == nil {
+		jlog(INFO, job, fmt.Sprintf("'tcpdumpw' termination signal created: %s", terminationSignal.Name()))
+		terminationSignal.Close()
+		if *exp_wait > 0 {
+			err = waitExported(job, exportedSignal, time.Duration(*exp_wait)*time.Second)
+		}
+	} else {
+		jlog(ERROR, job, fmt.Sprintf("'tcpdumpw' termination signal creation failed: %s | %s", *exitSignal, err.Error()))
+		err = fmt.Errorf("failed to signal 'pcap_fsn' to export PCAP files: %w", err)
+	}
+	shutdown.complete("exports")
+
+	if unlockErr := pcapMutex.Unlock(); unlockErr != nil {
+		jlog(ERROR, job, fmt.Sprintf("failed to release PCAP lock file: %v", unlockErr))
+	} else {
+		jlog(INFO, job, fmt.Sprintf("released PCAP lock file: %s", pcapLockFile))
+	}
+	shutdown.complete("lock")
+
+	// spans are buffered: export the ones for the last execution before exiting
+	flushTracer()
+	closeFlowExporter()
+	closeLogSink()
+	shutdown.complete("telemetry")
+	shutdown.done(job)
+
+	return err
+}
+
+// waitExported waits up to `timeout` for `pcap_fsn` to write the result of exporting the last PCAP files into `signal`;
+// it returns an error if any of them was not exported, or if the result was not written in time.
+func waitExported(job *tcpdumpJob, signal string, timeout time.Duration) error {
+	waitStartTS := time.Now()
+	ticker := time.NewTicker(exportedCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		content, err := os.ReadFile(signal)
+		if err == nil {
+			os.Remove(signal)
+			var result struct {
+				Files    uint64 `json:"files"`
+				Bytes    uint64 `json:"bytes"`
+				Failures uint64 `json:"failures"`
+			}
+			if err := json.Unmarshal(content, &result); err != nil {
+				jlog(ERROR, job, fmt.Sprintf("invalid 'pcap_fsn' export result: %s | %v", signal, err))
+				return fmt.Errorf("invalid 'pcap_fsn' export result: %w", err)
+			}
+			if result.Failures > 0 {
+				jlog(ERROR, job, fmt.Sprintf("'pcap_fsn' failed to export PCAP files | exported: %d | failures: %d | latency: %v", result.Files, result.Failures, time.Since(waitStartTS)))
+				return fmt.Errorf("'pcap_fsn' failed to export %d PCAP files", result.Failures)
+			}
+			jlog(INFO, job, fmt.Sprintf("'pcap_fsn' exported all PCAP files | exported: %d | bytes: %d | latency: %v", result.Files, result.Bytes, time.Since(waitStartTS)))
+			return nil
+		}
+		if time.Since(waitStartTS) >= timeout {
+			jlog(ERROR, job, fmt.Sprintf("'pcap_fsn' did not report exporting PCAP files within %v: %s", timeout, signal))
+			return fmt.Errorf("'pcap_fsn' did not report exporting PCAP files within %v", timeout)
+		}
+		<-ticker.C
+	}
+}
+
+func appendFilter(
+	ctx context.Context,
+	filters []pcap.PcapFilterProvider,
+	compatFilters pcap.PcapFilters,
+	rawFilter *string,
+	factory pcapFilter.PcapFilterProviderFactory,
+) []pcap.PcapFilterProvider {
+	select {
+	case <-ctx.Done():
+		return filters
+	default:
+		if *rawFilter == "" ||
+			strings.EqualFold(*rawFilter, "ALL") ||
+			strings.EqualFold(*rawFilter, "ANY") {
+			return filters
+		}
+	}
+
+	filter := factory(rawFilter, compatFilters)
+	filters = append(filters, filter)
+	jlog(INFO, &emptyTcpdumpJob, stringFormatter.Format("using filter: {0}", filter.String()))
+
+	return filters
+}
+
+// parsePorts returns all the valid ports in a comma separated list.
+func parsePorts(ports *string) []uint16 {
+	parsedPorts := []uint16{}
+	for _, value := range strings.Split(*ports, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(value), 10, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+		parsedPorts = append(parsedPorts, uint16(port))
+	}
+	return parsedPorts
+}
+
+func parseEphemeralPorts(ephemerals *string) *pcap.PcapEmphemeralPorts {
+	// default ephemeral ports range
+	ephemeralPortRange := &pcap.PcapEmphemeralPorts{
+		Min: pcap.PCAP_MIN_EPHEMERAL_PORT,
+		Max: pcap.PCAP_MAX_EPHEMERAL_PORT,
+	}
+
+	if *ephemerals == "" {
+		return ephemeralPortRange
+	}
+
+	ephemeralPorts := strings.SplitN(*ephemerals, ",", 2)
+
+	if len(ephemeralPorts) != 2 {
+		return ephemeralPortRange
+	}
+
+	for i, valueStr := range ephemeralPorts {
+		if value, err := strconv.ParseUint(valueStr, 10, 16); err != nil && value >= 0x0400 && value <= 0xFFFF {
+			// see: https://datatracker.ietf.org/doc/html/rfc6056#page-5
+			// a valid `ephemeral port` must be within RFC 6056 range: [1024/0x4000,65535/0xFFFF]
+			port := uint16(value)
+			if i == 0 && port < ephemeralPortRange.Max {
+				ephemeralPortRange.Min = uint16(value)
+			} else if port > ephemeralPortRange.Min {
+				ephemeralPortRange.Max = uint16(value)
+			}
+		}
+	}
+
+	return ephemeralPortRange
+}
+
+// secondsValue is a flag which holds an amount of seconds; it accepts both integers and duration strings like `90s` or `5m`.
+type secondsValue int
+
+func (v *secondsValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+// Get allows to tell flags holding seconds apart from plain integers.
+func (v *secondsValue) Get() any {
+	return time.Duration(*v) * time.Second
+}
+
+func (v *secondsValue) Set(value string) error {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		*v = secondsValue(seconds)
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("neither seconds nor duration: %s", value)
+	}
+	if d%time.Second != 0 {
+		return fmt.Errorf("not a whole amount of seconds: %s", value)
+	}
+	*v = secondsValue(d / time.Second)
+	return nil
+}
+
+// tagsFlag defines a flag which may be repeated to add user defined tags.
+func tagsFlag(name string, usage string) *tags.Tags {
+	userTags := &tags.Tags{}
+	flag.Var(userTags, name, usage)
+	return userTags
+}
+
+// secondsFlag defines a flag which may be set using either an integer amount of seconds or a duration string;
+// the pointer it returns always holds seconds.
+func secondsFlag(name string, value int, usage string) *int {
+	seconds := value
+	flag.Var((*secondsValue)(&seconds), name, usage)
+	return &seconds
+}
+
+// exit writes the final status record, and then terminates the process with `code`.
+func exit(code int, reason string) {
+	class, ok := exitClasses[code]
+	if !ok && code > exitSignaled {
+		class = "signal"
+	}
+	severity := INFO
+	if class != "success" && class != "signal" {
+		severity = ERROR
+	}
+	jlogWithData(severity, &emptyTcpdumpJob, fmt.Sprintf("process exiting: %s | class: %s | exit code: %d", reason, class, code),
+		&exitRecord{Code: code, Class: class, Reason: reason})
+	os.Exit(code)
+}
+
+// fatal reports `message` as a fatal error, and then terminates the process with `code`.
+func fatal(code int, message string) {
+	jlog(FATAL, &emptyTcpdumpJob, message)
+	exit(code, message)
+}
+
+// shutdownSteps are the steps of the graceful shutdown, in the order in which they are completed.
+var shutdownSteps = []string{"tasks", "writers", "spills", "exports", "lock", "telemetry"}
+
+// begin starts measuring the graceful shutdown, and forcefully exits if it takes longer than `grace`.
+func (s *shutdownProgress) begin(job *tcpdumpJob, grace time.Duration) {
+	s.mu.Lock()
+	s.startTS = time.Now()
+	s.mu.Unlock()
+
+	if grace <= 0 {
+		return
+	}
+	time.AfterFunc(grace, func() {
+		completed, pending := s.report()
+		jlogWithData(ERROR, job, fmt.Sprintf("shutdown grace period exceeded: %v | completed: [%s] | pending: [%s]",
+			grace, strings.Join(completed, ","), strings.Join(pending, ",")), s.snapshot())
+		exit(exitShutdownGrace, fmt.Sprintf("shutdown did not complete within %v", grace))
+	})
+}
+
+// complete records that step `name` of the graceful shutdown completed; it is a no-op unless the shutdown began.
+func (s *shutdownProgress) complete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.startTS.IsZero() {
+		return
+	}
+	s.steps = append(s.steps, shutdownStep{Name: name, Latency: time.Since(s.startTS).String()})
+}
+
+// snapshot returns a copy of the steps completed so far.
+func (s *shutdownProgress) snapshot() []shutdownStep {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.steps)
+}
+
+// report returns the names of completed and pending steps.
+func (s *shutdownProgress) report() ([]string, []string) {
+	steps := s.snapshot()
+	completed := make([]string, 0, len(steps))
+	for _, step := range steps {
+		completed = append(completed, step.Name)
+	}
+	pending := []string{}
+	for _, name := range shutdownSteps {
+		if !slices.Contains(completed, name) {
+			pending = append(pending, name)
+		}
+	}
+	return completed, pending
+}
+
+// done logs the steps of the graceful shutdown if it began.
+func (s *shutdownProgress) done(job *tcpdumpJob) {
+	s.mu.Lock()
+	startTS := s.startTS
+	s.mu.Unlock()
+	if startTS.IsZero() {
+		return
+	}
+	completed, _ := s.report()
+	jlogWithData(INFO, job, fmt.Sprintf("shutdown completed | latency: %v | steps: [%s]",
+		time.Since(startTS), strings.Join(completed, ",")), s.snapshot())
+}
+
+// exitWhenDone terminates the process once all PCAP tasks are done; `err` is not `nil` if `pcap_fsn` was not signaled to export PCAP files,
+// or if it reported that some of them were not exported.
+func exitWhenDone(err error) {
+	if err != nil {
+		exit(exitExportFailure, err.Error())
+	}
+	if sig := receivedSignal.Load(); sig != nil {
+		code := exitSignaled
+		if signum, ok := (*sig).(syscall.Signal); ok {
+			code += int(signum)
+		}
+		exit(code, fmt.Sprintf("signaled: %v", *sig))
+	}
+	exit(exitSuccess, "packet capture completed")
+}
+
+// loadTimezone returns the location used to schedule packet captures; `timezone` is validated at startup,
+// so falling back to UTC only happens if the zone could not be loaded afterwards.
+func loadTimezone(tz *string) *time.Location {
+	location, err := zoneinfo.Load(*tz)
+	if err == nil {
+		return location
+	}
+	jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("could not load timezone '%s': %v | falling back to: UTC", *tz, err))
+	*tz = "UTC"
+	return time.UTC
+}
+
+// maxSnaplen is the largest amount of bytes that libpcap captures from each packet.
+const maxSnaplen = 262144
+
+// isCronExpSet returns `true` if a cron expression was provided; the startup script uses `-` as a placeholder.
+func isCronExpSet() bool {
+	exp := strings.TrimSpace(*cron_exp)
+	return exp != "" && exp != "-"
+}
+
+// cronParser is the same parser used by the scheduler: the 1st field is the seconds.
+var cronParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// validateFlags verifies the combinations of flags which would otherwise start a capture
+// that does not do what was asked; it reports all the problems found at once.
+func validateFlags() error {
+	var errs []error
+
+	if *use_cron && !isCronExpSet() {
+		errs = append(errs, errors.New("'use_cron' is enabled but 'cron_exp' is empty: set a cron expression such as '0 */5 * * * *'"))
+	} else if *use_cron {
+		if _, err := cronParser.Parse(*cron_exp); err != nil {
+			errs = append(errs, fmt.Errorf("invalid 'cron_exp': %q | %w", *cron_exp, err))
+		}
+	} else if isCronExpSet() {
+		errs = append(errs, fmt.Errorf("'cron_exp' is set to %q but 'use_cron' is disabled: enable 'use_cron' or unset 'cron_exp'", *cron_exp))
+	}
+
+	if _, err := zoneinfo.Load(*timezone); err != nil {
+		errs = append(errs, fmt.Errorf("invalid 'timezone': %q | %w | use 'list_timezones' to get the available zones", *timezone, err))
+	}
+	if !strings.EqualFold(*file_tz, "utc") && !strings.EqualFold(*file_tz, "local") {
+		errs = append(errs, fmt.Errorf("invalid 'file_timezone': %q | use 'utc' or 'local'", *file_tz))
+	}
+
+	if *snaplen < 0 || *snaplen > maxSnaplen {
+		errs = append(errs, fmt.Errorf("'snaplen' must be between 0 and %d bytes: %d", maxSnaplen, *snaplen))
+	}
+
+	if *duration < 0 {
+		errs = append(errs, fmt.Errorf("'timeout' must not be negative: %ds", *duration))
+	}
+	if *interval < 0 {
+		errs = append(errs, fmt.Errorf("'interval' must not be negative: %ds", *interval))
+	}
+	if *duration > 0 && *interval > *duration {
+		errs = append(errs, fmt.Errorf("'interval' ( %ds ) is larger than 'timeout' ( %ds ): PCAP files would never be rotated", *interval, *duration))
+	}
+	switch strings.ToLower(*leftovers) {
+	case leftoverPolicyExport, leftoverPolicyDelete, leftoverPolicyKeep:
+	default:
+		errs = append(errs, fmt.Errorf("invalid 'leftover_policy': %q | use 'export', 'delete' or 'keep'", *leftovers))
+	}
+	for _, key := range reservedTagKeys {
+		if _, ok := user_tags.Map()[key]; ok {
+			errs = append(errs, fmt.Errorf("invalid 'tag': %q is reserved | reserved keys: %s", key, strings.Join(reservedTagKeys, ", ")))
+		}
+	}
+	if *max_engine < 0 {
+		errs = append(errs, fmt.Errorf("'max_concurrent_engines' must not be negative: %d", *max_engine))
+	}
+	if *probe_addr != "" {
+		errs = append(errs, validateProbe()...)
+	}
+	if *win_slot < 0 || (*win_slot > 0 && (*win_slot < time.Second || *win_slot%time.Second != 0)) {
+		errs = append(errs, fmt.Errorf("'window_slot' must be a whole number of seconds: %v", *win_slot))
+	}
+	if *shutdown_g < 0 {
+		errs = append(errs, fmt.Errorf("'shutdown_grace' must not be negative: %v", *shutdown_g))
+	}
+
+	if strings.EqualFold(*run_mode, jobMode) && (*use_cron || (*duration <= 0 && !isReplay())) {
+		errs = append(errs, errors.New("'job' mode requires a 'timeout' and is not compatible with 'use_cron'"))
+	}
+	switch strings.ToLower(*engine_s) {
+	case liveEngine:
+		if *input != "" {
+			errs = append(errs, fmt.Errorf("'input' is set to %q but 'engine' is 'live'", *input))
+		}
+	case fileEngine:
+		errs = append(errs, validateReplay()...)
+	default:
+		errs = append(errs, fmt.Errorf("invalid 'engine': %q | use 'live' or 'file'", *engine_s))
+	}
+	if strings.EqualFold(*run_mode, windowMode) && (*use_cron || *ctrl_sock == "") {
+		errs = append(errs, errors.New("'window' mode requires a 'control_socket' and is not compatible with 'use_cron'"))
+	}
+
+	if *profile_s != "" {
+		errs = append(errs, validateProfiles()...)
+	}
+	if *state_f != "" {
+		if info, err := os.Stat(*state_f); err == nil && !info.Mode().IsRegular() {
+			errs = append(errs, fmt.Errorf("invalid 'state_file': %q is not a regular file", *state_f))
+		}
+	}
+	if *ifstats_on && (*ifstats_to <= 0 || !strings.EqualFold(*engine_s, liveEngine)) {
+		errs = append(errs, errors.New("'iface_stats' requires an 'iface_stats_interval' greater than 0 and the 'live' engine"))
+	}
+	if *hist_size < 0 {
+		errs = append(errs, fmt.Errorf("invalid 'history': %d | must not be negative", *hist_size))
+	} else if *hist_size == 0 && (*hist_file != "" || *http_addr != "") {
+		errs = append(errs, errors.New("'history_file' and 'http_addr' require a 'history' greater than 0"))
+	}
+	if *hist_file != "" {
+		if info, err := os.Stat(*hist_file); err == nil && !info.Mode().IsRegular() {
+			errs = append(errs, fmt.Errorf("invalid 'history_file': %q is not a regular file", *hist_file))
+		}
+	}
+	if *http_addr != "" {
+		if _, _, err := net.SplitHostPort(*http_addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid 'http_addr': %q | %v", *http_addr, err))
+		}
+	}
+	if *spill_dir != "" {
+		// spilled files would be found again in `directory`
+		hot, _ := filepath.Abs(*directory)
+		cold, _ := filepath.Abs(*spill_dir)
+		if rel, err := filepath.Rel(hot, cold); err == nil && filepath.IsLocal(rel) {
+			errs = append(errs, fmt.Errorf("invalid 'spill_dir': %q must not be 'directory' nor be within it", *spill_dir))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateReplay verifies that the packets of 'input' can be replayed: only engines which translate packets into JSON are able to.
+func validateReplay() []error {
+	var errs []error
+	if *input == "" {
+		errs = append(errs, errors.New("the 'file' engine requires an 'input'"))
+	} else if info, err := os.Stat(*input); err != nil || !info.Mode().IsRegular() {
+		errs = append(errs, fmt.Errorf("invalid 'input': %q is not a readable file", *input))
+	}
+	if !strings.EqualFold(*run_mode, jobMode) || *profile_s != "" {
+		errs = append(errs, errors.New("the 'file' engine requires 'job' mode, and it is not compatible with 'profiles'"))
+	}
+	if *tcp_dump {
+		errs = append(errs, errors.New("the 'file' engine only translates packets into JSON: disable 'tcpdump'"))
+	}
+	return errs
+}
 
-	for _, task := range job.tasks {
-		for _, writer := range task.writers {
-			writer.Rotate()
-			writer.Close()
-		}
+// validateProbe verifies that markers can be sent, and that they are expected more than once before raising an alert.
+func validateProbe() []error {
+	var errs []error
+	if _, err := net.ResolveUDPAddr("udp", *probe_addr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid 'probe': %q | %w", *probe_addr, err))
+	}
+	if *probe_int <= 0 {
+		errs = append(errs, fmt.Errorf("'probe_interval' must be positive: %ds", *probe_int))
+	} else if *probe_to <= *probe_int {
+		errs = append(errs, fmt.Errorf("'probe_timeout' must be longer than 'probe_interval': %ds <= %ds", *probe_to, *probe_int))
 	}
+	if isReplay() {
+		errs = append(errs, fmt.Errorf("'probe' markers are never captured by the '%s' engine", strings.ToLower(*engine_s)))
+	}
+	return errs
+}
 
-	// `TCPDUMPW_EXITED` file creation signals `pcap_fsn` to start its own termination process
-	terminationSignal, err := os.OpenFile(*exitSignal, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+// validateProfiles verifies the profiles along with the flags they do not override.
+func validateProfiles() []error {
+	var errs []error
 
-	if err == nil {
-		jlog(INFO, job, fmt.Sprintf("'tcpdumpw' termination signal created: %s", terminationSignal.Name()))
-		terminationSignal.Close()
-	} else {
-		jlog(ERROR, job, fmt.Sprintf("'tcpdumpw' termination signal creation failed: %s | %s", *exitSignal, err.Error()))
+	if *use_cron || !strings.EqualFold(*run_mode, sidecarMode) {
+		errs = append(errs, errors.New("'profiles' require 'sidecar' mode and replace 'use_cron': set 'cron_exp' in each profile instead"))
 	}
 
-	if unlockErr := pcapMutex.Unlock(); unlockErr != nil {
-		jlog(ERROR, job, fmt.Sprintf("failed to release PCAP lock file: %v", unlockErr))
-	} else {
-		jlog(INFO, job, fmt.Sprintf("released PCAP lock file: %s", pcapLockFile))
+	captureProfiles, err := profiles.Load(*profile_s)
+	if err != nil {
+		return append(errs, fmt.Errorf("invalid 'profiles' | %w", err))
 	}
-}
 
-func appendFilter(
-	ctx context.Context,
-	filters []pcap.PcapFilterProvider,
-	compatFilters pcap.PcapFilters,
-	rawFilter *string,
-	factory pcapFilter.PcapFilterProviderFactory,
-) []pcap.PcapFilterProvider {
-	select {
-	case <-ctx.Done():
-		return filters
-	default:
-		if *rawFilter == "" ||
-			strings.EqualFold(*rawFilter, "ALL") ||
-			strings.EqualFold(*rawFilter, "ANY") {
-			return filters
+	for _, profile := range captureProfiles {
+		if profile.CronExp != "" {
+			if _, err := cronParser.Parse(profile.CronExp); err != nil {
+				errs = append(errs, fmt.Errorf("invalid 'cron_exp' of profile '%s': %q | %w", profile.Name, profile.CronExp, err))
+			}
+		}
+		if snaplen := *override(profile.Snaplen, snaplen); snaplen < 0 || snaplen > maxSnaplen {
+			errs = append(errs, fmt.Errorf("'snaplen' of profile '%s' must be between 0 and %d bytes: %d", profile.Name, maxSnaplen, snaplen))
+		}
+		timeout, interval := *override(profile.Timeout, duration), *override(profile.Interval, interval)
+		if timeout < 0 || interval < 0 {
+			errs = append(errs, fmt.Errorf("'timeout' and 'interval' of profile '%s' must not be negative", profile.Name))
+		} else if timeout > 0 && interval > timeout {
+			errs = append(errs, fmt.Errorf("'interval' ( %ds ) of profile '%s' is larger than its 'timeout' ( %ds ): PCAP files would never be rotated", interval, profile.Name, timeout))
+		}
+		if profile.CronExp == "" && timeout > 0 {
+			errs = append(errs, fmt.Errorf("profile '%s' has no 'cron_exp': it runs until shutdown and must not set a 'timeout'", profile.Name))
 		}
 	}
 
-	filter := factory(rawFilter, compatFilters)
-	filters = append(filters, filter)
-	jlog(INFO, &emptyTcpdumpJob, stringFormatter.Format("using filter: {0}", filter.String()))
+	return errs
+}
 
-	return filters
+// schemaCommand prints the JSON Schema of the configuration or of the JSON documents written by `tcpdumpw`.
+const schemaCommand = "schema"
+
+// schemas are the contracts which downstream parsers may validate against; see: `tcpdumpw schema <name>`.
+var schemas = map[string]func() any{
+	"config": func() any {
+		return schema.FromFlags("config", "tcpdumpw configuration",
+			"flags accepted by tcpdumpw; they may also be set as environment variables prefixed with "+flagsEnvPrefix, flag.CommandLine)
+	},
+	"log": func() any {
+		return schema.FromType("log", "tcpdumpw log entry",
+			"structured log entries written into standard output; see: https://cloud.google.com/logging/docs/structured-logging", jLogEntry{})
+	},
+	"summary": func() any {
+		return schema.FromType("summary", "tcpdumpw execution summary",
+			"summary of an execution written into 'summary_dir' and included in notifications", pcapExecutionSummary{})
+	},
+	"packet": func() any {
+		return schema.Packet()
+	},
+	"recovery": func() any {
+		return schema.FromType("recovery", "tcpdumpw recovery manifest",
+			"files left behind by previous executions found at startup; written into 'summary_dir'", recoveryManifest{})
+	},
 }
 
-func parseEphemeralPorts(ephemerals *string) *pcap.PcapEmphemeralPorts {
-	// default ephemeral ports range
-	ephemeralPortRange := &pcap.PcapEmphemeralPorts{
-		Min: pcap.PCAP_MIN_EPHEMERAL_PORT,
-		Max: pcap.PCAP_MAX_EPHEMERAL_PORT,
+// printSchema prints the schema named by the 1st argument, or the available names if there is none; it returns the exit code.
+func printSchema(args []string) int {
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
 	}
+	slices.Sort(names)
 
-	if *ephemerals == "" {
-		return ephemeralPortRange
+	if len(args) == 0 {
+		fmt.Println(strings.Join(names, "\n"))
+		return exitSuccess
 	}
 
-	ephemeralPorts := strings.SplitN(*ephemerals, ",", 2)
-
-	if len(ephemeralPorts) != 2 {
-		return ephemeralPortRange
+	newSchema, ok := schemas[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown schema: %s | available: %s\n", args[0], strings.Join(names, ", "))
+		return exitConfigError
 	}
-
-	for i, valueStr := range ephemeralPorts {
-		if value, err := strconv.ParseUint(valueStr, 10, 16); err != nil && value >= 0x0400 && value <= 0xFFFF {
-			// see: https://datatracker.ietf.org/doc/html/rfc6056#page-5
-			// a valid `ephemeral port` must be within RFC 6056 range: [1024/0x4000,65535/0xFFFF]
-			port := uint16(value)
-			if i == 0 && port < ephemeralPortRange.Max {
-				ephemeralPortRange.Min = uint16(value)
-			} else if port > ephemeralPortRange.Min {
-				ephemeralPortRange.Max = uint16(value)
-			}
-		}
+	document, err := json.MarshalIndent(newSchema(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode schema: %s | %v\n", args[0], err)
+		return exitConfigError
 	}
+	fmt.Println(string(document))
+	return exitSuccess
+}
 
-	return ephemeralPortRange
+// flagsEnvPrefix is prepended to the uppercase name of a flag to get the environment variable which sets its value.
+const flagsEnvPrefix = "TCPDUMPW_"
+
+// setFlagsFromEnv sets the value of every flag which is defined as an environment variable; it must be called
+// before parsing the command line, so that flags are the ones which prevail. It returns the names of the flags set.
+func setFlagsFromEnv() ([]string, error) {
+	var errs []error
+	names := []string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		envVar := flagsEnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(envVar)
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value for %s: %q | %w", envVar, value, err))
+			return
+		}
+		names = append(names, f.Name)
+	})
+	return names, errors.Join(errs...)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == schemaCommand {
+		os.Exit(printSchema(os.Args[2:]))
+	}
+
+	envFlags, envFlagsErr := setFlagsFromEnv()
 	flag.Parse()
+	// flags in the command line prevail over environment variables
+	flag.Visit(func(f *flag.Flag) {
+		envFlags = slices.DeleteFunc(envFlags, func(name string) bool { return name == f.Name })
+	})
+
+	if *print_ver {
+		version, _ := json.Marshal(newBuildInfo())
+		fmt.Println(string(version))
+		os.Exit(0)
+	}
+
+	if *list_tz {
+		prefix := *timezone
+		if prefix == "UTC" {
+			prefix = ""
+		}
+		for _, zone := range zoneinfo.List(prefix) {
+			fmt.Println(zone)
+		}
+		os.Exit(0)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer func() {
 		if r := recover(); r != nil {
 			jlog(FATAL, &emptyTcpdumpJob, stringFormatter.Format("panic: {0}", r))
 			fmt.Fprintln(os.Stderr, string(debug.Stack()))
+			exit(exitPanic, fmt.Sprintf("panic: %v", r))
 		}
 	}()
 
 	jid.Store(uuid.Nil)
 	xid.Store(uuid.Nil)
 
+	if envFlagsErr != nil {
+		fatal(exitConfigError, fmt.Sprintf("failed to set flags from environment: %v", envFlagsErr))
+	} else if len(envFlags) > 0 {
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("flags set from environment: %v", envFlags))
+	}
+
+	build := newBuildInfo()
+	jlogWithData(INFO, &emptyTcpdumpJob, fmt.Sprintf("tcpdumpw %s | commit: %s | built: %s | %s", build.Version, build.Commit, build.Date, build.Libpcap), build)
+
+	if err := validateFlags(); err != nil {
+		fatal(exitConfigError, fmt.Sprintf("invalid configuration: %v", err))
+	}
+
+	if *use_mds {
+		resolveIdentity(ctx)
+	}
+
+	if *audit_log != "" {
+		stream, err := audit.NewStream(*audit_log, map[string]string{
+			"instance": identity.InstanceID,
+			"revision": identity.Revision,
+		})
+		if err != nil {
+			// captures must never be controlled without being traceable
+			fatal(exitConfigError, fmt.Sprintf("failed to open audit log: %s | %v", *audit_log, err))
+		}
+		auditStream = stream
+		defer auditStream.Close()
+	}
+
+	if *otlp_url != "" {
+		tracer = newTracer(ctx, otlp_url)
+	}
+
+	if *rst_alert > 0 {
+		resetAlerts = analysis.NewBurstDetector(*rst_alert, resetAlertWindow)
+	}
+
+	if *probe_addr != "" {
+		isCapturing := func() bool { return activeTasks.Load() > 0 }
+		if p, err := probe.New(*probe_addr, time.Duration(*probe_int)*time.Second,
+			time.Duration(*probe_to)*time.Second, isCapturing, onProbeEvent); err == nil {
+			markerProbe = p
+		} else {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to create probe: %v", err))
+		}
+	}
+
+	if *notify_url != "" {
+		resolveSecretFlag(ctx, "notify_webhook", *notify_url, func(url string) {
+			if hook, err := notify.NewWebhook(url, *notify_fmt, notifyTimeout); err == nil {
+				webhook.Store(hook)
+			} else {
+				jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to create webhook: %v", err))
+			}
+		})
+	}
+
+	if *mtls_cert != "" {
+		credentials, err := loadMTLSCredentials(ctx)
+		if err != nil {
+			// network exports must never fall back to unauthenticated connections
+			fatal(exitConfigError, fmt.Sprintf("failed to load mTLS credentials: %v", err))
+		}
+		mtlsCredentials = credentials
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("network exports require mutual TLS: %s", credentials))
+	}
+
+	if *log_sink != "" {
+		resolveSecretFlag(ctx, "log_sink", *log_sink, func(endpoint string) {
+			// entries already queued into the previous sink are still shipped
+			if sink := newLogSink(endpoint); sink != nil {
+				go closeSink(logSink.Swap(sink))
+			}
+		})
+	}
+
+	if *geoip_db != "" {
+		geoDatabase = loadGeoDatabase(ctx, geoip_db)
+	}
+
+	if *rdns_log {
+		rdnsResolver = rdns.NewResolver(ctx, *rdns_cache, rdnsTTL, rdnsTimeout)
+	}
+
+	if mode, err := l7.ParsePayloadMode(*json_pl); err == nil {
+		payloadMode = mode
+	} else {
+		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("invalid JSON payload mode, payloads are embedded as translated: %v", err))
+	}
+
+	if rules, err := l7.ParseRedactionRules(*redact, *redact_re); err == nil {
+		redactionRules = rules
+		if rules != nil {
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("JSON records are redacted | rules: %s | regex: %s", *redact, *redact_re))
+		}
+	} else {
+		// captures must never be shared without the expected redactions
+		fatal(exitConfigError, fmt.Sprintf("invalid redaction rules: %v", err))
+	}
+
+	if *tls_keylog != "" {
+		if *hdrs_only {
+			// decrypted payloads must not be analyzed when application payloads must not be seen
+			jlog(WARNING, &emptyTcpdumpJob, "'tls_keylog' is not compatible with 'headers_only': TLS sessions are not decrypted")
+		} else {
+			keyLog = analysis.NewKeyLog(*tls_keylog)
+		}
+	}
+
+	if *hdrs_only {
+		jlog(INFO, &emptyTcpdumpJob, "packets are truncated after their transport header: application payloads are not written")
+	}
+
+	if *anon_key != "" {
+		secretCtx, secretCancel := context.WithTimeout(ctx, secretTimeout)
+		loaded, err := loadAnonymizer(secretCtx, anon_key)
+		secretCancel()
+		if err != nil {
+			// captures must never be shared with the original IP addresses
+			fatal(exitConfigError, fmt.Sprintf("failed to load anonymization key: %s | %v", *anon_key, err))
+		}
+		anonymizer = loaded
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("IP addresses are anonymized in PCAP files and JSON records | key: %s", *anon_key))
+	}
+
+	if *pl_match != "" {
+		pattern, err := regexp.Compile(*pl_match)
+		if err == nil {
+			payloadScope, err = l7.ParseMatchScope(*pl_scope)
+		}
+		if err == nil {
+			payloadPattern = pattern
+			jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("JSON records are written only if their payload matches: %s | scope: %s", *pl_match, payloadScope))
+		} else {
+			jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("invalid payload match, JSON records are not filtered: %v", err))
+		}
+	}
+
+	if *trace_corr {
+		// connections stay correlated for as long as flows may still be exported
+		traceTable = analysis.NewTraceTable(identity.ProjectID, tcpIdleTimeout)
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("packets and flow records are correlated with the traces of HTTP requests | project: %s", identity.ProjectID))
+	}
+
+	if *ipfix_to != "" {
+		// flow records are required to be exported
+		*flows_log = true
+		flowExporter = newFlowExporter(ipfix_to)
+	}
+
 	if *compat || strings.EqualFold(*filter, "DISABLED") {
 		*filter = ""
 	} else {
 		*filter = strings.TrimSpace(*filter)
 	}
 
+	if _, err := parseJSONSinks(*json_sinks, *json_dump, *json_log, *sink_pcap, false); err != nil {
+		fatal(exitConfigError, fmt.Sprintf("invalid JSON sinks: %s | %v", *json_sinks, err))
+	}
+
+	if expandedFilter, err := pcapFilter.ExpandPresets(*filter); err != nil {
+		fatal(exitConfigError, fmt.Sprintf("invalid filter: %s | %v", *filter, err))
+	} else if expandedFilter != *filter {
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("expanded filter presets: %s => %s", *filter, expandedFilter))
+		*filter = expandedFilter
+	}
+
 	compatFilters := pcap.NewPcapFilters()
 	filters := []pcap.PcapFilterProvider{}
 
@@ -610,21 +5159,115 @@ func main() {
 		}
 	}
 
+	if *no_noise {
+		noiseFilterProvider := pcapFilter.NewNoiseFilterProvider()
+		if *filter != "" {
+			// the complex filter is used as is by all engines: platform noise must be excluded from it
+			complexFilter := stringFormatter.Format("({0})", *filter)
+			*filter = *noiseFilterProvider.Apply(ctx, &complexFilter, pcap.PCAP_FILTER_MODE_AND)
+			jlog(INFO, &emptyTcpdumpJob, stringFormatter.Format("using filter: {0}", *filter))
+		} else {
+			filters = append(filters, noiseFilterProvider)
+			jlog(INFO, &emptyTcpdumpJob, stringFormatter.Format("using filter: {0}", noiseFilterProvider.String()))
+		}
+		if *compat {
+			jlog(WARNING, &emptyTcpdumpJob, "platform noise is only excluded from 'tcpdump' captures in compat mode")
+		}
+	}
+
 	ephemeralPortRange := parseEphemeralPorts(ephemerals)
 
-	tasks := createTasks(ctx, pcap_iface, timezone, directory, extension,
-		filter, filters, compatFilters, snaplen, interval, compat, tcp_dump,
-		json_dump, json_log, ordered, conntrack, gcp_gae, ephemeralPortRange)
+	if !*dry_run {
+		prepareDirectories(directory, *gcp_gae && *json_dump, min_free)
+	}
+
+	mount := findMount(directory)
+	isGCSFuse = detectGCSFuse(mount, directory, gcs_fuse)
+	isNetworkFs = detectNetworkFs(mount, directory, nfs_mode)
+	if isNetworkFs {
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("writes into %s are batched | buffer: %d KiB | sync: %ds", *directory, *nfs_buf, *nfs_sync))
+	}
+	memoryBudget := guardMemoryVolume(mount, directory, mem_budget, mem_rotate)
+	if *spill_dir != "" && !*dry_run {
+		prepareSpillDirectory(directory, spill_dir)
+	}
+
+	selectedSinks, _ := parseJSONSinks(*json_sinks, *json_dump, *json_log, *sink_pcap, *gcp_gae)
+	enabledSinks := []string{}
+	for sink, enabled := range selectedSinks {
+		if enabled {
+			enabledSinks = append(enabledSinks, sink)
+		}
+	}
+	slices.Sort(enabledSinks)
+
+	var captureProfiles []*profiles.Profile = nil
+	if *profile_s != "" {
+		// profiles were validated along with all other flags
+		captureProfiles, _ = profiles.Load(*profile_s)
+	}
+
+	jlogWithData(INFO, &emptyTcpdumpJob, "effective configuration", newEffectiveConfig(envFlags, map[string]any{
+		"gcs_fuse":           isGCSFuse,
+		"network_fs":         isNetworkFs,
+		"tmpfs_budget_bytes": memoryBudget,
+		"json_sinks":         enabledSinks,
+		"engines":            selectEngines(),
+		"ephemeral_ports":    ephemeralPortRange,
+		"profiles":           captureProfiles,
+	}))
+
+	if *dry_run {
+		exit(dryRun(ctx, filter, filters), "dry run completed")
+	}
+
+	if *self_test {
+		exit(selfTest(ctx), "self-test completed")
+	}
+
+	// profiles only override some flags: all other ones are shared by all tasks
+	newTasks := func(label string, profile *profiles.Profile) []*pcapTask {
+		return createTasks(ctx, newTaskConfig(label, profile, filters, compatFilters, ephemeralPortRange))
+	}
+
+	var tasks []*pcapTask
+	var profileJobs []*tcpdumpJob = nil
+	if len(captureProfiles) > 0 {
+		for _, profile := range captureProfiles {
+			jobs := newPcapProfile(profile, func(label string) []*pcapTask {
+				return newTasks(label, profile)
+			})
+			profileJobs = append(profileJobs, jobs...)
+			for _, job := range jobs {
+				tasks = append(tasks, job.tasks...)
+			}
+		}
+	} else {
+		tasks = newTasks("", nil)
+	}
 
 	if len(tasks) == 0 {
-		jlog(FATAL, &emptyTcpdumpJob, "no PCAP tasks available")
-		os.Exit(1)
+		if len(findDevices(pcap_iface)) == 0 {
+			fatal(exitNoIfaces, fmt.Sprintf("no PCAP tasks available: no interfaces match '%s'", *pcap_iface))
+		}
+		fatal(exitEngineFailure, "no PCAP tasks available: no PCAP engine could be created")
 	}
 
 	pcapMutex := flock.New(pcapLockFile)
 	if locked, lockErr := pcapMutex.TryLock(); !locked || lockErr != nil {
-		jlog(FATAL, &emptyTcpdumpJob, fmt.Sprintf("failed to acquire PCAP lock | locked: %t | %v", locked, lockErr))
-		os.Exit(2)
+		fatal(exitLockFailure, fmt.Sprintf("failed to acquire PCAP lock | locked: %t | %v", locked, lockErr))
+	}
+
+	if *state_f != "" {
+		stateStore = restoreState(*state_f)
+	}
+	if *hist_size > 0 {
+		executionHistory = openHistory(*hist_size, *hist_file)
+	}
+
+	// the lock guarantees that no other `tcpdumpw` is writing into `directory`
+	if manifest := reconcileFiles(directory, extension, strings.ToLower(*leftovers)); manifest != nil {
+		reportRecovery(manifest)
 	}
 
 	jobs = haxmap.New[string, *tcpdumpJob]()
@@ -632,14 +5275,98 @@ func main() {
 	timeout := time.Duration(*duration) * time.Second
 	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("parsed timeout: %v", timeout))
 
+	isJobMode := strings.EqualFold(*run_mode, jobMode)
+	isWindowMode := strings.EqualFold(*run_mode, windowMode)
+
+	var controlServer *control.Server
+	if *ctrl_sock != "" {
+		controlServer = control.NewServer(*ctrl_sock)
+		registerStatusCommand(controlServer, tasks)
+	}
+
+	if *http_addr != "" {
+		go startHTTPServer(ctx, *http_addr)
+	}
+
 	// the file to be created when `tcpdumpw` exists
 	exitSignal := fmt.Sprintf("%s/TCPDUMPW_EXITED", *directory)
+	// the file to be created when all PCAP files must be exported ASAP
+	flushSignal := fmt.Sprintf("%s/TCPDUMPW_FLUSH", *directory)
+
+	if *use_mds && *term_watch {
+		go watchTermination(ctx, tasks, &flushSignal)
+	}
+
+	if memoryBudget > 0 {
+		go watchMemoryVolume(ctx, tasks, directory, memoryBudget)
+	}
+
+	if spiller != nil {
+		go spillFiles(ctx, directory, extension, spillInterval)
+	}
+
+	if *disk_guard {
+		minFree := uint64(max(*min_free, 0)) * 1024 * 1024
+		diskGuard = storage.NewDiskGuard(*directory, minFree, 2*minFree+diskResumeHeadroom)
+		go watchDisk(ctx, tasks, &flushSignal)
+	}
+
+	if *max_engine > 0 {
+		engines = governor.New(*max_engine)
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("PCAP engines limited to %d of %d", *max_engine, len(tasks)))
+	}
+
+	if *heartbeat > 0 {
+		go beat(ctx, tasks, directory, *heartbeat)
+	}
+
+	if markerProbe != nil {
+		go markerProbe.Run(ctx)
+		jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("sending probe markers to %s every %ds | timeout: %ds", markerProbe.Target(), *probe_int, *probe_to))
+	}
+
+	if *tcp_rtt && *tcp_rtt_to > 0 {
+		go reportLatency(ctx, tasks, time.Duration(*tcp_rtt_to)*time.Second)
+	}
+
+	if *flows_log && *flows_to > 0 {
+		go reportFlows(ctx, tasks, time.Duration(*flows_to)*time.Second)
+	}
+
+	if *quic_log && *quic_to > 0 {
+		go reportQUIC(ctx, tasks, time.Duration(*quic_to)*time.Second)
+	}
+
+	if *conn_tbl && *conn_to > 0 {
+		go reportConnections(ctx, tasks, time.Duration(*conn_to)*time.Second)
+	}
+
+	metricsSinks := []metricsSink{}
+	if *metrics {
+		client := gcp.NewMonitoringClient(gcp.NewMetadataClient(mdsTimeout), identity, monitoringTimeout)
+		metricsSinks = append(metricsSinks, metricsSink{"Cloud Monitoring", client.Write})
+	}
+	if tracer != nil {
+		metricsSinks = append(metricsSinks, metricsSink{"OTLP", tracer.WriteMetrics})
+	}
+	if len(metricsSinks) > 0 && *metrics_to > 0 {
+		go reportMetrics(ctx, tasks, time.Duration(*metrics_to)*time.Second, metricsSinks)
+	}
+
+	if *ifstats_on {
+		go sampleIfaces(ctx, findDevices(pcap_iface), time.Duration(*ifstats_to)*time.Second, metricsSinks)
+	}
 
 	// receives status of TCP listener termination: `true` means successful
 	tcpStopChannel := make(chan bool, 1)
 
 	// create empty job: used if CRON is not enabled
 	job := &tcpdumpJob{Jid: uuid.Nil.String(), tasks: tasks}
+	if isWindowMode {
+		// windows stop when their last request is closed
+		timeout = 0
+	}
+	job.j = capture.NewJob("tcpdump", capture.Schedule{Timeout: timeout}, &capture.Slot{Tasks: captureTasks(tasks), Hooks: newJobHooks(job)})
 
 	jlog(INFO, job, fmt.Sprintf("acquired PCAP lock: %s", pcapLockFile))
 
@@ -648,6 +5375,9 @@ func main() {
 	go func() {
 		signal := <-signals
 		jlog(INFO, job, fmt.Sprintf("signaled: %v", signal))
+		receivedSignal.Store(&signal)
+		shutdown.begin(job, *shutdown_g)
+		recordAction(&audit.Actor{Source: audit.SourceSignal, Signal: signal.String()}, "SHUTDOWN", nil, "", nil)
 		cancel()
 		// unblock TCP listener; next iteration will find `ctx` done
 		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", *hc_port))
@@ -656,99 +5386,66 @@ func main() {
 		}
 	}()
 
-	// Skip scheduling, execute `tcpdump` immediately
-	if !*use_cron {
-		id := uuid.New().String()
-		ctx = context.WithValue(ctx, pcap.PcapContextID, id)
-		logName := fmt.Sprintf("projects/%s/pcaps/%s", os.Getenv("PROJECT_ID"), id)
-		ctx = context.WithValue(ctx, pcap.PcapContextLogName, logName)
-		// start the TCP listener for health checks
+	// Execute `tcpdump` immediately and exit when done
+	if isJobMode {
+		waitForApp(ctx, wait_for, time.Duration(*wait_to)*time.Second)
+		if isReplay() {
+			// the execution ends as soon as all packets were replayed
+			ctx = untilReplayed(ctx, tasks)
+		}
+		code := runJob(ctx, job, pcapMutex, &exitSignal)
+		exit(code, "PCAP job execution completed")
+	}
+
+	// Execute `tcpdump` only while the APP is handling requests
+	if isWindowMode {
+		window := newPcapWindow(ctx, job, time.Duration(*win_linger)*time.Second)
+		registerWindowCommands(controlServer, window)
+		go startControlServer(ctx, controlServer)
 		go startTCPListener(ctx, hc_port, job, tcpStopChannel)
-		start(ctx, &timeout, job)
-		waitDone(job, pcapMutex, &exitSignal)
+		<-ctx.Done()
+		window.wait()
+		doneErr := waitDone(job, pcapMutex, &exitSignal)
 		<-tcpStopChannel
 		close(tcpStopChannel)
-		return
+		exitWhenDone(doneErr)
 	}
 
-	// The `timezone` to be used when scheduling `tcpdump` cron jobs
-	location, err := time.LoadLocation(*timezone)
-	if err != nil {
-		*timezone = "UTC"
-		location = time.UTC
-		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("could not load timezone '%s': %v", *timezone, err))
+	if controlServer != nil {
+		go startControlServer(ctx, controlServer)
 	}
-	jlog(INFO, &emptyTcpdumpJob, fmt.Sprintf("parsed timezone: %v", location))
-
-	// Create a scheduler using the requested timezone.
-	// no more than 1 packet capturing job (all its tasks) should ever be executed.
-	s, err := gocron.NewScheduler(
-		gocron.WithLimitConcurrentJobs(1, gocron.LimitModeReschedule),
-		gocron.WithLocation(location),
-		gocron.WithGlobalJobOptions(
-			gocron.WithTags(
-				os.Getenv("PROJECT_ID"),
-				os.Getenv("APP_SERVICE"),
-				os.Getenv("GCP_REGION"),
-				os.Getenv("APP_REVISION"),
-				os.Getenv("INSTANCE_ID"),
-			),
-		),
-	)
-	if err != nil {
-		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to create scheduler: %v", err))
-		os.Exit(3)
-	}
-
-	// Use the provided `cron` expression ro schedule the packet capturing job
-	j, err := s.NewJob(
-		gocron.CronJob(fmt.Sprintf("TZ=%s %s", *timezone, *cron_exp), true),
-		gocron.NewTask(tcpdump, timeout),
-		gocron.WithName("tcpdump"),
-		gocron.WithSingletonMode(gocron.LimitModeReschedule),
-		gocron.WithEventListeners(
-			gocron.AfterJobRuns(afterTcpdump),
-			gocron.BeforeJobRuns(beforeTcpdump),
-		),
-	)
-	if err != nil {
-		jlog(ERROR, &emptyTcpdumpJob, fmt.Sprintf("failed to create scheduled job: %v", err))
-		s.Shutdown()
-		os.Exit(4)
-	}
-
-	jid.Store(j.ID())
-
-	// redefine default `job` with the scheduled one
-	job = &tcpdumpJob{
-		ctx:   ctx,
-		tasks: tasks,
-		Jid:   j.ID().String(),
-		Name:  j.Name(),
-		Tags:  j.Tags(),
-		j:     &j,
-	}
-	jobs.Set(job.Jid, job)
-	jlog(INFO, job, "scheduled job")
-
-	// Start the packet capturing scheduler
-	s.Start()
-
-	nextRun, _ := j.NextRun()
-	jlog(INFO, job, fmt.Sprintf("next execution: %v", nextRun))
 
-	// start the TCP listener for health checks
-	go startTCPListener(ctx, hc_port, job, tcpStopChannel)
+	// Schedule every profile as an independent job
+	if len(profileJobs) > 0 {
+		schedule(ctx, profileJobs, job, tcpStopChannel)
+		doneErr := waitDone(job, pcapMutex, &exitSignal)
+		<-tcpStopChannel
+		close(tcpStopChannel)
+		exitWhenDone(doneErr)
+	}
 
-	// Block main goroutine until a signal is received
-	<-ctx.Done()
+	// Skip scheduling, execute `tcpdump` immediately
+	if !*use_cron {
+		// start the TCP listener for health checks
+		go startTCPListener(ctx, hc_port, job, tcpStopChannel)
+		// containers may depend on this sidecar: health checks must be available while waiting for the app
+		waitForApp(ctx, wait_for, time.Duration(*wait_to)*time.Second)
+		job.j.Execute(ctx)
+		doneErr := waitDone(job, pcapMutex, &exitSignal)
+		<-tcpStopChannel
+		close(tcpStopChannel)
+		exitWhenDone(doneErr)
+	}
 
-	s.StopJobs()
-	s.RemoveJob(j.ID())
-	s.Shutdown()
-	jlog(INFO, job, "scheduler terminated")
+	// Use the provided `cron` expression to schedule the packet capturing job;
+	// no more than 1 packet capturing job (all its tasks) should ever be executed.
+	scheduledJob := &tcpdumpJob{tasks: tasks, Name: "tcpdump"}
+	scheduledJob.j = capture.NewJob(scheduledJob.Name, capture.Schedule{CronExp: *cron_exp, Seconds: true, Timeout: timeout},
+		&capture.Slot{Tasks: captureTasks(tasks), Hooks: newJobHooks(scheduledJob)})
+	schedule(ctx, []*tcpdumpJob{scheduledJob}, job, tcpStopChannel)
 
-	waitDone(job, pcapMutex, &exitSignal)
+	doneErr := waitDone(job, pcapMutex, &exitSignal)
 	<-tcpStopChannel
 	close(tcpStopChannel)
+	exitWhenDone(doneErr)
 }
@@ -0,0 +1,287 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+type (
+	// AnomalyHandler is invoked for every anomaly, at most once per window for the same source or destination.
+	AnomalyHandler func(event *AnomalyEvent)
+
+	// AnomalyEvent describes suspicious traffic; `Severity` is either `WARNING` or `ERROR`.
+	AnomalyEvent struct {
+		Iface       string    `json:"iface"`
+		Type        string    `json:"type"`
+		Severity    string    `json:"severity"`
+		Source      string    `json:"source,omitempty"`
+		Destination string    `json:"destination,omitempty"`
+		Count       int       `json:"count,omitempty"`
+		Baseline    float64   `json:"baseline,omitempty"`
+		Window      string    `json:"window,omitempty"`
+		Timestamp   time.Time `json:"timestamp"`
+	}
+
+	// AnomalyConfig contains the thresholds used to flag suspicious traffic.
+	AnomalyConfig struct {
+		// connection attempts per second which are considered a SYN flood
+		SYNFloodRate int
+		// connection attempts per second are flagged when they exceed the average by this factor
+		SYNRateFactor float64
+		// distinct destination ports within `ScanWindow` that a single source may try to connect to
+		ScanPorts  int
+		ScanWindow time.Duration
+		// destinations that may be contacted; all destinations are allowed if empty
+		AllowedDestinations []netip.Prefix
+	}
+
+	// AnomalyAnalyzer is a packet analyzer which flags SYN floods, port scans and traffic to unexpected destinations;
+	// it must be fed by a Dispatcher.
+	AnomalyAnalyzer struct {
+		mu        sync.Mutex
+		iface     *string
+		config    *AnomalyConfig
+		synRate   *rateBaseline
+		scans     map[string]*portScan
+		reported  map[string]time.Time
+		lastSweep time.Time
+		onAnomaly AnomalyHandler
+	}
+
+	// rateBaseline counts events per second, and maintains their exponentially weighted moving average.
+	rateBaseline struct {
+		second   int64
+		count    int
+		average  float64
+		seconds  int
+		alerted  map[string]bool
+		hasCount bool
+	}
+
+	portScan struct {
+		start    time.Time
+		ports    map[uint16]struct{}
+		reported bool
+	}
+)
+
+const (
+	AnomalySYNFlood              = "syn_flood"
+	AnomalySYNRate               = "syn_rate"
+	AnomalyPortScan              = "port_scan"
+	AnomalyUnexpectedDestination = "unexpected_destination"
+)
+
+const (
+	// weight of every second in the average of connection attempts
+	rateSmoothing = 0.05
+	// the average is not reliable until enough seconds are observed
+	rateWarmup = 60
+	// rates below this value are never flagged as anomalies, regardless of the average
+	minAnomalousRate = 20
+	// the same anomaly is reported at most once within this window
+	anomalyReportWindow = 1 * time.Minute
+)
+
+// observe counts an event at `ts`, and returns the amount of events within the same second.
+func (r *rateBaseline) observe(ts time.Time) int {
+	second := ts.Unix()
+	if r.hasCount && second != r.second {
+		r.average = rateSmoothing*float64(r.count) + (1-rateSmoothing)*r.average
+		// seconds without events also contribute to the average
+		if idle := second - r.second - 1; idle > 0 {
+			r.average *= math.Pow(1-rateSmoothing, float64(min(idle, 3600)))
+		}
+		r.seconds += int(max(1, min(second-r.second, rateWarmup)))
+		r.count = 0
+		clear(r.alerted)
+	}
+	r.hasCount = true
+	r.second = second
+	r.count += 1
+	return r.count
+}
+
+// alert returns `true` once per second for every kind of alert.
+func (r *rateBaseline) alert(kind string) bool {
+	if r.alerted[kind] {
+		return false
+	}
+	r.alerted[kind] = true
+	return true
+}
+
+func (a *AnomalyAnalyzer) newEvent(kind, severity string, ts time.Time) *AnomalyEvent {
+	return &AnomalyEvent{
+		Iface:     *a.iface,
+		Type:      kind,
+		Severity:  severity,
+		Timestamp: ts,
+	}
+}
+
+// shouldReport deduplicates anomalies for the same `key`; must be called while holding `a.mu`.
+func (a *AnomalyAnalyzer) shouldReport(key string, ts time.Time) bool {
+	if last, ok := a.reported[key]; ok && ts.Sub(last) < anomalyReportWindow {
+		return false
+	}
+	a.reported[key] = ts
+	return true
+}
+
+// sweep forgets expired port scans and reports; must be called while holding `a.mu`.
+func (a *AnomalyAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < sweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for source, scan := range a.scans {
+		if now.Sub(scan.start) > a.config.ScanWindow {
+			delete(a.scans, source)
+		}
+	}
+	for key, last := range a.reported {
+		if now.Sub(last) > anomalyReportWindow {
+			delete(a.reported, key)
+		}
+	}
+}
+
+func (a *AnomalyAnalyzer) checkSYNRate(ts time.Time) {
+	count := a.synRate.observe(ts)
+
+	if a.config.SYNFloodRate > 0 && count > a.config.SYNFloodRate && a.synRate.alert(AnomalySYNFlood) {
+		event := a.newEvent(AnomalySYNFlood, "ERROR", ts)
+		event.Count = count
+		event.Baseline = a.synRate.average
+		event.Window = time.Second.String()
+		a.onAnomaly(event)
+		return
+	}
+
+	if a.config.SYNRateFactor <= 0 || a.synRate.seconds < rateWarmup {
+		return
+	}
+	threshold := max(minAnomalousRate, a.config.SYNRateFactor*a.synRate.average)
+	if float64(count) > threshold && a.synRate.alert(AnomalySYNRate) {
+		event := a.newEvent(AnomalySYNRate, "WARNING", ts)
+		event.Count = count
+		event.Baseline = a.synRate.average
+		event.Window = time.Second.String()
+		a.onAnomaly(event)
+	}
+}
+
+func (a *AnomalyAnalyzer) checkPortScan(src string, dst string, port uint16, ts time.Time) {
+	if a.config.ScanPorts <= 0 {
+		return
+	}
+	scan, ok := a.scans[src]
+	if !ok || ts.Sub(scan.start) > a.config.ScanWindow {
+		scan = &portScan{start: ts, ports: make(map[uint16]struct{})}
+		a.scans[src] = scan
+	}
+	scan.ports[port] = struct{}{}
+	if len(scan.ports) <= a.config.ScanPorts || scan.reported {
+		return
+	}
+	scan.reported = true
+	event := a.newEvent(AnomalyPortScan, "WARNING", ts)
+	event.Source = src
+	event.Destination = dst
+	event.Count = len(scan.ports)
+	event.Window = a.config.ScanWindow.String()
+	a.onAnomaly(event)
+}
+
+func (a *AnomalyAnalyzer) isAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() {
+		return true
+	}
+	for _, prefix := range a.config.AllowedDestinations {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AnomalyAnalyzer) checkDestination(src string, dst string, port uint16, ts time.Time) {
+	if len(a.config.AllowedDestinations) == 0 {
+		return
+	}
+	addr, err := netip.ParseAddr(dst)
+	if err != nil || a.isAllowed(addr) {
+		return
+	}
+	destination := fmt.Sprintf("%s:%d", dst, port)
+	if !a.shouldReport(AnomalyUnexpectedDestination+"|"+destination, ts) {
+		return
+	}
+	event := a.newEvent(AnomalyUnexpectedDestination, "ERROR", ts)
+	event.Source = src
+	event.Destination = destination
+	a.onAnomaly(event)
+}
+
+func (a *AnomalyAnalyzer) analyze(packet *Packet) {
+	ts := packet.timestamp()
+
+	// connection attempts are TCP segments carrying only SYN, or UDP datagrams
+	isSYN := packet.L4.Flags.Map.SYN && !packet.L4.Flags.Map.ACK
+	isUDP := packet.L3.Proto.Name == "UDP"
+	if !isSYN && !isUDP {
+		return
+	}
+
+	_, dstPort := packet.Ports()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(ts)
+
+	if isSYN {
+		a.checkSYNRate(ts)
+		a.checkPortScan(packet.L3.Src, packet.L3.Dst, dstPort, ts)
+	}
+	a.checkDestination(packet.L3.Src, packet.L3.Dst, dstPort, ts)
+}
+
+// Analyze looks for anomalies in connection attempts; all other packets are ignored.
+func (a *AnomalyAnalyzer) Analyze(packet *Packet) {
+	if packet.L3 != nil && packet.L4 != nil {
+		a.analyze(packet)
+	}
+}
+
+// NewAnomalyAnalyzer creates an analyzer which flags suspicious traffic found in the JSON translated packets
+// captured from `iface`, using the thresholds defined by `config`.
+func NewAnomalyAnalyzer(iface *string, config *AnomalyConfig, onAnomaly AnomalyHandler) *AnomalyAnalyzer {
+	return &AnomalyAnalyzer{
+		iface:     iface,
+		config:    config,
+		synRate:   &rateBaseline{alerted: make(map[string]bool)},
+		scans:     make(map[string]*portScan),
+		reported:  make(map[string]time.Time),
+		onAnomaly: onAnomaly,
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type (
+	// CloseHandler is invoked for every connection which is reset, or which stops being active without being closed.
+	CloseHandler func(event *CloseEvent)
+
+	// CloseEvent describes a connection which was not gracefully closed; `Direction` is the
+	// direction of the segment that reset the connection: `client_to_server` or `server_to_client`.
+	CloseEvent struct {
+		Type        string    `json:"type"`
+		Iface       string    `json:"iface"`
+		ClientIP    string    `json:"client_ip"`
+		ClientPort  uint16    `json:"client_port"`
+		ServerIP    string    `json:"server_ip"`
+		ServerPort  uint16    `json:"server_port"`
+		Direction   string    `json:"direction,omitempty"`
+		ClientBytes uint64    `json:"client_bytes"`
+		ServerBytes uint64    `json:"server_bytes"`
+		Duration    float64   `json:"duration_ms"`
+		Timestamp   time.Time `json:"timestamp"`
+	}
+
+	// CloseAnalyzer is a packet analyzer which follows connections until they are closed, in order to find
+	// the ones that are reset or that time out without a FIN; it must be fed by a Dispatcher.
+	CloseAnalyzer struct {
+		mu          sync.Mutex
+		iface       *string
+		connections map[string]*trackedConnection
+		idleTimeout time.Duration
+		lastSweep   time.Time
+		onClose     CloseHandler
+	}
+
+	trackedConnection struct {
+		clientIP    string
+		clientPort  uint16
+		serverIP    string
+		serverPort  uint16
+		clientBytes uint64
+		serverBytes uint64
+		clientFIN   bool
+		serverFIN   bool
+		start       time.Time
+		last        time.Time
+	}
+
+	// BurstDetector counts events within a sliding window, and reports when they reach a threshold.
+	BurstDetector struct {
+		mu        sync.Mutex
+		threshold int
+		window    time.Duration
+		events    []time.Time
+		alertedAt time.Time
+	}
+)
+
+const (
+	CloseEventReset       = "reset"
+	CloseEventIdleTimeout = "idle_timeout"
+
+	directionClientToServer = "client_to_server"
+	directionServerToClient = "server_to_client"
+)
+
+// connections are keyed by both endpoints sorted, so that both directions share the same key
+func connectionKey(segment *Packet) string {
+	src := fmt.Sprintf("%s:%d", segment.L3.Src, *segment.L4.Src)
+	dst := fmt.Sprintf("%s:%d", segment.L3.Dst, *segment.L4.Dst)
+	if src < dst {
+		return src + "|" + dst
+	}
+	return dst + "|" + src
+}
+
+func (a *CloseAnalyzer) emit(eventType, direction string, conn *trackedConnection, ts time.Time) {
+	if a.onClose == nil {
+		return
+	}
+	a.onClose(&CloseEvent{
+		Type:        eventType,
+		Iface:       *a.iface,
+		ClientIP:    conn.clientIP,
+		ClientPort:  conn.clientPort,
+		ServerIP:    conn.serverIP,
+		ServerPort:  conn.serverPort,
+		Direction:   direction,
+		ClientBytes: conn.clientBytes,
+		ServerBytes: conn.serverBytes,
+		Duration:    toMillis(conn.last.Sub(conn.start)),
+		Timestamp:   ts,
+	})
+}
+
+// sweep reports connections which have not been active for `idleTimeout`; must be called while holding `a.mu`.
+func (a *CloseAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < sweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for key, conn := range a.connections {
+		if now.Sub(conn.last) > a.idleTimeout {
+			delete(a.connections, key)
+			a.emit(CloseEventIdleTimeout, "", conn, now)
+		}
+	}
+}
+
+func (a *CloseAnalyzer) analyze(segment *Packet) {
+	ts := segment.timestamp()
+	flags := segment.L4.Flags.Map
+	key := connectionKey(segment)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(ts)
+
+	conn, ok := a.connections[key]
+	if !ok {
+		if flags.RST {
+			return // resets for connections that were never seen carry no useful information
+		}
+		// the sender of the 1st segment is the client, unless it is a SYN/ACK
+		conn = &trackedConnection{
+			clientIP: segment.L3.Src, clientPort: *segment.L4.Src,
+			serverIP: segment.L3.Dst, serverPort: *segment.L4.Dst,
+			start: ts,
+		}
+		if flags.SYN && flags.ACK {
+			conn.clientIP, conn.serverIP = conn.serverIP, conn.clientIP
+			conn.clientPort, conn.serverPort = conn.serverPort, conn.clientPort
+		}
+		a.connections[key] = conn
+	}
+	conn.last = ts
+
+	fromClient := segment.L3.Src == conn.clientIP && *segment.L4.Src == conn.clientPort
+	payloadLen := segment.payloadLen()
+	if fromClient {
+		conn.clientBytes += payloadLen
+		conn.clientFIN = conn.clientFIN || flags.FIN
+	} else {
+		conn.serverBytes += payloadLen
+		conn.serverFIN = conn.serverFIN || flags.FIN
+	}
+
+	if flags.RST {
+		delete(a.connections, key)
+		direction := directionServerToClient
+		if fromClient {
+			direction = directionClientToServer
+		}
+		a.emit(CloseEventReset, direction, conn, ts)
+		return
+	}
+
+	// both sides sent a FIN: the connection was gracefully closed
+	if conn.clientFIN && conn.serverFIN {
+		delete(a.connections, key)
+	}
+}
+
+// Analyze follows TCP segments; all other packets are ignored.
+func (a *CloseAnalyzer) Analyze(packet *Packet) {
+	if packet.isSegment() {
+		a.analyze(packet)
+	}
+}
+
+// NewCloseAnalyzer creates an analyzer which reports connections captured from `iface` that are
+// reset, or that are not active for `idleTimeout` without being closed.
+func NewCloseAnalyzer(iface *string, idleTimeout time.Duration, onClose CloseHandler) *CloseAnalyzer {
+	return &CloseAnalyzer{
+		iface:       iface,
+		connections: make(map[string]*trackedConnection),
+		idleTimeout: idleTimeout,
+		onClose:     onClose,
+	}
+}
+
+// Observe records an event at `ts`, and returns the amount of events within the window; it returns
+// `true` when the threshold is reached, at most once per window.
+func (d *BurstDetector) Observe(ts time.Time) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.events = append(d.events, ts)
+	// events are observed in order: drop the ones that are older than the window
+	expired := 0
+	for expired < len(d.events) && ts.Sub(d.events[expired]) > d.window {
+		expired++
+	}
+	d.events = d.events[expired:]
+
+	count := len(d.events)
+	if count < d.threshold || ts.Sub(d.alertedAt) < d.window {
+		return count, false
+	}
+	d.alertedAt = ts
+	return count, true
+}
+
+// NewBurstDetector creates a detector for `threshold` events within `window`.
+func NewBurstDetector(threshold int, window time.Duration) *BurstDetector {
+	return &BurstDetector{threshold: threshold, window: window}
+}
@@ -0,0 +1,193 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+type (
+	// ConnSnapshot counts the TCP connections to a peer by state, at the time the snapshot was taken;
+	// the peer is the server side of connections: the one which received the SYN.
+	ConnSnapshot struct {
+		Iface string `json:"iface"`
+		Peer  string `json:"peer"`
+		// connections which completed the handshake, or which were already established when the capture started
+		Open uint64 `json:"open"`
+		// connections which did not complete the handshake: SYN or SYN/ACK sent
+		HalfOpen uint64 `json:"half_open"`
+		// connections which have been closed by one peer only
+		Closing   uint64    `json:"closing"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	// ConnTable is a packet analyzer which follows the state of TCP connections from their SYN, FIN and RST segments,
+	// giving a view similar to `conntrack` without access to the host; it must be fed by a Dispatcher.
+	ConnTable struct {
+		mu          sync.Mutex
+		iface       *string
+		connections map[string]*connState
+		idleTimeout time.Duration
+		lastSweep   time.Time
+	}
+
+	connState struct {
+		state     uint8
+		client    string
+		server    string
+		clientFIN bool
+		serverFIN bool
+		last      time.Time
+	}
+)
+
+const (
+	connSynSent uint8 = iota
+	connSynReceived
+	connEstablished
+	connClosing
+)
+
+// sweep forgets connections which have not been active for `idleTimeout`; must be called while holding `t.mu`.
+func (t *ConnTable) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < sweepInterval {
+		return
+	}
+	t.lastSweep = now
+	for key, conn := range t.connections {
+		if now.Sub(conn.last) > t.idleTimeout {
+			delete(t.connections, key)
+		}
+	}
+}
+
+func (t *ConnTable) analyze(segment *Packet) {
+	ts := segment.timestamp()
+	flags := segment.L4.Flags.Map
+	key := connectionKey(segment)
+	src := fmt.Sprintf("%s:%d", segment.L3.Src, *segment.L4.Src)
+	dst := fmt.Sprintf("%s:%d", segment.L3.Dst, *segment.L4.Dst)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(ts)
+
+	conn, ok := t.connections[key]
+	if !ok {
+		if flags.RST || flags.FIN {
+			return // connections which are being torn down are not worth tracking
+		}
+		conn = &connState{client: src, server: dst, state: connEstablished}
+		switch {
+		case flags.SYN && flags.ACK:
+			conn.client, conn.server = dst, src
+			conn.state = connSynReceived
+		case flags.SYN:
+			conn.state = connSynSent
+		case *segment.L4.Src < *segment.L4.Dst:
+			// connections established before the capture started: servers usually listen on the lower port
+			conn.client, conn.server = dst, src
+		}
+		t.connections[key] = conn
+	}
+	conn.last = ts
+
+	if flags.RST {
+		delete(t.connections, key)
+		return
+	}
+
+	fromClient := src == conn.client
+	switch {
+	case flags.SYN && !flags.ACK && fromClient && conn.state == connClosing:
+		// the 4-tuple is being reused by a new connection
+		conn.state, conn.clientFIN, conn.serverFIN = connSynSent, false, false
+	case flags.SYN && flags.ACK && !fromClient && conn.state == connSynSent:
+		conn.state = connSynReceived
+	case flags.ACK && !flags.SYN && fromClient && conn.state == connSynReceived:
+		conn.state = connEstablished
+	}
+
+	if flags.FIN {
+		if fromClient {
+			conn.clientFIN = true
+		} else {
+			conn.serverFIN = true
+		}
+		conn.state = connClosing
+	}
+	// both sides sent a FIN: the connection was gracefully closed
+	if conn.clientFIN && conn.serverFIN {
+		delete(t.connections, key)
+	}
+}
+
+// Snapshot counts the connections which are currently tracked for every peer, with the busiest peers first.
+func (t *ConnTable) Snapshot() []*ConnSnapshot {
+	now := time.Now()
+	peers := make(map[string]*ConnSnapshot)
+
+	t.mu.Lock()
+	for _, conn := range t.connections {
+		snapshot, ok := peers[conn.server]
+		if !ok {
+			snapshot = &ConnSnapshot{Iface: *t.iface, Peer: conn.server, Timestamp: now}
+			peers[conn.server] = snapshot
+		}
+		switch conn.state {
+		case connSynSent, connSynReceived:
+			snapshot.HalfOpen += 1
+		case connEstablished:
+			snapshot.Open += 1
+		case connClosing:
+			snapshot.Closing += 1
+		}
+	}
+	t.mu.Unlock()
+
+	snapshots := make([]*ConnSnapshot, 0, len(peers))
+	for _, snapshot := range peers {
+		snapshots = append(snapshots, snapshot)
+	}
+	slices.SortFunc(snapshots, func(a, b *ConnSnapshot) int {
+		if c := cmp.Compare(b.Open+b.HalfOpen+b.Closing, a.Open+a.HalfOpen+a.Closing); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Peer, b.Peer)
+	})
+	return snapshots
+}
+
+// Analyze follows TCP segments; all other packets are ignored.
+func (t *ConnTable) Analyze(packet *Packet) {
+	if packet.isSegment() {
+		t.analyze(packet)
+	}
+}
+
+// NewConnTable creates an analyzer which tracks the state of TCP connections captured from `iface`;
+// connections which are not active for `idleTimeout` are forgotten.
+func NewConnTable(iface *string, idleTimeout time.Duration) *ConnTable {
+	return &ConnTable{
+		iface:       iface,
+		connections: make(map[string]*connState),
+		idleTimeout: idleTimeout,
+	}
+}
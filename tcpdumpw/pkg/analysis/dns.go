@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// DNSHandler is invoked for every DNS query, once it is answered or it times out.
+	DNSHandler func(record *DNSRecord)
+
+	DNSQuestion struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+
+	DNSAnswer struct {
+		Name  string `json:"name"`
+		Type  string `json:"type"`
+		TTL   uint32 `json:"ttl"`
+		IP    string `json:"ip,omitempty"`
+		CNAME string `json:"cname,omitempty"`
+		NS    string `json:"ns,omitempty"`
+		PTR   string `json:"ptr,omitempty"`
+	}
+
+	// DNSRecord pairs a DNS query with its response.
+	DNSRecord struct {
+		Iface     string         `json:"iface"`
+		ID        uint16         `json:"id"`
+		Client    string         `json:"client"`
+		Server    string         `json:"server"`
+		Questions []*DNSQuestion `json:"questions"`
+		Answers   []*DNSAnswer   `json:"answers,omitempty"`
+		RCode     string         `json:"rcode,omitempty"`
+		Latency   float64        `json:"latency_ms,omitempty"`
+		TimedOut  bool           `json:"timed_out,omitempty"`
+		Timestamp time.Time      `json:"timestamp"`
+	}
+
+	// DNSAnalyzer is a packet analyzer which pairs DNS queries with their responses by ID;
+	// it must be fed by a Dispatcher.
+	DNSAnalyzer struct {
+		mu        sync.Mutex
+		iface     *string
+		pending   map[string]*DNSRecord
+		timeout   time.Duration
+		lastSweep time.Time
+		onRecord  DNSHandler
+	}
+)
+
+const dnsPort = 53
+
+func dnsKey(client, server string, id uint16) string {
+	return fmt.Sprintf("%s|%s|%d", client, server, id)
+}
+
+// sweep reports queries which were not answered within `timeout`; must be called while holding `a.mu`.
+func (a *DNSAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < a.timeout {
+		return
+	}
+	a.lastSweep = now
+	for key, record := range a.pending {
+		if now.Sub(record.Timestamp) > a.timeout {
+			delete(a.pending, key)
+			record.TimedOut = true
+			a.onRecord(record)
+		}
+	}
+}
+
+func (a *DNSAnalyzer) analyze(message *Packet) {
+	ts := message.timestamp()
+	srcPort, dstPort := message.Ports()
+	src := fmt.Sprintf("%s:%d", message.L3.Src, srcPort)
+	dst := fmt.Sprintf("%s:%d", message.L3.Dst, dstPort)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(ts)
+
+	// responses are sent from the DNS port; all other messages are queries
+	if srcPort != dnsPort {
+		a.pending[dnsKey(src, dst, message.DNS.ID)] = &DNSRecord{
+			Iface:     *a.iface,
+			ID:        message.DNS.ID,
+			Client:    src,
+			Server:    dst,
+			Questions: message.DNS.Questions,
+			Timestamp: ts,
+		}
+		return
+	}
+
+	key := dnsKey(dst, src, message.DNS.ID)
+	record, ok := a.pending[key]
+	if !ok {
+		return // the query was not captured
+	}
+	delete(a.pending, key)
+
+	record.Answers = message.DNS.Answers
+	record.RCode = message.DNS.ResponseCode
+	record.Latency = toMillis(ts.Sub(record.Timestamp))
+	a.onRecord(record)
+}
+
+// Analyze pairs the DNS messages carried by `packet`; all other packets are ignored.
+func (a *DNSAnalyzer) Analyze(packet *Packet) {
+	if packet.L3 != nil && packet.L4 != nil && packet.DNS != nil {
+		a.analyze(packet)
+	}
+}
+
+// Names returns the names of all questions, which is useful to summarize a record.
+func (r *DNSRecord) Names() string {
+	names := make([]string, len(r.Questions))
+	for i, question := range r.Questions {
+		names[i] = question.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// NewDNSAnalyzer creates an analyzer which pairs the DNS queries and responses captured from `iface`;
+// queries which are not answered within `timeout` are reported as timed out.
+func NewDNSAnalyzer(iface *string, timeout time.Duration, onRecord DNSHandler) *DNSAnalyzer {
+	return &DNSAnalyzer{
+		iface:    iface,
+		pending:  make(map[string]*DNSRecord),
+		timeout:  timeout,
+		onRecord: onRecord,
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+type (
+	// clientHello contains the fields of a TLS `ClientHello` message required to fingerprint it
+	clientHello struct {
+		version    uint16
+		ciphers    []uint16
+		extensions []uint16
+		serverName string
+		alpn       []string
+		groups     []uint16
+		points     []uint8
+		sigAlgs    []uint16
+		versions   []uint16
+	}
+
+	// serverHello contains the fields of a TLS `ServerHello` message required to fingerprint it
+	serverHello struct {
+		version         uint16
+		cipher          uint16
+		extensions      []uint16
+		selectedVersion uint16
+		alpn            string
+	}
+)
+
+// see: https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml
+const (
+	extensionServerName          = 0
+	extensionSupportedGroups     = 10
+	extensionECPointFormats      = 11
+	extensionSignatureAlgorithms = 13
+	extensionALPN                = 16
+	extensionSupportedVersions   = 43
+)
+
+// ja4EmptyHash is used by JA4 instead of hashing empty lists
+const ja4EmptyHash = "000000000000"
+
+// see: https://datatracker.ietf.org/doc/html/rfc8701
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	filtered := make([]uint16, 0, len(values))
+	for _, value := range values {
+		if !isGREASE(value) {
+			filtered = append(filtered, value)
+		}
+	}
+	return filtered
+}
+
+func joinDecimal[T uint8 | uint16](values []T) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.FormatUint(uint64(value), 10)
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("%04x", value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func readUint16List(data *cryptobyte.String) []uint16 {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return nil
+	}
+	values := []uint16{}
+	var value uint16
+	for list.ReadUint16(&value) {
+		values = append(values, value)
+	}
+	return values
+}
+
+func readALPN(data *cryptobyte.String) []string {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return nil
+	}
+	protocols := []string{}
+	var protocol cryptobyte.String
+	for list.ReadUint8LengthPrefixed(&protocol) {
+		protocols = append(protocols, string(protocol))
+	}
+	return protocols
+}
+
+func readServerName(data *cryptobyte.String) string {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return ""
+	}
+	var nameType uint8
+	var name cryptobyte.String
+	for list.ReadUint8(&nameType) && list.ReadUint16LengthPrefixed(&name) {
+		if nameType == 0 { // host_name
+			return string(name)
+		}
+	}
+	return ""
+}
+
+// see: https://datatracker.ietf.org/doc/html/rfc8446#section-4.1.2
+func parseClientHello(body []byte) (*clientHello, bool) {
+	hello := &clientHello{}
+	s := cryptobyte.String(body)
+
+	var sessionID, ciphers, compressionMethods cryptobyte.String
+	if !s.ReadUint16(&hello.version) || !s.Skip(32) || // random
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&ciphers) ||
+		!s.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, false
+	}
+
+	var cipher uint16
+	for ciphers.ReadUint16(&cipher) {
+		hello.ciphers = append(hello.ciphers, cipher)
+	}
+
+	var extensions cryptobyte.String
+	if s.Empty() || !s.ReadUint16LengthPrefixed(&extensions) {
+		return hello, true // extensions are optional
+	}
+
+	var extension uint16
+	var data cryptobyte.String
+	for extensions.ReadUint16(&extension) && extensions.ReadUint16LengthPrefixed(&data) {
+		hello.extensions = append(hello.extensions, extension)
+		switch extension {
+		case extensionServerName:
+			hello.serverName = readServerName(&data)
+		case extensionSupportedGroups:
+			hello.groups = readUint16List(&data)
+		case extensionECPointFormats:
+			data.ReadUint8LengthPrefixed((*cryptobyte.String)(&hello.points))
+		case extensionSignatureAlgorithms:
+			hello.sigAlgs = readUint16List(&data)
+		case extensionALPN:
+			hello.alpn = readALPN(&data)
+		case extensionSupportedVersions:
+			var versions cryptobyte.String
+			var version uint16
+			data.ReadUint8LengthPrefixed(&versions)
+			for versions.ReadUint16(&version) {
+				hello.versions = append(hello.versions, version)
+			}
+		}
+	}
+
+	return hello, true
+}
+
+// see: https://datatracker.ietf.org/doc/html/rfc8446#section-4.1.3
+func parseServerHello(body []byte) (*serverHello, bool) {
+	hello := &serverHello{}
+	s := cryptobyte.String(body)
+
+	var sessionID cryptobyte.String
+	var compressionMethod uint8
+	if !s.ReadUint16(&hello.version) || !s.Skip(32) || // random
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16(&hello.cipher) ||
+		!s.ReadUint8(&compressionMethod) {
+		return nil, false
+	}
+
+	var extensions cryptobyte.String
+	if s.Empty() || !s.ReadUint16LengthPrefixed(&extensions) {
+		return hello, true // extensions are optional
+	}
+
+	var extension uint16
+	var data cryptobyte.String
+	for extensions.ReadUint16(&extension) && extensions.ReadUint16LengthPrefixed(&data) {
+		hello.extensions = append(hello.extensions, extension)
+		switch extension {
+		case extensionSupportedVersions:
+			data.ReadUint16(&hello.selectedVersion)
+		case extensionALPN:
+			// TLS 1.3 servers send ALPN encrypted, so it is only available for older versions
+			if protocols := readALPN(&data); len(protocols) > 0 {
+				hello.alpn = protocols[0]
+			}
+		}
+	}
+
+	return hello, true
+}
+
+// negotiatedVersion is the version selected by the server: TLS 1.3 uses
+// the `supported_versions` extension, as the legacy version is TLS 1.2.
+func (h *serverHello) negotiatedVersion() uint16 {
+	if h.selectedVersion != 0 {
+		return h.selectedVersion
+	}
+	return h.version
+}
+
+// ja3s is the MD5 hash of `version,cipher,extensions`.
+func (h *serverHello) ja3s() string {
+	ja3s := fmt.Sprintf("%d,%d,%s", h.version, h.cipher, joinDecimal(h.extensions))
+	hash := md5.Sum([]byte(ja3s))
+	return hex.EncodeToString(hash[:])
+}
+
+// ja3 is the MD5 hash of `version,ciphers,extensions,groups,point_formats`;
+// see: https://github.com/salesforce/ja3
+func (h *clientHello) ja3() string {
+	ja3 := strings.Join([]string{
+		strconv.FormatUint(uint64(h.version), 10),
+		joinDecimal(withoutGREASE(h.ciphers)),
+		joinDecimal(withoutGREASE(h.extensions)),
+		joinDecimal(withoutGREASE(h.groups)),
+		joinDecimal(h.points),
+	}, ",")
+	hash := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(hash[:])
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+func ja4Hash(value string) string {
+	if value == "" {
+		return ja4EmptyHash
+	}
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ja4ALPN is made of the 1st and last characters of the 1st ALPN value
+func (h *clientHello) ja4ALPN() string {
+	if len(h.alpn) == 0 || h.alpn[0] == "" {
+		return "00"
+	}
+	alpn := h.alpn[0]
+	if !isAlphanumeric(alpn[0]) || !isAlphanumeric(alpn[len(alpn)-1]) {
+		alpn = hex.EncodeToString([]byte(alpn))
+	}
+	return string(alpn[0]) + string(alpn[len(alpn)-1])
+}
+
+// ja4 is the `JA4_a`, `JA4_b` and `JA4_c` sections of the JA4 TLS client fingerprint;
+// see: https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (h *clientHello) ja4() string {
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	version := h.version
+	if versions := withoutGREASE(h.versions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+
+	sni := "i"
+	if slices.Contains(extensions, extensionServerName) {
+		sni = "d"
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni,
+		min(len(ciphers), 99), min(len(extensions), 99), h.ja4ALPN())
+
+	slices.Sort(ciphers)
+	b := ja4Hash(joinHex(ciphers))
+
+	// SNI and ALPN are already part of `JA4_a`
+	sortedExtensions := slices.DeleteFunc(slices.Clone(extensions), func(extension uint16) bool {
+		return extension == extensionServerName || extension == extensionALPN
+	})
+	slices.Sort(sortedExtensions)
+	c := joinHex(sortedExtensions)
+	if sigAlgs := withoutGREASE(h.sigAlgs); len(sigAlgs) > 0 {
+		c = c + "_" + joinHex(sigAlgs)
+	}
+
+	return fmt.Sprintf("%s_%s_%s", a, b, ja4Hash(c))
+}
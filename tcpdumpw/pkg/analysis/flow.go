@@ -0,0 +1,245 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/geoip"
+)
+
+type (
+	// FlowHandler is invoked for every flow record, when it is exported.
+	FlowHandler func(record *FlowRecord)
+
+	// FlowRecord aggregates the packets sent in one direction of a flow, identified by its 5-tuple;
+	// active flows are exported periodically, and their counters start over after every export.
+	FlowRecord struct {
+		Iface    string    `json:"iface"`
+		Proto    string    `json:"proto"`
+		ProtoNum uint8     `json:"proto_num"`
+		Src      string    `json:"src"`
+		Dst      string    `json:"dst"`
+		SrcPort  uint16    `json:"src_port,omitempty"`
+		DstPort  uint16    `json:"dst_port,omitempty"`
+		Start    time.Time `json:"start"`
+		End      time.Time `json:"end"`
+		Packets  uint64    `json:"packets"`
+		Bytes    uint64    `json:"bytes"`
+		TCPFlags string    `json:"tcp_flags,omitempty"`
+		// why the record was exported: `active`, `idle`, `fin`, `rst` or `shutdown`
+		Reason string `json:"reason"`
+		// only available for external addresses, when a GeoIP database is configured
+		SrcGeo *geoip.Location `json:"src_geo,omitempty"`
+		DstGeo *geoip.Location `json:"dst_geo,omitempty"`
+		// only available for external addresses with PTR records, when reverse DNS is enabled
+		SrcHost string `json:"src_host,omitempty"`
+		DstHost string `json:"dst_host,omitempty"`
+		// Cloud Trace span of the last request seen on the connection, when trace correlation is enabled
+		Trace string `json:"trace,omitempty"`
+		Span  string `json:"span_id,omitempty"`
+	}
+
+	// FlowAnalyzer is a packet analyzer which aggregates packets into flow records;
+	// it must be fed by a Dispatcher.
+	FlowAnalyzer struct {
+		mu          sync.Mutex
+		iface       *string
+		flows       map[string]*flow
+		idleTimeout time.Duration
+		lastSweep   time.Time
+		onRecord    FlowHandler
+	}
+
+	flow struct {
+		record   *FlowRecord
+		tcpFlags uint8
+	}
+)
+
+// IPv6 `len` is the size of the payload, which does not include the fixed header
+const ipv6HeaderSize = 40
+
+// TCP flags are reported in the same order as they are found in the TCP header
+var tcpFlagNames = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+
+const (
+	tcpFlagFIN = 1 << 0
+	tcpFlagRST = 1 << 2
+)
+
+func tcpFlagsString(flags uint8) string {
+	names := make([]string, 0, len(tcpFlagNames))
+	for i, name := range tcpFlagNames {
+		if flags&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// TCPControlBits returns `TCPFlags` as they are found in the TCP header.
+func (r *FlowRecord) TCPControlBits() uint8 {
+	bits := uint8(0)
+	for _, name := range strings.Split(r.TCPFlags, "|") {
+		if i := slices.Index(tcpFlagNames, name); i >= 0 {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+func (f *flow) export(reason string) *FlowRecord {
+	record := *f.record
+	record.TCPFlags = tcpFlagsString(f.tcpFlags)
+	record.Reason = reason
+	return &record
+}
+
+// reset starts counting again after an active flow is exported.
+func (f *flow) reset() {
+	f.record.Start = time.Time{}
+	f.record.Packets = 0
+	f.record.Bytes = 0
+	f.tcpFlags = 0
+}
+
+// sweep exports the flows which have not been active for `idleTimeout`; must be called while holding `a.mu`.
+func (a *FlowAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < sweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for key, f := range a.flows {
+		if now.Sub(f.record.End) > a.idleTimeout {
+			delete(a.flows, key)
+			if f.record.Packets > 0 {
+				a.onRecord(f.export("idle"))
+			}
+		}
+	}
+}
+
+func (a *FlowAnalyzer) analyze(packet *Packet) {
+	ts := packet.timestamp()
+
+	size := packet.L3.Len
+	if packet.L3.V == 6 {
+		size += ipv6HeaderSize
+	}
+
+	srcPort, dstPort := packet.Ports()
+	var tcpFlags uint8
+	if packet.L4 != nil {
+		tcpFlags = packet.L4.Flags.Map.bits()
+	}
+
+	proto := packet.L3.Proto.Name
+	key := fmt.Sprintf("%s|%s", proto, flowKey(packet.L3.Src, srcPort, packet.L3.Dst, dstPort))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(ts)
+
+	f, ok := a.flows[key]
+	if !ok {
+		f = &flow{
+			record: &FlowRecord{
+				Iface:    *a.iface,
+				Proto:    proto,
+				ProtoNum: packet.L3.Proto.Num,
+				Src:      packet.L3.Src,
+				Dst:      packet.L3.Dst,
+				SrcPort:  srcPort,
+				DstPort:  dstPort,
+			},
+		}
+		a.flows[key] = f
+	}
+
+	if f.record.Start.IsZero() {
+		f.record.Start = ts
+	}
+	f.record.End = ts
+	f.record.Packets += 1
+	f.record.Bytes += size
+	f.tcpFlags |= tcpFlags
+
+	// TCP flows expire as soon as they are closed
+	switch {
+	case tcpFlags&tcpFlagRST != 0:
+		delete(a.flows, key)
+		a.onRecord(f.export("rst"))
+	case tcpFlags&tcpFlagFIN != 0:
+		delete(a.flows, key)
+		a.onRecord(f.export("fin"))
+	}
+}
+
+// Analyze aggregates IP packets into flows; all other packets are ignored.
+func (a *FlowAnalyzer) Analyze(packet *Packet) {
+	if packet.L3 != nil && packet.L3.Src != "" {
+		a.analyze(packet)
+	}
+}
+
+// Export reports all the flows which were active since the previous export, and expires idle ones;
+// when `final` is `true`, all flows are expired, i/e: when packet capturing is stopped.
+func (a *FlowAnalyzer) Export(now time.Time, final bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	keys := make([]string, 0, len(a.flows))
+	for key := range a.flows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		f := a.flows[key]
+		switch {
+		case final:
+			delete(a.flows, key)
+			if f.record.Packets > 0 {
+				a.onRecord(f.export("shutdown"))
+			}
+		case now.Sub(f.record.End) > a.idleTimeout:
+			delete(a.flows, key)
+			if f.record.Packets > 0 {
+				a.onRecord(f.export("idle"))
+			}
+		case f.record.Packets > 0:
+			a.onRecord(f.export("active"))
+			f.reset()
+		}
+	}
+}
+
+// NewFlowAnalyzer creates an analyzer which aggregates the JSON translated packets captured from `iface`
+// into flow records; flows which are not active for `idleTimeout` expire, and are exported.
+func NewFlowAnalyzer(iface *string, idleTimeout time.Duration, onRecord FlowHandler) *FlowAnalyzer {
+	return &FlowAnalyzer{
+		iface:       iface,
+		flows:       make(map[string]*flow),
+		idleTimeout: idleTimeout,
+		onRecord:    onRecord,
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"encoding/binary"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+type (
+	// GRPCHandler is invoked for every gRPC call, once the server completes or resets its stream.
+	GRPCHandler func(call *GRPCCall)
+
+	// GRPCCall summarizes a gRPC call carried by an HTTP/2 stream; sizes are the sum of
+	// the length-prefixed messages sent in each direction, as they are seen on the wire.
+	GRPCCall struct {
+		Iface            string    `json:"iface"`
+		Client           string    `json:"client"`
+		Server           string    `json:"server"`
+		StreamID         uint32    `json:"stream_id"`
+		Authority        string    `json:"authority,omitempty"`
+		Service          string    `json:"service"`
+		Method           string    `json:"method"`
+		Code             *int      `json:"code,omitempty"`
+		Status           string    `json:"status,omitempty"`
+		Message          string    `json:"message,omitempty"`
+		HTTPStatus       int       `json:"http_status,omitempty"`
+		Reset            string    `json:"reset,omitempty"`
+		RequestMessages  int64     `json:"request_messages"`
+		RequestBytes     int64     `json:"request_bytes"`
+		ResponseMessages int64     `json:"response_messages"`
+		ResponseBytes    int64     `json:"response_bytes"`
+		Latency          float64   `json:"latency_ms"`
+		Timestamp        time.Time `json:"timestamp"`
+	}
+
+	// grpcMessageReader counts the length-prefixed messages sent in one direction of a stream;
+	// see: https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md#requests
+	grpcMessageReader struct {
+		prefix    []byte
+		remaining uint32
+		messages  *int64
+		bytes     *int64
+	}
+
+	grpcStream struct {
+		call    *GRPCCall
+		readers [2]*grpcMessageReader
+	}
+)
+
+const grpcMessagePrefixSize = 5
+
+// see: https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+var grpcStatusCodes = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+func grpcStatusCode(code int) string {
+	if code >= 0 && code < len(grpcStatusCodes) {
+		return grpcStatusCodes[code]
+	}
+	return strconv.Itoa(code)
+}
+
+func isGRPC(fields []hpack.HeaderField) bool {
+	for _, field := range fields {
+		if field.Name == "content-type" {
+			return strings.HasPrefix(field.Value, "application/grpc")
+		}
+	}
+	return false
+}
+
+func (r *grpcMessageReader) feed(chunk []byte) {
+	for len(chunk) > 0 {
+		if r.remaining > 0 {
+			n := min(uint32(len(chunk)), r.remaining)
+			r.remaining -= n
+			chunk = chunk[n:]
+			continue
+		}
+		n := min(len(chunk), grpcMessagePrefixSize-len(r.prefix))
+		r.prefix = append(r.prefix, chunk[:n]...)
+		chunk = chunk[n:]
+		if len(r.prefix) < grpcMessagePrefixSize {
+			return
+		}
+		// the 1st byte is the compressed flag, followed by the length of the message
+		r.remaining = binary.BigEndian.Uint32(r.prefix[1:])
+		r.prefix = r.prefix[:0]
+		*r.messages += 1
+		*r.bytes += int64(r.remaining)
+	}
+}
+
+func newGRPCStream(iface string, conn *h2Conn, streamID uint32, stream *h2Stream) *grpcStream {
+	// `:path` is `/<package>.<service>/<method>`
+	service, method, _ := strings.Cut(strings.TrimPrefix(stream.path, "/"), "/")
+	call := &GRPCCall{
+		Iface:     iface,
+		Client:    conn.client,
+		Server:    conn.server,
+		StreamID:  streamID,
+		Authority: stream.authority,
+		Service:   service,
+		Method:    method,
+		Timestamp: conn.now,
+	}
+	return &grpcStream{
+		call: call,
+		readers: [2]*grpcMessageReader{
+			{messages: &call.RequestMessages, bytes: &call.RequestBytes},
+			{messages: &call.ResponseMessages, bytes: &call.ResponseBytes},
+		},
+	}
+}
+
+// onResponseHeaders records the status of the call, which is sent either
+// in the trailers, or in the response headers for `Trailers-Only` responses.
+func (s *grpcStream) onResponseHeaders(fields []hpack.HeaderField) {
+	for _, field := range fields {
+		switch field.Name {
+		case ":status":
+			s.call.HTTPStatus, _ = strconv.Atoi(field.Value)
+		case "grpc-status":
+			if code, err := strconv.Atoi(field.Value); err == nil {
+				s.call.Code = &code
+				s.call.Status = grpcStatusCode(code)
+			}
+		case "grpc-message":
+			// see: https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md#responses
+			if message, err := url.PathUnescape(field.Value); err == nil {
+				s.call.Message = message
+			} else {
+				s.call.Message = field.Value
+			}
+		}
+	}
+}
+
+func (s *grpcStream) complete(now time.Time) *GRPCCall {
+	s.call.Latency = toMillis(now.Sub(s.call.Timestamp))
+	return s.call
+}
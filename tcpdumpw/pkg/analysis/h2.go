@@ -0,0 +1,503 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+)
+
+type (
+	// H2Handler is invoked for every HTTP/2 stream level event.
+	H2Handler func(event *H2Event)
+
+	// H2Event describes an HTTP/2 frame, or a flow-control stall; `Direction` is the
+	// direction of the frame, or of the data being stalled: `client_to_server` or `server_to_client`.
+	H2Event struct {
+		Type         string    `json:"type"`
+		Iface        string    `json:"iface"`
+		Client       string    `json:"client"`
+		Server       string    `json:"server"`
+		Direction    string    `json:"direction"`
+		StreamID     uint32    `json:"stream_id"`
+		Method       string    `json:"method,omitempty"`
+		Path         string    `json:"path,omitempty"`
+		Authority    string    `json:"authority,omitempty"`
+		Status       int       `json:"status,omitempty"`
+		EndStream    bool      `json:"end_stream,omitempty"`
+		ErrorCode    string    `json:"error_code,omitempty"`
+		LastStreamID uint32    `json:"last_stream_id,omitempty"`
+		Debug        string    `json:"debug,omitempty"`
+		Window       int64     `json:"window,omitempty"`
+		Duration     float64   `json:"duration_ms,omitempty"`
+		Timestamp    time.Time `json:"timestamp"`
+	}
+
+	// H2Analyzer decodes the frames of cleartext HTTP/2 ( h2c ) connections to the configured ports;
+	// it must be fed with TCP segments including their payload.
+	H2Analyzer struct {
+		iface     *string
+		ports     map[uint16]struct{}
+		conns     map[string]*h2Conn
+		timeout   time.Duration
+		lastSweep time.Time
+		onEvent   H2Handler
+		// may be `nil`: gRPC calls are only summarized if set
+		onCall GRPCHandler
+	}
+
+	// h2Window is the flow-control window of a sender, either for a connection or for a stream
+	h2Window struct {
+		size    int64
+		stalled time.Time
+	}
+
+	h2Stream struct {
+		method    string
+		path      string
+		authority string
+		// indexed by sender: `h2Client` or `h2Server`
+		windows [2]*h2Window
+		ended   [2]bool
+		// only set for gRPC calls
+		grpc *grpcStream
+	}
+
+	// h2Peer is the state of one of the endpoints of a connection, as a sender
+	h2Peer struct {
+		conn    *h2Conn
+		index   int
+		reader  *h2FrameReader
+		decoder *hpack.Decoder
+		// header blocks are completed by CONTINUATION frames
+		headerBlock  []byte
+		headerStream uint32
+		headerFlags  uint8
+		window       *h2Window
+		// the initial window of new streams, as configured by the receiver
+		initialWindow int64
+	}
+
+	h2Conn struct {
+		analyzer *H2Analyzer
+		client   string
+		server   string
+		lastSeen time.Time
+		now      time.Time
+		peers    [2]*h2Peer
+		streams  map[uint32]*h2Stream
+		// indexed by sender: connections are discarded once both peers sent FIN
+		finished [2]bool
+	}
+)
+
+const (
+	H2EventHeaders = "HEADERS"
+	H2EventReset   = "RST_STREAM"
+	H2EventGoAway  = "GOAWAY"
+	H2EventStall   = "FLOW_CONTROL_STALL"
+	H2EventResume  = "FLOW_CONTROL_RESUME"
+)
+
+const (
+	h2Client = 0
+	h2Server = 1
+)
+
+const (
+	// see: https://datatracker.ietf.org/doc/html/rfc9113#section-6.9.2
+	h2DefaultWindow         = 65535
+	h2DefaultHeaderTable    = 4096
+	h2SettingHeaderTable    = 0x1
+	h2SettingInitialWindow  = 0x4
+	h2MaxStreamsPerConn     = 1024
+	h2MaxDebugDataReported  = 256
+	h2DirectionClientServer = "client_to_server"
+	h2DirectionServerClient = "server_to_client"
+)
+
+func h2Direction(index int) string {
+	if index == h2Client {
+		return h2DirectionClientServer
+	}
+	return h2DirectionServerClient
+}
+
+func (c *h2Conn) newEvent(eventType string, sender int, streamID uint32) *H2Event {
+	return &H2Event{
+		Type:      eventType,
+		Iface:     *c.analyzer.iface,
+		Client:    c.client,
+		Server:    c.server,
+		Direction: h2Direction(sender),
+		StreamID:  streamID,
+		Timestamp: c.now,
+	}
+}
+
+func (c *h2Conn) stream(streamID uint32) *h2Stream {
+	if stream, ok := c.streams[streamID]; ok {
+		return stream
+	}
+	if len(c.streams) >= h2MaxStreamsPerConn {
+		return nil
+	}
+	stream := &h2Stream{}
+	for i, peer := range c.peers {
+		stream.windows[i] = &h2Window{size: peer.initialWindow}
+	}
+	c.streams[streamID] = stream
+	return stream
+}
+
+// consume reduces the window of `sender`, and reports a stall once it is exhausted.
+func (c *h2Conn) consume(window *h2Window, sender int, streamID uint32, n uint32) {
+	window.size -= int64(n)
+	if window.size > 0 || !window.stalled.IsZero() {
+		return
+	}
+	window.stalled = c.now
+	event := c.newEvent(H2EventStall, sender, streamID)
+	event.Window = window.size
+	c.analyzer.onEvent(event)
+}
+
+// increment enlarges the window of `sender`, and reports a resume if it was stalled.
+func (c *h2Conn) increment(window *h2Window, sender int, streamID uint32, n int64) {
+	window.size += n
+	if window.size <= 0 || window.stalled.IsZero() {
+		return
+	}
+	event := c.newEvent(H2EventResume, sender, streamID)
+	event.Window = window.size
+	event.Duration = toMillis(c.now.Sub(window.stalled))
+	window.stalled = time.Time{}
+	c.analyzer.onEvent(event)
+}
+
+func (c *h2Conn) endStream(streamID uint32, sender int) {
+	stream, ok := c.streams[streamID]
+	if !ok {
+		return
+	}
+	stream.ended[sender] = true
+	if stream.ended[h2Client] && stream.ended[h2Server] {
+		delete(c.streams, streamID)
+	}
+}
+
+func (p *h2Peer) peer() *h2Peer {
+	return p.conn.peers[1-p.index]
+}
+
+func (p *h2Peer) onFrameHeader(header *h2FrameHeader) {
+	if header.typ != h2FrameData || header.length == 0 || header.streamID == 0 {
+		return
+	}
+	// flow-control accounts for the whole DATA frame, including padding
+	p.conn.consume(p.window, p.index, 0, header.length)
+	if stream := p.conn.stream(header.streamID); stream != nil {
+		p.conn.consume(stream.windows[p.index], p.index, header.streamID, header.length)
+	}
+}
+
+func (p *h2Peer) onData(header *h2FrameHeader, chunk []byte) {
+	if stream, ok := p.conn.streams[header.streamID]; ok && stream.grpc != nil {
+		stream.grpc.readers[p.index].feed(chunk)
+	}
+}
+
+// onGRPCHeaders tracks gRPC calls, and reports them once the server ends their stream.
+func (p *h2Peer) onGRPCHeaders(streamID uint32, stream *h2Stream, flags uint8, fields []hpack.HeaderField) {
+	analyzer := p.conn.analyzer
+	if p.index == h2Client {
+		if stream.grpc == nil && isGRPC(fields) {
+			stream.grpc = newGRPCStream(*analyzer.iface, p.conn, streamID, stream)
+		}
+		return
+	}
+	if stream.grpc == nil {
+		return
+	}
+	stream.grpc.onResponseHeaders(fields)
+	if flags&h2FlagEndStream != 0 {
+		analyzer.onCall(stream.grpc.complete(p.conn.now))
+		stream.grpc = nil
+	}
+}
+
+func (p *h2Peer) onHeaders(streamID uint32, flags uint8, fields []hpack.HeaderField) {
+	stream := p.conn.stream(streamID)
+	event := p.conn.newEvent(H2EventHeaders, p.index, streamID)
+	event.EndStream = flags&h2FlagEndStream != 0
+	for _, field := range fields {
+		switch field.Name {
+		case ":method":
+			event.Method = field.Value
+		case ":path":
+			event.Path = field.Value
+		case ":authority":
+			event.Authority = field.Value
+		case ":status":
+			event.Status, _ = strconv.Atoi(field.Value)
+		}
+	}
+	if stream != nil && p.index == h2Client && event.Method != "" {
+		stream.method, stream.path, stream.authority = event.Method, event.Path, event.Authority
+	} else if stream != nil {
+		// responses do not carry the request pseudo-headers
+		event.Method, event.Path, event.Authority = stream.method, stream.path, stream.authority
+	}
+	if stream != nil && p.conn.analyzer.onCall != nil {
+		// the HEADERS of gRPC calls are summarized by `GRPCCall`
+		isCall := stream.grpc != nil || (p.index == h2Client && isGRPC(fields))
+		p.onGRPCHeaders(streamID, stream, flags, fields)
+		if isCall {
+			return
+		}
+	}
+	p.conn.analyzer.onEvent(event)
+}
+
+// onHeaderBlock decodes a complete header block; blocks must always be decoded to keep the HPACK state in sync.
+func (p *h2Peer) onHeaderBlock() {
+	block, streamID, flags := p.headerBlock, p.headerStream, p.headerFlags
+	p.headerBlock = nil
+	if p.decoder == nil {
+		return
+	}
+	fields, err := p.decoder.DecodeFull(block)
+	if err != nil {
+		p.decoder = nil // the HPACK state is lost, so no more header blocks can be decoded
+		return
+	}
+	p.onHeaders(streamID, flags, fields)
+	if flags&h2FlagEndStream != 0 {
+		p.conn.endStream(streamID, p.index)
+	}
+}
+
+// see: https://datatracker.ietf.org/doc/html/rfc9113#section-6.2
+func headersFragment(header *h2FrameHeader, data []byte) ([]byte, bool) {
+	padLen := 0
+	if header.flags&h2FlagPadded != 0 {
+		if len(data) < 1 {
+			return nil, false
+		}
+		padLen = int(data[0])
+		data = data[1:]
+	}
+	if header.flags&h2FlagPriority != 0 {
+		if len(data) < 5 {
+			return nil, false
+		}
+		data = data[5:]
+	}
+	if padLen > len(data) {
+		return nil, false
+	}
+	return data[:len(data)-padLen], true
+}
+
+func (p *h2Peer) onSettings(header *h2FrameHeader, data []byte) {
+	if header.flags&h2FlagAck != 0 {
+		return
+	}
+	// settings sent by this peer configure the other peer as a sender
+	sender := p.peer()
+	for len(data) >= 6 {
+		id, value := binary.BigEndian.Uint16(data[0:2]), binary.BigEndian.Uint32(data[2:6])
+		data = data[6:]
+		switch id {
+		case h2SettingHeaderTable:
+			if sender.decoder != nil {
+				sender.decoder.SetAllowedMaxDynamicTableSize(value)
+			}
+		case h2SettingInitialWindow:
+			delta := int64(value) - sender.initialWindow
+			sender.initialWindow = int64(value)
+			for streamID, stream := range p.conn.streams {
+				p.conn.increment(stream.windows[sender.index], sender.index, streamID, delta)
+			}
+		}
+	}
+}
+
+func (p *h2Peer) onFrame(header *h2FrameHeader, data []byte) {
+	switch header.typ {
+	case h2FrameHeaders:
+		fragment, ok := headersFragment(header, data)
+		if !ok {
+			return
+		}
+		p.headerBlock = append(p.headerBlock[:0], fragment...)
+		p.headerStream = header.streamID
+		p.headerFlags = header.flags
+		if header.flags&h2FlagEndHeaders != 0 {
+			p.onHeaderBlock()
+		}
+
+	case h2FrameContinuation:
+		if header.streamID != p.headerStream {
+			return
+		}
+		p.headerBlock = append(p.headerBlock, data...)
+		if header.flags&h2FlagEndHeaders != 0 {
+			p.onHeaderBlock()
+		}
+
+	case h2FrameData:
+		if header.flags&h2FlagEndStream != 0 {
+			p.conn.endStream(header.streamID, p.index)
+		}
+
+	case h2FrameRSTStream:
+		if len(data) < 4 {
+			return
+		}
+		event := p.conn.newEvent(H2EventReset, p.index, header.streamID)
+		event.ErrorCode = h2ErrorCode(binary.BigEndian.Uint32(data))
+		if stream, ok := p.conn.streams[header.streamID]; ok {
+			event.Method, event.Path, event.Authority = stream.method, stream.path, stream.authority
+			delete(p.conn.streams, header.streamID)
+			if stream.grpc != nil {
+				stream.grpc.call.Reset = event.ErrorCode
+				p.conn.analyzer.onCall(stream.grpc.complete(p.conn.now))
+			}
+		}
+		p.conn.analyzer.onEvent(event)
+
+	case h2FrameGoAway:
+		if len(data) < 8 {
+			return
+		}
+		event := p.conn.newEvent(H2EventGoAway, p.index, 0)
+		event.LastStreamID = binary.BigEndian.Uint32(data[0:4]) & 0x7fffffff
+		event.ErrorCode = h2ErrorCode(binary.BigEndian.Uint32(data[4:8]))
+		if debug := data[8:]; len(debug) > 0 {
+			event.Debug = string(debug[:min(len(debug), h2MaxDebugDataReported)])
+		}
+		p.conn.analyzer.onEvent(event)
+
+	case h2FrameSettings:
+		p.onSettings(header, data)
+
+	case h2FrameWindowUpdate:
+		if len(data) < 4 {
+			return
+		}
+		// window updates sent by this peer allow the other peer to send more data
+		sender := p.peer()
+		increment := int64(binary.BigEndian.Uint32(data) & 0x7fffffff)
+		if header.streamID == 0 {
+			p.conn.increment(sender.window, sender.index, 0, increment)
+		} else if stream, ok := p.conn.streams[header.streamID]; ok {
+			p.conn.increment(stream.windows[sender.index], sender.index, header.streamID, increment)
+		}
+	}
+}
+
+func (a *H2Analyzer) newConn(segment *payload.Segment) *h2Conn {
+	conn := &h2Conn{
+		analyzer: a,
+		client:   fmt.Sprintf("%s:%d", segment.SrcIP, segment.SrcPort),
+		server:   fmt.Sprintf("%s:%d", segment.DstIP, segment.DstPort),
+		streams:  make(map[uint32]*h2Stream),
+	}
+	for i := range conn.peers {
+		peer := &h2Peer{
+			conn:          conn,
+			index:         i,
+			decoder:       hpack.NewDecoder(h2DefaultHeaderTable, nil),
+			window:        &h2Window{size: h2DefaultWindow},
+			initialWindow: h2DefaultWindow,
+		}
+		peer.reader = newH2FrameReader(i == h2Server, peer)
+		conn.peers[i] = peer
+	}
+	return conn
+}
+
+func (a *H2Analyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < a.timeout {
+		return
+	}
+	a.lastSweep = now
+	for key, conn := range a.conns {
+		if now.Sub(conn.lastSeen) > a.timeout {
+			delete(a.conns, key)
+		}
+	}
+}
+
+func (a *H2Analyzer) Analyze(segment *payload.Segment) {
+	a.sweep(segment.Timestamp)
+
+	var key string
+	sender := h2Client
+	if _, ok := a.ports[segment.DstPort]; ok {
+		key = flowKey(segment.SrcIP, segment.SrcPort, segment.DstIP, segment.DstPort)
+	} else if _, ok := a.ports[segment.SrcPort]; ok {
+		key = flowKey(segment.DstIP, segment.DstPort, segment.SrcIP, segment.SrcPort)
+		sender = h2Server
+	} else {
+		return
+	}
+
+	conn, ok := a.conns[key]
+	if !ok {
+		// frames cannot be decoded without the connection preface and the initial HPACK state
+		if sender == h2Server || !segment.SYN {
+			return
+		}
+		conn = a.newConn(segment)
+		a.conns[key] = conn
+	}
+	conn.lastSeen = segment.Timestamp
+	conn.now = segment.Timestamp
+
+	conn.peers[sender].reader.feed(segment)
+
+	if segment.FIN {
+		conn.finished[sender] = true
+	}
+	if segment.RST || (conn.finished[h2Client] && conn.finished[h2Server]) {
+		delete(a.conns, key)
+	}
+}
+
+// NewH2Analyzer creates an analyzer which reports the HTTP/2 stream level events of the h2c servers listening on `ports`;
+// connections must be captured since their handshake, and the ones which are not active for `timeout` are discarded.
+// gRPC calls are reported to `onCall` instead of `onEvent`, unless it is `nil`.
+func NewH2Analyzer(iface *string, ports []uint16, timeout time.Duration, onEvent H2Handler, onCall GRPCHandler) *H2Analyzer {
+	portSet := make(map[uint16]struct{}, len(ports))
+	for _, port := range ports {
+		portSet[port] = struct{}{}
+	}
+	return &H2Analyzer{
+		iface:   iface,
+		ports:   portSet,
+		conns:   make(map[string]*h2Conn),
+		timeout: timeout,
+		onEvent: onEvent,
+		onCall:  onCall,
+	}
+}
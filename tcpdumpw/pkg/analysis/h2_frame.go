@@ -0,0 +1,254 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+)
+
+type (
+	h2FrameType uint8
+
+	// see: https://datatracker.ietf.org/doc/html/rfc9113#section-4.1
+	h2FrameHeader struct {
+		length   uint32
+		typ      h2FrameType
+		flags    uint8
+		streamID uint32
+	}
+
+	// h2FrameHandler receives the frames decoded from one direction of a connection;
+	// DATA frames are not buffered: their content is delivered in chunks, without padding,
+	// and `onFrame` is invoked without payload once they are complete.
+	h2FrameHandler interface {
+		onFrameHeader(header *h2FrameHeader)
+		onFrame(header *h2FrameHeader, payload []byte)
+		onData(header *h2FrameHeader, chunk []byte)
+	}
+
+	// h2FrameReader decodes the frames sent in one direction of a connection;
+	// decoding stops as soon as segments are lost, as frames cannot be resynchronized.
+	h2FrameReader struct {
+		fromServer bool
+		sequence   tcpSequence
+		// `true` until the connection preface, or the `101 Switching Protocols` response, is consumed
+		awaitingPreface bool
+		broken          bool
+		buf             []byte
+		header          *h2FrameHeader
+		padded          bool
+		dataRemaining   uint32
+		padRemaining    uint32
+		handler         h2FrameHandler
+	}
+)
+
+const (
+	h2FrameData         h2FrameType = 0x0
+	h2FrameHeaders      h2FrameType = 0x1
+	h2FramePriority     h2FrameType = 0x2
+	h2FrameRSTStream    h2FrameType = 0x3
+	h2FrameSettings     h2FrameType = 0x4
+	h2FramePushPromise  h2FrameType = 0x5
+	h2FramePing         h2FrameType = 0x6
+	h2FrameGoAway       h2FrameType = 0x7
+	h2FrameWindowUpdate h2FrameType = 0x8
+	h2FrameContinuation h2FrameType = 0x9
+)
+
+const (
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+)
+
+const (
+	h2FrameHeaderSize = 9
+	// frames other than DATA are buffered until complete; larger ones are not decoded
+	h2MaxBufferedFrame = 1 << 20
+)
+
+var (
+	h2Preface       = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	h2UpgradePrefix = []byte("HTTP/1.1 ")
+)
+
+// see: https://datatracker.ietf.org/doc/html/rfc9113#section-7
+var h2ErrorCodes = []string{
+	"NO_ERROR",
+	"PROTOCOL_ERROR",
+	"INTERNAL_ERROR",
+	"FLOW_CONTROL_ERROR",
+	"SETTINGS_TIMEOUT",
+	"STREAM_CLOSED",
+	"FRAME_SIZE_ERROR",
+	"REFUSED_STREAM",
+	"CANCEL",
+	"COMPRESSION_ERROR",
+	"CONNECT_ERROR",
+	"ENHANCE_YOUR_CALM",
+	"INADEQUATE_SECURITY",
+	"HTTP_1_1_REQUIRED",
+}
+
+func h2ErrorCode(code uint32) string {
+	if int(code) < len(h2ErrorCodes) {
+		return h2ErrorCodes[code]
+	}
+	return fmt.Sprintf("0x%x", code)
+}
+
+func decodeFrameHeader(data []byte) *h2FrameHeader {
+	return &h2FrameHeader{
+		length:   uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2]),
+		typ:      h2FrameType(data[3]),
+		flags:    data[4],
+		streamID: binary.BigEndian.Uint32(data[5:9]) & 0x7fffffff,
+	}
+}
+
+// consumePreface skips the client connection preface, or the `101 Switching Protocols` response
+// sent by servers upgrading to h2c; it returns `nil` if more bytes are required.
+func (r *h2FrameReader) consumePreface() []byte {
+	if r.fromServer {
+		// with prior knowledge, servers start sending frames right away
+		if len(r.buf) < len(h2UpgradePrefix) && bytes.HasPrefix(h2UpgradePrefix, r.buf) {
+			return nil
+		}
+		if !bytes.HasPrefix(r.buf, h2UpgradePrefix) {
+			return r.buf
+		}
+		if idx := bytes.Index(r.buf, headersEnd); idx >= 0 {
+			return r.buf[idx+len(headersEnd):]
+		}
+		return nil
+	}
+	// clients upgrading to h2c send the preface after the upgrade request
+	if idx := bytes.Index(r.buf, h2Preface); idx >= 0 {
+		return r.buf[idx+len(h2Preface):]
+	}
+	return nil
+}
+
+// consume advances the reader using `data`, and returns the bytes which were not consumed.
+func (r *h2FrameReader) consume(data []byte) []byte {
+	if r.awaitingPreface {
+		r.buf = append(r.buf, data...)
+		rest := r.consumePreface()
+		if rest == nil {
+			r.broken = len(r.buf) > httpMaxHeaderSize
+			return nil
+		}
+		r.awaitingPreface = false
+		r.buf = nil
+		return rest
+	}
+
+	if r.header == nil {
+		r.buf = append(r.buf, data...)
+		if len(r.buf) < h2FrameHeaderSize {
+			return nil
+		}
+		r.header = decodeFrameHeader(r.buf)
+		rest := r.buf[h2FrameHeaderSize:]
+		r.buf = nil
+		r.handler.onFrameHeader(r.header)
+		if r.header.typ == h2FrameData {
+			r.padded = r.header.flags&h2FlagPadded != 0
+			r.dataRemaining = r.header.length
+			r.padRemaining = 0
+		} else if r.header.length > h2MaxBufferedFrame {
+			r.broken = true
+			return nil
+		}
+		if r.header.length == 0 {
+			r.completeFrame(nil)
+		}
+		return rest
+	}
+
+	if r.header.typ != h2FrameData {
+		need := int(r.header.length) - len(r.buf)
+		if len(data) < need {
+			r.buf = append(r.buf, data...)
+			return nil
+		}
+		r.buf = append(r.buf, data[:need]...)
+		r.completeFrame(r.buf)
+		return data[need:]
+	}
+
+	// see: https://datatracker.ietf.org/doc/html/rfc9113#section-6.1
+	if r.padded {
+		r.padded = false
+		r.padRemaining = uint32(data[0])
+		if r.padRemaining+1 > r.dataRemaining {
+			r.broken = true
+			return nil
+		}
+		r.dataRemaining -= r.padRemaining + 1
+		data = data[1:]
+	}
+	if n := min(uint32(len(data)), r.dataRemaining); n > 0 {
+		r.handler.onData(r.header, data[:n])
+		r.dataRemaining -= n
+		data = data[n:]
+	}
+	if r.dataRemaining == 0 {
+		n := min(uint32(len(data)), r.padRemaining)
+		r.padRemaining -= n
+		data = data[n:]
+		if r.padRemaining == 0 {
+			r.completeFrame(nil)
+		}
+	}
+	return data
+}
+
+func (r *h2FrameReader) completeFrame(payload []byte) {
+	header := r.header
+	r.header = nil
+	r.buf = nil
+	r.handler.onFrame(header, payload)
+}
+
+func (r *h2FrameReader) feed(segment *payload.Segment) {
+	ok, gap := r.sequence.next(segment)
+	if !ok || r.broken {
+		return
+	}
+	if gap {
+		r.broken = true
+		return
+	}
+	data := segment.Payload
+	for len(data) > 0 && !r.broken {
+		data = r.consume(data)
+	}
+}
+
+func newH2FrameReader(fromServer bool, handler h2FrameHandler) *h2FrameReader {
+	return &h2FrameReader{
+		fromServer:      fromServer,
+		awaitingPreface: true,
+		handler:         handler,
+	}
+}
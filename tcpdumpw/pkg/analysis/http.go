@@ -0,0 +1,249 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+)
+
+type (
+	// HTTPHandler is invoked for every HTTP transaction, once the response is complete or it times out.
+	HTTPHandler func(transaction *HTTPTransaction)
+
+	// HTTPTransaction summarizes an HTTP/1.x request and its response; sizes do not include headers.
+	// `Trace` and `Span` are the Cloud Trace span propagated by the request, if any.
+	HTTPTransaction struct {
+		Iface         string    `json:"iface"`
+		Client        string    `json:"client"`
+		Server        string    `json:"server"`
+		Method        string    `json:"method"`
+		Path          string    `json:"path"`
+		Host          string    `json:"host,omitempty"`
+		Proto         string    `json:"proto"`
+		Status        int       `json:"status,omitempty"`
+		RequestBytes  int64     `json:"request_bytes"`
+		ResponseBytes int64     `json:"response_bytes"`
+		Latency       float64   `json:"latency_ms,omitempty"`
+		TimedOut      bool      `json:"timed_out,omitempty"`
+		Trace         string    `json:"trace,omitempty"`
+		Span          string    `json:"span_id,omitempty"`
+		Timestamp     time.Time `json:"timestamp"`
+	}
+
+	// HTTPAnalyzer reassembles the TCP streams of HTTP/1.x servers listening on the configured ports,
+	// and pairs requests with their responses; it must be fed with TCP segments including their payload.
+	HTTPAnalyzer struct {
+		iface         *string
+		ports         map[uint16]struct{}
+		conns         map[string]*httpConn
+		timeout       time.Duration
+		lastSweep     time.Time
+		onTransaction HTTPHandler
+		// may be `nil`, in which case upgraded connections are not followed
+		onWebSocket WebSocketHandler
+		// may be `nil`, in which case connections are not correlated with the traces of their requests
+		traces *TraceTable
+	}
+
+	// httpConn tracks both directions of a connection; pipelined requests are answered in order.
+	httpConn struct {
+		client   string
+		server   string
+		lastSeen time.Time
+		requests *httpParser
+		response *httpParser
+		pending  []*httpMessage
+		// set when the connection stops carrying HTTP/1.x, i/e: after `101 Switching Protocols`
+		ignored bool
+		// set when the connection is upgraded to WebSocket
+		ws *wsSession
+	}
+)
+
+// the max amount of requests waiting for a response on a single connection
+const httpMaxPending = 128
+
+func (a *HTTPAnalyzer) newTransaction(conn *httpConn, request *httpMessage) *HTTPTransaction {
+	return &HTTPTransaction{
+		Iface:        *a.iface,
+		Client:       conn.client,
+		Server:       conn.server,
+		Method:       request.method,
+		Path:         request.path,
+		Host:         request.host,
+		Proto:        request.proto,
+		RequestBytes: request.bodyBytes,
+		Trace:        request.trace,
+		Span:         request.span,
+		Timestamp:    request.start,
+	}
+}
+
+func (a *HTTPAnalyzer) onRequest(conn *httpConn, request *httpMessage) {
+	// the rest of the connection is correlated with the last traced request
+	if a.traces != nil && request.trace != "" {
+		a.traces.Set(conn.client, conn.server, request.trace, request.span)
+	}
+	if len(conn.pending) >= httpMaxPending {
+		return
+	}
+	conn.pending = append(conn.pending, request)
+}
+
+func (a *HTTPAnalyzer) onResponse(conn *httpConn, response *httpMessage) {
+	// interim responses are followed by the final one, i/e: `100 Continue`
+	if response.status >= 100 && response.status < 200 && response.status != 101 {
+		return
+	}
+	if len(conn.pending) == 0 {
+		return // the request was not captured
+	}
+	request := conn.pending[0]
+	conn.pending = conn.pending[1:]
+
+	transaction := a.newTransaction(conn, request)
+	transaction.Status = response.status
+	transaction.ResponseBytes = response.bodyBytes
+	transaction.Latency = toMillis(response.end.Sub(request.start))
+	a.onTransaction(transaction)
+
+	if response.status == 101 {
+		conn.ignored = true
+		if request.upgrade == "websocket" && a.onWebSocket != nil {
+			conn.ws = a.newWebSocket(conn, request, response)
+		}
+	}
+}
+
+// closeConn reports all the requests of `conn` which were not answered, and its WebSocket session.
+func (a *HTTPAnalyzer) closeConn(conn *httpConn, ended string, ts time.Time) {
+	for _, request := range conn.pending {
+		transaction := a.newTransaction(conn, request)
+		transaction.TimedOut = true
+		a.onTransaction(transaction)
+	}
+	conn.pending = nil
+	if conn.ws != nil {
+		a.endWebSocket(conn.ws, ended, ts)
+		conn.ws = nil
+	}
+}
+
+func (a *HTTPAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < a.timeout {
+		return
+	}
+	a.lastSweep = now
+	for key, conn := range a.conns {
+		if now.Sub(conn.lastSeen) > a.timeout {
+			delete(a.conns, key)
+			a.closeConn(conn, WebSocketEndedIdle, conn.lastSeen)
+		}
+	}
+}
+
+func (a *HTTPAnalyzer) newConn(segment *payload.Segment) *httpConn {
+	conn := &httpConn{
+		client: fmt.Sprintf("%s:%d", segment.SrcIP, segment.SrcPort),
+		server: fmt.Sprintf("%s:%d", segment.DstIP, segment.DstPort),
+	}
+	conn.requests = newHTTPParser(false, nil, func(request *httpMessage) { a.onRequest(conn, request) })
+	conn.response = newHTTPParser(true, conn.nextMethod, func(response *httpMessage) { a.onResponse(conn, response) })
+	return conn
+}
+
+// nextMethod is the method of the request which is being answered; `HEAD` responses have no body.
+func (c *httpConn) nextMethod() string {
+	if len(c.pending) == 0 {
+		return ""
+	}
+	return c.pending[0].method
+}
+
+func (a *HTTPAnalyzer) Analyze(segment *payload.Segment) {
+	a.sweep(segment.Timestamp)
+
+	var key string
+	var fromServer bool
+	if _, ok := a.ports[segment.DstPort]; ok {
+		key = flowKey(segment.SrcIP, segment.SrcPort, segment.DstIP, segment.DstPort)
+	} else if _, ok := a.ports[segment.SrcPort]; ok {
+		key = flowKey(segment.DstIP, segment.DstPort, segment.SrcIP, segment.SrcPort)
+		fromServer = true
+	} else {
+		return
+	}
+
+	conn, ok := a.conns[key]
+	if !ok {
+		// connections are only tracked from the client side, so that requests are seen before responses
+		if fromServer || (!segment.SYN && len(segment.Payload) == 0) {
+			return
+		}
+		conn = a.newConn(segment)
+		a.conns[key] = conn
+	}
+	conn.lastSeen = segment.Timestamp
+
+	if conn.ws != nil {
+		conn.ws.feed(fromServer, segment)
+	} else if !conn.ignored {
+		if fromServer {
+			// frames may be sent right after the `101 Switching Protocols` response
+			if rest := conn.response.feed(segment); conn.ws != nil {
+				conn.ws.server.consume(rest)
+			}
+		} else {
+			conn.requests.feed(segment)
+		}
+	}
+
+	// WebSocket connections may be closed by either peer
+	if segment.RST || ((fromServer || conn.ws != nil) && segment.FIN) {
+		// responses without a length are complete when the server closes the connection
+		if fromServer && segment.FIN {
+			conn.response.close(segment.Timestamp)
+		}
+		delete(a.conns, key)
+		ended := WebSocketEndedFIN
+		if segment.RST {
+			ended = WebSocketEndedReset
+		}
+		a.closeConn(conn, ended, segment.Timestamp)
+	}
+}
+
+// NewHTTPAnalyzer creates an analyzer which logs the HTTP/1.x transactions of the servers listening on `ports`;
+// connections which are not active for `timeout` are discarded, and their requests are reported as timed out.
+// If `onWebSocket` is not `nil`, the frames of connections upgraded to WebSocket are summarized as well;
+// if `traces` is not `nil`, connections are correlated with the Cloud Trace span of their last request.
+func NewHTTPAnalyzer(iface *string, ports []uint16, timeout time.Duration, onTransaction HTTPHandler, onWebSocket WebSocketHandler, traces *TraceTable) *HTTPAnalyzer {
+	portSet := make(map[uint16]struct{}, len(ports))
+	for _, port := range ports {
+		portSet[port] = struct{}{}
+	}
+	return &HTTPAnalyzer{
+		iface:         iface,
+		ports:         portSet,
+		conns:         make(map[string]*httpConn),
+		timeout:       timeout,
+		onTransaction: onTransaction,
+		onWebSocket:   onWebSocket,
+		traces:        traces,
+	}
+}
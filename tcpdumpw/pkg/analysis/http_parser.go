@@ -0,0 +1,307 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+)
+
+type (
+	httpParserState uint8
+
+	// httpMessage is an HTTP/1.x request or response; bodies are not retained, only their size.
+	httpMessage struct {
+		start  time.Time
+		end    time.Time
+		method string
+		path   string
+		proto  string
+		status int
+		host   string
+		// protocol requested by the `Upgrade` header, in lower case
+		upgrade string
+		// Cloud Trace span propagated by the request, if any
+		trace     string
+		span      string
+		bodyBytes int64
+	}
+
+	// httpParser decodes the HTTP/1.x messages sent in one direction of a TCP stream;
+	// segments must be fed in order: retransmissions are skipped, and gaps discard the current message.
+	httpParser struct {
+		isResponse bool
+		state      httpParserState
+		buf        []byte
+		remaining  int64
+		current    *httpMessage
+		sequence   tcpSequence
+		// set once a `101 Switching Protocols` response is decoded: the rest of the stream is not HTTP/1.x
+		switched bool
+		// provides the method of the request being answered, only used by response parsers
+		requestMethod func() string
+		onMessage     func(message *httpMessage)
+	}
+)
+
+const (
+	httpStateHeaders httpParserState = iota
+	httpStateBody
+	httpStateChunkSize
+	httpStateChunkData
+	httpStateTrailers
+	httpStateUntilClose
+)
+
+const (
+	// headers larger than this are not HTTP, or they are not worth reassembling
+	httpMaxHeaderSize = 64 * 1024
+	httpProtoName     = "HTTP/1."
+)
+
+var (
+	crlf       = []byte("\r\n")
+	headersEnd = []byte("\r\n\r\n")
+)
+
+func (p *httpParser) reset() {
+	p.state = httpStateHeaders
+	p.buf = nil
+	p.remaining = 0
+	p.current = nil
+}
+
+func (p *httpParser) complete(ts time.Time) {
+	message := p.current
+	message.end = ts
+	p.reset()
+	p.switched = p.isResponse && message.status == 101
+	p.onMessage(message)
+}
+
+// parseStartLine decodes either a request line, or a status line if the parser is decoding responses.
+func (p *httpParser) parseStartLine(line string) bool {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	if p.isResponse {
+		if !strings.HasPrefix(parts[0], httpProtoName) {
+			return false
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return false
+		}
+		p.current.proto = parts[0]
+		p.current.status = status
+		return true
+	}
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], httpProtoName) {
+		return false
+	}
+	p.current.method = parts[0]
+	p.current.path = parts[1]
+	p.current.proto = parts[2]
+	return true
+}
+
+// parseHeaders decodes the headers of the current message, and selects how its body is delimited.
+func (p *httpParser) parseHeaders(headers []byte) bool {
+	lines := strings.Split(string(headers), "\r\n")
+	if !p.parseStartLine(lines[0]) {
+		return false
+	}
+
+	contentLength := int64(-1)
+	chunked := false
+	for _, line := range lines[1:] {
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "host":
+			p.current.host = value
+		case "upgrade":
+			p.current.upgrade = strings.ToLower(value)
+		case cloudTraceContextHeader:
+			// it takes precedence as it is the one used by Cloud Trace
+			if trace, span, ok := parseTraceHeader(cloudTraceContextHeader, value); ok {
+				p.current.trace, p.current.span = trace, span
+			}
+		case traceparentHeader:
+			if trace, span, ok := parseTraceHeader(traceparentHeader, value); ok && p.current.trace == "" {
+				p.current.trace, p.current.span = trace, span
+			}
+		case "content-length":
+			if length, err := strconv.ParseInt(value, 10, 64); err == nil {
+				contentLength = length
+			}
+		case "transfer-encoding":
+			chunked = strings.Contains(strings.ToLower(value), "chunked")
+		}
+	}
+
+	switch {
+	case p.isResponse && !p.hasResponseBody():
+		p.state = httpStateHeaders
+	case chunked:
+		p.state = httpStateChunkSize
+	case contentLength > 0:
+		p.state = httpStateBody
+		p.remaining = contentLength
+	case contentLength < 0 && p.isResponse:
+		// responses without a length are delimited by the server closing the connection
+		p.state = httpStateUntilClose
+	default:
+		p.state = httpStateHeaders
+	}
+	return true
+}
+
+// see: https://datatracker.ietf.org/doc/html/rfc9112#section-6.3
+func (p *httpParser) hasResponseBody() bool {
+	status := p.current.status
+	if (status >= 100 && status < 200) || status == 204 || status == 304 {
+		return false
+	}
+	return p.requestMethod() != "HEAD"
+}
+
+// consume advances the parser using `data`, and returns the bytes which were not consumed.
+func (p *httpParser) consume(data []byte, ts time.Time) ([]byte, bool) {
+	switch p.state {
+	case httpStateHeaders:
+		if p.current == nil {
+			p.current = &httpMessage{start: ts}
+		}
+		p.buf = append(p.buf, data...)
+		idx := bytes.Index(p.buf, headersEnd)
+		if idx < 0 {
+			return nil, len(p.buf) <= httpMaxHeaderSize
+		}
+		rest := p.buf[idx+len(headersEnd):]
+		if !p.parseHeaders(p.buf[:idx]) {
+			return nil, false
+		}
+		p.buf = nil
+		if p.state == httpStateHeaders {
+			p.complete(ts)
+		}
+		return rest, true
+
+	case httpStateBody, httpStateChunkData:
+		n := min(int64(len(data)), p.remaining)
+		p.remaining -= n
+		if p.state == httpStateBody {
+			p.current.bodyBytes += n
+		}
+		if p.remaining > 0 {
+			return nil, true
+		}
+		if p.state == httpStateBody {
+			p.complete(ts)
+		} else {
+			p.state = httpStateChunkSize
+		}
+		return data[n:], true
+
+	case httpStateChunkSize:
+		p.buf = append(p.buf, data...)
+		idx := bytes.Index(p.buf, crlf)
+		if idx < 0 {
+			return nil, len(p.buf) <= httpMaxHeaderSize
+		}
+		sizeHex, _, _ := strings.Cut(string(p.buf[:idx]), ";") // chunk extensions are ignored
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+		if err != nil || size < 0 {
+			return nil, false
+		}
+		rest := p.buf[idx+len(crlf):]
+		p.buf = nil
+		if size == 0 {
+			p.state = httpStateTrailers
+			return rest, true
+		}
+		p.current.bodyBytes += size
+		p.remaining = size + int64(len(crlf)) // every chunk is terminated by CRLF
+		p.state = httpStateChunkData
+		return rest, true
+
+	case httpStateTrailers:
+		p.buf = append(p.buf, data...)
+		end := -1
+		if bytes.HasPrefix(p.buf, crlf) {
+			end = len(crlf)
+		} else if idx := bytes.Index(p.buf, headersEnd); idx >= 0 {
+			end = idx + len(headersEnd)
+		}
+		if end < 0 {
+			return nil, len(p.buf) <= httpMaxHeaderSize
+		}
+		rest := p.buf[end:]
+		p.complete(ts)
+		return rest, true
+
+	case httpStateUntilClose:
+		p.current.bodyBytes += int64(len(data))
+		return nil, true
+	}
+	return nil, false
+}
+
+// feed decodes the messages in `segment`; once the protocol is switched, it returns the bytes which follow
+// the `101 Switching Protocols` response.
+func (p *httpParser) feed(segment *payload.Segment) []byte {
+	ok, gap := p.sequence.next(segment)
+	if !ok {
+		return nil
+	}
+	if gap {
+		p.reset() // the current message cannot be completed
+	}
+	data := segment.Payload
+	for len(data) > 0 && !p.switched {
+		var ok bool
+		if data, ok = p.consume(data, segment.Timestamp); !ok {
+			// not HTTP/1.x, or a message which cannot be decoded
+			p.reset()
+			return nil
+		}
+	}
+	return data
+}
+
+// close completes responses which are delimited by the server closing the connection.
+func (p *httpParser) close(ts time.Time) {
+	if p.state == httpStateUntilClose && p.current != nil {
+		p.complete(ts)
+	}
+}
+
+func newHTTPParser(isResponse bool, requestMethod func() string, onMessage func(message *httpMessage)) *httpParser {
+	return &httpParser{
+		isResponse:    isResponse,
+		state:         httpStateHeaders,
+		requestMethod: requestMethod,
+		onMessage:     onMessage,
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// ICMPHandler is invoked when an ICMP error is first seen, and then at most once per window
+	// with the amount of identical errors received since the previous event.
+	ICMPHandler func(event *ICMPEvent)
+
+	// ICMPEvent describes ICMP or ICMPv6 errors sent by `Reporter` about packets from `Source` to `Destination`;
+	// `Severity` is either `WARNING` or `ERROR`.
+	ICMPEvent struct {
+		Iface    string `json:"iface"`
+		Type     string `json:"type"`
+		Severity string `json:"severity"`
+		// as translated, i/e: `DestinationUnreachable(Port)`
+		Message  string `json:"message"`
+		ICMPType uint8  `json:"icmp_type"`
+		ICMPCode uint8  `json:"icmp_code"`
+		Reporter string `json:"reporter"`
+		// addresses and protocol of the packet which caused the error; ports are not included
+		// in translated packets, and ICMPv6 messages may not include the original header at all.
+		Source      string    `json:"source,omitempty"`
+		Destination string    `json:"destination,omitempty"`
+		Proto       string    `json:"proto,omitempty"`
+		Count       int       `json:"count"`
+		Timestamp   time.Time `json:"timestamp"`
+	}
+
+	// ICMPAnalyzer is a packet analyzer which summarizes ICMP and ICMPv6 error messages, and attributes
+	// them to the original flow; it must be fed by a Dispatcher.
+	ICMPAnalyzer struct {
+		mu        sync.Mutex
+		iface     *string
+		errors    map[string]*icmpErrors
+		lastSweep time.Time
+		onEvent   ICMPHandler
+	}
+
+	icmpErrors struct {
+		count        int
+		lastReport   time.Time
+		lastActivity time.Time
+	}
+
+	// original IP header embedded into ICMP error messages
+	jsonEmbeddedHeader struct {
+		Src   string          `json:"src"`
+		Dst   string          `json:"dst"`
+		Proto json.RawMessage `json:"proto"`
+	}
+)
+
+const (
+	ICMPUnreachable      = "unreachable"
+	ICMPAdminProhibited  = "admin_prohibited"
+	ICMPTimeExceeded     = "time_exceeded"
+	ICMPPacketTooBig     = "packet_too_big"
+	ICMPParameterProblem = "parameter_problem"
+)
+
+// see: https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xhtml
+var ipProtocolNames = map[uint8]string{
+	1:   "ICMPv4",
+	6:   "TCP",
+	17:  "UDP",
+	58:  "ICMPv6",
+	132: "SCTP",
+}
+
+// classifyICMPv4 returns an empty string if the message is not an error;
+// see: https://www.iana.org/assignments/icmp-parameters/icmp-parameters.xhtml
+func classifyICMPv4(icmpType, code uint8) string {
+	switch icmpType {
+	case 3:
+		switch code {
+		case 4:
+			return ICMPPacketTooBig
+		case 9, 10, 13:
+			return ICMPAdminProhibited
+		}
+		return ICMPUnreachable
+	case 11:
+		return ICMPTimeExceeded
+	case 12:
+		return ICMPParameterProblem
+	}
+	return ""
+}
+
+// classifyICMPv6 returns an empty string if the message is not an error;
+// see: https://www.iana.org/assignments/icmpv6-parameters/icmpv6-parameters.xhtml
+func classifyICMPv6(icmpType, code uint8) string {
+	switch icmpType {
+	case 1:
+		switch code {
+		case 1, 5, 6:
+			return ICMPAdminProhibited
+		}
+		return ICMPUnreachable
+	case 2:
+		return ICMPPacketTooBig
+	case 3:
+		return ICMPTimeExceeded
+	case 4:
+		return ICMPParameterProblem
+	}
+	return ""
+}
+
+// protoName returns the name of the embedded protocol, which is translated either as a name or as a number.
+func (h *jsonEmbeddedHeader) protoName() string {
+	var name string
+	if err := json.Unmarshal(h.Proto, &name); err == nil {
+		return name
+	}
+	var num uint8
+	if err := json.Unmarshal(h.Proto, &num); err != nil {
+		return ""
+	}
+	if name, ok := ipProtocolNames[num]; ok {
+		return name
+	}
+	return strconv.Itoa(int(num))
+}
+
+func (p *Packet) newEvent(kind string) *ICMPEvent {
+	icmp := p.ICMP
+	event := &ICMPEvent{
+		Type:     kind,
+		Severity: "WARNING",
+		Message:  icmp.Msg,
+		ICMPType: icmp.Type,
+		ICMPCode: icmp.Code,
+		Reporter: p.L3.Src,
+	}
+	// errors are sent to the source of the original packet
+	event.Source = p.L3.Dst
+	header := icmp.IPv4
+	if header == nil {
+		header = icmp.IPv6
+	}
+	if header != nil {
+		event.Source, event.Destination, event.Proto = header.Src, header.Dst, header.protoName()
+	}
+	// traffic blocked by firewalls or policies is never going to succeed
+	if kind == ICMPAdminProhibited {
+		event.Severity = "ERROR"
+	}
+	return event
+}
+
+// sweep forgets errors which have not been seen for a while; must be called while holding `a.mu`.
+func (a *ICMPAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < sweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for key, seen := range a.errors {
+		if now.Sub(seen.lastActivity) > anomalyReportWindow {
+			delete(a.errors, key)
+		}
+	}
+}
+
+func (a *ICMPAnalyzer) analyze(packet *Packet) {
+	var kind string
+	if packet.L3.V == 6 {
+		kind = classifyICMPv6(packet.ICMP.Type, packet.ICMP.Code)
+	} else {
+		kind = classifyICMPv4(packet.ICMP.Type, packet.ICMP.Code)
+	}
+	if kind == "" {
+		return
+	}
+
+	ts := packet.timestamp()
+	event := packet.newEvent(kind)
+	event.Iface = *a.iface
+	event.Timestamp = ts
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(ts)
+
+	key := event.Message + "|" + event.Reporter + "|" + event.Proto + "|" + event.Source + "|" + event.Destination
+	seen, ok := a.errors[key]
+	if !ok {
+		seen = &icmpErrors{}
+		a.errors[key] = seen
+	}
+	seen.count += 1
+	seen.lastActivity = ts
+	if ts.Sub(seen.lastReport) < anomalyReportWindow {
+		return
+	}
+	event.Count = seen.count
+	seen.count = 0
+	seen.lastReport = ts
+	a.onEvent(event)
+}
+
+// Analyze summarizes the ICMP errors carried by `packet`; all other packets are ignored.
+func (a *ICMPAnalyzer) Analyze(packet *Packet) {
+	if packet.L3 != nil && packet.ICMP != nil {
+		a.analyze(packet)
+	}
+}
+
+// NewICMPAnalyzer creates an analyzer which summarizes the ICMP errors found in the JSON translated packets captured from `iface`.
+func NewICMPAnalyzer(iface *string, onEvent ICMPHandler) *ICMPAnalyzer {
+	return &ICMPAnalyzer{
+		iface:   iface,
+		errors:  make(map[string]*icmpErrors),
+		onEvent: onEvent,
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// KeyLog holds the secrets which TLS clients and servers write into an `SSLKEYLOGFILE`, using the NSS key log format;
+	// the file is read incrementally as it grows. See: https://datatracker.ietf.org/doc/draft-ietf-tls-keylogfile/
+	KeyLog struct {
+		path     string
+		mu       sync.Mutex
+		offset   int64
+		partial  []byte
+		lastRead time.Time
+		secrets  map[string]*keyLogSecrets
+	}
+
+	// keyLogSecrets are the secrets of a single TLS session, identified by the random of its `ClientHello`
+	keyLogSecrets struct {
+		added time.Time
+		// TLS 1.2 and older
+		masterSecret []byte
+		// TLS 1.3
+		clientHandshake []byte
+		serverHandshake []byte
+		clientTraffic   []byte
+		serverTraffic   []byte
+	}
+)
+
+const (
+	keyLogClientRandom    = "CLIENT_RANDOM"
+	keyLogClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+
+	// the file is read again when secrets are missing, but not more often than this
+	keyLogReadInterval = 100 * time.Millisecond
+	// secrets are only required while sessions are being decrypted
+	keyLogRetention = 1 * time.Hour
+)
+
+func (k *KeyLog) add(line []byte, now time.Time) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 || bytes.HasPrefix(fields[0], []byte("#")) {
+		return
+	}
+	clientRandom, secret := string(bytes.ToLower(fields[1])), make([]byte, hex.DecodedLen(len(fields[2])))
+	if _, err := hex.Decode(secret, fields[2]); err != nil {
+		return
+	}
+
+	secrets, ok := k.secrets[clientRandom]
+	if !ok {
+		secrets = &keyLogSecrets{added: now}
+		k.secrets[clientRandom] = secrets
+	}
+	switch string(fields[0]) {
+	case keyLogClientRandom:
+		secrets.masterSecret = secret
+	case keyLogClientHandshake:
+		secrets.clientHandshake = secret
+	case keyLogServerHandshake:
+		secrets.serverHandshake = secret
+	case keyLogClientTraffic:
+		secrets.clientTraffic = secret
+	case keyLogServerTraffic:
+		secrets.serverTraffic = secret
+	}
+}
+
+// read adds the lines appended since the last read; must be called while holding `k.mu`.
+func (k *KeyLog) read(now time.Time) {
+	k.lastRead = now
+
+	file, err := os.Open(k.path)
+	if err != nil {
+		// the file is created by the APP when it establishes its 1st TLS session
+		return
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err == nil && info.Size() < k.offset {
+		// the file was truncated or replaced
+		k.offset, k.partial = 0, nil
+	}
+	if _, err := file.Seek(k.offset, io.SeekStart); err != nil {
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	k.offset += int64(len(data))
+
+	data = append(k.partial, data...)
+	lines := bytes.Split(data, []byte("\n"))
+	// the last line is still being written unless it is empty
+	k.partial = bytes.Clone(lines[len(lines)-1])
+	for _, line := range lines[:len(lines)-1] {
+		k.add(line, now)
+	}
+
+	for clientRandom, secrets := range k.secrets {
+		if now.Sub(secrets.added) > keyLogRetention {
+			delete(k.secrets, clientRandom)
+		}
+	}
+}
+
+// lookup returns the secrets of the session whose `ClientHello` random is `clientRandom`;
+// the file is read again if they are not known yet, or if they are incomplete.
+func (k *KeyLog) lookup(clientRandom []byte, complete func(*keyLogSecrets) bool) (*keyLogSecrets, bool) {
+	key := hex.EncodeToString(clientRandom)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	secrets, ok := k.secrets[key]
+	if ok && complete(secrets) {
+		return secrets, true
+	}
+	if now := time.Now(); now.Sub(k.lastRead) >= keyLogReadInterval {
+		k.read(now)
+		secrets, ok = k.secrets[key]
+	}
+	return secrets, ok && complete(secrets)
+}
+
+func (k *KeyLog) Path() string {
+	return k.path
+}
+
+// NewKeyLog creates a key log for the `SSLKEYLOGFILE` at `path`, which may not exist yet.
+func NewKeyLog(path string) *KeyLog {
+	return &KeyLog{
+		path:    path,
+		secrets: make(map[string]*keyLogSecrets),
+	}
+}
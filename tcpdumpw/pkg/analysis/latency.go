@@ -0,0 +1,272 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Percentiles summarize the latency samples observed for a destination during a window.
+	Percentiles struct {
+		Count uint64  `json:"count"`
+		P50   float64 `json:"p50_ms"`
+		P90   float64 `json:"p90_ms"`
+		P95   float64 `json:"p95_ms"`
+		P99   float64 `json:"p99_ms"`
+		Max   float64 `json:"max_ms"`
+	}
+
+	// LatencyReport describes the connections established with a destination during a window:
+	// `Handshake` is the SYN to ACK time, `FirstByte` is the time between the 1st client
+	// and server payloads ( time to first byte ), and `TLSHandshake` is the `ClientHello`
+	// to `ServerHello` time.
+	LatencyReport struct {
+		Iface        string       `json:"iface"`
+		Destination  string       `json:"destination"`
+		Start        time.Time    `json:"start"`
+		End          time.Time    `json:"end"`
+		Handshake    *Percentiles `json:"handshake,omitempty"`
+		FirstByte    *Percentiles `json:"first_byte,omitempty"`
+		TLSHandshake *Percentiles `json:"tls_handshake,omitempty"`
+	}
+
+	// LatencyAnalyzer is a packet analyzer which measures TCP handshakes and the time to first byte
+	// of every connection; it must be fed by a Dispatcher.
+	LatencyAnalyzer struct {
+		mu          sync.Mutex
+		iface       *string
+		connections map[string]*connection
+		samples     map[string]*latencySamples
+		windowStart time.Time
+		lastSweep   time.Time
+		// reports of the previous window, which are published as metrics
+		lastReports []*LatencyReport
+	}
+
+	// a connection is identified by its client to server direction
+	connection struct {
+		destination    string
+		synTS          time.Time
+		synAckTS       time.Time
+		established    bool
+		clientDataTS   time.Time
+		measured       bool
+		lastActivityTS time.Time
+	}
+
+	latencySamples struct {
+		handshake    []time.Duration
+		firstByte    []time.Duration
+		tlsHandshake []time.Duration
+	}
+)
+
+// destinations with lots of connections are summarized using the first samples of every window
+const maxLatencySamples = 10000
+
+func reverseFlow(segment *Packet) string {
+	return fmt.Sprintf("%s:%d > %s:%d", segment.L3.Dst, *segment.L4.Dst, segment.L3.Src, *segment.L4.Src)
+}
+
+func (a *LatencyAnalyzer) samplesFor(destination string) *latencySamples {
+	samples, ok := a.samples[destination]
+	if !ok {
+		samples = &latencySamples{}
+		a.samples[destination] = samples
+	}
+	return samples
+}
+
+func appendSample(samples []time.Duration, sample time.Duration) []time.Duration {
+	if len(samples) >= maxLatencySamples {
+		return samples
+	}
+	return append(samples, sample)
+}
+
+// sweep forgets connections which have not been active for a while; must be called while holding `a.mu`.
+func (a *LatencyAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < sweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for key, conn := range a.connections {
+		if now.Sub(conn.lastActivityTS) > flowIdleTimeout {
+			delete(a.connections, key)
+		}
+	}
+}
+
+func (a *LatencyAnalyzer) analyze(segment *Packet) {
+	ts := segment.timestamp()
+	flags := segment.L4.Flags.Map
+	payloadLen := segment.payloadLen()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(ts)
+
+	// SYN: a client is opening a new connection
+	if flags.SYN && !flags.ACK {
+		a.connections[segment.flow()] = &connection{
+			destination:    fmt.Sprintf("%s:%d", segment.L3.Dst, *segment.L4.Dst),
+			synTS:          ts,
+			lastActivityTS: ts,
+		}
+		return
+	}
+
+	// segments sent by the server are keyed by the reverse direction
+	if conn, ok := a.connections[reverseFlow(segment)]; ok {
+		conn.lastActivityTS = ts
+		switch {
+		case flags.SYN && flags.ACK:
+			conn.synAckTS = ts
+		case payloadLen > 0 && !conn.clientDataTS.IsZero() && !conn.measured:
+			conn.measured = true
+			samples := a.samplesFor(conn.destination)
+			samples.firstByte = appendSample(samples.firstByte, ts.Sub(conn.clientDataTS))
+		}
+		return
+	}
+
+	conn, ok := a.connections[segment.flow()]
+	if !ok {
+		return
+	}
+	conn.lastActivityTS = ts
+
+	if flags.RST || flags.FIN {
+		delete(a.connections, segment.flow())
+		return
+	}
+
+	if !conn.established && flags.ACK && !conn.synAckTS.IsZero() {
+		conn.established = true
+		samples := a.samplesFor(conn.destination)
+		samples.handshake = appendSample(samples.handshake, ts.Sub(conn.synTS))
+	}
+
+	if payloadLen > 0 && conn.clientDataTS.IsZero() {
+		conn.clientDataTS = ts
+	}
+}
+
+// Analyze follows TCP segments; all other packets are ignored.
+func (a *LatencyAnalyzer) Analyze(packet *Packet) {
+	if packet.isSegment() {
+		a.analyze(packet)
+	}
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// nearest-rank percentiles; `samples` are sorted in place
+func newPercentiles(samples []time.Duration) *Percentiles {
+	if len(samples) == 0 {
+		return nil
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(samples))+0.5) - 1
+		return samples[max(0, min(i, len(samples)-1))]
+	}
+	return &Percentiles{
+		Count: uint64(len(samples)),
+		P50:   toMillis(rank(0.50)),
+		P90:   toMillis(rank(0.90)),
+		P95:   toMillis(rank(0.95)),
+		P99:   toMillis(rank(0.99)),
+		Max:   toMillis(samples[len(samples)-1]),
+	}
+}
+
+// AddTLSHandshake records the time between a `ClientHello` sent to `destination` and its `ServerHello`.
+func (a *LatencyAnalyzer) AddTLSHandshake(destination string, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	samples := a.samplesFor(destination)
+	samples.tlsHandshake = appendSample(samples.tlsHandshake, latency)
+}
+
+// Report returns the latency percentiles for every destination observed since the previous report.
+func (a *LatencyAnalyzer) Report() []*LatencyReport {
+	a.mu.Lock()
+	samples := a.samples
+	start, end := a.windowStart, time.Now()
+	a.samples = make(map[string]*latencySamples)
+	a.windowStart = end
+	a.mu.Unlock()
+
+	reports := make([]*LatencyReport, 0, len(samples))
+	for destination, destinationSamples := range samples {
+		reports = append(reports, &LatencyReport{
+			Iface:        *a.iface,
+			Destination:  destination,
+			Start:        start,
+			End:          end,
+			Handshake:    newPercentiles(destinationSamples.handshake),
+			FirstByte:    newPercentiles(destinationSamples.firstByte),
+			TLSHandshake: newPercentiles(destinationSamples.tlsHandshake),
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Destination < reports[j].Destination })
+
+	a.mu.Lock()
+	a.lastReports = reports
+	a.mu.Unlock()
+
+	return reports
+}
+
+// LastReports returns the reports of the previous window, ordered by the amount of samples;
+// at most `limit` reports are returned, so that busy services do not create too many time series.
+func (a *LatencyAnalyzer) LastReports(limit int) []*LatencyReport {
+	a.mu.Lock()
+	reports := slices.Clone(a.lastReports)
+	a.mu.Unlock()
+
+	count := func(report *LatencyReport) uint64 {
+		total := uint64(0)
+		for _, percentiles := range []*Percentiles{report.Handshake, report.FirstByte, report.TLSHandshake} {
+			if percentiles != nil {
+				total += percentiles.Count
+			}
+		}
+		return total
+	}
+	sort.SliceStable(reports, func(i, j int) bool { return count(reports[i]) > count(reports[j]) })
+	return reports[:min(limit, len(reports))]
+}
+
+// NewLatencyAnalyzer creates an analyzer which measures TCP handshakes and time to first byte
+// for all the connections found in the JSON translated packets captured from `iface`.
+func NewLatencyAnalyzer(iface *string) *LatencyAnalyzer {
+	return &LatencyAnalyzer{
+		iface:       iface,
+		connections: make(map[string]*connection),
+		samples:     make(map[string]*latencySamples),
+		windowStart: time.Now(),
+	}
+}
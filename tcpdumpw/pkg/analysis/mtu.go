@@ -0,0 +1,316 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// MTUHandler is invoked for every MTU related problem, at most once per window for the same flow.
+	MTUHandler func(event *MTUEvent)
+
+	// MTUEvent describes fragmented traffic, path MTU signals, or segments which are too big to reach their destination;
+	// `Severity` is either `WARNING` or `ERROR`.
+	MTUEvent struct {
+		Iface       string `json:"iface"`
+		Type        string `json:"type"`
+		Severity    string `json:"severity"`
+		Source      string `json:"source,omitempty"`
+		Destination string `json:"destination,omitempty"`
+		// address of the router which reported that the packet is too big
+		Router    string    `json:"router,omitempty"`
+		MSS       uint16    `json:"mss,omitempty"`
+		Count     int       `json:"count,omitempty"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	// MTUAnalyzer is a packet analyzer which detects IP fragmentation, ICMP "fragmentation needed" messages,
+	// clamped MSS announcements and path MTU blackholes; it must be fed by a Dispatcher.
+	MTUAnalyzer struct {
+		mu        sync.Mutex
+		iface     *string
+		mtu       int
+		flows     map[string]*mtuFlow
+		fragments map[string]*fragmentCount
+		reported  map[string]time.Time
+		lastSweep time.Time
+		onEvent   MTUHandler
+	}
+
+	// state of a single direction of a TCP connection
+	mtuFlow struct {
+		// MSS announced by the receiver of this direction
+		mss          uint16
+		fullSeq      uint32
+		hasFullSeq   bool
+		retransmits  int
+		reported     bool
+		lastActivity time.Time
+	}
+
+	fragmentCount struct {
+		count        int
+		lastReport   time.Time
+		lastActivity time.Time
+	}
+)
+
+const (
+	MTUFragmented          = "fragmented"
+	MTUFragmentationNeeded = "fragmentation_needed"
+	MTUClampedMSS          = "mss_clamped"
+	MTUBlackhole           = "pmtu_blackhole"
+)
+
+const (
+	// full sized segments retransmitted this many times without being acknowledged are considered to be lost
+	blackholeRetransmits = 3
+	ipv6FragmentHeader   = 44
+	icmp4Unreachable     = 3
+	icmp4FragNeeded      = 4
+	icmp6PacketTooBig    = 2
+	// IPv4 and TCP headers without options
+	ipv4TCPHeaders = 40
+	ipv6TCPHeaders = 60
+)
+
+func (p *Packet) isFragment() bool {
+	if p.L3.V == 6 {
+		return p.L3.Proto.Num == ipv6FragmentHeader
+	}
+	return p.L3.Foff > 0 || slices.Contains(p.L3.Flags, "MF")
+}
+
+// mss returns the value of the MSS option, which is translated as: `{"MSS":["1460","0x05b4"]}`.
+func (p *Packet) mss() (uint16, bool) {
+	for _, opt := range p.L4.Opts {
+		values := map[string][]string{}
+		if err := json.Unmarshal(opt, &values); err != nil {
+			continue
+		}
+		if mss, ok := values["MSS"]; ok && len(mss) > 0 {
+			value, err := strconv.ParseUint(mss[0], 10, 16)
+			return uint16(value), err == nil
+		}
+	}
+	return 0, false
+}
+
+func (a *MTUAnalyzer) emit(kind, severity string, ts time.Time, configure func(event *MTUEvent)) {
+	event := &MTUEvent{
+		Iface:     *a.iface,
+		Type:      kind,
+		Severity:  severity,
+		Timestamp: ts,
+	}
+	configure(event)
+	a.onEvent(event)
+}
+
+// shouldReport deduplicates events for the same `key`; must be called while holding `a.mu`.
+func (a *MTUAnalyzer) shouldReport(key string, ts time.Time) bool {
+	if last, ok := a.reported[key]; ok && ts.Sub(last) < anomalyReportWindow {
+		return false
+	}
+	a.reported[key] = ts
+	return true
+}
+
+// sweep forgets idle flows and expired reports; must be called while holding `a.mu`.
+func (a *MTUAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < sweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for key, state := range a.flows {
+		if now.Sub(state.lastActivity) > flowIdleTimeout {
+			delete(a.flows, key)
+		}
+	}
+	for key, fragments := range a.fragments {
+		if now.Sub(fragments.lastActivity) > anomalyReportWindow {
+			delete(a.fragments, key)
+		}
+	}
+	for key, last := range a.reported {
+		if now.Sub(last) > anomalyReportWindow {
+			delete(a.reported, key)
+		}
+	}
+}
+
+// checkFragment reports fragmented traffic between 2 hosts when it is first seen, and then once per window.
+func (a *MTUAnalyzer) checkFragment(packet *Packet, ts time.Time) {
+	key := packet.L3.Src + " > " + packet.L3.Dst
+	fragments, ok := a.fragments[key]
+	if !ok {
+		fragments = &fragmentCount{}
+		a.fragments[key] = fragments
+	}
+	fragments.count += 1
+	fragments.lastActivity = ts
+	if ts.Sub(fragments.lastReport) < anomalyReportWindow {
+		return
+	}
+	count := fragments.count
+	fragments.count = 0
+	fragments.lastReport = ts
+	a.emit(MTUFragmented, "WARNING", ts, func(event *MTUEvent) {
+		event.Source = packet.L3.Src
+		event.Destination = packet.L3.Dst
+		event.Count = count
+	})
+}
+
+func (a *MTUAnalyzer) checkICMP(packet *Packet, ts time.Time) {
+	icmp := packet.ICMP
+	isFragNeeded := packet.L3.V == 4 && icmp.Type == icmp4Unreachable && icmp.Code == icmp4FragNeeded
+	isTooBig := packet.L3.V == 6 && icmp.Type == icmp6PacketTooBig
+	if !isFragNeeded && !isTooBig {
+		return
+	}
+	// ICMPv6 "packet too big" messages are translated without the original header
+	source, destination := packet.L3.Dst, ""
+	if icmp.IPv4 != nil {
+		source, destination = icmp.IPv4.Src, icmp.IPv4.Dst
+	}
+	if !a.shouldReport(MTUFragmentationNeeded+"|"+source+"|"+destination, ts) {
+		return
+	}
+	a.emit(MTUFragmentationNeeded, "WARNING", ts, func(event *MTUEvent) {
+		event.Source = source
+		event.Destination = destination
+		event.Router = packet.L3.Src
+	})
+}
+
+// localMSS is the largest MSS allowed by the MTU of the interface, or 0 if it is unknown.
+func (a *MTUAnalyzer) localMSS(version uint8) uint16 {
+	if a.mtu <= 0 {
+		return 0
+	}
+	if version == 6 {
+		return uint16(max(0, a.mtu-ipv6TCPHeaders))
+	}
+	return uint16(max(0, a.mtu-ipv4TCPHeaders))
+}
+
+func (a *MTUAnalyzer) flowState(key string, ts time.Time) *mtuFlow {
+	state, ok := a.flows[key]
+	if !ok {
+		state = &mtuFlow{}
+		a.flows[key] = state
+	}
+	state.lastActivity = ts
+	return state
+}
+
+func (a *MTUAnalyzer) checkSegment(packet *Packet, ts time.Time) {
+	l3, l4 := packet.L3, packet.L4
+	source := fmt.Sprintf("%s:%d", l3.Src, *l4.Src)
+	destination := fmt.Sprintf("%s:%d", l3.Dst, *l4.Dst)
+
+	if l4.Flags.Map.SYN {
+		mss, ok := packet.mss()
+		if !ok {
+			return
+		}
+		// the MSS announced by one side limits the segments sent by the other one
+		a.flowState(flowKey(l3.Dst, *l4.Dst, l3.Src, *l4.Src), ts).mss = mss
+		if localMSS := a.localMSS(l3.V); mss < localMSS && a.shouldReport(MTUClampedMSS+"|"+l3.Src, ts) {
+			a.emit(MTUClampedMSS, "WARNING", ts, func(event *MTUEvent) {
+				event.Source = source
+				event.Destination = destination
+				event.MSS = mss
+			})
+		}
+		return
+	}
+
+	state, ok := a.flows[flowKey(l3.Src, *l4.Src, l3.Dst, *l4.Dst)]
+	if !ok || state.mss == 0 || l4.Seq == nil {
+		return
+	}
+	state.lastActivity = ts
+
+	payloadLen, _ := strconv.ParseUint(l4.Len, 10, 32)
+	if payloadLen < uint64(state.mss) {
+		return
+	}
+
+	// full sized segments which are sent over and over again never made it through the path
+	if state.hasFullSeq && state.fullSeq == *l4.Seq {
+		state.retransmits += 1
+	} else {
+		state.fullSeq = *l4.Seq
+		state.hasFullSeq = true
+		state.retransmits = 0
+	}
+	if state.retransmits < blackholeRetransmits || state.reported {
+		return
+	}
+	state.reported = true
+	a.emit(MTUBlackhole, "ERROR", ts, func(event *MTUEvent) {
+		event.Source = source
+		event.Destination = destination
+		event.MSS = state.mss
+		event.Count = state.retransmits
+	})
+}
+
+func (a *MTUAnalyzer) analyze(packet *Packet) {
+	ts := packet.timestamp()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(ts)
+
+	if packet.isFragment() {
+		a.checkFragment(packet, ts)
+	}
+	if packet.ICMP != nil {
+		a.checkICMP(packet, ts)
+	}
+	if packet.isSegment() {
+		a.checkSegment(packet, ts)
+	}
+}
+
+// Analyze looks for MTU problems in any IP packet.
+func (a *MTUAnalyzer) Analyze(packet *Packet) {
+	if packet.L3 != nil {
+		a.analyze(packet)
+	}
+}
+
+// NewMTUAnalyzer creates an analyzer which detects MTU problems in the JSON translated packets captured from `iface`;
+// `mtu` is the MTU of the interface, used to detect clamped MSS announcements; 0 if it is unknown.
+func NewMTUAnalyzer(iface *string, mtu int, onEvent MTUHandler) *MTUAnalyzer {
+	return &MTUAnalyzer{
+		iface:     iface,
+		mtu:       mtu,
+		flows:     make(map[string]*mtuFlow),
+		fragments: make(map[string]*fragmentCount),
+		reported:  make(map[string]time.Time),
+		onEvent:   onEvent,
+	}
+}
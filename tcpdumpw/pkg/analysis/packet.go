@@ -0,0 +1,183 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type (
+	// Packet contains the fields of JSON translated packets used by all analyzers; it is decoded only once by the
+	// Dispatcher, and shared by all analyzers, which must not modify it.
+	Packet struct {
+		Timestamp *struct {
+			Seconds int64 `json:"seconds"`
+			Nanos   int64 `json:"nanos"`
+		} `json:"timestamp"`
+		L3 *struct {
+			V     uint8    `json:"v"`
+			Src   string   `json:"src"`
+			Dst   string   `json:"dst"`
+			Len   uint64   `json:"len"`
+			Flags []string `json:"flags"`
+			Foff  uint16   `json:"foff"`
+			Proto struct {
+				Num  uint8  `json:"num"`
+				Name string `json:"name"`
+			} `json:"proto"`
+		} `json:"L3"`
+		L4 *struct {
+			Src   *uint16 `json:"src"`
+			Dst   *uint16 `json:"dst"`
+			Seq   *uint32 `json:"seq"`
+			Ack   uint32  `json:"ack"`
+			Win   uint16  `json:"win"`
+			Len   string  `json:"len"`
+			Flags struct {
+				Map jsonTCPFlags `json:"map"`
+			} `json:"flags"`
+			Opts []json.RawMessage `json:"opts"`
+		} `json:"L4"`
+		ICMP *struct {
+			Type uint8  `json:"type"`
+			Code uint8  `json:"code"`
+			Msg  string `json:"msg"`
+			// header of the packet which could not be delivered
+			IPv4 *jsonEmbeddedHeader `json:"IPv4"`
+			IPv6 *jsonEmbeddedHeader `json:"IPv6"`
+		} `json:"ICMP"`
+		DNS *struct {
+			ID           uint16         `json:"id"`
+			ResponseCode string         `json:"response_code"`
+			Questions    []*DNSQuestion `json:"questions"`
+			Answers      []*DNSAnswer   `json:"answers"`
+		} `json:"DNS"`
+	}
+
+	// jsonTCPFlags are only set for TCP segments
+	jsonTCPFlags struct {
+		FIN bool `json:"FIN"`
+		SYN bool `json:"SYN"`
+		RST bool `json:"RST"`
+		PSH bool `json:"PSH"`
+		ACK bool `json:"ACK"`
+		URG bool `json:"URG"`
+		ECE bool `json:"ECE"`
+		CWR bool `json:"CWR"`
+	}
+
+	// PacketAnalyzer is fed by a Dispatcher with every JSON translated packet.
+	PacketAnalyzer interface {
+		Analyze(packet *Packet)
+	}
+
+	// Dispatcher is a PCAP writer which decodes every JSON translated packet once, and feeds it into all its analyzers;
+	// it must be fed with the same JSON translated packets written into all other writers.
+	Dispatcher struct {
+		iface     *string
+		analyzers []PacketAnalyzer
+	}
+)
+
+func (p *Packet) timestamp() time.Time {
+	if p.Timestamp == nil {
+		return time.Now()
+	}
+	return time.Unix(p.Timestamp.Seconds, p.Timestamp.Nanos)
+}
+
+// `len` is the size of the TCP payload, and it is translated as a string
+func (p *Packet) payloadLen() uint64 {
+	payloadLen, _ := strconv.ParseUint(p.L4.Len, 10, 32)
+	return payloadLen
+}
+
+func flowKey(srcIP string, srcPort uint16, dstIP string, dstPort uint16) string {
+	return fmt.Sprintf("%s:%d > %s:%d", srcIP, srcPort, dstIP, dstPort)
+}
+
+// flow must only be used with TCP segments.
+func (p *Packet) flow() string {
+	return flowKey(p.L3.Src, *p.L4.Src, p.L3.Dst, *p.L4.Dst)
+}
+
+// Ports returns the ports of TCP segments and UDP datagrams; they are 0 for all other packets.
+func (p *Packet) Ports() (uint16, uint16) {
+	var src, dst uint16
+	if p.L4 != nil && p.L4.Src != nil {
+		src = *p.L4.Src
+	}
+	if p.L4 != nil && p.L4.Dst != nil {
+		dst = *p.L4.Dst
+	}
+	return src, dst
+}
+
+// isSegment reports whether `p` is a TCP segment: only TCP segments carry sequence numbers.
+func (p *Packet) isSegment() bool {
+	return p.L3 != nil && p.L4 != nil && p.L4.Seq != nil && p.L4.Src != nil && p.L4.Dst != nil
+}
+
+// bits returns the flags in the order of `tcpFlagNames`.
+func (f *jsonTCPFlags) bits() uint8 {
+	var bits uint8
+	for i, set := range []bool{f.FIN, f.SYN, f.RST, f.PSH, f.ACK, f.URG, f.ECE, f.CWR} {
+		if set {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+// decodePacket returns `false` if `p` is not a JSON translated packet.
+func decodePacket(p []byte) (*Packet, bool) {
+	packet := &Packet{}
+	if err := json.Unmarshal(bytes.TrimSpace(p), packet); err != nil {
+		return nil, false
+	}
+	return packet, true
+}
+
+func (d *Dispatcher) Write(p []byte) (int, error) {
+	if packet, ok := decodePacket(p); ok {
+		for _, analyzer := range d.analyzers {
+			analyzer.Analyze(packet)
+		}
+	}
+	return len(p), nil
+}
+
+func (d *Dispatcher) Close() error {
+	return nil
+}
+
+func (d *Dispatcher) Rotate() {}
+
+func (d *Dispatcher) IsStdOutOrErr() bool {
+	return false
+}
+
+func (d *Dispatcher) GetIface() *string {
+	return d.iface
+}
+
+// NewDispatcher creates a writer which feeds the JSON translated packets captured from `iface` into `analyzers`.
+func NewDispatcher(iface *string, analyzers ...PacketAnalyzer) *Dispatcher {
+	return &Dispatcher{iface: iface, analyzers: analyzers}
+}
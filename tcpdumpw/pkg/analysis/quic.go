@@ -0,0 +1,394 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"cmp"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+)
+
+type (
+	// QUICHandler is invoked when the `ClientHello` of a QUIC connection is decoded, and when a connection migrates.
+	QUICHandler func(record *QUICRecord)
+
+	// QUICRecord describes a QUIC connection using the `ClientHello` carried by the Initial packets of the client;
+	// `Type` is either `initial` or `migration`, in which case `Client` is the new address of the client.
+	QUICRecord struct {
+		Iface   string   `json:"iface"`
+		Type    string   `json:"type"`
+		Client  string   `json:"client"`
+		Server  string   `json:"server"`
+		Version string   `json:"version"`
+		SNI     string   `json:"sni,omitempty"`
+		ALPN    []string `json:"alpn,omitempty"`
+		JA4     string   `json:"ja4,omitempty"`
+		// original Destination Connection ID chosen by the client, and Source Connection IDs of both peers
+		DCID       string    `json:"dcid"`
+		ClientCID  string    `json:"client_cid,omitempty"`
+		ServerCID  string    `json:"server_cid,omitempty"`
+		Migrations int       `json:"migrations,omitempty"`
+		Timestamp  time.Time `json:"timestamp"`
+	}
+
+	// TrafficSplit is the amount of QUIC and TCP traffic exchanged with a destination;
+	// bytes are transport payload bytes, so that both protocols are comparable.
+	TrafficSplit struct {
+		Destination string `json:"destination"`
+		QUICPackets uint64 `json:"quic_packets"`
+		QUICBytes   uint64 `json:"quic_bytes"`
+		TCPPackets  uint64 `json:"tcp_packets"`
+		TCPBytes    uint64 `json:"tcp_bytes"`
+	}
+
+	// QUICAnalyzer decodes the `ClientHello` of QUIC connections, follows their connection IDs, and splits
+	// the traffic of every destination between QUIC and TCP; it must be fed with UDP datagrams and TCP segments
+	// including their payload, see `payload.Engine`.
+	QUICAnalyzer struct {
+		iface       *string
+		connections map[string]*quicConnection
+		// connections are found by connection ID, or by addresses if the connection ID is not known
+		cids       map[string]*quicConnection
+		cidLengths map[int]struct{}
+		timeout    time.Duration
+		lastSweep  time.Time
+		onRecord   QUICHandler
+		// the traffic split is read while packets are being analyzed
+		splitMu sync.Mutex
+		split   map[string]*TrafficSplit
+	}
+
+	quicConnection struct {
+		record       *QUICRecord
+		flow         string
+		serverIP     string
+		serverPort   uint16
+		keys         *quicInitialKeys
+		fragments    []*cryptoFragment
+		cryptoSize   int
+		helloDone    bool
+		cids         []string
+		lastActivity time.Time
+	}
+)
+
+const (
+	QUICInitial   = "initial"
+	QUICMigration = "migration"
+)
+
+const (
+	// clients must choose an original Destination Connection ID of at least 8 bytes
+	quicMinInitialDCIDSize = 8
+	// `ClientHello` messages larger than this are not reassembled
+	quicMaxCryptoSize = 16384
+
+	maxQUICConnections = 10000
+	// destinations beyond this amount are aggregated, so that the traffic split has a bounded cardinality
+	maxSplitDestinations   = 100
+	otherSplitDestinations = "other"
+)
+
+func quicVersionName(version uint32) string {
+	switch version {
+	case quicVersion1:
+		return "QUICv1"
+	case quicVersion2:
+		return "QUICv2"
+	}
+	return fmt.Sprintf("0x%08x", version)
+}
+
+func (c *quicConnection) isServer(ip string, port uint16) bool {
+	return ip == c.serverIP && port == c.serverPort
+}
+
+// countSplit adds a packet exchanged with `destination` into the traffic split.
+func (a *QUICAnalyzer) countSplit(destination string, quic bool, size int) {
+	a.splitMu.Lock()
+	defer a.splitMu.Unlock()
+
+	if _, ok := a.split[destination]; !ok && len(a.split) >= maxSplitDestinations {
+		destination = otherSplitDestinations
+	}
+	split, ok := a.split[destination]
+	if !ok {
+		split = &TrafficSplit{Destination: destination}
+		a.split[destination] = split
+	}
+	if quic {
+		split.QUICPackets += 1
+		split.QUICBytes += uint64(size)
+	} else {
+		split.TCPPackets += 1
+		split.TCPBytes += uint64(size)
+	}
+}
+
+// TakeSplit returns the QUIC and TCP traffic exchanged with every destination since the previous invocation,
+// sorted by the total amount of bytes.
+func (a *QUICAnalyzer) TakeSplit() []*TrafficSplit {
+	a.splitMu.Lock()
+	split := a.split
+	a.split = make(map[string]*TrafficSplit)
+	a.splitMu.Unlock()
+
+	splits := make([]*TrafficSplit, 0, len(split))
+	for _, destination := range split {
+		splits = append(splits, destination)
+	}
+	slices.SortFunc(splits, func(a, b *TrafficSplit) int {
+		return cmp.Compare(b.QUICBytes+b.TCPBytes, a.QUICBytes+a.TCPBytes)
+	})
+	return splits
+}
+
+// sweep forgets connections which are idle, and stops decoding `ClientHello` messages which are not completed.
+func (a *QUICAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < sweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for flow, connection := range a.connections {
+		if now.Sub(connection.lastActivity) > flowIdleTimeout {
+			delete(a.connections, flow)
+			for _, cid := range connection.cids {
+				delete(a.cids, cid)
+			}
+			continue
+		}
+		if !connection.helloDone && now.Sub(connection.record.Timestamp) > a.timeout {
+			connection.helloDone = true
+			connection.keys, connection.fragments = nil, nil
+		}
+	}
+}
+
+func (a *QUICAnalyzer) addCID(connection *quicConnection, cid []byte) {
+	if len(cid) == 0 {
+		return
+	}
+	key := string(cid)
+	if _, ok := a.cids[key]; ok {
+		return
+	}
+	a.cids[key] = connection
+	a.cidLengths[len(cid)] = struct{}{}
+	connection.cids = append(connection.cids, key)
+}
+
+func (a *QUICAnalyzer) newConnection(datagram *payload.Datagram, header *quicLongHeader) *quicConnection {
+	if len(a.connections) >= maxQUICConnections || len(header.dcid) < quicMinInitialDCIDSize {
+		return nil
+	}
+	keys, err := newClientInitialKeys(header.version, header.dcid)
+	if err != nil {
+		return nil
+	}
+	flow := flowKey(datagram.SrcIP, datagram.SrcPort, datagram.DstIP, datagram.DstPort)
+	connection := &quicConnection{
+		record: &QUICRecord{
+			Iface:     *a.iface,
+			Type:      QUICInitial,
+			Client:    fmt.Sprintf("%s:%d", datagram.SrcIP, datagram.SrcPort),
+			Server:    fmt.Sprintf("%s:%d", datagram.DstIP, datagram.DstPort),
+			Version:   quicVersionName(header.version),
+			DCID:      hex.EncodeToString(header.dcid),
+			ClientCID: hex.EncodeToString(header.scid),
+			Timestamp: datagram.Timestamp,
+		},
+		flow:       flow,
+		serverIP:   datagram.DstIP,
+		serverPort: datagram.DstPort,
+		keys:       keys,
+	}
+	a.connections[flow] = connection
+	a.addCID(connection, header.dcid)
+	a.addCID(connection, header.scid)
+	return connection
+}
+
+// find returns the connection of a datagram using its connection ID, or its addresses.
+func (a *QUICAnalyzer) find(datagram *payload.Datagram, dcid []byte) *quicConnection {
+	if connection, ok := a.cids[string(dcid)]; ok && len(dcid) > 0 {
+		return connection
+	}
+	if connection, ok := a.connections[flowKey(datagram.SrcIP, datagram.SrcPort, datagram.DstIP, datagram.DstPort)]; ok {
+		return connection
+	}
+	return a.connections[flowKey(datagram.DstIP, datagram.DstPort, datagram.SrcIP, datagram.SrcPort)]
+}
+
+// findShort returns the connection of a short header packet, whose connection ID size is only known by its peers.
+func (a *QUICAnalyzer) findShort(datagram *payload.Datagram) *quicConnection {
+	for size := range a.cidLengths {
+		if len(datagram.Payload) > size {
+			if connection, ok := a.cids[string(datagram.Payload[1:1+size])]; ok {
+				return connection
+			}
+		}
+	}
+	return a.find(datagram, nil)
+}
+
+// migrate follows a connection whose client address changed, i/e: because of NAT rebinding.
+func (a *QUICAnalyzer) migrate(connection *quicConnection, datagram *payload.Datagram) {
+	record := connection.record
+	client := fmt.Sprintf("%s:%d", datagram.SrcIP, datagram.SrcPort)
+	if !connection.isServer(datagram.DstIP, datagram.DstPort) || client == record.Client {
+		// packets sent by the server, which follows the client only after validating its new address
+		return
+	}
+
+	delete(a.connections, connection.flow)
+	connection.flow = flowKey(datagram.SrcIP, datagram.SrcPort, datagram.DstIP, datagram.DstPort)
+	a.connections[connection.flow] = connection
+
+	record.Client = client
+	record.Migrations += 1
+	migration := *record
+	migration.Type = QUICMigration
+	migration.Timestamp = datagram.Timestamp
+	a.onRecord(&migration)
+}
+
+// decodeInitial adds the CRYPTO frames of a client Initial packet, until the `ClientHello` is complete.
+func (a *QUICAnalyzer) decodeInitial(connection *quicConnection, packet []byte, header *quicLongHeader) {
+	frames, ok := connection.keys.open(packet, header)
+	if !ok {
+		return
+	}
+	fragments, ok := readCryptoFrames(frames)
+	if !ok {
+		return
+	}
+	for _, fragment := range fragments {
+		connection.cryptoSize += len(fragment.data)
+	}
+	connection.fragments = append(connection.fragments, fragments...)
+	if connection.cryptoSize > quicMaxCryptoSize {
+		connection.helloDone = true
+		connection.keys, connection.fragments = nil, nil
+		return
+	}
+
+	msgType, body, ok := assembleCrypto(connection.fragments)
+	if !ok {
+		return
+	}
+	connection.helloDone = true
+	connection.keys, connection.fragments = nil, nil
+	if msgType != tlsHandshakeClientHello {
+		return
+	}
+	hello, ok := parseClientHello(body)
+	if !ok {
+		return
+	}
+
+	record := connection.record
+	record.SNI = hello.serverName
+	record.ALPN = hello.alpn
+	// QUIC clients are fingerprinted as TLS clients, using `q` as the protocol
+	record.JA4 = "q" + hello.ja4()[1:]
+	a.onRecord(record)
+}
+
+// analyzeLongHeader goes through all the long header packets coalesced into a datagram.
+func (a *QUICAnalyzer) analyzeLongHeader(datagram *payload.Datagram) *quicConnection {
+	var connection *quicConnection
+	data := datagram.Payload
+	for isQUICLongHeader(data) {
+		header, ok := parseQUICLongHeader(data)
+		if !ok || !isKnownQUICVersion(header.version) {
+			break
+		}
+
+		if connection == nil {
+			connection = a.find(datagram, header.dcid)
+		}
+		if connection == nil && header.packetType == quicPacketInitial {
+			connection = a.newConnection(datagram, header)
+		}
+		if connection == nil {
+			break
+		}
+
+		fromClient := connection.isServer(datagram.DstIP, datagram.DstPort)
+		if !fromClient && connection.record.ServerCID == "" && len(header.scid) > 0 {
+			// servers choose their own connection ID, which is then used by clients in short header packets
+			connection.record.ServerCID = hex.EncodeToString(header.scid)
+			a.addCID(connection, header.scid)
+		}
+		if fromClient && header.packetType == quicPacketInitial && !connection.helloDone {
+			a.decodeInitial(connection, data, header)
+		}
+
+		if header.packetType == quicPacketRetry || header.size >= len(data) {
+			break
+		}
+		data = data[header.size:]
+	}
+	return connection
+}
+
+// AnalyzeDatagram identifies QUIC packets; UDP datagrams which do not belong to a QUIC connection are ignored.
+func (a *QUICAnalyzer) AnalyzeDatagram(datagram *payload.Datagram) {
+	a.sweep(datagram.Timestamp)
+
+	var connection *quicConnection
+	if isQUICLongHeader(datagram.Payload) {
+		connection = a.analyzeLongHeader(datagram)
+	} else if isQUICShortHeader(datagram.Payload) {
+		connection = a.findShort(datagram)
+	}
+	if connection == nil {
+		return
+	}
+
+	connection.lastActivity = datagram.Timestamp
+	a.migrate(connection, datagram)
+
+	a.countSplit(connection.serverIP, true, len(datagram.Payload))
+}
+
+// Analyze accounts TCP segments into the traffic split; the destination is assumed to be the peer using the lowest port.
+func (a *QUICAnalyzer) Analyze(segment *payload.Segment) {
+	destination := segment.DstIP
+	if segment.SrcPort < segment.DstPort {
+		destination = segment.SrcIP
+	}
+	a.countSplit(destination, false, len(segment.Payload))
+}
+
+// NewQUICAnalyzer creates an analyzer which extracts the SNI, ALPN and JA4 fingerprint of the QUIC connections
+// captured from `iface`, and splits traffic between QUIC and TCP; `ClientHello` messages which are not completed
+// within `timeout` are not decoded.
+func NewQUICAnalyzer(iface *string, timeout time.Duration, onRecord QUICHandler) *QUICAnalyzer {
+	return &QUICAnalyzer{
+		iface:       iface,
+		connections: make(map[string]*quicConnection),
+		cids:        make(map[string]*quicConnection),
+		cidLengths:  make(map[int]struct{}),
+		timeout:     timeout,
+		onRecord:    onRecord,
+		split:       make(map[string]*TrafficSplit),
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"io"
+	"slices"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+type (
+	// quicLongHeader is the cleartext part of QUIC long header packets;
+	// see: https://www.rfc-editor.org/rfc/rfc9000.html#name-long-header-packets
+	quicLongHeader struct {
+		version    uint32
+		packetType uint8
+		dcid       []byte
+		scid       []byte
+		// offset of the packet number, only available for Initial, 0-RTT and Handshake packets
+		pnOffset int
+		// size of the whole packet, used to find the next packet coalesced in the same datagram
+		size int
+	}
+
+	// quicInitialKeys remove the protection of client Initial packets, which is derived from
+	// the Destination Connection ID chosen by the client: it is not a secret.
+	// see: https://www.rfc-editor.org/rfc/rfc9001.html#name-initial-secrets
+	quicInitialKeys struct {
+		aead cipher.AEAD
+		iv   []byte
+		hp   cipher.Block
+	}
+
+	cryptoFragment struct {
+		offset uint64
+		data   []byte
+	}
+)
+
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+
+	quicPacketInitial   = 0
+	quicPacketZeroRTT   = 1
+	quicPacketHandshake = 2
+	quicPacketRetry     = 3
+
+	quicMaxConnectionIDSize = 20
+	quicSampleSize          = 16
+	quicMaxPacketNumberSize = 4
+
+	quicFramePadding         = 0x00
+	quicFramePing            = 0x01
+	quicFrameACK             = 0x02
+	quicFrameACKWithECN      = 0x03
+	quicFrameCrypto          = 0x06
+	quicFrameConnectionClose = 0x1c
+)
+
+var (
+	quicVersion1Salt = []byte{
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+	}
+	// see: https://www.rfc-editor.org/rfc/rfc9369.html#name-initial-salt
+	quicVersion2Salt = []byte{
+		0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9,
+	}
+)
+
+func isQUICLongHeader(data []byte) bool {
+	return len(data) > 0 && data[0]&0xc0 == 0xc0
+}
+
+func isQUICShortHeader(data []byte) bool {
+	return len(data) > 0 && data[0]&0xc0 == 0x40
+}
+
+func isKnownQUICVersion(version uint32) bool {
+	return version == quicVersion1 || version == quicVersion2
+}
+
+// readVarint reads a variable-length integer; see: https://www.rfc-editor.org/rfc/rfc9000.html#name-variable-length-integer-enc
+func readVarint(s *cryptobyte.String) (uint64, bool) {
+	var first uint8
+	if !s.ReadUint8(&first) {
+		return 0, false
+	}
+	value := uint64(first & 0x3f)
+	for i := 1; i < 1<<(first>>6); i++ {
+		var next uint8
+		if !s.ReadUint8(&next) {
+			return 0, false
+		}
+		value = value<<8 | uint64(next)
+	}
+	return value, true
+}
+
+func parseQUICLongHeader(packet []byte) (*quicLongHeader, bool) {
+	s := cryptobyte.String(packet)
+	var first uint8
+	var dcid, scid cryptobyte.String
+	header := &quicLongHeader{}
+	if !s.ReadUint8(&first) || !s.ReadUint32(&header.version) ||
+		!s.ReadUint8LengthPrefixed(&dcid) || !s.ReadUint8LengthPrefixed(&scid) ||
+		len(dcid) > quicMaxConnectionIDSize || len(scid) > quicMaxConnectionIDSize {
+		return nil, false
+	}
+	header.dcid, header.scid = dcid, scid
+	header.size = len(packet)
+
+	// the rest of the header is version specific: i/e: version negotiation packets
+	if !isKnownQUICVersion(header.version) {
+		return header, true
+	}
+
+	header.packetType = (first >> 4) & 0x03
+	if header.version == quicVersion2 {
+		// QUIC v2 rotates packet types: Retry=0, Initial=1, 0-RTT=2, Handshake=3
+		header.packetType = (header.packetType + 3) & 0x03
+	}
+	if header.packetType == quicPacketRetry {
+		return header, true
+	}
+
+	if header.packetType == quicPacketInitial {
+		tokenLen, ok := readVarint(&s)
+		if !ok || !s.Skip(int(tokenLen)) {
+			return nil, false
+		}
+	}
+	length, ok := readVarint(&s)
+	if !ok {
+		return nil, false
+	}
+	header.pnOffset = len(packet) - len(s)
+	header.size = header.pnOffset + int(length)
+	return header, true
+}
+
+// hkdfExpandLabel is `HKDF-Expand-Label` as defined by TLS 1.3; see: https://www.rfc-editor.org/rfc/rfc8446.html#section-7.1
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(sha256.New, secret, b.BytesOrPanic()), out)
+	return out
+}
+
+func newClientInitialKeys(version uint32, dcid []byte) (*quicInitialKeys, error) {
+	salt, prefix := quicVersion1Salt, "quic"
+	if version == quicVersion2 {
+		salt, prefix = quicVersion2Salt, "quicv2"
+	}
+	initialSecret := hkdf.Extract(sha256.New, dcid, salt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+
+	block, err := aes.NewCipher(hkdfExpandLabel(clientSecret, prefix+" key", 16))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(clientSecret, prefix+" hp", 16))
+	if err != nil {
+		return nil, err
+	}
+	return &quicInitialKeys{aead: aead, iv: hkdfExpandLabel(clientSecret, prefix+" iv", 12), hp: hp}, nil
+}
+
+// open removes header and packet protection from a client Initial packet, and returns its frames;
+// see: https://www.rfc-editor.org/rfc/rfc9001.html#name-header-protection
+func (k *quicInitialKeys) open(packet []byte, header *quicLongHeader) ([]byte, bool) {
+	sampleOffset := header.pnOffset + quicMaxPacketNumberSize
+	if header.size > len(packet) || sampleOffset+quicSampleSize > header.size {
+		return nil, false
+	}
+	mask := make([]byte, quicSampleSize)
+	k.hp.Encrypt(mask, packet[sampleOffset:sampleOffset+quicSampleSize])
+
+	// packets are owned by the engine: protection must not be removed in place
+	unprotected := slices.Clone(packet[:sampleOffset])
+	unprotected[0] ^= mask[0] & 0x0f
+	pnLen := int(unprotected[0]&0x03) + 1
+
+	nonce := slices.Clone(k.iv)
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		unprotected[header.pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(unprotected[header.pnOffset+i])
+	}
+	// the truncated packet number is enough, as only the first packets of every connection are decrypted
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+
+	headerSize := header.pnOffset + pnLen
+	frames, err := k.aead.Open(nil, nonce, packet[headerSize:header.size], unprotected[:headerSize])
+	if err != nil {
+		return nil, false
+	}
+	return frames, true
+}
+
+// readCryptoFrames returns the CRYPTO frames of an Initial packet; `false` if it contains frames
+// which are not allowed in Initial packets. See: https://www.rfc-editor.org/rfc/rfc9000.html#name-frames-and-frame-types
+func readCryptoFrames(frames []byte) ([]*cryptoFragment, bool) {
+	fragments := []*cryptoFragment{}
+	s := cryptobyte.String(frames)
+	for !s.Empty() {
+		frameType, ok := readVarint(&s)
+		if !ok {
+			return nil, false
+		}
+		switch frameType {
+		case quicFramePadding, quicFramePing:
+		case quicFrameACK, quicFrameACKWithECN:
+			// largest acknowledged, delay, range count and first range
+			fields := []uint64{0, 0, 0, 0}
+			for i := range fields {
+				if fields[i], ok = readVarint(&s); !ok {
+					return nil, false
+				}
+			}
+			extra := 2 * fields[2]
+			if frameType == quicFrameACKWithECN {
+				extra += 3
+			}
+			for i := uint64(0); i < extra; i++ {
+				if _, ok := readVarint(&s); !ok {
+					return nil, false
+				}
+			}
+		case quicFrameCrypto:
+			offset, ok := readVarint(&s)
+			if !ok {
+				return nil, false
+			}
+			length, ok := readVarint(&s)
+			var data []byte
+			if !ok || !s.ReadBytes(&data, int(length)) {
+				return nil, false
+			}
+			fragments = append(fragments, &cryptoFragment{offset: offset, data: data})
+		case quicFrameConnectionClose:
+			// error code and frame type, followed by the reason phrase
+			if _, ok := readVarint(&s); !ok {
+				return nil, false
+			}
+			if _, ok := readVarint(&s); !ok {
+				return nil, false
+			}
+			reasonLen, ok := readVarint(&s)
+			if !ok || !s.Skip(int(reasonLen)) {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return fragments, true
+}
+
+// assembleCrypto returns the 1st handshake message carried by `fragments`, which may arrive
+// in any order and across many packets; `false` if some fragment is still missing.
+func assembleCrypto(fragments []*cryptoFragment) (uint8, []byte, bool) {
+	slices.SortFunc(fragments, func(a, b *cryptoFragment) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+	data := []byte{}
+	for _, fragment := range fragments {
+		if fragment.offset > uint64(len(data)) {
+			break
+		}
+		if end := fragment.offset + uint64(len(fragment.data)); end > uint64(len(data)) {
+			data = append(data, fragment.data[uint64(len(data))-fragment.offset:]...)
+		}
+	}
+	if len(data) < tlsHandshakeHeaderSize {
+		return 0, nil, false
+	}
+	msgLen := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if len(data) < tlsHandshakeHeaderSize+msgLen {
+		return 0, nil, false
+	}
+	return data[0], data[tlsHandshakeHeaderSize : tlsHandshakeHeaderSize+msgLen], true
+}
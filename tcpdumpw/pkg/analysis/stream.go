@@ -0,0 +1,46 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+)
+
+type (
+	// tcpSequence follows the sequence numbers of one direction of a TCP stream,
+	// so that application protocols are decoded using segments in order.
+	tcpSequence struct {
+		synced  bool
+		nextSeq uint32
+	}
+)
+
+// next reports whether `segment` must be decoded: it is `false` for retransmissions;
+// `gap` is `true` if segments were lost, so decoders must discard whatever they buffered.
+func (s *tcpSequence) next(segment *payload.Segment) (ok, gap bool) {
+	seq := segment.Seq
+	if segment.SYN {
+		seq += 1 // SYN consumes 1 sequence number
+	}
+	if s.synced && seq != s.nextSeq {
+		if int32(seq-s.nextSeq) < 0 {
+			return false, false
+		}
+		gap = true
+	}
+	s.synced = true
+	s.nextSeq = seq + uint32(len(segment.Payload))
+	return true, gap
+}
@@ -0,0 +1,333 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// EventHandler is invoked for every TCP anomaly found in the stream of JSON translated packets.
+	EventHandler func(event *Event)
+
+	// Event describes a TCP segment which was retransmitted, received out of order, a duplicate ACK,
+	// a zero window announcement, or a flow which stopped making progress.
+	Event struct {
+		Type      string    `json:"type"`
+		Iface     string    `json:"iface"`
+		Flow      string    `json:"flow"`
+		Seq       uint32    `json:"seq"`
+		Ack       uint32    `json:"ack"`
+		Len       uint32    `json:"len"`
+		Count     uint64    `json:"count,omitempty"`
+		Timestamp time.Time `json:"timestamp"`
+		// for how long a flow has not made progress; only available for stalled flows
+		Stall string `json:"stall,omitempty"`
+	}
+
+	// Totals are the amount of TCP anomalies found since the analyzer was created.
+	Totals struct {
+		Segments        uint64 `json:"segments"`
+		Retransmissions uint64 `json:"retransmissions"`
+		DuplicateAcks   uint64 `json:"duplicate_acks"`
+		OutOfOrder      uint64 `json:"out_of_order"`
+		ZeroWindows     uint64 `json:"zero_windows"`
+		Stalls          uint64 `json:"stalls"`
+	}
+
+	// TCPAnalyzer is a packet analyzer which tracks the sequence numbers of every TCP flow direction;
+	// it must be fed by a Dispatcher.
+	TCPAnalyzer struct {
+		mu              sync.Mutex
+		iface           *string
+		flows           map[string]*flowState
+		lastSweep       time.Time
+		lastStallCheck  time.Time
+		stallTimeout    time.Duration
+		onEvent         EventHandler
+		segments        atomic.Uint64
+		retransmissions atomic.Uint64
+		duplicateAcks   atomic.Uint64
+		outOfOrder      atomic.Uint64
+		zeroWindows     atomic.Uint64
+		stalls          atomic.Uint64
+	}
+
+	// state of a single direction of a TCP connection
+	flowState struct {
+		nextSeq      uint32
+		nextSeqTS    time.Time
+		lastAck      uint32
+		lastWin      uint16
+		dupAcks      uint64
+		hasSeq       bool
+		hasAck       bool
+		lastActivity time.Time
+		// key of the opposite direction of the same connection
+		reverse string
+		// last time new data was sent, or data sent was acknowledged
+		lastProgress time.Time
+		zeroWindow   bool
+		stalled      bool
+	}
+)
+
+const (
+	EventRetransmission = "retransmission"
+	EventDuplicateAck   = "duplicate_ack"
+	EventOutOfOrder     = "out_of_order"
+	EventZeroWindow     = "zero_window"
+	EventStalled        = "stalled"
+)
+
+const (
+	// segments filling a gap faster than this are considered to be out of order rather than retransmitted;
+	// see: https://www.wireshark.org/docs/wsug_html_chunked/ChAdvTCPAnalysis.html
+	outOfOrderThreshold = 3 * time.Millisecond
+	flowIdleTimeout     = 2 * time.Minute
+	sweepInterval       = 30 * time.Second
+	stallCheckInterval  = 1 * time.Second
+)
+
+// sequence numbers wrap around: compare them using serial number arithmetic ( RFC 1982 )
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (a *TCPAnalyzer) emit(eventType string, flow string, segmentLen uint32, ts time.Time, seq, ack uint32, count uint64) {
+	switch eventType {
+	case EventRetransmission:
+		a.retransmissions.Add(1)
+	case EventDuplicateAck:
+		a.duplicateAcks.Add(1)
+	case EventOutOfOrder:
+		a.outOfOrder.Add(1)
+	case EventZeroWindow:
+		a.zeroWindows.Add(1)
+	}
+	if a.onEvent == nil {
+		return
+	}
+	a.onEvent(&Event{
+		Type:      eventType,
+		Iface:     *a.iface,
+		Flow:      flow,
+		Seq:       seq,
+		Ack:       ack,
+		Len:       segmentLen,
+		Count:     count,
+		Timestamp: ts,
+	})
+}
+
+// sweep forgets flows which have not been active for a while; must be called while holding `a.mu`.
+func (a *TCPAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < sweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for key, state := range a.flows {
+		if now.Sub(state.lastActivity) > flowIdleTimeout {
+			delete(a.flows, key)
+		}
+	}
+}
+
+// isStalled reports whether the sender of `state` is not able to make progress: either because the receiver
+// announced a zero window, or because the data already sent is not being acknowledged.
+func (a *TCPAnalyzer) isStalled(state *flowState) bool {
+	if !state.hasSeq || state.lastProgress.IsZero() {
+		return false
+	}
+	peer, ok := a.flows[state.reverse]
+	if !ok {
+		return false
+	}
+	return peer.zeroWindow || (peer.hasAck && seqLess(peer.lastAck, state.nextSeq))
+}
+
+// checkStalls reports flows which have not made progress within the stall timeout; must be called while holding `a.mu`.
+func (a *TCPAnalyzer) checkStalls(now time.Time) {
+	if a.stallTimeout <= 0 || now.Sub(a.lastStallCheck) < stallCheckInterval {
+		return
+	}
+	a.lastStallCheck = now
+	for flow, state := range a.flows {
+		if state.stalled || !a.isStalled(state) {
+			continue
+		}
+		stall := now.Sub(state.lastProgress)
+		if stall < a.stallTimeout {
+			continue
+		}
+		state.stalled = true
+		a.stalls.Add(1)
+		if a.onEvent == nil {
+			continue
+		}
+		a.onEvent(&Event{
+			Type:      EventStalled,
+			Iface:     *a.iface,
+			Flow:      flow,
+			Seq:       state.nextSeq,
+			Ack:       state.lastAck,
+			Timestamp: now,
+			Stall:     stall.Truncate(time.Millisecond).String(),
+		})
+	}
+}
+
+// progress records that the sender of `state` was able to make progress.
+func (state *flowState) progress(ts time.Time) {
+	state.lastProgress = ts
+	state.stalled = false
+}
+
+func (a *TCPAnalyzer) analyze(segment *Packet) {
+	l4 := segment.L4
+	ts := segment.timestamp()
+	payloadLen := segment.payloadLen()
+	flags := l4.Flags.Map
+	flow := segment.flow()
+
+	a.segments.Add(1)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(ts)
+	a.checkStalls(ts)
+
+	state, ok := a.flows[flow]
+	if !ok || flags.SYN && !flags.ACK {
+		// new connections may reuse the same 4-tuple
+		state = &flowState{reverse: flowKey(segment.L3.Dst, *l4.Dst, segment.L3.Src, *l4.Src)}
+		a.flows[flow] = state
+	}
+	state.lastActivity = ts
+
+	seq := *l4.Seq
+	// SYN and FIN consume 1 sequence number
+	seqLen := uint32(payloadLen)
+	if flags.SYN || flags.FIN {
+		seqLen += 1
+	}
+	segmentEnd := seq + seqLen
+
+	// keep-alives carry at most 1 byte, and their sequence number is the last one acknowledged
+	isKeepAlive := payloadLen <= 1 && !flags.SYN && !flags.FIN && state.hasSeq && seq == state.nextSeq-1
+
+	if seqLen > 0 && !isKeepAlive {
+		switch {
+		case !state.hasSeq:
+			state.hasSeq = true
+			state.nextSeq, state.nextSeqTS = segmentEnd, ts
+			state.progress(ts)
+		case seqLess(seq, state.nextSeq):
+			if ts.Sub(state.nextSeqTS) < outOfOrderThreshold {
+				a.emit(EventOutOfOrder, flow, uint32(payloadLen), ts, seq, l4.Ack, 0)
+			} else {
+				a.emit(EventRetransmission, flow, uint32(payloadLen), ts, seq, l4.Ack, 0)
+			}
+			if seqLess(state.nextSeq, segmentEnd) {
+				state.nextSeq = segmentEnd
+			}
+		default:
+			state.nextSeq, state.nextSeqTS = segmentEnd, ts
+			state.progress(ts)
+		}
+	}
+
+	if flags.RST {
+		// data which is still outstanding will never be acknowledged
+		delete(a.flows, flow)
+		delete(a.flows, state.reverse)
+		return
+	}
+
+	if !flags.ACK {
+		return
+	}
+
+	// a zero window stops the opposite direction from sending data until the window is opened again
+	if l4.Win == 0 && !flags.SYN && !flags.FIN {
+		if !state.zeroWindow {
+			state.zeroWindow = true
+			a.emit(EventZeroWindow, flow, uint32(payloadLen), ts, seq, l4.Ack, 0)
+		}
+	} else {
+		state.zeroWindow = false
+	}
+
+	if peer, ok := a.flows[state.reverse]; ok && (!state.hasAck || seqLess(state.lastAck, l4.Ack)) {
+		peer.progress(ts)
+	}
+
+	// duplicate ACKs do not carry data, do not update the window and acknowledge the same sequence number
+	if state.hasAck && seqLen == 0 && l4.Ack == state.lastAck && l4.Win == state.lastWin {
+		state.dupAcks += 1
+		a.emit(EventDuplicateAck, flow, 0, ts, seq, l4.Ack, state.dupAcks)
+		return
+	}
+	state.hasAck = true
+	state.lastAck = l4.Ack
+	state.lastWin = l4.Win
+	state.dupAcks = 0
+}
+
+// Analyze follows TCP segments; all other packets are ignored.
+func (a *TCPAnalyzer) Analyze(packet *Packet) {
+	if packet.isSegment() {
+		a.analyze(packet)
+	}
+}
+
+// Totals returns the amount of analyzed segments and TCP anomalies found so far.
+func (a *TCPAnalyzer) Totals() Totals {
+	return Totals{
+		Segments:        a.segments.Load(),
+		Retransmissions: a.retransmissions.Load(),
+		DuplicateAcks:   a.duplicateAcks.Load(),
+		OutOfOrder:      a.outOfOrder.Load(),
+		ZeroWindows:     a.zeroWindows.Load(),
+		Stalls:          a.stalls.Load(),
+	}
+}
+
+// Sub returns the TCP anomalies found since `previous` was taken.
+func (t Totals) Sub(previous Totals) Totals {
+	return Totals{
+		Segments:        t.Segments - previous.Segments,
+		Retransmissions: t.Retransmissions - previous.Retransmissions,
+		DuplicateAcks:   t.DuplicateAcks - previous.DuplicateAcks,
+		OutOfOrder:      t.OutOfOrder - previous.OutOfOrder,
+		ZeroWindows:     t.ZeroWindows - previous.ZeroWindows,
+		Stalls:          t.Stalls - previous.Stalls,
+	}
+}
+
+// NewTCPAnalyzer creates an analyzer which finds TCP retransmissions, duplicate ACKs, out of order segments
+// and zero windows in the JSON translated packets captured from `iface`; flows which do not make progress
+// for longer than `stallTimeout` are reported as stalled, unless it is 0.
+func NewTCPAnalyzer(iface *string, stallTimeout time.Duration, onEvent EventHandler) *TCPAnalyzer {
+	return &TCPAnalyzer{
+		iface:        iface,
+		flows:        make(map[string]*flowState),
+		stallTimeout: stallTimeout,
+		onEvent:      onEvent,
+	}
+}
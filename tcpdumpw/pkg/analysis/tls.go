@@ -0,0 +1,245 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+)
+
+type (
+	// TLSHandler is invoked for every TLS handshake, once the server answers or it times out.
+	TLSHandler func(record *TLSRecord)
+
+	// TLSRecord describes a TLS handshake using only the cleartext `ClientHello` and `ServerHello` messages;
+	// `Version`, `Cipher` and `JA3S` are empty if the `ServerHello` was not captured.
+	TLSRecord struct {
+		Iface     string    `json:"iface"`
+		Client    string    `json:"client"`
+		Server    string    `json:"server"`
+		SNI       string    `json:"sni,omitempty"`
+		ALPN      []string  `json:"alpn,omitempty"`
+		Versions  []string  `json:"offered_versions,omitempty"`
+		Version   string    `json:"version,omitempty"`
+		Cipher    string    `json:"cipher,omitempty"`
+		Protocol  string    `json:"protocol,omitempty"`
+		JA3       string    `json:"ja3"`
+		JA4       string    `json:"ja4"`
+		JA3S      string    `json:"ja3s,omitempty"`
+		Latency   float64   `json:"latency_ms,omitempty"`
+		TimedOut  bool      `json:"timed_out,omitempty"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	// TLSAnalyzer pairs TLS `ClientHello` messages with their `ServerHello`, and reports handshakes which fail;
+	// it must be fed with TCP segments including their payload, see `payload.Engine`.
+	TLSAnalyzer struct {
+		iface      *string
+		streams    map[string]*tlsStream
+		pending    map[string]*TLSRecord
+		handshakes map[string]*tlsHandshake
+		timeout    time.Duration
+		lastSweep  time.Time
+		onRecord   TLSHandler
+		onFailure  TLSFailureHandler
+		// failure counters are read while segments are being analyzed
+		failuresMu sync.Mutex
+		failures   map[string]map[string]uint64
+	}
+
+	// tlsStream buffers the segments of handshake messages which do not fit in a single segment
+	tlsStream struct {
+		start time.Time
+		data  []byte
+	}
+)
+
+const (
+	tlsRecordHeaderSize    = 5
+	tlsHandshakeHeaderSize = 4
+	// the largest TLS record, and therefore the largest handshake message which is reassembled
+	tlsMaxRecordSize = tlsRecordHeaderSize + 16384
+
+	tlsRecordTypeHandshake = 0x16
+
+	tlsHandshakeClientHello = 1
+	tlsHandshakeServerHello = 2
+)
+
+func isHandshakeRecord(data []byte) bool {
+	// all TLS versions use `0x03` as the record major version
+	return len(data) >= tlsRecordHeaderSize && data[0] == tlsRecordTypeHandshake && data[1] == 0x03
+}
+
+// readHandshake returns the 1st handshake message in `data`; `complete` is `false`
+// if more segments are required, and `ok` is `false` if the message cannot be decoded.
+func readHandshake(data []byte) (msgType uint8, body []byte, complete, ok bool) {
+	if len(data) < tlsRecordHeaderSize+tlsHandshakeHeaderSize {
+		return 0, nil, false, true
+	}
+	recordLen := int(data[3])<<8 | int(data[4])
+	msgType = data[5]
+	msgLen := int(data[6])<<16 | int(data[7])<<8 | int(data[8])
+	// handshake messages fragmented across many records are not reassembled
+	if msgLen+tlsHandshakeHeaderSize > recordLen {
+		return 0, nil, false, false
+	}
+	end := tlsRecordHeaderSize + tlsHandshakeHeaderSize + msgLen
+	if len(data) < end {
+		return 0, nil, false, true
+	}
+	return msgType, data[tlsRecordHeaderSize+tlsHandshakeHeaderSize : end], true, true
+}
+
+// sweep reports handshakes which were not answered within `timeout`, and drops
+// incomplete handshake messages which are not being completed.
+func (a *TLSAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < a.timeout {
+		return
+	}
+	a.lastSweep = now
+	for flow, stream := range a.streams {
+		if now.Sub(stream.start) > a.timeout {
+			delete(a.streams, flow)
+		}
+	}
+	for flow, record := range a.pending {
+		if now.Sub(record.Timestamp) > a.timeout {
+			delete(a.pending, flow)
+			record.TimedOut = true
+			a.onRecord(record)
+		}
+	}
+	// handshakes which are neither completed nor failed were not fully captured
+	for flow, handshake := range a.handshakes {
+		if now.Sub(handshake.record.Timestamp) > a.timeout {
+			delete(a.handshakes, flow)
+		}
+	}
+}
+
+// reassemble returns the 1st handshake message sent through `flow`, once all of its segments are available.
+func (a *TLSAnalyzer) reassemble(flow string, segment *payload.Segment) (uint8, []byte, bool) {
+	stream, buffering := a.streams[flow]
+	if !buffering {
+		if !isHandshakeRecord(segment.Payload) {
+			return 0, nil, false
+		}
+		stream = &tlsStream{start: segment.Timestamp}
+	}
+	// segments are not retained by the engine, so their payload must be copied
+	stream.data = append(stream.data, segment.Payload...)
+
+	msgType, body, complete, ok := readHandshake(stream.data)
+	if !ok || (!complete && len(stream.data) >= tlsMaxRecordSize) {
+		delete(a.streams, flow)
+		return 0, nil, false
+	}
+	if !complete {
+		a.streams[flow] = stream
+		return 0, nil, false
+	}
+	delete(a.streams, flow)
+	return msgType, body, true
+}
+
+func (a *TLSAnalyzer) onClientHello(flow string, segment *payload.Segment, body []byte) {
+	hello, ok := parseClientHello(body)
+	if !ok {
+		return
+	}
+	record := &TLSRecord{
+		Iface:     *a.iface,
+		Client:    fmt.Sprintf("%s:%d", segment.SrcIP, segment.SrcPort),
+		Server:    fmt.Sprintf("%s:%d", segment.DstIP, segment.DstPort),
+		SNI:       hello.serverName,
+		ALPN:      hello.alpn,
+		JA3:       hello.ja3(),
+		JA4:       hello.ja4(),
+		Timestamp: segment.Timestamp,
+	}
+	for _, version := range hello.versions {
+		if !isGREASE(version) {
+			record.Versions = append(record.Versions, tls.VersionName(version))
+		}
+	}
+	a.pending[flow] = record
+	a.handshakes[flow] = &tlsHandshake{record: record}
+}
+
+func (a *TLSAnalyzer) onServerHello(segment *payload.Segment, body []byte) {
+	flow := flowKey(segment.DstIP, segment.DstPort, segment.SrcIP, segment.SrcPort)
+	record, ok := a.pending[flow]
+	if !ok {
+		return // the `ClientHello` was not captured
+	}
+	hello, ok := parseServerHello(body)
+	if !ok {
+		return
+	}
+	delete(a.pending, flow)
+
+	if handshake, ok := a.handshakes[flow]; ok {
+		handshake.serverHello = true
+		handshake.version = hello.negotiatedVersion()
+	}
+
+	record.Version = tls.VersionName(hello.negotiatedVersion())
+	record.Cipher = tls.CipherSuiteName(hello.cipher)
+	record.Protocol = hello.alpn
+	record.JA3S = hello.ja3s()
+	record.Latency = toMillis(segment.Timestamp.Sub(record.Timestamp))
+	a.onRecord(record)
+}
+
+func (a *TLSAnalyzer) Analyze(segment *payload.Segment) {
+	a.sweep(segment.Timestamp)
+
+	flow := flowKey(segment.SrcIP, segment.SrcPort, segment.DstIP, segment.DstPort)
+	if segment.RST || segment.FIN {
+		delete(a.streams, flow)
+	}
+	if len(segment.Payload) > 0 {
+		if msgType, body, ok := a.reassemble(flow, segment); ok {
+			switch msgType {
+			case tlsHandshakeClientHello:
+				a.onClientHello(flow, segment, body)
+			case tlsHandshakeServerHello:
+				a.onServerHello(segment, body)
+			}
+		}
+	}
+
+	a.track(flow, segment)
+}
+
+// NewTLSAnalyzer creates an analyzer which extracts the SNI, ALPN, negotiated version and cipher,
+// and JA3/JA4 fingerprints of the TLS handshakes captured from `iface`; `onFailure` may be `nil`.
+func NewTLSAnalyzer(iface *string, timeout time.Duration, onRecord TLSHandler, onFailure TLSFailureHandler) *TLSAnalyzer {
+	return &TLSAnalyzer{
+		iface:      iface,
+		streams:    make(map[string]*tlsStream),
+		pending:    make(map[string]*TLSRecord),
+		handshakes: make(map[string]*tlsHandshake),
+		timeout:    timeout,
+		onRecord:   onRecord,
+		onFailure:  onFailure,
+		failures:   make(map[string]map[string]uint64),
+	}
+}
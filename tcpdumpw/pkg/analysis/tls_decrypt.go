@@ -0,0 +1,513 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+type (
+	// TLSDecrypter decrypts the TLS sessions of the servers listening on its ports using the secrets found in a key log,
+	// and hands over their plaintext to HTTP/1.x and HTTP/2 analyzers as if it was carried by cleartext TCP segments.
+	// Sessions must be captured since their `ClientHello`, and only AEAD cipher suites are supported.
+	TLSDecrypter struct {
+		ports     map[uint16]struct{}
+		keyLog    *KeyLog
+		http      payload.Analyzer
+		h2        payload.Analyzer
+		sessions  map[string]*tlsSession
+		timeout   time.Duration
+		lastSweep time.Time
+	}
+
+	tlsSession struct {
+		clientRandom []byte
+		serverRandom []byte
+		version      uint16
+		suite        *tlsCipherSuite
+		directions   [2]*tlsDirection
+		// the analyzer plaintext is handed over to; it is chosen using the 1st plaintext sent by the client
+		target   payload.Analyzer
+		lastSeen time.Time
+	}
+
+	// tlsDirection decrypts the records sent by one of the peers of a session
+	tlsDirection struct {
+		sequence tcpSequence
+		buffer   []byte
+		// TLS 1.2 records are encrypted after `ChangeCipherSpec`; TLS 1.3 encrypted records are `application_data`
+		encrypted bool
+		keys      *tlsTrafficKeys
+		// TLS 1.3 handshake records are encrypted with other keys: they are skipped until a record is decrypted
+		synced bool
+		// encrypted records received before their secrets were written into the key log
+		pending   []*tlsPendingRecord
+		recordSeq uint64
+		// sequence number of the next plaintext segment
+		plainSeq uint32
+	}
+
+	tlsPendingRecord struct {
+		// the segment which completed the record, without its payload
+		segment *payload.Segment
+		record  []byte
+	}
+
+	tlsTrafficKeys struct {
+		aead cipher.AEAD
+		iv   []byte
+		// TLS 1.2 AES-GCM records carry the explicit part of their nonce
+		explicitNonce bool
+	}
+
+	tlsCipherSuite struct {
+		keyLen int
+		hash   func() hash.Hash
+		chacha bool
+	}
+)
+
+const (
+	tlsClient = 0
+	tlsServer = 1
+
+	tlsVersion13 = 0x0304
+
+	// TLS 1.2 PRF and TLS 1.3 HKDF labels
+	tlsLabelKeyExpansion = "key expansion"
+	tlsLabelPrefix       = "tls13 "
+
+	tlsGCMSaltSize      = 4
+	tlsGCMExplicitSize  = 8
+	tlsMaxCiphertextLen = 16384 + 2048
+	tlsMaxPending       = 64
+)
+
+var (
+	// see: https://www.iana.org/assignments/tls-parameters/tls-parameters.xhtml#tls-parameters-4
+	tlsCipherSuites = map[uint16]*tlsCipherSuite{
+		// TLS 1.3
+		0x1301: {keyLen: 16, hash: sha256.New},
+		0x1302: {keyLen: 32, hash: sha512.New384},
+		0x1303: {keyLen: 32, hash: sha256.New, chacha: true},
+		// TLS 1.2
+		0x009c: {keyLen: 16, hash: sha256.New},
+		0x009d: {keyLen: 32, hash: sha512.New384},
+		0xc02b: {keyLen: 16, hash: sha256.New},
+		0xc02c: {keyLen: 32, hash: sha512.New384},
+		0xc02f: {keyLen: 16, hash: sha256.New},
+		0xc030: {keyLen: 32, hash: sha512.New384},
+		0xcca8: {keyLen: 32, hash: sha256.New, chacha: true},
+		0xcca9: {keyLen: 32, hash: sha256.New, chacha: true},
+	}
+
+	// `ServerHello` messages with this random are `HelloRetryRequest`s; see: https://datatracker.ietf.org/doc/html/rfc8446#section-4.1.3
+	helloRetryRequestRandom = []byte{
+		0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+		0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+	}
+)
+
+func (s *tlsCipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	if s.chacha {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ivLen is 4 bytes for TLS 1.2 AES-GCM, as the rest of the nonce is sent with every record.
+func (s *tlsCipherSuite) ivLen(version uint16) int {
+	if version != tlsVersion13 && !s.chacha {
+		return tlsGCMSaltSize
+	}
+	return chacha20poly1305.NonceSize
+}
+
+// expandLabel is `HKDF-Expand-Label` with an empty context; see: https://datatracker.ietf.org/doc/html/rfc8446#section-7.1
+func (s *tlsCipherSuite) expandLabel(secret []byte, label string, length int) []byte {
+	var info cryptobyte.Builder
+	info.AddUint16(uint16(length))
+	info.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(tlsLabelPrefix + label))
+	})
+	info.AddUint8(0)
+	out := make([]byte, length)
+	hkdf.Expand(s.hash, secret, info.BytesOrPanic()).Read(out)
+	return out
+}
+
+// prf is the TLS 1.2 `P_hash` function; see: https://datatracker.ietf.org/doc/html/rfc5246#section-5
+func (s *tlsCipherSuite) prf(secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	out := make([]byte, 0, length)
+	a := seed
+	for len(out) < length {
+		mac := hmac.New(s.hash, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
+
+func (s *tlsSession) newTrafficKeys13(secret []byte) (*tlsTrafficKeys, error) {
+	aead, err := s.suite.newAEAD(s.suite.expandLabel(secret, "key", s.suite.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	return &tlsTrafficKeys{aead: aead, iv: s.suite.expandLabel(secret, "iv", s.suite.ivLen(s.version))}, nil
+}
+
+// deriveKeys returns `false` if the secrets of the session are not in the key log yet.
+func (s *tlsSession) deriveKeys(keyLog *KeyLog) bool {
+	if s.directions[tlsClient].keys != nil {
+		return true
+	}
+
+	if s.version == tlsVersion13 {
+		secrets, ok := keyLog.lookup(s.clientRandom, func(secrets *keyLogSecrets) bool {
+			return secrets.clientTraffic != nil && secrets.serverTraffic != nil
+		})
+		if !ok {
+			return false
+		}
+		clientKeys, clientErr := s.newTrafficKeys13(secrets.clientTraffic)
+		serverKeys, serverErr := s.newTrafficKeys13(secrets.serverTraffic)
+		if clientErr != nil || serverErr != nil {
+			return false
+		}
+		s.directions[tlsClient].keys, s.directions[tlsServer].keys = clientKeys, serverKeys
+		return true
+	}
+
+	secrets, ok := keyLog.lookup(s.clientRandom, func(secrets *keyLogSecrets) bool {
+		return secrets.masterSecret != nil
+	})
+	if !ok {
+		return false
+	}
+	// AEAD cipher suites do not use MAC keys
+	keyLen, ivLen := s.suite.keyLen, s.suite.ivLen(s.version)
+	keyBlock := s.suite.prf(secrets.masterSecret, tlsLabelKeyExpansion,
+		append(bytes.Clone(s.serverRandom), s.clientRandom...), 2*keyLen+2*ivLen)
+	for i, direction := range s.directions {
+		aead, err := s.suite.newAEAD(keyBlock[i*keyLen : (i+1)*keyLen])
+		if err != nil {
+			return false
+		}
+		iv := keyBlock[2*keyLen+i*ivLen : 2*keyLen+(i+1)*ivLen]
+		direction.keys = &tlsTrafficKeys{aead: aead, iv: iv, explicitNonce: !s.suite.chacha}
+	}
+	return true
+}
+
+// open decrypts `record`, and returns its content type and plaintext.
+func (k *tlsTrafficKeys) open(record []byte, seq uint64, version uint16) (uint8, []byte, bool) {
+	header, ciphertext := record[:tlsRecordHeaderSize], record[tlsRecordHeaderSize:]
+
+	nonce := make([]byte, k.aead.NonceSize())
+	var additionalData []byte
+	if k.explicitNonce {
+		if len(ciphertext) < tlsGCMExplicitSize+k.aead.Overhead() {
+			return 0, nil, false
+		}
+		copy(nonce, k.iv)
+		copy(nonce[tlsGCMSaltSize:], ciphertext[:tlsGCMExplicitSize])
+		ciphertext = ciphertext[tlsGCMExplicitSize:]
+	} else {
+		copy(nonce, k.iv)
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+		}
+	}
+
+	if version == tlsVersion13 {
+		additionalData = header
+	} else {
+		if len(ciphertext) < k.aead.Overhead() {
+			return 0, nil, false
+		}
+		additionalData = binary.BigEndian.AppendUint64(nil, seq)
+		additionalData = append(additionalData, header[0], header[1], header[2])
+		additionalData = binary.BigEndian.AppendUint16(additionalData, uint16(len(ciphertext)-k.aead.Overhead()))
+	}
+
+	plaintext, err := k.aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return 0, nil, false
+	}
+	if version != tlsVersion13 {
+		return header[0], plaintext, true
+	}
+	// TLS 1.3 hides the content type at the end of the plaintext, followed by optional padding
+	end := len(plaintext)
+	for end > 0 && plaintext[end-1] == 0 {
+		end--
+	}
+	if end == 0 {
+		return 0, nil, false
+	}
+	return plaintext[end-1], plaintext[:end-1], true
+}
+
+// deliver hands over plaintext to the analyzer of the session as a cleartext TCP segment.
+func (d *TLSDecrypter) deliver(session *tlsSession, direction int, segment *payload.Segment, plaintext []byte) {
+	if session.target == nil {
+		if direction != tlsClient {
+			return
+		}
+		session.target = d.http
+		if bytes.HasPrefix(plaintext, h2Preface) {
+			session.target = d.h2
+		}
+		if session.target == nil {
+			return
+		}
+		// analyzers only track connections from their start
+		syn := *segment
+		syn.Seq, syn.SYN, syn.FIN, syn.RST, syn.Payload = 0, true, false, false, nil
+		session.target.Analyze(&syn)
+	}
+
+	plain := *segment
+	plain.Seq, plain.SYN, plain.FIN, plain.RST, plain.Payload = session.directions[direction].plainSeq, false, false, false, plaintext
+	session.directions[direction].plainSeq += uint32(len(plaintext))
+	session.target.Analyze(&plain)
+}
+
+// decrypt returns `false` if `record` cannot be decrypted yet, as its secrets are not known.
+func (d *TLSDecrypter) decrypt(session *tlsSession, direction int, segment *payload.Segment, record []byte) bool {
+	if !session.deriveKeys(d.keyLog) {
+		return false
+	}
+	dir := session.directions[direction]
+
+	contentType, plaintext, ok := dir.keys.open(record, dir.recordSeq, session.version)
+	if !ok && session.version == tlsVersion13 && !dir.synced {
+		// encrypted with the handshake keys, which are not required to decrypt application data
+		return true
+	}
+	dir.synced = true
+	dir.recordSeq += 1
+	if ok && contentType == tlsRecordTypeApplicationData && len(plaintext) > 0 {
+		d.deliver(session, direction, segment, plaintext)
+	}
+	return true
+}
+
+func (d *TLSDecrypter) onHandshake(session *tlsSession, direction int, record []byte) bool {
+	msgType, body, complete, ok := readHandshake(record)
+	if !complete || !ok || len(body) < 34 {
+		return true
+	}
+
+	switch {
+	case direction == tlsClient && msgType == tlsHandshakeClientHello && session.clientRandom == nil:
+		session.clientRandom = bytes.Clone(body[2:34])
+
+	case direction == tlsServer && msgType == tlsHandshakeServerHello && session.serverRandom == nil:
+		if bytes.Equal(body[2:34], helloRetryRequestRandom) {
+			return true
+		}
+		hello, ok := parseServerHello(body)
+		if !ok {
+			return false
+		}
+		suite, ok := tlsCipherSuites[hello.cipher]
+		if !ok || session.clientRandom == nil {
+			return false
+		}
+		session.serverRandom = bytes.Clone(body[2:34])
+		session.version = hello.negotiatedVersion()
+		session.suite = suite
+		if session.version == tlsVersion13 {
+			session.directions[tlsClient].encrypted = true
+			session.directions[tlsServer].encrypted = true
+		}
+	}
+	return true
+}
+
+// onRecord returns `false` if the session cannot be decrypted.
+func (d *TLSDecrypter) onRecord(session *tlsSession, direction int, segment *payload.Segment, record []byte) bool {
+	dir := session.directions[direction]
+	recordType := record[0]
+
+	switch {
+	case dir.encrypted && (session.version != tlsVersion13 || recordType == tlsRecordTypeApplicationData):
+		if len(dir.pending) > 0 || !d.decrypt(session, direction, segment, record) {
+			if len(dir.pending) >= tlsMaxPending {
+				return false
+			}
+			header := *segment
+			header.Payload = nil
+			dir.pending = append(dir.pending, &tlsPendingRecord{segment: &header, record: bytes.Clone(record)})
+		}
+		return true
+
+	case recordType == tlsRecordTypeChangeCipherSpec:
+		// TLS 1.3 peers may send it for middlebox compatibility; it must be ignored
+		if session.version != 0 && session.version != tlsVersion13 {
+			dir.encrypted = true
+		}
+		return true
+
+	case recordType == tlsRecordTypeHandshake:
+		return d.onHandshake(session, direction, record)
+	}
+	return true
+}
+
+// flushPending decrypts the records which were buffered until their secrets became available;
+// records sent by the client are handed over first, so that requests are seen before their responses.
+func (d *TLSDecrypter) flushPending(session *tlsSession) {
+	for direction, dir := range session.directions {
+		for len(dir.pending) > 0 && d.decrypt(session, direction, dir.pending[0].segment, dir.pending[0].record) {
+			dir.pending = dir.pending[1:]
+		}
+	}
+}
+
+func (d *TLSDecrypter) feed(session *tlsSession, direction int, segment *payload.Segment) bool {
+	dir := session.directions[direction]
+	if ok, gap := dir.sequence.next(segment); !ok {
+		return true
+	} else if gap {
+		// records cannot be delimited after segments are lost
+		return false
+	}
+
+	d.flushPending(session)
+
+	dir.buffer = append(dir.buffer, segment.Payload...)
+	for len(dir.buffer) >= tlsRecordHeaderSize {
+		recordLen := int(binary.BigEndian.Uint16(dir.buffer[3:5]))
+		if dir.buffer[1] != 0x03 || recordLen > tlsMaxCiphertextLen {
+			return false
+		}
+		if len(dir.buffer) < tlsRecordHeaderSize+recordLen {
+			break
+		}
+		if !d.onRecord(session, direction, segment, dir.buffer[:tlsRecordHeaderSize+recordLen]) {
+			return false
+		}
+		dir.buffer = dir.buffer[tlsRecordHeaderSize+recordLen:]
+	}
+	// records are copied only if they must be kept
+	dir.buffer = bytes.Clone(dir.buffer)
+	return true
+}
+
+func (d *TLSDecrypter) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.timeout {
+		return
+	}
+	d.lastSweep = now
+	for key, session := range d.sessions {
+		if now.Sub(session.lastSeen) > d.timeout {
+			delete(d.sessions, key)
+		}
+	}
+}
+
+// close tells the analyzer of the session that its connection is done.
+func (d *TLSDecrypter) close(session *tlsSession, direction int, segment *payload.Segment) {
+	if session.target == nil {
+		return
+	}
+	closing := *segment
+	closing.Seq, closing.SYN, closing.Payload = session.directions[direction].plainSeq, false, nil
+	session.target.Analyze(&closing)
+}
+
+func (d *TLSDecrypter) Analyze(segment *payload.Segment) {
+	d.sweep(segment.Timestamp)
+
+	var key string
+	direction := tlsClient
+	if _, ok := d.ports[segment.DstPort]; ok {
+		key = flowKey(segment.SrcIP, segment.SrcPort, segment.DstIP, segment.DstPort)
+	} else if _, ok := d.ports[segment.SrcPort]; ok {
+		key = flowKey(segment.DstIP, segment.DstPort, segment.SrcIP, segment.SrcPort)
+		direction = tlsServer
+	} else {
+		return
+	}
+
+	session, ok := d.sessions[key]
+	if !ok {
+		// secrets are identified by the `ClientHello` random
+		if direction != tlsClient || !(segment.SYN || isHandshakeRecord(segment.Payload)) {
+			return
+		}
+		session = &tlsSession{directions: [2]*tlsDirection{{plainSeq: 1}, {plainSeq: 1}}}
+		d.sessions[key] = session
+	}
+	session.lastSeen = segment.Timestamp
+
+	if len(segment.Payload) > 0 && !d.feed(session, direction, segment) {
+		// a synthetic reset lets analyzers report whatever was pending
+		segment = &payload.Segment{
+			Timestamp: segment.Timestamp, SrcIP: segment.SrcIP, DstIP: segment.DstIP,
+			SrcPort: segment.SrcPort, DstPort: segment.DstPort, RST: true,
+		}
+	}
+
+	if segment.FIN || segment.RST {
+		d.close(session, direction, segment)
+	}
+	if segment.RST {
+		delete(d.sessions, key)
+	}
+}
+
+// NewTLSDecrypter creates an analyzer which decrypts the TLS sessions of the servers listening on `ports` using the
+// secrets in `keyLog`; plaintext is handed over to `http`, or to `h2` if it starts with the HTTP/2 connection preface.
+// Both analyzers must be tracking the same `ports`, and either may be `nil`. Sessions which are not active for
+// `timeout` are discarded.
+func NewTLSDecrypter(ports []uint16, keyLog *KeyLog, timeout time.Duration, http, h2 payload.Analyzer) *TLSDecrypter {
+	portSet := make(map[uint16]struct{}, len(ports))
+	for _, port := range ports {
+		portSet[port] = struct{}{}
+	}
+	return &TLSDecrypter{
+		ports:    portSet,
+		keyLog:   keyLog,
+		http:     http,
+		h2:       h2,
+		sessions: make(map[string]*tlsSession),
+		timeout:  timeout,
+	}
+}
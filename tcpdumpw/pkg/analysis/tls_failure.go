@@ -0,0 +1,261 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+)
+
+type (
+	// TLSFailureHandler is invoked for every TLS handshake which does not complete.
+	TLSFailureHandler func(failure *TLSFailure)
+
+	// TLSFailure describes a TLS handshake which ended with a fatal alert, or which was torn down before it completed.
+	TLSFailure struct {
+		Iface  string `json:"iface"`
+		Client string `json:"client"`
+		Server string `json:"server"`
+		SNI    string `json:"sni,omitempty"`
+		// negotiated version; empty if the `ServerHello` was not captured
+		Version string `json:"version,omitempty"`
+		JA4     string `json:"ja4"`
+		Reason  string `json:"reason"`
+		// name of the fatal alert; only available for cleartext alerts
+		Alert string `json:"alert,omitempty"`
+		// peer which sent the alert or tore down the connection: `client` or `server`
+		Sender string `json:"sender"`
+		// the reason is inferred from when the client gave up, rather than from a cleartext alert
+		Heuristic bool      `json:"heuristic,omitempty"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	// tlsHandshake follows the records exchanged after a `ClientHello` until the handshake completes.
+	tlsHandshake struct {
+		record      *TLSRecord
+		version     uint16
+		serverHello bool
+		clientCCS   bool
+		serverCCS   bool
+	}
+)
+
+const (
+	TLSFailureVersionMismatch = "version_mismatch"
+	TLSFailureSNIRejected     = "sni_rejected"
+	TLSFailureCertificate     = "certificate_rejected"
+	TLSFailureHandshake       = "handshake_failure"
+	TLSFailureAlert           = "alert"
+	TLSFailureAborted         = "aborted"
+)
+
+const (
+	tlsRecordTypeChangeCipherSpec = 0x14
+	tlsRecordTypeAlert            = 0x15
+	tlsRecordTypeApplicationData  = 0x17
+
+	tlsAlertLevelFatal = 2
+	// size of an alert encrypted using AEAD: 2 bytes of alert, 1 byte of inner content type and 16 bytes of tag
+	tlsEncryptedAlertSize = 19
+
+	// destinations beyond this amount are aggregated, so that failure counters have a bounded cardinality
+	maxTLSFailureDestinations = 100
+	otherTLSDestinations      = "other"
+)
+
+// see: https://www.iana.org/assignments/tls-parameters/tls-parameters.xhtml#tls-parameters-6
+var tlsAlertNames = map[uint8]string{
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	40:  "handshake_failure",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	112: "unrecognized_name",
+	113: "bad_certificate_status_response",
+	116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+func tlsAlertName(description uint8) string {
+	if name, ok := tlsAlertNames[description]; ok {
+		return name
+	}
+	return fmt.Sprintf("alert_%d", description)
+}
+
+func classifyTLSAlert(description uint8) string {
+	switch description {
+	case 70, 86:
+		return TLSFailureVersionMismatch
+	case 112:
+		return TLSFailureSNIRejected
+	case 42, 43, 44, 45, 46, 48, 113, 116:
+		return TLSFailureCertificate
+	case 40, 71:
+		return TLSFailureHandshake
+	}
+	return TLSFailureAlert
+}
+
+// forEachRecord invokes `onRecord` with the type, declared length and available body of every TLS record in `data`,
+// until it returns `false`; records are only found if `data` starts at a record boundary, which is the case for
+// the short flights which complete or abort handshakes.
+func forEachRecord(data []byte, onRecord func(recordType uint8, length int, body []byte) bool) {
+	for len(data) >= tlsRecordHeaderSize {
+		recordType := data[0]
+		if recordType < tlsRecordTypeChangeCipherSpec || recordType > tlsRecordTypeApplicationData || data[1] != 0x03 {
+			return
+		}
+		length := int(data[3])<<8 | int(data[4])
+		end := min(tlsRecordHeaderSize+length, len(data))
+		if !onRecord(recordType, length, data[tlsRecordHeaderSize:end]) || end == len(data) {
+			return
+		}
+		data = data[end:]
+	}
+}
+
+func (a *TLSAnalyzer) countFailure(failure *TLSFailure) {
+	destination := failure.SNI
+	if destination == "" {
+		destination = failure.Server
+	}
+
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	if _, ok := a.failures[destination]; !ok && len(a.failures) >= maxTLSFailureDestinations {
+		destination = otherTLSDestinations
+	}
+	reasons, ok := a.failures[destination]
+	if !ok {
+		reasons = make(map[string]uint64)
+		a.failures[destination] = reasons
+	}
+	reasons[failure.Reason] += 1
+}
+
+// TakeFailures returns the amount of failed handshakes per destination and reason since the previous invocation;
+// destinations are SNIs, or server addresses if the client did not send an SNI.
+func (a *TLSAnalyzer) TakeFailures() map[string]map[string]uint64 {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	failures := a.failures
+	a.failures = make(map[string]map[string]uint64)
+	return failures
+}
+
+func (a *TLSAnalyzer) fail(flow string, handshake *tlsHandshake, ts time.Time, reason, alert, sender string, heuristic bool) {
+	delete(a.handshakes, flow)
+	// handshakes rejected before the `ServerHello` must not be reported as timed out
+	delete(a.pending, flow)
+
+	record := handshake.record
+	failure := &TLSFailure{
+		Iface:     record.Iface,
+		Client:    record.Client,
+		Server:    record.Server,
+		SNI:       record.SNI,
+		Version:   record.Version,
+		JA4:       record.JA4,
+		Reason:    reason,
+		Alert:     alert,
+		Sender:    sender,
+		Heuristic: heuristic,
+		Timestamp: ts,
+	}
+	a.countFailure(failure)
+	if a.onFailure != nil {
+		a.onFailure(failure)
+	}
+}
+
+// track follows the records exchanged by both peers of a handshake, until it completes or fails.
+func (a *TLSAnalyzer) track(flow string, segment *payload.Segment) {
+	fromClient := true
+	handshake, ok := a.handshakes[flow]
+	if !ok {
+		fromClient = false
+		flow = flowKey(segment.DstIP, segment.DstPort, segment.SrcIP, segment.SrcPort)
+		if handshake, ok = a.handshakes[flow]; !ok {
+			return
+		}
+	}
+	sender := "server"
+	if fromClient {
+		sender = "client"
+	}
+
+	done := false
+	forEachRecord(segment.Payload, func(recordType uint8, length int, body []byte) bool {
+		switch recordType {
+		case tlsRecordTypeAlert:
+			// alerts are only readable until keys are established
+			if length == 2 && len(body) == 2 && body[0] == tlsAlertLevelFatal {
+				a.fail(flow, handshake, segment.Timestamp, classifyTLSAlert(body[1]), tlsAlertName(body[1]), sender, false)
+				done = true
+			}
+		case tlsRecordTypeChangeCipherSpec:
+			// TLS 1.3 peers send it only for compatibility with middleboxes
+			handshake.clientCCS = handshake.clientCCS || fromClient
+			handshake.serverCCS = handshake.serverCCS || !fromClient
+			if handshake.version < tls.VersionTLS13 && handshake.clientCCS && handshake.serverCCS {
+				delete(a.handshakes, flow)
+				done = true
+			}
+		case tlsRecordTypeApplicationData:
+			// early data may be sent before the `ServerHello`, and servers encrypt their TLS 1.3 handshake messages
+			if !handshake.serverHello || !fromClient && handshake.version >= tls.VersionTLS13 {
+				break
+			}
+			// a TLS 1.3 client which sends an alert instead of its `Finished` rejected the server certificate
+			if fromClient && handshake.version >= tls.VersionTLS13 && length == tlsEncryptedAlertSize {
+				a.fail(flow, handshake, segment.Timestamp, TLSFailureCertificate, "", sender, true)
+			} else {
+				delete(a.handshakes, flow)
+			}
+			done = true
+		}
+		return !done
+	})
+
+	if done || !segment.FIN && !segment.RST {
+		return
+	}
+	// clients which give up right after receiving the server certificate most likely did not trust it
+	if fromClient && handshake.serverHello {
+		a.fail(flow, handshake, segment.Timestamp, TLSFailureCertificate, "", sender, true)
+		return
+	}
+	a.fail(flow, handshake, segment.Timestamp, TLSFailureAborted, "", sender, false)
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// TraceTable remembers the Cloud Trace span of the last request seen on every connection,
+	// so that the rest of its packets and its flow records can be joined to the trace; it is safe for concurrent use.
+	TraceTable struct {
+		mu        sync.Mutex
+		project   string
+		ttl       time.Duration
+		conns     map[string]*tracedConn
+		lastSweep time.Time
+	}
+
+	tracedConn struct {
+		trace    string
+		span     string
+		lastSeen time.Time
+	}
+)
+
+const (
+	cloudTraceContextHeader = "x-cloud-trace-context"
+	traceparentHeader       = "traceparent"
+
+	// connections beyond this amount are not correlated until others expire
+	maxTracedConns = 50000
+)
+
+// parseTraceHeader returns the trace and span ids carried by either `X-Cloud-Trace-Context` or `traceparent`;
+// see: https://cloud.google.com/trace/docs/trace-context and https://www.w3.org/TR/trace-context/#traceparent-header
+func parseTraceHeader(name, value string) (string, string, bool) {
+	switch name {
+	case cloudTraceContextHeader:
+		// TRACE_ID/SPAN_ID;o=OPTIONS
+		value, _, _ = strings.Cut(value, ";")
+		trace, span, found := strings.Cut(value, "/")
+		if !found || trace == "" || span == "" {
+			return "", "", false
+		}
+		return trace, span, true
+	case traceparentHeader:
+		// VERSION-TRACE_ID-PARENT_ID-FLAGS
+		parts := strings.Split(value, "-")
+		if len(parts) < 4 || parts[1] == "" || parts[2] == "" {
+			return "", "", false
+		}
+		return parts[1], parts[2], true
+	}
+	return "", "", false
+}
+
+// traceKey identifies both directions of a connection.
+func traceKey(src, dst string) string {
+	if src > dst {
+		src, dst = dst, src
+	}
+	return src + "|" + dst
+}
+
+// sweep forgets connections which are idle; must be called while holding `t.mu`.
+func (t *TraceTable) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < sweepInterval {
+		return
+	}
+	t.lastSweep = now
+	for key, conn := range t.conns {
+		if now.Sub(conn.lastSeen) > t.ttl {
+			delete(t.conns, key)
+		}
+	}
+}
+
+// Resource returns the trace as a resource name, as expected by Cloud Logging; it is returned as is if it already is one.
+func (t *TraceTable) Resource(trace string) string {
+	if t.project == "" || strings.HasPrefix(trace, "projects/") {
+		return trace
+	}
+	return fmt.Sprintf("projects/%s/traces/%s", t.project, trace)
+}
+
+// Set correlates the connection between `src` and `dst`, in any order, with the given span;
+// `trace` may either be a trace id or its resource name.
+func (t *TraceTable) Set(src, dst, trace, span string) {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(now)
+
+	key := traceKey(src, dst)
+	conn, ok := t.conns[key]
+	if !ok {
+		if len(t.conns) >= maxTracedConns {
+			return
+		}
+		conn = &tracedConn{}
+		t.conns[key] = conn
+	}
+	conn.trace = t.Resource(trace)
+	conn.span = span
+	conn.lastSeen = now
+}
+
+// Lookup returns the trace resource name and span id correlated with the connection between `src` and `dst`, in any order.
+func (t *TraceTable) Lookup(src, dst string) (string, string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conn, ok := t.conns[traceKey(src, dst)]
+	if !ok {
+		return "", "", false
+	}
+	// connections are correlated for as long as their packets are seen
+	conn.lastSeen = time.Now()
+	return conn.trace, conn.span, true
+}
+
+// NewTraceTable creates a table which correlates connections with traces of `project`,
+// until they are not seen for `ttl`; `project` may be empty, in which case only trace ids are available.
+func NewTraceTable(project string, ttl time.Duration) *TraceTable {
+	return &TraceTable{
+		project: project,
+		ttl:     ttl,
+		conns:   make(map[string]*tracedConn),
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/payload"
+)
+
+type (
+	// WebSocketHandler is invoked for every WebSocket session, once its TCP connection is closed or idle.
+	WebSocketHandler func(session *WebSocketSession)
+
+	// WebSocketSession summarizes the frames exchanged through a connection upgraded to WebSocket;
+	// `CloseCode` is `1006` if the connection was torn down without a close frame, and it is not available for idle connections.
+	WebSocketSession struct {
+		Iface        string           `json:"iface"`
+		Client       string           `json:"client"`
+		Server       string           `json:"server"`
+		Host         string           `json:"host,omitempty"`
+		Path         string           `json:"path"`
+		ClientFrames *WebSocketFrames `json:"client_frames"`
+		ServerFrames *WebSocketFrames `json:"server_frames"`
+		CloseCode    int              `json:"close_code,omitempty"`
+		CloseReason  string           `json:"close_reason,omitempty"`
+		// peer which sent the 1st close frame: `client` or `server`; empty if no close frame was captured
+		ClosedBy string `json:"closed_by,omitempty"`
+		// how the TCP connection ended: `fin`, `reset` or `idle`
+		Ended    string  `json:"ended"`
+		Duration float64 `json:"duration_ms"`
+		// frames are not decoded after segments are lost, so counters are incomplete
+		Incomplete bool      `json:"incomplete,omitempty"`
+		Timestamp  time.Time `json:"timestamp"`
+	}
+
+	// WebSocketFrames counts the frames sent by one peer; `Bytes` are payload bytes, not including frame headers.
+	WebSocketFrames struct {
+		Frames       uint64 `json:"frames"`
+		Bytes        uint64 `json:"bytes"`
+		Text         uint64 `json:"text"`
+		Binary       uint64 `json:"binary"`
+		Continuation uint64 `json:"continuation"`
+		Ping         uint64 `json:"ping"`
+		Pong         uint64 `json:"pong"`
+		MaxFrameSize uint64 `json:"max_frame_size"`
+	}
+
+	// wsSession decodes both directions of a connection upgraded to WebSocket
+	wsSession struct {
+		session *WebSocketSession
+		client  *wsFrameReader
+		server  *wsFrameReader
+	}
+
+	// wsFrameReader decodes the frames sent in one direction of a WebSocket connection;
+	// the payload of data frames is skipped, and decoding stops as soon as segments are lost.
+	wsFrameReader struct {
+		sender    string
+		sequence  tcpSequence
+		broken    bool
+		buf       []byte
+		remaining uint64
+		frames    *WebSocketFrames
+		onClose   func(sender string, code int, reason string)
+	}
+)
+
+const (
+	WebSocketEndedFIN   = "fin"
+	WebSocketEndedReset = "reset"
+	WebSocketEndedIdle  = "idle"
+)
+
+// see: https://datatracker.ietf.org/doc/html/rfc6455#section-5.2
+const (
+	wsOpcodeContinuation = 0x0
+	wsOpcodeText         = 0x1
+	wsOpcodeBinary       = 0x2
+	wsOpcodeClose        = 0x8
+	wsOpcodePing         = 0x9
+	wsOpcodePong         = 0xa
+
+	wsMaxControlPayload = 125
+	wsMaskSize          = 4
+
+	// see: https://datatracker.ietf.org/doc/html/rfc6455#section-7.4.1
+	wsCloseNoStatus = 1005
+	wsCloseAbnormal = 1006
+)
+
+func (f *WebSocketFrames) count(opcode uint8, size uint64) {
+	f.Frames += 1
+	f.Bytes += size
+	f.MaxFrameSize = max(f.MaxFrameSize, size)
+	switch opcode {
+	case wsOpcodeContinuation:
+		f.Continuation += 1
+	case wsOpcodeText:
+		f.Text += 1
+	case wsOpcodeBinary:
+		f.Binary += 1
+	case wsOpcodePing:
+		f.Ping += 1
+	case wsOpcodePong:
+		f.Pong += 1
+	}
+}
+
+// readFrame decodes the frame at the start of `r.buf`, and returns the amount of bytes it consumed;
+// `0` if more bytes are required, and `false` if the data is not a WebSocket frame.
+func (r *wsFrameReader) readFrame() (int, bool) {
+	buf := r.buf
+	if len(buf) < 2 {
+		return 0, true
+	}
+	opcode := buf[0] & 0x0f
+	masked := buf[1]&0x80 != 0
+	size := uint64(buf[1] & 0x7f)
+
+	headerSize := 2
+	switch size {
+	case 126:
+		headerSize += 2
+	case 127:
+		headerSize += 8
+	}
+	if masked {
+		headerSize += wsMaskSize
+	}
+	if len(buf) < headerSize {
+		return 0, true
+	}
+	switch size {
+	case 126:
+		size = uint64(binary.BigEndian.Uint16(buf[2:4]))
+	case 127:
+		size = binary.BigEndian.Uint64(buf[2:10])
+	}
+
+	switch opcode {
+	case wsOpcodeContinuation, wsOpcodeText, wsOpcodeBinary:
+		// data frames are not buffered
+		r.frames.count(opcode, size)
+		available := min(uint64(len(buf)-headerSize), size)
+		r.remaining = size - available
+		return headerSize + int(available), true
+
+	case wsOpcodeClose, wsOpcodePing, wsOpcodePong:
+		if size > wsMaxControlPayload {
+			return 0, false
+		}
+		end := headerSize + int(size)
+		if len(buf) < end {
+			return 0, true
+		}
+		r.frames.count(opcode, size)
+		if opcode == wsOpcodeClose {
+			body := append([]byte{}, buf[headerSize:end]...)
+			if masked {
+				mask := buf[headerSize-wsMaskSize : headerSize]
+				for i := range body {
+					body[i] ^= mask[i%wsMaskSize]
+				}
+			}
+			code := wsCloseNoStatus
+			reason := ""
+			if len(body) >= 2 {
+				code = int(binary.BigEndian.Uint16(body))
+				reason = string(body[2:])
+			}
+			r.onClose(r.sender, code, reason)
+		}
+		return end, true
+	}
+	return 0, false
+}
+
+func (r *wsFrameReader) consume(data []byte) {
+	for len(data) > 0 && !r.broken {
+		if r.remaining > 0 {
+			n := min(uint64(len(data)), r.remaining)
+			r.remaining -= n
+			data = data[n:]
+			continue
+		}
+		r.buf = append(r.buf, data...)
+		n, ok := r.readFrame()
+		if !ok {
+			r.broken = true
+			r.buf = nil
+			return
+		}
+		if n == 0 {
+			return
+		}
+		data = r.buf[n:]
+		r.buf = nil
+	}
+}
+
+func (r *wsFrameReader) feed(segment *payload.Segment) {
+	ok, gap := r.sequence.next(segment)
+	if !ok {
+		return
+	}
+	// frames cannot be resynchronized
+	if gap {
+		r.broken = true
+		r.buf = nil
+	}
+	r.consume(segment.Payload)
+}
+
+func newWSFrameReader(sender string, sequence tcpSequence, onClose func(sender string, code int, reason string)) *wsFrameReader {
+	return &wsFrameReader{
+		sender:   sender,
+		sequence: sequence,
+		frames:   &WebSocketFrames{},
+		onClose:  onClose,
+	}
+}
+
+func (s *wsSession) onClose(sender string, code int, reason string) {
+	// the 1st close frame tells who closed the connection, the other one is an echo
+	if s.session.ClosedBy != "" {
+		return
+	}
+	s.session.ClosedBy = sender
+	s.session.CloseCode = code
+	s.session.CloseReason = reason
+}
+
+func (s *wsSession) feed(fromServer bool, segment *payload.Segment) {
+	if fromServer {
+		s.server.feed(segment)
+	} else {
+		s.client.feed(segment)
+	}
+}
+
+// newWebSocket starts decoding the frames of `conn` after the server accepted the upgrade requested by `request`.
+func (a *HTTPAnalyzer) newWebSocket(conn *httpConn, request, response *httpMessage) *wsSession {
+	ws := &wsSession{
+		session: &WebSocketSession{
+			Iface:     *a.iface,
+			Client:    conn.client,
+			Server:    conn.server,
+			Host:      request.host,
+			Path:      request.path,
+			Timestamp: response.end,
+		},
+	}
+	// frames are decoded from where HTTP/1.x messages ended
+	ws.client = newWSFrameReader("client", conn.requests.sequence, ws.onClose)
+	ws.server = newWSFrameReader("server", conn.response.sequence, ws.onClose)
+	ws.session.ClientFrames = ws.client.frames
+	ws.session.ServerFrames = ws.server.frames
+	return ws
+}
+
+func (a *HTTPAnalyzer) endWebSocket(ws *wsSession, ended string, ts time.Time) {
+	session := ws.session
+	session.Ended = ended
+	session.Duration = toMillis(ts.Sub(session.Timestamp))
+	session.Incomplete = ws.client.broken || ws.server.broken
+	if session.ClosedBy == "" && ended != WebSocketEndedIdle {
+		session.CloseCode = wsCloseAbnormal
+	}
+	a.onWebSocket(session)
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package anonymize
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+type (
+	// Anonymizer replaces IP addresses using Crypto-PAn: the mapping is prefix-preserving, so that any 2 addresses which
+	// share a `k` bits prefix are anonymized into addresses which also share a `k` bits prefix; as long as the same key
+	// is used, every address is always anonymized into the same one. IPv6 addresses are anonymized using all their 128 bits.
+	// See: https://doi.org/10.1016/j.comnet.2004.03.033
+	Anonymizer struct {
+		block cipher.Block
+		pad   [aes.BlockSize]byte
+
+		mu    sync.Mutex
+		cache map[netip.Addr]netip.Addr
+	}
+)
+
+const (
+	// the 1st half is the AES key, the 2nd half is encrypted to pad addresses
+	KeySize = 2 * aes.BlockSize
+	// every address requires as many AES operations as its bits
+	maxCachedAddrs = 1 << 16
+)
+
+// ParseKey decodes a key of 32 bytes given as is, hex encoded or base64 encoded.
+func ParseKey(rawKey []byte) ([]byte, error) {
+	key := strings.TrimSpace(string(rawKey))
+	switch {
+	case len(key) == KeySize:
+		return []byte(key), nil
+	case len(key) == 2*KeySize:
+		if decoded, err := hex.DecodeString(key); err == nil {
+			return decoded, nil
+		}
+	default:
+		if decoded, err := base64.StdEncoding.DecodeString(key); err == nil && len(decoded) == KeySize {
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("anonymization keys must be %d bytes long, either raw, hex or base64 encoded", KeySize)
+}
+
+// anonymize applies Crypto-PAn to `addr`: the `n`th bit of the address is flipped if the 1st bit of the AES
+// encryption of its first `n-1` bits, padded with the bits of the pad which follow them, is set.
+func (a *Anonymizer) anonymize(addr []byte) []byte {
+	anonymized := make([]byte, len(addr))
+	input := make([]byte, aes.BlockSize)
+	output := make([]byte, aes.BlockSize)
+
+	for bit := 0; bit < 8*len(addr); bit++ {
+		copy(input, a.pad[:])
+		whole := bit / 8
+		copy(input[:whole], addr[:whole])
+		if partial := bit % 8; partial > 0 {
+			mask := byte(0xff << (8 - partial))
+			input[whole] = (addr[whole] & mask) | (a.pad[whole] &^ mask)
+		}
+		a.block.Encrypt(output, input)
+		anonymized[whole] |= (output[0] >> 7) << (7 - bit%8)
+	}
+
+	for i := range anonymized {
+		anonymized[i] ^= addr[i]
+	}
+	return anonymized
+}
+
+// Addr returns the anonymized version of `addr`; IPv4-mapped IPv6 addresses are anonymized as IPv4 addresses.
+func (a *Anonymizer) Addr(addr netip.Addr) netip.Addr {
+	addr = addr.WithZone("")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if anonymized, ok := a.cache[addr]; ok {
+		return anonymized
+	}
+
+	var anonymized netip.Addr
+	if addr.Is4In6() {
+		unmapped := addr.Unmap().As4()
+		anonymized = netip.AddrFrom16(netip.AddrFrom4([4]byte(a.anonymize(unmapped[:]))).As16())
+	} else {
+		anonymized, _ = netip.AddrFromSlice(a.anonymize(addr.AsSlice()))
+	}
+
+	if len(a.cache) >= maxCachedAddrs {
+		clear(a.cache)
+	}
+	a.cache[addr] = anonymized
+	return anonymized
+}
+
+// NewAnonymizer creates an anonymizer from a key of `KeySize` bytes.
+func NewAnonymizer(key []byte) (*Anonymizer, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("anonymization keys must be %d bytes long", KeySize)
+	}
+
+	block, err := aes.NewCipher(key[:aes.BlockSize])
+	if err != nil {
+		return nil, err
+	}
+
+	anonymizer := &Anonymizer{
+		block: block,
+		cache: make(map[netip.Addr]netip.Addr),
+	}
+	block.Encrypt(anonymizer.pad[:], key[aes.BlockSize:])
+	return anonymizer, nil
+}
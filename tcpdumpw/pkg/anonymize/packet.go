@@ -0,0 +1,211 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package anonymize
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ipv4AddrSize = 4
+	ipv6AddrSize = 16
+	ipv6HdrSize  = 40
+)
+
+// pseudoHeader holds the addresses of an IP header before and after they were anonymized,
+// as transport checksums cover them.
+type pseudoHeader struct {
+	original   []byte
+	anonymized []byte
+}
+
+// onesSum returns the folded one's complement sum of `data` as 16 bits words.
+func onesSum(data []byte) uint32 {
+	sum := uint32(0)
+	for i := 0; i < len(data); i += 2 {
+		if i+1 < len(data) {
+			sum += uint32(binary.BigEndian.Uint16(data[i:]))
+		} else {
+			sum += uint32(data[i]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return sum
+}
+
+// updateChecksum incrementally updates the checksum at `data[offset:]` after `original` was replaced by `updated`;
+// which allows to fix checksums of truncated packets. See: https://datatracker.ietf.org/doc/html/rfc1624#section-3
+func updateChecksum(data []byte, offset int, original, updated []byte) {
+	if offset+2 > len(data) {
+		return
+	}
+	sum := uint32(^binary.BigEndian.Uint16(data[offset:]))
+	sum += ^onesSum(original) & 0xffff
+	sum += onesSum(updated)
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	binary.BigEndian.PutUint16(data[offset:], ^uint16(sum))
+}
+
+// replace anonymizes the address of `size` bytes at `data[offset:]` in place.
+func (a *Anonymizer) replace(data []byte, offset, size int, pseudo *pseudoHeader) bool {
+	if offset+size > len(data) {
+		return false
+	}
+	original := slices.Clone(data[offset : offset+size])
+	addr, _ := netip.AddrFromSlice(original)
+	anonymized := a.Addr(addr).AsSlice()
+	copy(data[offset:], anonymized)
+	pseudo.original = append(pseudo.original, original...)
+	pseudo.anonymized = append(pseudo.anonymized, anonymized...)
+	return true
+}
+
+// rewriteIPv4 anonymizes the IPv4 header at `data[offset:]`; it returns the offset of its transport header,
+// which is `-1` for fragments other than the 1st one as they do not carry it.
+func (a *Anonymizer) rewriteIPv4(data []byte, offset int, pseudo *pseudoHeader) (uint8, int) {
+	if offset+20 > len(data) {
+		return 0, -1
+	}
+	a.replace(data, offset+12, ipv4AddrSize, pseudo)
+	a.replace(data, offset+16, ipv4AddrSize, pseudo)
+	updateChecksum(data, offset+10, pseudo.original, pseudo.anonymized)
+
+	if binary.BigEndian.Uint16(data[offset+6:])&0x1fff != 0 {
+		return 0, -1
+	}
+	return data[offset+9], offset + int(data[offset]&0x0f)*4
+}
+
+// rewriteIPv6 anonymizes the IPv6 header at `data[offset:]`; it returns the offset of its transport header
+// after skipping all extension headers, which is `-1` if it is not available.
+func (a *Anonymizer) rewriteIPv6(data []byte, offset int, pseudo *pseudoHeader) (uint8, int) {
+	if !a.replace(data, offset+8, ipv6AddrSize, pseudo) || !a.replace(data, offset+24, ipv6AddrSize, pseudo) {
+		return 0, -1
+	}
+
+	next, offset := data[offset+6], offset+ipv6HdrSize
+	for offset+8 <= len(data) {
+		switch layers.IPProtocol(next) {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			next, offset = data[offset], offset+(int(data[offset+1])+1)*8
+		case layers.IPProtocolIPv6Fragment:
+			if binary.BigEndian.Uint16(data[offset+2:])&0xfff8 != 0 {
+				return 0, -1
+			}
+			next, offset = data[offset], offset+8
+		default:
+			return next, offset
+		}
+	}
+	return 0, -1
+}
+
+// rewriteIP anonymizes the addresses of the IP packet at `data[offset:]` and fixes all the checksums which cover them;
+// packets quoted by ICMP errors are anonymized as well, but only at the outermost level.
+func (a *Anonymizer) rewriteIP(data []byte, offset int, quoted bool) {
+	if offset >= len(data) {
+		return
+	}
+
+	pseudo := &pseudoHeader{}
+	proto, l4 := uint8(0), -1
+	switch data[offset] >> 4 {
+	case 4:
+		proto, l4 = a.rewriteIPv4(data, offset, pseudo)
+	case 6:
+		proto, l4 = a.rewriteIPv6(data, offset, pseudo)
+	}
+	if l4 < 0 || l4 >= len(data) {
+		return
+	}
+
+	switch layers.IPProtocol(proto) {
+	case layers.IPProtocolTCP:
+		updateChecksum(data, l4+16, pseudo.original, pseudo.anonymized)
+	case layers.IPProtocolUDP:
+		// a zero checksum means that IPv4 UDP datagrams carry no checksum at all
+		if l4+8 <= len(data) && binary.BigEndian.Uint16(data[l4+6:]) != 0 {
+			updateChecksum(data, l4+6, pseudo.original, pseudo.anonymized)
+			if binary.BigEndian.Uint16(data[l4+6:]) == 0 {
+				binary.BigEndian.PutUint16(data[l4+6:], 0xffff)
+			}
+		}
+	case layers.IPProtocolICMPv4:
+		if !quoted && l4+8 < len(data) && isICMPv4Error(data[l4]) {
+			original := slices.Clone(data[l4:])
+			a.rewriteIP(data, l4+8, true)
+			updateChecksum(data, l4+2, original, data[l4:])
+		}
+	case layers.IPProtocolICMPv6:
+		// unlike ICMPv4, the checksum of ICMPv6 also covers the IPv6 pseudo header
+		updateChecksum(data, l4+2, pseudo.original, pseudo.anonymized)
+		if !quoted && l4+8 < len(data) && isICMPv6Error(data[l4]) {
+			original := slices.Clone(data[l4:])
+			a.rewriteIP(data, l4+8, true)
+			updateChecksum(data, l4+2, original, data[l4:])
+		}
+	}
+}
+
+// rewriteARP anonymizes the sender and target protocol addresses of IPv4 ARP packets.
+func (a *Anonymizer) rewriteARP(data []byte, offset int) {
+	if offset+8 > len(data) || data[offset+5] != ipv4AddrSize {
+		return
+	}
+	hwAddrSize := int(data[offset+4])
+	pseudo := &pseudoHeader{}
+	a.replace(data, offset+8+hwAddrSize, ipv4AddrSize, pseudo)
+	a.replace(data, offset+8+2*hwAddrSize+ipv4AddrSize, ipv4AddrSize, pseudo)
+}
+
+func isICMPv4Error(icmpType uint8) bool {
+	switch icmpType {
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeRedirect,
+		layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+func isICMPv6Error(icmpType uint8) bool {
+	return icmpType >= layers.ICMPv6TypeDestinationUnreachable && icmpType <= layers.ICMPv6TypeParameterProblem
+}
+
+// Rewrite anonymizes in place all IP addresses of the packet in `data`, which may be truncated:
+// addresses are replaced as long as they were captured, and the checksums which cover them are kept valid.
+func (a *Anonymizer) Rewrite(data []byte, linkType layers.LinkType) {
+	packet := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	for _, layer := range packet.Layers() {
+		// layers are not copied: their contents are slices of `data`
+		offset := cap(data) - cap(layer.LayerContents())
+		switch layer.LayerType() {
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			a.rewriteIP(data, offset, false)
+			return
+		case layers.LayerTypeARP:
+			a.rewriteARP(data, offset)
+			return
+		}
+	}
+}
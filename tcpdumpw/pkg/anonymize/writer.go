@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package anonymize
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// Writer anonymizes all IP addresses found in JSON translated packets, before writing them into the wrapped writer;
+	// addresses are anonymized as they are in PCAP files, so that both remain correlated.
+	Writer struct {
+		pcap.PcapWriter
+		anonymizer *Anonymizer
+	}
+
+	jsonL3Record struct {
+		L3 *struct {
+			Src string `json:"src"`
+			Dst string `json:"dst"`
+		} `json:"L3"`
+	}
+)
+
+// IPv4-mapped IPv6 addresses, IPv4 addresses, or anything that may be an IPv6 address; candidates are validated before being anonymized.
+var addrRegexp = regexp.MustCompile(`(?:[0-9A-Fa-f]*:){2,}(?:\d{1,3}\.){3}\d{1,3}|(?:\d{1,3}\.){3}\d{1,3}|[0-9A-Fa-f]*(?::[0-9A-Fa-f]*){2,}`)
+
+func isAddrChar(c byte) bool {
+	return c == '.' || c == ':' || c == '_' ||
+		('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// parseAddr returns the address at the beginning of `candidate` and its length; summaries format IPv6 sockets as `<ip>:<port>`,
+// so the addresses of the record are preferred to avoid confusing ports with the last group of their address.
+func parseAddr(candidate string, known ...string) (netip.Addr, int, bool) {
+	for _, addr := range known {
+		if addr != "" && (candidate == addr || strings.HasPrefix(candidate, addr+":")) {
+			parsed, err := netip.ParseAddr(addr)
+			return parsed, len(addr), err == nil
+		}
+	}
+	parsed, err := netip.ParseAddr(candidate)
+	return parsed, len(candidate), err == nil
+}
+
+func (w *Writer) anonymize(p []byte) []byte {
+	// records which cannot be decoded are still anonymized, as it does not depend on their structure
+	record := &jsonL3Record{}
+	known := []string{}
+	if err := json.Unmarshal(bytes.TrimRight(p, " \r\n"), record); err == nil && record.L3 != nil {
+		known = append(known, record.L3.Src, record.L3.Dst)
+	}
+
+	anonymized := make([]byte, 0, len(p))
+	last := 0
+	for _, match := range addrRegexp.FindAllIndex(p, -1) {
+		start, end := match[0], match[1]
+		// addresses are never part of a larger word, except IPv4 sockets: `<ip>:<port>`
+		if (start > 0 && isAddrChar(p[start-1])) || (end < len(p) && isAddrChar(p[end]) && p[end] != ':') {
+			continue
+		}
+		addr, length, ok := parseAddr(string(p[start:end]), known...)
+		if !ok {
+			continue
+		}
+		anonymized = append(anonymized, p[last:start]...)
+		anonymized = append(anonymized, w.anonymizer.Addr(addr).String()...)
+		last = start + length
+	}
+	return append(anonymized, p[last:]...)
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if _, err := w.PcapWriter.Write(w.anonymize(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewWriter creates a writer which anonymizes JSON translated packets using `anonymizer`;
+// `writer` is returned as is if `anonymizer` is `nil`.
+func NewWriter(writer pcap.PcapWriter, anonymizer *Anonymizer) pcap.PcapWriter {
+	if anonymizer == nil {
+		return writer
+	}
+	return &Writer{PcapWriter: writer, anonymizer: anonymizer}
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Actor identifies who triggered an action; credentials are only available for local clients, i/e: over Unix sockets.
+	Actor struct {
+		// how the action was requested; i/e: `control_socket`, `signal` or `metadata_server`
+		Source  string  `json:"source"`
+		PID     *int32  `json:"pid,omitempty"`
+		UID     *uint32 `json:"uid,omitempty"`
+		GID     *uint32 `json:"gid,omitempty"`
+		Process string  `json:"process,omitempty"`
+		Signal  string  `json:"signal,omitempty"`
+	}
+
+	// Record describes a control-plane action: who requested it, when, with which parameters, and its outcome.
+	Record struct {
+		Timestamp time.Time `json:"timestamp"`
+		Actor     *Actor    `json:"actor"`
+		Action    string    `json:"action"`
+		Params    []string  `json:"params,omitempty"`
+		Result    string    `json:"result,omitempty"`
+		Error     string    `json:"error,omitempty"`
+		Job       string    `json:"job,omitempty"`
+		// the execution which resulted from the action, or the one it affected
+		Execution string `json:"execution,omitempty"`
+	}
+
+	// entry is formatted as a structured log so that records written into standard output are collected by Cloud Logging,
+	// and can be told apart from all other entries by their `stream` label.
+	entry struct {
+		Severity string            `json:"severity"`
+		Message  string            `json:"message"`
+		Audit    *Record           `json:"audit"`
+		Labels   map[string]string `json:"logging.googleapis.com/labels"`
+	}
+
+	// Stream writes audit records as JSON lines into standard output or an append-only file;
+	// records are written synchronously, so that actions are never performed without being recorded.
+	Stream struct {
+		mu     sync.Mutex
+		writer io.Writer
+		file   *os.File
+		labels map[string]string
+	}
+)
+
+const (
+	SourceControlSocket  = "control_socket"
+	SourceSignal         = "signal"
+	SourceMetadataServer = "metadata_server"
+
+	// Stdout is the location of the stream which writes records into standard output
+	Stdout = "stdout"
+
+	streamLabel = "stream"
+	streamName  = "audit"
+	// audit records are not errors, but they must stand out from regular entries
+	severity = "NOTICE"
+	fileMode = 0o600
+)
+
+// ProcessName returns the name of the process `pid`, or an empty string if it is not visible; i/e: in another PID namespace.
+func ProcessName(pid int32) string {
+	comm, err := os.ReadFile("/proc/" + strconv.FormatInt(int64(pid), 10) + "/comm")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+func (r *Record) message() string {
+	message := "audit: " + r.Action + " by " + r.Actor.Source
+	if r.Error != "" {
+		return message + " | error: " + r.Error
+	}
+	return message
+}
+
+// Write records `record`; files are synced so that records survive crashes.
+func (s *Stream) Write(record *Record) error {
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now()
+	}
+	line, err := json.Marshal(&entry{
+		Severity: severity,
+		Message:  record.message(),
+		Audit:    record,
+		Labels:   s.labels,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.writer.Write(line); err != nil {
+		return err
+	}
+	if s.file != nil {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+func (s *Stream) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// NewStream creates a stream which writes records into standard output if `location` is `stdout`,
+// or appends them into the file at `location` otherwise; every record is labeled with `labels`.
+func NewStream(location string, labels map[string]string) (*Stream, error) {
+	streamLabels := map[string]string{streamLabel: streamName}
+	for key, value := range labels {
+		if value != "" {
+			streamLabels[key] = value
+		}
+	}
+
+	if location == Stdout {
+		return &Stream{writer: os.Stdout, labels: streamLabels}, nil
+	}
+
+	file, err := os.OpenFile(location, os.O_WRONLY|os.O_CREATE|os.O_APPEND, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{writer: file, file: file, labels: streamLabels}, nil
+}
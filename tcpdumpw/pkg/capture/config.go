@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capture runs scheduled packet captures; it is the core of `tcpdumpw`, which is also available to Go services
+// which embed it instead of running the sidecar: a Manager schedules Jobs, and every execution of a Job starts
+// one Task per engine and iface, which is supervised and restarted if it stops before the execution ends.
+//
+// Features which depend on the sidecar environment (exporting files, analyzers, notifications, health checks,
+// `pcap_fsn` signals, etc.) remain in `tcpdumpw`, which plugs them into executions and tasks through Hooks;
+// JSON translated packets may be fed into any PcapWriter.
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// Config describes what is captured by every execution of a Job, and where PCAP files are written into.
+	Config struct {
+		// Iface is the prefix of the ifaces to capture from, i/e: `eth`; loopback is always captured. `any` captures from all ifaces at once.
+		Iface string
+		// Directory is where PCAP and JSON files are written into; it must exist.
+		Directory string
+		// Extension of PCAP files written by `tcpdump`; it defaults to `pcap`.
+		Extension string
+		// Filter is the BPF filter applied by all engines; it defaults to the one used by `tcpdumpw`.
+		Filter string
+		// Snaplen is the amount of bytes captured from each packet; 0 captures whole packets.
+		Snaplen int
+		// Interval after which files are rotated; it defaults to 60 seconds.
+		Interval time.Duration
+		// Timezone used to name files; it defaults to `UTC`.
+		Timezone string
+		// Tcpdump enables writing PCAP files using `tcpdump`.
+		Tcpdump bool
+		// JSON enables writing JSON translated packets into files.
+		JSON bool
+		// Ordered writes JSON translated packets in the order they were captured; ConnTrack also enables it.
+		Ordered   bool
+		ConnTrack bool
+		// Compat, Filters and CompatFilters are passed as is to all engines; Filters are used instead of Filter if it is empty.
+		Compat        bool
+		Filters       []pcap.PcapFilterProvider
+		CompatFilters pcap.PcapFilters
+		// Ephemerals is the range of ephemeral ports used to tell apart clients from servers; it defaults to the one of Linux.
+		Ephemerals *pcap.PcapEmphemeralPorts
+		// ID is included in file names if it is not empty, so that files written by different jobs are told apart.
+		ID string
+
+		// Devices returns the devices to capture from; by default, the ones found using `FindDevices(Iface)`.
+		Devices func(ctx context.Context) []*pcap.PcapDevice
+		// Output returns the file name template of the files captured from `netIface`; by default, `FileOutput(Directory, netIface, ID)`.
+		Output func(netIface *net.Interface) string
+		// NewEngine creates the engine described by `config`, whose format is either `pcap` or `json`; by default,
+		// PCAP files are written by `tcpdump`, and packets are translated into JSON by an engine built on libpcap.
+		NewEngine func(ctx context.Context, config *pcap.PcapConfig) (pcap.PcapEngine, error)
+		// Writers returns the writers which are fed with the JSON translated packets captured from `device`;
+		// they are created once per iface, and rotated along with files. JSON capturing is enabled if it returns any.
+		Writers func(ctx context.Context, device *pcap.PcapDevice, output string) []pcap.PcapWriter
+		// Tasks returns additional tasks for `device`, i/e: of engines which do not write files;
+		// they are started and stopped along with all others.
+		Tasks func(ctx context.Context, device *pcap.PcapDevice) []*Task
+	}
+
+	// Schedule describes when a Job is executed, and for how long.
+	Schedule struct {
+		// CronExp is a standard cron expression; the Job is executed once, as soon as the Manager starts, if it is empty.
+		CronExp string
+		// Seconds is `true` if the 1st field of CronExp are seconds.
+		Seconds bool
+		// Timeout is how long every execution captures packets for; executions without timeout only stop with the Manager.
+		Timeout time.Duration
+	}
+)
+
+const (
+	defaultExtension = "pcap"
+	defaultTimezone  = "UTC"
+	defaultInterval  = 60 * time.Second
+)
+
+var errNoEngines = errors.New("neither 'Tcpdump', 'JSON', 'Writers' nor 'Tasks' are enabled: nothing would be captured")
+
+// withDefaults returns a copy of `c` where all missing optional values are set.
+func (c Config) withDefaults() Config {
+	if c.Extension == "" {
+		c.Extension = defaultExtension
+	}
+	if c.Timezone == "" {
+		c.Timezone = defaultTimezone
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultInterval
+	}
+	if c.Filter == "" && len(c.Filters) == 0 && !c.Compat {
+		c.Filter = pcap.PcapDefaultFilter
+	}
+	if c.ConnTrack {
+		c.Ordered = true
+	}
+	return c
+}
+
+// Validate returns all the problems found in `c`, or `nil` if there are none.
+func (c *Config) Validate() error {
+	errs := []error{}
+	if c.Iface == "" && c.Devices == nil {
+		errs = append(errs, errors.New("'Iface' must not be empty"))
+	}
+	if c.Directory == "" && c.Output == nil {
+		errs = append(errs, errors.New("'Directory' must not be empty"))
+	} else if c.Directory != "" {
+		if info, err := os.Stat(c.Directory); err != nil {
+			errs = append(errs, fmt.Errorf("invalid 'Directory': %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("invalid 'Directory': %s is not a directory", c.Directory))
+		}
+	}
+	if c.Snaplen < 0 {
+		errs = append(errs, fmt.Errorf("invalid 'Snaplen': %d must not be negative", c.Snaplen))
+	}
+	if c.Interval < 0 || c.Interval%time.Second != 0 {
+		errs = append(errs, fmt.Errorf("invalid 'Interval': %v must be a positive whole number of seconds", c.Interval))
+	}
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("invalid 'Timezone': %w", err))
+		}
+	}
+	if !c.Tcpdump && !c.JSON && c.Writers == nil && c.Tasks == nil {
+		errs = append(errs, errNoEngines)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+const (
+	// AnyIface captures from all ifaces at once.
+	AnyIface      = "any"
+	anyIfaceIndex = 0
+
+	// FileNamePattern is the part of file names which identifies the iface and the time when the file was created;
+	// `pcap_fsn` relies on it to tell apart the files of different ifaces.
+	FileNamePattern   = "%d_%s__%%Y%%m%%dT%%H%%M%%S"
+	idFileNamePattern = "%d_%s__%s__%%Y%%m%%dT%%H%%M%%S"
+	runFileOutput     = `%s/part__` + FileNamePattern
+	runIDFileOutput   = `%s/part__` + idFileNamePattern
+
+	// loopback is always captured, along with the ifaces matching the prefix
+	devicesRegexTemplate = "^(?:(?:lo$)|(?:(?:ipvlan-)?%s\\d+.*$))"
+)
+
+// FindDevices returns the devices whose name starts with `prefix` followed by a number, along with loopback.
+func FindDevices(prefix string) []*pcap.PcapDevice {
+	if strings.EqualFold(prefix, AnyIface) {
+		return []*pcap.PcapDevice{
+			{
+				NetInterface: &net.Interface{
+					Name:  AnyIface,
+					Index: anyIfaceIndex,
+				},
+			},
+		}
+	}
+
+	ifaceRegexp := regexp.MustCompile(fmt.Sprintf(devicesRegexTemplate, prefix))
+	devices, _ := pcap.FindDevicesByRegex(ifaceRegexp)
+	return devices
+}
+
+// FileOutput returns the file name template of `netIface`; `id` is included in file names if it is not empty,
+// i/e: to tell apart the files of different jobs, or of different instances writing into the same directory.
+func FileOutput(directory string, netIface *net.Interface, id string) string {
+	if id != "" {
+		return fmt.Sprintf(runIDFileOutput, directory, netIface.Index, netIface.Name, id)
+	}
+	return fmt.Sprintf(runFileOutput, directory, netIface.Index, netIface.Name)
+}
+
+// NewPcapConfig returns the configuration of an engine which captures from `iface`; `format` is either `pcap` or `json`.
+func NewPcapConfig(
+	iface, format, output, extension, filter string,
+	filters []pcap.PcapFilterProvider,
+	compatFilters pcap.PcapFilters,
+	snaplen, interval int,
+	compat, ordered, conntrack bool,
+	ephemerals *pcap.PcapEmphemeralPorts,
+) *pcap.PcapConfig {
+	return &pcap.PcapConfig{
+		Compat:        compat,
+		Promisc:       true,
+		Iface:         iface,
+		Snaplen:       snaplen,
+		TsType:        "",
+		Format:        format,
+		Output:        output,
+		Extension:     extension,
+		Filter:        filter,
+		Interval:      interval,
+		Ordered:       ordered,
+		ConnTrack:     conntrack,
+		Filters:       filters,
+		CompatFilters: compatFilters,
+		Ephemerals:    ephemerals,
+	}
+}
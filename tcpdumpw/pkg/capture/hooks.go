@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/health"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/procs"
+)
+
+type (
+	// Hooks follow the executions of a Job and the runs of its Tasks; all of them are optional.
+	// They are called concurrently by all Tasks, so they must be safe for concurrent use.
+	Hooks struct {
+		// Begin is called when an execution starts, before its Tasks do; Tasks run with the returned context,
+		// and `end` is called once all of them stopped, after the execution was summarized.
+		Begin func(ctx context.Context, exe *Execution) (context.Context, func())
+		// Acquire is called before every run of an engine, and blocks until the engine may start; it returns how to
+		// release what it acquired, which is called once the run is over. The Task stops for the rest of the execution
+		// if it returns an error.
+		Acquire func(ctx context.Context, t *Task) (func(), error)
+		// Start is called every time an engine starts; the engine runs with the returned context, which is done once
+		// the run is over, and `end` is called with the error which stopped it.
+		Start func(ctx context.Context, t *Task) (context.Context, func(err error))
+		// OnEvent is called for every Event; it must not block.
+		OnEvent func(event *Event)
+		// OnWriteError is called with every error returned by the writers of a Task.
+		OnWriteError func(t *Task, err error)
+	}
+
+	// EventKind tells apart what an Event reports.
+	EventKind int
+
+	// Event reports a change in a Task or in an execution; only the fields which are relevant to its Kind are set.
+	Event struct {
+		Kind EventKind
+		// Job is the name of the Job the Task or the execution belong to.
+		Job string
+		// Task is `nil` for events of executions.
+		Task *Task
+		// Execution is only set for events of executions.
+		Execution  *Execution
+		Transition *health.Transition
+		Err        error
+		// Backoff is how long a Task waits before restarting its engine.
+		Backoff time.Duration
+		// Deadline is how long Tasks are given to stop once their execution ended.
+		Deadline time.Duration
+		// Process is the `tcpdump` which was killed.
+		Process *procs.Process
+	}
+)
+
+const (
+	// StateChanged reports that a Task moved into a new state, as described by `Transition`.
+	StateChanged EventKind = iota
+	// TaskRestarting reports that the engine of a Task stopped before its execution ended because of `Err`;
+	// it is restarted after `Backoff`, or as soon as it is acquired again if it was paused.
+	TaskRestarting
+	// TaskStopped reports that a Task stopped along with its execution; `Err` is set if its engine failed.
+	TaskStopped
+	// TaskKilled reports that the `tcpdump` of a Task which did not stop by the deadline was killed; `Err` is set if it could not be,
+	// and `Process` is `nil` if `tcpdump` processes could not be found.
+	TaskKilled
+	// TaskAbandoned reports that the engine of a Task did not stop even after its execution was forcefully stopped.
+	TaskAbandoned
+	// ExecutionStopping reports that an execution ended, and that its Tasks are given `Deadline` to stop.
+	ExecutionStopping
+	// ExecutionStopped reports that all Tasks of an execution stopped; `Err` is set if they did not stop by the deadline,
+	// in which case they were forcefully stopped.
+	ExecutionStopped
+	// ExecutionSkipped reports that an execution was not started because all slots of its Job were running one.
+	ExecutionSkipped
+)
+
+var eventKinds = map[EventKind]string{
+	StateChanged:      "state",
+	TaskRestarting:    "restarting",
+	TaskStopped:       "stopped",
+	TaskKilled:        "killed",
+	TaskAbandoned:     "abandoned",
+	ExecutionStopping: "stopping",
+	ExecutionStopped:  "stopped",
+	ExecutionSkipped:  "skipped",
+}
+
+func emit(hooks *Hooks, event *Event) {
+	if hooks.OnEvent != nil {
+		hooks.OnEvent(event)
+	}
+}
+
+func (k EventKind) String() string {
+	if name, ok := eventKinds[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+func (e *Event) String() string {
+	message := e.Job
+	if e.Task != nil {
+		message = fmt.Sprintf("%s | %s | %s", message, e.Task.iface, e.Task.name)
+	}
+	if e.Kind == StateChanged {
+		message = fmt.Sprintf("%s | %s -> %s", message, e.Transition.From, e.Transition.To)
+		if e.Transition.Err != nil {
+			message = fmt.Sprintf("%s | %v", message, e.Transition.Err)
+		}
+		return message
+	}
+	message = fmt.Sprintf("%s | %s", message, e.Kind)
+	if e.Err != nil {
+		message = fmt.Sprintf("%s | %v", message, e.Err)
+	}
+	return message
+}
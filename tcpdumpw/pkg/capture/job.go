@@ -0,0 +1,347 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/execution"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/health"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/procs"
+	"github.com/gchux/pcap-cli/pkg/pcap"
+	"github.com/go-co-op/gocron/v2"
+	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
+)
+
+type (
+	// Job is a capture which is executed according to its Schedule; every execution starts all the Tasks of one of its Slots.
+	Job struct {
+		name     string
+		schedule Schedule
+		clock    clockwork.Clock
+		slots    []*Slot
+		// slots which are not running an execution
+		free chan *Slot
+		// `nil` unless the Job was added using `Manager.AddJob`, which creates its tasks
+		config  *Config
+		manager *Manager
+
+		scheduled  atomic.Pointer[gocron.Job]
+		executions atomic.Uint64
+		last       atomic.Pointer[Execution]
+	}
+
+	// Slot is a set of Tasks which runs one execution of a Job at a time, along with the Hooks which follow them;
+	// a Job runs as many executions concurrently as slots it has.
+	Slot struct {
+		Tasks []*Task
+		Hooks Hooks
+
+		index   int
+		current atomic.Pointer[Execution]
+	}
+
+	// Execution summarizes a single execution of a Job.
+	Execution struct {
+		ID   string `json:"id"`
+		Job  string `json:"job"`
+		Slot int    `json:"slot"`
+		// Start is when Tasks were started, Stop when they were asked to stop, and End when all of them stopped.
+		Start   time.Time     `json:"start"`
+		Stop    time.Time     `json:"stop"`
+		End     time.Time     `json:"end"`
+		Timeout time.Duration `json:"timeout"`
+		Tasks   []TaskStatus  `json:"tasks"`
+		// Stopped is `false` if some engines did not stop even after being forcefully stopped.
+		Stopped bool  `json:"stopped"`
+		Err     error `json:"-"`
+	}
+
+	// JobStatus is a snapshot of the state of a Job.
+	JobStatus struct {
+		Name       string `json:"name"`
+		Executions uint64 `json:"executions"`
+		// IDs of the executions which are running
+		Running []string     `json:"running,omitempty"`
+		Tasks   []TaskStatus `json:"tasks"`
+		Last    *Execution   `json:"last,omitempty"`
+	}
+)
+
+const (
+	// stopDeadline is how long engines are given to flush their files once an execution ends.
+	stopDeadline = 2 * time.Second
+	// forcedStopGrace is how long engines are given to stop once they were forcefully stopped.
+	forcedStopGrace = 2 * time.Second
+)
+
+var (
+	// ErrBusy is returned by `Job.Execute` when all slots of the Job are running an execution.
+	ErrBusy = errors.New("all slots of the job are running an execution")
+
+	errStopTimeout  = errors.New("timed out waiting for engines to stop")
+	errEngineWedged = errors.New("engine did not stop after its execution ended")
+)
+
+// NewJob returns a Job which runs the Tasks of one of `slots` every time that `schedule` fires; it must have at least one slot.
+// Jobs are executed using `Execute`, or scheduled by adding them to a Manager, whose clock they use from then on.
+func NewJob(name string, schedule Schedule, slots ...*Slot) *Job {
+	j := &Job{
+		name:     name,
+		schedule: schedule,
+		clock:    clockwork.NewRealClock(),
+		slots:    slots,
+		free:     make(chan *Slot, len(slots)),
+	}
+	for i, slot := range slots {
+		slot.index = i
+		j.free <- slot
+	}
+	return j
+}
+
+// Name returns the name of `j`, which is unique within its Manager.
+func (j *Job) Name() string {
+	return j.name
+}
+
+// ID returns the ID assigned to `j` by the scheduler of its Manager; it is empty until `j` is scheduled.
+func (j *Job) ID() string {
+	if scheduled := j.scheduled.Load(); scheduled != nil {
+		return (*scheduled).ID().String()
+	}
+	return ""
+}
+
+// Tags returns the tags assigned to `j` by its Manager once it is scheduled.
+func (j *Job) Tags() []string {
+	if scheduled := j.scheduled.Load(); scheduled != nil {
+		return (*scheduled).Tags()
+	}
+	return nil
+}
+
+// NextRun returns when `j` is executed next; it is zero if `j` is not scheduled to run again.
+func (j *Job) NextRun() time.Time {
+	if scheduled := j.scheduled.Load(); scheduled != nil {
+		if nextRun, err := (*scheduled).NextRun(); err == nil {
+			return nextRun
+		}
+	}
+	return time.Time{}
+}
+
+// Last returns the summary of the last execution of `j` which ended, if any.
+func (j *Job) Last() *Execution {
+	return j.last.Load()
+}
+
+// Tasks returns the tasks of all slots of `j`; tasks of jobs added using `Manager.AddJob` are only available once it is scheduled.
+func (j *Job) Tasks() []*Task {
+	tasks := []*Task{}
+	for _, slot := range j.slots {
+		tasks = append(tasks, slot.Tasks...)
+	}
+	return tasks
+}
+
+// Status returns the current state of `j`.
+func (j *Job) Status() JobStatus {
+	tasks := j.Tasks()
+	status := JobStatus{
+		Name:       j.name,
+		Executions: j.executions.Load(),
+		Tasks:      make([]TaskStatus, 0, len(tasks)),
+		Last:       j.last.Load(),
+	}
+	for _, slot := range j.slots {
+		if exe := slot.current.Load(); exe != nil {
+			status.Running = append(status.Running, exe.ID)
+		}
+	}
+	for _, task := range tasks {
+		status.Tasks = append(status.Tasks, task.Status())
+	}
+	return status
+}
+
+// Rotate closes the files of all tasks of `j` and opens new ones; it returns how many files were rotated.
+func (j *Job) Rotate() int {
+	rotated := 0
+	for _, task := range j.Tasks() {
+		rotated += task.Rotate()
+	}
+	return rotated
+}
+
+// Execute runs an execution of `j` right away, using one of its slots which is not running another one;
+// it returns ErrBusy if all of them are. It returns once all tasks stopped, along with the errors which stopped them.
+func (j *Job) Execute(ctx context.Context) error {
+	var slot *Slot
+	select {
+	case slot = <-j.free:
+	default:
+		return ErrBusy
+	}
+	defer func() { j.free <- slot }()
+	return j.run(ctx, slot)
+}
+
+// execute is the task of the scheduled job: executions which would overlap with all running ones are skipped.
+func (j *Job) execute(ctx context.Context) error {
+	err := j.Execute(ctx)
+	if errors.Is(err, ErrBusy) && len(j.slots) > 0 {
+		emit(&j.slots[0].Hooks, &Event{Kind: ExecutionSkipped, Job: j.name, Err: err})
+		return nil
+	}
+	return err
+}
+
+// run runs all tasks of `slot` until the timeout of the schedule of `j` expires or `ctx` is done.
+func (j *Job) run(ctx context.Context, slot *Slot) error {
+	exe := &Execution{ID: uuid.New().String(), Job: j.name, Slot: slot.index, Start: time.Now(), Timeout: j.schedule.Timeout}
+	hooks := &slot.Hooks
+
+	info := &execution.Info{JobID: j.ID(), ExecutionID: exe.ID}
+	info.LogName = fmt.Sprintf("pcap/%s", info.ID())
+	// engines find the identity of the execution in their context
+	ctx = execution.NewContext(ctx, info)
+
+	slot.current.Store(exe)
+	defer slot.current.Store(nil)
+
+	end := func() {}
+	if hooks.Begin != nil {
+		ctx, end = hooks.Begin(ctx, exe)
+	}
+
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	if j.schedule.Timeout > 0 {
+		timer := j.clock.AfterFunc(j.schedule.Timeout, cancel)
+		defer timer.Stop()
+	}
+
+	// every execution waits for its own tasks: tasks abandoned by a previous one must not block it
+	var wg sync.WaitGroup
+	deadlines := make(chan *time.Duration, len(slot.Tasks))
+	for _, task := range slot.Tasks {
+		wg.Add(1)
+		go task.supervise(ctx, &wg, j.name, hooks, j.clock, deadlines)
+	}
+
+	<-ctx.Done()
+	exe.Stop = time.Now()
+	emit(hooks, &Event{Kind: ExecutionStopping, Job: j.name, Execution: exe, Deadline: stopDeadline})
+	for range slot.Tasks {
+		deadline := stopDeadline - time.Since(exe.Stop)
+		deadlines <- &deadline
+	}
+
+	var stopErr error
+	exe.Stopped = waitTimeout(&wg, stopDeadline-time.Since(exe.Stop))
+	if !exe.Stopped {
+		stopErr = errStopTimeout
+		exe.Stopped = j.forceStop(slot, &wg)
+	}
+	close(deadlines)
+
+	exe.End = time.Now()
+	for _, task := range slot.Tasks {
+		status := task.Status()
+		exe.Tasks = append(exe.Tasks, status)
+		if task.err != nil {
+			exe.Err = errors.Join(exe.Err, fmt.Errorf("%s/%s: %w", task.iface, task.name, task.err))
+		}
+	}
+	exe.Err = errors.Join(exe.Err, stopErr)
+	emit(hooks, &Event{Kind: ExecutionStopped, Job: j.name, Execution: exe, Err: stopErr})
+
+	j.executions.Add(1)
+	j.last.Store(exe)
+	end()
+	if j.manager != nil && j.manager.OnExecution != nil {
+		j.manager.OnExecution(exe)
+	}
+	return exe.Err
+}
+
+// forceStop stops the engines of `slot` which did not return by the deadline: `tcpdump` processes are killed, and engines
+// which are still active after `forcedStopGrace` are abandoned so that they cannot wedge the next execution.
+// It returns `false` if some engines were abandoned.
+func (j *Job) forceStop(slot *Slot, wg *sync.WaitGroup) bool {
+	hooks := &slot.Hooks
+	for _, t := range slot.Tasks {
+		if !t.engine.IsActive() {
+			continue
+		}
+		if _, isTcpdump := t.engine.(*pcap.Tcpdump); isTcpdump {
+			killTcpdump(j.name, t, hooks)
+		}
+	}
+
+	if waitTimeout(wg, forcedStopGrace) {
+		return true
+	}
+	for _, t := range slot.Tasks {
+		if t.engine.IsActive() {
+			t.err = errors.Join(t.err, errEngineWedged)
+			t.setState(j.name, hooks, health.Failed, errEngineWedged)
+			emit(hooks, &Event{Kind: TaskAbandoned, Job: j.name, Task: t, Err: errEngineWedged})
+		}
+	}
+	return false
+}
+
+// killTcpdump kills the `tcpdump` processes capturing from the iface of `t` which were started by the current process.
+func killTcpdump(job string, t *Task, hooks *Hooks) {
+	processes, err := procs.Children("tcpdump")
+	if err != nil {
+		emit(hooks, &Event{Kind: TaskKilled, Job: job, Task: t, Err: err})
+		return
+	}
+	for _, process := range processes {
+		if !process.HasArgs("-i", t.iface) {
+			continue
+		}
+		emit(hooks, &Event{Kind: TaskKilled, Job: job, Task: t, Process: process, Err: process.Kill()})
+	}
+}
+
+// waitTimeout waits for `wg` for up to `timeout`; it returns `false` if it timed out.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
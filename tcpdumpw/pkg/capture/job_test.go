@@ -0,0 +1,297 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/capture"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/testkit"
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+// memoryWriter keeps JSON translated packets in memory instead of writing them into files.
+type memoryWriter struct {
+	mu        sync.Mutex
+	iface     string
+	lines     int
+	rotations int
+	closed    bool
+}
+
+const (
+	// handshake is emitted as soon as engines start
+	handshake = `{"packets":[
+		{"proto":"tcp","src":"10.0.0.1:40000","dst":"10.0.0.2:443","flags":"SYN","seq":1},
+		{"proto":"tcp","src":"10.0.0.2:443","dst":"10.0.0.1:40000","flags":"SYN,ACK","seq":7,"ack":2}
+	]}`
+	// delayed is emitted 1 second after engines start, as measured by their clock
+	delayed = `{"packets":[{"after_ms":1000,"proto":"udp","src":"10.0.0.1:5353","dst":"10.0.0.2:53","payload":"ping"}]}`
+)
+
+var start = time.Date(2024, time.May, 1, 3, 0, 0, 0, time.UTC)
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines += 1
+	return len(p), nil
+}
+
+func (w *memoryWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return nil
+}
+
+func (w *memoryWriter) Rotate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rotations += 1
+}
+
+func (w *memoryWriter) IsStdOutOrErr() bool {
+	return false
+}
+
+func (w *memoryWriter) GetIface() *string {
+	return &w.iface
+}
+
+func (w *memoryWriter) Lines() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lines
+}
+
+// newScriptedTask returns a Task whose engine emits the packets of `spec` as measured by `clock`.
+func newScriptedTask(t *testing.T, spec string, clock testkit.Clock) (*capture.Task, *testkit.Engine, *memoryWriter) {
+	t.Helper()
+	script, err := testkit.LoadScript(spec)
+	if err != nil {
+		t.Fatalf("invalid script: %v", err)
+	}
+	config := capture.NewPcapConfig(testkit.Iface, "json", "", "json", "", nil, nil, 0, 0, false, false, false, nil)
+	engine := testkit.NewEngine(config, script, clock)
+	writer := &memoryWriter{iface: testkit.Iface}
+	return capture.NewTask(testkit.Iface, "jsondump", engine, []pcap.PcapWriter{writer}), engine, writer
+}
+
+// newFakeJob returns a Job with a single slot running `tasks`, which is executed using `clock`.
+func newFakeJob(t *testing.T, clock testkit.FakeClock, schedule capture.Schedule, hooks capture.Hooks, tasks ...*capture.Task) *capture.Job {
+	t.Helper()
+	job := capture.NewJob("test", schedule, &capture.Slot{Tasks: tasks, Hooks: hooks})
+	if err := capture.NewManager(nil, clock).Add(job); err != nil {
+		t.Fatalf("failed to add job: %v", err)
+	}
+	return job
+}
+
+// eventually waits for `condition` to hold, as measured by the real clock.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// advanceUntil advances `clock` by `step` until `condition` holds; timers are created concurrently by the code
+// under test, so the clock keeps moving until they are created and fired.
+func advanceUntil(t *testing.T, what string, clock testkit.FakeClock, step time.Duration, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		clock.Advance(step)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// events collects the events reported by the Hooks of a Slot.
+type events struct {
+	mu     sync.Mutex
+	events []*capture.Event
+}
+
+func (e *events) add(event *capture.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *events) find(kind capture.EventKind) *capture.Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, event := range e.events {
+		if event.Kind == kind {
+			return event
+		}
+	}
+	return nil
+}
+
+func TestExecuteStopsOnTimeout(t *testing.T) {
+	clock := testkit.NewFakeClock(start)
+	task, _, writer := newScriptedTask(t, handshake, clock)
+	job := newFakeJob(t, clock, capture.Schedule{Timeout: 5 * time.Second}, capture.Hooks{}, task)
+
+	done := make(chan error, 1)
+	go func() { done <- job.Execute(context.Background()) }()
+	eventually(t, "packets to be written", func() bool { return writer.Lines() == 2 })
+
+	select {
+	case err := <-done:
+		t.Fatalf("execution ended before its timeout: %v", err)
+	default:
+	}
+
+	advanceUntil(t, "the execution to end", clock, time.Second, func() bool { return job.Last() != nil })
+	if err := <-done; err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+	exe := job.Last()
+	if !exe.Stopped || exe.Timeout != 5*time.Second {
+		t.Errorf("unexpected execution: %+v", exe)
+	}
+	if status := job.Status(); status.Executions != 1 || len(status.Running) != 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if packets := task.Counters().Snapshot(); packets.Packets != 2 {
+		t.Errorf("expected 2 packets to be counted, got: %+v", packets)
+	}
+}
+
+func TestScriptedPacketsFollowClock(t *testing.T) {
+	clock := testkit.NewFakeClock(start)
+	task, engine, writer := newScriptedTask(t, delayed, clock)
+	job := newFakeJob(t, clock, capture.Schedule{}, capture.Hooks{}, task)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- job.Execute(ctx) }()
+	eventually(t, "the engine to start", task.PcapEngine().IsActive)
+
+	// real time flowing must not emit packets which are scheduled by the fake clock
+	time.Sleep(100 * time.Millisecond)
+	if engine.Packets() != 0 {
+		t.Fatalf("packet emitted before the clock was advanced")
+	}
+	advanceUntil(t, "the packet to be written", clock, 500*time.Millisecond, func() bool { return writer.Lines() == 1 })
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+}
+
+func TestExecuteIsBusy(t *testing.T) {
+	clock := testkit.NewFakeClock(start)
+	task, _, _ := newScriptedTask(t, handshake, clock)
+	job := newFakeJob(t, clock, capture.Schedule{}, capture.Hooks{}, task)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- job.Execute(ctx) }()
+	eventually(t, "the execution to start", func() bool { return len(job.Status().Running) == 1 })
+
+	if err := job.Execute(ctx); !errors.Is(err, capture.ErrBusy) {
+		t.Errorf("expected ErrBusy, got: %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+	if executions := job.Status().Executions; executions != 1 {
+		t.Errorf("expected 1 execution, got: %d", executions)
+	}
+}
+
+func TestAbortedEngineRestartsAfterBackoff(t *testing.T) {
+	clock := testkit.NewFakeClock(start)
+	task, engine, writer := newScriptedTask(t, handshake, clock)
+	events := &events{}
+	job := newFakeJob(t, clock, capture.Schedule{}, capture.Hooks{OnEvent: events.add}, task)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- job.Execute(ctx) }()
+	eventually(t, "packets to be written", func() bool { return writer.Lines() == 2 })
+
+	stalled := errors.New("stalled")
+	if !task.Abort(stalled) {
+		t.Fatal("engine is not running")
+	}
+	eventually(t, "the engine to be restarting", func() bool { return events.find(capture.TaskRestarting) != nil })
+	restarting := events.find(capture.TaskRestarting)
+	if !errors.Is(restarting.Err, stalled) || restarting.Backoff != time.Second {
+		t.Errorf("unexpected event: %+v", restarting)
+	}
+	if task.Restarts() != 1 {
+		t.Errorf("expected 1 restart, got: %d", task.Restarts())
+	}
+
+	// the engine waits for its backoff as measured by the fake clock, and emits the script again once restarted
+	time.Sleep(100 * time.Millisecond)
+	if engine.Packets() != 2 {
+		t.Fatalf("engine restarted before its backoff: %d packets", engine.Packets())
+	}
+	advanceUntil(t, "the script to be emitted again", clock, 500*time.Millisecond, func() bool { return writer.Lines() == 4 })
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+	if stopped := events.find(capture.TaskStopped); stopped == nil || stopped.Err != nil {
+		t.Errorf("expected a clean stop, got: %+v", stopped)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	clock := testkit.NewFakeClock(start)
+	task, _, writer := newScriptedTask(t, handshake, clock)
+	job := newFakeJob(t, clock, capture.Schedule{}, capture.Hooks{}, task)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- job.Execute(ctx) }()
+	eventually(t, "packets to be written", func() bool { return writer.Lines() == 2 })
+
+	if rotated := job.Rotate(); rotated != 1 {
+		t.Errorf("expected 1 file to be rotated, got: %d", rotated)
+	}
+	writer.mu.Lock()
+	rotations := writer.rotations
+	writer.mu.Unlock()
+	if rotations != 1 {
+		t.Errorf("expected the writer to be rotated once, got: %d", rotations)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+	"github.com/go-co-op/gocron/v2"
+	"github.com/jonboulle/clockwork"
+)
+
+type (
+	// Manager schedules the executions of its Jobs.
+	Manager struct {
+		// OnEvent is called for every Event of the jobs added using AddJob; it must not block.
+		OnEvent func(*Event)
+		// OnExecution is called every time an execution of any Job ends.
+		OnExecution func(*Execution)
+		// Tags are assigned to all jobs when they are scheduled.
+		Tags []string
+
+		location *time.Location
+		clock    clockwork.Clock
+
+		mu        sync.Mutex
+		jobs      []*Job
+		running   bool
+		scheduler gocron.Scheduler
+	}
+)
+
+var (
+	errRunning      = errors.New("manager is already running")
+	errNoTasks      = errors.New("no tasks could be created: no ifaces matched or all engines failed")
+	errDuplicateJob = errors.New("duplicate job name")
+)
+
+// NewManager returns a Manager which schedules jobs in `location`, or in UTC if it is `nil`; `clock` is the source of time
+// of the scheduler and of the timeouts and backoffs of executions, the real one is used if it is `nil`.
+func NewManager(location *time.Location, clock clockwork.Clock) *Manager {
+	if location == nil {
+		location = time.UTC
+	}
+	if clock == nil {
+		clock = clockwork.NewRealClock()
+	}
+	return &Manager{location: location, clock: clock}
+}
+
+// AddJob registers a job which captures as described by `config` every time that `schedule` fires;
+// its tasks are created when the Manager schedules it.
+func (m *Manager) AddJob(name string, config Config, schedule Schedule) (*Job, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config of job '%s': %w", name, err)
+	}
+	config = config.withDefaults()
+
+	job := NewJob(name, schedule, &Slot{Hooks: Hooks{OnEvent: m.emit}})
+	job.config = &config
+	if err := m.Add(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Add registers `job`, which is executed using the clock of `m` from then on; jobs may only be added before `m` is scheduled.
+func (m *Manager) Add(job *Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.running {
+		return errRunning
+	}
+	for _, j := range m.jobs {
+		if j.name == job.name {
+			return fmt.Errorf("%w: %s", errDuplicateJob, job.name)
+		}
+	}
+
+	job.clock = m.clock
+	job.manager = m
+	m.jobs = append(m.jobs, job)
+	return nil
+}
+
+// Jobs returns all the jobs registered into `m`.
+func (m *Manager) Jobs() []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Job(nil), m.jobs...)
+}
+
+// Schedule creates the tasks of the jobs added using AddJob, and schedules all jobs; executions run with `ctx`,
+// and they only start once `m` is started.
+func (m *Manager) Schedule(ctx context.Context) error {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return errRunning
+	}
+	m.running = true
+	jobs := append([]*Job(nil), m.jobs...)
+	m.mu.Unlock()
+
+	var limit uint = 0
+	for _, job := range jobs {
+		// every job limits its own executions: the scheduler must not hold back executions of other jobs
+		limit += uint(len(job.slots))
+		if job.config == nil {
+			continue
+		}
+		// tasks which could not be created are left out: the ones of other ifaces and engines still capture
+		tasks, err := NewTasks(ctx, job.config)
+		if len(tasks) == 0 {
+			closeJobs(jobs)
+			return fmt.Errorf("failed to create tasks of job '%s': %w", job.name, err)
+		}
+		job.slots[0].Tasks = tasks
+	}
+
+	s, err := gocron.NewScheduler(
+		gocron.WithLimitConcurrentJobs(max(limit, 1), gocron.LimitModeReschedule),
+		gocron.WithLocation(m.location),
+		gocron.WithClock(m.clock),
+		gocron.WithGlobalJobOptions(
+			gocron.WithTags(m.Tags...),
+		),
+	)
+	if err != nil {
+		closeJobs(jobs)
+		return fmt.Errorf("failed to create scheduler: %w", err)
+	}
+
+	for _, job := range jobs {
+		definition := gocron.OneTimeJob(gocron.OneTimeJobStartImmediately())
+		if job.schedule.CronExp != "" {
+			definition = gocron.CronJob(job.schedule.CronExp, job.schedule.Seconds)
+		}
+		scheduled, err := s.NewJob(definition, gocron.NewTask(job.execute, ctx), gocron.WithName(job.name))
+		if err != nil {
+			s.Shutdown()
+			closeJobs(jobs)
+			return fmt.Errorf("failed to schedule job '%s': %w", job.name, err)
+		}
+		job.scheduled.Store(&scheduled)
+	}
+
+	m.mu.Lock()
+	m.scheduler = s
+	m.mu.Unlock()
+	return nil
+}
+
+// Start starts executing the jobs scheduled by `m`.
+func (m *Manager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.scheduler != nil {
+		m.scheduler.Start()
+	}
+}
+
+// Shutdown stops scheduling executions and waits for running ones to end, which stop along with the context
+// they were scheduled with; then, the files of the jobs added using AddJob are flushed, and all their writers closed.
+func (m *Manager) Shutdown() error {
+	m.mu.Lock()
+	s := m.scheduler
+	jobs := append([]*Job(nil), m.jobs...)
+	m.mu.Unlock()
+
+	if s == nil {
+		return nil
+	}
+	err := s.Shutdown()
+	closeJobs(jobs)
+	return err
+}
+
+// Run schedules and starts all jobs of `m` until `ctx` is done, and then shuts it down.
+func (m *Manager) Run(ctx context.Context) error {
+	if err := m.Schedule(ctx); err != nil {
+		return err
+	}
+	m.Start()
+	<-ctx.Done()
+	return m.Shutdown()
+}
+
+func (m *Manager) emit(event *Event) {
+	if m.OnEvent != nil {
+		m.OnEvent(event)
+	}
+}
+
+// closeJobs flushes and closes the writers of all tasks of the `jobs` added using AddJob.
+func closeJobs(jobs []*Job) {
+	for _, job := range jobs {
+		if job.config == nil {
+			continue
+		}
+		job.Rotate()
+		for _, task := range job.Tasks() {
+			task.close()
+		}
+	}
+}
+
+// NewTasks creates one task per engine for every device described by `config`: `tcpdump` if it is enabled, then the ones
+// returned by `config.Tasks`, and then the JSON one if there are writers to feed; tasks which could not be created are skipped,
+// and the errors which prevented them are returned along with all others.
+func NewTasks(ctx context.Context, config *Config) ([]*Task, error) {
+	devices := FindDevices(config.Iface)
+	if config.Devices != nil {
+		devices = config.Devices(ctx)
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no ifaces found for prefix: %s", config.Iface)
+	}
+
+	output := func(netIface *net.Interface) string {
+		return FileOutput(config.Directory, netIface, config.ID)
+	}
+	if config.Output != nil {
+		output = config.Output
+	}
+	newEngine := newEngine
+	if config.NewEngine != nil {
+		newEngine = config.NewEngine
+	}
+	ephemerals := config.Ephemerals
+	if ephemerals == nil {
+		ephemerals = &pcap.PcapEmphemeralPorts{Min: pcap.PCAP_MIN_EPHEMERAL_PORT, Max: pcap.PCAP_MAX_EPHEMERAL_PORT}
+	}
+	interval := int(config.Interval / time.Second)
+
+	tasks := []*Task{}
+	errs := []error{}
+	for _, device := range devices {
+		netIface := device.NetInterface
+		iface := netIface.Name
+		ifaceAndIndex := fmt.Sprintf("%d/%s", netIface.Index, iface)
+		output := output(netIface)
+
+		if config.Tcpdump {
+			tcpdumpCfg := NewPcapConfig(iface, "pcap", output, config.Extension, config.Filter, config.Filters, config.CompatFilters,
+				config.Snaplen, interval, config.Compat, config.Ordered, config.ConnTrack, ephemerals)
+			if engine, err := newEngine(ctx, tcpdumpCfg); err == nil {
+				task := NewTask(iface, "tcpdump", engine, nil)
+				task.output = output
+				tasks = append(tasks, task)
+			} else {
+				errs = append(errs, fmt.Errorf("%s/tcpdump: %w", ifaceAndIndex, err))
+			}
+		}
+
+		if config.Tasks != nil {
+			tasks = append(tasks, config.Tasks(ctx, device)...)
+		}
+
+		writers := []pcap.PcapWriter{}
+		if config.JSON {
+			extension := "json"
+			writer, err := pcap.NewPcapWriter(ctx, &ifaceAndIndex, &output, &extension, &config.Timezone, interval)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s/jsondump: %w", ifaceAndIndex, err))
+			} else {
+				writers = append(writers, writer)
+			}
+		}
+		if config.Writers != nil {
+			writers = append(writers, config.Writers(ctx, device, output)...)
+		}
+		if len(writers) == 0 {
+			continue
+		}
+
+		jsonCfg := NewPcapConfig(iface, "json", output, "json", config.Filter, config.Filters, config.CompatFilters,
+			config.Snaplen, interval, config.Compat, config.Ordered, config.ConnTrack, ephemerals)
+		engine, err := newEngine(ctx, jsonCfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s/jsondump: %w", ifaceAndIndex, err))
+			for _, writer := range writers {
+				writer.Close()
+			}
+			continue
+		}
+		task := NewTask(iface, "jsondump", engine, writers)
+		task.output = output
+		tasks = append(tasks, task)
+	}
+
+	if len(tasks) == 0 {
+		return nil, errors.Join(append(errs, errNoTasks)...)
+	}
+	return tasks, errors.Join(errs...)
+}
+
+// newEngine creates the default engine of `config`: `tcpdump` to write PCAP files, or libpcap to translate packets into JSON.
+func newEngine(_ context.Context, config *pcap.PcapConfig) (pcap.PcapEngine, error) {
+	if config.Format == "pcap" {
+		return pcap.NewTcpdump(config)
+	}
+	return pcap.NewPcap(config)
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/capture"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/testkit"
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+// scriptedConfig returns a Config whose only task emits the packets of `spec` into `writer`, as measured by `clock`.
+func scriptedConfig(t *testing.T, spec string, clock testkit.Clock, writer *memoryWriter) capture.Config {
+	t.Helper()
+	script, err := testkit.LoadScript(spec)
+	if err != nil {
+		t.Fatalf("invalid script: %v", err)
+	}
+	return capture.Config{
+		Devices: func(context.Context) []*pcap.PcapDevice {
+			return []*pcap.PcapDevice{{NetInterface: &net.Interface{Index: 0, Name: testkit.Iface}}}
+		},
+		Output: func(*net.Interface) string { return "" },
+		NewEngine: func(_ context.Context, config *pcap.PcapConfig) (pcap.PcapEngine, error) {
+			return testkit.NewEngine(config, script, clock), nil
+		},
+		Writers: func(context.Context, *pcap.PcapDevice, string) []pcap.PcapWriter {
+			return []pcap.PcapWriter{writer}
+		},
+	}
+}
+
+// executions collects the summaries of the executions reported by a Manager.
+type executions struct {
+	mu         sync.Mutex
+	executions []*capture.Execution
+}
+
+func (e *executions) add(exe *capture.Execution) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.executions = append(e.executions, exe)
+}
+
+func (e *executions) len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.executions)
+}
+
+func TestManagerSchedulesOnClock(t *testing.T) {
+	clock := testkit.NewFakeClock(start)
+	writer := &memoryWriter{iface: testkit.Iface}
+	executions := &executions{}
+
+	manager := capture.NewManager(nil, clock)
+	manager.OnExecution = executions.add
+	job, err := manager.AddJob("test", scriptedConfig(t, handshake, clock, writer),
+		capture.Schedule{CronExp: "*/10 * * * * *", Seconds: true, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("failed to add job: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := manager.Schedule(ctx); err != nil {
+		t.Fatalf("failed to schedule: %v", err)
+	}
+	manager.Start()
+
+	if next := job.NextRun(); !next.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("unexpected next run: %v", next)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if writer.Lines() != 0 {
+		t.Fatal("job executed before it was scheduled to")
+	}
+
+	advanceUntil(t, "2 executions", clock, time.Second, func() bool { return executions.len() == 2 })
+	for _, exe := range executions.executions {
+		if exe.Err != nil || !exe.Stopped || exe.Timeout != 5*time.Second {
+			t.Errorf("unexpected execution: %+v", exe)
+		}
+	}
+	if lines := writer.Lines(); lines != 4 {
+		t.Errorf("expected the script to be emitted by every execution, got %d packets", lines)
+	}
+
+	cancel()
+	if err := manager.Shutdown(); err != nil {
+		t.Fatalf("failed to shutdown: %v", err)
+	}
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	if !writer.closed {
+		t.Error("writers were not closed on shutdown")
+	}
+}
+
+func TestManagerShutdownStopsExecutions(t *testing.T) {
+	clock := testkit.NewFakeClock(start)
+	writer := &memoryWriter{iface: testkit.Iface}
+	events := &events{}
+
+	manager := capture.NewManager(nil, clock)
+	manager.OnEvent = events.add
+	// jobs without cron expression are executed once, as soon as the Manager starts, until it is shut down
+	job, err := manager.AddJob("test", scriptedConfig(t, handshake, clock, writer), capture.Schedule{})
+	if err != nil {
+		t.Fatalf("failed to add job: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := manager.Schedule(ctx); err != nil {
+		t.Fatalf("failed to schedule: %v", err)
+	}
+	manager.Start()
+	eventually(t, "packets to be written", func() bool { return writer.Lines() == 2 })
+	if running := job.Status().Running; len(running) != 1 {
+		t.Fatalf("expected 1 running execution, got: %v", running)
+	}
+
+	cancel()
+	if err := manager.Shutdown(); err != nil {
+		t.Fatalf("failed to shutdown: %v", err)
+	}
+	exe := job.Last()
+	if exe == nil || exe.Err != nil || !exe.Stopped {
+		t.Fatalf("unexpected execution: %+v", exe)
+	}
+	if stopped := events.find(capture.TaskStopped); stopped == nil || stopped.Err != nil {
+		t.Errorf("expected a clean stop, got: %+v", stopped)
+	}
+	if status := job.Status(); len(status.Running) != 0 || status.Tasks[0].Counters.Packets != 2 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
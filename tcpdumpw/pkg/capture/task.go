@@ -0,0 +1,408 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/health"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/stats"
+	"github.com/gchux/pcap-cli/pkg/pcap"
+	"github.com/jonboulle/clockwork"
+)
+
+type (
+	// Task captures packets from a single iface using a single engine; it outlives executions.
+	Task struct {
+		iface    string
+		name     string
+		output   string
+		engine   pcap.PcapEngine
+		writers  []pcap.PcapWriter
+		health   *health.Tracker
+		counters *stats.Counters
+		restarts atomic.Uint64
+		// aborts the current run of the engine with a cause
+		abort atomic.Pointer[context.CancelCauseFunc]
+		err   error
+	}
+
+	// TaskStatus is a snapshot of the state of a Task.
+	TaskStatus struct {
+		Iface    string                 `json:"iface"`
+		Engine   string                 `json:"engine"`
+		Status   health.Status          `json:"status"`
+		Restarts uint64                 `json:"restarts"`
+		Counters stats.CountersSnapshot `json:"counters"`
+		Error    string                 `json:"error,omitempty"`
+	}
+
+	// safeWriter drops the packet which caused a panic, and aborts the current run of the engine so that it is restarted.
+	safeWriter struct {
+		pcap.PcapWriter
+		task  *Task
+		hooks *Hooks
+	}
+)
+
+const (
+	minRestartBackoff    = 1 * time.Second
+	maxRestartBackoff    = 30 * time.Second
+	stalledStopDeadline  = 2 * time.Second
+	captureCheckInterval = 250 * time.Millisecond
+)
+
+var (
+	// ErrPaused stops the current run of an engine without counting it as a failure; engines aborted with an error
+	// which wraps it are restarted right away, and their Hooks are expected to hold them back until they may capture again.
+	ErrPaused = errors.New("paused")
+
+	errRotationRestart = errors.New("engine restarted to rotate its PCAP file")
+	errEarlyStop       = errors.New("engine stopped before the execution ended")
+)
+
+// NewTask returns a Task which captures from `iface` using `engine`, and writes JSON translated packets into `writers`;
+// `name` tells apart the engines of the same iface. Packets are counted as they are written into the 1st writer.
+func NewTask(iface, name string, engine pcap.PcapEngine, writers []pcap.PcapWriter) *Task {
+	counters := &stats.Counters{}
+	// packets are only counted once, no matter how many writers they are written into
+	if len(writers) > 0 {
+		writers[0] = stats.NewCountingWriter(writers[0], counters)
+	}
+	return &Task{iface: iface, name: name, engine: engine, writers: writers, health: health.NewTracker(), counters: counters}
+}
+
+// Iface returns the name of the iface captured by `t`.
+func (t *Task) Iface() string {
+	return t.iface
+}
+
+// Engine returns the name of the engine used by `t`, i/e: `tcpdump` or `jsondump`.
+func (t *Task) Engine() string {
+	return t.name
+}
+
+// PcapEngine returns the engine used by `t`.
+func (t *Task) PcapEngine() pcap.PcapEngine {
+	return t.engine
+}
+
+// Writers returns the writers fed by the engine of `t`.
+func (t *Task) Writers() []pcap.PcapWriter {
+	return t.writers
+}
+
+// Output returns the file name template of the files written by `t`; it is empty if `t` was not created from a Config.
+func (t *Task) Output() string {
+	return t.output
+}
+
+// Counters returns the packets written by `t` since it was created.
+func (t *Task) Counters() *stats.Counters {
+	return t.counters
+}
+
+// Health returns the state of `t`.
+func (t *Task) Health() *health.Tracker {
+	return t.health
+}
+
+// Restarts returns how many times the engine of `t` was restarted during the current, or the last, execution.
+func (t *Task) Restarts() uint64 {
+	return t.restarts.Load()
+}
+
+// Err returns the error which stopped the engine of `t` during the last execution, if any.
+func (t *Task) Err() error {
+	return t.err
+}
+
+// Status returns the current state of `t`.
+func (t *Task) Status() TaskStatus {
+	status := TaskStatus{
+		Iface:    t.iface,
+		Engine:   t.name,
+		Status:   t.health.Status(),
+		Restarts: t.restarts.Load(),
+		Counters: t.counters.Snapshot(),
+	}
+	if t.err != nil {
+		status.Error = t.err.Error()
+	}
+	return status
+}
+
+// Abort stops the current run of the engine of `t` with `cause`; it returns `false` if the engine is not running.
+// The engine is restarted unless its execution is over.
+func (t *Task) Abort(cause error) bool {
+	abort := t.abort.Load()
+	if abort == nil {
+		return false
+	}
+	(*abort)(cause)
+	return true
+}
+
+// Rotate closes the files of `t` and opens new ones; it returns how many files were rotated. `tcpdump` is restarted
+// into a new file, and writers into standard output are not rotated.
+func (t *Task) Rotate() int {
+	if _, isTcpdump := t.engine.(*pcap.Tcpdump); isTcpdump {
+		// engines which are not capturing yet are already writing into a new file
+		if t.abort.Load() == nil {
+			return 0
+		}
+		if _, capturing := t.health.SetIf(health.Capturing, health.Rotating); capturing && t.Abort(errRotationRestart) {
+			return 1
+		}
+		return 0
+	}
+
+	rotated := 0
+	if len(t.writers) == 0 {
+		return rotated
+	}
+	t.health.SetIf(health.Capturing, health.Rotating)
+	for _, writer := range t.writers {
+		if !writer.IsStdOutOrErr() {
+			writer.Rotate()
+			rotated += 1
+		}
+	}
+	t.health.SetIf(health.Rotating, health.Capturing)
+	return rotated
+}
+
+// close closes the writers of `t`; it must only be called once no execution is running.
+func (t *Task) close() {
+	for _, writer := range t.writers {
+		writer.Close()
+	}
+}
+
+// run starts the engine of `t`, and converts its panics into errors so that it may be restarted.
+func (t *Task) run(ctx context.Context, writers []pcap.PcapWriter, stopDeadline <-chan *time.Duration) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("engine panicked: %v", r)
+		}
+	}()
+	// all PCAP engines are context aware
+	return t.engine.Start(ctx, writers, stopDeadline)
+}
+
+// Write drops the packet which caused a panic, and aborts the current run of the engine so that it is restarted.
+func (w *safeWriter) Write(p []byte) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("writer panicked: %v", r)
+			w.task.Abort(err)
+		}
+	}()
+	n, err = w.PcapWriter.Write(p)
+	if err != nil && w.hooks.OnWriteError != nil {
+		w.hooks.OnWriteError(w.task, err)
+	}
+	return n, err
+}
+
+// supervise runs the engine of `t` until `ctx` is done; if the engine stops early, it is restarted
+// with exponential backoff, so that the rest of the execution is not left uncaptured.
+// `tcpdump` is also restarted, without backoff, whenever its file is rotated.
+func (t *Task) supervise(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	job string,
+	hooks *Hooks,
+	clock clockwork.Clock,
+	stopDeadline <-chan *time.Duration,
+) {
+	defer wg.Done()
+
+	t.restarts.Store(0)
+	backoff := minRestartBackoff
+
+	// writers are called by the engine: their panics must stop the current run and not the whole process
+	writers := make([]pcap.PcapWriter, 0, len(t.writers))
+	for _, writer := range t.writers {
+		writers = append(writers, &safeWriter{PcapWriter: writer, task: t, hooks: hooks})
+	}
+
+	for {
+		release := func() {}
+		if hooks.Acquire != nil {
+			acquired, err := hooks.Acquire(ctx, t)
+			if err != nil {
+				t.setState(job, hooks, health.Configured, nil)
+				return
+			}
+			if acquired != nil {
+				release = acquired
+			}
+		}
+
+		engineCtx, engineCancel := context.WithCancelCause(ctx)
+		t.abort.Store(&engineCancel)
+		runCtx, end := engineCtx, func(error) {}
+		if hooks.Start != nil {
+			runCtx, end = hooks.Start(engineCtx, t)
+		}
+		engineStopDeadline := make(chan *time.Duration, 1)
+		go forwardStopDeadline(ctx, engineCtx, stopDeadline, engineStopDeadline)
+		t.setState(job, hooks, health.Starting, nil)
+		go t.watchCapturing(engineCtx, job, hooks)
+		startTS := clock.Now()
+		err := t.run(runCtx, writers, engineStopDeadline)
+		release()
+		engineCancel(nil)
+		// the run was aborted, i/e: because the engine stalled or one of its writers panicked
+		if cause := context.Cause(engineCtx); ctx.Err() == nil && !errors.Is(cause, context.Canceled) {
+			err = cause
+		}
+		rotated := errors.Is(err, errRotationRestart)
+		if rotated {
+			// stopping the engine to rotate its file is not a failure
+			err = nil
+		}
+		end(err)
+
+		if ctx.Err() != nil {
+			if isCleanStop(err) {
+				t.err = nil
+				emit(hooks, &Event{Kind: TaskStopped, Job: job, Task: t})
+				t.setState(job, hooks, health.Configured, nil)
+			} else {
+				t.err = err
+				emit(hooks, &Event{Kind: TaskStopped, Job: job, Task: t, Err: err})
+				t.setState(job, hooks, health.Failed, err)
+			}
+			return
+		}
+		t.err = err
+
+		if rotated {
+			// files are named after the second they were created at: the new file must not replace the rotated one
+			now := clock.Now()
+			if !sleep(ctx, clock, now.Truncate(time.Second).Add(time.Second).Sub(now)) {
+				emit(hooks, &Event{Kind: TaskStopped, Job: job, Task: t})
+				t.setState(job, hooks, health.Configured, nil)
+				return
+			}
+			continue
+		}
+
+		if errors.Is(err, ErrPaused) {
+			// engines are restarted as soon as they are allowed to capture again
+			emit(hooks, &Event{Kind: TaskRestarting, Job: job, Task: t, Err: err})
+			t.setState(job, hooks, health.Degraded, err)
+			continue
+		}
+
+		if err == nil {
+			err = errEarlyStop
+			t.err = err
+		}
+		// engines which ran for a while are not failing repeatedly
+		if clock.Since(startTS) > maxRestartBackoff {
+			backoff = minRestartBackoff
+		}
+		t.restarts.Add(1)
+		t.setState(job, hooks, health.Degraded, err)
+		emit(hooks, &Event{Kind: TaskRestarting, Job: job, Task: t, Err: err, Backoff: backoff})
+
+		if !sleep(ctx, clock, backoff) {
+			emit(hooks, &Event{Kind: TaskStopped, Job: job, Task: t, Err: err})
+			t.setState(job, hooks, health.Failed, err)
+			return
+		}
+		backoff = min(2*backoff, maxRestartBackoff)
+	}
+}
+
+// watchCapturing moves `t` into `capturing` once its engine is active; engines do not report when their capture is open.
+func (t *Task) watchCapturing(ctx context.Context, job string, hooks *Hooks) {
+	ticker := time.NewTicker(captureCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if t.engine.IsActive() {
+			if transition, changed := t.health.SetIf(health.Starting, health.Capturing); changed {
+				emit(hooks, &Event{Kind: StateChanged, Job: job, Task: t, Transition: transition})
+			}
+			return
+		}
+	}
+}
+
+// setState moves `t` into `state` and reports the transition; transitions caused by rotations are not reported.
+func (t *Task) setState(job string, hooks *Hooks, state health.State, err error) {
+	transition, changed := t.health.Set(state, err)
+	if !changed || transition.From == health.Rotating || transition.To == health.Rotating {
+		return
+	}
+	emit(hooks, &Event{Kind: StateChanged, Job: job, Task: t, Transition: transition})
+}
+
+// forwardStopDeadline provides the deadline to stop a single run of an engine: the one of the execution when `ctx` is done,
+// or a short one if only `engineCtx` is done; i/e: because `tcpdump` is restarted to rotate its file, or because the engine stalled.
+func forwardStopDeadline(ctx, engineCtx context.Context, stopDeadline <-chan *time.Duration, engineStopDeadline chan<- *time.Duration) {
+	<-engineCtx.Done()
+	if ctx.Err() == nil {
+		deadline := stalledStopDeadline
+		engineStopDeadline <- &deadline
+		return
+	}
+	if deadline, ok := <-stopDeadline; ok {
+		engineStopDeadline <- deadline
+	}
+}
+
+// sleep waits for `d` as measured by `clock`; it returns `false` if `ctx` was done first.
+func sleep(ctx context.Context, clock clockwork.Clock, d time.Duration) bool {
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.Chan():
+		return true
+	}
+}
+
+// isCleanStop returns `true` if `err` only reports that the execution of an engine ended.
+func isCleanStop(err error) bool {
+	if err == nil {
+		return true
+	}
+	if joinedErr, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joinedErr.Unwrap() {
+			if !isCleanStop(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
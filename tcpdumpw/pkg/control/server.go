@@ -0,0 +1,194 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package control
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/wissance/stringFormatter"
+)
+
+type (
+	// CommandHandler executes a control command; the returned string is sent back to the client.
+	CommandHandler func(ctx context.Context, args []string) (string, error)
+
+	// Server accepts line delimited commands over a Unix socket;
+	// each line is `COMMAND [ARG...]` and each response is `OK [RESULT]` or `ERR <MESSAGE>`.
+	Server struct {
+		path      string
+		mu        sync.RWMutex
+		handlers  map[string]CommandHandler
+		onCommand func(ctx context.Context, command string, args []string, result string, err error)
+	}
+
+	// Peer holds the credentials of the process which sent a command, as reported by the kernel.
+	Peer struct {
+		PID int32
+		UID uint32
+		GID uint32
+	}
+
+	peerKey struct{}
+)
+
+const (
+	responseOK  = "OK"
+	responseERR = "ERR"
+)
+
+var errUnknownCommand = errors.New("unknown command")
+
+func (s *Server) Handle(command string, handler CommandHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[strings.ToUpper(command)] = handler
+}
+
+// OnCommand registers a function to be invoked after every command is executed;
+// the credentials of the client are available using `PeerFromContext`.
+func (s *Server) OnCommand(onCommand func(ctx context.Context, command string, args []string, result string, err error)) {
+	s.onCommand = onCommand
+}
+
+// PeerFromContext returns the credentials of the client which sent the command being executed.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	peer, ok := ctx.Value(peerKey{}).(*Peer)
+	return peer, ok
+}
+
+// peerCredentials asks the kernel who is connected to the socket: clients cannot forge them.
+func peerCredentials(conn net.Conn) (*Peer, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a Unix socket: %s", conn.RemoteAddr())
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var ucredErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, ucredErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if ucredErr != nil {
+		return nil, ucredErr
+	}
+	return &Peer{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
+
+func (s *Server) execute(ctx context.Context, line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return responseERR + " empty command"
+	}
+
+	command := strings.ToUpper(fields[0])
+	args := fields[1:]
+
+	s.mu.RLock()
+	handler, ok := s.handlers[command]
+	s.mu.RUnlock()
+
+	var result string
+	var err error
+	if ok {
+		result, err = handler(ctx, args)
+	} else {
+		err = errUnknownCommand
+	}
+
+	if s.onCommand != nil {
+		s.onCommand(ctx, command, args, result, err)
+	}
+
+	if err != nil {
+		return stringFormatter.Format("{0} {1}", responseERR, err.Error())
+	}
+	if result == "" {
+		return responseOK
+	}
+	return stringFormatter.Format("{0} {1}", responseOK, result)
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	if peer, err := peerCredentials(conn); err == nil {
+		ctx = context.WithValue(ctx, peerKey{}, peer)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if _, err := fmt.Fprintln(conn, s.execute(ctx, scanner.Text())); err != nil {
+			return
+		}
+	}
+}
+
+// Serve accepts connections until `ctx` is done.
+func (s *Server) Serve(ctx context.Context) error {
+	// a previous execution may have left the socket behind
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+	// containers sharing the volume may run as any user
+	os.Chmod(s.path, 0o666)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				os.Remove(s.path)
+				return nil
+			default:
+				return err
+			}
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *Server) Path() string {
+	return s.path
+}
+
+func NewServer(path string) *Server {
+	return &Server{
+		path:     path,
+		handlers: make(map[string]CommandHandler),
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package engines is the registry of PCAP engines; every engine declares what it is able to do and what it requires
+// from the environment, so that the best available one is selected at startup instead of failing once capturing starts.
+package engines
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// Source is where an engine obtains packets from.
+	Source string
+
+	// Capabilities describe what an engine is able to do, and what it requires from the environment.
+	Capabilities struct {
+		// Formats are the formats the engine writes packets as: `pcap` files, or `json` translated packets fed into writers.
+		Formats []string `json:"formats"`
+		Source  Source   `json:"source"`
+		// Root engines require `CAP_NET_RAW` to open captures.
+		Root bool `json:"root"`
+		// Binary is the external executable the engine runs, if any.
+		Binary string `json:"binary,omitempty"`
+		// TsType engines allow to choose the source of timestamps.
+		TsType bool `json:"tstype"`
+		// Fanout engines allow to spread the packets of a single iface across many sockets.
+		Fanout bool `json:"fanout"`
+		// Truncate engines are able to drop the payload of every packet; Rewrite engines are able to modify packets before writing them.
+		Truncate bool `json:"truncate"`
+		Rewrite  bool `json:"rewrite"`
+		// Millis and Sequence engines include milliseconds, and sequence numbers, in the names of the files they write;
+		// `strftime` has no directive for them.
+		Millis   bool `json:"millis"`
+		Sequence bool `json:"sequence"`
+	}
+
+	// Factory creates an engine which captures as described by `config`.
+	Factory func(ctx context.Context, config *pcap.PcapConfig) (pcap.PcapEngine, error)
+
+	// Engine is a registered PCAP engine.
+	Engine struct {
+		Name         string       `json:"name"`
+		Capabilities Capabilities `json:"capabilities"`
+		// Priority is used to choose among engines which satisfy the same requirements; the highest wins.
+		Priority int     `json:"priority"`
+		Factory  Factory `json:"-"`
+		// Probe returns why the engine is not available, beyond its declared requirements; it is optional.
+		Probe func() error `json:"-"`
+	}
+
+	// Requirements describe the engine a task needs.
+	Requirements struct {
+		Format   string
+		Source   Source
+		TsType   bool
+		Fanout   bool
+		Truncate bool
+		Rewrite  bool
+		Millis   bool
+		Sequence bool
+	}
+
+	// Rejection explains why an engine was not selected.
+	Rejection struct {
+		Engine string `json:"engine"`
+		Reason string `json:"reason"`
+	}
+)
+
+const (
+	// Live engines capture packets from ifaces.
+	Live Source = "live"
+	// File engines replay the packets of capture files.
+	File Source = "file"
+	// Script engines emit scripted packets.
+	Script Source = "script"
+)
+
+const (
+	FormatPCAP = "pcap"
+	FormatJSON = "json"
+)
+
+// `CAP_NET_RAW` is the 13th bit of the effective capabilities; see: `capabilities(7)`
+const capNetRaw = 13
+
+var (
+	// ErrNoEngine is returned when no registered engine satisfies the requirements.
+	ErrNoEngine = errors.New("no engine is available")
+	// ErrUnknown is returned when looking up an engine which was not registered.
+	ErrUnknown = errors.New("unknown engine")
+)
+
+var (
+	mu       sync.RWMutex
+	registry = []*Engine{}
+
+	rootOnce sync.Once
+	rootErr  error
+)
+
+// Register makes `engine` available to be selected; it panics if its name is already taken,
+// as registration happens while initializing packages.
+func Register(engine *Engine) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if engine == nil || engine.Factory == nil {
+		panic("engines: Register with nil factory")
+	}
+	for _, registered := range registry {
+		if strings.EqualFold(registered.Name, engine.Name) {
+			panic(fmt.Sprintf("engines: Register called twice for engine: %s", engine.Name))
+		}
+	}
+	registry = append(registry, engine)
+}
+
+// Lookup returns the engine registered as `name`.
+func Lookup(name string) (*Engine, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	for _, engine := range registry {
+		if strings.EqualFold(engine.Name, name) {
+			return engine, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknown, name)
+}
+
+// Engines returns all the registered engines, in the order they were registered.
+func Engines() []*Engine {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]*Engine(nil), registry...)
+}
+
+// Supports returns why `e` does not satisfy `req`, or `nil` if it does.
+func (e *Engine) Supports(req *Requirements) error {
+	c := &e.Capabilities
+	switch {
+	case !slices.Contains(c.Formats, req.Format):
+		return fmt.Errorf("format '%s' is not supported", req.Format)
+	case c.Source != req.Source:
+		return fmt.Errorf("source '%s' is not supported", req.Source)
+	case req.TsType && !c.TsType:
+		return errors.New("timestamp types are not supported")
+	case req.Fanout && !c.Fanout:
+		return errors.New("fanout is not supported")
+	case req.Truncate && !c.Truncate:
+		return errors.New("truncating packets is not supported")
+	case req.Rewrite && !c.Rewrite:
+		return errors.New("rewriting packets is not supported")
+	case req.Millis && !c.Millis:
+		return errors.New("milliseconds in file names are not supported")
+	case req.Sequence && !c.Sequence:
+		return errors.New("sequence numbers in file names are not supported")
+	}
+	return nil
+}
+
+// Available returns why `e` cannot run in the current environment, or `nil` if it can.
+func (e *Engine) Available() error {
+	if e.Capabilities.Binary != "" {
+		if _, err := exec.LookPath(e.Capabilities.Binary); err != nil {
+			return fmt.Errorf("'%s' is not installed: %w", e.Capabilities.Binary, err)
+		}
+	}
+	if e.Capabilities.Root {
+		if err := checkCapNetRaw(); err != nil {
+			return err
+		}
+	}
+	if e.Probe != nil {
+		return e.Probe()
+	}
+	return nil
+}
+
+// Select returns the available engine with the highest priority which satisfies `req`, along with the reasons
+// why every other engine was rejected; engines with the same priority are chosen in registration order.
+func Select(req *Requirements) (*Engine, []Rejection, error) {
+	candidates := Engines()
+	slices.SortStableFunc(candidates, func(a, b *Engine) int {
+		return b.Priority - a.Priority
+	})
+
+	var selected *Engine = nil
+	rejections := []Rejection{}
+	for _, engine := range candidates {
+		if err := engine.Supports(req); err != nil {
+			rejections = append(rejections, Rejection{Engine: engine.Name, Reason: err.Error()})
+			continue
+		}
+		if selected != nil {
+			rejections = append(rejections, Rejection{Engine: engine.Name, Reason: fmt.Sprintf("lower priority than '%s'", selected.Name)})
+			continue
+		}
+		if err := engine.Available(); err != nil {
+			rejections = append(rejections, Rejection{Engine: engine.Name, Reason: err.Error()})
+			continue
+		}
+		selected = engine
+	}
+
+	if selected == nil {
+		return nil, rejections, fmt.Errorf("%w: format: %s | source: %s", ErrNoEngine, req.Format, req.Source)
+	}
+	return selected, rejections, nil
+}
+
+// checkCapNetRaw returns an error if the process is not allowed to open captures.
+func checkCapNetRaw() error {
+	rootOnce.Do(func() {
+		rootErr = readCapNetRaw()
+	})
+	return rootErr
+}
+
+func readCapNetRaw() error {
+	status, err := os.Open("/proc/self/status")
+	if err != nil {
+		// capabilities cannot be verified: let the engine report the actual error
+		return nil
+	}
+	defer status.Close()
+
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !found {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return nil
+		}
+		if caps&(1<<capNetRaw) == 0 {
+			return errors.New("CAP_NET_RAW is required")
+		}
+		return nil
+	}
+	return nil
+}
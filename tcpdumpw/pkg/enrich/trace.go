@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enrich
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// TraceCorrelator remembers which Cloud Trace span every connection belongs to;
+	// connections are identified by their `ip:port` addresses, in any order.
+	TraceCorrelator interface {
+		Set(src, dst, trace, span string)
+		// Lookup returns the trace as a resource name, i/e: `projects/<project>/traces/<trace>`
+		Lookup(src, dst string) (string, string, bool)
+	}
+
+	// TraceWriter adds the trace and span of their connection into JSON translated packets which do not carry them;
+	// packets whose HTTP headers were decoded by the translator also teach the correlator about their connection.
+	TraceWriter struct {
+		pcap.PcapWriter
+		correlator TraceCorrelator
+	}
+
+	jsonTracedRecord struct {
+		L3 *struct {
+			Src string `json:"src"`
+			Dst string `json:"dst"`
+		} `json:"L3"`
+		L4 *struct {
+			Src uint16 `json:"src"`
+			Dst uint16 `json:"dst"`
+		} `json:"L4"`
+		Trace string `json:"logging.googleapis.com/trace"`
+		Span  string `json:"logging.googleapis.com/spanId"`
+	}
+)
+
+const (
+	traceProperty = "logging.googleapis.com/trace"
+	spanProperty  = "logging.googleapis.com/spanId"
+)
+
+func (w *TraceWriter) correlate(p []byte) []byte {
+	record := bytes.TrimRight(p, " \r\n")
+	if !bytes.HasSuffix(record, []byte("}")) {
+		return p
+	}
+
+	traced := &jsonTracedRecord{}
+	if err := json.Unmarshal(record, traced); err != nil || traced.L3 == nil || traced.L4 == nil {
+		return p
+	}
+	src := fmt.Sprintf("%s:%d", traced.L3.Src, traced.L4.Src)
+	dst := fmt.Sprintf("%s:%d", traced.L3.Dst, traced.L4.Dst)
+
+	if traced.Trace != "" {
+		w.correlator.Set(src, dst, traced.Trace, traced.Span)
+		return p
+	}
+
+	trace, span, ok := w.correlator.Lookup(src, dst)
+	if !ok {
+		return p
+	}
+	encodedTrace, _ := json.Marshal(trace)
+	encodedSpan, _ := json.Marshal(span)
+
+	correlated := make([]byte, 0, len(p)+len(encodedTrace)+len(encodedSpan)+64)
+	correlated = append(correlated, record[:len(record)-1]...)
+	correlated = append(correlated, `,"`+traceProperty+`":`...)
+	correlated = append(correlated, encodedTrace...)
+	correlated = append(correlated, `,"`+spanProperty+`":`...)
+	correlated = append(correlated, encodedSpan...)
+	correlated = append(correlated, '}')
+	return append(correlated, p[len(record):]...)
+}
+
+func (w *TraceWriter) Write(p []byte) (int, error) {
+	if _, err := w.PcapWriter.Write(w.correlate(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func NewTraceWriter(writer pcap.PcapWriter, correlator TraceCorrelator) *TraceWriter {
+	return &TraceWriter{PcapWriter: writer, correlator: correlator}
+}
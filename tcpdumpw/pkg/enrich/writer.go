@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enrich
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// Annotator describes the addresses of JSON translated packets;
+	// annotations must be available without blocking the capture path.
+	Annotator interface {
+		// Property is the name of the object which contains the annotation, i/e: `GEO`
+		Property() string
+		// Annotate returns `nil` if there is nothing to be added about `src` and `dst`
+		Annotate(src, dst string) any
+	}
+
+	// Writer adds the annotations of all annotators into JSON translated packets,
+	// as the last properties of every record, before writing them into the wrapped writer.
+	Writer struct {
+		pcap.PcapWriter
+		annotators []Annotator
+	}
+
+	// ConstantAnnotator adds the same annotation into every record, i/e: the tags of the capture.
+	ConstantAnnotator struct {
+		property   string
+		annotation json.RawMessage
+	}
+
+	jsonAddresses struct {
+		L3 *struct {
+			Src string `json:"src"`
+			Dst string `json:"dst"`
+		} `json:"L3"`
+	}
+)
+
+func (w *Writer) enrich(p []byte) []byte {
+	record := bytes.TrimRight(p, " \r\n")
+	if !bytes.HasSuffix(record, []byte("}")) {
+		return p
+	}
+
+	addresses := &jsonAddresses{}
+	if err := json.Unmarshal(record, addresses); err != nil || addresses.L3 == nil {
+		return p
+	}
+
+	var enriched []byte
+	for _, annotator := range w.annotators {
+		annotation := annotator.Annotate(addresses.L3.Src, addresses.L3.Dst)
+		if annotation == nil {
+			continue
+		}
+		encoded, err := json.Marshal(annotation)
+		if err != nil {
+			continue
+		}
+		if enriched == nil {
+			enriched = make([]byte, 0, len(p)+len(encoded)+16)
+			enriched = append(enriched, record[:len(record)-1]...)
+		}
+		enriched = append(enriched, `,"`...)
+		enriched = append(enriched, annotator.Property()...)
+		enriched = append(enriched, `":`...)
+		enriched = append(enriched, encoded...)
+	}
+
+	if enriched == nil {
+		return p
+	}
+	enriched = append(enriched, '}')
+	return append(enriched, p[len(record):]...)
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if _, err := w.PcapWriter.Write(w.enrich(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func NewWriter(writer pcap.PcapWriter, annotators ...Annotator) *Writer {
+	return &Writer{PcapWriter: writer, annotators: annotators}
+}
+
+func (a *ConstantAnnotator) Property() string {
+	return a.property
+}
+
+func (a *ConstantAnnotator) Annotate(src, dst string) any {
+	return a.annotation
+}
+
+// NewConstantAnnotator encodes `annotation` only once: it must not change afterwards.
+func NewConstantAnnotator(property string, annotation any) (*ConstantAnnotator, error) {
+	encoded, err := json.Marshal(annotation)
+	if err != nil {
+		return nil, err
+	}
+	return &ConstantAnnotator{property: property, annotation: encoded}, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package execution carries the identity of the execution packets are captured by: engines obtain it from
+// their context, and writers are able to stamp it onto their outputs.
+package execution
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// Info identifies an execution of a job.
+	Info struct {
+		JobID       string `json:"job,omitempty"`
+		ExecutionID string `json:"execution"`
+		// Slot is the wall-clock window the execution belongs to; empty unless windows are enabled.
+		Slot string `json:"slot,omitempty"`
+		// Profile is the name of the capture profile the execution belongs to, if any.
+		Profile string            `json:"profile,omitempty"`
+		Tags    map[string]string `json:"tags,omitempty"`
+		// LogName is where the packets translated by this execution are logged.
+		LogName string `json:"-"`
+	}
+
+	// Annotator stamps the identity of the current execution onto JSON translated packets; it implements
+	// `enrich.Annotator`, and its execution is replaced every time one starts. It is safe for concurrent use.
+	Annotator struct {
+		property   string
+		annotation atomic.Pointer[json.RawMessage]
+	}
+
+	infoKey struct{}
+)
+
+// ID returns the ID used by engines to identify the execution, i/e: `job/<job>/exe/<execution>`;
+// executions which do not belong to a scheduled job are identified by their own ID.
+func (i *Info) ID() string {
+	if i.JobID == "" {
+		return i.ExecutionID
+	}
+	return fmt.Sprintf("job/%s/exe/%s", i.JobID, i.ExecutionID)
+}
+
+// WithSlot returns a copy of `i` which belongs to `slot`.
+func (i *Info) WithSlot(slot string) *Info {
+	info := *i
+	info.Slot = slot
+	return &info
+}
+
+// NewContext returns a copy of `ctx` which carries `info`; the keys used by `pcap-cli` engines are also set,
+// so that JSON translated packets are labeled with the ID and log name of the execution.
+func NewContext(ctx context.Context, info *Info) context.Context {
+	ctx = context.WithValue(ctx, infoKey{}, info)
+	ctx = context.WithValue(ctx, pcap.PcapContextID, info.ID())
+	return context.WithValue(ctx, pcap.PcapContextLogName, info.LogName)
+}
+
+// FromContext returns the execution carried by `ctx`, if any.
+func FromContext(ctx context.Context) (*Info, bool) {
+	info, ok := ctx.Value(infoKey{}).(*Info)
+	return info, ok
+}
+
+// NewAnnotator returns an annotator which adds the current execution as `property`; nothing is added until one starts.
+func NewAnnotator(property string) *Annotator {
+	return &Annotator{property: property}
+}
+
+// Set replaces the execution stamped onto packets; `nil` stops stamping them. It is a no-op on a `nil` annotator.
+func (a *Annotator) Set(info *Info) {
+	if a == nil {
+		return
+	}
+	if info == nil {
+		a.annotation.Store(nil)
+		return
+	}
+	// executions are encoded only once, instead of once per packet
+	if encoded, err := json.Marshal(info); err == nil {
+		annotation := json.RawMessage(encoded)
+		a.annotation.Store(&annotation)
+	}
+}
+
+func (a *Annotator) Property() string {
+	return a.property
+}
+
+func (a *Annotator) Annotate(src, dst string) any {
+	if annotation := a.annotation.Load(); annotation != nil {
+		return *annotation
+	}
+	return nil
+}
@@ -97,3 +97,7 @@ func NewPortsFilterProvider(rawFilter *string, compatFilters pcap.PcapFilters) p
 func NewTCPFlagsFilterProvider(rawFilter *string, compatFilters pcap.PcapFilters) pcap.PcapFilterProvider {
 	return newPcapFilterProvider(rawFilter, compatFilters, newTCPFlagsFilterProvider)
 }
+
+func NewNoiseFilterProvider() pcap.PcapFilterProvider {
+	return newNoiseFilterProvider()
+}
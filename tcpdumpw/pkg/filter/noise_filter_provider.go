@@ -0,0 +1,91 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/gchux/pcap-cli/pkg/pcap"
+	"github.com/wissance/stringFormatter"
+)
+
+type (
+	// NoiseFilterProvider excludes the traffic generated by the platform rather than by the workload:
+	// health checks, requests to the metadata server and logging agents shipping entries to Cloud Logging.
+	NoiseFilterProvider struct {
+		resolver *net.Resolver
+	}
+)
+
+var (
+	// see: https://cloud.google.com/compute/docs/metadata/overview
+	noiseHosts = []string{"169.254.169.254"}
+	// see: https://cloud.google.com/load-balancing/docs/health-check-concepts#ip-ranges
+	noiseNETs = []string{"35.191.0.0/16", "130.211.0.0/22"}
+	// logging agents stream entries into the Cloud Logging API
+	noiseFQDNs = []string{"logging.googleapis.com"}
+)
+
+func (p *NoiseFilterProvider) getIPs(ctx context.Context) []string {
+	ipSet := mapset.NewThreadUnsafeSet(noiseHosts...)
+	for _, fqdn := range noiseFQDNs {
+		addrs, err := p.resolver.LookupHost(ctx, fqdn)
+		if err != nil {
+			// the FQDN is not resolvable: then its traffic is not expected either
+			continue
+		}
+		for _, addr := range addrs {
+			if IP, err := netip.ParseAddr(addr); err == nil {
+				ipSet.Add(IP.String())
+			}
+		}
+	}
+	return ipSet.ToSlice()
+}
+
+func (p *NoiseFilterProvider) Get(ctx context.Context) (*string, bool) {
+	hosts := stringFormatter.Format("host {0}", strings.Join(p.getIPs(ctx), " or host "))
+	nets := stringFormatter.Format("net {0}", strings.Join(noiseNETs, " or net "))
+	filter := stringFormatter.Format("not ({0} or {1})", hosts, nets)
+	return &filter, true
+}
+
+func (p *NoiseFilterProvider) String() string {
+	if filter, ok := p.Get(context.Background()); ok {
+		return stringFormatter.Format("NoiseFilter[{0}] => ({1})",
+			strings.Join(noiseFQDNs, ","), *filter)
+	}
+	return "NoiseFilter[nil]"
+}
+
+func (p *NoiseFilterProvider) Apply(
+	ctx context.Context,
+	srcFilter *string,
+	mode pcap.PcapFilterMode,
+) *string {
+	return applyFilter(ctx, srcFilter, p, mode)
+}
+
+func newNoiseFilterProvider() pcap.PcapFilterProvider {
+	return &NoiseFilterProvider{
+		resolver: &net.Resolver{
+			PreferGo: true,
+		},
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/wissance/stringFormatter"
+)
+
+// presets are vetted BPF expressions which may be referenced by name as `@<name>` in complex filters.
+var presets = map[string]string{
+	// DNS queries and responses, including zone transfers and large responses over TCP
+	"dns": "udp port 53 or tcp port 53",
+	// Cloud Run containers never listen on port 443: all HTTPS traffic, including QUIC, is egress
+	"https-egress": "tcp port 443 or udp port 443",
+	// MySQL, PostgreSQL, SQL Server and the Cloud SQL Auth Proxy
+	"sql": "tcp port 3306 or tcp port 3307 or tcp port 5432 or tcp port 1433",
+	// Redis and Memcached, i/e: Memorystore
+	"cache":           "tcp port 6379 or tcp port 11211",
+	"no-healthchecks": stringFormatter.Format("not (net {0})", strings.Join(noiseNETs, " or net ")),
+	"no-metadata":     stringFormatter.Format("not (host {0})", strings.Join(noiseHosts, " or host ")),
+	// connection establishment and teardown
+	"handshakes": "tcp[tcpflags] & (tcp-syn|tcp-fin|tcp-rst) != 0",
+	"icmp":       "icmp or icmp6",
+}
+
+var presetReference = regexp.MustCompile(`@([a-z0-9][a-z0-9-]*)`)
+
+// Presets returns the names of all the available presets.
+func Presets() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, "@"+name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ExpandPresets replaces every `@<name>` in `filter` with the BPF expression of the preset it references, so that
+// presets may be composed with each other and with user supplied clauses; i/e: `@dns or (@sql and not host 10.0.0.1)`.
+func ExpandPresets(filter string) (string, error) {
+	var err error
+	expanded := presetReference.ReplaceAllStringFunc(filter, func(reference string) string {
+		expression, ok := presets[reference[1:]]
+		if !ok {
+			err = fmt.Errorf("unknown filter preset: %s; available presets: %s", reference, strings.Join(Presets(), ","))
+			return reference
+		}
+		// preset expressions are isolated so that they are not affected by the precedence of adjacent operators
+		return stringFormatter.Format("({0})", expression)
+	})
+	return expanded, err
+}
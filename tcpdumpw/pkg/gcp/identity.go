@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type (
+	Identity struct {
+		ProjectID      string `json:"project_id,omitempty"`
+		Service        string `json:"service,omitempty"`
+		Region         string `json:"region,omitempty"`
+		Revision       string `json:"revision,omitempty"`
+		InstanceID     string `json:"instance_id,omitempty"`
+		ServiceAccount string `json:"service_account,omitempty"`
+	}
+
+	identityField struct {
+		value *string
+		path  string
+		parse func(string) string
+	}
+)
+
+const (
+	mdsProjectID      = "project/project-id"
+	mdsRegion         = "instance/region"
+	mdsZone           = "instance/zone"
+	mdsInstanceID     = "instance/id"
+	mdsServiceAccount = "instance/service-accounts/default/email"
+)
+
+func firstEnvVar(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// `instance/region` is formatted as: `projects/<number>/regions/<region>`
+func regionFromPath(value string) string {
+	return path.Base(value)
+}
+
+// `instance/zone` is formatted as: `projects/<number>/zones/<region>-<zone>`
+func regionFromZone(value string) string {
+	zone := path.Base(value)
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+func (i *Identity) missingFields() []*identityField {
+	return []*identityField{
+		{&i.ProjectID, mdsProjectID, nil},
+		{&i.Region, mdsRegion, regionFromPath},
+		{&i.InstanceID, mdsInstanceID, nil},
+		{&i.ServiceAccount, mdsServiceAccount, nil},
+	}
+}
+
+// Tags returns the identity fields in the order used to tag scheduled jobs and log entries.
+func (i *Identity) Tags() []string {
+	return []string{i.ProjectID, i.Service, i.Region, i.Revision, i.InstanceID, i.ServiceAccount}
+}
+
+// InstanceHash returns a short and stable representation of the instance ID.
+func (i *Identity) InstanceHash() string {
+	if i.InstanceID == "" {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(i.InstanceID))
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
+
+// Resolve populates all identity fields which were not provided via environment
+// using the metadata server; it returns the names of the fields that were resolved.
+// Fields are resolved independently: the error holds all the fields which could not be resolved.
+func (i *Identity) Resolve(ctx context.Context, client *MetadataClient) ([]string, error) {
+	resolved := []string{}
+	var errs []error
+
+	for _, field := range i.missingFields() {
+		if *field.value != "" {
+			continue
+		}
+
+		value, err := client.Get(ctx, field.path)
+		if err != nil && field.path == mdsRegion {
+			// App Engine Flex and GCE expose the zone instead of the region
+			value, err = client.Get(ctx, mdsZone)
+			field.parse = regionFromZone
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("metadata[%s]: %w", field.path, err))
+			continue
+		}
+
+		if field.parse != nil {
+			value = field.parse(value)
+		}
+		*field.value = value
+		resolved = append(resolved, field.path)
+	}
+
+	return resolved, errors.Join(errs...)
+}
+
+// NewIdentityFromEnv creates an `Identity` using the environment variables
+// populated by the sidecar `init` script, or by the Cloud Run runtime.
+func NewIdentityFromEnv() *Identity {
+	return &Identity{
+		ProjectID:  firstEnvVar("PROJECT_ID", "GOOGLE_CLOUD_PROJECT", "GCLOUD_PROJECT"),
+		Service:    firstEnvVar("APP_SERVICE", "K_SERVICE"),
+		Region:     firstEnvVar("GCP_REGION"),
+		Revision:   firstEnvVar("APP_REVISION", "K_REVISION"),
+		InstanceID: firstEnvVar("INSTANCE_ID"),
+	}
+}
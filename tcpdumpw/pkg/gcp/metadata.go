@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wissance/stringFormatter"
+)
+
+type (
+	MetadataClient struct {
+		client  *http.Client
+		watcher *http.Client
+		baseURL string
+	}
+)
+
+const (
+	metadataHostEnvVar   = "GCE_METADATA_HOST"
+	metadataDefaultHost  = "metadata.google.internal"
+	metadataURLTemplate  = "http://{0}/computeMetadata/v1/"
+	metadataFlavorHeader = "Metadata-Flavor"
+	metadataFlavor       = "Google"
+)
+
+var (
+	errMetadataUnavailable = errors.New("metadata server is unavailable")
+	ErrMetadataNotFound    = errors.New("metadata is not available")
+)
+
+func (c *MetadataClient) get(ctx context.Context, client *http.Client, path string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set(metadataFlavorHeader, metadataFlavor)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", "", errors.Join(errMetadataUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	// the metadata server always flags its responses; anything else is a proxy or a captive portal
+	if res.Header.Get(metadataFlavorHeader) != metadataFlavor {
+		return "", "", errMetadataUnavailable
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return "", "", ErrMetadataNotFound
+	} else if res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("metadata[%s] status: %d", path, res.StatusCode)
+	}
+
+	value, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(string(value)), res.Header.Get("ETag"), nil
+}
+
+func (c *MetadataClient) Get(ctx context.Context, path string) (string, error) {
+	value, _, err := c.get(ctx, c.client, path)
+	return value, err
+}
+
+// WaitForChange blocks until the value at `path` is different from the one identified by `etag`;
+// an empty `etag` returns the current value immediately. The lifetime of the request is bound to `ctx`.
+func (c *MetadataClient) WaitForChange(ctx context.Context, path, etag string) (string, string, error) {
+	if etag == "" {
+		return c.get(ctx, c.client, path)
+	}
+	path = stringFormatter.Format("{0}?wait_for_change=true&last_etag={1}", path, etag)
+	return c.get(ctx, c.watcher, path)
+}
+
+func NewMetadataClient(timeout time.Duration) *MetadataClient {
+	host := os.Getenv(metadataHostEnvVar)
+	if host == "" {
+		host = metadataDefaultHost
+	}
+
+	return &MetadataClient{
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		// hanging GETs are only bound by their context
+		watcher: &http.Client{},
+		baseURL: stringFormatter.Format(metadataURLTemplate, host),
+	}
+}
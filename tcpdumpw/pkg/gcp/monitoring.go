@@ -0,0 +1,188 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wissance/stringFormatter"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/stats"
+)
+
+type (
+	MonitoringClient struct {
+		tokens   *tokenSource
+		client   *http.Client
+		identity *Identity
+		url      string
+	}
+
+	monitoringResource struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels"`
+	}
+
+	monitoringMetric struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels,omitempty"`
+	}
+
+	monitoringInterval struct {
+		EndTime string `json:"endTime"`
+	}
+
+	monitoringValue struct {
+		Int64Value  *string  `json:"int64Value,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+
+	monitoringPoint struct {
+		Interval monitoringInterval `json:"interval"`
+		Value    monitoringValue    `json:"value"`
+	}
+
+	monitoringTimeSeries struct {
+		Metric     monitoringMetric   `json:"metric"`
+		Resource   monitoringResource `json:"resource"`
+		MetricKind string             `json:"metricKind"`
+		ValueType  string             `json:"valueType"`
+		Points     []monitoringPoint  `json:"points"`
+	}
+
+	monitoringRequest struct {
+		TimeSeries []*monitoringTimeSeries `json:"timeSeries"`
+	}
+)
+
+const (
+	monitoringURLTemplate = "https://monitoring.googleapis.com/v3/projects/{0}/timeSeries"
+	metricTypePrefix      = "custom.googleapis.com/pcap/"
+	// Cloud Run resources do not accept custom metrics: `generic_task` is mapped to Cloud Run labels instead.
+	monitoringResourceType = "generic_task"
+	// Cloud Monitoring accepts up to 200 time series per request
+	maxTimeSeriesPerRequest = 200
+)
+
+func (c *MonitoringClient) resource() monitoringResource {
+	return monitoringResource{
+		Type: monitoringResourceType,
+		Labels: map[string]string{
+			"project_id": c.identity.ProjectID,
+			"location":   c.identity.Region,
+			"namespace":  c.identity.Service,
+			"job":        c.identity.Revision,
+			"task_id":    c.identity.InstanceID,
+		},
+	}
+}
+
+func (c *MonitoringClient) newTimeSeries(point *stats.Point, endTime string) *monitoringTimeSeries {
+	// Cloud Run resource labels are also added as metric labels to make metrics easier to find
+	labels := map[string]string{
+		"service_name":  c.identity.Service,
+		"revision_name": c.identity.Revision,
+	}
+	for key, value := range point.Labels {
+		labels[key] = value
+	}
+
+	series := &monitoringTimeSeries{
+		Metric:     monitoringMetric{Type: metricTypePrefix + point.Name, Labels: labels},
+		Resource:   c.resource(),
+		MetricKind: "GAUGE",
+		Points:     []monitoringPoint{{Interval: monitoringInterval{EndTime: endTime}}},
+	}
+
+	if point.Double != nil {
+		series.ValueType = "DOUBLE"
+		series.Points[0].Value.DoubleValue = point.Double
+	} else {
+		value := strconv.FormatInt(*point.Int64, 10)
+		series.ValueType = "INT64"
+		series.Points[0].Value.Int64Value = &value
+	}
+
+	return series
+}
+
+func (c *MonitoringClient) write(ctx context.Context, token string, series []*monitoringTimeSeries) error {
+	body, err := json.Marshal(&monitoringRequest{TimeSeries: series})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("monitoring status: %d | %s", res.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// Write creates a time series for each point, named `custom.googleapis.com/pcap/<name>`; all points share the same timestamp.
+func (c *MonitoringClient) Write(ctx context.Context, timestamp time.Time, points []*stats.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	token, err := c.tokens.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	endTime := timestamp.UTC().Format(time.RFC3339Nano)
+	series := make([]*monitoringTimeSeries, 0, len(points))
+	for _, point := range points {
+		series = append(series, c.newTimeSeries(point, endTime))
+	}
+
+	for len(series) > 0 {
+		size := min(len(series), maxTimeSeriesPerRequest)
+		if err := c.write(ctx, token, series[:size]); err != nil {
+			return err
+		}
+		series = series[size:]
+	}
+	return nil
+}
+
+func NewMonitoringClient(mds *MetadataClient, identity *Identity, timeout time.Duration) *MonitoringClient {
+	return &MonitoringClient{
+		tokens:   newTokenSource(mds),
+		client:   &http.Client{Timeout: timeout},
+		identity: identity,
+		url:      stringFormatter.Format(monitoringURLTemplate, identity.ProjectID),
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/wissance/stringFormatter"
+)
+
+type (
+	// SecretManagerClient accesses secret versions stored in Secret Manager using the default service account.
+	SecretManagerClient struct {
+		tokens *tokenSource
+		client *http.Client
+	}
+
+	secretVersion struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+)
+
+const (
+	// SecretScheme prefixes flag values which must be resolved from Secret Manager,
+	// i/e: `sm://projects/<project>/secrets/<secret>`.
+	SecretScheme = "sm://"
+
+	secretManagerURLTemplate = "https://secretmanager.googleapis.com/v1/{0}:access"
+	secretLatestVersion      = "/versions/latest"
+)
+
+var (
+	secretNameRegexp     = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+(/versions/[^/]+)?$`)
+	errInvalidSecretName = errors.New("secrets must be formatted as: projects/<project>/secrets/<secret>[/versions/<version>]")
+)
+
+// IsSecretName reports whether `name` is the resource name of a secret or a secret version,
+// i/e: `projects/<project>/secrets/<secret>/versions/<version>`; it may be prefixed by `sm://`.
+func IsSecretName(name string) bool {
+	return secretNameRegexp.MatchString(strings.TrimPrefix(name, SecretScheme))
+}
+
+// IsSecretRef reports whether `value` references a secret instead of being the value itself.
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretScheme)
+}
+
+// Access returns the payload of the secret version `name`; the latest version is used if it is not specified.
+func (c *SecretManagerClient) Access(ctx context.Context, name string) ([]byte, error) {
+	name = strings.TrimPrefix(name, SecretScheme)
+	match := secretNameRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return nil, errInvalidSecretName
+	}
+	if match[1] == "" {
+		name += secretLatestVersion
+	}
+
+	token, err := c.tokens.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, stringFormatter.Format(secretManagerURLTemplate, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("secret manager status: %d | %s", res.StatusCode, bytes.TrimSpace(message))
+	}
+
+	version := &secretVersion{}
+	if err := json.NewDecoder(res.Body).Decode(version); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(version.Payload.Data)
+}
+
+// Resolve returns the payload of the secret referenced by `value`, without surrounding whitespace;
+// `value` is returned as is if it does not reference a secret.
+func (c *SecretManagerClient) Resolve(ctx context.Context, value string) (string, error) {
+	if !IsSecretRef(value) {
+		return value, nil
+	}
+	payload, err := c.Access(ctx, value)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(payload)), nil
+}
+
+// Watch resolves `ref` every `interval` until `ctx` is done; `onChange` is called when its payload is not `current`
+// anymore, or when it cannot be resolved. Versions are usually not pinned, so that rotated secrets are picked up.
+func (c *SecretManagerClient) Watch(
+	ctx context.Context,
+	ref, current string,
+	interval time.Duration,
+	onChange func(value string, err error),
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			resolveCtx, resolveCancel := context.WithTimeout(ctx, c.client.Timeout)
+			value, err := c.Resolve(resolveCtx, ref)
+			resolveCancel()
+			if err != nil {
+				onChange("", err)
+			} else if value != current {
+				current = value
+				onChange(value, nil)
+			}
+		}
+	}
+}
+
+func NewSecretManagerClient(mds *MetadataClient, timeout time.Duration) *SecretManagerClient {
+	return &SecretManagerClient{
+		tokens: newTokenSource(mds),
+		client: &http.Client{Timeout: timeout},
+	}
+}
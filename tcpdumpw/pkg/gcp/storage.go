@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wissance/stringFormatter"
+)
+
+type (
+	// StorageClient downloads objects from Cloud Storage using the default service account.
+	StorageClient struct {
+		tokens *tokenSource
+		client *http.Client
+	}
+)
+
+const (
+	storageURLTemplate = "https://storage.googleapis.com/storage/v1/b/{0}/o/{1}?alt=media"
+	storageScheme      = "gs://"
+)
+
+var errInvalidStorageURL = errors.New("Cloud Storage URLs must be formatted as: gs://<bucket>/<object>")
+
+// IsStorageURL reports whether `location` is a Cloud Storage URL, i/e: `gs://<bucket>/<object>`.
+func IsStorageURL(location string) bool {
+	return strings.HasPrefix(location, storageScheme)
+}
+
+// Download returns the content of the object referenced by `location`, formatted as `gs://<bucket>/<object>`.
+func (c *StorageClient) Download(ctx context.Context, location string) ([]byte, error) {
+	bucket, object, _ := strings.Cut(strings.TrimPrefix(location, storageScheme), "/")
+	if !IsStorageURL(location) || bucket == "" || object == "" {
+		return nil, errInvalidStorageURL
+	}
+
+	token, err := c.tokens.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	objectURL := stringFormatter.Format(storageURLTemplate, url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("storage status: %d | %s", res.StatusCode, bytes.TrimSpace(message))
+	}
+	return io.ReadAll(res.Body)
+}
+
+func NewStorageClient(mds *MetadataClient, timeout time.Duration) *StorageClient {
+	return &StorageClient{
+		tokens: newTokenSource(mds),
+		client: &http.Client{Timeout: timeout},
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+type (
+	TerminationNotice struct {
+		Path  string
+		Value string
+	}
+
+	terminationPath struct {
+		path     string
+		isNotice func(string) bool
+	}
+)
+
+const terminationRetryDelay = 5 * time.Second
+
+var terminationPaths = []*terminationPath{
+	{
+		path: "instance/preempted",
+		isNotice: func(value string) bool {
+			return strings.EqualFold(value, "TRUE")
+		},
+	},
+	{
+		path: "instance/maintenance-event",
+		isNotice: func(value string) bool {
+			return strings.HasPrefix(value, "TERMINATE")
+		},
+	},
+}
+
+func (c *MetadataClient) watchTermination(
+	ctx context.Context,
+	p *terminationPath,
+	notices chan<- *TerminationNotice,
+) {
+	etag := ""
+	for {
+		value, nextEtag, err := c.WaitForChange(ctx, p.path, etag)
+
+		if errors.Is(err, ErrMetadataNotFound) || errors.Is(err, errMetadataUnavailable) {
+			// the runtime does not expose this path: there is nothing to watch
+			return
+		} else if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(terminationRetryDelay):
+				continue
+			}
+		}
+
+		if p.isNotice(value) {
+			select {
+			case notices <- &TerminationNotice{Path: p.path, Value: value}:
+			default:
+			}
+			return
+		}
+		etag = nextEtag
+	}
+}
+
+// WatchTermination subscribes to the instance shutdown notification paths;
+// the returned channel delivers at most one notice, the first one to be observed.
+func (c *MetadataClient) WatchTermination(ctx context.Context) <-chan *TerminationNotice {
+	notices := make(chan *TerminationNotice, 1)
+	for _, p := range terminationPaths {
+		go c.watchTermination(ctx, p, notices)
+	}
+	return notices
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type (
+	// tokenSource caches the access token of the default service account until it is about to expire.
+	tokenSource struct {
+		mu     sync.Mutex
+		mds    *MetadataClient
+		token  string
+		expiry time.Time
+	}
+
+	accessToken struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+)
+
+const (
+	mdsDefaultToken    = "instance/service-accounts/default/token"
+	tokenRefreshMargin = 1 * time.Minute
+)
+
+func (s *tokenSource) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expiry) > tokenRefreshMargin {
+		return s.token, nil
+	}
+
+	value, err := s.mds.Get(ctx, mdsDefaultToken)
+	if err != nil {
+		return "", err
+	}
+
+	token := &accessToken{}
+	if err := json.Unmarshal([]byte(value), token); err != nil {
+		return "", err
+	}
+
+	s.token = token.AccessToken
+	s.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+func newTokenSource(mds *MetadataClient) *tokenSource {
+	return &tokenSource{mds: mds}
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package geoip
+
+import (
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type (
+	// Location describes where an external IP address is, and the network it belongs to.
+	Location struct {
+		Country      string `json:"country,omitempty"`
+		ASN          uint   `json:"asn,omitempty"`
+		Organization string `json:"org,omitempty"`
+	}
+
+	// Database looks up IP addresses in MMDB databases; country ( or city ) and ASN
+	// databases are usually distributed separately, so results of all of them are merged.
+	Database struct {
+		readers []*maxminddb.Reader
+	}
+
+	// Endpoints is the annotation added into JSON translated packets as the `GEO` object.
+	Endpoints struct {
+		Src *Location `json:"src,omitempty"`
+		Dst *Location `json:"dst,omitempty"`
+	}
+
+	// only the fields which are included in JSON records are decoded;
+	// see: https://dev.maxmind.com/geoip/docs/databases
+	mmdbRecord struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+		ASN          uint   `maxminddb:"autonomous_system_number"`
+		Organization string `maxminddb:"autonomous_system_organization"`
+	}
+)
+
+// IsExternal reports whether `addr` is routed through the internet;
+// private, loopback and link-local addresses are not found in MMDB databases.
+func IsExternal(addr netip.Addr) bool {
+	return addr.IsValid() && addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// Lookup returns `nil` if `ip` is not an external address, or if it is not found in any database.
+func (d *Database) Lookup(ip string) *Location {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !IsExternal(addr.Unmap()) {
+		return nil
+	}
+
+	location := &Location{}
+	for _, reader := range d.readers {
+		record := &mmdbRecord{}
+		if err := reader.Lookup(addr.AsSlice(), record); err != nil {
+			continue
+		}
+		if location.Country == "" {
+			location.Country = record.Country.ISOCode
+		}
+		if location.Country == "" {
+			location.Country = record.RegisteredCountry.ISOCode
+		}
+		if location.ASN == 0 {
+			location.ASN = record.ASN
+			location.Organization = record.Organization
+		}
+	}
+
+	if *location == (Location{}) {
+		return nil
+	}
+	return location
+}
+
+func (d *Database) Property() string {
+	return "GEO"
+}
+
+// Annotate returns the locations of `src` and `dst`, or `nil` if none of them is external.
+func (d *Database) Annotate(src, dst string) any {
+	endpoints := &Endpoints{Src: d.Lookup(src), Dst: d.Lookup(dst)}
+	if endpoints.Src == nil && endpoints.Dst == nil {
+		return nil
+	}
+	return endpoints
+}
+
+// NewDatabase opens the MMDB databases contained in `buffers`, which remain in use while the database is.
+func NewDatabase(buffers ...[]byte) (*Database, error) {
+	database := &Database{}
+	for _, buffer := range buffers {
+		reader, err := maxminddb.FromBytes(buffer)
+		if err != nil {
+			return nil, err
+		}
+		database.readers = append(database.readers, reader)
+	}
+	return database, nil
+}
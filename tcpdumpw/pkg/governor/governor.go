@@ -0,0 +1,122 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package governor
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+)
+
+type (
+	// Governor limits how many PCAP engines run at the same time across all executions;
+	// engines which exceed the limit are queued, and they are started by priority once a running one stops.
+	Governor struct {
+		limit int
+
+		mu     sync.Mutex
+		active int
+		seq    uint64
+		queue  []*waiter
+	}
+
+	// Usage describes the engines running and queued.
+	Usage struct {
+		Limit  int `json:"limit"`
+		Active int `json:"active"`
+		Queued int `json:"queued"`
+	}
+
+	waiter struct {
+		priority int
+		seq      uint64
+		granted  chan struct{}
+	}
+)
+
+func New(limit int) *Governor {
+	return &Governor{limit: limit}
+}
+
+// Acquire blocks until an engine is allowed to run; lower `priority` values are started first,
+// and engines with the same priority are started in the order they were queued.
+// `onQueued` is called with the position in the queue if the engine must wait.
+// It returns the error of `ctx` if it is done first; otherwise, `Release` must be called once the engine stops.
+func (g *Governor) Acquire(ctx context.Context, priority int, onQueued func(position int)) error {
+	g.mu.Lock()
+	if g.active < g.limit && len(g.queue) == 0 {
+		g.active += 1
+		g.mu.Unlock()
+		return nil
+	}
+
+	g.seq += 1
+	w := &waiter{priority: priority, seq: g.seq, granted: make(chan struct{})}
+	position, _ := slices.BinarySearchFunc(g.queue, w, compareWaiters)
+	g.queue = slices.Insert(g.queue, position, w)
+	g.mu.Unlock()
+
+	if onQueued != nil {
+		onQueued(position + 1)
+	}
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if index := slices.Index(g.queue, w); index >= 0 {
+		g.queue = slices.Delete(g.queue, index, index+1)
+		return ctx.Err()
+	}
+	// the slot was granted while `ctx` was being done: hand it over to the next engine
+	g.release()
+	return ctx.Err()
+}
+
+// Release allows the next queued engine to run.
+func (g *Governor) Release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.release()
+}
+
+func (g *Governor) release() {
+	if len(g.queue) > 0 {
+		// the slot is handed over: the amount of active engines does not change
+		w := g.queue[0]
+		g.queue = g.queue[1:]
+		close(w.granted)
+		return
+	}
+	g.active = max(g.active-1, 0)
+}
+
+func (g *Governor) Usage() Usage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return Usage{Limit: g.limit, Active: g.active, Queued: len(g.queue)}
+}
+
+func compareWaiters(a, b *waiter) int {
+	if a.priority != b.priority {
+		return cmp.Compare(a.priority, b.priority)
+	}
+	return cmp.Compare(a.seq, b.seq)
+}
@@ -0,0 +1,299 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package headers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	libpcap "github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/storage"
+)
+
+type (
+	// Engine is a PCAP engine which writes PCAP files as `tcpdump` does, except that packets may be truncated
+	// right after their transport header: addressing, flags and options are preserved, and application payload
+	// never reaches the disk regardless of the snapshot length. Packets may also be rewritten before being written.
+	Engine struct {
+		iface     string
+		filter    string
+		snaplen   int
+		directory string
+		template  string
+		location  *time.Location
+		interval  time.Duration
+		truncate  bool
+		rewriter  PacketRewriter
+		isActive  atomic.Bool
+		// writes are batched and files synced periodically on network filesystems
+		bufSize      int
+		syncInterval time.Duration
+
+		file   *os.File
+		bw     *bufio.Writer
+		writer *pcapgo.Writer
+		path   string
+	}
+
+	// PacketRewriter modifies captured packets in place, i/e: to anonymize them; packets may be truncated.
+	PacketRewriter interface {
+		Rewrite(data []byte, linkType layers.LinkType)
+	}
+)
+
+const (
+	handleTimeout = 100 * time.Millisecond
+	fileMode      = 0o666
+	// `tcpdump` captures whole packets when the snapshot length is 0
+	maxSnaplen = 262144
+)
+
+var errAlreadyStarted = errors.New("already started")
+
+func (e *Engine) IsActive() bool {
+	return e.isActive.Load()
+}
+
+func (e *Engine) newHandle() (*libpcap.Handle, error) {
+	inactiveHandle, err := libpcap.NewInactiveHandle(e.iface)
+	if err != nil {
+		return nil, err
+	}
+	defer inactiveHandle.CleanUp()
+
+	if err = inactiveHandle.SetSnapLen(e.snaplen); err != nil {
+		return nil, err
+	}
+	if err = inactiveHandle.SetPromisc(true); err != nil {
+		return nil, err
+	}
+	if err = inactiveHandle.SetTimeout(handleTimeout); err != nil {
+		return nil, err
+	}
+
+	handle, err := inactiveHandle.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to activate: %w", err)
+	}
+	if err = handle.SetBPFFilter(e.filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("BPF filter error: [%s] => %w", e.filter, err)
+	}
+	return handle, nil
+}
+
+// headersLength returns the amount of bytes of `packet` which precede its application payload, which is the size
+// of all its headers up to the transport one; packets without a transport header ( i/e: IP fragments ) keep all
+// the headers which could be decoded, i/e: the 8 bytes of ICMP headers. Trailers such as Ethernet padding are dropped.
+func headersLength(packet gopacket.Packet) int {
+	length := 0
+	for _, layer := range packet.Layers() {
+		switch layer.(type) {
+		case gopacket.ApplicationLayer, gopacket.ErrorLayer:
+			return length
+		}
+		length += len(layer.LayerContents())
+		if _, ok := layer.(gopacket.TransportLayer); ok {
+			break
+		}
+	}
+	return min(length, len(packet.Data()))
+}
+
+func (e *Engine) open(linkType layers.LinkType) error {
+	now := time.Now()
+	sequence := storage.NextSequence(filepath.Join(e.directory, e.template))
+	path := filepath.Join(e.directory, storage.FormatFileName(now.In(e.location), e.template, sequence))
+	// as `tcpdump`, files are named after the time they were opened; never overwrite the previous one
+	if path == e.path {
+		time.Sleep(time.Until(now.Truncate(time.Second).Add(time.Second)))
+		path = filepath.Join(e.directory, storage.FormatFileName(time.Now().In(e.location), e.template, sequence))
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(file, e.bufSize)
+	writer := pcapgo.NewWriter(bw)
+	if err := writer.WriteFileHeader(uint32(e.snaplen), linkType); err != nil {
+		file.Close()
+		return err
+	}
+
+	e.file, e.bw, e.writer, e.path = file, bw, writer, path
+	return nil
+}
+
+func (e *Engine) closeFile() error {
+	if e.file == nil {
+		return nil
+	}
+	err := errors.Join(e.bw.Flush(), e.file.Close())
+	e.file, e.bw, e.writer = nil, nil, nil
+	return err
+}
+
+// sync writes the buffered packets into the current file and flushes it into its filesystem.
+func (e *Engine) sync() error {
+	if e.file == nil {
+		return nil
+	}
+	if err := e.bw.Flush(); err != nil {
+		return err
+	}
+	return e.file.Sync()
+}
+
+// BatchWrites buffers up to `bufSize` bytes before writing into files, which are synced every `syncInterval`;
+// it must be called before the engine is started.
+func (e *Engine) BatchWrites(bufSize int, syncInterval time.Duration) {
+	e.bufSize = bufSize
+	e.syncInterval = syncInterval
+}
+
+func (e *Engine) write(packet gopacket.Packet, linkType layers.LinkType) error {
+	info := packet.Metadata().CaptureInfo
+	data := packet.Data()
+	if e.truncate {
+		data = data[:headersLength(packet)]
+		// `Length` is kept: readers still know how large the packet was on the wire
+		info.CaptureLength = len(data)
+	}
+	if e.rewriter != nil {
+		// packets are not copied by the packet source: its buffers must not be modified
+		data = slices.Clone(data)
+		e.rewriter.Rewrite(data, linkType)
+	}
+	return e.writer.WritePacket(info, data)
+}
+
+// Start captures packets until `ctx` is done; `writers` are not used, as packets are written into PCAP files
+// which are rotated every interval, as `tcpdump -G` does.
+func (e *Engine) Start(
+	ctx context.Context,
+	writers []pcap.PcapWriter,
+	stopDeadline <-chan *time.Duration,
+) error {
+	if !e.isActive.CompareAndSwap(false, true) {
+		return errAlreadyStarted
+	}
+	defer e.isActive.Store(false)
+
+	handle, err := e.newHandle()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	linkType := handle.LinkType()
+	if err := e.open(linkType); err != nil {
+		return err
+	}
+	defer e.closeFile()
+
+	// files are never rotated if there is no interval: receiving from a `nil` channel blocks forever
+	var rotate <-chan time.Time = nil
+	if e.interval > 0 {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		rotate = ticker.C
+	}
+	var sync <-chan time.Time = nil
+	if e.syncInterval > 0 {
+		ticker := time.NewTicker(e.syncInterval)
+		defer ticker.Stop()
+		sync = ticker.C
+	}
+
+	source := gopacket.NewPacketSource(handle, linkType)
+	source.NoCopy = true
+
+	packets := source.Packets()
+	for {
+		select {
+		case <-ctx.Done():
+			// packets are written synchronously, so there is nothing to drain
+			<-stopDeadline
+			return ctx.Err()
+
+		case <-rotate:
+			if err := e.closeFile(); err != nil {
+				return err
+			}
+			if err := e.open(linkType); err != nil {
+				return err
+			}
+
+		case <-sync:
+			if err := e.sync(); err != nil {
+				return err
+			}
+
+		case packet, ok := <-packets:
+			if !ok {
+				return nil
+			}
+			if err := e.write(packet, linkType); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NewEngine creates an engine which captures packets from the iface of `config`, and writes them into files named after
+// `<Output>.<Extension>` ( `strftime` format ), truncated after their transport header if `truncate` is enabled and
+// rewritten by `rewriter` if it is not `nil`; `filter` is the BPF filter used by all other engines, and it may be empty.
+func NewEngine(config *pcap.PcapConfig, filter, timezone string, truncate bool, rewriter PacketRewriter) (*Engine, error) {
+	fileNameTemplate := fmt.Sprintf("%s.%s", config.Output, config.Extension)
+	directory := filepath.Dir(fileNameTemplate)
+	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	snaplen := config.Snaplen
+	if snaplen <= 0 {
+		snaplen = maxSnaplen
+	}
+
+	return &Engine{
+		iface:     config.Iface,
+		filter:    filter,
+		snaplen:   snaplen,
+		directory: directory,
+		template:  filepath.Base(fileNameTemplate),
+		location:  location,
+		interval:  time.Duration(config.Interval) * time.Second,
+		truncate:  truncate,
+		rewriter:  rewriter,
+	}, nil
+}
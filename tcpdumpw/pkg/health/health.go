@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// State is the stage of its lifecycle a PCAP task is at.
+	State string
+
+	// Status describes the current state of a task, when it was entered, and the last error it reported.
+	Status struct {
+		State       State      `json:"state"`
+		Since       time.Time  `json:"since"`
+		LastError   string     `json:"last_error,omitempty"`
+		LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+		Transitions uint64     `json:"transitions"`
+	}
+
+	// Transition is a change of state; `Err` is the reason of the transition into `Degraded` or `Failed`.
+	Transition struct {
+		From State
+		To   State
+		Err  error
+	}
+
+	// Tracker holds the state of a single task; it is safe for concurrent use.
+	Tracker struct {
+		mu     sync.Mutex
+		status Status
+	}
+)
+
+const (
+	// Configured tasks were created, and they are waiting for an execution to start.
+	Configured State = "configured"
+	// Queued tasks are waiting for other engines to stop before starting their own.
+	Queued State = "queued"
+	// Starting tasks are opening their capture.
+	Starting State = "starting"
+	// Capturing tasks are writing packets.
+	Capturing State = "capturing"
+	// Rotating tasks are closing their files and opening new ones.
+	Rotating State = "rotating"
+	// Exporting tasks stopped capturing and their files are being exported.
+	Exporting State = "exporting"
+	// Degraded tasks stopped capturing unexpectedly, and they are waiting to be restarted.
+	Degraded State = "degraded"
+	// Failed tasks could not be stopped or did not stop cleanly when their execution ended.
+	Failed State = "failed"
+)
+
+func NewTracker() *Tracker {
+	return &Tracker{status: Status{State: Configured, Since: time.Now()}}
+}
+
+// Set moves the task into `state`; `err` is recorded as the last error if it is not `nil`.
+// It returns the transition and whether the state changed.
+func (t *Tracker) Set(state State, err error) (*Transition, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.set(state, err)
+}
+
+// SetIf moves the task into `state` only if it currently is in `from`.
+func (t *Tracker) SetIf(from, state State) (*Transition, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status.State != from {
+		return &Transition{From: t.status.State, To: t.status.State}, false
+	}
+	return t.set(state, nil)
+}
+
+func (t *Tracker) set(state State, err error) (*Transition, bool) {
+	now := time.Now()
+	if err != nil {
+		t.status.LastError = err.Error()
+		t.status.LastErrorAt = &now
+	}
+
+	transition := &Transition{From: t.status.State, To: state, Err: err}
+	if t.status.State == state {
+		return transition, false
+	}
+	t.status.State = state
+	t.status.Since = now
+	t.status.Transitions += 1
+	return transition, true
+}
+
+func (t *Tracker) State() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status.State
+}
+
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package history keeps the summaries of the last executions in a ring buffer, optionally mirrored into a file so
+// that they survive restarts, and serves them over HTTP.
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+type (
+	// Query selects which summaries are listed; empty fields match all summaries.
+	Query struct {
+		Job    string
+		Status string
+		// Limit is the max amount of summaries to be listed; 0 lists all of them.
+		Limit int
+	}
+
+	// Ring holds the last summaries added to it, in the order they were added; it is safe for concurrent use.
+	Ring struct {
+		path    string
+		mu      sync.RWMutex
+		entries []*entry
+		// next is the position where the next entry is stored once the ring is full
+		next int
+	}
+
+	entry struct {
+		// the fields used to filter summaries; every summary must be a JSON object
+		Job       string `json:"job"`
+		Execution string `json:"execution"`
+		Status    string `json:"status"`
+		summary   json.RawMessage
+	}
+)
+
+// Path is where `Ring` is served by `Handle`.
+const Path = "/executions"
+
+// ErrSize is returned when a ring cannot hold any summary.
+var ErrSize = errors.New("history size must be greater than 0")
+
+func newEntry(summary json.RawMessage) (*entry, error) {
+	e := &entry{summary: summary}
+	if err := json.Unmarshal(summary, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// New creates a ring holding the last `size` summaries. If `path` is not empty, summaries are saved into it
+// whenever one is added, and the ones saved by a previous process are loaded; if the file cannot be parsed,
+// the ring is empty and the error is returned, so that a corrupted file never prevents captures.
+func New(size int, path string) (*Ring, error) {
+	if size <= 0 {
+		return nil, ErrSize
+	}
+	ring := &Ring{path: path, entries: make([]*entry, 0, size)}
+	if path == "" {
+		return ring, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ring, nil
+	} else if err != nil {
+		return ring, err
+	}
+
+	var summaries []json.RawMessage
+	if err := json.Unmarshal(data, &summaries); err != nil {
+		return ring, fmt.Errorf("invalid history file: %s | %w", path, err)
+	}
+	for _, summary := range summaries {
+		e, err := newEntry(summary)
+		if err != nil {
+			return &Ring{path: path, entries: make([]*entry, 0, size)}, fmt.Errorf("invalid history file: %s | %w", path, err)
+		}
+		ring.push(e)
+	}
+	return ring, nil
+}
+
+// Size returns the max amount of summaries held by `r`.
+func (r *Ring) Size() int {
+	return cap(r.entries)
+}
+
+// Len returns the amount of summaries held by `r`.
+func (r *Ring) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.entries)
+}
+
+func (r *Ring) push(e *entry) {
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+		return
+	}
+	// the oldest entry is the one at `next`
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// ordered returns all entries, oldest first.
+func (r *Ring) ordered() []*entry {
+	ordered := make([]*entry, 0, len(r.entries))
+	ordered = append(ordered, r.entries[r.next:]...)
+	return append(ordered, r.entries[:r.next]...)
+}
+
+// Add stores `summary`, which must be marshaled as a JSON object, evicting the oldest one if `r` is full;
+// the returned error is only about saving the summaries into the file, as `summary` is always kept in memory.
+func (r *Ring) Add(summary any) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	e, err := newEntry(data)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.push(e)
+	var summaries []json.RawMessage
+	if r.path != "" {
+		for _, e := range r.ordered() {
+			summaries = append(summaries, e.summary)
+		}
+	}
+	r.mu.Unlock()
+
+	if r.path == "" {
+		return nil
+	}
+	return save(r.path, summaries)
+}
+
+// save replaces `path` atomically, so that it is never read partially.
+func save(path string, summaries []json.RawMessage) error {
+	data, err := json.Marshal(summaries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o666); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// List returns the summaries matching `query`, newest first.
+func (r *Ring) List(query *Query) []json.RawMessage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	summaries := []json.RawMessage{}
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		e := r.entries[(r.next+i)%len(r.entries)]
+		if (query.Job != "" && e.Job != query.Job) || (query.Status != "" && e.Status != query.Status) {
+			continue
+		}
+		summaries = append(summaries, e.summary)
+		if query.Limit > 0 && len(summaries) == query.Limit {
+			break
+		}
+	}
+	return summaries
+}
+
+// ServeHTTP responds with a JSON array of the summaries matching the `job`, `status` and `limit` query parameters.
+func (r *Ring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	query := &Query{Job: params.Get("job"), Status: params.Get("status")}
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit: %s", limit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := json.Marshal(r.List(query))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Handle registers `r` into `mux` as `GET /executions`.
+func (r *Ring) Handle(mux *http.ServeMux) {
+	mux.Handle("GET "+Path, r)
+}
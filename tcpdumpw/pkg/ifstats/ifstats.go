@@ -0,0 +1,298 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ifstats samples the traffic of network interfaces using dedicated capture handles which only read packet
+// headers: packets, bytes and their breakdown by protocol are aggregated and published every interval, regardless
+// of whether PCAP files are being written, so that coarse network telemetry is always available.
+package ifstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	libpcap "github.com/google/gopacket/pcap"
+)
+
+type (
+	// Counts are the packets and bytes, as seen on the wire, of a kind of traffic.
+	Counts struct {
+		Packets uint64 `json:"packets"`
+		Bytes   uint64 `json:"bytes"`
+	}
+
+	// Sample is the traffic observed on an iface between `Start` and `End`.
+	Sample struct {
+		Iface string    `json:"iface"`
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		Counts
+		// PPS is packets per second, and BPS is bits per second.
+		PPS float64 `json:"pps"`
+		BPS float64 `json:"bps"`
+		// Drops are the packets which were not sampled, as reported by the capture handle.
+		Drops     uint64             `json:"drops"`
+		Protocols map[string]*Counts `json:"protocols"`
+	}
+
+	// Aggregator accumulates the packets observed on an iface until a sample is taken; it is not safe for concurrent use.
+	Aggregator struct {
+		iface     string
+		start     time.Time
+		total     Counts
+		protocols map[string]*Counts
+
+		parsers map[gopacket.LayerType]*gopacket.DecodingLayerParser
+		decoded []gopacket.LayerType
+		eth     layers.Ethernet
+		sll     layers.LinuxSLL
+		loop    layers.Loopback
+		ip4     layers.IPv4
+		ip6     layers.IPv6
+		arp     layers.ARP
+	}
+
+	// Source is where packets are sampled from; it is satisfied by live capture handles.
+	Source interface {
+		ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+		LinkType() layers.LinkType
+		Stats() (*libpcap.Stats, error)
+	}
+
+	// Sampler publishes a sample of the traffic of an iface every interval.
+	Sampler struct {
+		iface    string
+		filter   string
+		interval time.Duration
+		publish  func(*Sample)
+	}
+)
+
+const (
+	ProtocolTCP   = "tcp"
+	ProtocolUDP   = "udp"
+	ProtocolICMP  = "icmp"
+	ProtocolARP   = "arp"
+	ProtocolOther = "other"
+
+	// enough to hold the link and network headers of every packet, which is all that is needed to classify it
+	snaplen       = 128
+	handleTimeout = 100 * time.Millisecond
+)
+
+func newCounts() map[string]*Counts {
+	return map[string]*Counts{
+		ProtocolTCP:   {},
+		ProtocolUDP:   {},
+		ProtocolICMP:  {},
+		ProtocolARP:   {},
+		ProtocolOther: {},
+	}
+}
+
+// NewAggregator creates an aggregator for `iface` whose first sample starts at `start`.
+func NewAggregator(iface string, start time.Time) *Aggregator {
+	return &Aggregator{
+		iface:     iface,
+		start:     start,
+		protocols: newCounts(),
+		parsers:   map[gopacket.LayerType]*gopacket.DecodingLayerParser{},
+		decoded:   make([]gopacket.LayerType, 0, 4),
+	}
+}
+
+func protocolName(protocol layers.IPProtocol) string {
+	switch protocol {
+	case layers.IPProtocolTCP:
+		return ProtocolTCP
+	case layers.IPProtocolUDP:
+		return ProtocolUDP
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		return ProtocolICMP
+	}
+	return ProtocolOther
+}
+
+// firstLayer returns the type of the outermost layer of `data`; raw captures carry no link layer.
+func firstLayer(data []byte, linkType layers.LinkType) gopacket.LayerType {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback
+	}
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return layers.LayerTypeIPv6
+	}
+	return layers.LayerTypeIPv4
+}
+
+// classify returns the protocol of `data` as seen by the network layer; only the headers preceding it are decoded.
+func (a *Aggregator) classify(data []byte, linkType layers.LinkType) string {
+	first := firstLayer(data, linkType)
+	parser, ok := a.parsers[first]
+	if !ok {
+		parser = gopacket.NewDecodingLayerParser(first, &a.eth, &a.sll, &a.loop, &a.ip4, &a.ip6, &a.arp)
+		// transport layers are not decoded: they are classified by the network layer
+		parser.IgnoreUnsupported = true
+		a.parsers[first] = parser
+	}
+
+	// truncated packets are classified by the layers which could be decoded
+	parser.DecodeLayers(data, &a.decoded)
+	for _, layerType := range a.decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			return protocolName(a.ip4.Protocol)
+		case layers.LayerTypeIPv6:
+			return protocolName(a.ip6.NextHeader)
+		case layers.LayerTypeARP:
+			return ProtocolARP
+		}
+	}
+	return ProtocolOther
+}
+
+// Observe accounts for a packet; `info.Length` is used, as packets are truncated when captured.
+func (a *Aggregator) Observe(data []byte, info gopacket.CaptureInfo, linkType layers.LinkType) {
+	length := uint64(info.Length)
+	a.total.Packets += 1
+	a.total.Bytes += length
+	counts := a.protocols[a.classify(data, linkType)]
+	counts.Packets += 1
+	counts.Bytes += length
+}
+
+// Take returns the sample of the traffic observed since the previous one, and starts the next one at `end`.
+func (a *Aggregator) Take(end time.Time, drops uint64) *Sample {
+	sample := &Sample{
+		Iface:     a.iface,
+		Start:     a.start,
+		End:       end,
+		Counts:    a.total,
+		Drops:     drops,
+		Protocols: a.protocols,
+	}
+	if seconds := end.Sub(a.start).Seconds(); seconds > 0 {
+		sample.PPS = float64(sample.Packets) / seconds
+		sample.BPS = float64(sample.Bytes*8) / seconds
+	}
+
+	a.start = end
+	a.total = Counts{}
+	a.protocols = newCounts()
+	return sample
+}
+
+// Iface returns the iface whose traffic is sampled.
+func (s *Sampler) Iface() string {
+	return s.iface
+}
+
+func (s *Sampler) newHandle() (*libpcap.Handle, error) {
+	inactiveHandle, err := libpcap.NewInactiveHandle(s.iface)
+	if err != nil {
+		return nil, err
+	}
+	defer inactiveHandle.CleanUp()
+
+	if err = inactiveHandle.SetSnapLen(snaplen); err != nil {
+		return nil, err
+	}
+	if err = inactiveHandle.SetPromisc(true); err != nil {
+		return nil, err
+	}
+	if err = inactiveHandle.SetTimeout(handleTimeout); err != nil {
+		return nil, err
+	}
+
+	handle, err := inactiveHandle.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to activate: %w", err)
+	}
+	if s.filter == "" {
+		return handle, nil
+	}
+	if err = handle.SetBPFFilter(s.filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("BPF filter error: [%s] => %w", s.filter, err)
+	}
+	return handle, nil
+}
+
+// Run samples the traffic of the iface until `ctx` is done; the last partial sample is published as well.
+func (s *Sampler) Run(ctx context.Context) error {
+	handle, err := s.newHandle()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return s.Sample(ctx, handle)
+}
+
+// Sample publishes a sample of the packets read from `source` every interval until `ctx` is done.
+func (s *Sampler) Sample(ctx context.Context, source Source) error {
+	linkType := source.LinkType()
+	aggregator := NewAggregator(s.iface, time.Now())
+	next := time.Now().Add(s.interval)
+	// handles report drops since they were activated
+	dropped := uint64(0)
+
+	publish := func(now time.Time) {
+		drops := uint64(0)
+		if stats, err := source.Stats(); err == nil {
+			total := uint64(stats.PacketsDropped + stats.PacketsIfDropped)
+			if total >= dropped {
+				drops = total - dropped
+			}
+			dropped = total
+		}
+		s.publish(aggregator.Take(now, drops))
+	}
+
+	for {
+		if ctx.Err() != nil {
+			publish(time.Now())
+			return nil
+		}
+
+		data, info, err := source.ZeroCopyReadPacketData()
+		if err == nil {
+			aggregator.Observe(data, info, linkType)
+		} else if !errors.Is(err, libpcap.NextErrorTimeoutExpired) {
+			publish(time.Now())
+			return err
+		}
+
+		if now := time.Now(); !now.Before(next) {
+			publish(now)
+			next = now.Add(s.interval)
+		}
+	}
+}
+
+// NewSampler creates a sampler for `iface` which publishes a sample every `interval`; `filter` is optional.
+func NewSampler(iface, filter string, interval time.Duration, publish func(*Sample)) *Sampler {
+	return &Sampler{
+		iface:    iface,
+		filter:   filter,
+		interval: interval,
+		publish:  publish,
+	}
+}
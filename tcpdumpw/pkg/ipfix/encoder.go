@@ -0,0 +1,318 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfix
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/analysis"
+)
+
+type (
+	// Labels identify the Cloud Run instance which exports flows; IPFIX messages
+	// include them as enterprise specific fields, NetFlow v9 messages do not.
+	Labels struct {
+		Service  string
+		Revision string
+		Instance string
+	}
+
+	// field is an information element ( IPFIX ) or a field type ( NetFlow v9 ).
+	field struct {
+		id         uint16
+		length     uint16
+		enterprise bool
+	}
+
+	encoder interface {
+		// encode returns a message containing `records`, including templates if `withTemplates` is `true`
+		encode(records []*analysis.FlowRecord, withTemplates bool, now time.Time) []byte
+	}
+
+	ipfixEncoder struct {
+		domainID uint32
+		labels   *Labels
+		// IPFIX sequence numbers count data records, not messages
+		sequence uint32
+	}
+
+	netflow9Encoder struct {
+		sourceID uint32
+		start    time.Time
+		// NetFlow v9 sequence numbers count messages
+		sequence uint32
+	}
+)
+
+const (
+	ipfixVersion    = 10
+	netflow9Version = 9
+
+	ipfixTemplateSetID    = 2
+	netflow9TemplateSetID = 0
+
+	// templates for flows between IPv4 and IPv6 addresses
+	templateIPv4 = 256
+	templateIPv6 = 257
+
+	// see: https://www.iana.org/assignments/enterprise-numbers/
+	googlePEN = 11129
+
+	variableLength = 0xffff
+)
+
+// see: https://www.iana.org/assignments/ipfix/ipfix.xhtml
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieTCPControlBits           = 6
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieLastSwitched             = 21
+	ieFirstSwitched            = 22
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowEndReason            = 136
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+)
+
+// enterprise specific information elements, scoped by `googlePEN`
+const (
+	ieCloudRunService  = 1
+	ieCloudRunRevision = 2
+	ieCloudRunInstance = 3
+)
+
+// see: https://www.iana.org/assignments/ipfix/ipfix.xhtml#ipfix-flow-end-reason
+const (
+	flowEndIdleTimeout   = 0x01
+	flowEndActiveTimeout = 0x02
+	flowEndOfFlow        = 0x03
+	flowEndForced        = 0x04
+)
+
+var flowEndReasons = map[string]uint8{
+	"idle":     flowEndIdleTimeout,
+	"active":   flowEndActiveTimeout,
+	"fin":      flowEndOfFlow,
+	"rst":      flowEndOfFlow,
+	"shutdown": flowEndForced,
+}
+
+func addressFields(template uint16) []field {
+	if template == templateIPv6 {
+		return []field{{id: ieSourceIPv6Address, length: 16}, {id: ieDestinationIPv6Address, length: 16}}
+	}
+	return []field{{id: ieSourceIPv4Address, length: 4}, {id: ieDestinationIPv4Address, length: 4}}
+}
+
+func ipfixFields(template uint16) []field {
+	return append(addressFields(template),
+		field{id: ieSourceTransportPort, length: 2},
+		field{id: ieDestinationTransportPort, length: 2},
+		field{id: ieProtocolIdentifier, length: 1},
+		field{id: ieTCPControlBits, length: 2},
+		field{id: iePacketDeltaCount, length: 8},
+		field{id: ieOctetDeltaCount, length: 8},
+		field{id: ieFlowStartMilliseconds, length: 8},
+		field{id: ieFlowEndMilliseconds, length: 8},
+		field{id: ieFlowEndReason, length: 1},
+		field{id: ieCloudRunService, length: variableLength, enterprise: true},
+		field{id: ieCloudRunRevision, length: variableLength, enterprise: true},
+		field{id: ieCloudRunInstance, length: variableLength, enterprise: true},
+	)
+}
+
+// NetFlow v9 does not support enterprise specific, nor variable length fields
+func netflow9Fields(template uint16) []field {
+	return append(addressFields(template),
+		field{id: ieSourceTransportPort, length: 2},
+		field{id: ieDestinationTransportPort, length: 2},
+		field{id: ieProtocolIdentifier, length: 1},
+		field{id: ieTCPControlBits, length: 1},
+		field{id: iePacketDeltaCount, length: 8},
+		field{id: ieOctetDeltaCount, length: 8},
+		field{id: ieFirstSwitched, length: 4},
+		field{id: ieLastSwitched, length: 4},
+	)
+}
+
+func appendTemplate(b []byte, id uint16, fields []field) []byte {
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+	for _, f := range fields {
+		if f.enterprise {
+			b = binary.BigEndian.AppendUint16(b, f.id|0x8000)
+			b = binary.BigEndian.AppendUint16(b, f.length)
+			b = binary.BigEndian.AppendUint32(b, googlePEN)
+			continue
+		}
+		b = binary.BigEndian.AppendUint16(b, f.id)
+		b = binary.BigEndian.AppendUint16(b, f.length)
+	}
+	return b
+}
+
+// see: https://datatracker.ietf.org/doc/html/rfc7011#section-7
+func appendVariableLength(b []byte, value string) []byte {
+	if len(value) < 255 {
+		b = append(b, uint8(len(value)))
+	} else {
+		value = value[:min(len(value), 0xffff)]
+		b = append(b, 255)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	}
+	return append(b, value...)
+}
+
+// set wraps the content of a set with its header; content is padded to 4 bytes if `pad` is `true`.
+func appendSet(b []byte, id uint16, content []byte, pad bool) []byte {
+	if pad {
+		for len(content)%4 != 0 {
+			content = append(content, 0)
+		}
+	}
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(content)))
+	return append(b, content...)
+}
+
+// templateFor returns the template matching the addresses of `record`,
+// or `0` if they are not valid IP addresses.
+func templateFor(record *analysis.FlowRecord) (uint16, netip.Addr, netip.Addr) {
+	src, srcErr := netip.ParseAddr(record.Src)
+	dst, dstErr := netip.ParseAddr(record.Dst)
+	if srcErr != nil || dstErr != nil {
+		return 0, src, dst
+	}
+	if src.Unmap().Is4() && dst.Unmap().Is4() {
+		return templateIPv4, src.Unmap(), dst.Unmap()
+	}
+	return templateIPv6, netip.AddrFrom16(src.As16()), netip.AddrFrom16(dst.As16())
+}
+
+// groupRecords encodes the records sharing each template using `encodeRecord`.
+func groupRecords(
+	records []*analysis.FlowRecord,
+	encodeRecord func(b []byte, record *analysis.FlowRecord, src, dst netip.Addr) []byte,
+) (map[uint16][]byte, uint32) {
+	sets := make(map[uint16][]byte, 2)
+	count := uint32(0)
+	for _, record := range records {
+		template, src, dst := templateFor(record)
+		if template == 0 {
+			continue
+		}
+		sets[template] = encodeRecord(sets[template], record, src, dst)
+		count += 1
+	}
+	return sets, count
+}
+
+func appendAddresses(b []byte, src, dst netip.Addr) []byte {
+	b = append(b, src.AsSlice()...)
+	return append(b, dst.AsSlice()...)
+}
+
+func (e *ipfixEncoder) encodeRecord(b []byte, record *analysis.FlowRecord, src, dst netip.Addr) []byte {
+	b = appendAddresses(b, src, dst)
+	b = binary.BigEndian.AppendUint16(b, record.SrcPort)
+	b = binary.BigEndian.AppendUint16(b, record.DstPort)
+	b = append(b, record.ProtoNum)
+	b = binary.BigEndian.AppendUint16(b, uint16(record.TCPControlBits()))
+	b = binary.BigEndian.AppendUint64(b, record.Packets)
+	b = binary.BigEndian.AppendUint64(b, record.Bytes)
+	b = binary.BigEndian.AppendUint64(b, uint64(record.Start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(record.End.UnixMilli()))
+	b = append(b, flowEndReasons[record.Reason])
+	b = appendVariableLength(b, e.labels.Service)
+	b = appendVariableLength(b, e.labels.Revision)
+	return appendVariableLength(b, e.labels.Instance)
+}
+
+// see: https://datatracker.ietf.org/doc/html/rfc7011#section-3.1
+func (e *ipfixEncoder) encode(records []*analysis.FlowRecord, withTemplates bool, now time.Time) []byte {
+	sets, count := groupRecords(records, e.encodeRecord)
+
+	message := make([]byte, 16, 1024)
+	if withTemplates {
+		templates := appendTemplate(nil, templateIPv4, ipfixFields(templateIPv4))
+		templates = appendTemplate(templates, templateIPv6, ipfixFields(templateIPv6))
+		message = appendSet(message, ipfixTemplateSetID, templates, false)
+	}
+	for _, template := range []uint16{templateIPv4, templateIPv6} {
+		if content, ok := sets[template]; ok {
+			message = appendSet(message, template, content, false)
+		}
+	}
+
+	binary.BigEndian.PutUint16(message[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(message[2:], uint16(len(message)))
+	binary.BigEndian.PutUint32(message[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(message[8:], e.sequence)
+	binary.BigEndian.PutUint32(message[12:], e.domainID)
+	e.sequence += count
+	return message
+}
+
+// NetFlow v9 timestamps are milliseconds since the exporter started ( `sysUptime` )
+func (e *netflow9Encoder) uptime(ts time.Time) uint32 {
+	return uint32(max(0, ts.Sub(e.start).Milliseconds()))
+}
+
+func (e *netflow9Encoder) encodeRecord(b []byte, record *analysis.FlowRecord, src, dst netip.Addr) []byte {
+	b = appendAddresses(b, src, dst)
+	b = binary.BigEndian.AppendUint16(b, record.SrcPort)
+	b = binary.BigEndian.AppendUint16(b, record.DstPort)
+	b = append(b, record.ProtoNum)
+	b = append(b, record.TCPControlBits())
+	b = binary.BigEndian.AppendUint64(b, record.Packets)
+	b = binary.BigEndian.AppendUint64(b, record.Bytes)
+	b = binary.BigEndian.AppendUint32(b, e.uptime(record.Start))
+	return binary.BigEndian.AppendUint32(b, e.uptime(record.End))
+}
+
+// see: https://www.ietf.org/rfc/rfc3954.html#section-5.1
+func (e *netflow9Encoder) encode(records []*analysis.FlowRecord, withTemplates bool, now time.Time) []byte {
+	sets, count := groupRecords(records, e.encodeRecord)
+
+	message := make([]byte, 20, 1024)
+	if withTemplates {
+		templates := appendTemplate(nil, templateIPv4, netflow9Fields(templateIPv4))
+		templates = appendTemplate(templates, templateIPv6, netflow9Fields(templateIPv6))
+		message = appendSet(message, netflow9TemplateSetID, templates, true)
+		count += 2
+	}
+	for _, template := range []uint16{templateIPv4, templateIPv6} {
+		if content, ok := sets[template]; ok {
+			message = appendSet(message, template, content, true)
+		}
+	}
+
+	binary.BigEndian.PutUint16(message[0:], netflow9Version)
+	binary.BigEndian.PutUint16(message[2:], uint16(count))
+	binary.BigEndian.PutUint32(message[4:], e.uptime(now))
+	binary.BigEndian.PutUint32(message[8:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(message[12:], e.sequence)
+	binary.BigEndian.PutUint32(message[16:], e.sourceID)
+	e.sequence += 1
+	return message
+}
@@ -0,0 +1,268 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfix
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/analysis"
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/mtls"
+)
+
+// Exporter sends flow records to an IPFIX or NetFlow v9 collector; records are queued
+// and written asynchronously, so that packet capturing is never blocked.
+type Exporter struct {
+	network string
+	address string
+	format  string
+	// IPFIX over TLS: https://datatracker.ietf.org/doc/html/rfc7011#section-10.4
+	tlsConfig *tls.Config
+	encoder   encoder
+	queue     chan *analysis.FlowRecord
+	conn      net.Conn
+	dropped   atomic.Uint64
+	exported  atomic.Uint64
+	// templates must be sent when a TCP connection is established, and periodically over UDP
+	lastTemplates time.Time
+	// guards `queue` from being written after it is closed
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+const (
+	queueSize        = 4096
+	dialTimeout      = 5 * time.Second
+	writeTimeout     = 5 * time.Second
+	reconnectDelay   = 1 * time.Second
+	templateInterval = 1 * time.Minute
+	// keeps UDP messages below the path MTU, even with long enterprise specific fields
+	maxDatagramRecords = 4
+	maxStreamRecords   = 64
+)
+
+var errUnsupportedScheme = errors.New("unsupported flow collector scheme")
+
+func (e *Exporter) isDatagram() bool {
+	return e.network == "udp"
+}
+
+func (e *Exporter) dial() error {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if e.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, e.network, e.address, e.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(e.network, e.address)
+	}
+	if err != nil {
+		return err
+	}
+	e.conn = conn
+	e.lastTemplates = time.Time{}
+	return nil
+}
+
+func (e *Exporter) write(records []*analysis.FlowRecord) error {
+	if e.conn == nil {
+		if err := e.dial(); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	withTemplates := e.lastTemplates.IsZero() || (e.isDatagram() && now.Sub(e.lastTemplates) > templateInterval)
+	message := e.encoder.encode(records, withTemplates, now)
+	e.conn.SetWriteDeadline(now.Add(writeTimeout))
+	if _, err := e.conn.Write(message); err != nil {
+		// stream connections must be re-established to avoid writing partial messages
+		e.conn.Close()
+		e.conn = nil
+		return err
+	}
+	if withTemplates {
+		e.lastTemplates = now
+	}
+	return nil
+}
+
+// batch collects the records which are already queued, so that they are sent in a single message.
+func (e *Exporter) batch(record *analysis.FlowRecord) ([]*analysis.FlowRecord, bool) {
+	size := maxStreamRecords
+	if e.isDatagram() {
+		size = maxDatagramRecords
+	}
+	records := []*analysis.FlowRecord{record}
+	for len(records) < size {
+		select {
+		case record, ok := <-e.queue:
+			if !ok {
+				return records, false
+			}
+			records = append(records, record)
+		default:
+			return records, true
+		}
+	}
+	return records, true
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	for record := range e.queue {
+		records, open := e.batch(record)
+		if err := e.write(records); err != nil {
+			e.dropped.Add(uint64(len(records)))
+			fmt.Fprintf(os.Stderr, "failed to export flows into %s: %v\n", e, err)
+			time.Sleep(reconnectDelay)
+		} else {
+			e.exported.Add(uint64(len(records)))
+		}
+		if !open {
+			break
+		}
+	}
+	if e.conn != nil {
+		e.conn.Close()
+	}
+}
+
+// Export queues `record` to be sent to the collector; records are dropped if the queue is full.
+func (e *Exporter) Export(record *analysis.FlowRecord) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		e.dropped.Add(1)
+		return
+	}
+	select {
+	case e.queue <- record:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Exported returns the amount of records sent to the collector.
+func (e *Exporter) Exported() uint64 {
+	return e.exported.Load()
+}
+
+// Dropped returns the amount of records that could not be sent to the collector.
+func (e *Exporter) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+// Close sends all queued records, or gives up when `ctx` is done.
+func (e *Exporter) Close(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *Exporter) String() string {
+	if e.tlsConfig != nil {
+		return fmt.Sprintf("%s+tls://%s", e.format, e.address)
+	}
+	return fmt.Sprintf("%s+%s://%s", e.format, e.network, e.address)
+}
+
+// observationDomain identifies the exporting instance; it is derived from the instance ID.
+func observationDomain(labels *Labels) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(labels.Instance))
+	return h.Sum32()
+}
+
+// NewExporter creates an exporter for `endpoint`, which is either `<host>:<port>` ( IPFIX over UDP ),
+// or formatted as `<format>+<transport>://<host>:<port>`; formats are `ipfix` ( RFC 7011 ) and `netflow9`
+// ( RFC 3954 ), transports are `udp`, `tcp` and `tls`: i/e: `ipfix+tls://collector:4740` or `netflow9+udp://collector:2055`.
+// If `credentials` is not `nil`, mutual TLS is required: only the `tls` transport is allowed.
+func NewExporter(endpoint string, labels *Labels, credentials *mtls.Credentials) (*Exporter, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "ipfix+udp://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("flow collector port is required: %s", endpoint)
+	}
+
+	format, transport, _ := strings.Cut(u.Scheme, "+")
+
+	exporter := &Exporter{
+		network: transport,
+		address: u.Host,
+		format:  format,
+		queue:   make(chan *analysis.FlowRecord, queueSize),
+		done:    make(chan struct{}),
+	}
+
+	switch transport {
+	case "udp", "tcp":
+		if credentials != nil {
+			return nil, fmt.Errorf("%w: mutual TLS requires the 'tls' transport: %s", errUnsupportedScheme, u.Scheme)
+		}
+	case "tls":
+		exporter.network = "tcp"
+		exporter.tlsConfig = &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}
+		if credentials != nil {
+			exporter.tlsConfig = credentials.Apply(exporter.tlsConfig)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedScheme, u.Scheme)
+	}
+
+	switch format {
+	case "ipfix":
+		exporter.encoder = &ipfixEncoder{domainID: observationDomain(labels), labels: labels}
+	case "netflow9":
+		// NetFlow v9 is only defined over UDP
+		if transport != "udp" {
+			return nil, fmt.Errorf("%w: %s", errUnsupportedScheme, u.Scheme)
+		}
+		exporter.encoder = &netflow9Encoder{sourceID: observationDomain(labels), start: time.Now()}
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedScheme, u.Scheme)
+	}
+
+	go exporter.run()
+	return exporter, nil
+}
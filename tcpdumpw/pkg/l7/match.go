@@ -0,0 +1,215 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l7
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// MatchWriter only writes JSON translated packets whose payload matches a pattern; if its scope is `flow`,
+	// all packets of flows with at least 1 matching packet are written, including a few which preceded the match.
+	MatchWriter struct {
+		pcap.PcapWriter
+		mu        sync.Mutex
+		pattern   *regexp.Regexp
+		scope     string
+		flows     map[string]*matchedFlow
+		lastSweep time.Time
+	}
+
+	matchedFlow struct {
+		matched      bool
+		backlog      [][]byte
+		lastActivity time.Time
+	}
+
+	// only the fields required to match payloads are decoded
+	jsonPayloadRecord struct {
+		L3 *struct {
+			Src string `json:"src"`
+			Dst string `json:"dst"`
+		} `json:"L3"`
+		L4 *struct {
+			Src uint16 `json:"src"`
+			Dst uint16 `json:"dst"`
+		} `json:"L4"`
+		L7 *struct {
+			Content string `json:"content"`
+			Sample  string `json:"sample"`
+		} `json:"L7"`
+		HTTP *struct {
+			Raw string `json:"raw"`
+		} `json:"HTTP"`
+	}
+)
+
+const (
+	MatchScopePacket = "packet"
+	MatchScopeFlow   = "flow"
+)
+
+const (
+	// packets of a flow which are kept until its 1st match, so that i/e: the handshake is not lost
+	matchBacklogSize = 32
+	// flows beyond this amount are not followed until others expire
+	maxMatchFlows   = 10000
+	matchFlowTTL    = 2 * time.Minute
+	matchSweepEvery = 30 * time.Second
+)
+
+// payload returns the application payload as retained by the translator.
+func (r *jsonPayloadRecord) payload() string {
+	if r.HTTP != nil && r.HTTP.Raw != "" {
+		return r.HTTP.Raw
+	}
+	if r.L7 == nil {
+		return ""
+	}
+	if r.L7.Content != "" {
+		return r.L7.Content
+	}
+	return r.L7.Sample
+}
+
+// flow identifies both directions of a flow; packets without ports are identified by their addresses.
+func (r *jsonPayloadRecord) flow() string {
+	if r.L3 == nil {
+		return ""
+	}
+	src, dst := r.L3.Src, r.L3.Dst
+	if r.L4 != nil {
+		src, dst = fmt.Sprintf("%s:%d", src, r.L4.Src), fmt.Sprintf("%s:%d", dst, r.L4.Dst)
+	}
+	if src > dst {
+		src, dst = dst, src
+	}
+	return src + "|" + dst
+}
+
+// sweep forgets flows which are idle; must be called while holding `w.mu`.
+func (w *MatchWriter) sweep(now time.Time) {
+	if now.Sub(w.lastSweep) < matchSweepEvery {
+		return
+	}
+	w.lastSweep = now
+	for key, flow := range w.flows {
+		if now.Sub(flow.lastActivity) > matchFlowTTL {
+			delete(w.flows, key)
+		}
+	}
+}
+
+// matchFlow returns the records to be written for `p`, which are buffered until the flow matches.
+func (w *MatchWriter) matchFlow(record *jsonPayloadRecord, p []byte, matched bool) [][]byte {
+	key := record.flow()
+	if key == "" {
+		if matched {
+			return [][]byte{p}
+		}
+		return nil
+	}
+
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.sweep(now)
+
+	flow, ok := w.flows[key]
+	if !ok {
+		if len(w.flows) >= maxMatchFlows && !matched {
+			return nil
+		}
+		flow = &matchedFlow{}
+		w.flows[key] = flow
+	}
+	flow.lastActivity = now
+
+	if flow.matched {
+		return [][]byte{p}
+	}
+	if !matched {
+		// writers must not retain `p`
+		if len(flow.backlog) >= matchBacklogSize {
+			flow.backlog = flow.backlog[1:]
+		}
+		flow.backlog = append(flow.backlog, bytes.Clone(p))
+		return nil
+	}
+	flow.matched = true
+	records := append(flow.backlog, p)
+	flow.backlog = nil
+	return records
+}
+
+func (w *MatchWriter) Write(p []byte) (int, error) {
+	record := &jsonPayloadRecord{}
+	if err := json.Unmarshal(bytes.TrimSpace(p), record); err != nil {
+		return len(p), nil
+	}
+	matched := false
+	if payload := record.payload(); payload != "" {
+		matched = w.pattern.MatchString(payload)
+	}
+
+	if w.scope == MatchScopePacket {
+		if !matched {
+			return len(p), nil
+		}
+		if _, err := w.PcapWriter.Write(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	for _, matchedRecord := range w.matchFlow(record, p, matched) {
+		if _, err := w.PcapWriter.Write(matchedRecord); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// ParseMatchScope returns an error if `scope` is neither `packet` nor `flow`.
+func ParseMatchScope(scope string) (string, error) {
+	switch scope {
+	case MatchScopePacket, MatchScopeFlow:
+		return scope, nil
+	}
+	return "", fmt.Errorf("invalid payload match scope: %s", scope)
+}
+
+// NewMatchWriter creates a writer which only writes JSON translated packets whose payload matches `pattern`,
+// or all the packets of flows which include a match if `scope` is `flow`; `writer` is returned as is if `pattern` is `nil`.
+func NewMatchWriter(writer pcap.PcapWriter, pattern *regexp.Regexp, scope string) pcap.PcapWriter {
+	if pattern == nil {
+		return writer
+	}
+	return &MatchWriter{
+		PcapWriter: writer,
+		pattern:    pattern,
+		scope:      scope,
+		flows:      make(map[string]*matchedFlow),
+	}
+}
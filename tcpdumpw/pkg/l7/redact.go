@@ -0,0 +1,317 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l7
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// RedactionRules mask personal data and credentials in JSON translated packets: patterns are only applied
+	// to what the translator decoded from the application payload, while JSONPath expressions may select any field.
+	RedactionRules struct {
+		patterns []*redactionPattern
+		// JSONPath expressions split into segments; `*` matches any property or array element
+		paths [][]string
+		// lower case names of headers whose values are masked
+		headers []string
+	}
+
+	redactionPattern struct {
+		name   string
+		regexp *regexp.Regexp
+		// the 1st group is preserved, i/e: the name of a header or an authentication scheme
+		keepPrefix bool
+		// matches are only masked if they are valid; may be `nil`
+		validate func(match string) bool
+	}
+
+	// RedactWriter masks the fields of JSON translated packets selected by its rules, before writing them into the wrapped writer.
+	RedactWriter struct {
+		pcap.PcapWriter
+		rules *RedactionRules
+	}
+)
+
+const (
+	RedactEmail         = "email"
+	RedactCard          = "card"
+	RedactToken         = "token"
+	RedactAuthorization = "authorization"
+	RedactAll           = "all"
+	redactCustom        = "regex"
+)
+
+var (
+	emailPattern = &redactionPattern{
+		name:   RedactEmail,
+		regexp: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	}
+
+	cardPattern = &redactionPattern{
+		name:     RedactCard,
+		regexp:   regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		validate: isCardNumber,
+	}
+
+	tokenPatterns = []*redactionPattern{
+		{name: RedactToken, regexp: regexp.MustCompile(`(?i)\b((?:bearer|basic|token)\s+)[A-Za-z0-9._~+/=-]+`), keepPrefix: true},
+		// JWTs: https://datatracker.ietf.org/doc/html/rfc7519#section-3
+		{name: RedactToken, regexp: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)},
+		{name: RedactToken, regexp: regexp.MustCompile(`(?i)([?&](?:access_token|id_token|token|api_key|apikey|key|password|secret)=)[^&\s#]+`), keepPrefix: true},
+	}
+
+	authorizationPattern = &redactionPattern{
+		name:       RedactAuthorization,
+		regexp:     regexp.MustCompile(`(?i)\b((?:proxy-authorization|authorization|cookie|set-cookie|x-api-key)\s*:\s*)[^\r\n]*`),
+		keepPrefix: true,
+	}
+
+	// decoded HTTP headers are objects keyed by header name
+	authorizationHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "x-api-key"}
+	headerKeysRegexp     = regexp.MustCompile(`(?i)"(?:proxy-authorization|authorization|cookie|set-cookie|x-api-key)"`)
+)
+
+func mask(name string) string {
+	return "[REDACTED:" + name + "]"
+}
+
+// isCardNumber applies the Luhn algorithm to the digits of `match`; see: https://en.wikipedia.org/wiki/Luhn_algorithm
+func isCardNumber(match string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(match)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range digits {
+		digit := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+func (p *redactionPattern) redact(value string) string {
+	return p.regexp.ReplaceAllStringFunc(value, func(match string) string {
+		if p.validate != nil && !p.validate(match) {
+			return match
+		}
+		if p.keepPrefix {
+			return p.regexp.FindStringSubmatch(match)[1] + mask(p.name)
+		}
+		return mask(p.name)
+	})
+}
+
+// parseJSONPath supports `$.a.b`, `$.a[0]`, `$.a[*]` and `$.a.*`.
+func parseJSONPath(expression string) ([]string, error) {
+	path, found := strings.CutPrefix(expression, "$.")
+	if !found {
+		return nil, fmt.Errorf("JSONPath must start with '$.': %s", expression)
+	}
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	segments := strings.Split(path, ".")
+	if slices.Contains(segments, "") {
+		return nil, fmt.Errorf("invalid JSONPath: %s", expression)
+	}
+	return segments, nil
+}
+
+// ParseRedactionRules parses a comma separated list of built-in rules ( `email`, `card`, `token`, `authorization`
+// or `all` ) and JSONPath expressions; matches of `pattern` are masked as well if it is not empty.
+func ParseRedactionRules(rules, pattern string) (*RedactionRules, error) {
+	redactionRules := &RedactionRules{}
+	builtins := map[string]bool{}
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if strings.HasPrefix(rule, "$") {
+			path, err := parseJSONPath(rule)
+			if err != nil {
+				return nil, err
+			}
+			redactionRules.paths = append(redactionRules.paths, path)
+			continue
+		}
+		switch rule = strings.ToLower(rule); rule {
+		case RedactEmail, RedactCard, RedactToken, RedactAuthorization:
+			builtins[rule] = true
+		case RedactAll:
+			for _, name := range []string{RedactEmail, RedactCard, RedactToken, RedactAuthorization} {
+				builtins[name] = true
+			}
+		default:
+			return nil, fmt.Errorf("invalid redaction rule: %s", rule)
+		}
+	}
+
+	// headers are masked before their values are, so that the whole header is reported as an authorization
+	if builtins[RedactAuthorization] {
+		redactionRules.patterns = append(redactionRules.patterns, authorizationPattern)
+		redactionRules.headers = authorizationHeaders
+	}
+	if builtins[RedactToken] {
+		redactionRules.patterns = append(redactionRules.patterns, tokenPatterns...)
+	}
+	if builtins[RedactEmail] {
+		redactionRules.patterns = append(redactionRules.patterns, emailPattern)
+	}
+	if builtins[RedactCard] {
+		redactionRules.patterns = append(redactionRules.patterns, cardPattern)
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern: %w", err)
+		}
+		redactionRules.patterns = append(redactionRules.patterns, &redactionPattern{name: redactCustom, regexp: re})
+	}
+
+	if len(redactionRules.patterns) == 0 && len(redactionRules.paths) == 0 {
+		return nil, nil
+	}
+	return redactionRules, nil
+}
+
+func (r *RedactionRules) redactString(value string) string {
+	for _, pattern := range r.patterns {
+		value = pattern.redact(value)
+	}
+	return value
+}
+
+func (r *RedactionRules) matchesPath(path []string) bool {
+	for _, expression := range r.paths {
+		if len(expression) != len(path) {
+			continue
+		}
+		matched := true
+		for i, segment := range expression {
+			if segment != "*" && segment != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// mayApply tells if a record needs to be decoded, so that the ones which contain nothing to be masked are written as is.
+func (r *RedactionRules) mayApply(record []byte) bool {
+	if len(r.paths) > 0 {
+		return true
+	}
+	if len(r.headers) > 0 && headerKeysRegexp.Match(record) {
+		return true
+	}
+	for _, pattern := range r.patterns {
+		if pattern.regexp.Match(record) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrub masks `value` and all its children; patterns are only applied if `value` was decoded from the application payload.
+func (r *RedactionRules) scrub(value any, path []string, isPayload bool) any {
+	if r.matchesPath(path) {
+		return "[REDACTED]"
+	}
+	switch v := value.(type) {
+	case string:
+		if isPayload {
+			return r.redactString(v)
+		}
+	case map[string]any:
+		for key, child := range v {
+			if isPayload && slices.Contains(r.headers, strings.ToLower(key)) {
+				v[key] = mask(RedactAuthorization)
+				continue
+			}
+			v[key] = r.scrub(child, append(path, key), isPayload)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = r.scrub(child, append(path, strconv.Itoa(i)), isPayload)
+		}
+	}
+	return value
+}
+
+func (w *RedactWriter) redact(p []byte) []byte {
+	record := bytes.TrimRight(p, " \r\n")
+	if !w.rules.mayApply(record) {
+		return p
+	}
+
+	properties := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	// numbers must be written exactly as translated
+	decoder.UseNumber()
+	if err := decoder.Decode(&properties); err != nil {
+		return p
+	}
+
+	for name, value := range properties {
+		if message, ok := value.(string); ok && name == "message" && !w.rules.matchesPath([]string{name}) {
+			// only the part of the summary which describes the payload is masked; i/e: flow ids look like card numbers
+			if length, ok := summaryLength(message); ok {
+				properties[name] = message[:length] + w.rules.redactString(message[length:])
+			}
+			continue
+		}
+		properties[name] = w.rules.scrub(value, []string{name}, slices.Contains(applicationProperties, name))
+	}
+
+	redacted, err := json.Marshal(properties)
+	if err != nil {
+		return p
+	}
+	return append(redacted, p[len(record):]...)
+}
+
+func (w *RedactWriter) Write(p []byte) (int, error) {
+	if _, err := w.PcapWriter.Write(w.redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewRedactWriter creates a writer which masks the fields of JSON translated packets selected by `rules`;
+// `writer` is returned as is if `rules` is `nil`.
+func NewRedactWriter(writer pcap.PcapWriter, rules *RedactionRules) pcap.PcapWriter {
+	if rules == nil {
+		return writer
+	}
+	return &RedactWriter{PcapWriter: writer, rules: rules}
+}
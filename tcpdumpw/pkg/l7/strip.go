@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l7
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+// StripWriter removes everything the translator decoded from the application payload of JSON translated packets,
+// before writing them into the wrapped writer: only link, network and transport headers are kept.
+type StripWriter struct {
+	pcap.PcapWriter
+}
+
+// objects added by the translator for application protocols
+var applicationProperties = []string{"L7", "HTTP", "DNS", "TLS"}
+
+// the last field of the summary of TCP segments; i/e: HTTP request lines are appended after it
+const tcpSummaryTail = "| len/seq/ack:"
+
+// summaryLength returns the length of the part of `message` which only describes headers;
+// `false` if nothing was appended to it about the application payload.
+func summaryLength(message string) (int, bool) {
+	start := strings.Index(message, tcpSummaryTail)
+	if start < 0 {
+		return 0, false
+	}
+	start += len(tcpSummaryTail)
+	end := strings.Index(message[start:], " | ")
+	if end < 0 {
+		return 0, false
+	}
+	return start + end, true
+}
+
+// stripMessage removes from the summary of a packet whatever was appended about its application payload.
+func stripMessage(properties map[string]json.RawMessage) {
+	var message string
+	if raw, ok := properties["message"]; !ok || json.Unmarshal(raw, &message) != nil {
+		return
+	}
+	if length, ok := summaryLength(message); ok {
+		properties["message"], _ = json.Marshal(message[:length])
+	}
+}
+
+func (w *StripWriter) strip(p []byte) []byte {
+	record := bytes.TrimRight(p, " \r\n")
+
+	// the summary of TCP segments may describe their payload even if it was not decoded
+	found := bytes.Contains(record, []byte(tcpSummaryTail))
+	for _, name := range applicationProperties {
+		if found {
+			break
+		}
+		found = bytes.Contains(record, []byte(`"`+name+`"`))
+	}
+	if !found {
+		return p
+	}
+
+	properties := map[string]json.RawMessage{}
+	if err := json.Unmarshal(record, &properties); err != nil {
+		// records which cannot be stripped must not be written
+		return nil
+	}
+	for _, name := range applicationProperties {
+		delete(properties, name)
+	}
+	stripMessage(properties)
+	stripped, err := json.Marshal(properties)
+	if err != nil {
+		return nil
+	}
+	return append(stripped, p[len(record):]...)
+}
+
+func (w *StripWriter) Write(p []byte) (int, error) {
+	stripped := w.strip(p)
+	if stripped == nil {
+		return len(p), nil
+	}
+	if _, err := w.PcapWriter.Write(stripped); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewStripWriter creates a writer which removes application protocols from JSON translated packets.
+func NewStripWriter(writer pcap.PcapWriter) pcap.PcapWriter {
+	return &StripWriter{PcapWriter: writer}
+}
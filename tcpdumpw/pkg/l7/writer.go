@@ -0,0 +1,201 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l7
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// PayloadMode controls how the application payload is embedded into JSON translated packets.
+	PayloadMode struct {
+		Encoding string
+		// max amount of payload bytes to embed; `0` embeds all the bytes retained by the translator
+		MaxBytes int
+	}
+
+	// Writer rewrites the application payload of JSON translated packets
+	// according to its mode, before writing them into the wrapped writer.
+	Writer struct {
+		pcap.PcapWriter
+		mode *PayloadMode
+	}
+)
+
+const (
+	// PayloadText embeds the payload as translated, which is the default
+	PayloadText   = "text"
+	PayloadNone   = "none"
+	PayloadBase64 = "base64"
+	PayloadHex    = "hex"
+)
+
+// the translator marks payloads longer than what it retains with this suffix
+const truncationMarker = "..."
+
+var (
+	l7Property   = []byte(`"L7"`)
+	httpProperty = []byte(`"HTTP"`)
+)
+
+// ParsePayloadMode parses `none`, `text`, `base64[:maxbytes]` or `hex[:maxbytes]`.
+func ParsePayloadMode(value string) (*PayloadMode, error) {
+	encoding, maxBytes, found := strings.Cut(strings.ToLower(strings.TrimSpace(value)), ":")
+	mode := &PayloadMode{Encoding: encoding}
+	switch encoding {
+	case "", PayloadText:
+		mode.Encoding = PayloadText
+	case PayloadNone, PayloadBase64, PayloadHex:
+	default:
+		return nil, fmt.Errorf("invalid payload encoding: %s", value)
+	}
+	if !found {
+		return mode, nil
+	}
+	if mode.Encoding != PayloadBase64 && mode.Encoding != PayloadHex {
+		return nil, fmt.Errorf("max bytes are only allowed for 'base64' and 'hex': %s", value)
+	}
+	size, err := strconv.Atoi(maxBytes)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid payload max bytes: %s", value)
+	}
+	mode.MaxBytes = size
+	return mode, nil
+}
+
+func (m *PayloadMode) String() string {
+	if m.MaxBytes > 0 {
+		return fmt.Sprintf("%s:%d", m.Encoding, m.MaxBytes)
+	}
+	return m.Encoding
+}
+
+func decodeObject(raw json.RawMessage) map[string]json.RawMessage {
+	object := map[string]json.RawMessage{}
+	if raw != nil && json.Unmarshal(raw, &object) != nil {
+		return nil
+	}
+	return object
+}
+
+// take removes the string property `name` from `object`, and returns its value.
+func take(object map[string]json.RawMessage, name string) (string, bool) {
+	raw, ok := object[name]
+	if !ok {
+		return "", false
+	}
+	delete(object, name)
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", false
+	}
+	return value, true
+}
+
+// payloadSize returns the size of the payload as reported by the translator.
+func payloadSize(l7Object, httpObject map[string]json.RawMessage) int {
+	var size int
+	if raw, ok := httpObject["size"]; ok && json.Unmarshal(raw, &size) == nil {
+		return size
+	}
+	if raw, ok := l7Object["length"]; ok && json.Unmarshal(raw, &size) == nil {
+		return size
+	}
+	return 0
+}
+
+func (w *Writer) encode(payload []byte) string {
+	if w.mode.Encoding == PayloadHex {
+		return hex.EncodeToString(payload)
+	}
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+// rewrite replaces the payload carried by `L7` and `HTTP` objects: `L7.content`, `L7.sample`, `L7.body` and `HTTP.raw`.
+func (w *Writer) rewrite(p []byte) []byte {
+	record := bytes.TrimRight(p, " \r\n")
+	if !bytes.Contains(record, l7Property) && !bytes.Contains(record, httpProperty) {
+		return p
+	}
+
+	properties := map[string]json.RawMessage{}
+	if err := json.Unmarshal(record, &properties); err != nil {
+		return p
+	}
+	l7Object, httpObject := decodeObject(properties["L7"]), decodeObject(properties["HTTP"])
+	if l7Object == nil || httpObject == nil {
+		return p
+	}
+
+	// HTTP messages are also split into lines, which are not needed when the whole message is embedded
+	delete(l7Object, "body")
+	raw, found := take(httpObject, "raw")
+	for _, name := range []string{"content", "sample"} {
+		if value, ok := take(l7Object, name); ok && !found {
+			raw, found = value, true
+		}
+	}
+	if !found {
+		return p
+	}
+
+	if w.mode.Encoding != PayloadNone {
+		size := payloadSize(l7Object, httpObject)
+		payload := []byte(raw)
+		if len(payload) < size {
+			payload = bytes.TrimSuffix(payload, []byte(truncationMarker))
+		}
+		if w.mode.MaxBytes > 0 && len(payload) > w.mode.MaxBytes {
+			payload = payload[:w.mode.MaxBytes]
+		}
+		l7Object["payload"], _ = json.Marshal(w.encode(payload))
+		l7Object["encoding"], _ = json.Marshal(w.mode.Encoding)
+		l7Object["truncated"], _ = json.Marshal(len(payload) < size)
+	}
+
+	if _, ok := properties["HTTP"]; ok {
+		properties["HTTP"], _ = json.Marshal(httpObject)
+	}
+	properties["L7"], _ = json.Marshal(l7Object)
+	rewritten, err := json.Marshal(properties)
+	if err != nil {
+		return p
+	}
+	return append(rewritten, p[len(record):]...)
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if _, err := w.PcapWriter.Write(w.rewrite(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewWriter creates a writer which embeds the application payload of JSON translated packets according to `mode`;
+// `writer` is returned as is if the payload must be embedded as translated.
+func NewWriter(writer pcap.PcapWriter, mode *PayloadMode) pcap.PcapWriter {
+	if mode == nil || mode.Encoding == PayloadText {
+		return writer
+	}
+	return &Writer{PcapWriter: writer, mode: mode}
+}
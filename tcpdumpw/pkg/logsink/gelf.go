@@ -0,0 +1,145 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logsink
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type gelfEncoder struct {
+	hostname string
+	chunked  bool
+}
+
+const (
+	gelfVersion = "1.1"
+	// see: https://go2docs.graylog.org/current/getting_in_log_data/gelf.html#GELFviaUDP
+	gelfChunkSize      = 8192
+	gelfChunkHeader    = 12
+	gelfMaxChunks      = 128
+	gelfMissingMessage = "-"
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+var errGELFMessageTooLarge = errors.New("GELF message exceeds 128 chunks")
+
+// see: https://go2docs.graylog.org/current/getting_in_log_data/gelf.html#GELFPayloadSpecification
+var gelfLevels = map[string]int{
+	"EMERGENCY": 0,
+	"ALERT":     1,
+	"CRITICAL":  2,
+	"FATAL":     2,
+	"ERROR":     3,
+	"WARNING":   4,
+	"NOTICE":    5,
+	"INFO":      6,
+	"DEBUG":     7,
+}
+
+// GELF additional fields must be prefixed with `_`, and their values must be strings or numbers.
+func gelfAdditionalField(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, float64:
+		return v
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+func (e *gelfEncoder) chunk(message []byte) ([][]byte, error) {
+	if !e.chunked || len(message) <= gelfChunkSize {
+		return [][]byte{message}, nil
+	}
+
+	payloadSize := gelfChunkSize - gelfChunkHeader
+	count := (len(message) + payloadSize - 1) / payloadSize
+	if count > gelfMaxChunks {
+		return nil, errGELFMessageTooLarge
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := min((i+1)*payloadSize, len(message))
+		chunk := make([]byte, 0, gelfChunkHeader+end-i*payloadSize)
+		chunk = append(chunk, gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, message[i*payloadSize:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+func (e *gelfEncoder) encode(entry *Entry) ([][]byte, error) {
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal(entry.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	level, ok := gelfLevels[entry.Severity]
+	if !ok {
+		level = gelfLevels["INFO"]
+	}
+
+	message := map[string]interface{}{
+		"version":   gelfVersion,
+		"host":      e.hostname,
+		"level":     level,
+		"timestamp": float64(time.Now().UnixMicro()) / 1e6,
+		"_msg_id":   entry.MsgID,
+	}
+
+	message["short_message"] = gelfMissingMessage
+	if shortMessage, ok := payload["message"].(string); ok && shortMessage != "" {
+		message["short_message"] = shortMessage
+	}
+	delete(payload, "message")
+
+	for key, value := range payload {
+		// `_id` is reserved by GELF
+		if key == "id" {
+			key = "id_"
+		}
+		message["_"+key] = gelfAdditionalField(value)
+	}
+
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.chunked {
+		// stream transports delimit messages using a null byte
+		return [][]byte{append(encoded, 0)}, nil
+	}
+	return e.chunk(encoded)
+}
+
+func newGELFEncoder(hostname string, chunked bool) *gelfEncoder {
+	return &gelfEncoder{hostname: hostname, chunked: chunked}
+}
@@ -0,0 +1,245 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logsink
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/mtls"
+)
+
+type (
+	// Entry is a JSON log entry: either an operational log or a translated packet.
+	Entry struct {
+		Severity string
+		// identifies the kind of entry; i/e: `log` or `packet`
+		MsgID   string
+		Payload []byte
+	}
+
+	encoder interface {
+		// encode returns the frames to be written into the connection for `entry`
+		encode(entry *Entry) ([][]byte, error)
+	}
+
+	// Sink ships log entries into a syslog or GELF endpoint; entries are queued
+	// and written asynchronously, so that packet capturing is never blocked.
+	Sink struct {
+		network   string
+		address   string
+		tlsConfig *tls.Config
+		encoder   encoder
+		queue     chan [][]byte
+		conn      net.Conn
+		dropped   atomic.Uint64
+		// guards `queue` from being written after it is closed
+		mu     sync.RWMutex
+		closed bool
+		done   chan struct{}
+	}
+)
+
+const (
+	queueSize      = 4096
+	dialTimeout    = 5 * time.Second
+	writeTimeout   = 5 * time.Second
+	reconnectDelay = 1 * time.Second
+)
+
+var errUnsupportedScheme = errors.New("unsupported log sink scheme")
+
+// every datagram is a single message: no framing is required
+func (s *Sink) isDatagram() bool {
+	return s.network == "udp"
+}
+
+func (s *Sink) dial() error {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if s.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, s.network, s.address, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(s.network, s.address)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *Sink) write(frames [][]byte) error {
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	for _, frame := range frames {
+		if _, err := s.conn.Write(frame); err != nil {
+			// stream connections must be re-established to avoid writing partial frames
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	for frames := range s.queue {
+		if err := s.write(frames); err != nil {
+			s.dropped.Add(1)
+			fmt.Fprintf(os.Stderr, "failed to write into log sink %s://%s: %v\n", s.network, s.address, err)
+			time.Sleep(reconnectDelay)
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// Send queues `entry` to be written into the sink; entries are dropped if the queue is full.
+func (s *Sink) Send(entry *Entry) {
+	frames, err := s.encoder.encode(entry)
+	if err != nil {
+		s.dropped.Add(1)
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		s.dropped.Add(1)
+		return
+	}
+	select {
+	case s.queue <- frames:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Dropped returns the amount of entries that could not be written into the sink.
+func (s *Sink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close writes all queued entries, or gives up when `ctx` is done.
+func (s *Sink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Sink) String() string {
+	return fmt.Sprintf("%s://%s", s.network, s.address)
+}
+
+func newTLSConfig(endpoint *url.URL) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: endpoint.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	// private CAs are common for SIEM endpoints
+	if ca := endpoint.Query().Get("ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in: %s", ca)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// NewSink creates a sink for `endpoint`, which must be formatted as `<format>+<transport>://<host>:<port>`;
+// formats are `syslog` ( RFC 5424 ) and `gelf`, transports are `udp`, `tcp` and `tls`.
+// i/e: `syslog+tls://siem.example.com:6514?ca=/certs/ca.pem` or `gelf+udp://graylog:12201`.
+// If `credentials` is not `nil`, mutual TLS is required: only the `tls` transport is allowed.
+func NewSink(endpoint, hostname, appName string, credentials *mtls.Credentials) (*Sink, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("log sink port is required: %s", endpoint)
+	}
+
+	format, transport, _ := strings.Cut(u.Scheme, "+")
+
+	sink := &Sink{
+		network: "tcp",
+		address: u.Host,
+		queue:   make(chan [][]byte, queueSize),
+		done:    make(chan struct{}),
+	}
+
+	if credentials != nil && transport != "tls" {
+		return nil, fmt.Errorf("%w: mutual TLS requires the 'tls' transport: %s", errUnsupportedScheme, u.Scheme)
+	}
+
+	switch transport {
+	case "udp":
+		sink.network = "udp"
+	case "tcp":
+	case "tls":
+		if sink.tlsConfig, err = newTLSConfig(u); err != nil {
+			return nil, err
+		}
+		if credentials != nil {
+			sink.tlsConfig = credentials.Apply(sink.tlsConfig)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedScheme, u.Scheme)
+	}
+
+	switch format {
+	case "syslog":
+		sink.encoder = newSyslogEncoder(hostname, appName, !sink.isDatagram())
+	case "gelf":
+		sink.encoder = newGELFEncoder(hostname, sink.isDatagram())
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedScheme, u.Scheme)
+	}
+
+	go sink.run()
+	return sink, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logsink
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+type syslogEncoder struct {
+	hostname string
+	appName  string
+	procID   string
+	// stream transports use octet counting framing; see: https://datatracker.ietf.org/doc/html/rfc6587#section-3.4.1
+	octetCounting bool
+}
+
+const (
+	syslogFacilityLocal0 = 16
+	syslogNilValue       = "-"
+)
+
+// see: https://datatracker.ietf.org/doc/html/rfc5424#section-6.2.1
+var syslogSeverities = map[string]int{
+	"EMERGENCY": 0,
+	"ALERT":     1,
+	"CRITICAL":  2,
+	"FATAL":     2,
+	"ERROR":     3,
+	"WARNING":   4,
+	"NOTICE":    5,
+	"INFO":      6,
+	"DEBUG":     7,
+}
+
+func syslogValue(value string, maxLength int) string {
+	if value == "" {
+		return syslogNilValue
+	}
+	if len(value) > maxLength {
+		return value[:maxLength]
+	}
+	return value
+}
+
+// see: https://datatracker.ietf.org/doc/html/rfc5424#section-6
+func (e *syslogEncoder) encode(entry *Entry) ([][]byte, error) {
+	severity, ok := syslogSeverities[entry.Severity]
+	if !ok {
+		severity = syslogSeverities["INFO"]
+	}
+
+	message := fmt.Sprintf("<%d>1 %s %s %s %s %s %s %s",
+		syslogFacilityLocal0*8+severity,
+		time.Now().UTC().Format(time.RFC3339Nano),
+		e.hostname, e.appName, e.procID,
+		syslogValue(entry.MsgID, 32),
+		syslogNilValue, // STRUCTURED-DATA: the payload is already structured
+		entry.Payload)
+
+	if e.octetCounting {
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+	return [][]byte{[]byte(message)}, nil
+}
+
+func newSyslogEncoder(hostname, appName string, octetCounting bool) *syslogEncoder {
+	return &syslogEncoder{
+		hostname:      syslogValue(hostname, 255),
+		appName:       syslogValue(appName, 48),
+		procID:        strconv.Itoa(os.Getpid()),
+		octetCounting: octetCounting,
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logsink
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type writer struct {
+	sink  *Sink
+	iface *string
+}
+
+const packetMsgID = "packet"
+
+func (w *writer) Write(p []byte) (int, error) {
+	payload := bytes.TrimSpace(p)
+	if len(payload) == 0 {
+		return len(p), nil
+	}
+
+	severity := struct {
+		Severity string `json:"severity"`
+	}{}
+	json.Unmarshal(payload, &severity)
+
+	// writers may reuse `p` after `Write` returns
+	w.sink.Send(&Entry{
+		Severity: severity.Severity,
+		MsgID:    packetMsgID,
+		Payload:  append([]byte(nil), payload...),
+	})
+	return len(p), nil
+}
+
+// the sink is shared by all writers: it must be closed by its owner
+func (w *writer) Close() error {
+	return nil
+}
+
+func (w *writer) Rotate() {}
+
+func (w *writer) IsStdOutOrErr() bool {
+	return false
+}
+
+func (w *writer) GetIface() *string {
+	return w.iface
+}
+
+// NewPcapWriter creates a writer which ships every JSON translated packet into `sink`.
+func NewPcapWriter(sink *Sink, iface *string) pcap.PcapWriter {
+	return &writer{sink: sink, iface: iface}
+}
@@ -0,0 +1,205 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Loader returns the content of `location`, which may be a file or a secret; i/e: a PEM encoded certificate.
+	Loader func(ctx context.Context, location string) ([]byte, error)
+
+	// Credentials hold the client certificate used to authenticate against remote endpoints, and the CAs used to
+	// verify them; both are reloaded periodically, so that rotated certificates are used by all new connections.
+	Credentials struct {
+		certLocation string
+		keyLocation  string
+		caLocation   string
+		spiffeID     *url.URL
+		load         Loader
+		material     atomic.Pointer[material]
+	}
+
+	material struct {
+		cert, key, ca []byte
+		certificate   *tls.Certificate
+		roots         *x509.CertPool
+	}
+)
+
+const spiffeScheme = "spiffe"
+
+var errSPIFFEIDMismatch = errors.New("SPIFFE ID mismatch")
+
+func (c *Credentials) loadMaterial(ctx context.Context) (*material, error) {
+	m := &material{}
+	var err error
+	if m.cert, err = c.load(ctx, c.certLocation); err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %s | %w", c.certLocation, err)
+	}
+	if m.key, err = c.load(ctx, c.keyLocation); err != nil {
+		return nil, fmt.Errorf("failed to load private key: %s | %w", c.keyLocation, err)
+	}
+	if c.caLocation != "" {
+		if m.ca, err = c.load(ctx, c.caLocation); err != nil {
+			return nil, fmt.Errorf("failed to load CA: %s | %w", c.caLocation, err)
+		}
+	}
+
+	if current := c.material.Load(); current != nil &&
+		bytes.Equal(current.cert, m.cert) && bytes.Equal(current.key, m.key) && bytes.Equal(current.ca, m.ca) {
+		return current, nil
+	}
+
+	certificate, err := tls.X509KeyPair(m.cert, m.key)
+	if err != nil {
+		return nil, err
+	}
+	m.certificate = &certificate
+	if m.ca != nil {
+		m.roots = x509.NewCertPool()
+		if !m.roots.AppendCertsFromPEM(m.ca) {
+			return nil, fmt.Errorf("no certificates found in: %s", c.caLocation)
+		}
+	}
+	return m, nil
+}
+
+// Reload loads the certificate, the private key and the CAs again; the current ones are kept if any of them is not valid.
+// It returns `true` if any of them was rotated.
+func (c *Credentials) Reload(ctx context.Context) (bool, error) {
+	m, err := c.loadMaterial(ctx)
+	if err != nil {
+		return false, err
+	}
+	return c.material.Swap(m) != m, nil
+}
+
+// Run reloads credentials every `interval` until `ctx` is done; `onReload` is called after every attempt.
+func (c *Credentials) Run(ctx context.Context, interval time.Duration, onReload func(rotated bool, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			onReload(c.Reload(ctx))
+		}
+	}
+}
+
+func (c *Credentials) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.material.Load().certificate, nil
+}
+
+// verifySPIFFEID checks that the leaf certificate of the peer is an X.509-SVID for the expected SPIFFE ID;
+// IDs without a path only verify the trust domain. See: https://github.com/spiffe/spiffe/blob/main/standards/X509-SVID.md
+func (c *Credentials) verifySPIFFEID(leaf *x509.Certificate) error {
+	for _, uri := range leaf.URIs {
+		if uri.Scheme != spiffeScheme || !strings.EqualFold(uri.Host, c.spiffeID.Host) {
+			continue
+		}
+		if c.spiffeID.Path == "" || uri.Path == c.spiffeID.Path {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: expected %s", errSPIFFEIDMismatch, c.spiffeID)
+}
+
+// verifyConnection verifies the chain of the peer against the current CAs, and its SPIFFE ID if one is expected;
+// SVIDs are not required to carry DNS names, so they are only verified if no SPIFFE ID is expected.
+func (c *Credentials) verifyConnection(config *tls.Config, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no peer certificates")
+	}
+	leaf := state.PeerCertificates[0]
+
+	options := x509.VerifyOptions{
+		Roots:         config.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	if roots := c.material.Load().roots; roots != nil {
+		options.Roots = roots
+	}
+	for _, intermediate := range state.PeerCertificates[1:] {
+		options.Intermediates.AddCert(intermediate)
+	}
+	if c.spiffeID == nil {
+		options.DNSName = state.ServerName
+	}
+	if _, err := leaf.Verify(options); err != nil {
+		return err
+	}
+
+	if c.spiffeID != nil {
+		return c.verifySPIFFEID(leaf)
+	}
+	return nil
+}
+
+// Apply configures `config` to present the client certificate, and to verify peers using the CAs and the SPIFFE ID;
+// peers are verified against the `RootCAs` of `config`, or the system ones, if no CAs were given.
+func (c *Credentials) Apply(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.GetClientCertificate = c.getClientCertificate
+	// CAs are rotated, so chains must be verified against the current ones rather than against a fixed pool
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		return c.verifyConnection(config, state)
+	}
+	return config
+}
+
+func (c *Credentials) String() string {
+	if c.spiffeID != nil {
+		return fmt.Sprintf("mTLS[%s|%s|%s] => %s", c.certLocation, c.keyLocation, c.caLocation, c.spiffeID)
+	}
+	return fmt.Sprintf("mTLS[%s|%s|%s]", c.certLocation, c.keyLocation, c.caLocation)
+}
+
+// NewCredentials loads the client certificate and private key at `certLocation` and `keyLocation`, and the CAs
+// at `caLocation` which may be empty; peers must present an X.509-SVID for `spiffeID` if it is not empty.
+func NewCredentials(ctx context.Context, certLocation, keyLocation, caLocation, spiffeID string, load Loader) (*Credentials, error) {
+	credentials := &Credentials{
+		certLocation: certLocation,
+		keyLocation:  keyLocation,
+		caLocation:   caLocation,
+		load:         load,
+	}
+
+	if spiffeID != "" {
+		id, err := url.Parse(spiffeID)
+		if err != nil || id.Scheme != spiffeScheme || id.Host == "" {
+			return nil, fmt.Errorf("invalid SPIFFE ID: %s", spiffeID)
+		}
+		credentials.spiffeID = id
+	}
+
+	if _, err := credentials.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
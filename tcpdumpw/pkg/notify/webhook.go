@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type (
+	// Webhook posts notifications into an HTTP endpoint; `slack` formatted notifications
+	// only contain a text, while `json` formatted notifications contain the whole payload.
+	Webhook struct {
+		url    string
+		format string
+		client *http.Client
+	}
+
+	slackMessage struct {
+		Text string `json:"text"`
+	}
+)
+
+const (
+	FormatJSON  = "json"
+	FormatSlack = "slack"
+)
+
+func (w *Webhook) body(text string, payload interface{}) ([]byte, error) {
+	if w.format == FormatSlack {
+		return json.Marshal(&slackMessage{Text: text})
+	}
+	return json.Marshal(payload)
+}
+
+// Send posts `text` or `payload` into the webhook, depending on its format.
+func (w *Webhook) Send(ctx context.Context, text string, payload interface{}) error {
+	body, err := w.body(text, payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("webhook status: %d | %s", res.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+func (w *Webhook) String() string {
+	// webhook URLs usually contain secrets: only the host is safe to be logged
+	if i := strings.Index(w.url, "://"); i >= 0 {
+		host, _, _ := strings.Cut(w.url[i+3:], "/")
+		return w.url[:i+3] + host
+	}
+	return w.format
+}
+
+// NewWebhook creates a webhook for `url`; `format` must be either `json` or `slack`.
+func NewWebhook(url, format string, timeout time.Duration) (*Webhook, error) {
+	format = strings.ToLower(format)
+	if format != FormatJSON && format != FormatSlack {
+		return nil, fmt.Errorf("unsupported webhook format: %s", format)
+	}
+	return &Webhook{
+		url:    url,
+		format: format,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
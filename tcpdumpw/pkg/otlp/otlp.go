@@ -0,0 +1,362 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/stats"
+)
+
+type (
+	// Exporter sends spans and metrics to an OTLP/HTTP endpoint using the JSON encoding;
+	// see: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+	Exporter struct {
+		mu       sync.Mutex
+		endpoint string
+		scope    string
+		client   *http.Client
+		resource map[string]string
+		spans    []*Span
+	}
+
+	Span struct {
+		mu         sync.Mutex
+		exporter   *Exporter
+		traceID    string
+		spanID     string
+		parentID   string
+		name       string
+		start      time.Time
+		end        time.Time
+		attributes map[string]string
+		events     []*spanEvent
+		err        error
+		ended      bool
+	}
+
+	spanEvent struct {
+		name       string
+		timestamp  time.Time
+		attributes map[string]string
+	}
+
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+
+	anyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+
+	spanCtxKey struct{}
+)
+
+const (
+	tracesPath  = "/v1/traces"
+	metricsPath = "/v1/metrics"
+
+	spanKindInternal = 1
+	statusCodeOk     = 1
+	statusCodeError  = 2
+
+	// spans are buffered between flushes; older ones are dropped if the endpoint is not reachable
+	maxBufferedSpans = 2048
+)
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func unixNano(ts time.Time) string {
+	return strconv.FormatInt(ts.UnixNano(), 10)
+}
+
+func toAttributes(attributes map[string]string) []keyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]keyValue, 0, len(keys))
+	for _, key := range keys {
+		kvs = append(kvs, keyValue{Key: key, Value: anyValue{StringValue: attributes[key]}})
+	}
+	return kvs
+}
+
+// ContextWithSpan returns a copy of `ctx` in which `span` is the parent of spans started using it.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanCtxKey{}, span)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	if span, ok := ctx.Value(spanCtxKey{}).(*Span); ok {
+		return span
+	}
+	return nil
+}
+
+// StartSpan starts a span which is a child of the span in `ctx`, if any; it is safe to call on a `nil` exporter.
+func (e *Exporter) StartSpan(ctx context.Context, name string, attributes map[string]string) (context.Context, *Span) {
+	if e == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		exporter:   e,
+		traceID:    randomID(16),
+		spanID:     randomID(8),
+		name:       name,
+		start:      time.Now(),
+		attributes: attributes,
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	}
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// AddEvent records a point in time within the span; it is safe to call on a `nil` span.
+func (s *Span) AddEvent(name string, attributes map[string]string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, &spanEvent{name: name, timestamp: time.Now(), attributes: attributes})
+}
+
+// TraceID returns the hex encoded trace ID of the span, or an empty string for a `nil` span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.traceID
+}
+
+// SpanID returns the hex encoded ID of the span, or an empty string for a `nil` span.
+func (s *Span) SpanID() string {
+	if s == nil {
+		return ""
+	}
+	return s.spanID
+}
+
+// End completes the span and queues it to be exported; it is safe to call on a `nil` span.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.err = err
+	s.mu.Unlock()
+
+	s.exporter.enqueue(s)
+}
+
+func (s *Span) toJSON() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]map[string]interface{}, 0, len(s.events))
+	for _, event := range s.events {
+		events = append(events, map[string]interface{}{
+			"name":         event.name,
+			"timeUnixNano": unixNano(event.timestamp),
+			"attributes":   toAttributes(event.attributes),
+		})
+	}
+
+	status := map[string]interface{}{"code": statusCodeOk}
+	if s.err != nil {
+		status = map[string]interface{}{"code": statusCodeError, "message": s.err.Error()}
+	}
+
+	span := map[string]interface{}{
+		"traceId":           s.traceID,
+		"spanId":            s.spanID,
+		"name":              s.name,
+		"kind":              spanKindInternal,
+		"startTimeUnixNano": unixNano(s.start),
+		"endTimeUnixNano":   unixNano(s.end),
+		"attributes":        toAttributes(s.attributes),
+		"events":            events,
+		"status":            status,
+	}
+	if s.parentID != "" {
+		span["parentSpanId"] = s.parentID
+	}
+	return span
+}
+
+func (e *Exporter) enqueue(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.spans) >= maxBufferedSpans {
+		e.spans = e.spans[1:]
+	}
+	e.spans = append(e.spans, span)
+}
+
+func (e *Exporter) post(ctx context.Context, path string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("OTLP[%s] status: %d", path, res.StatusCode)
+	}
+	return nil
+}
+
+func (e *Exporter) resourceJSON() map[string]interface{} {
+	return map[string]interface{}{"attributes": toAttributes(e.resource)}
+}
+
+func (e *Exporter) scopeJSON() map[string]interface{} {
+	return map[string]interface{}{"name": e.scope}
+}
+
+// Flush exports all ended spans; spans are dropped if exporting fails.
+func (e *Exporter) Flush(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	jsonSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		jsonSpans = append(jsonSpans, span.toJSON())
+	}
+
+	return e.post(ctx, tracesPath, map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource":   e.resourceJSON(),
+			"scopeSpans": []map[string]interface{}{{"scope": e.scopeJSON(), "spans": jsonSpans}},
+		}},
+	})
+}
+
+// WriteMetrics exports `points` as gauges named `pcap.<name>`.
+func (e *Exporter) WriteMetrics(ctx context.Context, timestamp time.Time, points []*stats.Point) error {
+	if e == nil || len(points) == 0 {
+		return nil
+	}
+
+	metrics := []map[string]interface{}{}
+	byName := map[string][]map[string]interface{}{}
+	for _, point := range points {
+		dataPoint := map[string]interface{}{
+			"attributes":   toAttributes(point.Labels),
+			"timeUnixNano": unixNano(timestamp),
+		}
+		if point.Double != nil {
+			dataPoint["asDouble"] = *point.Double
+		} else {
+			dataPoint["asInt"] = strconv.FormatInt(*point.Int64, 10)
+		}
+		name := "pcap." + strings.ReplaceAll(point.Name, "/", ".")
+		byName[name] = append(byName[name], dataPoint)
+	}
+	for name, dataPoints := range byName {
+		metrics = append(metrics, map[string]interface{}{
+			"name":  name,
+			"gauge": map[string]interface{}{"dataPoints": dataPoints},
+		})
+	}
+
+	return e.post(ctx, metricsPath, map[string]interface{}{
+		"resourceMetrics": []map[string]interface{}{{
+			"resource":     e.resourceJSON(),
+			"scopeMetrics": []map[string]interface{}{{"scope": e.scopeJSON(), "metrics": metrics}},
+		}},
+	})
+}
+
+// Run flushes spans every `interval` until `ctx` is done; `onError` is notified about failed flushes.
+func (e *Exporter) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Flush(ctx); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// NewExporter creates an exporter for `endpoint`; i/e: `http://127.0.0.1:4318`.
+func NewExporter(endpoint, scope string, resource map[string]string, timeout time.Duration) *Exporter {
+	return &Exporter{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		scope:    scope,
+		client:   &http.Client{Timeout: timeout},
+		resource: resource,
+	}
+}
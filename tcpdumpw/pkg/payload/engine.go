@@ -0,0 +1,237 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package payload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	libpcap "github.com/google/gopacket/pcap"
+)
+
+type (
+	// Segment is a TCP segment including its payload, which JSON translated packets do not carry.
+	Segment struct {
+		Timestamp time.Time
+		SrcIP     string
+		DstIP     string
+		SrcPort   uint16
+		DstPort   uint16
+		Seq       uint32
+		SYN       bool
+		FIN       bool
+		RST       bool
+		Payload   []byte
+	}
+
+	// Datagram is a UDP datagram including its payload.
+	Datagram struct {
+		Timestamp time.Time
+		SrcIP     string
+		DstIP     string
+		SrcPort   uint16
+		DstPort   uint16
+		Payload   []byte
+	}
+
+	// Analyzer is fed with every TCP segment captured by an `Engine`;
+	// segments are delivered sequentially, so analyzers do not need to be thread safe.
+	Analyzer interface {
+		Analyze(segment *Segment)
+	}
+
+	// DatagramAnalyzer is an analyzer which is fed with UDP datagrams as well;
+	// UDP is only captured if at least 1 analyzer implements it.
+	DatagramAnalyzer interface {
+		Analyzer
+		AnalyzeDatagram(datagram *Datagram)
+	}
+
+	// Engine is a PCAP engine which captures TCP segments and hands them over to analyzers,
+	// instead of translating them and writing them into PCAP writers.
+	Engine struct {
+		iface             string
+		filter            string
+		snaplen           int
+		isActive          atomic.Bool
+		analyzers         []Analyzer
+		datagramAnalyzers []DatagramAnalyzer
+	}
+)
+
+const handleTimeout = 100 * time.Millisecond
+
+var errAlreadyStarted = errors.New("already started")
+
+func (e *Engine) IsActive() bool {
+	return e.isActive.Load()
+}
+
+func (e *Engine) newHandle() (*libpcap.Handle, error) {
+	inactiveHandle, err := libpcap.NewInactiveHandle(e.iface)
+	if err != nil {
+		return nil, err
+	}
+	defer inactiveHandle.CleanUp()
+
+	if err = inactiveHandle.SetSnapLen(e.snaplen); err != nil {
+		return nil, err
+	}
+	if err = inactiveHandle.SetTimeout(handleTimeout); err != nil {
+		return nil, err
+	}
+
+	handle, err := inactiveHandle.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to activate: %w", err)
+	}
+	if err = handle.SetBPFFilter(e.filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("BPF filter error: [%s] => %w", e.filter, err)
+	}
+	return handle, nil
+}
+
+func newDatagram(packet gopacket.Packet) (*Datagram, bool) {
+	network := packet.NetworkLayer()
+	udp, ok := packet.TransportLayer().(*layers.UDP)
+	if network == nil || !ok {
+		return nil, false
+	}
+
+	flow := network.NetworkFlow()
+	datagram := &Datagram{
+		Timestamp: packet.Metadata().Timestamp,
+		SrcIP:     flow.Src().String(),
+		DstIP:     flow.Dst().String(),
+		SrcPort:   uint16(udp.SrcPort),
+		DstPort:   uint16(udp.DstPort),
+		Payload:   udp.Payload,
+	}
+	return datagram, true
+}
+
+func newSegment(packet gopacket.Packet) (*Segment, bool) {
+	network := packet.NetworkLayer()
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if network == nil || !ok {
+		return nil, false
+	}
+
+	flow := network.NetworkFlow()
+	segment := &Segment{
+		Timestamp: packet.Metadata().Timestamp,
+		SrcIP:     flow.Src().String(),
+		DstIP:     flow.Dst().String(),
+		SrcPort:   uint16(tcp.SrcPort),
+		DstPort:   uint16(tcp.DstPort),
+		Seq:       tcp.Seq,
+		SYN:       tcp.SYN,
+		FIN:       tcp.FIN,
+		RST:       tcp.RST,
+		Payload:   tcp.Payload,
+	}
+	return segment, true
+}
+
+func (e *Engine) analyze(packet gopacket.Packet) {
+	if segment, ok := newSegment(packet); ok {
+		for _, analyzer := range e.analyzers {
+			analyzer.Analyze(segment)
+		}
+		return
+	}
+	if len(e.datagramAnalyzers) == 0 {
+		return
+	}
+	if datagram, ok := newDatagram(packet); ok {
+		for _, analyzer := range e.datagramAnalyzers {
+			analyzer.AnalyzeDatagram(datagram)
+		}
+	}
+}
+
+// Start captures TCP segments until `ctx` is done; `writers` are not used,
+// as all segments are handed over to the analyzers the engine was created with.
+func (e *Engine) Start(
+	ctx context.Context,
+	writers []pcap.PcapWriter,
+	stopDeadline <-chan *time.Duration,
+) error {
+	if !e.isActive.CompareAndSwap(false, true) {
+		return errAlreadyStarted
+	}
+	defer e.isActive.Store(false)
+
+	handle, err := e.newHandle()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	// packets are discarded once analyzed: analyzers must copy whatever they keep
+	source.NoCopy = true
+
+	packets := source.Packets()
+	for {
+		select {
+		case <-ctx.Done():
+			// all engines receive a stop deadline; segments are analyzed synchronously, so there is nothing to flush
+			<-stopDeadline
+			return ctx.Err()
+
+		case packet, ok := <-packets:
+			if !ok {
+				return nil
+			}
+			e.analyze(packet)
+		}
+	}
+}
+
+// NewEngine creates an engine which hands over to `analyzers` the TCP segments captured from `iface`, and UDP
+// datagrams to the ones which implement `DatagramAnalyzer`; `filter` is the BPF filter used by all other engines,
+// and it may be empty.
+func NewEngine(iface, filter string, snaplen int, analyzers ...Analyzer) *Engine {
+	datagramAnalyzers := []DatagramAnalyzer{}
+	for _, analyzer := range analyzers {
+		if datagramAnalyzer, ok := analyzer.(DatagramAnalyzer); ok {
+			datagramAnalyzers = append(datagramAnalyzers, datagramAnalyzer)
+		}
+	}
+
+	transports := "tcp"
+	if len(datagramAnalyzers) > 0 {
+		transports = "(tcp or udp)"
+	}
+	payloadFilter := transports
+	if filter != "" {
+		payloadFilter = fmt.Sprintf("(%s) and %s", filter, transports)
+	}
+	return &Engine{
+		iface:             iface,
+		filter:            payloadFilter,
+		snaplen:           snaplen,
+		analyzers:         analyzers,
+		datagramAnalyzers: datagramAnalyzers,
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	libpcap "github.com/google/gopacket/pcap"
+)
+
+const (
+	captureProbeTimeout = 100 * time.Millisecond
+	minCaptureBackoff   = 250 * time.Millisecond
+	maxCaptureBackoff   = 5 * time.Second
+)
+
+// libpcap only reports errors as messages; these ones are expected while the instance is starting.
+var transientCaptureErrors = []string{
+	"operation not permitted",
+	"permission denied",
+	"device or resource busy",
+	"resource temporarily unavailable",
+	"no such device",
+	"not up",
+}
+
+// IsTransientCaptureError reports whether opening a capture failed for a reason which may go away on its own.
+func IsTransientCaptureError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := strings.ToLower(err.Error())
+	for _, transientError := range transientCaptureErrors {
+		if strings.Contains(message, transientError) {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitForCapture opens and closes a capture on `iface` until it succeeds; transient failures are retried with
+// exponential backoff until `timeout` elapses, other failures are returned immediately. `onRetry` may be `nil`.
+func WaitForCapture(
+	ctx context.Context,
+	iface string,
+	snaplen int,
+	timeout time.Duration,
+	onRetry func(attempt int, err error, backoff time.Duration),
+) error {
+	if snaplen <= 0 {
+		snaplen = selfTestSnaplen
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := minCaptureBackoff
+	for attempt := 1; ; attempt++ {
+		handle, err := libpcap.OpenLive(iface, int32(snaplen), false /* promisc */, captureProbeTimeout)
+		if err == nil {
+			handle.Close()
+			return nil
+		}
+		if !IsTransientCaptureError(err) {
+			return err
+		}
+
+		deadline, _ := ctx.Deadline()
+		backoff = min(backoff, time.Until(deadline))
+		if backoff <= 0 {
+			return fmt.Errorf("capture could not be opened within %v: %w", timeout, err)
+		}
+		if onRetry != nil {
+			onRetry(attempt, err, backoff)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("capture could not be opened within %v: %w", timeout, err)
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxCaptureBackoff)
+	}
+}
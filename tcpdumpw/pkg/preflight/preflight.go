@@ -0,0 +1,208 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/storage"
+	"github.com/google/gopacket/layers"
+	libpcap "github.com/google/gopacket/pcap"
+)
+
+type (
+	// Check is the outcome of validating a single aspect of the configuration.
+	Check struct {
+		Name   string `json:"check"`
+		Target string `json:"target"`
+		OK     bool   `json:"ok"`
+		Detail string `json:"detail,omitempty"`
+	}
+
+	// Report collects the outcome of all checks.
+	Report struct {
+		Valid  bool     `json:"valid"`
+		Checks []*Check `json:"checks"`
+	}
+)
+
+// see: https://github.com/torvalds/linux/blob/master/include/uapi/linux/if_arp.h
+const (
+	arphrdEther    = 1
+	arphrdLoopback = 772
+	arphrdNone     = 65534
+)
+
+// AnyIface is the pseudo-device which captures on all interfaces.
+const AnyIface = "any"
+
+func NewReport() *Report {
+	return &Report{Valid: true, Checks: []*Check{}}
+}
+
+// Add records the outcome of a check; the report is not valid if any check failed.
+func (r *Report) Add(name, target string, err error, detail string) {
+	check := &Check{Name: name, Target: target, OK: err == nil, Detail: detail}
+	if err != nil {
+		check.Detail = err.Error()
+	}
+	r.Valid = r.Valid && check.OK
+	r.Checks = append(r.Checks, check)
+}
+
+// LinkType returns the link type `libpcap` uses to capture on `iface`.
+func LinkType(iface string) (layers.LinkType, error) {
+	if iface == AnyIface {
+		return layers.LinkTypeLinuxSLL, nil
+	}
+	raw, err := os.ReadFile(filepath.Join("/sys/class/net", iface, "type"))
+	if err != nil {
+		return layers.LinkTypeNull, err
+	}
+	hwType, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return layers.LinkTypeNull, err
+	}
+	switch hwType {
+	case arphrdEther, arphrdLoopback:
+		// Linux loopback devices are captured with fake Ethernet headers
+		return layers.LinkTypeEthernet, nil
+	case arphrdNone:
+		// i/e: TUN devices used by Cloud Run gen1
+		return layers.LinkTypeRaw, nil
+	}
+	return layers.LinkTypeNull, fmt.Errorf("unsupported hardware type: %d", hwType)
+}
+
+// CompileFilter compiles `filter` for the link type of `iface`, and returns the amount of BPF instructions.
+func CompileFilter(iface string, snaplen int, filter string) (int, error) {
+	linkType, err := LinkType(iface)
+	if err != nil {
+		return 0, err
+	}
+	instructions, err := libpcap.CompileBPFFilter(linkType, snaplen, filter)
+	if err != nil {
+		return 0, err
+	}
+	return len(instructions), nil
+}
+
+// CheckWritable verifies that files may be created, written, renamed and deleted in `directory`;
+// PCAP files are renamed when they are rotated, so a directory that only allows writes is not enough.
+func CheckWritable(directory string) error {
+	info, err := os.Stat(directory)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory: %s", directory)
+	}
+	file, err := os.CreateTemp(directory, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	name := file.Name()
+	defer os.Remove(name)
+	if _, err = file.WriteString("preflight"); err != nil {
+		file.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	renamed := name + ".renamed"
+	if err = os.Rename(name, renamed); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	if err = os.Remove(renamed); err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+	return nil
+}
+
+// PrepareDirectory creates `directory` if it is missing and verifies that it is writable
+// and that at least `minFree` bytes are available; it returns the amount of free bytes.
+func PrepareDirectory(directory string, minFree uint64) (uint64, error) {
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return 0, fmt.Errorf("failed to create directory %s: %w", directory, err)
+	}
+	if err := CheckWritable(directory); err != nil {
+		return 0, fmt.Errorf("directory %s is not writable: %w", directory, err)
+	}
+	usage, err := storage.DiskUsage(directory)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get free space of directory %s: %w", directory, err)
+	}
+	if usage.Free < minFree {
+		return usage.Free, fmt.Errorf("directory %s does not have enough free space: %d bytes available, %d bytes required", directory, usage.Free, minFree)
+	}
+	return usage.Free, nil
+}
+
+// ProbeEndpoint verifies that the host of `endpoint` is reachable; i/e: `https://collector:4318` or `syslog+tcp://host:514`.
+// Datagram endpoints cannot be probed without sending data, so only their address is resolved.
+func ProbeEndpoint(ctx context.Context, endpoint string, timeout time.Duration) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("host is required: %s", endpoint)
+	}
+
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "http":
+			port = "80"
+		default:
+			return "", fmt.Errorf("port is required: %s", endpoint)
+		}
+	}
+	address := net.JoinHostPort(u.Hostname(), port)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if strings.Contains(u.Scheme, "udp") {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+		if err != nil {
+			return address, err
+		}
+		return fmt.Sprintf("udp://%s resolved to %s", address, strings.Join(addrs, ",")), nil
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return address, err
+	}
+	defer conn.Close()
+	return fmt.Sprintf("tcp://%s reachable from %s", address, conn.LocalAddr()), nil
+}
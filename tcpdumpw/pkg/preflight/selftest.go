@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preflight
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	libpcap "github.com/google/gopacket/pcap"
+)
+
+const (
+	selfTestReadTimeout   = 100 * time.Millisecond
+	selfTestProbeInterval = 500 * time.Millisecond
+	selfTestProbePrefix   = "tcpdumpw-selftest-"
+	selfTestSnaplen       = 65536
+)
+
+// SelfTest captures UDP packets sent to `target` on every iface in `ifaces` while probes carrying a unique payload
+// are sent to it; it passes if any probe is captured on any iface before `duration` elapses.
+func SelfTest(ctx context.Context, report *Report, ifaces []string, snaplen int, target string, duration time.Duration) {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		report.Add("selftest", target, err, "")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	if snaplen <= 0 {
+		snaplen = selfTestSnaplen
+	}
+
+	nonce := []byte(selfTestProbePrefix + uuid.New().String())
+	filter := fmt.Sprintf("udp dst port %d", addr.Port)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		observed []string
+	)
+
+	handles := 0
+	for _, iface := range ifaces {
+		handle, err := libpcap.OpenLive(iface, int32(snaplen), false /* promisc */, selfTestReadTimeout)
+		if err == nil {
+			if err = handle.SetBPFFilter(filter); err != nil {
+				handle.Close()
+			}
+		}
+		report.Add("capture", iface, err, filter)
+		if err != nil {
+			continue
+		}
+		handles++
+
+		wg.Add(1)
+		go func(iface string, handle *libpcap.Handle) {
+			defer wg.Done()
+			defer handle.Close()
+			for ctx.Err() == nil {
+				data, _, err := handle.ReadPacketData()
+				if errors.Is(err, libpcap.NextErrorTimeoutExpired) {
+					continue
+				} else if err != nil {
+					return
+				}
+				if bytes.Contains(data, nonce) {
+					mu.Lock()
+					observed = append(observed, iface)
+					mu.Unlock()
+					// a single observation per iface is enough
+					return
+				}
+			}
+		}(iface, handle)
+	}
+
+	if handles == 0 {
+		report.Add("selftest", target, errors.New("no iface could be captured"), "")
+		return
+	}
+
+	go sendProbes(ctx, addr, nonce)
+	wg.Wait()
+
+	if len(observed) == 0 {
+		report.Add("selftest", target, fmt.Errorf("probe was not captured within %v", duration), string(nonce))
+		return
+	}
+	report.Add("selftest", target, nil, fmt.Sprintf("probe %s captured on: %s", nonce, strings.Join(observed, ",")))
+}
+
+func sendProbes(ctx context.Context, addr *net.UDPAddr, nonce []byte) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(selfTestProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		// probes are not expected to be answered: delivery errors are irrelevant
+		conn.Write(nonce)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
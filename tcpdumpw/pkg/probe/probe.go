@@ -0,0 +1,225 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/analysis"
+)
+
+type (
+	// Handler is invoked when markers stop being captured, and once again when they are captured again.
+	Handler func(event *Event)
+
+	// Event describes a change in the observation of markers; `Type` is either `missing` or `recovered`.
+	Event struct {
+		Type         string     `json:"type"`
+		Target       string     `json:"target"`
+		Sent         uint64     `json:"sent"`
+		Captured     uint64     `json:"captured"`
+		LastCaptured *time.Time `json:"last_captured,omitempty"`
+		// time since markers were last captured, or since capturing started if they were never captured
+		Silence   string    `json:"silence"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	// Status is the state of the probe as reported by heartbeats.
+	Status struct {
+		Target       string     `json:"target"`
+		Sent         uint64     `json:"sent"`
+		Captured     uint64     `json:"captured"`
+		LastCaptured *time.Time `json:"last_captured,omitempty"`
+		Missing      bool       `json:"missing"`
+	}
+
+	// Probe periodically sends a tiny UDP marker to a target, and expects it to be captured within a timeout;
+	// markers are recognized in the JSON translated packets by their destination and source port, as UDP payloads
+	// are not translated.
+	Probe struct {
+		target   *net.UDPAddr
+		addr     netip.Addr
+		interval time.Duration
+		timeout  time.Duration
+		// markers are only expected while packets are being captured
+		isCapturing func() bool
+		onEvent     Handler
+
+		conn    *net.UDPConn
+		srcPort uint16
+		created time.Time
+
+		sent         atomic.Uint64
+		captured     atomic.Uint64
+		lastCaptured atomic.Int64
+		missing      atomic.Bool
+	}
+
+	// Observer is a packet analyzer which recognizes markers in the JSON translated packets captured from any iface.
+	Observer struct {
+		probe *Probe
+	}
+)
+
+const (
+	EventMissing   = "missing"
+	EventRecovered = "recovered"
+)
+
+const markerPrefix = "tcpdumpw-probe-"
+
+func (p *Probe) Target() string {
+	return p.target.String()
+}
+
+func (p *Probe) lastCapturedTime() *time.Time {
+	nanos := p.lastCaptured.Load()
+	if nanos == 0 {
+		return nil
+	}
+	ts := time.Unix(0, nanos)
+	return &ts
+}
+
+func (p *Probe) newEvent(kind string, now, since time.Time) *Event {
+	return &Event{
+		Type:         kind,
+		Target:       p.target.String(),
+		Sent:         p.sent.Load(),
+		Captured:     p.captured.Load(),
+		LastCaptured: p.lastCapturedTime(),
+		Silence:      now.Sub(since).Round(time.Millisecond).String(),
+		Timestamp:    now,
+	}
+}
+
+// Status returns the counters of sent and captured markers.
+func (p *Probe) Status() Status {
+	return Status{
+		Target:       p.target.String(),
+		Sent:         p.sent.Load(),
+		Captured:     p.captured.Load(),
+		LastCaptured: p.lastCapturedTime(),
+		Missing:      p.missing.Load(),
+	}
+}
+
+func (p *Probe) send() {
+	marker := markerPrefix + strconv.FormatUint(p.sent.Add(1), 10)
+	// markers are not expected to be answered: delivery errors are irrelevant
+	p.conn.Write([]byte(marker))
+}
+
+// observe records a captured marker; if markers were missing, they recovered.
+func (p *Probe) observe(now time.Time) {
+	p.captured.Add(1)
+	previous := p.lastCaptured.Swap(now.UnixNano())
+	if p.missing.CompareAndSwap(true, false) {
+		since := p.created
+		if previous != 0 {
+			since = time.Unix(0, previous)
+		}
+		p.onEvent(p.newEvent(EventRecovered, now, since))
+	}
+}
+
+// Run sends markers every interval until `ctx` is done, and reports them as missing if none is captured within
+// the timeout; time spent without capturing, i/e: between scheduled executions, does not count.
+func (p *Probe) Run(ctx context.Context) {
+	defer p.conn.Close()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	// markers are expected since the latest of: the last one captured, or capturing was resumed
+	var resumed time.Time
+	for {
+		now := time.Now()
+		if !p.isCapturing() {
+			resumed = time.Time{}
+		} else {
+			if resumed.IsZero() {
+				resumed = now
+			}
+			p.send()
+
+			since := resumed
+			if last := p.lastCapturedTime(); last != nil && last.After(since) {
+				since = *last
+			}
+			if now.Sub(since) > p.timeout && p.missing.CompareAndSwap(false, true) {
+				p.onEvent(p.newEvent(EventMissing, now, since))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Observer returns an analyzer which must be fed by a Dispatcher.
+func (p *Probe) Observer() *Observer {
+	return &Observer{probe: p}
+}
+
+// Analyze records the capture of `packet` if it is a marker sent by the probe.
+func (o *Observer) Analyze(packet *analysis.Packet) {
+	if packet.L3 == nil || packet.L4 == nil || packet.L3.Proto.Name != "UDP" {
+		return
+	}
+	if srcPort, dstPort := packet.Ports(); srcPort != o.probe.srcPort || dstPort != uint16(o.probe.target.Port) {
+		return
+	}
+	if dst, err := netip.ParseAddr(packet.L3.Dst); err != nil || dst.Unmap() != o.probe.addr {
+		return
+	}
+	o.probe.observe(time.Now())
+}
+
+// New creates a probe which sends markers to the UDP address `target` every `interval`, and reports them as missing
+// if none is captured within `timeout` while `isCapturing` returns `true`.
+func New(target string, interval, timeout time.Duration, isCapturing func() bool, onEvent Handler) (*Probe, error) {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %s | %w", target, err)
+	}
+	// markers are recognized by their source port: it must not change while the probe runs
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial target: %s | %w", target, err)
+	}
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return &Probe{
+		target:      addr,
+		addr:        ip.Unmap(),
+		interval:    interval,
+		timeout:     timeout,
+		isCapturing: isCapturing,
+		onEvent:     onEvent,
+		conn:        conn,
+		srcPort:     uint16(local.Port),
+		created:     time.Now(),
+	}, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package procs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const procDir = "/proc"
+
+type (
+	// Process is a process started by the current one.
+	Process struct {
+		Pid  int      `json:"pid"`
+		Name string   `json:"name"`
+		Args []string `json:"args"`
+	}
+)
+
+// readStat returns the executable name and the parent pid of `pid`.
+func readStat(pid int) (string, int, error) {
+	stat, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", 0, err
+	}
+	// the executable name is enclosed in parentheses, and it may contain spaces or parentheses itself
+	start, end := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+	if start < 0 || end < start {
+		return "", 0, syscall.EINVAL
+	}
+	// the fields following the name are: state and parent pid
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 2 {
+		return "", 0, syscall.EINVAL
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, err
+	}
+	return string(stat[start+1 : end]), ppid, nil
+}
+
+func readArgs(pid int) ([]string, error) {
+	cmdline, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), nil
+}
+
+// Children returns the processes started by the current one whose executable is `name`.
+func Children(name string) ([]*Process, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	self := os.Getpid()
+	children := []*Process{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// processes may exit at any time: they are skipped
+		comm, ppid, err := readStat(pid)
+		if err != nil || ppid != self || comm != name {
+			continue
+		}
+		args, err := readArgs(pid)
+		if err != nil {
+			continue
+		}
+		children = append(children, &Process{Pid: pid, Name: comm, Args: args})
+	}
+	return children, nil
+}
+
+// HasArgs reports whether `args` are passed to the process in the same order, i/e: `-i eth0`.
+func (p *Process) HasArgs(args ...string) bool {
+	for i := 0; i+len(args) <= len(p.Args); i++ {
+		if slices.Equal(p.Args[i:i+len(args)], args) {
+			return true
+		}
+	}
+	return false
+}
+
+// Kill sends `SIGKILL` to the process and to the rest of its process group if it leads one.
+func (p *Process) Kill() error {
+	if pgid, err := syscall.Getpgid(p.Pid); err == nil && pgid == p.Pid {
+		return syscall.Kill(-p.Pid, syscall.SIGKILL)
+	}
+	return syscall.Kill(p.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiles
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/sinks"
+)
+
+type (
+	// Profile is a set of tasks captured and scheduled independently from all others; i/e: flow records
+	// captured all the time with a small snaplen, and full packets captured on a schedule.
+	// Fields which are not set take the value of the flag with the same name.
+	Profile struct {
+		Name     string  `json:"name"`
+		Iface    *string `json:"iface,omitempty"`
+		Filter   *string `json:"filter,omitempty"`
+		Snaplen  *int    `json:"snaplen,omitempty"`
+		Interval *int    `json:"interval,omitempty"`
+		Timeout  *int    `json:"timeout,omitempty"`
+		// profiles without a cron expression are executed once, as soon as `tcpdumpw` starts
+		CronExp  string `json:"cron_exp,omitempty"`
+		Tcpdump  *bool  `json:"tcpdump,omitempty"`
+		Jsondump *bool  `json:"jsondump,omitempty"`
+		Flows    *bool  `json:"flows,omitempty"`
+		// executions of this profile which may overlap; every one of them captures with its own tasks
+		MaxConcurrent int `json:"max_concurrent,omitempty"`
+		// ordered list of the writers of JSON PCAP records; it prevails over `json_sinks`
+		Sinks []*Sink `json:"sinks,omitempty"`
+	}
+
+	// Sink is 1 of the writers of JSON PCAP records of a profile, by its registered name.
+	Sink struct {
+		Name   string       `json:"name"`
+		Policy sinks.Policy `json:"policy,omitempty"`
+		// records held for a best-effort sink while it is busy
+		Queue int `json:"queue,omitempty"`
+	}
+)
+
+const (
+	DefaultMaxConcurrent = 1
+	MaxConcurrent        = 8
+)
+
+// names are included in file names: they must not break the file name template.
+var nameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// Load parses `spec`, which is either a JSON array of profiles or the path of a file containing it.
+func Load(spec string) ([]*Profile, error) {
+	data := []byte(strings.TrimSpace(spec))
+	if !bytes.HasPrefix(data, []byte("[")) {
+		var err error
+		if data, err = os.ReadFile(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	profiles := []*Profile{}
+	if err := decoder.Decode(&profiles); err != nil {
+		return nil, fmt.Errorf("invalid profiles: %w", err)
+	}
+	if len(profiles) == 0 {
+		return nil, errors.New("no profiles defined")
+	}
+
+	var errs []error
+	names := make(map[string]bool, len(profiles))
+	for _, profile := range profiles {
+		if names[profile.Name] {
+			errs = append(errs, fmt.Errorf("duplicate profile: %q", profile.Name))
+		}
+		names[profile.Name] = true
+		if profile.MaxConcurrent == 0 {
+			profile.MaxConcurrent = DefaultMaxConcurrent
+		}
+		if err := profile.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return profiles, errors.Join(errs...)
+}
+
+// Validate checks the values which do not depend on other flags; cron expressions are checked by the scheduler.
+func (p *Profile) Validate() error {
+	var errs []error
+	if !nameRegex.MatchString(p.Name) {
+		errs = append(errs, fmt.Errorf("invalid profile name: %q | use up to 32 lowercase letters, digits and dashes", p.Name))
+	}
+	if p.Timeout != nil && *p.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("profile %q: 'timeout' must not be negative: %ds", p.Name, *p.Timeout))
+	}
+	if p.Interval != nil && *p.Interval < 0 {
+		errs = append(errs, fmt.Errorf("profile %q: 'interval' must not be negative: %ds", p.Name, *p.Interval))
+	}
+	if p.MaxConcurrent < 1 || p.MaxConcurrent > MaxConcurrent {
+		errs = append(errs, fmt.Errorf("profile %q: 'max_concurrent' must be between 1 and %d: %d", p.Name, MaxConcurrent, p.MaxConcurrent))
+	}
+	names := make(map[string]bool, len(p.Sinks))
+	for _, sink := range p.Sinks {
+		if sink == nil {
+			errs = append(errs, fmt.Errorf("profile %q: empty sink", p.Name))
+			continue
+		}
+		registered, err := sinks.Lookup(sink.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("profile %q: %w", p.Name, err))
+		} else if names[registered.Name] {
+			errs = append(errs, fmt.Errorf("profile %q: duplicate sink: %q", p.Name, sink.Name))
+		} else {
+			// aliases are resolved so that sinks are looked up only once
+			names[registered.Name] = true
+			sink.Name = registered.Name
+		}
+		policy, err := sinks.ParsePolicy(string(sink.Policy))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("profile %q: %w", p.Name, err))
+		}
+		sink.Policy = policy
+		if sink.Queue < 0 || sink.Queue > sinks.MaxQueueSize {
+			errs = append(errs, fmt.Errorf("profile %q: sink %q: 'queue' must be between 0 and %d: %d", p.Name, sink.Name, sinks.MaxQueueSize, sink.Queue))
+		} else if sink.Queue > 0 && policy == sinks.PolicyRequired {
+			errs = append(errs, fmt.Errorf("profile %q: sink %q: 'queue' is only used by '%s' sinks", p.Name, sink.Name, sinks.PolicyBestEffort))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Profile) String() string {
+	schedule := p.CronExp
+	if schedule == "" {
+		schedule = "at startup"
+	}
+	return fmt.Sprintf("%s(%s)", p.Name, schedule)
+}
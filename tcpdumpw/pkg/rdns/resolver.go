@@ -0,0 +1,173 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rdns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Resolver caches the PTR records of external IP addresses; lookups never block:
+	// addresses which are not cached yet are resolved in the background, and their
+	// hostnames become available to subsequent lookups.
+	Resolver struct {
+		mu       sync.Mutex
+		resolver *net.Resolver
+		cache    map[string]*cacheEntry
+		pending  map[string]struct{}
+		queue    chan string
+		maxSize  int
+		ttl      time.Duration
+		timeout  time.Duration
+	}
+
+	cacheEntry struct {
+		hostname string
+		expires  time.Time
+	}
+
+	// Endpoints is the annotation added into JSON translated packets as the `RDNS` object.
+	Endpoints struct {
+		Src string `json:"src,omitempty"`
+		Dst string `json:"dst,omitempty"`
+	}
+)
+
+const (
+	queueSize = 1024
+	workers   = 4
+	// addresses without PTR records are not looked up again until this time elapses
+	negativeTTL = 1 * time.Minute
+)
+
+func isExternal(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// store must be called while holding `r.mu`.
+func (r *Resolver) store(ip string, entry *cacheEntry) {
+	if _, ok := r.cache[ip]; !ok && len(r.cache) >= r.maxSize {
+		now := time.Now()
+		evicted := false
+		for key, cached := range r.cache {
+			if now.After(cached.expires) {
+				delete(r.cache, key)
+				evicted = true
+			}
+		}
+		// the cache is bounded: if nothing expired, an arbitrary entry is evicted
+		if !evicted {
+			for key := range r.cache {
+				delete(r.cache, key)
+				break
+			}
+		}
+	}
+	r.cache[ip] = entry
+}
+
+func (r *Resolver) resolve(ctx context.Context, ip string) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	names, err := r.resolver.LookupAddr(ctx, ip)
+	cancel()
+
+	entry := &cacheEntry{expires: time.Now().Add(negativeTTL)}
+	if err == nil && len(names) > 0 {
+		entry.hostname = strings.TrimSuffix(names[0], ".")
+		entry.expires = time.Now().Add(r.ttl)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, ip)
+	r.store(ip, entry)
+}
+
+func (r *Resolver) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ip := <-r.queue:
+			r.resolve(ctx, ip)
+		}
+	}
+}
+
+// Lookup returns the cached hostname of `ip`, or an empty string if it is not an external
+// address, if it has no PTR record, or if it is not resolved yet; in which case it is queued.
+func (r *Resolver) Lookup(ip string) string {
+	if !isExternal(ip) {
+		return ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.cache[ip]; ok && time.Now().Before(entry.expires) {
+		return entry.hostname
+	}
+	if _, ok := r.pending[ip]; ok {
+		return ""
+	}
+	select {
+	case r.queue <- ip:
+		r.pending[ip] = struct{}{}
+	default:
+		// the address is queued again by the next lookup
+	}
+	return ""
+}
+
+func (r *Resolver) Property() string {
+	return "RDNS"
+}
+
+// Annotate returns the hostnames of `src` and `dst`, or `nil` if none of them is resolved.
+func (r *Resolver) Annotate(src, dst string) any {
+	endpoints := &Endpoints{Src: r.Lookup(src), Dst: r.Lookup(dst)}
+	if endpoints.Src == "" && endpoints.Dst == "" {
+		return nil
+	}
+	return endpoints
+}
+
+// NewResolver creates a resolver which caches up to `maxSize` hostnames for `ttl`;
+// every PTR lookup is abandoned after `timeout`, and all of them stop when `ctx` is done.
+func NewResolver(ctx context.Context, maxSize int, ttl, timeout time.Duration) *Resolver {
+	resolver := &Resolver{
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]*cacheEntry, maxSize),
+		pending:  make(map[string]struct{}),
+		queue:    make(chan string, queueSize),
+		maxSize:  max(1, maxSize),
+		ttl:      ttl,
+		timeout:  timeout,
+	}
+	for i := 0; i < workers; i++ {
+		go resolver.run(ctx)
+	}
+	return resolver
+}
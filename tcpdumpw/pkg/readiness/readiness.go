@@ -0,0 +1,133 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readiness
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wissance/stringFormatter"
+)
+
+type (
+	ReadinessProbe interface {
+		fmt.Stringer
+		Probe(context.Context) error
+	}
+
+	httpReadinessProbe struct {
+		url    string
+		client *http.Client
+	}
+
+	tcpReadinessProbe struct {
+		address string
+		dialer  *net.Dialer
+	}
+)
+
+const (
+	defaultProbeTimeout = 1 * time.Second
+	defaultProbeHost    = "127.0.0.1"
+)
+
+func (p *httpReadinessProbe) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status: %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (p *httpReadinessProbe) String() string {
+	return stringFormatter.Format("HTTP[{0}]", p.url)
+}
+
+func (p *tcpReadinessProbe) Probe(ctx context.Context) error {
+	conn, err := p.dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *tcpReadinessProbe) String() string {
+	return stringFormatter.Format("TCP[{0}]", p.address)
+}
+
+// NewReadinessProbe creates a probe from:
+//   - an HTTP(S) URL; i/e: `http://127.0.0.1:8080/ready`, which is ready when it responds with `2xx`.
+//   - a TCP address; i/e: `tcp://127.0.0.1:8080`, `127.0.0.1:8080` or just `8080`, which is ready when it accepts connections.
+func NewReadinessProbe(target string) (ReadinessProbe, error) {
+	target = strings.TrimSpace(target)
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return &httpReadinessProbe{
+			url:    target,
+			client: &http.Client{Timeout: defaultProbeTimeout},
+		}, nil
+	}
+
+	address := strings.TrimPrefix(target, "tcp://")
+	if port, err := strconv.ParseUint(address, 10, 16); err == nil {
+		address = net.JoinHostPort(defaultProbeHost, strconv.FormatUint(port, 10))
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid readiness target '%s': %w", target, err)
+	}
+
+	return &tcpReadinessProbe{
+		address: address,
+		dialer:  &net.Dialer{Timeout: defaultProbeTimeout},
+	}, nil
+}
+
+// WaitUntilReady blocks until `probe` succeeds, or `ctx` is done; `onFailure` is invoked with each failed attempt.
+func WaitUntilReady(
+	ctx context.Context,
+	probe ReadinessProbe,
+	interval time.Duration,
+	onFailure func(uint64, error),
+) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for attempt := uint64(1); ; attempt++ {
+		err := probe.Probe(ctx)
+		if err == nil {
+			return nil
+		}
+		onFailure(attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/gchux/pcap-cli/pkg/pcap"
+	"github.com/gchux/pcap-cli/pkg/transformer"
+	"github.com/google/gopacket"
+	libpcap "github.com/google/gopacket/pcap"
+)
+
+type (
+	// Engine replays the packets of a PCAP or PCAPNG file through the same translation into JSON used for live captures,
+	// so that all writers and analyzers are fed as if packets were being captured. Once all packets were translated,
+	// it keeps waiting for `ctx` to be done, as live engines do, and `Done` is closed.
+	Engine struct {
+		config   *pcap.PcapConfig
+		input    string
+		filter   string
+		realtime bool
+		isActive atomic.Bool
+
+		packets atomic.Uint64
+		done    chan struct{}
+		// the error which ended the replay before the end of the input file; available once `done` is closed
+		err error
+	}
+
+	// flushWriter tracks the translations written, so that the end of a replay can be told apart.
+	flushWriter struct {
+		io.Writer
+		writes    atomic.Uint64
+		lastWrite atomic.Int64
+	}
+)
+
+// Iface is the name of the iface replayed packets are translated as being captured from.
+const Iface = "file"
+
+const (
+	// flushTimeout bounds the time to write all translations once all packets were replayed
+	flushTimeout = 10 * time.Second
+	// packets may not be translated, i/e: if they are filtered out; writers idle for this long are flushed
+	flushIdle     = time.Second
+	flushInterval = 50 * time.Millisecond
+)
+
+var errAlreadyStarted = errors.New("already started")
+
+func (e *Engine) IsActive() bool {
+	return e.isActive.Load()
+}
+
+// Done is closed once all packets of the input file were replayed and their translations written.
+func (e *Engine) Done() <-chan struct{} {
+	return e.done
+}
+
+// Err returns the error which ended the replay before the end of the input file, i/e: if it was truncated;
+// it must not be called before `Done` is closed.
+func (e *Engine) Err() error {
+	return e.err
+}
+
+// Packets returns the amount of packets replayed.
+func (e *Engine) Packets() uint64 {
+	return e.packets.Load()
+}
+
+func (e *Engine) open() (*libpcap.Handle, error) {
+	// `libpcap` reads both PCAP and PCAPNG files, and applies BPF filters as it does for live captures
+	handle, err := libpcap.OpenOffline(e.input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input: %s | %w", e.input, err)
+	}
+	if e.filter != "" {
+		if err := handle.SetBPFFilter(e.filter); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("BPF filter error: [%s] => %w", e.filter, err)
+		}
+	}
+	return handle, nil
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.writes.Add(1)
+	w.lastWrite.Store(time.Now().UnixNano())
+	return w.Writer.Write(p)
+}
+
+// flush waits until all `packets` were written, or `w` went idle; translations are dropped
+// once the context of the transformer is done, so it must be waited for before it is.
+func (w *flushWriter) flush(ctx context.Context, packets uint64) {
+	deadline := time.Now().Add(flushTimeout)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	w.lastWrite.CompareAndSwap(0, time.Now().UnixNano())
+	for w.writes.Load() < packets && time.Now().Before(deadline) &&
+		time.Since(time.Unix(0, w.lastWrite.Load())) < flushIdle {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewTransformer creates the translation into JSON of packets captured from `iface` as `config` requires, along with
+// a function which waits until the translations of `packets` were written; packets emitted by engines which do not
+// capture them must be translated by it, so that all writers and analyzers are fed as if they were being captured.
+func NewTransformer(
+	ctx context.Context,
+	config *pcap.PcapConfig,
+	iface string,
+	writers []pcap.PcapWriter,
+) (transformer.IPcapTransformer, func(context.Context, uint64), error) {
+	if len(writers) == 0 {
+		return nil, nil, errors.New("no writers")
+	}
+	// all writers receive the same translations: tracking the 1st one is enough
+	flusher := &flushWriter{Writer: writers[0]}
+	ioWriters := []io.Writer{flusher}
+	for _, writer := range writers[1:] {
+		ioWriters = append(ioWriters, writer)
+	}
+
+	pcapIface := &transformer.PcapIface{Index: 0, Name: iface, Addrs: mapset.NewThreadUnsafeSet[string]()}
+	compatFilters, _ := config.CompatFilters.(transformer.PcapFilters)
+	format := config.Format
+
+	var fn transformer.IPcapTransformer
+	var err error
+	if config.Ordered {
+		fn, err = transformer.NewOrderedTransformer(ctx, pcapIface, config.Ephemerals, compatFilters, ioWriters, &format, config.Debug, config.Compat)
+	} else if config.ConnTrack {
+		fn, err = transformer.NewConnTrackTransformer(ctx, pcapIface, config.Ephemerals, compatFilters, ioWriters, &format, config.Debug, config.Compat)
+	} else {
+		fn, err = transformer.NewTransformer(ctx, pcapIface, config.Ephemerals, compatFilters, ioWriters, &format, config.Debug, config.Compat)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid format: %w", err)
+	}
+	return fn, flusher.flush, nil
+}
+
+// pace delays the replay of a packet captured at `ts`, so that the time between packets is the original one.
+func pace(ctx context.Context, firstTS, startTS, ts time.Time) error {
+	delay := ts.Sub(firstTS) - time.Since(startTS)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Start replays the input file; it returns the error of `ctx` once it is done, or an error if the file cannot be read.
+func (e *Engine) Start(
+	ctx context.Context,
+	writers []pcap.PcapWriter,
+	stopDeadline <-chan *time.Duration,
+) error {
+	if !e.isActive.CompareAndSwap(false, true) {
+		return errAlreadyStarted
+	}
+	defer e.isActive.Store(false)
+
+	// engines may be restarted: packets must never be replayed twice
+	select {
+	case <-e.done:
+		<-ctx.Done()
+		<-stopDeadline
+		return ctx.Err()
+	default:
+	}
+
+	handle, err := e.open()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	fn, flush, err := NewTransformer(ctx, e.config, Iface, writers)
+	if err != nil {
+		return err
+	}
+
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	source.Lazy = true
+	source.DecodeStreamsAsDatagrams = true
+
+	var firstTS, startTS time.Time
+	var replayErr error = nil
+	for {
+		packet, err := source.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// truncated files end with a partial record: everything before it was replayed
+			replayErr = err
+			break
+		}
+
+		ts := packet.Metadata().Timestamp
+		if e.realtime {
+			if firstTS.IsZero() {
+				firstTS, startTS = ts, time.Now()
+			} else if err := pace(ctx, firstTS, startTS, ts); err != nil {
+				break
+			}
+		}
+
+		serial := e.packets.Add(1)
+		if err := fn.Apply(ctx, &packet, &serial); err != nil && ctx.Err() != nil {
+			break
+		}
+	}
+
+	if ctx.Err() == nil {
+		flush(ctx, e.packets.Load())
+		e.err = replayErr
+		close(e.done)
+		<-ctx.Done()
+	}
+
+	deadline := <-stopDeadline
+	if deadline == nil {
+		deadline = new(time.Duration)
+	}
+	fn.WaitDone(ctx, deadline)
+	return ctx.Err()
+}
+
+// NewEngine creates an engine which replays the packets of `input` translated as `config` requires; `filter`
+// is the BPF filter used by all other engines, and it may be empty. If `realtime` is enabled, the original time
+// between packets is respected; otherwise, packets are replayed as fast as they can be translated.
+func NewEngine(config *pcap.PcapConfig, input, filter string, realtime bool) *Engine {
+	if config.Ephemerals == nil {
+		config.Ephemerals = &pcap.PcapEmphemeralPorts{Min: pcap.PCAP_MIN_EPHEMERAL_PORT, Max: pcap.PCAP_MAX_EPHEMERAL_PORT}
+	}
+	return &Engine{
+		config:   config,
+		input:    input,
+		filter:   filter,
+		realtime: realtime,
+		done:     make(chan struct{}),
+	}
+}
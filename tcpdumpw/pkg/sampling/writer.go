@@ -0,0 +1,163 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sampling
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// SuppressedHandler is invoked once for every window in which records were suppressed.
+	SuppressedHandler func(iface *string, window time.Time, suppressed uint64)
+
+	// RateLimitedWriter writes at most `maxEPS` records per second: the first ones in every
+	// second ( head ) are written immediately, while the last `tail` ones are held and written
+	// when the second is over; all other records are suppressed.
+	RateLimitedWriter struct {
+		pcap.PcapWriter
+		mu           sync.Mutex
+		head         uint64
+		tail         int
+		window       time.Time
+		written      uint64
+		suppressed   uint64
+		tailRecords  [][]byte
+		tailNext     int
+		total        atomic.Uint64
+		onSuppressed SuppressedHandler
+	}
+)
+
+const windowSize = time.Second
+
+// flush must be called while holding `w.mu`.
+func (w *RateLimitedWriter) flush(now time.Time) {
+	window := now.Truncate(windowSize)
+	if window.Equal(w.window) {
+		return
+	}
+
+	// tail records are kept in a ring buffer: write them in the order they were received
+	size := len(w.tailRecords)
+	for i := 0; i < size; i++ {
+		w.PcapWriter.Write(w.tailRecords[(w.tailNext+i)%size])
+	}
+
+	if w.suppressed > 0 && w.onSuppressed != nil {
+		w.onSuppressed(w.PcapWriter.GetIface(), w.window, w.suppressed)
+	}
+
+	w.window = window
+	w.written = 0
+	w.suppressed = 0
+	w.tailRecords = w.tailRecords[:0]
+	w.tailNext = 0
+}
+
+func (w *RateLimitedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.flush(time.Now())
+
+	if w.written < w.head {
+		w.written++
+		return w.PcapWriter.Write(p)
+	}
+
+	if w.tail == 0 {
+		w.suppressed++
+		w.total.Add(1)
+		return len(p), nil
+	}
+
+	// writers may reuse `p` after `Write` returns
+	record := append([]byte(nil), p...)
+	if len(w.tailRecords) < w.tail {
+		w.tailRecords = append(w.tailRecords, record)
+		return len(p), nil
+	}
+
+	// the oldest record held for the tail is replaced by the newest one
+	w.tailRecords[w.tailNext] = record
+	w.tailNext = (w.tailNext + 1) % w.tail
+	w.suppressed++
+	w.total.Add(1)
+	return len(p), nil
+}
+
+func (w *RateLimitedWriter) Rotate() {
+	w.mu.Lock()
+	w.flush(time.Now().Add(windowSize))
+	w.mu.Unlock()
+	w.PcapWriter.Rotate()
+}
+
+func (w *RateLimitedWriter) Close() error {
+	w.mu.Lock()
+	w.flush(time.Now().Add(windowSize))
+	w.mu.Unlock()
+	return w.PcapWriter.Close()
+}
+
+// Suppressed returns the amount of records which were not written since the writer was created.
+func (w *RateLimitedWriter) Suppressed() uint64 {
+	return w.total.Load()
+}
+
+// tail records must be written even if no more records are received
+func (w *RateLimitedWriter) flushEvery(ctx context.Context) {
+	ticker := time.NewTicker(windowSize)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.mu.Lock()
+			w.flush(now)
+			w.mu.Unlock()
+		}
+	}
+}
+
+// NewRateLimitedWriter wraps `writer` so that no more than `maxEPS` records are written
+// per second, `tail` of which are the last ones received during each second.
+func NewRateLimitedWriter(
+	ctx context.Context,
+	writer pcap.PcapWriter,
+	maxEPS, tail int,
+	onSuppressed SuppressedHandler,
+) *RateLimitedWriter {
+	if tail > maxEPS {
+		tail = maxEPS
+	}
+	w := &RateLimitedWriter{
+		PcapWriter:   writer,
+		head:         uint64(maxEPS - tail),
+		tail:         tail,
+		window:       time.Now().Truncate(windowSize),
+		tailRecords:  make([][]byte, 0, tail),
+		onSuppressed: onSuppressed,
+	}
+	go w.flushEvery(ctx)
+	return w
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Schema is a JSON Schema ( draft 2020-12 ) document or sub-schema.
+	Schema struct {
+		Schema               string             `json:"$schema,omitempty"`
+		ID                   string             `json:"$id,omitempty"`
+		Title                string             `json:"title,omitempty"`
+		Description          string             `json:"description,omitempty"`
+		Type                 any                `json:"type,omitempty"`
+		Format               string             `json:"format,omitempty"`
+		Pattern              string             `json:"pattern,omitempty"`
+		Default              any                `json:"default,omitempty"`
+		Properties           map[string]*Schema `json:"properties,omitempty"`
+		Required             []string           `json:"required,omitempty"`
+		Items                *Schema            `json:"items,omitempty"`
+		AdditionalProperties any                `json:"additionalProperties,omitempty"`
+	}
+)
+
+const (
+	draft   = "https://json-schema.org/draft/2020-12/schema"
+	baseURI = "https://github.com/gchux/cloud-run-tcpdump/schemas/"
+	// durationPattern matches the duration strings accepted by flags which hold an amount of seconds.
+	durationPattern = `^([0-9]+|([0-9]+(h|m|s|ms|us|µs|ns))+)$`
+)
+
+// packetSchema describes the JSON records into which packets are translated; they are not backed by a Go type.
+//
+//go:embed packet.schema.json
+var packetSchema []byte
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func newDocument(name, title, description string) *Schema {
+	return &Schema{
+		Schema:      draft,
+		ID:          baseURI + name + ".schema.json",
+		Title:       title,
+		Description: description,
+	}
+}
+
+// FromType describes the JSON encoding of `value` as produced by `encoding/json`;
+// fields tagged with `omitempty` are not required.
+func FromType(name, title, description string, value any) *Schema {
+	document := fromType(reflect.TypeOf(value))
+	document.Schema = draft
+	document.ID = baseURI + name + ".schema.json"
+	document.Title = title
+	document.Description = description
+	return document
+}
+
+func fromType(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: fromType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: fromType(t.Elem())}
+	case reflect.Struct:
+		return fromStruct(t)
+	}
+	// interfaces may hold any value
+	return &Schema{}
+}
+
+func fromStruct(t reflect.Type) *Schema {
+	schema := &Schema{
+		Type:       "object",
+		Properties: map[string]*Schema{},
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = fromType(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return schema
+}
+
+// FromFlags describes the configuration accepted by `flags` as a JSON object whose properties are the flags names.
+func FromFlags(name, title, description string, flags *flag.FlagSet) *Schema {
+	document := newDocument(name, title, description)
+	document.Type = "object"
+	document.Properties = map[string]*Schema{}
+	document.AdditionalProperties = false
+
+	flags.VisitAll(func(f *flag.Flag) {
+		property := &Schema{Description: f.Usage}
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			property.Type = "string"
+			property.Default = f.DefValue
+			document.Properties[f.Name] = property
+			return
+		}
+		switch getter.Get().(type) {
+		case bool:
+			property.Type = "boolean"
+			property.Default, _ = strconv.ParseBool(f.DefValue)
+		case time.Duration:
+			// amounts of seconds may also be set using duration strings
+			property.Type = []string{"integer", "string"}
+			property.Pattern = durationPattern
+			property.Default, _ = strconv.Atoi(f.DefValue)
+		case int, int64, uint, uint64:
+			property.Type = "integer"
+			property.Default, _ = strconv.Atoi(f.DefValue)
+		case float64:
+			property.Type = "number"
+			property.Default, _ = strconv.ParseFloat(f.DefValue, 64)
+		default:
+			property.Type = "string"
+			property.Default = f.DefValue
+		}
+		document.Properties[f.Name] = property
+	})
+	return document
+}
+
+// Packet returns the schema of the JSON records into which packets are translated.
+func Packet() json.RawMessage {
+	return json.RawMessage(packetSchema)
+}
@@ -0,0 +1,289 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sinks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+// Policy tells how the failures of a sink affect all other sinks of the same FanoutWriter.
+type Policy string
+
+const (
+	// PolicyRequired sinks are written in the capture path: their failures are returned to the engine.
+	PolicyRequired Policy = "required"
+	// PolicyBestEffort sinks are written from their own queue: records are dropped when they cannot keep up.
+	PolicyBestEffort Policy = "best_effort"
+)
+
+const (
+	DefaultQueueSize = 1024
+	MaxQueueSize     = 65536
+
+	reportInterval = 10 * time.Second
+	// best-effort sinks which are still writing queued records when closing are abandoned after this long
+	closeTimeout = 5 * time.Second
+)
+
+var (
+	errClosed = errors.New("fan-out writer is closed")
+
+	// receiving from a closed channel never blocks
+	closedDeadline = func() <-chan time.Time {
+		deadline := make(chan time.Time)
+		close(deadline)
+		return deadline
+	}()
+)
+
+type (
+	// Branch is 1 of the sinks written by a FanoutWriter.
+	Branch struct {
+		Name   string
+		Policy Policy
+		// Queue is the amount of records held for a best-effort sink while it is busy.
+		Queue  int
+		Writer pcap.PcapWriter
+	}
+
+	// DegradedHandler is invoked at most once every 10 seconds for every sink which dropped or failed to write records.
+	DegradedHandler func(iface *string, sink string, policy Policy, dropped, failed uint64)
+
+	branch struct {
+		*Branch
+		queue   chan []byte
+		rotate  atomic.Bool
+		discard atomic.Bool
+		done    chan error
+		dropped atomic.Uint64
+		failed  atomic.Uint64
+	}
+
+	// FanoutWriter writes every record into an ordered list of sinks, so that slow best-effort sinks never block the capture.
+	FanoutWriter struct {
+		iface      *string
+		branches   []*branch
+		stop       context.CancelFunc
+		closed     atomic.Bool
+		closeOnce  sync.Once
+		closeErr   error
+		onDegraded DegradedHandler
+	}
+)
+
+// ParsePolicy returns the policy named `policy`; sinks are required by default.
+func ParsePolicy(policy string) (Policy, error) {
+	switch Policy(strings.ToLower(strings.TrimSpace(policy))) {
+	case "", PolicyRequired:
+		return PolicyRequired, nil
+	case PolicyBestEffort:
+		return PolicyBestEffort, nil
+	}
+	return "", fmt.Errorf("invalid sink policy: %q | use '%s' or '%s'", policy, PolicyRequired, PolicyBestEffort)
+}
+
+// drain writes the records queued for a best-effort sink until the queue is closed; the sink is closed afterwards.
+func (b *branch) drain() {
+	for record := range b.queue {
+		if b.discard.Load() {
+			b.dropped.Add(1)
+			continue
+		}
+		if _, err := b.Writer.Write(record); err != nil {
+			b.failed.Add(1)
+		}
+		// rotations are requested without blocking: they are applied as soon as the sink is done with its current record
+		if b.rotate.CompareAndSwap(true, false) {
+			b.Writer.Rotate()
+		}
+	}
+	if b.rotate.Load() {
+		b.Writer.Rotate()
+	}
+	b.done <- b.Writer.Close()
+}
+
+func (w *FanoutWriter) Write(p []byte) (int, error) {
+	if w.closed.Load() {
+		return 0, errClosed
+	}
+
+	var errs []error
+	var record []byte = nil
+	for _, b := range w.branches {
+		if b.Policy == PolicyRequired {
+			if _, err := b.Writer.Write(p); err != nil {
+				b.failed.Add(1)
+				errs = append(errs, fmt.Errorf("sink '%s': %w", b.Name, err))
+			}
+			continue
+		}
+		// writers may reuse `p` after `Write` returns: all best-effort sinks share the same copy
+		if record == nil {
+			record = append([]byte(nil), p...)
+		}
+		select {
+		case b.queue <- record:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+	if len(errs) > 0 {
+		return 0, errors.Join(errs...)
+	}
+	return len(p), nil
+}
+
+func (w *FanoutWriter) Rotate() {
+	for _, b := range w.branches {
+		if b.Writer.IsStdOutOrErr() {
+			continue
+		}
+		if b.Policy == PolicyRequired {
+			b.Writer.Rotate()
+		} else {
+			b.rotate.Store(true)
+		}
+	}
+}
+
+// Close closes all sinks: best-effort ones are given some time to write the records they hold.
+func (w *FanoutWriter) Close() error {
+	w.closeOnce.Do(func() {
+		w.closed.Store(true)
+		w.stop()
+
+		var errs []error
+		for _, b := range w.branches {
+			if b.Policy == PolicyRequired {
+				if err := b.Writer.Close(); err != nil {
+					errs = append(errs, fmt.Errorf("sink '%s': %w", b.Name, err))
+				}
+				continue
+			}
+			close(b.queue)
+		}
+
+		deadline := time.After(closeTimeout)
+		for _, b := range w.branches {
+			if b.Policy == PolicyRequired {
+				continue
+			}
+			select {
+			case err := <-b.done:
+				if err != nil {
+					errs = append(errs, fmt.Errorf("sink '%s': %w", b.Name, err))
+				}
+			case <-deadline:
+				// the deadline fires only once: all other sinks still writing are abandoned as well
+				deadline = closedDeadline
+				b.discard.Store(true)
+			}
+		}
+
+		w.report()
+		w.closeErr = errors.Join(errs...)
+	})
+	return w.closeErr
+}
+
+func (w *FanoutWriter) IsStdOutOrErr() bool {
+	for _, b := range w.branches {
+		if !b.Writer.IsStdOutOrErr() {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *FanoutWriter) GetIface() *string {
+	return w.iface
+}
+
+// Dropped returns the amount of records which were not written into sink `name` since the writer was created.
+func (w *FanoutWriter) Dropped(name string) uint64 {
+	for _, b := range w.branches {
+		if b.Name == name {
+			return b.dropped.Load()
+		}
+	}
+	return 0
+}
+
+func (w *FanoutWriter) report() {
+	if w.onDegraded == nil {
+		return
+	}
+	for _, b := range w.branches {
+		dropped, failed := b.dropped.Swap(0), b.failed.Swap(0)
+		if dropped > 0 || failed > 0 {
+			w.onDegraded(w.iface, b.Name, b.Policy, dropped, failed)
+		}
+	}
+}
+
+func (w *FanoutWriter) reportEvery(ctx context.Context) {
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.report()
+		}
+	}
+}
+
+// NewFanoutWriter writes every record into all `branches`, in their order; required sinks are written
+// before `Write` returns, while every best-effort sink is written by its own goroutine.
+func NewFanoutWriter(
+	ctx context.Context,
+	iface *string,
+	branches []*Branch,
+	onDegraded DegradedHandler,
+) *FanoutWriter {
+	ctx, stop := context.WithCancel(ctx)
+	w := &FanoutWriter{
+		iface:      iface,
+		branches:   make([]*branch, 0, len(branches)),
+		stop:       stop,
+		onDegraded: onDegraded,
+	}
+	for _, b := range branches {
+		fanoutBranch := &branch{Branch: b}
+		if b.Policy == PolicyBestEffort {
+			queue := b.Queue
+			if queue <= 0 {
+				queue = DefaultQueueSize
+			}
+			fanoutBranch.queue = make(chan []byte, queue)
+			fanoutBranch.done = make(chan error, 1)
+			go fanoutBranch.drain()
+		}
+		w.branches = append(w.branches, fanoutBranch)
+	}
+	go w.reportEvery(ctx)
+	return w
+}
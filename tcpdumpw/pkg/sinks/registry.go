@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sinks is the registry of the writers JSON translated packets may be written into; every sink is a self-contained
+// factory registered under a name, so that new sinks are selected in `json_sinks` without changing how tasks are created.
+package sinks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// Target describes the iface whose JSON translated packets are written into a sink.
+	Target struct {
+		// NetIface is the iface packets are captured from.
+		NetIface *net.Interface
+		// IfaceAndIndex identifies the iface in logs, i/e: `2/eth0`.
+		IfaceAndIndex string
+		// Output is the file name template of the iface, and Extension the one of JSON files.
+		Output    string
+		Extension string
+		// Timezone and Interval are used to name and rotate files.
+		Timezone string
+		Interval int
+	}
+
+	// WriterFactory creates the writer of a sink for every iface which is captured from.
+	WriterFactory interface {
+		New(ctx context.Context, target *Target) (pcap.PcapWriter, error)
+	}
+
+	// WriterFactoryFunc is a WriterFactory implemented by a function.
+	WriterFactoryFunc func(ctx context.Context, target *Target) (pcap.PcapWriter, error)
+
+	// Sink is a registered WriterFactory.
+	Sink struct {
+		Name string
+		// Aliases are alternative names of the sink, i/e: `gcs` for `file`.
+		Aliases []string
+		// Limited sinks are subject to the records per second limit, as they are not able to keep up with a busy iface.
+		Limited bool
+		Factory WriterFactory
+	}
+)
+
+var (
+	// ErrUnavailable is returned by factories of sinks which are selected but not configured.
+	ErrUnavailable = errors.New("sink is not available")
+	// ErrUnknown is returned when selecting a sink which was not registered.
+	ErrUnknown = errors.New("unknown sink")
+)
+
+var (
+	mu       sync.RWMutex
+	registry = []*Sink{}
+	names    = map[string]*Sink{}
+)
+
+func (f WriterFactoryFunc) New(ctx context.Context, target *Target) (pcap.PcapWriter, error) {
+	return f(ctx, target)
+}
+
+// Register makes `sink` available by its name and aliases; it panics if any of them is already taken,
+// as registration happens while initializing packages.
+func Register(sink *Sink) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if sink == nil || sink.Factory == nil {
+		panic("sinks: Register with nil factory")
+	}
+	for _, name := range append([]string{sink.Name}, sink.Aliases...) {
+		name = normalize(name)
+		if name == "" {
+			panic("sinks: Register with empty name")
+		}
+		if _, taken := names[name]; taken {
+			panic(fmt.Sprintf("sinks: Register called twice for sink: %s", name))
+		}
+		names[name] = sink
+	}
+	registry = append(registry, sink)
+}
+
+// Lookup returns the sink registered as `name`, which may be any of its aliases.
+func Lookup(name string) (*Sink, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if sink, ok := names[normalize(name)]; ok {
+		return sink, nil
+	}
+	return nil, fmt.Errorf("%w: %s | available: %s", ErrUnknown, name, strings.Join(namesLocked(), ", "))
+}
+
+// Sinks returns all the registered sinks, in the order they were registered;
+// writers of every iface are created in this order.
+func Sinks() []*Sink {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]*Sink(nil), registry...)
+}
+
+// Names returns the names of all the registered sinks, in the order they were registered.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return namesLocked()
+}
+
+func namesLocked() []string {
+	sinkNames := make([]string, 0, len(registry))
+	for _, sink := range registry {
+		sinkNames = append(sinkNames, sink.Name)
+	}
+	return sinkNames
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
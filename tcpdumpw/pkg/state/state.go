@@ -0,0 +1,287 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package state persists what `tcpdumpw` knows about its jobs and executions into a small file, so that it is
+// restored when the sidecar restarts: executions interrupted by the restart are reported, last-run information
+// remains accurate, and files which were not exported yet are attributed to the execution which wrote them.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type (
+	// Execution is a single execution of a job.
+	Execution struct {
+		ID      string    `json:"id"`
+		Job     string    `json:"job"`
+		Window  string    `json:"window,omitempty"`
+		Profile string    `json:"profile,omitempty"`
+		Status  string    `json:"status"`
+		Start   time.Time `json:"start"`
+		// End is `nil` while the execution is running.
+		End       *time.Time `json:"end,omitempty"`
+		Files     uint64     `json:"files,omitempty"`
+		FileBytes uint64     `json:"file_bytes,omitempty"`
+	}
+
+	// Job is what is known about a job across restarts; jobs are identified by name, as their IDs change on every start.
+	Job struct {
+		ID         string     `json:"id"`
+		Executions uint64     `json:"executions"`
+		Last       *Execution `json:"last,omitempty"`
+	}
+
+	// State is the content of the state file.
+	State struct {
+		Version int       `json:"version"`
+		Saved   time.Time `json:"saved"`
+		// Jobs by name.
+		Jobs map[string]*Job `json:"jobs"`
+		// Running are the executions which were in progress when the state was saved, by ID.
+		Running map[string]*Execution `json:"running,omitempty"`
+		// History are the last executions which ended, oldest first.
+		History []*Execution `json:"history,omitempty"`
+		// Pending are the files which were not exported yet, along with the ID of the execution which wrote them.
+		Pending map[string]string `json:"pending,omitempty"`
+	}
+
+	// Store keeps the state in memory and saves it into its file; it is safe for concurrent use.
+	Store struct {
+		path    string
+		history int
+		mu      sync.Mutex
+		state   *State
+	}
+)
+
+const (
+	version = 1
+	// StatusInterrupted is the status of executions which were running when `tcpdumpw` stopped without ending them.
+	StatusInterrupted = "interrupted"
+)
+
+// ErrVersion is returned when the state file was written by an incompatible version.
+var ErrVersion = errors.New("unsupported state version")
+
+func newState() *State {
+	return &State{
+		Version: version,
+		Jobs:    map[string]*Job{},
+		Running: map[string]*Execution{},
+		Pending: map[string]string{},
+	}
+}
+
+// Open loads the state saved into `path`; the store is empty if the file does not exist. If the file cannot be
+// parsed, the store is empty and the error is returned, so that a corrupted file never prevents captures.
+// At most `history` executions are kept.
+func Open(path string, history int) (*Store, error) {
+	store := &Store{path: path, history: history, state: newState()}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return store, err
+	}
+
+	loaded := newState()
+	if err := json.Unmarshal(data, loaded); err != nil {
+		return store, fmt.Errorf("invalid state file: %s | %w", path, err)
+	}
+	if loaded.Version != version {
+		return store, fmt.Errorf("%w: %d", ErrVersion, loaded.Version)
+	}
+	// maps are omitted when empty
+	if loaded.Jobs == nil {
+		loaded.Jobs = map[string]*Job{}
+	}
+	if loaded.Running == nil {
+		loaded.Running = map[string]*Execution{}
+	}
+	if loaded.Pending == nil {
+		loaded.Pending = map[string]string{}
+	}
+	store.state = loaded
+	return store, nil
+}
+
+// Path returns the file the state is saved into.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Snapshot returns a copy of the current state.
+func (s *Store) Snapshot() *State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the state only holds plain values: a round trip is the simplest deep copy
+	data, _ := json.Marshal(s.state)
+	snapshot := newState()
+	json.Unmarshal(data, snapshot)
+	return snapshot
+}
+
+// Job returns what is known about the job named `name`, or `nil` if it never ran or `s` is `nil`.
+func (s *Store) Job(name string) *Job {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.state.Jobs[name]
+	if !ok {
+		return nil
+	}
+	restored := *job
+	if job.Last != nil {
+		last := *job.Last
+		restored.Last = &last
+	}
+	return &restored
+}
+
+// Interrupted ends all the executions which were running when the state was saved, as they cannot be running anymore;
+// they are recorded as interrupted, and returned.
+func (s *Store) Interrupted(now time.Time) []*Execution {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	interrupted := make([]*Execution, 0, len(s.state.Running))
+	for id, execution := range s.state.Running {
+		delete(s.state.Running, id)
+		execution.Status = StatusInterrupted
+		execution.End = &now
+		s.endLocked(execution)
+		interrupted = append(interrupted, execution)
+	}
+	return interrupted
+}
+
+// Begin records that `execution` of the job `jobID` started.
+func (s *Store) Begin(jobID string, execution *Execution) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	started := *execution
+	s.state.Running[execution.ID] = &started
+	job := s.jobLocked(execution.Job)
+	job.ID = jobID
+}
+
+// End records that `execution` ended.
+func (s *Store) End(execution *Execution) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.state.Running, execution.ID)
+	ended := *execution
+	s.endLocked(&ended)
+}
+
+func (s *Store) endLocked(execution *Execution) {
+	job := s.jobLocked(execution.Job)
+	job.Executions += 1
+	last := *execution
+	job.Last = &last
+
+	s.state.History = append(s.state.History, execution)
+	if overflow := len(s.state.History) - s.history; overflow > 0 {
+		s.state.History = s.state.History[overflow:]
+	}
+}
+
+func (s *Store) jobLocked(name string) *Job {
+	job, ok := s.state.Jobs[name]
+	if !ok {
+		job = &Job{}
+		s.state.Jobs[name] = job
+	}
+	return job
+}
+
+// Executions returns the amount of executions of all jobs.
+func (s *Store) Executions() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	executions := uint64(0)
+	for _, job := range s.state.Jobs {
+		executions += job.Executions
+	}
+	return executions
+}
+
+// SetPending replaces the files which were not exported yet: files which are still pending keep the execution
+// they were attributed to, and new ones are attributed to `executionID`.
+func (s *Store) SetPending(paths []string, executionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := make(map[string]string, len(paths))
+	for _, path := range paths {
+		if owner, ok := s.state.Pending[path]; ok {
+			pending[path] = owner
+		} else {
+			pending[path] = executionID
+		}
+	}
+	s.state.Pending = pending
+}
+
+// Owner returns the ID of the execution which wrote the file at `path`, if it is pending and `s` is not `nil`.
+func (s *Store) Owner(path string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owner, ok := s.state.Pending[path]
+	return owner, ok
+}
+
+// Save writes the state into its file; the file is replaced atomically, so that it is never read partially.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	s.state.Saved = time.Now()
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o666); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// FileTracker observes the files written into a directory; files are moved out of it as soon as
+	// they are rotated, so it must be scanned often enough to see all of them.
+	FileTracker struct {
+		mu        sync.Mutex
+		directory string
+		baseline  map[string]int64
+		files     map[string]int64
+	}
+)
+
+func (t *FileTracker) scan() map[string]int64 {
+	files := make(map[string]int64)
+	entries, err := os.ReadDir(t.directory)
+	if err != nil {
+		return files
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			files[entry.Name()] = info.Size()
+		}
+	}
+	return files
+}
+
+// Scan records the current size of all files; files that are no longer available keep their last known size.
+func (t *FileTracker) Scan() {
+	files := t.scan()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for name, size := range files {
+		if size > t.files[name] {
+			t.files[name] = size
+		}
+	}
+}
+
+// Track scans the directory every `interval` until `ctx` is done.
+func (t *FileTracker) Track(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.Scan()
+			return
+		case <-ticker.C:
+			t.Scan()
+		}
+	}
+}
+
+// Summary returns the amount of files named `prefix*suffix` and the amount of bytes written
+// into them since the tracker was created; files that existed before are only accounted for their growth.
+func (t *FileTracker) Summary(prefix, suffix string) (uint64, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	files, bytes := uint64(0), uint64(0)
+	for name, size := range t.files {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		baseline, existed := t.baseline[name]
+		if !existed {
+			files += 1
+		}
+		if size > baseline {
+			bytes += uint64(size - baseline)
+		}
+	}
+	return files, bytes
+}
+
+// Files returns the names of the files named `prefix*suffix` which were created since the tracker was created.
+func (t *FileTracker) Files(prefix, suffix string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	files := []string{}
+	for name := range t.files {
+		if _, existed := t.baseline[name]; existed {
+			continue
+		}
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func NewFileTracker(directory string) *FileTracker {
+	t := &FileTracker{directory: directory}
+	t.baseline = t.scan()
+	t.files = make(map[string]int64, len(t.baseline))
+	for name, size := range t.baseline {
+		t.files[name] = size
+	}
+	return t
+}
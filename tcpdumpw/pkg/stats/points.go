@@ -0,0 +1,34 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+type (
+	// Point is a single value for a metric; `Name` is relative to the prefix used by each metrics backend.
+	Point struct {
+		Name   string
+		Labels map[string]string
+		Int64  *int64
+		Double *float64
+	}
+)
+
+func Int64Point(name string, labels map[string]string, value uint64) *Point {
+	v := int64(value)
+	return &Point{Name: name, Labels: labels, Int64: &v}
+}
+
+func DoublePoint(name string, labels map[string]string, value float64) *Point {
+	return &Point{Name: name, Labels: labels, Double: &value}
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"os"
+	"strings"
+)
+
+type (
+	// FileProgress tells whether the files named `<prefix>*<suffix>` in a directory are still being written;
+	// files are moved out of the directory as soon as they are rotated, so only new files and growth are considered.
+	FileProgress struct {
+		directory string
+		prefix    string
+		suffix    string
+		sizes     map[string]int64
+	}
+)
+
+func (p *FileProgress) scan() map[string]int64 {
+	sizes := make(map[string]int64)
+	entries, err := os.ReadDir(p.directory)
+	if err != nil {
+		return sizes
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, p.prefix) || !strings.HasSuffix(name, p.suffix) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			sizes[name] = info.Size()
+		}
+	}
+	return sizes
+}
+
+// Advanced returns `true` if a file was created or an existing one grew since the previous call.
+func (p *FileProgress) Advanced() bool {
+	sizes := p.scan()
+	advanced := false
+	for name, size := range sizes {
+		if previous, ok := p.sizes[name]; !ok || size > previous {
+			advanced = true
+			break
+		}
+	}
+	p.sizes = sizes
+	return advanced
+}
+
+func NewFileProgress(directory, prefix, suffix string) *FileProgress {
+	p := &FileProgress{directory: directory, prefix: prefix, suffix: suffix}
+	p.sizes = p.scan()
+	return p
+}
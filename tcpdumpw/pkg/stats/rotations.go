@@ -0,0 +1,67 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// FileRotations follows the file named `<prefix>*<suffix>` which is being written into a directory: the newest one,
+	// as file names start with the time when they were created.
+	FileRotations struct {
+		directory string
+		prefix    string
+		suffix    string
+		current   string
+		createdTS time.Time
+		size      int64
+	}
+)
+
+// Scan returns the file being written, how long ago it was created, and whether it grew since the previous call;
+// files are considered created when they are first seen. The name is empty if there are no files.
+func (r *FileRotations) Scan() (string, time.Duration, bool) {
+	entries, err := os.ReadDir(r.directory)
+	if err != nil {
+		return "", 0, false
+	}
+	current, size := "", int64(0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, r.prefix) || !strings.HasSuffix(name, r.suffix) || name < current {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			current, size = name, info.Size()
+		}
+	}
+
+	if current != r.current {
+		r.current, r.createdTS, r.size = current, time.Now(), size
+		return current, 0, false
+	}
+	grew := size > r.size
+	r.size = size
+	return current, time.Since(r.createdTS), grew
+}
+
+func NewFileRotations(directory, prefix, suffix string) *FileRotations {
+	r := &FileRotations{directory: directory, prefix: prefix, suffix: suffix}
+	r.Scan()
+	return r
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+type (
+	// Counters are updated by PCAP writers: every write is a translated packet.
+	Counters struct {
+		packets   atomic.Uint64
+		bytes     atomic.Uint64
+		rotations atomic.Uint64
+	}
+
+	CountersSnapshot struct {
+		Packets   uint64 `json:"packets"`
+		Bytes     uint64 `json:"bytes"`
+		Rotations uint64 `json:"rotations"`
+	}
+
+	// IfaceCounters are maintained by the kernel for every network interface;
+	// they account for all the traffic, not only for the packets that matched the filter.
+	IfaceCounters struct {
+		Packets uint64 `json:"packets"`
+		Bytes   uint64 `json:"bytes"`
+		Drops   uint64 `json:"drops"`
+	}
+
+	countingWriter struct {
+		pcap.PcapWriter
+		counters *Counters
+	}
+)
+
+const sysClassNet = "/sys/class/net"
+
+func (c *Counters) Snapshot() CountersSnapshot {
+	return CountersSnapshot{
+		Packets:   c.packets.Load(),
+		Bytes:     c.bytes.Load(),
+		Rotations: c.rotations.Load(),
+	}
+}
+
+func (c *Counters) AddRotation() {
+	c.rotations.Add(1)
+}
+
+// Sub returns the difference between `s` and a previous snapshot.
+func (s CountersSnapshot) Sub(previous CountersSnapshot) CountersSnapshot {
+	return CountersSnapshot{
+		Packets:   s.Packets - previous.Packets,
+		Bytes:     s.Bytes - previous.Bytes,
+		Rotations: s.Rotations - previous.Rotations,
+	}
+}
+
+// Sub returns the difference between `c` and a previous reading;
+// counters may be reset if the interface is re-created, so they never go below zero.
+func (c *IfaceCounters) Sub(previous *IfaceCounters) *IfaceCounters {
+	sub := func(current, previous uint64) uint64 {
+		if current < previous {
+			return current
+		}
+		return current - previous
+	}
+	return &IfaceCounters{
+		Packets: sub(c.Packets, previous.Packets),
+		Bytes:   sub(c.Bytes, previous.Bytes),
+		Drops:   sub(c.Drops, previous.Drops),
+	}
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.PcapWriter.Write(p)
+	w.counters.packets.Add(1)
+	w.counters.bytes.Add(uint64(n))
+	return n, err
+}
+
+func (w *countingWriter) Rotate() {
+	w.counters.AddRotation()
+	w.PcapWriter.Rotate()
+}
+
+// NewCountingWriter updates `counters` every time that a packet is written into `writer`.
+func NewCountingWriter(writer pcap.PcapWriter, counters *Counters) pcap.PcapWriter {
+	return &countingWriter{PcapWriter: writer, counters: counters}
+}
+
+func readSysClassNetCounter(iface, counter string) uint64 {
+	value, err := os.ReadFile(filepath.Join(sysClassNet, iface, "statistics", counter))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(strings.TrimSpace(string(value)), 10, 64)
+	return n
+}
+
+// ReadIfaceCounters reads counters for `iface` from `/sys/class/net/<iface>/statistics`.
+func ReadIfaceCounters(iface string) (*IfaceCounters, error) {
+	if _, err := os.Stat(filepath.Join(sysClassNet, iface, "statistics")); err != nil {
+		return nil, err
+	}
+	return &IfaceCounters{
+		Packets: readSysClassNetCounter(iface, "rx_packets") + readSysClassNetCounter(iface, "tx_packets"),
+		Bytes:   readSysClassNetCounter(iface, "rx_bytes") + readSysClassNetCounter(iface, "tx_bytes"),
+		Drops:   readSysClassNetCounter(iface, "rx_dropped") + readSysClassNetCounter(iface, "tx_dropped"),
+	}, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import "syscall"
+
+type (
+	// Usage describes the capacity of the filesystem which contains a directory.
+	Usage struct {
+		Total uint64 `json:"total"`
+		Free  uint64 `json:"free"`
+		Used  uint64 `json:"used"`
+	}
+)
+
+// DiskUsage returns the capacity of the filesystem which contains `directory`;
+// for in-memory volumes, `Total` is the size of the volume and not the instance memory.
+func DiskUsage(directory string) (*Usage, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(directory, &fs); err != nil {
+		return nil, err
+	}
+	blockSize := uint64(fs.Bsize)
+	total := fs.Blocks * blockSize
+	free := fs.Bavail * blockSize
+	return &Usage{
+		Total: total,
+		Free:  free,
+		Used:  total - (fs.Bfree * blockSize),
+	}, nil
+}
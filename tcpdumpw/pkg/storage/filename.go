@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/itchyny/timefmt-go"
+)
+
+const (
+	// MillisFileTimestamp is appended to file name templates to include milliseconds into the time when files are created;
+	// `strftime` has no directive for milliseconds: `%L` is only supported by `FormatFileName`.
+	MillisFileTimestamp = ".%L"
+	// SequenceFileName is appended to file name templates to include the sequence number of every file among the ones
+	// written out of the same template; `%Q` is only supported by `FormatFileName`.
+	SequenceFileName = "_%Q"
+)
+
+// sequences holds the last sequence number of every template; they are kept when writers and engines are re-created.
+var sequences sync.Map
+
+// NextSequence returns the sequence number of the next file written out of `template`, starting at 1.
+func NextSequence(template string) uint64 {
+	sequence, _ := sequences.LoadOrStore(template, new(atomic.Uint64))
+	return sequence.(*atomic.Uint64).Add(1)
+}
+
+// FormatFileName returns the name of the file created at `now` out of `template` ( `strftime` format ),
+// along with `%L` and `%Q`, which is replaced by `sequence`.
+func FormatFileName(now time.Time, template string, sequence uint64) string {
+	if strings.Contains(template, "%L") {
+		template = strings.ReplaceAll(template, "%L", fmt.Sprintf("%03d", now.Nanosecond()/int(time.Millisecond)))
+	}
+	if strings.Contains(template, "%Q") {
+		template = strings.ReplaceAll(template, "%Q", fmt.Sprintf("%06d", sequence))
+	}
+	return timefmt.Format(now, template)
+}
@@ -0,0 +1,258 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wissance/stringFormatter"
+)
+
+type (
+	// FuseFileHandler is notified every time a file is closed, which is when Cloud Storage FUSE uploads it.
+	FuseFileHandler func(path string, size int64, err error)
+
+	// FuseWriter writes files sequentially and never renames nor re-opens them:
+	// Cloud Storage FUSE uploads an object when its file is closed, and any other
+	// access pattern forces it to download and re-upload the whole object.
+	// It also batches writes into network filesystems, which are synced periodically.
+	FuseWriter struct {
+		mu        sync.Mutex
+		iface     *string
+		directory string
+		template  string
+		location  *time.Location
+		bufSize   int
+		file      *os.File
+		bw        *bufio.Writer
+		path      string
+		size      int64
+		closed    bool
+		onClose   FuseFileHandler
+	}
+)
+
+const (
+	DefaultFuseBufferSize = 4 * 1024 * 1024
+	fuseFileMode          = 0o666
+	// files created within the same second are told apart by a suffix, up to this amount
+	maxFuseNameSuffix = 1000
+)
+
+var ErrFuseWriterClosed = errors.New("writer is closed")
+
+func (w *FuseWriter) fileName(now time.Time, sequence uint64) string {
+	return filepath.Join(w.directory, FormatFileName(now.In(w.location), w.template, sequence))
+}
+
+func (w *FuseWriter) open() error {
+	sequence := NextSequence(filepath.Join(w.directory, w.template))
+	path := w.fileName(time.Now(), sequence)
+
+	// never truncate a file which was already uploaded within the same second: names which were already
+	// used get a numeric suffix instead, as waiting for the next second would block all writes meanwhile.
+	name, ext := strings.TrimSuffix(path, filepath.Ext(path)), filepath.Ext(path)
+	var file *os.File
+	err := fs.ErrExist
+	if path != w.path {
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fuseFileMode)
+	}
+	for suffix := 1; errors.Is(err, fs.ErrExist) && suffix <= maxFuseNameSuffix; suffix++ {
+		path = fmt.Sprintf("%s_%d%s", name, suffix, ext)
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fuseFileMode)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.bw = bufio.NewWriterSize(file, w.bufSize)
+	w.path = path
+	w.size = 0
+	return nil
+}
+
+func (w *FuseWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+
+	flushErr := w.bw.Flush()
+	// closing the file is what triggers the upload into Cloud Storage
+	closeErr := w.file.Close()
+	err := errors.Join(flushErr, closeErr)
+
+	if w.onClose != nil {
+		w.onClose(w.path, w.size, err)
+	}
+
+	w.file = nil
+	w.bw = nil
+	return err
+}
+
+// Write appends `p` into the current file; files are created lazily so that empty files are never uploaded.
+func (w *FuseWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrFuseWriterClosed
+	}
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.bw.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Sync writes the buffered data into the current file and flushes it into its filesystem.
+func (w *FuseWriter) Sync() error {
+	w.mu.Lock()
+	if w.file == nil {
+		w.mu.Unlock()
+		return nil
+	}
+	err := w.bw.Flush()
+	file := w.file
+	w.mu.Unlock()
+
+	// syncing may take long on network filesystems: writes are not blocked meanwhile, and closed files are already synced
+	if syncErr := file.Sync(); syncErr != nil && !errors.Is(syncErr, os.ErrClosed) {
+		err = errors.Join(err, syncErr)
+	}
+	return err
+}
+
+// SyncEvery syncs the current file every `interval` until `ctx` is done, so that files written into network filesystems
+// are readable by other clients before they are rotated; `onError` is notified of failures.
+func (w *FuseWriter) SyncEvery(ctx context.Context, interval time.Duration, onError func(error)) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := w.Sync(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// Rotate closes ( and so uploads ) the current file; the next write creates a new one.
+func (w *FuseWriter) Rotate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closeFile()
+}
+
+func (w *FuseWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	return w.closeFile()
+}
+
+func (w *FuseWriter) IsStdOutOrErr() bool {
+	return false
+}
+
+func (w *FuseWriter) GetIface() *string {
+	return w.iface
+}
+
+func (w *FuseWriter) rotateEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.Rotate()
+			return
+		case <-ticker.C:
+			w.Rotate()
+		}
+	}
+}
+
+// NewFuseWriter creates a writer for files named after `template.extension` ( `strftime` format ),
+// which are rotated every `interval` seconds and when `ctx` is done.
+func NewFuseWriter(
+	ctx context.Context,
+	iface, template, extension, timezone *string,
+	interval, bufSize int,
+	onClose FuseFileHandler,
+) (*FuseWriter, error) {
+	fileNameTemplate := stringFormatter.Format("{0}.{1}", *template, *extension)
+	directory := filepath.Dir(fileNameTemplate)
+
+	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	if bufSize <= 0 {
+		bufSize = DefaultFuseBufferSize
+	}
+
+	w := &FuseWriter{
+		iface:     iface,
+		directory: directory,
+		template:  filepath.Base(fileNameTemplate),
+		location:  location,
+		bufSize:   bufSize,
+		onClose:   onClose,
+	}
+
+	if interval > 0 {
+		go w.rotateEvery(ctx, time.Duration(interval)*time.Second)
+	} else {
+		go func() {
+			<-ctx.Done()
+			w.Rotate()
+		}()
+	}
+
+	return w, nil
+}
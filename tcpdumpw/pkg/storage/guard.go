@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// DiskState is the state of the directory where PCAP files are written.
+	DiskState string
+
+	// DiskGuard tracks whether writing PCAP files must be paused because a directory ran out of space;
+	// it pauses when less than `minFree` bytes are available or a write failed with `ENOSPC`,
+	// and it resumes once at least `resumeFree` bytes are available.
+	DiskGuard struct {
+		directory  string
+		minFree    uint64
+		resumeFree uint64
+		full       atomic.Bool
+
+		mu      sync.Mutex
+		state   DiskState
+		resumed chan struct{}
+	}
+
+	// DiskTransition describes a change of state.
+	DiskTransition struct {
+		From      DiskState `json:"from"`
+		To        DiskState `json:"to"`
+		Reason    string    `json:"reason"`
+		Free      uint64    `json:"free"`
+		Threshold uint64    `json:"threshold"`
+	}
+)
+
+const (
+	DiskWritable DiskState = "writable"
+	DiskPaused   DiskState = "paused"
+)
+
+// ReportFull records that a write failed because the directory ran out of space;
+// it is taken into account by the next call to `Check`.
+func (g *DiskGuard) ReportFull() {
+	g.full.Store(true)
+}
+
+func (g *DiskGuard) State() DiskState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.state
+}
+
+// Wait blocks while writing is paused; it returns the error of `ctx` if it is done first.
+func (g *DiskGuard) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
+
+// Check samples the free space of the directory, and returns the change of state if there is one.
+func (g *DiskGuard) Check() (*DiskTransition, error) {
+	usage, err := DiskUsage(g.directory)
+	if err != nil {
+		return nil, err
+	}
+	full := g.full.Swap(false)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case g.state == DiskWritable && (full || usage.Free < g.minFree):
+		reason := "free space below threshold"
+		if full {
+			reason = "no space left on device"
+		}
+		g.state = DiskPaused
+		g.resumed = make(chan struct{})
+		return &DiskTransition{From: DiskWritable, To: DiskPaused, Reason: reason, Free: usage.Free, Threshold: g.minFree}, nil
+
+	case g.state == DiskPaused && usage.Free >= g.resumeFree:
+		g.state = DiskWritable
+		close(g.resumed)
+		return &DiskTransition{From: DiskPaused, To: DiskWritable, Reason: "free space recovered", Free: usage.Free, Threshold: g.resumeFree}, nil
+	}
+	return nil, nil
+}
+
+func NewDiskGuard(directory string, minFree, resumeFree uint64) *DiskGuard {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &DiskGuard{
+		directory:  directory,
+		minFree:    minFree,
+		resumeFree: max(resumeFree, minFree),
+		state:      DiskWritable,
+		resumed:    resumed,
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	cgroupV2MemoryLimitFile = "/sys/fs/cgroup/memory.max"
+	cgroupV1MemoryLimitFile = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+	memInfoFile             = "/proc/meminfo"
+	memInfoTotal            = "MemTotal:"
+	// cgroup v1 reports an unlimited limit as the max page aligned int64
+	cgroupV1Unlimited = uint64(0x7FFFFFFFFFFFF000)
+)
+
+var errMemoryLimitNotFound = errors.New("memory limit not found")
+
+func readCgroupMemoryLimit(file string) (uint64, error) {
+	value, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+
+	limit := strings.TrimSpace(string(value))
+	if limit == "max" {
+		return 0, errMemoryLimitNotFound
+	}
+
+	bytes, err := strconv.ParseUint(limit, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if bytes >= cgroupV1Unlimited {
+		return 0, errMemoryLimitNotFound
+	}
+	return bytes, nil
+}
+
+// `/proc/meminfo` reports memory in KiB; i/e: `MemTotal:        2097152 kB`
+func readMemTotal() (uint64, error) {
+	memInfo, err := os.Open(memInfoFile)
+	if err != nil {
+		return 0, err
+	}
+	defer memInfo.Close()
+
+	scanner := bufio.NewScanner(memInfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != memInfoTotal {
+			continue
+		}
+		kib, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kib * 1024, nil
+	}
+	return 0, errMemoryLimitNotFound
+}
+
+// MemoryLimit returns the amount of bytes available to the instance: the cgroup limit
+// if there is one, or the total amount of memory otherwise ( this is the case for Cloud Run gen1 ).
+func MemoryLimit() (uint64, error) {
+	for _, file := range []string{cgroupV2MemoryLimitFile, cgroupV1MemoryLimitFile} {
+		if limit, err := readCgroupMemoryLimit(file); err == nil {
+			return limit, nil
+		}
+	}
+	return readMemTotal()
+}
+
+// DirectorySize returns the amount of bytes used by all regular files within `directory`.
+func DirectorySize(directory string) (uint64, error) {
+	size := uint64(0)
+	err := filepath.WalkDir(directory, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// files are moved out of the directory while it is being walked
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
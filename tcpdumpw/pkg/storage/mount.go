@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type (
+	Mount struct {
+		Point  string
+		FsType string
+		Source string
+	}
+)
+
+const (
+	mountInfoFile      = "/proc/self/mountinfo"
+	mountInfoSeparator = "-"
+	gcsFuseFsType      = "fuse.gcsfuse"
+	gcsFuseSource      = "gcsfuse"
+	tmpfsFsType        = "tmpfs"
+	ramfsFsType        = "ramfs"
+)
+
+// mount points in `mountinfo` escape spaces, tabs, new lines and backslashes as octal
+var mountInfoUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// IsGCSFuse returns `true` if the mount is served by Cloud Storage FUSE;
+// Cloud Run volumes report `fuse.gcsfuse`, while manual mounts may only report `fuse`.
+func (m *Mount) IsGCSFuse() bool {
+	if strings.EqualFold(m.FsType, gcsFuseFsType) {
+		return true
+	}
+	return strings.HasPrefix(m.FsType, "fuse") && strings.Contains(m.Source, gcsFuseSource)
+}
+
+// IsNetworkFs returns `true` if the mount is served over the network by NFS ( i/e: Filestore ) or SMB,
+// where every write and every metadata change is a round trip to the server.
+func (m *Mount) IsNetworkFs() bool {
+	fsType := strings.ToLower(m.FsType)
+	return fsType == "nfs" || fsType == "nfs4" || fsType == "cifs" || fsType == "smb3"
+}
+
+// IsMemoryBacked returns `true` if files written into the mount count against the container memory;
+// in Cloud Run, this is the case for in-memory volumes and for the container filesystem.
+func (m *Mount) IsMemoryBacked() bool {
+	return m.FsType == tmpfsFsType || m.FsType == ramfsFsType
+}
+
+func isSubPath(path, mountPoint string) bool {
+	if mountPoint == "/" || path == mountPoint {
+		return true
+	}
+	return strings.HasPrefix(path, mountPoint+string(filepath.Separator))
+}
+
+// see: https://man7.org/linux/man-pages/man5/proc_pid_mountinfo.5.html
+func parseMountInfo(line string) (*Mount, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 10 {
+		return nil, false
+	}
+	for i := 6; i < len(fields)-2; i++ {
+		if fields[i] == mountInfoSeparator {
+			return &Mount{
+				Point:  mountInfoUnescaper.Replace(fields[4]),
+				FsType: fields[i+1],
+				Source: fields[i+2],
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// FindMount returns the mount which contains `directory`: the one with the longest mount point.
+func FindMount(directory string) (*Mount, error) {
+	path, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	mountInfo, err := os.Open(mountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer mountInfo.Close()
+
+	var mount *Mount
+	scanner := bufio.NewScanner(mountInfo)
+	for scanner.Scan() {
+		m, ok := parseMountInfo(scanner.Text())
+		if !ok || !isSubPath(path, m.Point) {
+			continue
+		}
+		if mount == nil || len(m.Point) >= len(mount.Point) {
+			mount = m
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if mount == nil {
+		return nil, os.ErrNotExist
+	}
+	return mount, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+type (
+	// Repair describes a file which was left behind by an engine that did not close it.
+	Repair struct {
+		Path      string `json:"path"`
+		Bytes     int64  `json:"bytes"`
+		Truncated int64  `json:"truncated"`
+		Records   uint64 `json:"records"`
+	}
+)
+
+// see: https://wiki.wireshark.org/Development/LibpcapFileFormat
+const (
+	pcapMagicMicros uint32 = 0xA1B2C3D4
+	pcapMagicNanos  uint32 = 0xA1B23C4D
+	// pcapng files are made of blocks which are not repaired
+	pcapngMagic uint32 = 0x0A0D0D0A
+
+	pcapGlobalHeaderSize = 24
+	pcapRecordHeaderSize = 16
+	// no valid record is larger than the max snaplen; larger lengths are garbage
+	maxPcapRecordSize = 262144
+)
+
+func isPcapMagic(magic []byte) (binary.ByteOrder, bool) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if m := order.Uint32(magic); m == pcapMagicMicros || m == pcapMagicNanos {
+			return order, true
+		}
+	}
+	return nil, false
+}
+
+// validPcapLength returns the length of the PCAP file up to its last complete record.
+func validPcapLength(reader *bufio.Reader, order binary.ByteOrder, size int64) (int64, uint64, error) {
+	if size < pcapGlobalHeaderSize {
+		return 0, 0, nil
+	}
+	if _, err := reader.Discard(pcapGlobalHeaderSize); err != nil {
+		return 0, 0, err
+	}
+
+	valid := int64(pcapGlobalHeaderSize)
+	records := uint64(0)
+	header := make([]byte, pcapRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return valid, records, nil
+			}
+			return valid, records, err
+		}
+		capLen := int64(order.Uint32(header[8:12]))
+		if capLen > maxPcapRecordSize || valid+pcapRecordHeaderSize+capLen > size {
+			return valid, records, nil
+		}
+		if _, err := reader.Discard(int(capLen)); err != nil {
+			return valid, records, nil
+		}
+		valid += pcapRecordHeaderSize + capLen
+		records++
+	}
+}
+
+// validJSONLength returns the length of the JSON lines file up to its last complete line.
+func validJSONLength(reader *bufio.Reader) (int64, uint64, error) {
+	valid := int64(0)
+	read := int64(0)
+	records := uint64(0)
+	for {
+		line, err := reader.ReadSlice('\n')
+		read += int64(len(line))
+		if err == nil {
+			valid = read
+			if len(bytes.TrimSpace(line)) > 0 {
+				records++
+			}
+			continue
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return valid, records, nil
+		}
+		return valid, records, err
+	}
+}
+
+// RepairFile truncates the PCAP or JSON lines file at `path` right after its last complete record;
+// files are written sequentially, so an engine which did not close them may leave a partial record behind.
+func RepairFile(path string) (*Repair, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	repair := &Repair{Path: path, Bytes: size}
+
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	var valid int64
+	if magic, peekErr := reader.Peek(4); peekErr != nil {
+		// files shorter than a magic number contain no records
+		valid = 0
+	} else if binary.BigEndian.Uint32(magic) == pcapngMagic {
+		valid = size
+	} else if order, ok := isPcapMagic(magic); ok {
+		valid, repair.Records, err = validPcapLength(reader, order, size)
+	} else {
+		valid, repair.Records, err = validJSONLength(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if valid < size {
+		if err := file.Truncate(valid); err != nil {
+			return nil, err
+		}
+		repair.Truncated = size - valid
+		repair.Bytes = valid
+	}
+	return repair, file.Sync()
+}
@@ -0,0 +1,214 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type (
+	// Spill describes a file moved from the fast directory into the slow one.
+	Spill struct {
+		Source  string        `json:"source"`
+		Target  string        `json:"target"`
+		Bytes   int64         `json:"bytes"`
+		Latency time.Duration `json:"latency"`
+		Err     error         `json:"-"`
+	}
+
+	// SpillHandler is notified every time a file is spilled, or fails to be.
+	SpillHandler func(spill *Spill)
+
+	// Spiller moves the files rotated in a fast directory ( i/e: an in-memory volume ) into a slower one
+	// ( i/e: a persistent volume or a Cloud Storage FUSE mount ) in the background, one at a time,
+	// so that writing packets never waits for the slow directory. Files keep their path relative to
+	// the fast directory; files which failed to be spilled are left in place so they may be spilled again
+	// after `spillRetryDelay`.
+	Spiller struct {
+		hot       string
+		cold      string
+		onSpilled SpillHandler
+
+		mu      sync.Mutex
+		pending map[string]struct{}
+		failed  map[string]time.Time
+		closed  bool
+		queue   chan string
+		done    chan struct{}
+	}
+)
+
+const (
+	DefaultSpillQueueSize = 4096
+	spillBufferSize       = 1024 * 1024
+	spillRetryDelay       = 30 * time.Second
+)
+
+// Spill queues `path` to be moved into the slow directory; it returns `false` if `path` is not in the fast directory,
+// if it is already queued, if it failed to be spilled less than `spillRetryDelay` ago, or if the queue is full or closed.
+func (s *Spiller) Spill(path string) bool {
+	if _, err := s.target(path); err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, queued := s.pending[path]; queued || s.closed {
+		return false
+	}
+	if failedTS, failed := s.failed[path]; failed && time.Since(failedTS) < spillRetryDelay {
+		return false
+	}
+	select {
+	case s.queue <- path:
+		s.pending[path] = struct{}{}
+		return true
+	default:
+		return false
+	}
+}
+
+// Pending returns the amount of files queued to be spilled.
+func (s *Spiller) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Close stops accepting files, and waits until all the queued ones are spilled.
+func (s *Spiller) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+func (s *Spiller) target(path string) (string, error) {
+	rel, err := filepath.Rel(s.hot, path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsLocal(rel) {
+		return "", errors.New("file is not in the spilled directory: " + path)
+	}
+	return filepath.Join(s.cold, rel), nil
+}
+
+func (s *Spiller) run() {
+	defer close(s.done)
+
+	for path := range s.queue {
+		spill := &Spill{Source: path}
+		startTS := time.Now()
+		spill.Target, spill.Err = s.target(path)
+		if spill.Err == nil {
+			spill.Bytes, spill.Err = MoveFile(path, spill.Target)
+		}
+		spill.Latency = time.Since(startTS)
+
+		s.mu.Lock()
+		delete(s.pending, path)
+		if spill.Err != nil {
+			s.failed[path] = time.Now()
+		} else {
+			delete(s.failed, path)
+		}
+		s.mu.Unlock()
+
+		if s.onSpilled != nil {
+			s.onSpilled(spill)
+		}
+	}
+}
+
+// MoveFile moves `source` into `target`, creating its directory if needed; files are renamed if both are in
+// the same filesystem, otherwise `source` is copied sequentially using large buffers, synced, and removed.
+// It returns the amount of bytes moved; `target` is removed if copying fails, while `source` is left in place.
+func MoveFile(source, target string) (int64, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	err = os.Rename(source, target)
+	if err == nil {
+		return info.Size(), nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return 0, err
+	}
+
+	bytes, err := copyFile(source, target)
+	if err != nil {
+		os.Remove(target)
+		return bytes, err
+	}
+	return bytes, os.Remove(source)
+}
+
+func copyFile(source, target string) (int64, error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	// files are written sequentially and never renamed: Cloud Storage FUSE uploads them as soon as they are closed
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fuseFileMode)
+	if err != nil {
+		return 0, err
+	}
+
+	// hiding `ReadFrom` forces writes of `spillBufferSize` bytes instead of letting the kernel pick their size
+	bytes, err := io.CopyBuffer(struct{ io.Writer }{dst}, src, make([]byte, spillBufferSize))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return bytes, err
+}
+
+// NewSpiller starts moving the files queued by `Spill` from `hot` into `cold`; `onSpilled` may be `nil`.
+func NewSpiller(hot, cold string, queueSize int, onSpilled SpillHandler) *Spiller {
+	if queueSize <= 0 {
+		queueSize = DefaultSpillQueueSize
+	}
+	s := &Spiller{
+		hot:       filepath.Clean(hot),
+		cold:      filepath.Clean(cold),
+		onSpilled: onSpilled,
+		pending:   make(map[string]struct{}),
+		failed:    make(map[string]time.Time),
+		queue:     make(chan string, queueSize),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
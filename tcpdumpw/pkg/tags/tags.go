@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tags
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Tags are user defined `key=value` pairs stamped onto all the artifacts of a capture;
+// as a `flag.Value`, the flag may be repeated and every value may hold several comma separated pairs.
+type Tags struct {
+	values map[string]string
+}
+
+const (
+	maxTags        = 32
+	maxValueLength = 63
+)
+
+// keys are used as Cloud Logging labels: they must be valid label keys.
+var keyRegex = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+
+func (t *Tags) String() string {
+	if t == nil {
+		return ""
+	}
+	return strings.Join(t.List(), ",")
+}
+
+// Set adds the comma separated pairs in `value`; keys which were already set are overwritten.
+func (t *Tags) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return fmt.Errorf("invalid tag: %q | use 'key=value'", pair)
+		}
+		if !keyRegex.MatchString(key) {
+			return fmt.Errorf("invalid tag key: %q | use up to 63 lowercase letters, digits, dashes and underscores starting with a letter", key)
+		}
+		if len(value) > maxValueLength || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value of tag '%s': %q | use up to %d characters in a single line", key, value, maxValueLength)
+		}
+		if t.values == nil {
+			t.values = map[string]string{}
+		}
+		t.values[key] = value
+	}
+	if len(t.values) > maxTags {
+		return fmt.Errorf("too many tags: %d | up to %d are allowed", len(t.values), maxTags)
+	}
+	return nil
+}
+
+func (t *Tags) Len() int {
+	return len(t.values)
+}
+
+// Map returns a copy of all tags; `nil` if there are none.
+func (t *Tags) Map() map[string]string {
+	if len(t.values) == 0 {
+		return nil
+	}
+	return maps.Clone(t.values)
+}
+
+// List returns all tags as `key=value` sorted by key.
+func (t *Tags) List() []string {
+	keys := make([]string, 0, len(t.values))
+	for key := range t.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+t.values[key])
+	}
+	return pairs
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testkit provides engines and clocks which allow to exercise scheduling, rotation, export and shutdown
+// end-to-end without root privileges nor real ifaces: packets are emitted from a script instead of being captured,
+// and time may be controlled by tests instead of flowing.
+package testkit
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+type (
+	// Clock is the source of time of the scheduler and of scripted engines.
+	Clock = clockwork.Clock
+	// FakeClock is a Clock which only moves forward when it is advanced; timers and tickers created from it fire
+	// as soon as it is advanced beyond their deadline.
+	FakeClock = clockwork.FakeClock
+)
+
+// NewRealClock returns the clock used unless tests inject another one; it is backed by the `time` package.
+func NewRealClock() Clock {
+	return clockwork.NewRealClock()
+}
+
+// NewFakeClock returns a clock which starts at `start`, or at the current time if it is zero.
+func NewFakeClock(start time.Time) FakeClock {
+	if start.IsZero() {
+		return clockwork.NewFakeClock()
+	}
+	return clockwork.NewFakeClockAt(start)
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testkit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gchux/cloud-run-tcpdump/tcpdumpw/pkg/replay"
+	"github.com/gchux/pcap-cli/pkg/pcap"
+)
+
+// Engine emits the packets of a script through the same translation into JSON used for live captures, so that
+// all writers and analyzers are fed as if packets were being captured; time between packets is measured by
+// its clock, so that tests using a fake one control when packets are emitted. Once all packets were emitted,
+// it keeps waiting for `ctx` to be done, as live engines do, and `Done` is closed.
+type Engine struct {
+	config   *pcap.PcapConfig
+	script   *Script
+	clock    Clock
+	isActive atomic.Bool
+
+	packets atomic.Uint64
+	done    chan struct{}
+	// closing `done` only once allows engines to be restarted
+	isDone atomic.Bool
+}
+
+// Iface is the name of the iface scripted packets are translated as being captured from.
+const Iface = "mock"
+
+var errAlreadyStarted = errors.New("already started")
+
+func (e *Engine) IsActive() bool {
+	return e.isActive.Load()
+}
+
+// Done is closed once all packets of the script were emitted and their translations written for the 1st time;
+// it is never closed for scripts which loop.
+func (e *Engine) Done() <-chan struct{} {
+	return e.done
+}
+
+// Err always returns `nil`: scripts are validated when loaded.
+func (e *Engine) Err() error {
+	return nil
+}
+
+// Packets returns the amount of packets emitted.
+func (e *Engine) Packets() uint64 {
+	return e.packets.Load()
+}
+
+// emit emits all packets of the script once; it returns `false` if `ctx` was done before all of them were emitted.
+func (e *Engine) emit(ctx context.Context, apply func(*Packet) error) bool {
+	for _, packet := range e.script.Packets {
+		for i := 0; i < packet.Repeat; i++ {
+			if delay := packet.after(); delay > 0 {
+				select {
+				case <-ctx.Done():
+					return false
+				case <-e.clock.After(delay):
+				}
+			}
+			if err := apply(packet); err != nil && ctx.Err() != nil {
+				return false
+			}
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// Start emits the packets of the script; every time the engine is started, it emits them again from the 1st one.
+// It returns the error of `ctx` once it is done.
+func (e *Engine) Start(
+	ctx context.Context,
+	writers []pcap.PcapWriter,
+	stopDeadline <-chan *time.Duration,
+) error {
+	if !e.isActive.CompareAndSwap(false, true) {
+		return errAlreadyStarted
+	}
+	defer e.isActive.Store(false)
+
+	fn, flush, err := replay.NewTransformer(ctx, e.config, Iface, writers)
+	if err != nil {
+		return err
+	}
+
+	apply := func(p *Packet) error {
+		packet := p.decode(e.clock.Now())
+		serial := e.packets.Add(1)
+		return fn.Apply(ctx, &packet, &serial)
+	}
+
+	for e.emit(ctx, apply) {
+		if !e.script.Loop {
+			break
+		}
+	}
+
+	if ctx.Err() == nil {
+		flush(ctx, e.packets.Load())
+		if e.isDone.CompareAndSwap(false, true) {
+			close(e.done)
+		}
+		<-ctx.Done()
+	}
+
+	deadline := <-stopDeadline
+	if deadline == nil {
+		deadline = new(time.Duration)
+	}
+	fn.WaitDone(ctx, deadline)
+	return ctx.Err()
+}
+
+// NewEngine creates an engine which emits the packets of `script` translated as `config` requires;
+// time between packets is measured by `clock`.
+func NewEngine(config *pcap.PcapConfig, script *Script, clock Clock) *Engine {
+	if config.Ephemerals == nil {
+		config.Ephemerals = &pcap.PcapEmphemeralPorts{Min: pcap.PCAP_MIN_EPHEMERAL_PORT, Max: pcap.PCAP_MAX_EPHEMERAL_PORT}
+	}
+	return &Engine{
+		config: config,
+		script: script,
+		clock:  clock,
+		done:   make(chan struct{}),
+	}
+}
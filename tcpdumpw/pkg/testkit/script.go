@@ -0,0 +1,238 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type (
+	// Packet is a scripted packet; addresses are `ip:port` for TCP and UDP, and just `ip` for ICMP.
+	Packet struct {
+		// milliseconds since the previous packet was emitted, or since the engine started for the 1st one
+		AfterMs int    `json:"after_ms,omitempty"`
+		Proto   string `json:"proto"`
+		Src     string `json:"src"`
+		Dst     string `json:"dst"`
+		// comma separated TCP flags: `SYN`, `ACK`, `PSH`, `FIN`, `RST` and `URG`
+		Flags   string `json:"flags,omitempty"`
+		Seq     uint32 `json:"seq,omitempty"`
+		Ack     uint32 `json:"ack,omitempty"`
+		Payload string `json:"payload,omitempty"`
+		// times the packet is emitted, every one of them `after_ms` after the previous one
+		Repeat int `json:"repeat,omitempty"`
+
+		data []byte
+	}
+
+	// Script is the sequence of packets emitted by an `Engine`.
+	Script struct {
+		Packets []*Packet `json:"packets"`
+		// scripts which loop emit their packets again and again until the engine is stopped
+		Loop bool `json:"loop,omitempty"`
+	}
+)
+
+const MaxRepeat = 1_000_000
+
+var (
+	srcMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	dstMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+
+	serializeOptions = gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+)
+
+// LoadScript parses `spec`, which is either a JSON script or the path of a file containing it;
+// all packets are built while loading, so that invalid ones are reported before emitting any.
+func LoadScript(spec string) (*Script, error) {
+	data := []byte(strings.TrimSpace(spec))
+	if !bytes.HasPrefix(data, []byte("{")) {
+		var err error
+		if data, err = os.ReadFile(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	script := &Script{}
+	if err := decoder.Decode(script); err != nil {
+		return nil, fmt.Errorf("invalid script: %w", err)
+	}
+	if len(script.Packets) == 0 {
+		return nil, errors.New("no packets defined")
+	}
+
+	var errs []error
+	var delay time.Duration
+	for index, packet := range script.Packets {
+		if packet.Repeat == 0 {
+			packet.Repeat = 1
+		}
+		if err := packet.build(); err != nil {
+			errs = append(errs, fmt.Errorf("packet %d: %w", index, err))
+		}
+		delay += packet.after()
+	}
+	// a script which loops without delays would emit packets as fast as they can be translated forever
+	if script.Loop && delay <= 0 {
+		errs = append(errs, errors.New("scripts which loop require at least one packet with 'after_ms'"))
+	}
+	return script, errors.Join(errs...)
+}
+
+func (p *Packet) after() time.Duration {
+	return time.Duration(p.AfterMs) * time.Millisecond
+}
+
+func parseTCPFlags(tcp *layers.TCP, flags string) error {
+	for _, flag := range strings.Split(flags, ",") {
+		switch strings.ToUpper(strings.TrimSpace(flag)) {
+		case "":
+		case "SYN":
+			tcp.SYN = true
+		case "ACK":
+			tcp.ACK = true
+		case "PSH":
+			tcp.PSH = true
+		case "FIN":
+			tcp.FIN = true
+		case "RST":
+			tcp.RST = true
+		case "URG":
+			tcp.URG = true
+		default:
+			return fmt.Errorf("invalid TCP flag: %q", flag)
+		}
+	}
+	return nil
+}
+
+// addrs parses the source and destination of `p`; ports are only parsed if `withPorts` is enabled.
+func (p *Packet) addrs(withPorts bool) (src, dst netip.AddrPort, err error) {
+	if withPorts {
+		if src, err = netip.ParseAddrPort(p.Src); err != nil {
+			return src, dst, fmt.Errorf("invalid 'src': %w", err)
+		}
+		if dst, err = netip.ParseAddrPort(p.Dst); err != nil {
+			return src, dst, fmt.Errorf("invalid 'dst': %w", err)
+		}
+	} else {
+		srcAddr, srcErr := netip.ParseAddr(p.Src)
+		if srcErr != nil {
+			return src, dst, fmt.Errorf("invalid 'src': %w", srcErr)
+		}
+		dstAddr, dstErr := netip.ParseAddr(p.Dst)
+		if dstErr != nil {
+			return src, dst, fmt.Errorf("invalid 'dst': %w", dstErr)
+		}
+		src, dst = netip.AddrPortFrom(srcAddr, 0), netip.AddrPortFrom(dstAddr, 0)
+	}
+	if src.Addr().Is4() != dst.Addr().Is4() {
+		return src, dst, fmt.Errorf("'src' and 'dst' must be of the same IP version: %s => %s", p.Src, p.Dst)
+	}
+	return src, dst, nil
+}
+
+// build serializes `p` into an ethernet frame.
+func (p *Packet) build() error {
+	if p.AfterMs < 0 {
+		return fmt.Errorf("'after_ms' must not be negative: %d", p.AfterMs)
+	}
+	if p.Repeat < 1 || p.Repeat > MaxRepeat {
+		return fmt.Errorf("'repeat' must be between 1 and %d: %d", MaxRepeat, p.Repeat)
+	}
+
+	proto := strings.ToLower(p.Proto)
+	if proto != "tcp" && proto != "udp" && proto != "icmp" {
+		return fmt.Errorf("invalid 'proto': %q | use 'tcp', 'udp' or 'icmp'", p.Proto)
+	}
+	if p.Flags != "" && proto != "tcp" {
+		return fmt.Errorf("'flags' are only available for TCP: %s", p.Proto)
+	}
+
+	src, dst, err := p.addrs(proto != "icmp")
+	if err != nil {
+		return err
+	}
+	isIPv4 := src.Addr().Is4()
+
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, SrcIP: src.Addr().AsSlice(), DstIP: dst.Addr().AsSlice()}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, SrcIP: src.Addr().AsSlice(), DstIP: dst.Addr().AsSlice()}
+	var network gopacket.NetworkLayer = ip4
+	var networkLayer gopacket.SerializableLayer = ip4
+	if !isIPv4 {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		network, networkLayer = ip6, ip6
+	}
+
+	var transport gopacket.SerializableLayer
+	switch proto {
+	case "tcp":
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(src.Port()), DstPort: layers.TCPPort(dst.Port()), Seq: p.Seq, Ack: p.Ack, Window: 65535}
+		if err := parseTCPFlags(tcp, p.Flags); err != nil {
+			return err
+		}
+		tcp.SetNetworkLayerForChecksum(network)
+		ip4.Protocol, ip6.NextHeader = layers.IPProtocolTCP, layers.IPProtocolTCP
+		transport = tcp
+	case "udp":
+		udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port()), DstPort: layers.UDPPort(dst.Port())}
+		udp.SetNetworkLayerForChecksum(network)
+		ip4.Protocol, ip6.NextHeader = layers.IPProtocolUDP, layers.IPProtocolUDP
+		transport = udp
+	default:
+		if isIPv4 {
+			ip4.Protocol = layers.IPProtocolICMPv4
+			transport = &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)}
+		} else {
+			icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+			icmp.SetNetworkLayerForChecksum(network)
+			ip6.NextHeader = layers.IPProtocolICMPv6
+			transport = icmp
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, serializeOptions,
+		eth, networkLayer, transport, gopacket.Payload([]byte(p.Payload))); err != nil {
+		return fmt.Errorf("failed to build packet: %w", err)
+	}
+	p.data = buffer.Bytes()
+	return nil
+}
+
+// decode returns a new instance of `p` captured at `ts`.
+func (p *Packet) decode(ts time.Time) gopacket.Packet {
+	packet := gopacket.NewPacket(p.data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, DecodeStreamsAsDatagrams: true})
+	metadata := packet.Metadata()
+	metadata.Timestamp = ts
+	metadata.CaptureLength = len(p.data)
+	metadata.Length = len(p.data)
+	return packet
+}
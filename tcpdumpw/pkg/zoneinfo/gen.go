@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build ignore
+
+// gen.go writes `zones.go` with the names of the zones embedded by `time/tzdata`;
+// the embedded database cannot be listed at runtime, and container images may not ship `/usr/share/zoneinfo`.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+func main() {
+	archive, err := zip.OpenReader(filepath.Join(runtime.GOROOT(), "lib", "time", "zoneinfo.zip"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer archive.Close()
+
+	names := []string{}
+	for _, file := range archive.File {
+		if !strings.HasSuffix(file.Name, "/") {
+			names = append(names, file.Name)
+		}
+	}
+	slices.Sort(names)
+
+	license, err := os.ReadFile("gen.go")
+	if err != nil {
+		log.Fatal(err)
+	}
+	header, _, _ := strings.Cut(string(license), "//go:build")
+
+	var src bytes.Buffer
+	src.WriteString(header)
+	src.WriteString("// Code generated by gen.go; DO NOT EDIT.\n\npackage zoneinfo\n\n")
+	src.WriteString("// zones are the names of the zones embedded by `time/tzdata`.\n")
+	src.WriteString("var zones = []string{\n")
+	for _, name := range names {
+		fmt.Fprintf(&src, "\t%q,\n", name)
+	}
+	src.WriteString("}\n")
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("zones.go", formatted, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
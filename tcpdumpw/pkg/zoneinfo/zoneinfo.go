@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoneinfo
+
+//go:generate go run gen.go
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxSuggestions is the max amount of similar zones reported when a zone cannot be loaded.
+const maxSuggestions = 5
+
+// List returns the names of the available zones which start with `prefix`, case insensitive; i/e: `America/`.
+func List(prefix string) []string {
+	prefix = strings.ToLower(prefix)
+	names := []string{}
+	for _, name := range zones {
+		if strings.HasPrefix(strings.ToLower(name), prefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// suggest returns the zones whose name contains the last element of `name`, case insensitive;
+// i/e: `america/bogota` and `Bogota` both suggest `America/Bogota`.
+func suggest(name string) []string {
+	city := strings.ToLower(name[strings.LastIndex(name, "/")+1:])
+	if city == "" {
+		return nil
+	}
+	suggestions := []string{}
+	for _, zone := range zones {
+		if strings.Contains(strings.ToLower(zone), city) {
+			suggestions = append(suggestions, zone)
+		}
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+	}
+	return suggestions
+}
+
+// Load returns the location for the zone `name`; when it is not available, the error includes similar zones.
+func Load(name string) (*time.Location, error) {
+	location, err := time.LoadLocation(name)
+	if err == nil {
+		return location, nil
+	}
+	if suggestions := suggest(name); len(suggestions) > 0 && !slices.Contains(suggestions, name) {
+		return nil, fmt.Errorf("%w | did you mean: %s", err, strings.Join(suggestions, ", "))
+	}
+	return nil, err
+}